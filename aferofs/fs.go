@@ -0,0 +1,524 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package aferofs implements an afero.Fs on top of an encrypted storage, so
+// that applications that use afero can store their files encrypted.
+//
+// The files are decrypted transparently when they are read. New files are
+// created as paged blob files, see storage.BlobFile, which support
+// random-access reads and writes. Other files, e.g. data files, can be read
+// and replaced, but they can't be modified in place.
+package aferofs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/c2FmZQ/storage"
+)
+
+var _ afero.Fs = (*Fs)(nil)
+
+// ErrNotWritable is returned when a file that isn't a paged blob file is
+// opened for writing without os.O_TRUNC.
+var ErrNotWritable = errors.New("only paged blob files can be modified in place")
+
+// New returns a new afero.Fs that stores its files in s.
+func New(s *storage.Storage) *Fs {
+	return &Fs{s: s, fsys: s.FS()}
+}
+
+// Fs implements afero.Fs.
+type Fs struct {
+	s    *storage.Storage
+	fsys *storage.FS
+}
+
+// clean converts an afero name to a slash-separated name relative to the
+// root of the storage.
+func clean(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// Name returns the name of this filesystem.
+func (*Fs) Name() string {
+	return "storage"
+}
+
+// Create creates a file, or truncates it if it already exists.
+func (f *Fs) Create(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+}
+
+// Mkdir creates a directory. Its parent must exist.
+func (f *Fs) Mkdir(name string, perm os.FileMode) error {
+	n := clean(name)
+	if _, err := f.fsys.Stat(n); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if fi, err := f.fsys.Stat(path.Dir(n)); err != nil || !fi.IsDir() {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return f.s.MkdirAll(filepath.FromSlash(n))
+}
+
+// MkdirAll creates a directory, along with any necessary parents.
+func (f *Fs) MkdirAll(name string, perm os.FileMode) error {
+	return f.s.MkdirAll(filepath.FromSlash(clean(name)))
+}
+
+// Open opens a file for reading.
+func (f *Fs) Open(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a file with the given flags. The permissions are ignored.
+func (f *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	n := clean(name)
+	fi, err := f.fsys.Stat(n)
+	exists := err == nil
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		if !exists {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		ff, err := f.fsys.Open(n)
+		if err != nil {
+			return nil, err
+		}
+		return &readFile{name: name, fs: f, path: n, f: ff}, nil
+	}
+
+	switch {
+	case exists && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case exists && fi.IsDir():
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !exists:
+		if fi, err := f.fsys.Stat(path.Dir(n)); err != nil || !fi.IsDir() {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+	case flag&os.O_TRUNC != 0:
+		// Replace the file with a new paged blob file.
+		if err := f.s.DeleteFile(filepath.FromSlash(n)); err != nil {
+			return nil, err
+		}
+	}
+	bf, err := f.s.OpenBlobFile(filepath.FromSlash(n))
+	if err != nil {
+		if exists {
+			err = fmt.Errorf("%w: %v", ErrNotWritable, err)
+		}
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &writeFile{name: name, fs: f, path: n, bf: bf, flag: flag}, nil
+}
+
+// Remove removes a file or an empty directory.
+func (f *Fs) Remove(name string) error {
+	return f.s.DeleteFile(filepath.FromSlash(clean(name)))
+}
+
+// RemoveAll removes a file or a directory and everything it contains. It
+// returns nil if the file doesn't exist.
+func (f *Fs) RemoveAll(name string) error {
+	n := clean(name)
+	if _, err := f.fsys.Stat(n); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	var files []string
+	if err := fs.WalkDir(f.fsys, n, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		files = append(files, p)
+		return nil
+	}); err != nil {
+		return err
+	}
+	// Remove the files before the directories that contain them.
+	for i := len(files) - 1; i >= 0; i-- {
+		if err := f.s.DeleteFile(filepath.FromSlash(files[i])); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename renames a file or a directory. The files are re-encrypted when
+// needed, see storage.RenameFile.
+func (f *Fs) Rename(oldname, newname string) error {
+	o, n := clean(oldname), clean(newname)
+	fi, err := f.fsys.Stat(o)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return f.s.RenameFile(filepath.FromSlash(o), filepath.FromSlash(n))
+	}
+	if o == "." || n == o || strings.HasPrefix(n, o+"/") {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrInvalid}
+	}
+	var dirs []string
+	if err := fs.WalkDir(f.fsys, o, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		np := path.Join(n, strings.TrimPrefix(p, o))
+		if d.IsDir() {
+			dirs = append(dirs, p)
+			return f.s.MkdirAll(filepath.FromSlash(np))
+		}
+		return f.s.RenameFile(filepath.FromSlash(p), filepath.FromSlash(np))
+	}); err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := f.s.DeleteFile(filepath.FromSlash(dirs[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stat returns the FileInfo of a file. The size is the size of the decrypted
+// content.
+func (f *Fs) Stat(name string) (os.FileInfo, error) {
+	return f.fsys.Stat(clean(name))
+}
+
+// Chmod isn't supported. The storage's files are only accessible by their
+// owner.
+func (f *Fs) Chmod(name string, mode os.FileMode) error {
+	return &fs.PathError{Op: "chmod", Path: name, Err: errors.ErrUnsupported}
+}
+
+// Chown isn't supported.
+func (f *Fs) Chown(name string, uid, gid int) error {
+	return &fs.PathError{Op: "chown", Path: name, Err: errors.ErrUnsupported}
+}
+
+// Chtimes isn't supported.
+func (f *Fs) Chtimes(name string, atime, mtime time.Time) error {
+	return &fs.PathError{Op: "chtimes", Path: name, Err: errors.ErrUnsupported}
+}
+
+// readdir returns the FileInfo of the entries of directory p, sorted by name.
+func (f *Fs) readdir(p string) ([]os.FileInfo, error) {
+	entries, err := f.fsys.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, fi)
+	}
+	return out, nil
+}
+
+// dirReader implements Readdir and Readdirnames for afero.File.
+type dirReader struct {
+	entries []os.FileInfo
+	read    bool
+}
+
+func (d *dirReader) readdir(f *Fs, p string, count int) ([]os.FileInfo, error) {
+	if !d.read {
+		entries, err := f.readdir(p)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+	if count <= 0 {
+		out := d.entries
+		d.entries = nil
+		return out, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	count = min(count, len(d.entries))
+	out := d.entries[:count]
+	d.entries = d.entries[count:]
+	return out, nil
+}
+
+func names(fis []os.FileInfo, err error) ([]string, error) {
+	out := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		out = append(out, fi.Name())
+	}
+	return out, err
+}
+
+// readFile is a file opened for reading. It can be any type of file.
+type readFile struct {
+	name string
+	fs   *Fs
+	path string
+
+	mu  sync.Mutex
+	f   fs.File
+	dir dirReader
+}
+
+func (f *readFile) Name() string {
+	return f.name
+}
+
+func (f *readFile) Stat() (os.FileInfo, error) {
+	return f.f.Stat()
+}
+
+func (f *readFile) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.f.Read(b)
+}
+
+func (f *readFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.f.(io.Seeker)
+	if !ok {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: errors.New("is a directory")}
+	}
+	return s.Seek(offset, whence)
+}
+
+func (f *readFile) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.f.(io.Seeker)
+	if !ok {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.New("is a directory")}
+	}
+	cur, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Seek(cur, io.SeekStart)
+	if _, err := s.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(f.f, b)
+}
+
+func (f *readFile) Readdir(count int) ([]os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dir.readdir(f.fs, f.path, count)
+}
+
+func (f *readFile) Readdirnames(n int) ([]string, error) {
+	return names(f.Readdir(n))
+}
+
+func (f *readFile) Write([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+}
+
+func (f *readFile) WriteAt([]byte, int64) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+}
+
+func (f *readFile) WriteString(string) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+}
+
+func (f *readFile) Truncate(int64) error {
+	return &fs.PathError{Op: "truncate", Path: f.name, Err: os.ErrPermission}
+}
+
+func (f *readFile) Sync() error {
+	return nil
+}
+
+func (f *readFile) Close() error {
+	return f.f.Close()
+}
+
+// writeFile is a paged blob file opened for writing.
+type writeFile struct {
+	name string
+	fs   *Fs
+	path string
+	flag int
+
+	mu     sync.Mutex
+	bf     *storage.BlobFile
+	off    int64
+	closed bool
+}
+
+func (f *writeFile) check(op string, write bool) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+	if !write && f.flag&os.O_WRONLY != 0 {
+		return &fs.PathError{Op: op, Path: f.name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (f *writeFile) Name() string {
+	return f.name
+}
+
+func (f *writeFile) Stat() (os.FileInfo, error) {
+	return f.fs.fsys.Stat(f.path)
+}
+
+func (f *writeFile) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	n, err := f.bf.ReadAt(b, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *writeFile) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	return f.bf.ReadAt(b, off)
+}
+
+func (f *writeFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.bf.Size()
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *writeFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.off = f.bf.Size()
+	}
+	n, err := f.bf.WriteAt(b, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *writeFile) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		return 0, &fs.PathError{Op: "writeat", Path: f.name, Err: errors.New("file opened with O_APPEND")}
+	}
+	return f.bf.WriteAt(b, off)
+}
+
+func (f *writeFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *writeFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	return f.bf.Truncate(size)
+}
+
+func (f *writeFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("sync", true); err != nil {
+		return err
+	}
+	return f.bf.Sync()
+}
+
+func (f *writeFile) Readdir(int) ([]os.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+}
+
+func (f *writeFile) Readdirnames(int) ([]string, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+}
+
+func (f *writeFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return f.bf.Close()
+}
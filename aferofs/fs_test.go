@@ -0,0 +1,209 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package aferofs_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/afero"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/aferofs"
+	"github.com/c2FmZQ/storage/internal/storagetest"
+)
+
+func newFs(t *testing.T) (*aferofs.Fs, *storage.Storage) {
+	s := storagetest.New(t)
+	return aferofs.New(s), s
+}
+
+func TestReadWrite(t *testing.T) {
+	afs, _ := newFs(t)
+
+	if err := afero.WriteFile(afs, "/a/b/foo.txt", []byte("Hello"), 0600); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("afero.WriteFile() = %v, want ErrNotExist", err)
+	}
+	if err := afs.MkdirAll("/a/b", 0700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := afero.WriteFile(afs, "/a/b/foo.txt", []byte("Hello"), 0600); err != nil {
+		t.Fatalf("afero.WriteFile: %v", err)
+	}
+	f, err := afs.OpenFile("/a/b/foo.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := f.WriteString(" world"); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+	if _, err := f.Read(make([]byte, 1)); err == nil {
+		t.Error("Read on write-only file succeeded")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got, err := afero.ReadFile(afs, "/a/b/foo.txt"); err != nil || string(got) != "Hello world" {
+		t.Errorf("afero.ReadFile() = %q, %v", got, err)
+	}
+
+	f, err = afs.OpenFile("a/b/foo.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := f.Seek(6, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if _, err := f.Write([]byte("W")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := f.Truncate(8); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+	b := make([]byte, 3)
+	if _, err := f.ReadAt(b, 5); err != nil || string(b) != " Wo" {
+		t.Errorf("ReadAt() = %q, %v", b, err)
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() != 8 {
+		t.Errorf("Stat() = %v, %v", fi, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if _, err := afs.OpenFile("a/b/foo.txt", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("OpenFile(O_EXCL) = %v, want ErrExist", err)
+	}
+	if _, err := afs.Open("a/b/nothing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open(nothing) = %v, want ErrNotExist", err)
+	}
+	rf, err := afs.Open("a/b/foo.txt")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer rf.Close()
+	if _, err := rf.Write([]byte("x")); err == nil {
+		t.Error("Write on read-only file succeeded")
+	}
+	if _, err := rf.ReadAt(b, 1); err != nil || string(b) != "ell" {
+		t.Errorf("ReadAt() = %q, %v", b, err)
+	}
+	if got, err := io.ReadAll(rf); err != nil || string(got) != "Hello Wo" {
+		t.Errorf("ReadAll() = %q, %v", got, err)
+	}
+}
+
+func TestDataFiles(t *testing.T) {
+	afs, s := newFs(t)
+	raw := []byte("raw content")
+	if err := s.SaveDataFile("data", &raw); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	if got, err := afero.ReadFile(afs, "data"); err != nil || !bytes.Equal(got, raw) {
+		t.Errorf("afero.ReadFile() = %q, %v", got, err)
+	}
+	if _, err := afs.OpenFile("data", os.O_RDWR, 0); !errors.Is(err, aferofs.ErrNotWritable) {
+		t.Errorf("OpenFile(O_RDWR) = %v, want ErrNotWritable", err)
+	}
+	// Replace the data file.
+	if err := afero.WriteFile(afs, "data", []byte("new"), 0600); err != nil {
+		t.Fatalf("afero.WriteFile: %v", err)
+	}
+	if got, err := afero.ReadFile(afs, "data"); err != nil || string(got) != "new" {
+		t.Errorf("afero.ReadFile() = %q, %v", got, err)
+	}
+}
+
+func TestDirectories(t *testing.T) {
+	afs, _ := newFs(t)
+	if err := afs.Mkdir("a/b", 0700); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Mkdir(a/b) = %v, want ErrNotExist", err)
+	}
+	if err := afs.Mkdir("a", 0700); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if err := afs.Mkdir("a", 0700); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Mkdir(a) = %v, want ErrExist", err)
+	}
+	for _, f := range []string{"a/x", "a/y", "a/sub/z"} {
+		if err := afs.MkdirAll("a/sub", 0700); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := afero.WriteFile(afs, f, []byte(f), 0600); err != nil {
+			t.Fatalf("afero.WriteFile(%q): %v", f, err)
+		}
+	}
+	d, err := afs.Open("a")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if want := []string{"sub", "x", "y"}; err != nil || !reflect.DeepEqual(names, want) {
+		t.Errorf("Readdirnames() = %v, %v, want %v", names, err, want)
+	}
+
+	if err := afs.Rename("a", "b"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	var walked []string
+	if err := afero.Walk(afs, "/", func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			walked = append(walked, p)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("afero.Walk: %v", err)
+	}
+	if want := []string{"/b/sub/z", "/b/x", "/b/y"}; !reflect.DeepEqual(walked, want) {
+		t.Errorf("afero.Walk() = %v, want %v", walked, want)
+	}
+	if got, err := afero.ReadFile(afs, "b/sub/z"); err != nil || string(got) != "a/sub/z" {
+		t.Errorf("afero.ReadFile() = %q, %v", got, err)
+	}
+
+	if err := afs.Remove("b"); err == nil {
+		t.Error("Remove of non-empty directory succeeded")
+	}
+	if err := afs.RemoveAll("b"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	if _, err := afs.Stat("b"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(b) = %v, want ErrNotExist", err)
+	}
+	if err := afs.RemoveAll("b"); err != nil {
+		t.Errorf("RemoveAll: %v", err)
+	}
+	if err := afs.Chmod("a", 0700); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Chmod() = %v, want ErrUnsupported", err)
+	}
+}
@@ -0,0 +1,148 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Backend is the filesystem where the storage keeps its files. The default
+// Backend uses the local filesystem. Other implementations can put the
+// encrypted files in an object store, or anywhere else that offers similar
+// semantics.
+//
+// The names passed to the Backend are the slash or OS-separated paths built
+// by joining the storage's root directory with the relative file names.
+//
+// The storage's transactions depend on a few guarantees:
+//   - Rename atomically replaces newpath with oldpath.
+//   - OpenFile with os.O_CREATE|os.O_EXCL fails with fs.ErrExist if the file
+//     already exists.
+//   - Link fails with fs.ErrExist if newname already exists. It doesn't have
+//     to create a hard link, a copy is sufficient.
+//   - The errors wrap fs.ErrNotExist and fs.ErrExist when appropriate.
+//
+// The Sys method of the FileInfo values returned by Stat should either
+// return nil, or a comparable value that identifies the file, e.g. a pointer.
+// It is used to detect when cached objects are stale.
+type Backend interface {
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	Stat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Rename(oldpath, newpath string) error
+	Link(oldname, newname string) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	MkdirAll(path string, perm fs.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// File is a file opened by a Backend. *os.File implements this interface.
+type File interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Name() string
+	Stat() (fs.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// WithBackend specifies the Backend where the files are stored. The default
+// is the local filesystem.
+func WithBackend(b Backend) Option {
+	return func(opt *option) {
+		opt.backend = b
+	}
+}
+
+// NewOSBackend returns a Backend that uses the local filesystem.
+func NewOSBackend() Backend {
+	return osBackend{}
+}
+
+type osBackend struct{}
+
+func (osBackend) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osBackend) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osBackend) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osBackend) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osBackend) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osBackend) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (osBackend) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osBackend) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osBackend) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osBackend) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// readFile reads the whole content of a file from b.
+func readFile(b Backend, name string) ([]byte, error) {
+	f, err := b.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return appendAll(nil, f, sizeHint(f))
+}
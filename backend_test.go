@@ -0,0 +1,185 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dirBackend maps the paths under root to the local directory dir, and
+// counts the calls. Any I/O that doesn't go through the backend fails
+// because root doesn't exist.
+type dirBackend struct {
+	root string
+	dir  string
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func newDirBackend(root, dir string) *dirBackend {
+	return &dirBackend{root: root, dir: dir, calls: make(map[string]int)}
+}
+
+func (b *dirBackend) path(op, name string) string {
+	b.mu.Lock()
+	b.calls[op]++
+	b.mu.Unlock()
+	rel, err := filepath.Rel(b.root, name)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return filepath.Join(b.dir, "outside-of-root")
+	}
+	return filepath.Join(b.dir, rel)
+}
+
+func (b *dirBackend) count(op string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls[op]
+}
+
+func (b *dirBackend) Open(name string) (File, error) {
+	return osBackend{}.Open(b.path("Open", name))
+}
+
+func (b *dirBackend) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	return osBackend{}.OpenFile(b.path("OpenFile", name), flag, perm)
+}
+
+func (b *dirBackend) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(b.path("Stat", name))
+}
+
+func (b *dirBackend) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(b.path("ReadDir", name))
+}
+
+func (b *dirBackend) Rename(oldpath, newpath string) error {
+	return os.Rename(b.path("Rename", oldpath), b.path("Rename", newpath))
+}
+
+func (b *dirBackend) Link(oldname, newname string) error {
+	return os.Link(b.path("Link", oldname), b.path("Link", newname))
+}
+
+func (b *dirBackend) Remove(name string) error {
+	return os.Remove(b.path("Remove", name))
+}
+
+func (b *dirBackend) RemoveAll(path string) error {
+	return os.RemoveAll(b.path("RemoveAll", path))
+}
+
+func (b *dirBackend) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(b.path("MkdirAll", path), perm)
+}
+
+func (b *dirBackend) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(b.path("Chtimes", name), atime, mtime)
+}
+
+func TestWithBackend(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "does-not-exist")
+	be := newDirBackend(root, filepath.Join(dir, "real"))
+	s, err := Open(root, aesEncryptionKey(), WithBackend(be), WithCache(10), WithReadLocks())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	type Foo struct {
+		N int
+	}
+	if err := s.SaveDataFile("a/foo", Foo{1}); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	if err := s.SaveDataFile("b", Foo{2}); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	var foo Foo
+	if err := s.ReadDataFile("a/foo", &foo); err != nil || foo.N != 1 {
+		t.Fatalf("s.ReadDataFile() = %v, %v", foo, err)
+	}
+
+	tx, err := s.Begin("a/foo", "b")
+	if err != nil {
+		t.Fatalf("s.Begin: %v", err)
+	}
+	if err := tx.Write("a/foo", Foo{10}); err != nil {
+		t.Fatalf("tx.Write: %v", err)
+	}
+	if err := tx.Delete("b"); err != nil {
+		t.Fatalf("tx.Delete: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("tx.Commit: %v", err)
+	}
+	if err := s.ReadDataFile("a/foo", &foo); err != nil || foo.N != 10 {
+		t.Fatalf("s.ReadDataFile() = %v, %v", foo, err)
+	}
+	// From the cache.
+	if err := s.ReadDataFile("a/foo", &foo); err != nil || foo.N != 10 {
+		t.Fatalf("s.ReadDataFile() = %v, %v", foo, err)
+	}
+	if err := s.ReadDataFile("b", &foo); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("s.ReadDataFile(b) = %v, want ErrNotExist", err)
+	}
+
+	content := []byte("Hello world!")
+	writeBlob(t, s, "blob", content)
+	if got := readBlob(t, s, "blob"); !bytes.Equal(got, content) {
+		t.Errorf("readBlob() = %q, want %q", got, content)
+	}
+
+	if err := s.AppendRecord("records", Foo{1}); err != nil {
+		t.Fatalf("s.AppendRecord: %v", err)
+	}
+	n := 0
+	if err := s.ReadRecords("records", func(decode func(interface{}) error) error {
+		n++
+		return decode(&foo)
+	}); err != nil || n != 1 {
+		t.Fatalf("s.ReadRecords() = %d, %v", n, err)
+	}
+
+	if _, err := os.Stat(root); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("os.Stat(%q) = %v, want ErrNotExist", root, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "real", "outside-of-root")); err == nil {
+		t.Error("backend was called with a path outside of root")
+	}
+	for _, op := range []string{"OpenFile", "Open", "Rename", "Remove", "MkdirAll", "Stat"} {
+		if be.count(op) == 0 {
+			t.Errorf("%s was never called", op)
+		}
+	}
+}
@@ -24,51 +24,232 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"time"
 )
 
 func (s *Storage) createBackup(files []string) (*backup, error) {
-	b := &backup{dir: s.dir, TS: time.Now(), Files: files}
+	b := &backup{dir: s.dir, s: s, TS: time.Now(), Files: files}
 	if err := b.backup(); err != nil {
 		return nil, err
 	}
-	b.pending = filepath.Join("pending", fmt.Sprintf("%d", b.TS.UnixNano()))
-	if err := s.SaveDataFile(b.pending, b); err != nil {
+	if err := s.savePending(b); err != nil {
 		return nil, err
 	}
 	return b, nil
 }
 
-func (s *Storage) rollbackPendingOps() error {
-	m, err := filepath.Glob(filepath.Join(s.dir, "pending", "*"))
+// savePending records a pending operation so that it can be rolled back if
+// the process dies before it completes.
+func (s *Storage) savePending(b *backup) error {
+	b.pending = pendingFileName(b.TS)
+	return s.SaveDataFile(b.pending, b)
+}
+
+// pendingFileName returns the relative name of the record of the pending
+// operation that started at ts.
+func pendingFileName(ts time.Time) string {
+	return filepath.Join("pending", fmt.Sprintf("%d", ts.UnixNano()))
+}
+
+// PendingOpResult is the result of the recovery of one pending operation.
+type PendingOpResult struct {
+	// Name is the relative name of the pending operation's record.
+	Name string
+	// TS is the time when the operation started.
+	TS time.Time
+	// Files are the files that were changed by the operation.
+	Files []string
+	// RolledForward is true when the operation was committed, and was
+	// completed instead of rolled back.
+	RolledForward bool
+	// Err is the error that prevented the recovery of the operation, if
+	// any. The operation is still pending, and recovery can be retried.
+	Err error
+}
+
+// RollbackPendingOps recovers the operations that were interrupted, e.g.
+// because the process died in the middle of a commit. Operations that were
+// committed with CommitWAL are rolled forward, and all the others are rolled
+// back. It is called automatically by Open and New, and there is normally no
+// reason to call it again unless it failed. The operations of a BlobWriter
+// that is still in use, in this process or another one, are left alone.
+//
+// It returns the result of every pending operation that was recovered. If any of
+// them failed, the error is the combination of their errors.
+func (s *Storage) RollbackPendingOps() ([]PendingOpResult, error) {
+	ops, err := s.loadPendingOps()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for _, f := range m {
-		rel, err := filepath.Rel(s.dir, f)
-		if err != nil {
-			return err
+	return s.recoverPendingOps(ops)
+}
+
+// WaitForRecovery waits until the asynchronous recovery of pending operations
+// started by Open is complete, and returns its results. See
+// WithAsyncRecovery. It returns immediately when there is no asynchronous
+// recovery.
+func (s *Storage) WaitForRecovery() ([]PendingOpResult, error) {
+	if s.recovery == nil {
+		return nil, nil
+	}
+	<-s.recovery.done
+	return s.recovery.results, s.recovery.err
+}
+
+// recovery keeps track of an asynchronous recovery.
+type recovery struct {
+	// The files that are affected by the recovery. It must not be modified
+	// after the recovery starts.
+	files   map[string]struct{}
+	done    chan struct{}
+	results []PendingOpResult
+	err     error
+}
+
+// recoverAsync recovers ops in the background. Until it is done, the affected
+// files can't be locked or read.
+func (s *Storage) recoverAsync(ops []pendingOp) {
+	r := &recovery{
+		files: make(map[string]struct{}),
+		done:  make(chan struct{}),
+	}
+	for _, op := range ops {
+		if op.b == nil {
+			continue
+		}
+		for _, f := range slices.Concat(op.b.Files, op.b.Deleted) {
+			r.files[filepath.Clean(f)] = struct{}{}
 		}
+	}
+	s.recovery = r
+	go func() {
+		defer close(r.done)
+		r.results, r.err = s.recoverPendingOps(ops)
+		if r.err != nil {
+			s.Logger().Errorf("Recovery of pending operations failed: %v", r.err)
+		}
+	}()
+}
+
+// waitForRecovery waits until filename is recovered, if it is affected by an
+// asynchronous recovery, or until ctx is done.
+func (s *Storage) waitForRecovery(ctx context.Context, filename string) error {
+	if s.recovery == nil {
+		return nil
+	}
+	if _, ok := s.recovery.files[filepath.Clean(filename)]; !ok {
+		return nil
+	}
+	select {
+	case <-s.recovery.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("recovery of %s: %w", filename, ctx.Err())
+	}
+}
+
+// pendingOp is a pending operation that needs to be recovered. b is nil when
+// the operation's record can't be read.
+type pendingOp struct {
+	b   *backup
+	res PendingOpResult
+}
+
+// loadPendingOps reads the records of all the pending operations.
+func (s *Storage) loadPendingOps() ([]pendingOp, error) {
+	entries, err := s.backend.ReadDir(filepath.Join(s.dir, "pending"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ops := make([]pendingOp, 0, len(entries))
+	for _, e := range entries {
+		if internalFileRE.MatchString(e.Name()) {
+			// The lock of an owned operation.
+			continue
+		}
+		var op pendingOp
+		rel := filepath.Join("pending", e.Name())
+		op.res.Name = rel
 		var b backup
 		if err := s.ReadDataFile(rel, &b); err != nil {
-			return err
+			op.res.Err = err
+			ops = append(ops, op)
+			continue
 		}
 		b.dir = s.dir
+		b.s = s
 		b.pending = rel
+		op.b = &b
+		op.res.TS = b.TS
+		op.res.Files = b.Files
+		op.res.RolledForward = b.Committed
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// recoverPendingOps rolls ops back, or forward when they were committed.
+func (s *Storage) recoverPendingOps(ops []pendingOp) ([]PendingOpResult, error) {
+	var results []PendingOpResult
+	var errList []error
+	for _, op := range ops {
+		if op.b != nil {
+			op.res.Err = s.recoverPendingOp(op.b)
+		}
+		if errors.Is(op.res.Err, errPendingOpInUse) {
+			continue
+		}
+		if op.res.Err != nil {
+			errList = append(errList, fmt.Errorf("%s: %w", op.res.Name, op.res.Err))
+		}
+		results = append(results, op.res)
+	}
+	return results, errors.Join(errList...)
+}
+
+// errPendingOpInUse indicates that the owner of a pending operation is still
+// working on it.
+var errPendingOpInUse = errors.New("pending operation in use")
+
+func (s *Storage) recoverPendingOp(b *backup) error {
+	if b.Owned {
+		// The owner holds the lock of the record until the operation
+		// completes. The lock of an owner that died is stale, and the
+		// locker reclaims it.
+		if err := s.LockWithTimeout(b.pending, time.Second); errors.Is(err, context.DeadlineExceeded) {
+			return errPendingOpInUse
+		} else if err != nil {
+			return err
+		}
+		defer s.Unlock(b.pending)
+	} else if !s.exclusive {
 		// Make sure pending is this backup is really abandoned.
 		time.Sleep(time.Until(b.TS.Add(5 * time.Second)))
+	}
+	if b.Committed {
+		if err := b.rollForward(); err != nil {
+			return err
+		}
+		s.Logger().Infof("Rolled forward pending operation %d [%v]", b.TS.UnixNano(), b.Files)
+	} else {
 		if err := b.restore(); err != nil {
 			return err
 		}
 		s.Logger().Infof("Rolled back pending operation %d [%v]", b.TS.UnixNano(), b.Files)
-		// The abandoned files were most likely locked.
-		s.UnlockMany(b.Files)
 	}
+	// The abandoned files were most likely locked.
+	s.UnlockMany(slices.Concat(b.Files, b.Deleted))
 	return nil
 }
 
@@ -77,34 +258,70 @@ type backup struct {
 	TS time.Time `json:"ts"`
 	// Relative file names.
 	Files []string `json:"files"`
+	// Relative names of temporary files to delete on rollback.
+	Temp []string `json:"temp,omitempty"`
+	// Relative names of the files that didn't exist when the backup was
+	// made. They are deleted on rollback.
+	Created []string `json:"created,omitempty"`
+	// WAL is true when the operation uses a write-ahead log instead of a
+	// backup. The new versions of Files are written next to them, and
+	// Deleted are the files to delete.
+	WAL bool `json:"wal,omitempty"`
+	// Committed is true when all the new versions are written, and the
+	// operation must be rolled forward instead of back.
+	Committed bool `json:"committed,omitempty"`
+	// Relative names of the files to delete when rolling forward.
+	Deleted []string `json:"deleted,omitempty"`
+	// Owned is true when the owner of the operation holds the lock of the
+	// pending ops file until the operation completes, e.g. a BlobWriter.
+	// The operation is only recovered after its owner is gone.
+	Owned bool `json:"owned,omitempty"`
 
 	// The root of the data directory.
 	dir string
+	// The storage that created the backup.
+	s *Storage
 	// The relative file name of the pending ops file.
 	pending string
 }
 
 func (b *backup) backup() error {
-	ch := make(chan error)
+	type result struct {
+		f   string
+		err error
+	}
+	ch := make(chan result)
 	for _, f := range b.Files {
-		go func(fn string) { ch <- copyFile(b.backupFileName(fn), fn) }(filepath.Join(b.dir, f))
+		go func(f string) {
+			fn := filepath.Join(b.dir, f)
+			ch <- result{f, copyFile(b.s.backend, b.backupFileName(fn), fn)}
+		}(f)
 	}
 	var errList []error
 	for _ = range b.Files {
-		if err := <-ch; err != nil && !errors.Is(err, os.ErrNotExist) {
-			errList = append(errList, err)
+		r := <-ch
+		if errors.Is(r.err, os.ErrNotExist) {
+			b.Created = append(b.Created, r.f)
+			continue
+		}
+		if r.err != nil {
+			errList = append(errList, fmt.Errorf("%s: %w", r.f, r.err))
 		}
 	}
-	if errList != nil {
-		return fmt.Errorf("%w %v", errList[0], errList[1:])
+	sort.Strings(b.Created)
+	if err := errors.Join(errList...); err != nil {
+		return err
 	}
 	return nil
 }
 
 func (b *backup) restore() error {
+	if b.WAL {
+		return b.discardWAL()
+	}
 	ch := make(chan error)
 	for _, f := range b.Files {
-		go func(fn string) { ch <- os.Rename(b.backupFileName(fn), fn) }(filepath.Join(b.dir, f))
+		go func(fn string) { ch <- b.s.rename(b.backupFileName(fn), fn) }(filepath.Join(b.dir, f))
 	}
 	var errList []error
 	for _ = range b.Files {
@@ -112,10 +329,21 @@ func (b *backup) restore() error {
 			errList = append(errList, err)
 		}
 	}
-	if errList != nil {
-		return fmt.Errorf("%w %v", errList[0], errList[1:])
+	// The cache is invalidated after the renames, so that concurrent
+	// readers can't cache the content that is being replaced.
+	for _, f := range b.Files {
+		b.s.invalidateCache(f)
+	}
+	for _, f := range slices.Concat(b.Created, b.Temp) {
+		if err := b.s.backend.Remove(filepath.Join(b.dir, f)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errList = append(errList, err)
+		}
+		b.s.invalidateCache(f)
+	}
+	if err := errors.Join(errList...); err != nil {
+		return err
 	}
-	if err := os.Remove(filepath.Join(b.dir, b.pending)); err != nil && !errors.Is(err, os.ErrNotExist) {
+	if err := b.s.backend.Remove(filepath.Join(b.dir, b.pending)); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
 	return nil
@@ -124,7 +352,7 @@ func (b *backup) restore() error {
 func (b *backup) delete() error {
 	ch := make(chan error)
 	for _, f := range b.Files {
-		go func(fn string) { ch <- os.Remove(b.backupFileName(fn)) }(filepath.Join(b.dir, f))
+		go func(fn string) { ch <- b.s.backend.Remove(b.backupFileName(fn)) }(filepath.Join(b.dir, f))
 	}
 	var errList []error
 	for _ = range b.Files {
@@ -132,10 +360,10 @@ func (b *backup) delete() error {
 			errList = append(errList, err)
 		}
 	}
-	if errList != nil {
-		return fmt.Errorf("%w %v", errList[0], errList[1:])
+	if err := errors.Join(errList...); err != nil {
+		return err
 	}
-	if err := os.Remove(filepath.Join(b.dir, b.pending)); err != nil && !errors.Is(err, os.ErrNotExist) {
+	if err := b.s.backend.Remove(filepath.Join(b.dir, b.pending)); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
 	return nil
@@ -145,15 +373,71 @@ func (b *backup) backupFileName(f string) string {
 	return fmt.Sprintf("%s.bck-%d", f, b.TS.UnixNano())
 }
 
-func copyFile(dst, src string) error {
-	if err := os.Link(src, dst); err == nil {
+func (b *backup) walFileName(f string) string {
+	return fmt.Sprintf("%s.wal-%d", f, b.TS.UnixNano())
+}
+
+// discardWAL deletes the new versions of the files of an operation that
+// wasn't committed.
+func (b *backup) discardWAL() error {
+	var errList []error
+	for _, f := range b.Files {
+		if err := b.s.backend.Remove(filepath.Join(b.dir, b.walFileName(f))); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errList = append(errList, err)
+		}
+	}
+	if err := errors.Join(errList...); err != nil {
+		return err
+	}
+	if err := b.s.backend.Remove(filepath.Join(b.dir, b.pending)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// rollForward completes an operation that was committed: the new versions
+// replace the files, and the deleted files are deleted. It is safe to call
+// rollForward again if it was interrupted.
+func (b *backup) rollForward() error {
+	ch := make(chan error)
+	for _, f := range b.Files {
+		go func(f string) {
+			err := b.s.rename(filepath.Join(b.dir, b.walFileName(f)), filepath.Join(b.dir, f))
+			b.s.invalidateCache(f)
+			if errors.Is(err, os.ErrNotExist) {
+				// Already renamed.
+				err = nil
+			}
+			ch <- err
+		}(f)
+	}
+	for _, f := range b.Deleted {
+		go func(f string) { ch <- b.s.deleteFile(f) }(f)
+	}
+	var errList []error
+	for _ = range len(b.Files) + len(b.Deleted) {
+		if err := <-ch; err != nil {
+			errList = append(errList, err)
+		}
+	}
+	if err := errors.Join(errList...); err != nil {
+		return err
+	}
+	if err := b.s.backend.Remove(filepath.Join(b.dir, b.pending)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func copyFile(be Backend, dst, src string) error {
+	if err := be.Link(src, dst); err == nil {
 		return nil
 	}
-	in, err := os.Open(src)
+	in, err := be.Open(src)
 	if err != nil {
 		return err
 	}
-	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	out, err := be.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
 		in.Close()
 		return err
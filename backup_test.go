@@ -30,6 +30,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestBackupRestore(t *testing.T) {
@@ -186,3 +187,135 @@ func TestRestorePendingOps(t *testing.T) {
 
 	}
 }
+
+func TestBackupCreateAndDelete(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	mk := aesEncryptionKey()
+	s := New(dir, mk)
+
+	if err := os.WriteFile(filepath.Join(dir, "old"), []byte("old file"), 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	bck, err := s.createBackup([]string{"old", "new"})
+	if err != nil {
+		t.Fatalf("s.createBackup: %v", err)
+	}
+	var got backup
+	if err := s.ReadDataFile(bck.pending, &got); err != nil {
+		t.Fatalf("s.ReadDataFile: %v", err)
+	}
+	if want := []string{"new"}; !reflect.DeepEqual(want, got.Created) {
+		t.Errorf("Unexpected created files. Want %v, got %v", want, got.Created)
+	}
+
+	// Delete the old file, create the new one, and crash.
+	if err := os.Remove(filepath.Join(dir, "old")); err != nil {
+		t.Fatalf("os.Remove: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "new"), []byte("new file"), 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	New(dir, mk)
+
+	if b, err := os.ReadFile(filepath.Join(dir, "old")); err != nil || string(b) != "old file" {
+		t.Errorf("old file = %q, %v", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("new file should have been deleted: %v", err)
+	}
+}
+
+func TestRollbackPendingOpsResults(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	mk := aesEncryptionKey()
+	s := New(dir, mk)
+
+	if err := s.SaveDataFile("a", "foo"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	bck, err := s.createBackup([]string{"a", "b"})
+	if err != nil {
+		t.Fatalf("s.createBackup: %v", err)
+	}
+	res, err := s.RollbackPendingOps()
+	if err != nil {
+		t.Fatalf("s.RollbackPendingOps: %v", err)
+	}
+	want := []PendingOpResult{{Name: bck.pending, TS: bck.TS, Files: []string{"a", "b"}}}
+	if len(res) != 1 || res[0].Name != want[0].Name || !res[0].TS.Equal(want[0].TS) || !reflect.DeepEqual(res[0].Files, want[0].Files) || res[0].RolledForward || res[0].Err != nil {
+		t.Errorf("s.RollbackPendingOps() = %+v, want %+v", res, want)
+	}
+	if res, err := s.RollbackPendingOps(); err != nil || len(res) != 0 {
+		t.Errorf("s.RollbackPendingOps() = %+v, %v, want none", res, err)
+	}
+
+	// A pending operation that can't be read can't be recovered. Open
+	// reports the error instead of failing.
+	if err := os.WriteFile(filepath.Join(dir, "pending", "1"), []byte("garbage"), 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	s, err = Open(dir, mk)
+	if err == nil || s == nil {
+		t.Fatalf("Open() = %v, %v, want storage and error", s, err)
+	}
+	res, err = s.RollbackPendingOps()
+	if err == nil || len(res) != 1 || res[0].Name != filepath.Join("pending", "1") || res[0].Err == nil {
+		t.Errorf("s.RollbackPendingOps() = %+v, %v", res, err)
+	}
+}
+
+func TestAsyncRecovery(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	mk := aesEncryptionKey()
+	s := New(dir, mk)
+
+	if err := s.SaveDataFile("a", "foo"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	if _, err := s.createBackup([]string{"a"}); err != nil {
+		t.Fatalf("s.createBackup: %v", err)
+	}
+	if err := s.SaveDataFile("a", "bar"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+
+	start := time.Now()
+	if s, err := Open(dir, mk, WithAsyncRecovery()); err != nil {
+		t.Fatalf("Open: %v", err)
+	} else {
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("Open took %s", d)
+		}
+		// The read waits for the recovery.
+		var got string
+		if err := s.ReadDataFile("a", &got); err != nil || got != "foo" {
+			t.Errorf("s.ReadDataFile(a) = %q, %v, want foo", got, err)
+		}
+		res, err := s.WaitForRecovery()
+		if err != nil || len(res) != 1 {
+			t.Errorf("s.WaitForRecovery() = %+v, %v", res, err)
+		}
+	}
+
+	if _, err := s.createBackup([]string{"a"}); err != nil {
+		t.Fatalf("s.createBackup: %v", err)
+	}
+	if err := s.SaveDataFile("a", "bar"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	start = time.Now()
+	s, err := Open(dir, mk, WithExclusiveAccess())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Open took %s", d)
+	}
+	var got string
+	if err := s.ReadDataFile("a", &got); err != nil || got != "foo" {
+		t.Errorf("s.ReadDataFile(a) = %q, %v, want foo", got, err)
+	}
+}
@@ -0,0 +1,457 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+// OpenBlobAppend reopens a blob file that was written with OpenBlobWrite, and
+// continues writing at the end. It is meant to resume writes that were
+// interrupted, e.g. when the process died in the middle of a large upload.
+// writeFileName and finalFileName must be the same as with OpenBlobWrite.
+//
+// The returned offset is the number of bytes already in the blob. Data that
+// was written but not flushed to the file before the interruption is lost.
+// The caller is expected to resume writing from that offset.
+//
+// If the blob was closed, its last chunk can't be extended without reusing
+// its nonce. The same is true when the interruption left a partially written
+// chunk at the end of the file, since those bytes may already have been
+// copied elsewhere, e.g. in a snapshot. In both cases, the blob is
+// re-encrypted with a new file key in a new file that replaces writeFileName
+// when the returned writer is closed.
+func (s *Storage) OpenBlobAppend(writeFileName, finalFileName string) (w io.WriteCloser, offset int64, retErr error) {
+	fn := filepath.Join(s.dir, writeFileName)
+	flags := os.O_RDWR
+	if s.durability == DurabilityFull {
+		flags |= os.O_SYNC
+	}
+	of, err := s.backend.OpenFile(fn, flags, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+	f := &syncFile{of, s}
+	defer func() {
+		if retErr != nil {
+			f.File.Close()
+		}
+	}()
+
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		return nil, 0, err
+	}
+	if string(hdr[:4]) != "KRIN" {
+		return nil, 0, errors.New("wrong file type")
+	}
+	if hdr[4]&optEncodingMask != optRawBytes {
+		return nil, 0, errors.New("blob files is not raw bytes")
+	}
+	if hdr[4]&optCompressed != 0 {
+		return nil, 0, errors.New("compressed blobs cannot be appended")
+	}
+	hashed := hdr[4]&optHashed != 0
+	if hdr[4]&optEncrypted == 0 {
+		size, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, 0, err
+		}
+		dataStart := int64(len(hdr))
+		if !hashed {
+			return f, size - dataStart, nil
+		}
+		h, closed, err := hashPrefix(io.NewSectionReader(f.File, dataStart, size-dataStart), size-dataStart)
+		if err != nil {
+			return nil, 0, err
+		}
+		if closed {
+			// Remove the hash trailer. It is written again when the
+			// blob is closed.
+			size -= int64(hashTrailerSize)
+			if err := f.Truncate(size); err != nil {
+				return nil, 0, err
+			}
+		}
+		if _, err := f.Seek(size, io.SeekStart); err != nil {
+			return nil, 0, err
+		}
+		return &hashingWriter{&hashTrailerWriter{f, h}, h}, size - dataStart, nil
+	}
+	if s.masterKey == nil {
+		return nil, 0, errors.New("file is encrypted, but a master key was not provided")
+	}
+	k, err := s.masterKey.ReadEncryptedKey(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer k.Wipe()
+	streamStart, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Find where the data starts in the decrypted stream.
+	ctx := fileContext(finalFileName)
+	var dataStart int64
+	r, err := k.StartReader(ctx, f.File)
+	if err != nil {
+		return nil, 0, err
+	}
+	h := make([]byte, 5)
+	if _, err := io.ReadFull(r, h); err == nil {
+		if !bytes.Equal(hdr, h) {
+			return nil, 0, errors.New("wrong encrypted header")
+		}
+		if hdr[4]&optPadded != 0 {
+			if err := SkipPadding(r); err != nil {
+				return nil, 0, err
+			}
+		}
+		if dataStart, err = r.Seek(0, io.SeekCurrent); err != nil {
+			return nil, 0, err
+		}
+	}
+	if _, err := f.Seek(streamStart, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	sw, off, err := k.StartAppendWriter(ctx, f)
+	if errors.Is(err, crypto.ErrStreamNotAppendable) {
+		f.File.Close()
+		if dataStart == 0 {
+			return s.restartBlob(writeFileName, finalFileName)
+		}
+		return s.reencryptBlob(writeFileName, finalFileName, dataStart, hashed)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if dataStart == 0 || off < dataStart {
+		// Not even the header and padding were written. Start over.
+		sw.Close()
+		return s.restartBlob(writeFileName, finalFileName)
+	}
+	if !hashed {
+		return sw, off - dataStart, nil
+	}
+
+	// Hash the existing content with a separate reader.
+	rf, err := s.backend.Open(fn)
+	if err != nil {
+		sw.Close()
+		return nil, 0, err
+	}
+	if _, err := rf.Seek(streamStart, io.SeekStart); err != nil {
+		rf.Close()
+		sw.Close()
+		return nil, 0, err
+	}
+	rr, err := k.StartReader(ctx, rf)
+	if err != nil {
+		rf.Close()
+		sw.Close()
+		return nil, 0, err
+	}
+	var contentHash hash.Hash
+	var closed bool
+	if _, err = rr.Seek(dataStart, io.SeekStart); err == nil {
+		contentHash, closed, err = hashPrefix(rr, off-dataStart)
+	}
+	rr.Close()
+	if err != nil {
+		sw.Close()
+		return nil, 0, err
+	}
+	if closed {
+		// The blob was closed and its hash trailer is in a sealed chunk.
+		sw.Close()
+		return s.reencryptBlob(writeFileName, finalFileName, dataStart, hashed)
+	}
+	return &hashingWriter{&hashTrailerWriter{sw, contentHash}, contentHash}, off - dataStart, nil
+}
+
+// BlobSize returns the size of the content of a blob file. The size is
+// computed from the size of the file and the headers of the blob, without
+// reading the whole content.
+func (s *Storage) BlobSize(filename string) (int64, error) {
+	r, err := s.openBlobRead(filename, filename)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return r.Seek(0, io.SeekEnd)
+}
+
+// CopyBlob copies a blob from one storage to another, e.g. with a different
+// master key. The content is decrypted and re-encrypted as it is copied, and
+// it is never written to disk in plaintext (unless dst isn't encrypted). The
+// destination blob is replaced atomically.
+func CopyBlob(dst *Storage, dstName string, src *Storage, srcName string) error {
+	r, err := src.OpenBlobRead(srcName)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := dst.CreateBlob(dstName)
+	if err != nil {
+		return err
+	}
+	defer w.Abort()
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	return w.Commit()
+}
+
+// restartBlob replaces a blob file that doesn't have any content with a new
+// one.
+func (s *Storage) restartBlob(writeFileName, finalFileName string) (io.WriteCloser, int64, error) {
+	if err := s.backend.Remove(filepath.Join(s.dir, writeFileName)); err != nil {
+		return nil, 0, err
+	}
+	w, err := s.OpenBlobWrite(writeFileName, finalFileName)
+	return w, 0, err
+}
+
+// reencryptBlob copies the content of an encrypted blob file into a new file
+// with a new file key. The blob may or may not have been closed. dataStart is
+// the offset of the content in the decrypted stream. The returned writer can
+// be used to append more data. The new file replaces the old one when the
+// writer is closed.
+func (s *Storage) reencryptBlob(writeFileName, finalFileName string, dataStart int64, hashed bool) (io.WriteCloser, int64, error) {
+	f, err := s.backend.Open(filepath.Join(s.dir, writeFileName))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(5, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	k, err := s.masterKey.ReadEncryptedKey(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer k.Wipe()
+	r, err := k.StartReader(fileContext(finalFileName), f)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+	// Streams with flushed chunks can't seek.
+	if _, err := io.CopyN(io.Discard, r, dataStart); err != nil {
+		return nil, 0, err
+	}
+	tmp := fmt.Sprintf("%s.tmp-%d", writeFileName, time.Now().UnixNano())
+	w, err := s.OpenBlobWrite(tmp, finalFileName)
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := copyBlobContent(w, r, hashed)
+	if err != nil {
+		w.Close()
+		s.backend.Remove(filepath.Join(s.dir, tmp))
+		return nil, 0, err
+	}
+	return &renameOnClose{
+		WriteCloser: w,
+		s:           s,
+		from:        filepath.Join(s.dir, tmp),
+		to:          filepath.Join(s.dir, writeFileName),
+	}, n, nil
+}
+
+// copyBlobContent copies the content of a blob from r, the decrypted stream of
+// the blob, to w. If the blob was closed, the stream ends with io.EOF and, if
+// hashed is true, with a hash trailer that is verified and not copied. If the
+// writer was interrupted, the stream ends with crypto.ErrStreamTruncated and
+// the hash trailer is usually missing.
+func copyBlobContent(w io.Writer, r io.Reader, hashed bool) (int64, error) {
+	h := sha256.New()
+	var keep int
+	if hashed {
+		keep = hashTrailerSize
+	}
+	buf := make([]byte, 32*1024+keep)
+	var total int64
+	var held int
+	var closed bool
+	for {
+		n, err := r.Read(buf[held:])
+		held += n
+		if k := held - keep; k > 0 {
+			if _, err := w.Write(buf[:k]); err != nil {
+				return total, err
+			}
+			h.Write(buf[:k])
+			total += int64(k)
+			held = copy(buf, buf[k:held])
+		}
+		if err == io.EOF {
+			closed = true
+			break
+		}
+		if errors.Is(err, crypto.ErrStreamTruncated) {
+			break
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+	tail := buf[:held]
+	if hashed && held == hashTrailerSize && string(tail[blobHashSize:]) == blobHashTrailer && bytes.Equal(h.Sum(nil), tail[:blobHashSize]) {
+		return total, nil
+	}
+	if hashed && closed {
+		return total, errors.New("invalid blob hash trailer")
+	}
+	n, err := w.Write(tail)
+	return total + int64(n), err
+}
+
+// renameOnClose renames a file after the writer is closed.
+type renameOnClose struct {
+	io.WriteCloser
+	s        *Storage
+	from, to string
+}
+
+func (w *renameOnClose) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return w.s.rename(w.from, w.to)
+}
+
+// BlobWriter writes a blob file atomically. The data is written to a temporary
+// file that is renamed to its final name by Commit, or deleted by Abort. If the
+// process dies before either is called, the temporary file is deleted the next
+// time the storage is opened. The temporary file of a BlobWriter that is still
+// in use is never deleted, no matter how long the writes take.
+type BlobWriter struct {
+	s        *Storage
+	w        io.WriteCloser
+	filename string
+	tmp      string
+	b        *backup
+	done     bool
+}
+
+// CreateBlob opens a BlobWriter for filename. The caller must call either
+// Commit or Abort when it is done writing. It is safe to call Abort after
+// Commit, e.g.
+//
+//	w, err := s.CreateBlob(filename)
+//	if err != nil {
+//		return err
+//	}
+//	defer w.Abort()
+//	if _, err := io.Copy(w, r); err != nil {
+//		return err
+//	}
+//	return w.Commit()
+func (s *Storage) CreateBlob(filename string, opts ...BlobOption) (*BlobWriter, error) {
+	b := &backup{dir: s.dir, s: s, TS: time.Now(), Owned: true}
+	tmp := fmt.Sprintf("%s.tmp-%d", filename, b.TS.UnixNano())
+	b.Temp = []string{tmp}
+	// The lock tells the recovery of pending operations that the writer
+	// is still alive.
+	pending := pendingFileName(b.TS)
+	if err := s.Lock(pending); err != nil {
+		return nil, err
+	}
+	if err := s.savePending(b); err != nil {
+		s.Unlock(pending)
+		return nil, err
+	}
+	w, err := s.OpenBlobWrite(tmp, filename, opts...)
+	if err != nil {
+		b.delete()
+		s.Unlock(pending)
+		return nil, err
+	}
+	return &BlobWriter{s: s, w: w, filename: filename, tmp: tmp, b: b}, nil
+}
+
+// Write writes p to the blob.
+func (w *BlobWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, os.ErrClosed
+	}
+	return w.w.Write(p)
+}
+
+// Commit flushes the blob and renames it to its final name.
+func (w *BlobWriter) Commit() error {
+	if w.done {
+		return os.ErrClosed
+	}
+	w.done = true
+	if err := w.w.Close(); err != nil {
+		w.abort()
+		return err
+	}
+	if err := w.s.rename(filepath.Join(w.s.dir, w.tmp), filepath.Join(w.s.dir, w.filename)); err != nil {
+		w.abort()
+		return err
+	}
+	return w.release()
+}
+
+// Abort discards the blob. It does nothing if the blob was already committed
+// or aborted.
+func (w *BlobWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.w.Close()
+	return w.abort()
+}
+
+func (w *BlobWriter) abort() error {
+	if err := w.s.backend.Remove(filepath.Join(w.s.dir, w.tmp)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return w.release()
+}
+
+// release deletes the pending operation and releases its lock.
+func (w *BlobWriter) release() error {
+	err := w.b.delete()
+	if uerr := w.s.Unlock(w.b.pending); err == nil {
+		err = uerr
+	}
+	return err
+}
@@ -0,0 +1,332 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+func readBlob(t *testing.T, s *Storage, filename string) []byte {
+	t.Helper()
+	r, err := s.OpenBlobRead(filename)
+	if err != nil {
+		t.Fatalf("s.OpenBlobRead: %v", err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("io.ReadAll: %v", err)
+	}
+	return b
+}
+
+func TestBlobAppend(t *testing.T) {
+	testcases := []struct {
+		name string
+		mk   crypto.EncryptionKey
+	}{
+		{"AES", aesEncryptionKey()},
+		{"Chacha20Poly1305", ccEncryptionKey()},
+		{"PlainText", nil},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := New(dir, tc.mk)
+			content := make([]byte, 5*1024*1024)
+			if _, err := rand.Read(content); err != nil {
+				t.Fatalf("rand.Read: %v", err)
+			}
+
+			// Interrupted write. The writer is never closed.
+			w, err := s.OpenBlobWrite("temp", "final")
+			if err != nil {
+				t.Fatalf("s.OpenBlobWrite: %v", err)
+			}
+			if _, err := w.Write(content[:3*1024*1024]); err != nil {
+				t.Fatalf("w.Write: %v", err)
+			}
+			fn := filepath.Join(dir, "temp")
+			before, err := os.ReadFile(fn)
+			if err != nil {
+				t.Fatalf("os.ReadFile: %v", err)
+			}
+			if tc.mk != nil {
+				// Partially written chunk.
+				if err := os.WriteFile(fn, append(before, "garbage"...), 0600); err != nil {
+					t.Fatalf("os.WriteFile: %v", err)
+				}
+			}
+
+			w, off, err := s.OpenBlobAppend("temp", "final")
+			if err != nil {
+				t.Fatalf("s.OpenBlobAppend: %v", err)
+			}
+			if off <= 0 || off > 3*1024*1024 {
+				t.Fatalf("Unexpected offset %d", off)
+			}
+			if _, err := w.Write(content[off : 4*1024*1024]); err != nil {
+				t.Fatalf("w.Write: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("w.Close: %v", err)
+			}
+			if tc.mk != nil {
+				// The nonce of the partial chunk isn't used again.
+				// The blob has a new file key.
+				after, err := os.ReadFile(fn)
+				if err != nil {
+					t.Fatalf("os.ReadFile: %v", err)
+				}
+				if bytes.Equal(before[:100], after[:100]) {
+					t.Error("Blob wasn't re-encrypted")
+				}
+			}
+
+			// Append to a closed blob.
+			if w, off, err = s.OpenBlobAppend("temp", "final"); err != nil {
+				t.Fatalf("s.OpenBlobAppend: %v", err)
+			}
+			if want := int64(4 * 1024 * 1024); off != want {
+				t.Fatalf("Unexpected offset. Want %d, got %d", want, off)
+			}
+			if _, err := w.Write(content[off:]); err != nil {
+				t.Fatalf("w.Write: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("w.Close: %v", err)
+			}
+
+			if err := os.Rename(filepath.Join(dir, "temp"), filepath.Join(dir, "final")); err != nil {
+				t.Fatalf("os.Rename: %v", err)
+			}
+			if got := readBlob(t, s, "final"); !bytes.Equal(content, got) {
+				t.Errorf("Unexpected content: len %d, want %d", len(got), len(content))
+			}
+			m, _ := filepath.Glob(filepath.Join(dir, "*.tmp-*"))
+			if len(m) > 0 {
+				t.Errorf("Unexpected temp files: %v", m)
+			}
+		})
+	}
+}
+
+func TestBlobWriter(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, aesEncryptionKey())
+	content := []byte("Hello world!")
+
+	w, err := s.CreateBlob("blob")
+	if err != nil {
+		t.Fatalf("s.CreateBlob: %v", err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatalf("w.Write: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "blob")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("blob should not exist before commit: %v", err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("w.Commit: %v", err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatalf("w.Abort after commit: %v", err)
+	}
+	if err := w.Commit(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("w.Commit again: %v", err)
+	}
+	if got := readBlob(t, s, "blob"); !bytes.Equal(content, got) {
+		t.Errorf("Unexpected content. Want %q, got %q", content, got)
+	}
+
+	if w, err = s.CreateBlob("blob"); err != nil {
+		t.Fatalf("s.CreateBlob: %v", err)
+	}
+	if _, err := w.Write([]byte("something else")); err != nil {
+		t.Fatalf("w.Write: %v", err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatalf("w.Abort: %v", err)
+	}
+	if got := readBlob(t, s, "blob"); !bytes.Equal(content, got) {
+		t.Errorf("Unexpected content. Want %q, got %q", content, got)
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, "blob.tmp-*")); len(m) > 0 {
+		t.Errorf("Unexpected temp files: %v", m)
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, "pending", "*")); len(m) > 0 {
+		t.Errorf("Unexpected pending ops: %v", m)
+	}
+}
+
+func TestBlobWriterRollback(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s := New(dir, aesEncryptionKey())
+
+	w, err := s.CreateBlob("blob")
+	if err != nil {
+		t.Fatalf("s.CreateBlob: %v", err)
+	}
+	if _, err := w.Write([]byte("Hello world!")); err != nil {
+		t.Fatalf("w.Write: %v", err)
+	}
+	// Simulate a crash. The writer is abandoned, and its process is gone.
+	locks, _ := filepath.Glob(filepath.Join(dir, "pending", "*.lock"))
+	if len(locks) != 1 {
+		t.Fatalf("Unexpected pending op locks: %v", locks)
+	}
+	b, err := json.Marshal(lockOwner{PID: math.MaxInt32, Host: hostname(), TS: time.Now()})
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if err := os.WriteFile(locks[0], b, 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	if _, err := s.RollbackPendingOps(); err != nil {
+		t.Fatalf("s.RollbackPendingOps: %v", err)
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, "blob*")); len(m) > 0 {
+		t.Errorf("Unexpected files: %v", m)
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, "pending", "*")); len(m) > 0 {
+		t.Errorf("Unexpected pending ops: %v", m)
+	}
+}
+
+func TestBlobWriterConcurrentOpen(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	mk := aesEncryptionKey()
+	s := New(dir, mk)
+
+	w, err := s.CreateBlob("blob")
+	if err != nil {
+		t.Fatalf("s.CreateBlob: %v", err)
+	}
+	defer w.Abort()
+	if _, err := w.Write([]byte("Hello ")); err != nil {
+		t.Fatalf("w.Write: %v", err)
+	}
+	// The storage is opened again while the writer is still in use. Its
+	// temporary file must not be deleted.
+	if _, err := Open(dir, mk); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s2, err := Open(dir, mk, WithExclusiveAccess())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if res, err := s2.RollbackPendingOps(); err != nil || len(res) != 0 {
+		t.Fatalf("s2.RollbackPendingOps() = %v, %v", res, err)
+	}
+	if _, err := w.Write([]byte("world!")); err != nil {
+		t.Fatalf("w.Write: %v", err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("w.Commit: %v", err)
+	}
+	if got, want := readBlob(t, s, "blob"), []byte("Hello world!"); !bytes.Equal(got, want) {
+		t.Errorf("Unexpected content. Want %q, got %q", want, got)
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, "pending", "*")); len(m) > 0 {
+		t.Errorf("Unexpected pending ops: %v", m)
+	}
+}
+
+func TestBlobSize(t *testing.T) {
+	testcases := []struct {
+		name string
+		mk   crypto.EncryptionKey
+		opts []Option
+	}{
+		{"AES", aesEncryptionKey(), nil},
+		{"Chacha20Poly1305", ccEncryptionKey(), nil},
+		{"PlainText", nil, nil},
+		{"Compressed", aesEncryptionKey(), []Option{WithCompression()}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := New(t.TempDir(), tc.mk, tc.opts...)
+			for _, size := range []int{0, 1, 1024 * 1024, 2*1024*1024 + 17} {
+				writeBlob(t, s, "blob", make([]byte, size))
+				if got, err := s.BlobSize("blob"); err != nil || got != int64(size) {
+					t.Errorf("s.BlobSize() = %d, %v, want %d", got, err, size)
+				}
+			}
+
+			bf, err := s.OpenBlobFile("paged")
+			if err != nil {
+				t.Fatalf("s.OpenBlobFile: %v", err)
+			}
+			if _, err := bf.WriteAt([]byte("hello"), 100000); err != nil {
+				t.Fatalf("bf.WriteAt: %v", err)
+			}
+			bf.Close()
+			if got, err := s.BlobSize("paged"); err != nil || got != 100005 {
+				t.Errorf("s.BlobSize() = %d, %v, want %d", got, err, 100005)
+			}
+			if _, err := s.BlobSize("nothere"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("s.BlobSize(nothere) = %v", err)
+			}
+		})
+	}
+}
+
+func TestCopyBlob(t *testing.T) {
+	src := New(t.TempDir(), aesEncryptionKey())
+	dst := New(t.TempDir(), ccEncryptionKey())
+	content := make([]byte, 3*1024*1024+5)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	writeBlob(t, src, "src", content)
+
+	if err := CopyBlob(dst, "dir/dst", src, "src"); err != nil {
+		t.Fatalf("CopyBlob: %v", err)
+	}
+	if got := readBlob(t, dst, "dir/dst"); !bytes.Equal(content, got) {
+		t.Error("Unexpected content")
+	}
+	if err := dst.VerifyBlob("dir/dst"); err != nil {
+		t.Errorf("dst.VerifyBlob: %v", err)
+	}
+	if err := CopyBlob(dst, "dir/dst", src, "nothere"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("CopyBlob(nothere) = %v", err)
+	}
+	if got := readBlob(t, dst, "dir/dst"); !bytes.Equal(content, got) {
+		t.Error("Unexpected content after failed copy")
+	}
+}
@@ -0,0 +1,413 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+const (
+	// optPaged indicates that the file contains a blob stored in pages that
+	// can be rewritten individually.
+	optPaged = 0x06
+
+	blobPageSize       = 64 * 1024
+	blobPageHeaderSize = 12
+	// blobPageLast is set in the data size of the last page.
+	blobPageLast = 1 << 31
+)
+
+// errTruncatedBlobFile indicates that pages are missing at the end of a paged
+// blob file.
+var errTruncatedBlobFile = errors.New("truncated blob file")
+
+// Paged blob files contain a header, followed by the encrypted file key (if
+// encrypted), followed by pages of equal size. When the file is encrypted,
+// each page is encrypted individually with the file key. The plaintext page
+// is:
+//
+//	page number (uint64) | last (1 bit) | data size (31 bits) | data (padded to blobPageSize)
+//
+// Every page has blobPageSize bytes of data, except the last one. Since each
+// page is encrypted with its own random nonce, a page can be re-encrypted
+// without rewriting the rest of the file. The page number detects pages that
+// are moved within the file, and the last bit, which is only set on the last
+// page, detects pages that are removed from the end of the file. There is
+// always at least one page, even when the blob is empty.
+//
+// When the file isn't encrypted, the pages are simply the content of the blob.
+
+// BlobFile is a blob that supports random-access reads and writes. Only the
+// pages affected by a write are re-encrypted.
+//
+// Writes are not atomic. If the process dies in the middle of a write, some
+// pages may have the new content while others have the old content, and a
+// partially written page can't be decrypted. BlobFile is safe for concurrent
+// use by multiple goroutines, but not by multiple processes.
+type BlobFile struct {
+	s  *Storage
+	mu sync.Mutex
+	f  *syncFile
+	k  crypto.EncryptionKey
+	// The offset of the first page in the file.
+	start int64
+	// The size of an encrypted page.
+	slotSize int64
+	// The size of the blob content.
+	size int64
+	// The number of pages.
+	numPages int64
+}
+
+// OpenBlobFile opens a blob file for random-access reads and writes. The file
+// is created if it doesn't exist.
+func (s *Storage) OpenBlobFile(filename string) (*BlobFile, error) {
+	return s.openBlobFile(filename, true)
+}
+
+func (s *Storage) openBlobFile(filename string, create bool) (retBF *BlobFile, retErr error) {
+	fn := filepath.Join(s.dir, filename)
+	flags := os.O_RDWR
+	if s.durability == DurabilityFull {
+		flags |= os.O_SYNC
+	}
+	of, err := s.backend.OpenFile(fn, flags, 0600)
+	if errors.Is(err, os.ErrNotExist) && create {
+		err = s.createKeyedFile(fn, optPaged, func(k crypto.EncryptionKey, w io.Writer) error {
+			page, err := encodeBlobPage(k, 0, nil, true)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(page)
+			return err
+		})
+		if err == nil || errors.Is(err, os.ErrExist) {
+			of, err = s.backend.OpenFile(fn, flags, 0600)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	bf := &BlobFile{s: s, f: &syncFile{of, s}}
+	defer func() {
+		if retErr != nil {
+			bf.close()
+		}
+	}()
+
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(bf.f, hdr); err != nil {
+		return nil, err
+	}
+	if string(hdr[:4]) != "KRIN" {
+		return nil, errors.New("wrong file type")
+	}
+	if hdr[4]&optEncodingMask != optPaged {
+		return nil, errors.New("not a paged blob file")
+	}
+	if hdr[4]&optEncrypted != 0 {
+		if s.masterKey == nil {
+			return nil, errors.New("file is encrypted, but a master key was not provided")
+		}
+		if bf.k, err = s.masterKey.ReadEncryptedKey(bf.f); err != nil {
+			return nil, err
+		}
+	}
+	if bf.start, err = bf.f.Seek(0, io.SeekCurrent); err != nil {
+		return nil, err
+	}
+	fi, err := bf.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if bf.k == nil {
+		bf.size = fi.Size() - bf.start
+		return bf, nil
+	}
+
+	// The size of the encrypted pages only depends on the size of the
+	// plaintext.
+	enc, err := bf.k.Encrypt(make([]byte, blobPageHeaderSize+blobPageSize))
+	if err != nil {
+		return nil, err
+	}
+	bf.slotSize = int64(len(enc))
+	bf.numPages = (fi.Size() - bf.start) / bf.slotSize
+	if bf.numPages == 0 || (fi.Size()-bf.start)%bf.slotSize != 0 {
+		return nil, errTruncatedBlobFile
+	}
+	last, err := bf.readPage(bf.numPages - 1)
+	if err != nil {
+		return nil, err
+	}
+	bf.size = (bf.numPages-1)*blobPageSize + int64(len(last))
+	return bf, nil
+}
+
+// Size returns the size of the blob.
+func (bf *BlobFile) Size() int64 {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	return bf.size
+}
+
+// ReadAt implements io.ReaderAt.
+func (bf *BlobFile) ReadAt(b []byte, off int64) (int, error) {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	if off < 0 {
+		return 0, fs.ErrInvalid
+	}
+	if off >= bf.size {
+		return 0, io.EOF
+	}
+	var err error
+	if max := bf.size - off; int64(len(b)) > max {
+		b, err = b[:max], io.EOF
+	}
+	if bf.k == nil {
+		n, e := bf.f.ReadAt(b, bf.start+off)
+		if e != nil {
+			err = e
+		}
+		return n, err
+	}
+	var n int
+	for n < len(b) {
+		p := (off + int64(n)) / blobPageSize
+		page, e := bf.readPage(p)
+		if e != nil {
+			return n, e
+		}
+		n += copy(b[n:], page[off+int64(n)-p*blobPageSize:])
+	}
+	return n, err
+}
+
+// WriteAt implements io.WriterAt. Writing past the end of the blob extends it,
+// and the gap, if any, is filled with zeros.
+func (bf *BlobFile) WriteAt(b []byte, off int64) (int, error) {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	if off < 0 {
+		return 0, fs.ErrInvalid
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	end := off + int64(len(b))
+	if bf.k == nil {
+		n, err := bf.f.WriteAt(b, bf.start+off)
+		if e := off + int64(n); e > bf.size {
+			bf.size = e
+		}
+		return n, err
+	}
+
+	first := off / blobPageSize
+	if bf.size < off {
+		// Rewrite the last page to fill the gap.
+		first = bf.size / blobPageSize
+	}
+	last := (end - 1) / blobPageSize
+	numPages := max(bf.numPages, last+1)
+	if numPages > bf.numPages {
+		// The current last page is no longer the last one.
+		first = min(first, bf.numPages-1)
+	}
+	var n int
+	for p := first; p <= last; p++ {
+		var page []byte
+		if p < bf.numPages {
+			var err error
+			if page, err = bf.readPage(p); err != nil {
+				return n, err
+			}
+		}
+		pageStart := p * blobPageSize
+		if sz := min(blobPageSize, end-pageStart); int64(len(page)) < sz {
+			page = append(page, make([]byte, sz-int64(len(page)))...)
+		}
+		if off < pageStart+blobPageSize && end > pageStart {
+			from := max(off, pageStart)
+			n += copy(page[from-pageStart:], b[from-off:])
+		}
+		if err := bf.writePage(p, page, p == numPages-1); err != nil {
+			return n, err
+		}
+		if p >= bf.numPages {
+			bf.numPages = p + 1
+		}
+		if e := pageStart + int64(len(page)); e > bf.size {
+			bf.size = e
+		}
+	}
+	return n, nil
+}
+
+// Truncate changes the size of the blob. Extending the blob fills it with
+// zeros.
+func (bf *BlobFile) Truncate(size int64) error {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	if size < 0 {
+		return fs.ErrInvalid
+	}
+	if bf.k == nil {
+		if err := bf.f.Truncate(bf.start + size); err != nil {
+			return err
+		}
+		bf.size = size
+		return nil
+	}
+	if size == bf.size {
+		return nil
+	}
+	numPages := max(1, (size+blobPageSize-1)/blobPageSize)
+	if size > bf.size {
+		// Rewrite the last page and add new ones, filled with zeros.
+		first := bf.numPages - 1
+		for p := first; p < numPages; p++ {
+			var page []byte
+			if p < bf.numPages {
+				var err error
+				if page, err = bf.readPage(p); err != nil {
+					return err
+				}
+			}
+			sz := min(blobPageSize, size-p*blobPageSize)
+			page = append(page, make([]byte, sz-int64(len(page)))...)
+			if err := bf.writePage(p, page, p == numPages-1); err != nil {
+				return err
+			}
+		}
+	} else {
+		// Rewrite the new last page.
+		page, err := bf.readPage(numPages - 1)
+		if err != nil {
+			return err
+		}
+		if err := bf.writePage(numPages-1, page[:size-(numPages-1)*blobPageSize], true); err != nil {
+			return err
+		}
+	}
+	if err := bf.f.Truncate(bf.start + numPages*bf.slotSize); err != nil {
+		return err
+	}
+	bf.size, bf.numPages = size, numPages
+	return nil
+}
+
+// Sync commits the content of the blob to stable storage.
+func (bf *BlobFile) Sync() error {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	return bf.f.Sync()
+}
+
+// readPage reads and decrypts page p.
+func (bf *BlobFile) readPage(p int64) ([]byte, error) {
+	enc := make([]byte, bf.slotSize)
+	if _, err := bf.f.ReadAt(enc, bf.start+p*bf.slotSize); err != nil {
+		return nil, err
+	}
+	dec, err := bf.k.Decrypt(enc)
+	if err != nil {
+		return nil, err
+	}
+	if len(dec) != blobPageHeaderSize+blobPageSize || int64(binary.BigEndian.Uint64(dec[:8])) != p {
+		return nil, errors.New("invalid blob page")
+	}
+	size := int64(binary.BigEndian.Uint32(dec[8:12]))
+	last := size&blobPageLast != 0
+	size &^= blobPageLast
+	if size > blobPageSize || (size < blobPageSize && p < bf.numPages-1) {
+		return nil, errors.New("invalid blob page")
+	}
+	if isLast := p == bf.numPages-1; last != isLast {
+		if isLast {
+			return nil, errTruncatedBlobFile
+		}
+		return nil, errors.New("invalid blob page")
+	}
+	return dec[blobPageHeaderSize : blobPageHeaderSize+size], nil
+}
+
+// writePage encrypts and writes page p. last is true when p is the last page.
+func (bf *BlobFile) writePage(p int64, data []byte, last bool) error {
+	enc, err := encodeBlobPage(bf.k, p, data, last)
+	if err != nil {
+		return err
+	}
+	if int64(len(enc)) != bf.slotSize {
+		return errors.New("unexpected encrypted page size")
+	}
+	_, err = bf.f.WriteAt(enc, bf.start+p*bf.slotSize)
+	return err
+}
+
+// encodeBlobPage returns page p, encrypted with k.
+func encodeBlobPage(k crypto.EncryptionKey, p int64, data []byte, last bool) ([]byte, error) {
+	dec := make([]byte, blobPageHeaderSize+blobPageSize)
+	binary.BigEndian.PutUint64(dec[:8], uint64(p))
+	size := uint32(len(data))
+	if last {
+		size |= blobPageLast
+	}
+	binary.BigEndian.PutUint32(dec[8:12], size)
+	copy(dec[blobPageHeaderSize:], data)
+	return k.Encrypt(dec)
+}
+
+// Close closes the blob file.
+func (bf *BlobFile) Close() error {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	return bf.close()
+}
+
+func (bf *BlobFile) close() error {
+	if bf.k != nil {
+		bf.k.Wipe()
+	}
+	return bf.f.Close()
+}
+
+// blobFileReader reads a BlobFile sequentially.
+type blobFileReader struct {
+	*io.SectionReader
+	bf *BlobFile
+}
+
+func (r *blobFileReader) Close() error {
+	return r.bf.Close()
+}
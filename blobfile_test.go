@@ -0,0 +1,254 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+func TestBlobFile(t *testing.T) {
+	testcases := []struct {
+		name string
+		mk   crypto.EncryptionKey
+	}{
+		{"AES", aesEncryptionKey()},
+		{"Chacha20Poly1305", ccEncryptionKey()},
+		{"PlainText", nil},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := New(dir, tc.mk)
+			var want []byte
+			writeAt := func(bf *BlobFile, off int64, size int) {
+				t.Helper()
+				b := make([]byte, size)
+				rand.Read(b)
+				if n, err := bf.WriteAt(b, off); err != nil || n != size {
+					t.Fatalf("bf.WriteAt(%d, %d) = %d, %v", size, off, n, err)
+				}
+				if end := off + int64(size); end > int64(len(want)) {
+					want = append(want, make([]byte, end-int64(len(want)))...)
+				}
+				copy(want[off:], b)
+			}
+			check := func(bf *BlobFile) {
+				t.Helper()
+				if got := bf.Size(); got != int64(len(want)) {
+					t.Fatalf("bf.Size() = %d, want %d", got, len(want))
+				}
+				got := make([]byte, len(want)+10)
+				n, err := bf.ReadAt(got, 0)
+				if err != io.EOF || n != len(want) {
+					t.Fatalf("bf.ReadAt() = %d, %v", n, err)
+				}
+				if !bytes.Equal(want, got[:n]) {
+					t.Fatal("Unexpected content")
+				}
+			}
+
+			bf, err := s.OpenBlobFile("blob")
+			if err != nil {
+				t.Fatalf("s.OpenBlobFile: %v", err)
+			}
+			check(bf)
+			writeAt(bf, 0, 3*blobPageSize+100)
+			check(bf)
+			if err := bf.Close(); err != nil {
+				t.Fatalf("bf.Close: %v", err)
+			}
+
+			before, err := os.ReadFile(filepath.Join(dir, "blob"))
+			if err != nil {
+				t.Fatalf("os.ReadFile: %v", err)
+			}
+			if bf, err = s.OpenBlobFile("blob"); err != nil {
+				t.Fatalf("s.OpenBlobFile: %v", err)
+			}
+			check(bf)
+			// Across the boundary between the first and second pages.
+			writeAt(bf, blobPageSize-10, 20)
+			check(bf)
+			after, err := os.ReadFile(filepath.Join(dir, "blob"))
+			if err != nil {
+				t.Fatalf("os.ReadFile: %v", err)
+			}
+			if bf.k != nil {
+				// Only the first two pages were re-encrypted.
+				if n := bf.start + 2*bf.slotSize; !bytes.Equal(before[n:], after[n:]) {
+					t.Error("Unaffected pages were modified")
+				}
+				if n := bf.start + bf.slotSize; bytes.Equal(before[bf.start:n], after[bf.start:n]) {
+					t.Error("First page wasn't modified")
+				}
+			}
+
+			// Extend the blob with a gap.
+			writeAt(bf, 5*blobPageSize+7, 10)
+			check(bf)
+			// Small write in the last page.
+			writeAt(bf, int64(len(want))-3, 5)
+			check(bf)
+			b := make([]byte, 100)
+			if n, err := bf.ReadAt(b, blobPageSize-50); err != nil || !bytes.Equal(b[:n], want[blobPageSize-50:blobPageSize+50]) {
+				t.Fatalf("bf.ReadAt = %d, %v", n, err)
+			}
+			if err := bf.Close(); err != nil {
+				t.Fatalf("bf.Close: %v", err)
+			}
+
+			if got := readBlob(t, s, "blob"); !bytes.Equal(want, got) {
+				t.Errorf("OpenBlobRead: unexpected content")
+			}
+		})
+	}
+}
+
+func TestBlobFileWrongKey(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, aesEncryptionKey())
+	bf, err := s.OpenBlobFile("blob")
+	if err != nil {
+		t.Fatalf("s.OpenBlobFile: %v", err)
+	}
+	if _, err := bf.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatalf("bf.WriteAt: %v", err)
+	}
+	if err := bf.Close(); err != nil {
+		t.Fatalf("bf.Close: %v", err)
+	}
+	if _, err := New(dir, ccEncryptionKey()).OpenBlobFile("blob"); err == nil {
+		t.Fatal("OpenBlobFile with the wrong key didn't fail")
+	}
+	if _, err := New(dir, nil).OpenBlobFile("blob"); err == nil {
+		t.Fatal("OpenBlobFile without a key didn't fail")
+	}
+}
+
+func TestBlobFileTruncate(t *testing.T) {
+	for _, mk := range []crypto.EncryptionKey{aesEncryptionKey(), nil} {
+		s := New(t.TempDir(), mk)
+		bf, err := s.OpenBlobFile("blob")
+		if err != nil {
+			t.Fatalf("s.OpenBlobFile: %v", err)
+		}
+		want := make([]byte, 3*blobPageSize+100)
+		rand.Read(want)
+		if _, err := bf.WriteAt(want, 0); err != nil {
+			t.Fatalf("bf.WriteAt: %v", err)
+		}
+		for _, size := range []int64{2*blobPageSize + 10, 2 * blobPageSize, 2*blobPageSize + 5, 4*blobPageSize + 1, 0, 10} {
+			if err := bf.Truncate(size); err != nil {
+				t.Fatalf("bf.Truncate(%d): %v", size, err)
+			}
+			if size <= int64(len(want)) {
+				want = want[:size]
+			} else {
+				want = append(want, make([]byte, size-int64(len(want)))...)
+			}
+			if got := bf.Size(); got != size {
+				t.Fatalf("bf.Size() = %d, want %d", got, size)
+			}
+			got := make([]byte, size)
+			if _, err := bf.ReadAt(got, 0); err != nil && err != io.EOF {
+				t.Fatalf("bf.ReadAt: %v", err)
+			}
+			if !bytes.Equal(want, got) {
+				t.Fatalf("Unexpected content after Truncate(%d)", size)
+			}
+		}
+		if err := bf.Sync(); err != nil {
+			t.Fatalf("bf.Sync: %v", err)
+		}
+		if err := bf.Close(); err != nil {
+			t.Fatalf("bf.Close: %v", err)
+		}
+		if got := readBlob(t, s, "blob"); !bytes.Equal(want, got) {
+			t.Errorf("OpenBlobRead: unexpected content %v, want %v", got, want)
+		}
+	}
+}
+
+func TestBlobFileTruncated(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, aesEncryptionKey())
+	bf, err := s.OpenBlobFile("blob")
+	if err != nil {
+		t.Fatalf("s.OpenBlobFile: %v", err)
+	}
+	want := make([]byte, 2*blobPageSize+100)
+	rand.Read(want)
+	if _, err := bf.WriteAt(want, 0); err != nil {
+		t.Fatalf("bf.WriteAt: %v", err)
+	}
+	start, slotSize := bf.start, bf.slotSize
+	if err := bf.Close(); err != nil {
+		t.Fatalf("bf.Close: %v", err)
+	}
+	fn := filepath.Join(dir, "blob")
+	orig, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		size int64
+	}{
+		{"last page", start + 2*slotSize},
+		{"two pages", start + slotSize},
+		{"all pages", start},
+		{"partial page", start + 3*slotSize - 10},
+	} {
+		if err := os.WriteFile(fn, orig[:tc.size], 0600); err != nil {
+			t.Fatalf("os.WriteFile: %v", err)
+		}
+		if _, err := s.OpenBlobFile("blob"); !errors.Is(err, errTruncatedBlobFile) {
+			t.Errorf("%s: OpenBlobFile() = %v, want errTruncatedBlobFile", tc.name, err)
+		}
+		if _, err := s.OpenBlobRead("blob"); !errors.Is(err, errTruncatedBlobFile) {
+			t.Errorf("%s: OpenBlobRead() = %v, want errTruncatedBlobFile", tc.name, err)
+		}
+	}
+
+	// A new empty blob has one page.
+	bf, err = s.OpenBlobFile("empty")
+	if err != nil {
+		t.Fatalf("s.OpenBlobFile: %v", err)
+	}
+	if bf.numPages != 1 || bf.Size() != 0 {
+		t.Errorf("numPages = %d, size = %d, want 1, 0", bf.numPages, bf.Size())
+	}
+	if err := bf.Close(); err != nil {
+		t.Fatalf("bf.Close: %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package blobstore stores blobs by the hash of their content, on top of an
+// encrypted storage.
+//
+// Identical content is stored only once. Each blob has a reference count that
+// is incremented by Put and decremented by Release. The blob is deleted when
+// its last reference is released.
+//
+// The digest of a blob is the hex encoded SHA-256 of its content. The digests
+// are not visible in the file names.
+//
+// Example:
+//
+//	bs := blobstore.New(s, "blobs")
+//	digest, err := bs.Put(r)
+//	if err != nil {
+//		return err
+//	}
+//	...
+//	f, err := bs.Open(digest)
+//	if err != nil {
+//		return err
+//	}
+//	defer f.Close()
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+)
+
+// ErrNotFound is returned when a blob doesn't exist.
+var ErrNotFound = errors.New("blob not found")
+
+const fanoutLevels = 2
+
+// Info is the information about a blob.
+type Info struct {
+	// Digest is the hex encoded SHA-256 of the content.
+	Digest string `json:"digest"`
+	// Size is the size of the content.
+	Size int64 `json:"size"`
+	// Refs is the number of references to the blob.
+	Refs int `json:"refs"`
+	// Created is when the blob was first stored.
+	Created time.Time `json:"created"`
+}
+
+// Store stores content-addressed blobs.
+type Store struct {
+	s   *storage.Storage
+	dir string
+	seq atomic.Int64
+}
+
+// New returns a Store that keeps the blobs in dir.
+func New(s *storage.Storage, dir string) *Store {
+	return &Store{s: s, dir: dir}
+}
+
+// refFileName returns the name of the file that has the reference count of a
+// blob.
+func (bs *Store) refFileName(digest string) string {
+	return filepath.Join(bs.dir, "refs", bs.s.FanoutPath(digest, fanoutLevels))
+}
+
+// blobFileName returns the name of the file that has the content of a blob.
+func (bs *Store) blobFileName(digest string) string {
+	return filepath.Join(bs.dir, "data", bs.s.FanoutPath(digest, fanoutLevels))
+}
+
+func validDigest(digest string) bool {
+	b, err := hex.DecodeString(digest)
+	return err == nil && len(b) == sha256.Size
+}
+
+// Put stores the content of r, and returns its digest. If a blob with the same
+// content already exists, its reference count is incremented instead.
+//
+// The content is first written to a temporary blob while its digest is
+// computed. It is then moved to its final name only if it isn't a duplicate.
+func (bs *Store) Put(r io.Reader) (digest string, retErr error) {
+	tmp := filepath.Join(bs.dir, "tmp", fmt.Sprintf("%d-%d", time.Now().UnixNano(), bs.seq.Add(1)))
+	w, err := bs.s.CreateBlob(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer w.Abort()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(w, h), r)
+	if err != nil {
+		return "", err
+	}
+	if err := w.Commit(); err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := bs.s.DeleteFile(tmp); err != nil && !errors.Is(err, fs.ErrNotExist) && retErr == nil {
+			retErr = err
+		}
+	}()
+	digest = hex.EncodeToString(h.Sum(nil))
+
+	refFile := bs.refFileName(digest)
+	tx, err := bs.s.Begin(refFile)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	var info Info
+	if err := tx.Read(refFile, &info); errors.Is(err, fs.ErrNotExist) {
+		info = Info{Digest: digest, Size: size, Created: time.Now().UTC()}
+	} else if err != nil {
+		return "", err
+	}
+	exists := info.Refs > 0
+	if exists {
+		// The blob may be missing if the process died while it was being
+		// released.
+		if _, err := bs.s.BlobSize(bs.blobFileName(digest)); errors.Is(err, fs.ErrNotExist) {
+			exists = false
+		} else if err != nil {
+			return "", err
+		}
+	}
+	if !exists {
+		if err := bs.s.RenameFile(tmp, bs.blobFileName(digest)); err != nil {
+			return "", err
+		}
+	}
+	info.Refs++
+	if err := tx.Write(refFile, info); err != nil {
+		return "", err
+	}
+	return digest, tx.Commit()
+}
+
+// Stat returns information about a blob.
+func (bs *Store) Stat(digest string) (Info, error) {
+	if !validDigest(digest) {
+		return Info{}, ErrNotFound
+	}
+	var info Info
+	if err := bs.s.ReadDataFile(bs.refFileName(digest), &info); errors.Is(err, fs.ErrNotExist) {
+		return Info{}, ErrNotFound
+	} else if err != nil {
+		return Info{}, err
+	}
+	return info, nil
+}
+
+// Open opens a blob for reading.
+func (bs *Store) Open(digest string) (io.ReadSeekCloser, error) {
+	if !validDigest(digest) {
+		return nil, ErrNotFound
+	}
+	r, err := bs.s.OpenBlobRead(bs.blobFileName(digest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return r, err
+}
+
+// AddRef increments the reference count of an existing blob.
+func (bs *Store) AddRef(digest string) error {
+	return bs.update(digest, func(tx *storage.Tx, info *Info) error {
+		info.Refs++
+		return tx.Write(bs.refFileName(digest), info)
+	})
+}
+
+// Release decrements the reference count of a blob, and deletes the blob when
+// the count reaches zero.
+func (bs *Store) Release(digest string) error {
+	return bs.update(digest, func(tx *storage.Tx, info *Info) error {
+		if info.Refs--; info.Refs > 0 {
+			return tx.Write(bs.refFileName(digest), info)
+		}
+		if err := bs.s.DeleteFile(bs.blobFileName(digest)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return tx.Delete(bs.refFileName(digest))
+	})
+}
+
+// update calls fn with the information of an existing blob in a transaction,
+// and commits the changes if fn returns nil.
+func (bs *Store) update(digest string, fn func(tx *storage.Tx, info *Info) error) error {
+	if !validDigest(digest) {
+		return ErrNotFound
+	}
+	refFile := bs.refFileName(digest)
+	tx, err := bs.s.Begin(refFile)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var info Info
+	if err := tx.Read(refFile, &info); errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	if err := fn(tx, &info); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
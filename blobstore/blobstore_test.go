@@ -0,0 +1,156 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/storage/blobstore"
+	"github.com/c2FmZQ/storage/internal/storagetest"
+)
+
+func put(t *testing.T, bs *blobstore.Store, content string) string {
+	t.Helper()
+	digest, err := bs.Put(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	return digest
+}
+
+func read(t *testing.T, bs *blobstore.Store, digest string) string {
+	t.Helper()
+	r, err := bs.Open(digest)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	return string(b)
+}
+
+func TestPutOpen(t *testing.T) {
+	bs := blobstore.New(storagetest.New(t), "blobs")
+	content := strings.Repeat("Hello world! ", 10000)
+	digest := put(t, bs, content)
+
+	sum := sha256.Sum256([]byte(content))
+	if want := hex.EncodeToString(sum[:]); digest != want {
+		t.Errorf("Put() = %q, want %q", digest, want)
+	}
+	if got := read(t, bs, digest); got != content {
+		t.Errorf("Unexpected content. Got %d bytes, want %d", len(got), len(content))
+	}
+	info, err := bs.Stat(digest)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Digest != digest || info.Size != int64(len(content)) || info.Refs != 1 {
+		t.Errorf("Stat() = %+v", info)
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	s := storagetest.New(t)
+	bs := blobstore.New(s, "blobs")
+	d1 := put(t, bs, "same content")
+	d2 := put(t, bs, "same content")
+	d3 := put(t, bs, "other content")
+	if d1 != d2 {
+		t.Errorf("Digests differ: %q != %q", d1, d2)
+	}
+	if d1 == d3 {
+		t.Errorf("Digests are the same: %q", d1)
+	}
+	if info, err := bs.Stat(d1); err != nil || info.Refs != 2 {
+		t.Errorf("Stat(d1) = %+v, %v", info, err)
+	}
+
+	var files []string
+	if err := fs.WalkDir(s.FS(), "blobs/data", func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	}); err != nil {
+		t.Fatalf("WalkDir: %v", err)
+	}
+	if len(files) != 2 {
+		t.Errorf("Unexpected blob files: %v", files)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	bs := blobstore.New(storagetest.New(t), "blobs")
+	digest := put(t, bs, "content")
+	if err := bs.AddRef(digest); err != nil {
+		t.Fatalf("AddRef: %v", err)
+	}
+	if err := bs.Release(digest); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if got := read(t, bs, digest); got != "content" {
+		t.Errorf("Open() = %q, want %q", got, "content")
+	}
+	if err := bs.Release(digest); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if _, err := bs.Open(digest); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Errorf("Open() = %v, want ErrNotFound", err)
+	}
+	if err := bs.Release(digest); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Errorf("Release() = %v, want ErrNotFound", err)
+	}
+
+	// Storing the content again after it was deleted.
+	if d := put(t, bs, "content"); d != digest {
+		t.Errorf("Put() = %q, want %q", d, digest)
+	}
+	if got := read(t, bs, digest); got != "content" {
+		t.Errorf("Open() = %q, want %q", got, "content")
+	}
+}
+
+func TestInvalidDigest(t *testing.T) {
+	bs := blobstore.New(storagetest.New(t), "blobs")
+	if _, err := bs.Open("../foo"); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Errorf("Open() = %v, want ErrNotFound", err)
+	}
+	if _, err := bs.Stat(""); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Errorf("Stat() = %v, want ErrNotFound", err)
+	}
+	if err := bs.AddRef(hex.EncodeToString(bytes.Repeat([]byte{1}, 32))); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Errorf("AddRef() = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,865 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package btree is an ordered key-value store, on top of an encrypted
+// storage.
+//
+// The keys are kept in a B+tree whose nodes are stored in encrypted page
+// files. The changes are copy-on-write: a write transaction writes new pages
+// for the nodes that it changes, and commits by replacing the meta file that
+// points to the root of the tree. The old pages are deleted after the commit.
+// If the process dies in the middle of a commit, the tree is unchanged.
+//
+// The keys are sorted lexicographically, and they can be iterated in order
+// with a Cursor, or with Range.
+//
+// Example:
+//
+//	db, err := btree.Open(s, "index")
+//	if err != nil {
+//		return err
+//	}
+//	defer db.Close()
+//	err = db.Update(func(tx *btree.Tx) error {
+//		return tx.Put([]byte("2023-01-01/alice"), value)
+//	})
+//	...
+//	err = db.View(func(tx *btree.Tx) error {
+//		return tx.Range([]byte("2023-01-"), []byte("2023-02-"), func(k, v []byte) error {
+//			...
+//		})
+//	})
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/c2FmZQ/storage"
+)
+
+var (
+	// ErrClosed is returned when the DB is closed.
+	ErrClosed = errors.New("db is closed")
+	// ErrLocked is returned by Open when the DB is already open.
+	ErrLocked = errors.New("db is already open")
+	// ErrNotFound is returned by Get when a key doesn't exist.
+	ErrNotFound = errors.New("key not found")
+	// ErrTxNotWritable is returned when a read-only transaction is used to
+	// make changes.
+	ErrTxNotWritable = errors.New("transaction isn't writable")
+	// ErrTxDone is returned when a transaction is used after it ended.
+	ErrTxDone = errors.New("transaction is done")
+	// ErrCorruptPage is returned when a page can't be decoded.
+	ErrCorruptPage = errors.New("corrupt page")
+)
+
+const (
+	defaultMaxKeys   = 128
+	defaultCacheSize = 1024
+
+	lockFile = "btree"
+	metaFile = "meta"
+	pageDir  = "pages"
+)
+
+// pageRE matches the names of the page files.
+var pageRE = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// Option is used to specify optional parameters of Open.
+type Option func(*DB)
+
+// WithMaxKeys specifies the maximum number of keys in a node. Larger nodes
+// mean fewer, but larger, pages. The default is 128.
+func WithMaxKeys(n int) Option {
+	return func(db *DB) {
+		db.maxKeys = n
+	}
+}
+
+// WithCacheSize specifies the number of decoded pages that are cached in
+// memory. The default is 1024.
+func WithCacheSize(n int) Option {
+	return func(db *DB) {
+		db.cacheSize = n
+	}
+}
+
+// meta is the content of the meta file.
+type meta struct {
+	// Root is the ID of the root page, or 0 if the tree is empty.
+	Root uint64 `json:"root"`
+	// NextID is the ID of the next new page.
+	NextID uint64 `json:"nextId"`
+	// Free are the pages that are no longer used after the last commit, and
+	// that may not be deleted yet.
+	Free []uint64 `json:"free,omitempty"`
+}
+
+// DB is an ordered key-value store. It is safe for concurrent use. There can
+// be many concurrent read transactions, or one write transaction.
+type DB struct {
+	s         *storage.Storage
+	dir       string
+	maxKeys   int
+	cacheSize int
+
+	mu     sync.RWMutex
+	closed bool
+	meta   meta
+
+	cacheMu sync.Mutex
+	cache   map[uint64]*node
+}
+
+// Open opens the DB in dir. Only one DB can have the DB open at a time,
+// including in other processes.
+func Open(s *storage.Storage, dir string, opts ...Option) (*DB, error) {
+	db := &DB{
+		s:         s,
+		dir:       dir,
+		maxKeys:   defaultMaxKeys,
+		cacheSize: defaultCacheSize,
+		meta:      meta{NextID: 1},
+		cache:     make(map[uint64]*node),
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+	if db.maxKeys < 3 {
+		return nil, fmt.Errorf("invalid max keys: %d", db.maxKeys)
+	}
+	if err := s.MkdirAll(dir); err != nil {
+		return nil, err
+	}
+	ok, err := s.TryLock(filepath.Join(dir, lockFile))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrLocked
+	}
+	if err := db.load(); err != nil {
+		s.Unlock(filepath.Join(dir, lockFile))
+		return nil, err
+	}
+	return db, nil
+}
+
+// load reads the meta file, and deletes the pages that aren't used, e.g.
+// because the process died during or after a commit.
+func (db *DB) load() error {
+	if err := db.s.ReadDataFile(filepath.Join(db.dir, metaFile), &db.meta); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, id := range db.meta.Free {
+		if err := db.deletePage(id); err != nil {
+			return err
+		}
+	}
+	db.meta.Free = nil
+	entries, err := db.s.FS().ReadDir(filepath.ToSlash(filepath.Join(db.dir, pageDir)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !pageRE.MatchString(e.Name()) {
+			continue
+		}
+		id, err := strconv.ParseUint(e.Name(), 16, 64)
+		if err != nil {
+			return err
+		}
+		if id >= db.meta.NextID {
+			if err := db.deletePage(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes the DB. It waits for the transactions in progress to end.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	return db.s.Unlock(filepath.Join(db.dir, lockFile))
+}
+
+// View calls fn in a read-only transaction.
+func (db *DB) View(fn func(tx *Tx) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	tx := &Tx{db: db, root: db.meta.Root}
+	defer func() { tx.done = true }()
+	return fn(tx)
+}
+
+// Update calls fn in a write transaction. The transaction is committed if fn
+// returns nil, and rolled back otherwise.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	tx := &Tx{
+		db:       db,
+		writable: true,
+		root:     db.meta.Root,
+		nextID:   db.meta.NextID,
+		dirty:    make(map[uint64]*node),
+	}
+	defer func() { tx.done = true }()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+func (db *DB) pageName(id uint64) string {
+	return filepath.Join(db.dir, pageDir, fmt.Sprintf("%016x", id))
+}
+
+func (db *DB) deletePage(id uint64) error {
+	db.cacheMu.Lock()
+	delete(db.cache, id)
+	db.cacheMu.Unlock()
+	if err := db.s.DeleteFile(db.pageName(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// readPage returns a committed page. The pages never change after they are
+// committed, so they can be cached.
+func (db *DB) readPage(id uint64) (*node, error) {
+	db.cacheMu.Lock()
+	n, ok := db.cache[id]
+	db.cacheMu.Unlock()
+	if ok {
+		return n, nil
+	}
+	n = &node{}
+	if err := db.s.ReadDataFile(db.pageName(id), n); err != nil {
+		return nil, err
+	}
+	db.cacheMu.Lock()
+	defer db.cacheMu.Unlock()
+	if len(db.cache) >= db.cacheSize {
+		for k := range db.cache {
+			delete(db.cache, k)
+			if len(db.cache) < db.cacheSize {
+				break
+			}
+		}
+	}
+	if db.cacheSize > 0 {
+		db.cache[id] = n
+	}
+	return n, nil
+}
+
+// Tx is a transaction. It is only valid in the function that is passed to
+// View or Update, and it is not safe for concurrent use.
+//
+// The keys and values that are returned by a transaction must not be
+// modified, and they are only valid until the end of the transaction.
+type Tx struct {
+	db       *DB
+	writable bool
+	done     bool
+	root     uint64
+	nextID   uint64
+	// dirty are the pages that are new or changed in the transaction.
+	dirty map[uint64]*node
+	// freed are the committed pages that the transaction replaced or
+	// removed.
+	freed []uint64
+}
+
+// node returns a page, which may be dirty.
+func (tx *Tx) node(id uint64) (*node, error) {
+	if n, ok := tx.dirty[id]; ok {
+		return n, nil
+	}
+	return tx.db.readPage(id)
+}
+
+// modify returns a dirty copy of a page, with its new ID.
+func (tx *Tx) modify(id uint64) (uint64, *node, error) {
+	if n, ok := tx.dirty[id]; ok {
+		return id, n, nil
+	}
+	n, err := tx.db.readPage(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	tx.freed = append(tx.freed, id)
+	n = n.clone()
+	return tx.add(n), n, nil
+}
+
+// add adds a new dirty page, and returns its ID.
+func (tx *Tx) add(n *node) uint64 {
+	id := tx.nextID
+	tx.nextID++
+	tx.dirty[id] = n
+	return id
+}
+
+// drop removes a dirty page that is no longer used.
+func (tx *Tx) drop(id uint64) {
+	delete(tx.dirty, id)
+}
+
+func (tx *Tx) check(write bool) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if write && !tx.writable {
+		return ErrTxNotWritable
+	}
+	return nil
+}
+
+// commit writes the dirty pages, then the meta file, and then deletes the
+// freed pages.
+func (tx *Tx) commit() error {
+	if len(tx.dirty) == 0 && len(tx.freed) == 0 {
+		return nil
+	}
+	ids := make([]uint64, 0, len(tx.dirty))
+	for id := range tx.dirty {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if err := tx.db.s.SaveDataFile(tx.db.pageName(id), tx.dirty[id]); err != nil {
+			return err
+		}
+	}
+	m := meta{Root: tx.root, NextID: tx.nextID, Free: append(tx.db.meta.Free, tx.freed...)}
+	if err := tx.db.s.SaveDataFile(filepath.Join(tx.db.dir, metaFile), &m); err != nil {
+		return err
+	}
+	tx.db.meta = meta{Root: m.Root, NextID: m.NextID}
+	// The transaction is committed. The pages that can't be deleted now are
+	// deleted after the next commit, or the next time the DB is opened.
+	for _, id := range m.Free {
+		if err := tx.db.deletePage(id); err != nil {
+			tx.db.s.Logger().Errorf("btree: %s: %v", tx.db.pageName(id), err)
+			tx.db.meta.Free = append(tx.db.meta.Free, id)
+		}
+	}
+	return nil
+}
+
+// Get returns the value of a key. It returns ErrNotFound if the key doesn't
+// exist.
+func (tx *Tx) Get(key []byte) ([]byte, error) {
+	if err := tx.check(false); err != nil {
+		return nil, err
+	}
+	id := tx.root
+	for id != 0 {
+		n, err := tx.node(id)
+		if err != nil {
+			return nil, err
+		}
+		if !n.leaf {
+			id = n.children[n.childIndex(key)]
+			continue
+		}
+		if i, found := n.search(key); found {
+			return n.values[i], nil
+		}
+		break
+	}
+	return nil, ErrNotFound
+}
+
+// Put sets the value of a key, replacing the existing value, if any.
+func (tx *Tx) Put(key, value []byte) error {
+	if err := tx.check(true); err != nil {
+		return err
+	}
+	if len(key) == 0 {
+		return errors.New("empty key")
+	}
+	key, value = bytes.Clone(key), bytes.Clone(value)
+	if value == nil {
+		value = []byte{}
+	}
+	if tx.root == 0 {
+		tx.root = tx.add(&node{leaf: true})
+	}
+	id, sep, sibling, err := tx.put(tx.root, key, value)
+	if err != nil {
+		return err
+	}
+	tx.root = id
+	if sibling != 0 {
+		tx.root = tx.add(&node{keys: [][]byte{sep}, children: []uint64{id, sibling}})
+	}
+	return nil
+}
+
+// put inserts a key in the subtree of a page. If the page is split, it
+// returns the ID of the new sibling, and the first key of the sibling.
+func (tx *Tx) put(id uint64, key, value []byte) (uint64, []byte, uint64, error) {
+	id, n, err := tx.modify(id)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	if n.leaf {
+		i, found := n.search(key)
+		if found {
+			n.values[i] = value
+			return id, nil, 0, nil
+		}
+		n.keys = insertAt(n.keys, i, key)
+		n.values = insertAt(n.values, i, value)
+	} else {
+		i := n.childIndex(key)
+		child, sep, sibling, err := tx.put(n.children[i], key, value)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		n.children[i] = child
+		if sibling != 0 {
+			n.keys = insertAt(n.keys, i, sep)
+			n.children = insertAt(n.children, i+1, sibling)
+		}
+	}
+	if len(n.keys) <= tx.db.maxKeys {
+		return id, nil, 0, nil
+	}
+	sep, right := n.split()
+	return id, sep, tx.add(right), nil
+}
+
+// Delete deletes a key. Deleting a key that doesn't exist isn't an error.
+func (tx *Tx) Delete(key []byte) error {
+	if err := tx.check(true); err != nil {
+		return err
+	}
+	if _, err := tx.Get(key); errors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	id, empty, err := tx.delete(tx.root, key)
+	if err != nil {
+		return err
+	}
+	if empty {
+		tx.drop(id)
+		tx.root = 0
+		return nil
+	}
+	tx.root = id
+	for {
+		n := tx.dirty[tx.root]
+		if n == nil || n.leaf || len(n.children) != 1 {
+			return nil
+		}
+		tx.drop(tx.root)
+		tx.root = n.children[0]
+	}
+}
+
+// delete deletes a key from the subtree of a page, and returns whether the
+// page is empty. The key must exist.
+func (tx *Tx) delete(id uint64, key []byte) (uint64, bool, error) {
+	id, n, err := tx.modify(id)
+	if err != nil {
+		return 0, false, err
+	}
+	if n.leaf {
+		if i, found := n.search(key); found {
+			n.keys = removeAt(n.keys, i)
+			n.values = removeAt(n.values, i)
+		}
+		return id, len(n.keys) == 0, nil
+	}
+	i := n.childIndex(key)
+	child, empty, err := tx.delete(n.children[i], key)
+	if err != nil {
+		return 0, false, err
+	}
+	n.children[i] = child
+	if empty {
+		tx.drop(child)
+		n.children = removeAt(n.children, i)
+		if i > 0 {
+			n.keys = removeAt(n.keys, i-1)
+		} else if len(n.keys) > 0 {
+			n.keys = removeAt(n.keys, 0)
+		}
+	}
+	return id, len(n.children) == 0, nil
+}
+
+// Range calls fn with each key from <= key < to, in order. A nil to means no
+// upper bound. If fn returns an error, Range stops and returns that error.
+func (tx *Tx) Range(from, to []byte, fn func(k, v []byte) error) error {
+	c := tx.Cursor()
+	for k, v := c.Seek(from); k != nil; k, v = c.Next() {
+		if to != nil && bytes.Compare(k, to) >= 0 {
+			break
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return c.Err()
+}
+
+// Cursor returns a Cursor to iterate over the keys in order.
+func (tx *Tx) Cursor() *Cursor {
+	return &Cursor{tx: tx}
+}
+
+// Cursor iterates over the keys of a transaction in order. The methods return
+// a nil key when there are no more keys, or when an error occurs, in which
+// case Err returns the error.
+//
+// The cursor must not be used after the transaction changes.
+type Cursor struct {
+	tx    *Tx
+	stack []cursorElem
+	err   error
+}
+
+type cursorElem struct {
+	n *node
+	i int
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// First moves to the first key.
+func (c *Cursor) First() ([]byte, []byte) {
+	c.stack = c.stack[:0]
+	if !c.descend(c.tx.root, false) {
+		return nil, nil
+	}
+	return c.current()
+}
+
+// Last moves to the last key.
+func (c *Cursor) Last() ([]byte, []byte) {
+	c.stack = c.stack[:0]
+	if !c.descend(c.tx.root, true) {
+		return nil, nil
+	}
+	return c.current()
+}
+
+// Seek moves to the first key that is greater than or equal to key.
+func (c *Cursor) Seek(key []byte) ([]byte, []byte) {
+	c.stack = c.stack[:0]
+	if c.err = c.tx.check(false); c.err != nil {
+		return nil, nil
+	}
+	id := c.tx.root
+	for id != 0 {
+		n, err := c.tx.node(id)
+		if err != nil {
+			c.err = err
+			return nil, nil
+		}
+		if n.leaf {
+			i, _ := n.search(key)
+			c.stack = append(c.stack, cursorElem{n, i})
+			if i == len(n.keys) {
+				return c.Next()
+			}
+			return c.current()
+		}
+		i := n.childIndex(key)
+		c.stack = append(c.stack, cursorElem{n, i})
+		id = n.children[i]
+	}
+	return nil, nil
+}
+
+// Next moves to the next key.
+func (c *Cursor) Next() ([]byte, []byte) {
+	for len(c.stack) > 0 {
+		top := &c.stack[len(c.stack)-1]
+		top.i++
+		if top.n.leaf {
+			if top.i < len(top.n.keys) {
+				return c.current()
+			}
+		} else if top.i < len(top.n.children) {
+			if !c.descend(top.n.children[top.i], false) {
+				return nil, nil
+			}
+			return c.current()
+		}
+		c.stack = c.stack[:len(c.stack)-1]
+	}
+	return nil, nil
+}
+
+// Prev moves to the previous key.
+func (c *Cursor) Prev() ([]byte, []byte) {
+	for len(c.stack) > 0 {
+		top := &c.stack[len(c.stack)-1]
+		top.i--
+		if top.i >= 0 {
+			if top.n.leaf {
+				return c.current()
+			}
+			if !c.descend(top.n.children[top.i], true) {
+				return nil, nil
+			}
+			return c.current()
+		}
+		c.stack = c.stack[:len(c.stack)-1]
+	}
+	return nil, nil
+}
+
+// descend pushes the first or last path of the subtree of a page on the
+// stack.
+func (c *Cursor) descend(id uint64, last bool) bool {
+	if c.err = c.tx.check(false); c.err != nil {
+		return false
+	}
+	for id != 0 {
+		n, err := c.tx.node(id)
+		if err != nil {
+			c.err = err
+			c.stack = c.stack[:0]
+			return false
+		}
+		i := 0
+		if last {
+			i = len(n.keys) - 1
+			if !n.leaf {
+				i = len(n.children) - 1
+			}
+		}
+		c.stack = append(c.stack, cursorElem{n, i})
+		if n.leaf {
+			return len(n.keys) > 0
+		}
+		id = n.children[i]
+	}
+	return false
+}
+
+func (c *Cursor) current() ([]byte, []byte) {
+	top := c.stack[len(c.stack)-1]
+	return top.n.keys[top.i], top.n.values[top.i]
+}
+
+// node is a node of the tree. The children of internal nodes are such that
+// child i has the keys < keys[i], and child i+1 has the keys >= keys[i].
+type node struct {
+	leaf     bool
+	keys     [][]byte
+	values   [][]byte
+	children []uint64
+}
+
+func (n *node) clone() *node {
+	return &node{
+		leaf:     n.leaf,
+		keys:     append([][]byte(nil), n.keys...),
+		values:   append([][]byte(nil), n.values...),
+		children: append([]uint64(nil), n.children...),
+	}
+}
+
+// search returns the index of the first key >= key, and whether it is equal
+// to key.
+func (n *node) search(key []byte) (int, bool) {
+	i := sort.Search(len(n.keys), func(i int) bool { return bytes.Compare(n.keys[i], key) >= 0 })
+	return i, i < len(n.keys) && bytes.Equal(n.keys[i], key)
+}
+
+// childIndex returns the index of the child that has key.
+func (n *node) childIndex(key []byte) int {
+	return sort.Search(len(n.keys), func(i int) bool { return bytes.Compare(n.keys[i], key) > 0 })
+}
+
+// split moves the second half of the node to a new node, and returns the
+// separator key and the new node.
+func (n *node) split() ([]byte, *node) {
+	mid := len(n.keys) / 2
+	if n.leaf {
+		right := &node{
+			leaf:   true,
+			keys:   append([][]byte(nil), n.keys[mid:]...),
+			values: append([][]byte(nil), n.values[mid:]...),
+		}
+		n.keys, n.values = n.keys[:mid:mid], n.values[:mid:mid]
+		return right.keys[0], right
+	}
+	sep := n.keys[mid]
+	right := &node{
+		keys:     append([][]byte(nil), n.keys[mid+1:]...),
+		children: append([]uint64(nil), n.children[mid+1:]...),
+	}
+	n.keys, n.children = n.keys[:mid:mid], n.children[:mid+1:mid+1]
+	return sep, right
+}
+
+func insertAt[T any](s []T, i int, v T) []T {
+	var zero T
+	s = append(s, zero)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
+
+func removeAt[T any](s []T, i int) []T {
+	return append(s[:i], s[i+1:]...)
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+//
+// The format is: leaf (1 byte), number of keys (uvarint), then the keys, and
+// the values or the children. Keys and values are prefixed with their length
+// (uvarint). Children are uvarints.
+func (n *node) MarshalBinary() ([]byte, error) {
+	var b []byte
+	if n.leaf {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	b = binary.AppendUvarint(b, uint64(len(n.keys)))
+	for _, k := range n.keys {
+		b = binary.AppendUvarint(b, uint64(len(k)))
+		b = append(b, k...)
+	}
+	if n.leaf {
+		for _, v := range n.values {
+			b = binary.AppendUvarint(b, uint64(len(v)))
+			b = append(b, v...)
+		}
+		return b, nil
+	}
+	b = binary.AppendUvarint(b, uint64(len(n.children)))
+	for _, c := range n.children {
+		b = binary.AppendUvarint(b, c)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (n *node) UnmarshalBinary(b []byte) error {
+	d := decoder{b: b}
+	*n = node{leaf: d.byte() == 1}
+	nk := d.uvarint()
+	if nk > uint64(len(b)) {
+		return ErrCorruptPage
+	}
+	n.keys = make([][]byte, 0, nk)
+	for i := uint64(0); i < nk; i++ {
+		n.keys = append(n.keys, d.bytes())
+	}
+	if n.leaf {
+		n.values = make([][]byte, 0, nk)
+		for i := uint64(0); i < nk; i++ {
+			n.values = append(n.values, d.bytes())
+		}
+	} else {
+		nc := d.uvarint()
+		if nc != nk+1 {
+			return ErrCorruptPage
+		}
+		n.children = make([]uint64, 0, nc)
+		for i := uint64(0); i < nc; i++ {
+			n.children = append(n.children, d.uvarint())
+		}
+	}
+	if d.err || len(d.b) != 0 {
+		return ErrCorruptPage
+	}
+	return nil
+}
+
+// decoder decodes the fields of a page. err is set if the page is too short.
+type decoder struct {
+	b   []byte
+	err bool
+}
+
+func (d *decoder) byte() byte {
+	if len(d.b) == 0 {
+		d.err = true
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = true
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.err = true
+		return nil
+	}
+	v := d.b[:n:n]
+	d.b = d.b[n:]
+	return v
+}
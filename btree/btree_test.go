@@ -0,0 +1,234 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package btree_test
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/btree"
+	"github.com/c2FmZQ/storage/internal/storagetest"
+)
+
+func open(t *testing.T, s *storage.Storage) *btree.DB {
+	t.Helper()
+	db, err := btree.Open(s, "db", btree.WithMaxKeys(4), btree.WithCacheSize(8))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return db
+}
+
+// check verifies that the DB has the same content as want, in both
+// directions.
+func check(t *testing.T, db *btree.DB, want map[string]string) {
+	t.Helper()
+	keys := make([]string, 0, len(want))
+	for k := range want {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	err := db.View(func(tx *btree.Tx) error {
+		var got []string
+		c := tx.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if want[string(k)] != string(v) {
+				t.Errorf("Value of %q = %q, want %q", k, v, want[string(k)])
+			}
+			got = append(got, string(k))
+		}
+		if err := c.Err(); err != nil {
+			return err
+		}
+		if len(got) != len(keys) || (len(got) > 0 && !reflect.DeepEqual(got, keys)) {
+			t.Errorf("Forward keys = %q, want %q", got, keys)
+		}
+		got = got[:0]
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			got = append([]string{string(k)}, got...)
+		}
+		if len(got) != len(keys) || (len(got) > 0 && !reflect.DeepEqual(got, keys)) {
+			t.Errorf("Backward keys = %q, want %q", got, keys)
+		}
+		return c.Err()
+	})
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+}
+
+func TestRandomOps(t *testing.T) {
+	s := storagetest.New(t)
+	db := open(t, s)
+	want := make(map[string]string)
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 20; round++ {
+		err := db.Update(func(tx *btree.Tx) error {
+			for i := 0; i < 50; i++ {
+				k := fmt.Sprintf("key%03d", r.Intn(200))
+				if r.Intn(3) == 0 {
+					delete(want, k)
+					if err := tx.Delete([]byte(k)); err != nil {
+						return err
+					}
+					continue
+				}
+				v := fmt.Sprintf("value%d-%d", round, i)
+				want[k] = v
+				if err := tx.Put([]byte(k), []byte(v)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		check(t, db, want)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	db = open(t, s)
+	defer db.Close()
+	check(t, db, want)
+
+	// Delete everything.
+	err := db.Update(func(tx *btree.Tx) error {
+		for k := range want {
+			if err := tx.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	check(t, db, nil)
+	entries, err := fs.ReadDir(s.FS(), "db/pages")
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d pages left", len(entries))
+	}
+}
+
+func TestGetSeekRange(t *testing.T) {
+	db := open(t, storagetest.New(t))
+	defer db.Close()
+	err := db.Update(func(tx *btree.Tx) error {
+		for i := 0; i < 100; i += 2 {
+			if err := tx.Put([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprint(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	err = db.View(func(tx *btree.Tx) error {
+		if v, err := tx.Get([]byte("042")); err != nil || string(v) != "42" {
+			t.Errorf("Get(042) = %q, %v", v, err)
+		}
+		if _, err := tx.Get([]byte("043")); !errors.Is(err, btree.ErrNotFound) {
+			t.Errorf("Get(043) = %v, want ErrNotFound", err)
+		}
+		c := tx.Cursor()
+		if k, _ := c.Seek([]byte("043")); string(k) != "044" {
+			t.Errorf("Seek(043) = %q, want 044", k)
+		}
+		if k, _ := c.Prev(); string(k) != "042" {
+			t.Errorf("Prev() = %q, want 042", k)
+		}
+		if k, _ := c.Seek([]byte("999")); k != nil {
+			t.Errorf("Seek(999) = %q, want nil", k)
+		}
+		var got []string
+		if err := tx.Range([]byte("010"), []byte("020"), func(k, v []byte) error {
+			got = append(got, string(k))
+			return nil
+		}); err != nil {
+			return err
+		}
+		if want := []string{"010", "012", "014", "016", "018"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Range() = %q, want %q", got, want)
+		}
+		if err := tx.Put([]byte("x"), nil); !errors.Is(err, btree.ErrTxNotWritable) {
+			t.Errorf("Put() = %v, want ErrTxNotWritable", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	s := storagetest.New(t)
+	db := open(t, s)
+	want := map[string]string{"a": "1"}
+	if err := db.Update(func(tx *btree.Tx) error {
+		return tx.Put([]byte("a"), []byte("1"))
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	errFail := errors.New("fail")
+	if err := db.Update(func(tx *btree.Tx) error {
+		for i := 0; i < 20; i++ {
+			if err := tx.Put([]byte(fmt.Sprint(i)), []byte("x")); err != nil {
+				return err
+			}
+		}
+		return errFail
+	}); !errors.Is(err, errFail) {
+		t.Fatalf("Update() = %v, want %v", err, errFail)
+	}
+	check(t, db, want)
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// A page that was written by a commit that didn't complete is deleted.
+	if err := s.SaveDataFile("db/pages/00000000000000ff", []byte("orphan")); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+	db = open(t, s)
+	defer db.Close()
+	if _, err := fs.Stat(s.FS(), "db/pages/00000000000000ff"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(orphan) = %v, want ErrNotExist", err)
+	}
+	check(t, db, want)
+	if _, err := btree.Open(s, "db"); !errors.Is(err, btree.ErrLocked) {
+		t.Errorf("Open() = %v, want ErrLocked", err)
+	}
+}
@@ -0,0 +1,200 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"container/list"
+	"io/fs"
+	"os"
+	"reflect"
+	"sync"
+)
+
+// WithCache enables an in-memory cache of decoded objects with up to
+// maxEntries entries. ReadDataFile serves objects from the cache when the
+// file hasn't changed since it was cached.
+//
+// Cached objects are deep copied when they are added to the cache and when
+// they are served so that callers can't modify the cached values. A cache hit
+// replaces the content of obj instead of merging into it.
+func WithCache(maxEntries int) Option {
+	return func(opt *option) {
+		opt.cacheSize = maxEntries
+	}
+}
+
+type cacheEntry struct {
+	filename string
+	fi       fs.FileInfo
+	value    reflect.Value
+}
+
+// objectCache is a LRU cache of decoded objects.
+type objectCache struct {
+	maxEntries int
+	backend    Backend
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newObjectCache(maxEntries int, backend Backend) *objectCache {
+	return &objectCache{
+		maxEntries: maxEntries,
+		backend:    backend,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// get copies the cached object for filename into obj. It returns false if
+// the object isn't in the cache, or if the file changed.
+func (c *objectCache) get(filename, fullPath string, obj interface{}) bool {
+	v := reflect.ValueOf(obj)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return false
+	}
+	c.mu.Lock()
+	e, ok := c.entries[filename]
+	if !ok {
+		c.mu.Unlock()
+		return false
+	}
+	entry := e.Value.(*cacheEntry)
+	c.mu.Unlock()
+
+	fi, err := c.backend.Stat(fullPath)
+	if err != nil || !sameFileInfo(fi, entry.fi) || entry.value.Type() != v.Elem().Type() {
+		c.invalidate(filename)
+		return false
+	}
+	v.Elem().Set(deepCopy(entry.value))
+	c.mu.Lock()
+	if e, ok := c.entries[filename]; ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	return true
+}
+
+// add adds a copy of obj to the cache. fi is the FileInfo of the file that
+// obj was decoded from.
+func (c *objectCache) add(filename string, fi fs.FileInfo, obj interface{}) {
+	v := reflect.ValueOf(obj)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return
+	}
+	entry := &cacheEntry{filename: filename, fi: fi, value: deepCopy(v.Elem())}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[filename]; ok {
+		c.lru.Remove(e)
+	}
+	c.entries[filename] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*cacheEntry).filename)
+	}
+}
+
+// invalidate removes filename from the cache.
+func (c *objectCache) invalidate(filename string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[filename]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, filename)
+	}
+}
+
+func sameFileInfo(a, b fs.FileInfo) bool {
+	if !a.ModTime().Equal(b.ModTime()) || a.Size() != b.Size() {
+		return false
+	}
+	if os.SameFile(a, b) {
+		return true
+	}
+	// Other backends identify their files with comparable Sys values.
+	sa, sb := a.Sys(), b.Sys()
+	return sa != nil && reflect.TypeOf(sa).Comparable() && sa == sb
+}
+
+// deepCopy returns a deep copy of v. Unexported fields are copied by value.
+func deepCopy(v reflect.Value) reflect.Value {
+	out := reflect.New(v.Type()).Elem()
+	copyValue(out, v)
+	return out
+}
+
+func copyValue(dst, src reflect.Value) {
+	switch src.Kind() {
+	case reflect.Pointer:
+		if src.IsNil() {
+			return
+		}
+		p := reflect.New(src.Type().Elem())
+		copyValue(p.Elem(), src.Elem())
+		dst.Set(p)
+	case reflect.Interface:
+		if src.IsNil() {
+			return
+		}
+		dst.Set(deepCopy(src.Elem()))
+	case reflect.Slice:
+		if src.IsNil() {
+			return
+		}
+		s := reflect.MakeSlice(src.Type(), src.Len(), src.Len())
+		for i := 0; i < src.Len(); i++ {
+			copyValue(s.Index(i), src.Index(i))
+		}
+		dst.Set(s)
+	case reflect.Array:
+		for i := 0; i < src.Len(); i++ {
+			copyValue(dst.Index(i), src.Index(i))
+		}
+	case reflect.Map:
+		if src.IsNil() {
+			return
+		}
+		m := reflect.MakeMapWithSize(src.Type(), src.Len())
+		iter := src.MapRange()
+		for iter.Next() {
+			m.SetMapIndex(deepCopy(iter.Key()), deepCopy(iter.Value()))
+		}
+		dst.Set(m)
+	case reflect.Struct:
+		// Copy the whole struct first to get the unexported fields.
+		dst.Set(src)
+		for i := 0; i < src.NumField(); i++ {
+			if dst.Field(i).CanSet() {
+				copyValue(dst.Field(i), src.Field(i))
+			}
+		}
+	default:
+		dst.Set(src)
+	}
+}
@@ -0,0 +1,300 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package cache is an in-memory cache with per-entry TTL and LRU eviction,
+// persisted in an encrypted storage between restarts.
+//
+// Example:
+//
+//	c, err := cache.New(s, "cache/oidc", cache.WithMaxEntries(1000))
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	if v, ok := c.Get("discovery"); ok {
+//		...
+//	}
+//	c.Set("discovery", doc, time.Hour)
+package cache
+
+import (
+	"container/list"
+	"errors"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+)
+
+// ErrClosed is returned when the cache is closed.
+var ErrClosed = errors.New("cache is closed")
+
+const defaultSweepInterval = time.Minute
+
+// Option is used to specify optional parameters of New.
+type Option func(*Cache)
+
+// WithMaxEntries specifies the maximum number of entries. The least recently
+// used entries are evicted when there are more.
+func WithMaxEntries(n int) Option {
+	return func(c *Cache) {
+		c.maxEntries = n
+	}
+}
+
+// WithMaxBytes specifies the maximum total size of the keys and values. The
+// least recently used entries are evicted when the cache is larger.
+func WithMaxBytes(n int64) Option {
+	return func(c *Cache) {
+		c.maxBytes = n
+	}
+}
+
+// WithSweepInterval specifies how often the expired entries are removed, and
+// the cache is saved if it changed. The default is one minute. A zero or
+// negative value disables the background sweeps.
+func WithSweepInterval(d time.Duration) Option {
+	return func(c *Cache) {
+		c.sweepInterval = d
+	}
+}
+
+// entry is an entry of the cache. It is also how the entries are persisted.
+type entry struct {
+	Key     string    `json:"key"`
+	Value   []byte    `json:"value"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func (e *entry) size() int64 {
+	return int64(len(e.Key) + len(e.Value))
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// Cache is a key-value cache. It is safe for concurrent use.
+type Cache struct {
+	s             *storage.Storage
+	name          string
+	maxEntries    int
+	maxBytes      int64
+	sweepInterval time.Duration
+
+	mu     sync.Mutex
+	closed bool
+	dirty  bool
+	size   int64
+	// lru contains the entries, most recently used first.
+	lru   *list.List
+	items map[string]*list.Element
+
+	stop sync.Once
+	done chan struct{}
+	ch   chan struct{}
+}
+
+// New returns a cache persisted in the data file name. The entries that were
+// saved previously are loaded.
+func New(s *storage.Storage, name string, opts ...Option) (*Cache, error) {
+	c := &Cache{
+		s:             s,
+		name:          name,
+		sweepInterval: defaultSweepInterval,
+		lru:           list.New(),
+		items:         make(map[string]*list.Element),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	var entries []*entry
+	if err := s.ReadDataFile(name, &entries); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if e.expired(now) {
+			c.dirty = true
+			continue
+		}
+		c.items[e.Key] = c.lru.PushBack(e)
+		c.size += e.size()
+	}
+	c.evict()
+	if c.sweepInterval > 0 {
+		c.done = make(chan struct{})
+		c.ch = make(chan struct{})
+		go c.sweepLoop()
+	}
+	return c, nil
+}
+
+func (c *Cache) sweepLoop() {
+	defer close(c.ch)
+	ticker := time.NewTicker(c.sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if n := c.Sweep(); n > 0 {
+				c.s.Logger().Debugf("cache: %s: removed %d expired entries", c.name, n)
+			}
+			if err := c.Flush(); err != nil && !errors.Is(err, ErrClosed) {
+				c.s.Logger().Errorf("cache: %s: Flush: %v", c.name, err)
+			}
+		}
+	}
+}
+
+// Get returns the value of key, and whether it was found.
+func (c *Cache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*entry)
+	if e.expired(time.Now()) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return e.Value, true
+}
+
+// Set sets the value of key. The entry expires after ttl, or never if ttl is
+// zero.
+func (c *Cache) Set(key string, value []byte, ttl time.Duration) {
+	e := &entry{Key: key, Value: value}
+	if ttl != 0 {
+		e.Expires = time.Now().Add(ttl)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.remove(elem)
+	}
+	c.items[key] = c.lru.PushFront(e)
+	c.size += e.size()
+	c.dirty = true
+	c.evict()
+}
+
+// Delete removes key from the cache.
+func (c *Cache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// Len returns the number of entries in the cache, including the expired
+// entries that were not removed yet.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Sweep removes the expired entries, and returns how many were removed.
+func (c *Cache) Sweep() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	var n int
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*entry).expired(now) {
+			c.remove(elem)
+			n++
+		}
+		elem = next
+	}
+	return n
+}
+
+func (c *Cache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*entry)
+	delete(c.items, e.Key)
+	c.size -= e.size()
+	c.dirty = true
+}
+
+// evict removes the least recently used entries until the cache is within
+// its limits.
+func (c *Cache) evict() {
+	for c.lru.Len() > 0 && ((c.maxEntries > 0 && c.lru.Len() > c.maxEntries) || (c.maxBytes > 0 && c.size > c.maxBytes)) {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Flush saves the cache if it changed since it was last saved.
+func (c *Cache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	return c.flush()
+}
+
+func (c *Cache) flush() error {
+	if !c.dirty {
+		return nil
+	}
+	now := time.Now()
+	entries := make([]*entry, 0, c.lru.Len())
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		if e := elem.Value.(*entry); !e.expired(now) {
+			entries = append(entries, e)
+		}
+	}
+	if err := c.s.SaveDataFile(c.name, entries); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// Close stops the background sweeps, and saves the cache.
+func (c *Cache) Close() error {
+	c.stop.Do(func() {
+		if c.done != nil {
+			close(c.done)
+			<-c.ch
+		}
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.flush()
+}
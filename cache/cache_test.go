@@ -0,0 +1,141 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/cache"
+	"github.com/c2FmZQ/storage/internal/storagetest"
+)
+
+func newCache(t *testing.T, s *storage.Storage, opts ...cache.Option) *cache.Cache {
+	t.Helper()
+	c, err := cache.New(s, "cache", opts...)
+	if err != nil {
+		t.Fatalf("cache.New: %v", err)
+	}
+	return c
+}
+
+func checkGet(t *testing.T, c *cache.Cache, key, want string) {
+	t.Helper()
+	v, ok := c.Get(key)
+	if want == "" {
+		if ok {
+			t.Errorf("Get(%q) = %q, want not found", key, v)
+		}
+		return
+	}
+	if !ok || string(v) != want {
+		t.Errorf("Get(%q) = %q, %v, want %q", key, v, ok, want)
+	}
+}
+
+func TestCache(t *testing.T) {
+	s := storagetest.New(t)
+	c := newCache(t, s)
+	c.Set("foo", []byte("bar"), 0)
+	c.Set("short", []byte("lived"), 20*time.Millisecond)
+	c.Set("deleted", []byte("x"), 0)
+	c.Delete("deleted")
+	checkGet(t, c, "foo", "bar")
+	checkGet(t, c, "short", "lived")
+	checkGet(t, c, "deleted", "")
+
+	time.Sleep(30 * time.Millisecond)
+	checkGet(t, c, "short", "")
+	if got, want := c.Len(), 1; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+	c.Set("hour", []byte("long"), time.Hour)
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	c = newCache(t, s)
+	defer c.Close()
+	checkGet(t, c, "foo", "bar")
+	checkGet(t, c, "hour", "long")
+	if got, want := c.Len(), 2; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	s := storagetest.New(t)
+	c := newCache(t, s, cache.WithMaxEntries(3))
+	for i := 0; i < 3; i++ {
+		c.Set(fmt.Sprintf("k%d", i), []byte("v"), 0)
+	}
+	checkGet(t, c, "k0", "v")
+	c.Set("k3", []byte("v"), 0)
+	// k1 is the least recently used.
+	checkGet(t, c, "k1", "")
+	checkGet(t, c, "k0", "v")
+	c.Close()
+
+	c = newCache(t, s, cache.WithMaxBytes(10))
+	defer c.Close()
+	// The entries were loaded in LRU order, and are 3 bytes each.
+	if got, want := c.Len(), 3; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+	c.Set("k4", []byte("v"), 0)
+	checkGet(t, c, "k2", "")
+	checkGet(t, c, "k3", "v")
+	c.Set("big", []byte("0123456789"), 0)
+	if got, want := c.Len(), 0; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	s := storagetest.New(t)
+	c := newCache(t, s, cache.WithSweepInterval(10*time.Millisecond))
+	c.Set("a", []byte("1"), 20*time.Millisecond)
+	c.Set("b", []byte("2"), time.Hour)
+	time.Sleep(100 * time.Millisecond)
+	if got, want := c.Len(), 1; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+
+	// The background sweep saved the cache.
+	c2 := newCache(t, s, cache.WithSweepInterval(0))
+	checkGet(t, c2, "b", "2")
+	c2.Close()
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := c.Flush(); err != cache.ErrClosed {
+		t.Errorf("Flush() = %v, want ErrClosed", err)
+	}
+}
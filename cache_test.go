@@ -0,0 +1,120 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, aesEncryptionKey(), WithCache(2))
+
+	type Foo struct {
+		M map[string][]string
+		P *time.Time
+	}
+	now := time.Now().Round(0)
+	foo := Foo{M: map[string][]string{"a": {"b", "c"}}, P: &now}
+	if err := s.SaveDataFile("foo", foo); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	var got Foo
+	if err := s.ReadDataFile("foo", &got); err != nil {
+		t.Fatalf("s.ReadDataFile: %v", err)
+	}
+	if !reflect.DeepEqual(foo, got) {
+		t.Fatalf("s.ReadDataFile() got %+v, want %+v", got, foo)
+	}
+	if _, ok := s.cache.entries["foo"]; !ok {
+		t.Fatal("foo is not in the cache")
+	}
+
+	// Modifying the returned object doesn't change the cached value.
+	got.M["a"][0] = "X"
+	var got2 Foo
+	if err := s.ReadDataFile("foo", &got2); err != nil {
+		t.Fatalf("s.ReadDataFile: %v", err)
+	}
+	if !reflect.DeepEqual(foo, got2) {
+		t.Fatalf("s.ReadDataFile() got %+v, want %+v", got2, foo)
+	}
+
+	// A local commit invalidates the cache.
+	foo.M["a"] = []string{"d"}
+	if err := s.SaveDataFile("foo", foo); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	if _, ok := s.cache.entries["foo"]; ok {
+		t.Fatal("foo is still in the cache")
+	}
+	if err := s.ReadDataFile("foo", &got); err != nil {
+		t.Fatalf("s.ReadDataFile: %v", err)
+	}
+	if !reflect.DeepEqual(foo, got) {
+		t.Fatalf("s.ReadDataFile() got %+v, want %+v", got, foo)
+	}
+
+	// A change by another process is noticed.
+	s2 := New(dir, s.masterKey)
+	foo.M["a"] = []string{"e"}
+	if err := s2.SaveDataFile("foo", foo); err != nil {
+		t.Fatalf("s2.SaveDataFile: %v", err)
+	}
+	if err := s.ReadDataFile("foo", &got); err != nil {
+		t.Fatalf("s.ReadDataFile: %v", err)
+	}
+	if !reflect.DeepEqual(foo, got) {
+		t.Fatalf("s.ReadDataFile() got %+v, want %+v", got, foo)
+	}
+
+	// A deleted file isn't served from the cache.
+	if err := os.Remove(filepath.Join(dir, "foo")); err != nil {
+		t.Fatalf("os.Remove: %v", err)
+	}
+	if err := s.ReadDataFile("foo", &got); !os.IsNotExist(err) {
+		t.Fatalf("s.ReadDataFile: %v", err)
+	}
+
+	// LRU eviction.
+	for _, f := range []string{"a", "b", "c"} {
+		if err := s.SaveDataFile(f, f); err != nil {
+			t.Fatalf("s.SaveDataFile: %v", err)
+		}
+		var v string
+		if err := s.ReadDataFile(f, &v); err != nil || v != f {
+			t.Fatalf("s.ReadDataFile(%q) = %q, %v", f, v, err)
+		}
+	}
+	if n := len(s.cache.entries); n != 2 {
+		t.Errorf("Unexpected number of cache entries. Want 2, got %d", n)
+	}
+	if _, ok := s.cache.entries["a"]; ok {
+		t.Error("a should have been evicted")
+	}
+}
@@ -0,0 +1,29 @@
+module github.com/c2FmZQ/storage/certmagicstorage
+
+go 1.24.0
+
+require (
+	github.com/c2FmZQ/storage v0.0.0-20261015041833-c4dbad651a82
+	github.com/caddyserver/certmagic v0.21.3
+)
+
+require (
+	github.com/c2FmZQ/tpm v0.4.0 // indirect
+	github.com/caddyserver/zerossl v0.1.3 // indirect
+	github.com/google/go-tpm v0.9.3 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.7 // indirect
+	github.com/libdns/libdns v0.2.2 // indirect
+	github.com/mholt/acmez/v2 v2.0.1 // indirect
+	github.com/miekg/dns v1.1.59 // indirect
+	github.com/zeebo/blake3 v0.2.3 // indirect
+	go.uber.org/multierr v1.11.0 // indirect
+	go.uber.org/zap v1.27.0 // indirect
+	golang.org/x/crypto v0.32.0 // indirect
+	golang.org/x/mod v0.17.0 // indirect
+	golang.org/x/net v0.33.0 // indirect
+	golang.org/x/sync v0.10.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
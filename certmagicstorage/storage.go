@@ -0,0 +1,222 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package certmagicstorage implements certmagic.Storage on top of an encrypted
+// storage, so that the certificates and keys of Caddy and certmagic are
+// encrypted at rest.
+//
+// The keys are stored as files under a directory of the storage, and the
+// locks use the storage's lock files, which makes them safe to use from
+// several processes that share the same directory.
+//
+// Example:
+//
+//	cfg := certmagic.NewDefault()
+//	cfg.Storage = certmagicstorage.New(s, "certmagic")
+//
+// This package is a separate module to avoid adding the dependencies of
+// certmagic to the storage module.
+package certmagicstorage
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/certmagic"
+
+	"github.com/c2FmZQ/storage"
+)
+
+var _ certmagic.Storage = (*Storage)(nil)
+
+// Storage implements certmagic.Storage.
+type Storage struct {
+	s    *storage.Storage
+	dir  string
+	fsys *storage.FS
+}
+
+// New returns a certmagic.Storage that stores its keys under dir in s.
+func New(s *storage.Storage, dir string) *Storage {
+	return &Storage{s: s, dir: path.Clean(filepath.ToSlash(dir)), fsys: s.FS()}
+}
+
+// name returns the slash-separated name of the file of a key.
+func (c *Storage) name(key string) (string, error) {
+	name := path.Join(c.dir, key)
+	if !fs.ValidPath(name) || (c.dir != "." && !isIn(name, c.dir)) || storage.IsInternalFile(name) || (key != "" && name == c.dir) || isIn(name, c.lockDir()) {
+		return "", &fs.PathError{Op: "certmagic", Path: key, Err: fs.ErrInvalid}
+	}
+	return name, nil
+}
+
+// isIn returns true if name is dir, or is inside dir.
+func isIn(name, dir string) bool {
+	return name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// lockDir returns the directory of the lock files.
+func (c *Storage) lockDir() string {
+	return path.Join(c.dir, "locks")
+}
+
+// lockName returns the name of the file that is locked for a lock name.
+func (c *Storage) lockName(name string) string {
+	return filepath.Join(filepath.FromSlash(c.lockDir()), url.PathEscape(name))
+}
+
+// Lock acquires the lock for name, blocking until the lock can be obtained
+// or ctx is done.
+func (c *Storage) Lock(ctx context.Context, name string) error {
+	c.s.Logger().Debugf("certmagicstorage.Lock(%q)", name)
+	return c.s.LockContext(ctx, c.lockName(name))
+}
+
+// Unlock releases the lock for name.
+func (c *Storage) Unlock(_ context.Context, name string) error {
+	c.s.Logger().Debugf("certmagicstorage.Unlock(%q)", name)
+	return c.s.Unlock(c.lockName(name))
+}
+
+// Store puts value at key.
+func (c *Storage) Store(_ context.Context, key string, value []byte) error {
+	c.s.Logger().Debugf("certmagicstorage.Store(%q, ...)", key)
+	name, err := c.name(key)
+	if err != nil {
+		return err
+	}
+	return c.s.SaveDataFile(filepath.FromSlash(name), &value)
+}
+
+// Load retrieves the value at key. It returns an error that wraps
+// fs.ErrNotExist if the key doesn't exist.
+func (c *Storage) Load(_ context.Context, key string) ([]byte, error) {
+	c.s.Logger().Debugf("certmagicstorage.Load(%q)", key)
+	name, err := c.name(key)
+	if err != nil {
+		return nil, err
+	}
+	var value []byte
+	if err := c.s.ReadDataFile(filepath.FromSlash(name), &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Delete deletes the key, or all the keys under it if it is a directory.
+func (c *Storage) Delete(_ context.Context, key string) error {
+	c.s.Logger().Debugf("certmagicstorage.Delete(%q)", key)
+	name, err := c.name(key)
+	if err != nil {
+		return err
+	}
+	var names []string
+	err = fs.WalkDir(c.fsys, name, func(p string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == c.lockDir() {
+			return fs.SkipDir
+		}
+		names = append(names, p)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// The files are deleted before their directories.
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, n := range names {
+		if err := c.s.DeleteFile(filepath.FromSlash(n)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Exists returns true if the key exists.
+func (c *Storage) Exists(ctx context.Context, key string) bool {
+	_, err := c.Stat(ctx, key)
+	return err == nil
+}
+
+// List returns the keys under the prefix directory. When recursive is true,
+// the subdirectories are walked, and all the keys are returned, including
+// the directories.
+func (c *Storage) List(_ context.Context, prefix string, recursive bool) ([]string, error) {
+	c.s.Logger().Debugf("certmagicstorage.List(%q, %v)", prefix, recursive)
+	name, err := c.name(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	err = fs.WalkDir(c.fsys, name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == name {
+			return nil
+		}
+		if p == c.lockDir() {
+			return fs.SkipDir
+		}
+		keys = append(keys, path.Join(prefix, p[len(name)+1:]))
+		if d.IsDir() && !recursive {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Stat returns information about key.
+func (c *Storage) Stat(_ context.Context, key string) (certmagic.KeyInfo, error) {
+	name, err := c.name(key)
+	if err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+	fi, err := c.fsys.Stat(name)
+	if err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+	return certmagic.KeyInfo{
+		Key:        key,
+		Modified:   fi.ModTime(),
+		Size:       fi.Size(),
+		IsTerminal: !fi.IsDir(),
+	}, nil
+}
+
+// String implements fmt.Stringer. certmagic uses it to identify the storage.
+func (c *Storage) String() string {
+	return "certmagicstorage:" + filepath.Join(c.s.Dir(), filepath.FromSlash(c.dir))
+}
@@ -0,0 +1,144 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package certmagicstorage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage/certmagicstorage"
+	"github.com/c2FmZQ/storage/internal/storagetest"
+)
+
+func newStorage(t *testing.T) *certmagicstorage.Storage {
+	return certmagicstorage.New(storagetest.New(t), "certmagic")
+}
+
+func TestKeys(t *testing.T) {
+	ctx := context.Background()
+	c := newStorage(t)
+
+	if _, err := c.Load(ctx, "certificates/example.com/example.com.crt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Load = %v, want fs.ErrNotExist", err)
+	}
+	for _, k := range []string{
+		"certificates/example.com/example.com.crt",
+		"certificates/example.com/example.com.key",
+		"certificates/example.org/example.org.crt",
+		"acme/account.json",
+	} {
+		if err := c.Store(ctx, k, []byte(k)); err != nil {
+			t.Fatalf("Store(%q): %v", k, err)
+		}
+	}
+	if err := c.Store(ctx, "../escape", []byte("x")); err == nil {
+		t.Error("Store(../escape) succeeded unexpectedly")
+	}
+	if err := c.Store(ctx, "foo.lock", []byte("x")); err == nil {
+		t.Error("Store(foo.lock) succeeded unexpectedly")
+	}
+
+	b, err := c.Load(ctx, "acme/account.json")
+	if err != nil || string(b) != "acme/account.json" {
+		t.Errorf("Load = %q, %v", b, err)
+	}
+	if !c.Exists(ctx, "acme/account.json") || c.Exists(ctx, "acme/other.json") {
+		t.Error("Exists returned an unexpected result")
+	}
+	ki, err := c.Stat(ctx, "acme/account.json")
+	if err != nil || ki.Key != "acme/account.json" || ki.Size != int64(len("acme/account.json")) || !ki.IsTerminal || ki.Modified.IsZero() {
+		t.Errorf("Stat = %+v, %v", ki, err)
+	}
+	if ki, err := c.Stat(ctx, "acme"); err != nil || ki.IsTerminal {
+		t.Errorf("Stat(acme) = %+v, %v", ki, err)
+	}
+
+	keys, err := c.List(ctx, "certificates", false)
+	if got, want := fmt.Sprint(keys), "[certificates/example.com certificates/example.org]"; err != nil || got != want {
+		t.Errorf("List = %v, %v, want %v", got, err, want)
+	}
+	keys, err = c.List(ctx, "certificates", true)
+	if got, want := fmt.Sprint(keys), "[certificates/example.com certificates/example.com/example.com.crt certificates/example.com/example.com.key certificates/example.org certificates/example.org/example.org.crt]"; err != nil || got != want {
+		t.Errorf("List = %v, %v, want %v", got, err, want)
+	}
+	if _, err := c.List(ctx, "nothing", true); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("List = %v, want fs.ErrNotExist", err)
+	}
+
+	if err := c.Delete(ctx, "certificates/example.com"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if c.Exists(ctx, "certificates/example.com") || c.Exists(ctx, "certificates/example.com/example.com.crt") {
+		t.Error("Delete didn't delete the directory")
+	}
+	if !c.Exists(ctx, "certificates/example.org/example.org.crt") {
+		t.Error("Delete deleted too much")
+	}
+}
+
+func TestLock(t *testing.T) {
+	ctx := context.Background()
+	c := newStorage(t)
+	if err := c.Lock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	// The lock directory isn't a key.
+	if keys, err := c.List(ctx, "", true); err != nil || len(keys) != 0 {
+		t.Errorf("List = %v, %v", keys, err)
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := c.Lock(tctx, "issue_cert_example.com"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Lock = %v, want context.DeadlineExceeded", err)
+	}
+	if err := c.Lock(ctx, "issue_cert_example.org"); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	ch := make(chan error)
+	go func() {
+		ch <- c.Lock(ctx, "issue_cert_example.com")
+	}()
+	select {
+	case err := <-ch:
+		t.Fatalf("Lock returned before Unlock: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := c.Unlock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if err := <-ch; err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	for _, name := range []string{"issue_cert_example.com", "issue_cert_example.org"} {
+		if err := c.Unlock(ctx, name); err != nil {
+			t.Errorf("Unlock(%q): %v", name, err)
+		}
+	}
+}
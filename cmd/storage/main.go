@@ -0,0 +1,519 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Command storage inspects and maintains a storage directory. It can list
+// files, show their headers, decrypt them, re-encrypt them with a different
+// master key, change the passphrase of the master key, and recover pending
+// operations.
+//
+// Usage:
+//
+//	storage -dir <dir> [-key <file>] [-passphrase-file <file>] [-keyring <desc>] <command> [args]
+//
+// The passphrase is read from -passphrase-file, from the STORAGE_PASSPHRASE
+// systemd credential, from the STORAGE_PASSPHRASE environment variable, or
+// from the terminal, in that order. When -key is omitted, the files are
+// expected to be unencrypted.
+//
+// With -keyring, the unlocked master key is kept in the user keyring of the
+// Linux kernel for -keyring-timeout, so that the passphrase isn't needed
+// again until then.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+const usage = `Usage: storage -dir <dir> [-key <file>] [-passphrase-file <file>] [-keyring <desc>] <command> [args]
+
+Commands:
+  ls [dir]                 List the files with their headers and sizes.
+  header <file>...         Show the header of files, and the ID of the master
+                           key that encrypted them.
+  cat <file>               Decrypt a file and write its content to stdout.
+  reencrypt -new-key <file> [-new-passphrase-file <file>] [file...]
+                           Re-encrypt files with a different master key. The
+                           key is created if it doesn't exist.
+  passwd [-new-passphrase-file <file>]
+                           Change the passphrase of the master key.
+  rollback [-force]        Recover the pending operations. With -force, don't
+                           wait to make sure that they were abandoned.
+`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "storage: %v\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// cli holds the global flags and the streams of one invocation.
+type cli struct {
+	dir            string
+	keyFile        string
+	passphraseFile string
+	keyring        string
+	keyringTimeout time.Duration
+	verbose        bool
+
+	// keys are wiped when the command returns.
+	keys []crypto.MasterKey
+
+	stdin  *bufio.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	c := &cli{
+		stdin:  bufio.NewReader(stdin),
+		stdout: stdout,
+		stderr: stderr,
+	}
+	fset := flag.NewFlagSet("storage", flag.ContinueOnError)
+	fset.SetOutput(stderr)
+	fset.Usage = func() { fmt.Fprint(stderr, usage) }
+	fset.StringVar(&c.dir, "dir", "", "The storage directory.")
+	fset.StringVar(&c.keyFile, "key", "", "The master key file.")
+	fset.StringVar(&c.passphraseFile, "passphrase-file", "", "The file that contains the passphrase of the master key.")
+	fset.StringVar(&c.keyring, "keyring", "", "The description of the master key in the kernel keyring.")
+	fset.DurationVar(&c.keyringTimeout, "keyring-timeout", 15*time.Minute, "How long the master key stays in the kernel keyring.")
+	fset.BoolVar(&c.verbose, "v", false, "Show debug messages.")
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if c.dir == "" || fset.NArg() == 0 {
+		fset.Usage()
+		return flag.ErrHelp
+	}
+	defer func() {
+		for _, k := range c.keys {
+			k.Wipe()
+		}
+	}()
+	cmd, args := fset.Arg(0), fset.Args()[1:]
+	switch cmd {
+	case "ls":
+		return c.ls(args)
+	case "header":
+		return c.header(args)
+	case "cat":
+		return c.cat(args)
+	case "reencrypt":
+		return c.reencrypt(args)
+	case "passwd":
+		return c.passwd(args)
+	case "rollback":
+		return c.rollback(args)
+	default:
+		fset.Usage()
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+// readPassphrase returns the content of file if it is set, the content of
+// the systemd credential or the value of the environment variable named env
+// if they are set, or asks for the passphrase.
+func (c *cli) readPassphrase(file, env, prompt string) ([]byte, error) {
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(b, "\r\n"), nil
+	}
+	if env != "" {
+		b, err := crypto.ReadCredential(env)
+		if err == nil {
+			return bytes.TrimRight(b, "\r\n"), nil
+		}
+		if !errors.Is(err, crypto.ErrNoCredentials) && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if v := os.Getenv(env); v != "" {
+			return []byte(v), nil
+		}
+	}
+	return c.prompt(prompt)
+}
+
+// prompt asks for a passphrase on the terminal, or reads a line from stdin
+// when stdin isn't a terminal.
+func (c *cli) prompt(prompt string) ([]byte, error) {
+	fmt.Fprint(c.stderr, prompt)
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		defer fmt.Fprintln(c.stderr)
+		return term.ReadPassword(fd)
+	}
+	line, err := c.stdin.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+func (c *cli) cryptoOptions() []crypto.Option {
+	return []crypto.Option{crypto.WithLogger(logger{w: c.stderr, verbose: c.verbose})}
+}
+
+// masterKey reads the master key, or returns nil when there is no key file.
+// With -keyring, the key is read from the kernel keyring when it is there,
+// and saved to it otherwise.
+func (c *cli) masterKey() (crypto.MasterKey, error) {
+	if c.keyFile == "" {
+		return nil, nil
+	}
+	if c.keyring != "" {
+		mk, err := crypto.ReadMasterKeyFromKeyring(c.keyring, c.cryptoOptions()...)
+		if err == nil {
+			c.keys = append(c.keys, mk)
+			return mk, nil
+		}
+		if err != crypto.ErrNotInKeyring {
+			return nil, err
+		}
+	}
+	pp, err := c.readPassphrase(c.passphraseFile, "STORAGE_PASSPHRASE", "Passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	mk, err := crypto.ReadMasterKey(pp, c.keyFile, c.cryptoOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	c.keys = append(c.keys, mk)
+	if c.keyring != "" {
+		if err := crypto.SaveToKeyring(mk, c.keyring, c.keyringTimeout); err != nil {
+			return nil, err
+		}
+	}
+	return mk, nil
+}
+
+// open opens the storage with the master key. Pending operations are
+// recovered in the background so that files that aren't affected by them
+// can be inspected right away.
+func (c *cli) open(opts ...storage.Option) (*storage.Storage, crypto.MasterKey, error) {
+	mk, err := c.masterKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	var key crypto.EncryptionKey
+	if mk != nil {
+		key = mk
+	}
+	s, err := storage.Open(c.dir, key, append([]storage.Option{storage.WithAsyncRecovery()}, opts...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, mk, nil
+}
+
+func (c *cli) ls(args []string) error {
+	root := "."
+	switch len(args) {
+	case 0:
+	case 1:
+		root = filepath.ToSlash(filepath.Clean(args[0]))
+	default:
+		return errors.New("ls: too many arguments")
+	}
+	s, _, err := c.open()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HEADER\tSIZE\tMODIFIED\tNAME")
+	err = fs.WalkDir(s.FS(), root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		hdr := "-"
+		if h, err := s.ReadHeader(path); err == nil {
+			hdr = h.String()
+		}
+		size, mtime := "-", "-"
+		if fi, err := d.Info(); err == nil {
+			size = fmt.Sprintf("%d", fi.Size())
+			mtime = fi.ModTime().Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", hdr, size, mtime, path)
+		return nil
+	})
+	if ferr := tw.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+func (c *cli) header(args []string) error {
+	if len(args) == 0 {
+		return errors.New("header: missing file name")
+	}
+	s, _, err := c.open()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, f := range args {
+		h, err := s.ReadHeader(f)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f, err))
+			continue
+		}
+		if h.KeyID != "" {
+			fmt.Fprintf(c.stdout, "%s: %s key=%s\n", f, h, h.KeyID)
+			continue
+		}
+		fmt.Fprintf(c.stdout, "%s: %s\n", f, h)
+	}
+	return errors.Join(errs...)
+}
+
+func (c *cli) cat(args []string) error {
+	if len(args) != 1 {
+		return errors.New("cat: expected one file name")
+	}
+	s, _, err := c.open()
+	if err != nil {
+		return err
+	}
+	f, err := s.FS().Open(filepath.ToSlash(filepath.Clean(args[0])))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(c.stdout, f)
+	return err
+}
+
+func (c *cli) reencrypt(args []string) error {
+	fset := flag.NewFlagSet("reencrypt", flag.ContinueOnError)
+	fset.SetOutput(c.stderr)
+	newKeyFile := fset.String("new-key", "", "The new master key file. It is created if it doesn't exist.")
+	newPassphraseFile := fset.String("new-passphrase-file", "", "The file that contains the passphrase of the new master key.")
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if *newKeyFile == "" {
+		return errors.New("reencrypt: -new-key is required")
+	}
+	oldS, _, err := c.open()
+	if err != nil {
+		return err
+	}
+	if _, err := oldS.WaitForRecovery(); err != nil {
+		return err
+	}
+	pp, err := c.readPassphrase(*newPassphraseFile, "STORAGE_NEW_PASSPHRASE", "New passphrase: ")
+	if err != nil {
+		return err
+	}
+	newKey, err := crypto.ReadMasterKey(pp, *newKeyFile, c.cryptoOptions()...)
+	if errors.Is(err, fs.ErrNotExist) {
+		if newKey, err = crypto.CreateMasterKey(c.cryptoOptions()...); err == nil {
+			err = newKey.Save(pp, *newKeyFile)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	c.keys = append(c.keys, newKey)
+	newS, err := storage.Open(c.dir, newKey)
+	if err != nil {
+		return err
+	}
+
+	files := fset.Args()
+	if len(files) == 0 {
+		err := fs.WalkDir(oldS.FS(), ".", func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				files = append(files, path)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	var errs []error
+	for _, f := range files {
+		if h, err := oldS.ReadHeader(f); err == nil && h.Encoding == "records" {
+			fmt.Fprintf(c.stderr, "%s: skipped, record files can't be re-encrypted\n", f)
+			continue
+		}
+		if err := reencryptFile(newS, oldS, f); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f, err))
+			continue
+		}
+		fmt.Fprintf(c.stdout, "%s\n", f)
+	}
+	return errors.Join(errs...)
+}
+
+// reencryptFile replaces a file with a copy encrypted with newS's key.
+func reencryptFile(newS, oldS *storage.Storage, name string) error {
+	if err := oldS.Lock(name); err != nil {
+		return err
+	}
+	defer oldS.Unlock(name)
+	return storage.CopyFile(newS, name, oldS, name)
+}
+
+func (c *cli) passwd(args []string) error {
+	fset := flag.NewFlagSet("passwd", flag.ContinueOnError)
+	fset.SetOutput(c.stderr)
+	newPassphraseFile := fset.String("new-passphrase-file", "", "The file that contains the new passphrase.")
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if c.keyFile == "" {
+		return errors.New("passwd: -key is required")
+	}
+	old, err := c.readPassphrase(c.passphraseFile, "STORAGE_PASSPHRASE", "Passphrase: ")
+	if err != nil {
+		return err
+	}
+	mk, err := crypto.ReadMasterKey(old, c.keyFile, c.cryptoOptions()...)
+	if err != nil {
+		return err
+	}
+	c.keys = append(c.keys, mk)
+	var pp []byte
+	if *newPassphraseFile != "" {
+		if pp, err = c.readPassphrase(*newPassphraseFile, "", ""); err != nil {
+			return err
+		}
+	} else {
+		if pp, err = c.prompt("New passphrase: "); err != nil {
+			return err
+		}
+		again, err := c.prompt("Confirm new passphrase: ")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(pp, again) {
+			return errors.New("passwd: passphrases don't match")
+		}
+	}
+	return mk.ChangePassphrase(old, pp, c.keyFile)
+}
+
+func (c *cli) rollback(args []string) error {
+	fset := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	fset.SetOutput(c.stderr)
+	force := fset.Bool("force", false, "Recover the pending operations immediately. No other process must be using the storage.")
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	var opts []storage.Option
+	if *force {
+		opts = append(opts, storage.WithExclusiveAccess())
+	}
+	s, _, err := c.open(opts...)
+	if err != nil {
+		return err
+	}
+	results, err := s.WaitForRecovery()
+	if len(results) == 0 && err == nil {
+		fmt.Fprintln(c.stdout, "No pending operations.")
+		return nil
+	}
+	for _, r := range results {
+		status := "rolled back"
+		switch {
+		case r.Err != nil:
+			status = fmt.Sprintf("failed: %v", r.Err)
+		case r.RolledForward:
+			status = "rolled forward"
+		}
+		fmt.Fprintf(c.stdout, "%s %s [%s]: %s\n", r.Name, r.TS.Format("2006-01-02 15:04:05"), strings.Join(r.Files, " "), status)
+	}
+	return err
+}
+
+// logger writes the messages of the storage to stderr. Debug messages are
+// only shown with -v.
+type logger struct {
+	w       io.Writer
+	verbose bool
+}
+
+func (l logger) Debug(args ...any) {
+	if l.verbose {
+		fmt.Fprintln(l.w, append([]any{"DEBUG:"}, args...)...)
+	}
+}
+
+func (l logger) Debugf(f string, args ...any) {
+	if l.verbose {
+		fmt.Fprintf(l.w, "DEBUG: "+f+"\n", args...)
+	}
+}
+
+func (l logger) Info(args ...any) {
+	fmt.Fprintln(l.w, append([]any{"INFO:"}, args...)...)
+}
+
+func (l logger) Infof(f string, args ...any) {
+	fmt.Fprintf(l.w, "INFO: "+f+"\n", args...)
+}
+
+func (l logger) Error(args ...any) {
+	fmt.Fprintln(l.w, append([]any{"ERROR:"}, args...)...)
+}
+
+func (l logger) Errorf(f string, args ...any) {
+	fmt.Fprintf(l.w, "ERROR: "+f+"\n", args...)
+}
+
+func (l logger) Fatal(args ...any) {
+	l.Error(args...)
+	os.Exit(1)
+}
+
+func (l logger) Fatalf(f string, args ...any) {
+	l.Errorf(f, args...)
+	os.Exit(1)
+}
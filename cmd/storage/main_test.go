@@ -0,0 +1,230 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+// setup creates a storage with an encrypted master key, and returns the
+// global flags to use it.
+func setup(t *testing.T) (*storage.Storage, []string) {
+	t.Helper()
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "data")
+	keyFile := filepath.Join(tmp, "master.key")
+	ppFile := filepath.Join(tmp, "passphrase")
+	if err := os.WriteFile(ppFile, []byte("foo\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	mk, err := crypto.CreateMasterKey()
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	t.Cleanup(mk.Wipe)
+	if err := mk.Save([]byte("foo"), keyFile); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	s, err := storage.Open(dir, mk)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := s.SaveDataFile("a/doc", map[string]string{"hello": "world"}); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+	w, err := s.OpenBlobWrite("b/blob", "b/blob")
+	if err != nil {
+		t.Fatalf("OpenBlobWrite: %v", err)
+	}
+	if _, err := w.Write([]byte("Hello blob")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return s, []string{"-dir", dir, "-key", keyFile, "-passphrase-file", ppFile}
+}
+
+func runCmd(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	err := run(args, strings.NewReader(""), &stdout, &stderr)
+	if stderr.Len() > 0 {
+		t.Logf("stderr: %s", stderr.String())
+	}
+	return stdout.String(), err
+}
+
+func TestInspect(t *testing.T) {
+	_, flags := setup(t)
+
+	out, err := runCmd(t, append(flags, "ls")...)
+	if err != nil {
+		t.Fatalf("ls: %v", err)
+	}
+	for _, want := range []string{"a/doc", "b/blob", "gob,encrypted,padded"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("ls output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	out, err = runCmd(t, append(flags, "header", "a/doc", "b/blob")...)
+	if err != nil {
+		t.Fatalf("header: %v", err)
+	}
+	if want := regexp.MustCompile(`^a/doc: gob,encrypted,padded key=([0-9a-f]{16})\nb/blob: raw,encrypted,padded,hashed key=([0-9a-f]{16})\n$`); !want.MatchString(out) {
+		t.Errorf("header = %q, want %q", out, want)
+	} else if m := want.FindStringSubmatch(out); m[1] != m[2] {
+		t.Errorf("header key IDs = %q, %q, want the same", m[1], m[2])
+	}
+	if _, err := runCmd(t, append(flags, "header", "nope")...); err == nil {
+		t.Error("header of missing file didn't fail")
+	}
+
+	if out, err = runCmd(t, append(flags, "cat", "b/blob")...); err != nil {
+		t.Fatalf("cat: %v", err)
+	}
+	if want := "Hello blob"; out != want {
+		t.Errorf("cat = %q, want %q", out, want)
+	}
+
+	if _, err := runCmd(t, append(flags, "bogus")...); err == nil {
+		t.Error("unknown command didn't fail")
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	_, flags := setup(t)
+	dir := t.TempDir()
+	newKey := filepath.Join(dir, "new.key")
+	newPP := filepath.Join(dir, "new-passphrase")
+	if err := os.WriteFile(newPP, []byte("bar"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := runCmd(t, append(flags, "reencrypt", "-new-key", newKey, "-new-passphrase-file", newPP)...); err != nil {
+		t.Fatalf("reencrypt: %v", err)
+	}
+	newFlags := []string{flags[0], flags[1], "-key", newKey, "-passphrase-file", newPP}
+	out, err := runCmd(t, append(newFlags, "cat", "b/blob")...)
+	if err != nil {
+		t.Fatalf("cat: %v", err)
+	}
+	if want := "Hello blob"; out != want {
+		t.Errorf("cat = %q, want %q", out, want)
+	}
+	if _, err := runCmd(t, append(newFlags, "cat", "a/doc")...); err != nil {
+		t.Fatalf("cat: %v", err)
+	}
+	if _, err := runCmd(t, append(flags, "cat", "a/doc")...); err == nil {
+		t.Error("cat with the old key didn't fail")
+	}
+}
+
+func TestPasswd(t *testing.T) {
+	_, flags := setup(t)
+	var stdout, stderr bytes.Buffer
+	if err := run(append(flags, "passwd"), strings.NewReader("bar\nbar\n"), &stdout, &stderr); err != nil {
+		t.Fatalf("passwd: %v", err)
+	}
+	if _, err := runCmd(t, append(flags, "ls")...); err == nil {
+		t.Error("ls with the old passphrase didn't fail")
+	}
+	t.Setenv("STORAGE_PASSPHRASE", "bar")
+	if _, err := runCmd(t, flags[0], flags[1], flags[2], flags[3], "cat", "b/blob"); err != nil {
+		t.Errorf("cat with the new passphrase: %v", err)
+	}
+	if err := run(append(flags[:4], "passwd"), strings.NewReader("baz\nqux\n"), &stdout, &stderr); err == nil {
+		t.Error("passwd with mismatched passphrases didn't fail")
+	}
+}
+
+func TestCredentialAndKeyring(t *testing.T) {
+	_, flags := setup(t)
+	creds := t.TempDir()
+	if err := os.WriteFile(filepath.Join(creds, "STORAGE_PASSPHRASE"), []byte("foo\n"), 0400); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	t.Setenv("CREDENTIALS_DIRECTORY", creds)
+	t.Setenv("STORAGE_PASSPHRASE", "wrong")
+	desc := fmt.Sprintf("c2FmZQ-storage-test:%d:%d", os.Getpid(), time.Now().UnixNano())
+	keyringFlags := []string{flags[0], flags[1], flags[2], flags[3], "-keyring", desc}
+	if _, err := runCmd(t, append(keyringFlags, "cat", "b/blob")...); err != nil {
+		if errors.Is(err, crypto.ErrKeyringNotSupported) {
+			t.Skip(err)
+		}
+		t.Fatalf("cat with credential: %v", err)
+	}
+	defer crypto.RemoveFromKeyring(desc)
+
+	t.Setenv("CREDENTIALS_DIRECTORY", "")
+	if _, err := runCmd(t, append(flags[:4], "cat", "b/blob")...); err == nil {
+		t.Error("cat with the wrong passphrase didn't fail")
+	}
+	if _, err := runCmd(t, append(keyringFlags, "cat", "b/blob")...); err != nil {
+		t.Errorf("cat with keyring: %v", err)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	s, flags := setup(t)
+	out, err := runCmd(t, append(flags, "rollback")...)
+	if err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	if want := "No pending operations.\n"; out != want {
+		t.Errorf("rollback = %q, want %q", out, want)
+	}
+
+	// Leave the record of an interrupted operation behind.
+	ts := time.Now()
+	op := struct {
+		TS    time.Time
+		Files []string
+	}{ts, []string{"a/doc"}}
+	if err := s.SaveDataFile(fmt.Sprintf("pending/%d", ts.UnixNano()), op); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+
+	if out, err = runCmd(t, append(flags, "rollback", "-force")...); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	if !strings.Contains(out, "[a/doc]: rolled back") {
+		t.Errorf("rollback = %q", out)
+	}
+	var doc map[string]string
+	if err := s.ReadDataFile("a/doc", &doc); err != nil || doc["hello"] != "world" {
+		t.Errorf("ReadDataFile: %v, %v", doc, err)
+	}
+}
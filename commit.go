@@ -0,0 +1,201 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CommitStrategy specifies how changes to multiple files are committed
+// atomically.
+type CommitStrategy int
+
+const (
+	// CommitBackup makes a backup of all the files before changing them,
+	// and restores the backup if the commit fails. This is the default.
+	CommitBackup CommitStrategy = iota
+	// CommitWAL uses a write-ahead log. The new versions of the files are
+	// written first, then the intent to commit is journaled, and then the
+	// new versions replace the old ones. If the commit is interrupted
+	// after the intent is journaled, it is completed the next time the
+	// storage is opened. This avoids copying the files when the backup
+	// can't use hard links, and it is faster for large commits.
+	CommitWAL
+)
+
+// WithCommitStrategy specifies how changes to multiple files are committed.
+// The default is CommitBackup.
+func WithCommitStrategy(c CommitStrategy) Option {
+	return func(opt *option) {
+		opt.commitStrategy = c
+	}
+}
+
+// CommitError is returned when some of the changes in a commit fail. The
+// changes to all the files are rolled back.
+type CommitError struct {
+	// Errors contains the error for each file that failed, keyed by file
+	// name.
+	Errors map[string]error
+}
+
+// Files returns the sorted names of the files that failed.
+func (e *CommitError) Files() []string {
+	files := make([]string, 0, len(e.Errors))
+	for f := range e.Errors {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func (e *CommitError) Error() string {
+	var parts []string
+	for _, f := range e.Files() {
+		parts = append(parts, fmt.Sprintf("%s: %v", f, e.Errors[f]))
+	}
+	return "commit failed: " + strings.Join(parts, "; ")
+}
+
+// Unwrap returns the errors for all the files that failed, so that errors.Is
+// and errors.As can match any of them.
+func (e *CommitError) Unwrap() []error {
+	var errs []error
+	for _, f := range e.Files() {
+		errs = append(errs, e.Errors[f])
+	}
+	return errs
+}
+
+// fileResult is the result of an operation on one file.
+type fileResult struct {
+	file string
+	err  error
+}
+
+// collectErrors reads n results from ch, and returns a *CommitError if any of
+// them failed.
+func collectErrors(ch <-chan fileResult, n int) error {
+	var e *CommitError
+	for _ = range n {
+		r := <-ch
+		if r.err == nil {
+			continue
+		}
+		if e == nil {
+			e = &CommitError{Errors: make(map[string]error)}
+		}
+		e.Errors[r.file] = r.err
+	}
+	if e == nil {
+		return nil
+	}
+	return e
+}
+
+// commitChanges atomically writes objs to files, and deletes the files in
+// deleted.
+func (s *Storage) commitChanges(files []string, objs []interface{}, deleted []string) error {
+	if len(files)+len(deleted) <= 1 {
+		// Changes to a single file are always atomic.
+		return s.applyChanges(files, objs, deleted)
+	}
+	if s.commitStrategy == CommitWAL {
+		return s.commitWAL(files, objs, deleted)
+	}
+	// If some of the changes fail and some succeed, the data could be
+	// inconsistent. Make a backup of the original data, and restore it if
+	// anything goes wrong.
+	//
+	// If the process dies in the middle of saving the data, the backup will
+	// be restored automatically when the process restarts. See Open().
+	b, err := s.createBackup(append(append([]string(nil), files...), deleted...))
+	if err != nil {
+		return err
+	}
+	if err := s.applyChanges(files, objs, deleted); err != nil {
+		b.restore()
+		return err
+	}
+	return b.delete()
+}
+
+// applyChanges writes objs to files, and deletes the files in deleted.
+func (s *Storage) applyChanges(files []string, objs []interface{}, deleted []string) error {
+	ch := make(chan fileResult)
+	for i := range files {
+		go func(file string, obj interface{}) {
+			ch <- fileResult{file, s.SaveDataFile(file, obj)}
+		}(files[i], objs[i])
+	}
+	for _, f := range deleted {
+		go func(file string) {
+			ch <- fileResult{file, s.deleteFile(file)}
+		}(f)
+	}
+	return collectErrors(ch, len(files)+len(deleted))
+}
+
+// deleteFile deletes a file, if it exists.
+func (s *Storage) deleteFile(filename string) error {
+	fn := filepath.Join(s.dir, filename)
+	err := s.backend.Remove(fn)
+	s.invalidateCache(filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return s.syncDir(filepath.Dir(fn))
+}
+
+// commitWAL commits changes with a write-ahead log.
+func (s *Storage) commitWAL(files []string, objs []interface{}, deleted []string) error {
+	b := &backup{dir: s.dir, s: s, TS: time.Now(), Files: files, Deleted: deleted, WAL: true}
+	if err := s.savePending(b); err != nil {
+		return err
+	}
+	ch := make(chan fileResult)
+	for i := range files {
+		go func(file string, obj interface{}) {
+			ch <- fileResult{file, s.writeFile(fileContext(file), b.walFileName(file), obj)}
+		}(files[i], objs[i])
+	}
+	if err := collectErrors(ch, len(files)); err != nil {
+		b.restore()
+		return err
+	}
+	// Journal the intent to commit. From this point on, the commit is
+	// completed even if the process dies.
+	b.Committed = true
+	if err := s.SaveDataFile(b.pending, b); err != nil {
+		b.restore()
+		return err
+	}
+	return b.rollForward()
+}
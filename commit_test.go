@@ -0,0 +1,186 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCommitWAL(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey(), WithCommitStrategy(CommitWAL))
+	type Foo struct {
+		N int
+	}
+	files := []string{"a", "b", "c"}
+	for i, f := range files {
+		if err := s.SaveDataFile(f, Foo{i}); err != nil {
+			t.Fatalf("s.SaveDataFile: %v", err)
+		}
+	}
+	foos := []*Foo{{}, {}, {}}
+	commit, err := s.OpenManyForUpdate(files, foos)
+	if err != nil {
+		t.Fatalf("s.OpenManyForUpdate: %v", err)
+	}
+	for _, f := range foos {
+		f.N += 10
+	}
+	if err := commit(true, nil); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	for i, f := range files {
+		var foo Foo
+		if err := s.ReadDataFile(f, &foo); err != nil {
+			t.Fatalf("s.ReadDataFile(%q): %v", f, err)
+		}
+		if want, got := i+10, foo.N; want != got {
+			t.Errorf("%s: Unexpected value. Want %d, got %d", f, want, got)
+		}
+	}
+
+	tx, err := s.Begin("a", "b")
+	if err != nil {
+		t.Fatalf("s.Begin: %v", err)
+	}
+	if err := tx.Write("a", Foo{100}); err != nil {
+		t.Fatalf("tx.Write: %v", err)
+	}
+	if err := tx.Delete("b"); err != nil {
+		t.Fatalf("tx.Delete: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("tx.Commit: %v", err)
+	}
+	var foo Foo
+	if err := s.ReadDataFile("a", &foo); err != nil || foo.N != 100 {
+		t.Errorf("s.ReadDataFile(a) = %v, %v", foo, err)
+	}
+	if err := s.ReadDataFile("b", &foo); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("s.ReadDataFile(b) = %v, want ErrNotExist", err)
+	}
+	if m, _ := filepath.Glob(filepath.Join(s.dir, "*.wal-*")); len(m) != 0 {
+		t.Errorf("Unexpected WAL files: %v", m)
+	}
+}
+
+func TestCommitWALRecovery(t *testing.T) {
+	t.Parallel()
+	for _, committed := range []bool{false, true} {
+		dir := t.TempDir()
+		mk := aesEncryptionKey()
+		s := New(dir, mk, WithCommitStrategy(CommitWAL))
+		type Foo struct {
+			N int
+		}
+		for i, f := range []string{"a", "b"} {
+			if err := s.SaveDataFile(f, Foo{i}); err != nil {
+				t.Fatalf("s.SaveDataFile: %v", err)
+			}
+		}
+
+		// Simulate a commit that was interrupted before the new
+		// versions replaced the files.
+		b := &backup{dir: dir, s: s, TS: time.Now(), Files: []string{"a"}, Deleted: []string{"b"}, WAL: true}
+		if err := s.savePending(b); err != nil {
+			t.Fatalf("s.savePending: %v", err)
+		}
+		if err := s.writeFile(fileContext("a"), b.walFileName("a"), Foo{10}); err != nil {
+			t.Fatalf("s.writeFile: %v", err)
+		}
+		b.Committed = committed
+		if err := s.SaveDataFile(b.pending, b); err != nil {
+			t.Fatalf("s.SaveDataFile: %v", err)
+		}
+
+		// New will notice the interrupted commit, and either roll it
+		// forward or back.
+		s = New(dir, mk)
+
+		var a, bb Foo
+		if err := s.ReadDataFile("a", &a); err != nil {
+			t.Fatalf("s.ReadDataFile(a): %v", err)
+		}
+		errB := s.ReadDataFile("b", &bb)
+		if committed {
+			if a.N != 10 || !errors.Is(errB, os.ErrNotExist) {
+				t.Errorf("Roll forward: a = %v, b = %v, %v", a, bb, errB)
+			}
+		} else {
+			if a.N != 0 || errB != nil || bb.N != 1 {
+				t.Errorf("Roll back: a = %v, b = %v, %v", a, bb, errB)
+			}
+		}
+		if m, _ := filepath.Glob(filepath.Join(dir, "*.wal-*")); len(m) != 0 {
+			t.Errorf("Unexpected WAL files: %v", m)
+		}
+		if m, _ := filepath.Glob(filepath.Join(dir, "pending", "*")); len(m) != 0 {
+			t.Errorf("Unexpected pending ops: %v", m)
+		}
+	}
+}
+
+func TestCommitError(t *testing.T) {
+	for _, strategy := range []CommitStrategy{CommitBackup, CommitWAL} {
+		dir := t.TempDir()
+		s := New(dir, aesEncryptionKey(), WithCommitStrategy(strategy))
+		type Foo struct {
+			N int
+		}
+		if err := s.SaveDataFile("a", Foo{1}); err != nil {
+			t.Fatalf("s.SaveDataFile: %v", err)
+		}
+		tx, err := s.Begin("a", "b")
+		if err != nil {
+			t.Fatalf("s.Begin: %v", err)
+		}
+		if err := tx.Write("a", Foo{10}); err != nil {
+			t.Fatalf("tx.Write: %v", err)
+		}
+		if err := tx.Write("b", failingMarshaler{}); err != nil {
+			t.Fatalf("tx.Write: %v", err)
+		}
+		err = tx.Commit()
+		var ce *CommitError
+		if !errors.As(err, &ce) {
+			t.Fatalf("[%d] tx.Commit() = %v, want CommitError", strategy, err)
+		}
+		if got := ce.Files(); len(got) != 1 || got[0] != "b" {
+			t.Errorf("[%d] ce.Files() = %v, want [b]", strategy, got)
+		}
+		var foo Foo
+		if err := s.ReadDataFile("a", &foo); err != nil || foo.N != 1 {
+			t.Errorf("[%d] s.ReadDataFile(a) = %v, %v", strategy, foo, err)
+		}
+	}
+}
+
+type failingMarshaler struct{}
+
+func (failingMarshaler) MarshalBinary() ([]byte, error) {
+	return nil, errors.New("marshal failed")
+}
@@ -0,0 +1,277 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+)
+
+// Compressed blobs are split into blocks of blobBlockSize bytes that are
+// compressed independently so that the blob can be read from any offset
+// without decompressing everything before it.
+//
+// The compressed stream contains:
+//   - the blocks, each with a 5-byte header: the size of the block (uint32) and
+//     the compression method,
+//   - the index, i.e. the offset of each block (uint64),
+//   - the trailer: the size of the uncompressed blob (uint64), the number of
+//     blocks (uint32), and the magic string "KRIZ".
+//
+// When the blob is encrypted, all of the above is encrypted with the stream
+// encryption of the file.
+const (
+	blobBlockSize   = 1 << 20
+	blockHeaderSize = 5
+	blockStored     = 0x00
+	blockDeflate    = 0x01
+
+	blobTrailerSize = 16
+	blobTrailer     = "KRIZ"
+)
+
+// blockWriter compresses a blob stream.
+type blockWriter struct {
+	w     io.WriteCloser
+	fw    *flate.Writer
+	buf   []byte
+	comp  bytes.Buffer
+	off   int64
+	size  int64
+	index []int64
+	err   error
+}
+
+func newBlockWriter(w io.WriteCloser) *blockWriter {
+	fw, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return &blockWriter{w: w, fw: fw, buf: make([]byte, 0, blobBlockSize)}
+}
+
+// Write compresses and writes b.
+func (w *blockWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	var n int
+	for len(b) > 0 {
+		nn := copy(w.buf[len(w.buf):cap(w.buf)], b)
+		w.buf = w.buf[:len(w.buf)+nn]
+		b = b[nn:]
+		n += nn
+		if len(w.buf) == cap(w.buf) {
+			if w.err = w.flush(); w.err != nil {
+				return n, w.err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush compresses and writes one block.
+func (w *blockWriter) flush() error {
+	w.comp.Reset()
+	w.fw.Reset(&w.comp)
+	if _, err := w.fw.Write(w.buf); err != nil {
+		return err
+	}
+	if err := w.fw.Close(); err != nil {
+		return err
+	}
+	method, data := byte(blockDeflate), w.comp.Bytes()
+	if len(data) >= len(w.buf) {
+		method, data = blockStored, w.buf
+	}
+	var hdr [blockHeaderSize]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(data)))
+	hdr[4] = method
+	if _, err := w.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(data); err != nil {
+		return err
+	}
+	w.index = append(w.index, w.off)
+	w.off += int64(len(hdr) + len(data))
+	w.size += int64(len(w.buf))
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close writes the last block and the index, and closes the underlying
+// stream.
+func (w *blockWriter) Close() error {
+	if w.err == nil && len(w.buf) > 0 {
+		w.err = w.flush()
+	}
+	if w.err == nil {
+		b := make([]byte, 0, 8*len(w.index)+blobTrailerSize)
+		for _, off := range w.index {
+			b = binary.BigEndian.AppendUint64(b, uint64(off))
+		}
+		b = binary.BigEndian.AppendUint64(b, uint64(w.size))
+		b = binary.BigEndian.AppendUint32(b, uint32(len(w.index)))
+		b = append(b, blobTrailer...)
+		_, w.err = w.w.Write(b)
+	}
+	err := w.err
+	if e := w.w.Close(); err == nil {
+		err = e
+	}
+	w.err = fs.ErrClosed
+	return err
+}
+
+// blockReader decompresses a blob stream.
+type blockReader struct {
+	r     io.ReadSeekCloser
+	start int64
+	index []int64
+	size  int64
+	off   int64
+	blk   int
+	buf   []byte
+}
+
+// newBlockReader reads the index of a compressed blob. The compressed stream
+// is between offsets start and end of r.
+func newBlockReader(r io.ReadSeekCloser, start, end int64) (*blockReader, error) {
+	if end-start < blobTrailerSize {
+		return nil, errors.New("invalid compressed blob")
+	}
+	end -= blobTrailerSize
+	if _, err := r.Seek(end, io.SeekStart); err != nil {
+		return nil, err
+	}
+	trailer := make([]byte, blobTrailerSize)
+	if _, err := io.ReadFull(r, trailer); err != nil {
+		return nil, err
+	}
+	if string(trailer[12:]) != blobTrailer {
+		return nil, errors.New("invalid compressed blob trailer")
+	}
+	size := int64(binary.BigEndian.Uint64(trailer[:8]))
+	n := int64(binary.BigEndian.Uint32(trailer[8:12]))
+	if size < 0 || n != (size+blobBlockSize-1)/blobBlockSize || end-8*n < start {
+		return nil, errors.New("invalid compressed blob trailer")
+	}
+	if _, err := r.Seek(end-8*n, io.SeekStart); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 8*n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	index := make([]int64, n)
+	for i := range index {
+		index[i] = int64(binary.BigEndian.Uint64(b[8*i:]))
+	}
+	return &blockReader{r: r, start: start, index: index, size: size, blk: -1}, nil
+}
+
+// Read reads decompressed data.
+func (r *blockReader) Read(b []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	blk := int(r.off / blobBlockSize)
+	if blk != r.blk {
+		if err := r.readBlock(blk); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, r.buf[r.off-int64(blk)*blobBlockSize:])
+	r.off += int64(n)
+	return n, nil
+}
+
+// readBlock reads and decompresses one block.
+func (r *blockReader) readBlock(blk int) error {
+	r.blk = -1
+	if _, err := r.r.Seek(r.start+r.index[blk], io.SeekStart); err != nil {
+		return err
+	}
+	var hdr [blockHeaderSize]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		return err
+	}
+	size := int(binary.BigEndian.Uint32(hdr[:4]))
+	want := int(min(blobBlockSize, r.size-int64(blk)*blobBlockSize))
+	switch hdr[4] {
+	case blockStored:
+		if size != want {
+			return errors.New("invalid block size")
+		}
+		r.buf = slices.Grow(r.buf[:0], size)[:size]
+		if _, err := io.ReadFull(r.r, r.buf); err != nil {
+			return err
+		}
+	case blockDeflate:
+		fr := flate.NewReader(io.LimitReader(r.r, int64(size)))
+		var err error
+		if r.buf, err = appendAll(r.buf[:0], io.LimitReader(fr, int64(want)+1), want); err != nil {
+			return err
+		}
+		if err := fr.Close(); err != nil {
+			return err
+		}
+		if len(r.buf) != want {
+			return errors.New("invalid block size")
+		}
+	default:
+		return fmt.Errorf("unexpected block compression method %x", hdr[4])
+	}
+	r.blk = blk
+	return nil
+}
+
+// Seek moves the next read to a new offset in the decompressed data.
+func (r *blockReader) Seek(offset int64, whence int) (int64, error) {
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = r.off + offset
+	case io.SeekEnd:
+		newOffset = r.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if newOffset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	r.off = newOffset
+	return r.off, nil
+}
+
+// Close closes the underlying stream.
+func (r *blockReader) Close() error {
+	return r.r.Close()
+}
@@ -0,0 +1,151 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+func TestCompressedBlobs(t *testing.T) {
+	testcases := []struct {
+		name string
+		mk   crypto.EncryptionKey
+	}{
+		{"AES", aesEncryptionKey()},
+		{"Chacha20Poly1305", ccEncryptionKey()},
+		{"PlainText", nil},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := New(dir, tc.mk, WithCompression())
+
+			var buf bytes.Buffer
+			for i := 0; buf.Len() < 3*blobBlockSize+12345; i++ {
+				fmt.Fprintf(&buf, "line %d of a very compressible blob\n", i)
+			}
+			content := buf.Bytes()
+
+			w, err := s.CreateBlob("blob")
+			if err != nil {
+				t.Fatalf("s.CreateBlob: %v", err)
+			}
+			if _, err := w.Write(content); err != nil {
+				t.Fatalf("w.Write: %v", err)
+			}
+			if err := w.Commit(); err != nil {
+				t.Fatalf("w.Commit: %v", err)
+			}
+			fi, err := os.Stat(filepath.Join(dir, "blob"))
+			if err != nil {
+				t.Fatalf("os.Stat: %v", err)
+			}
+			if fi.Size() > int64(len(content))/2 {
+				t.Errorf("Blob isn't compressed: %d >= %d", fi.Size(), len(content)/2)
+			}
+
+			r, err := s.OpenBlobRead("blob")
+			if err != nil {
+				t.Fatalf("s.OpenBlobRead: %v", err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("io.ReadAll: %v", err)
+			}
+			if !bytes.Equal(content, got) {
+				t.Fatalf("Unexpected content")
+			}
+
+			for i := 0; i < 20; i++ {
+				off := rand.Int63n(int64(len(content)))
+				if _, err := r.Seek(off, io.SeekStart); err != nil {
+					t.Fatalf("r.Seek(%d): %v", off, err)
+				}
+				b := make([]byte, 2000)
+				n, err := io.ReadFull(r, b)
+				if err != nil && err != io.ErrUnexpectedEOF {
+					t.Fatalf("io.ReadFull: %v", err)
+				}
+				if want := content[off:min(off+2000, int64(len(content)))]; !bytes.Equal(want, b[:n]) {
+					t.Fatalf("Unexpected content at offset %d", off)
+				}
+			}
+			if off, err := r.Seek(-10, io.SeekEnd); err != nil || off != int64(len(content))-10 {
+				t.Fatalf("r.Seek(-10, io.SeekEnd) = %d, %v", off, err)
+			}
+			if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, content[len(content)-10:]) {
+				t.Fatalf("io.ReadAll = %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestCompressedBlobIncompressible(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, aesEncryptionKey(), WithCompression())
+
+	for _, size := range []int{0, 1, blobBlockSize, blobBlockSize + 1} {
+		content := make([]byte, size)
+		rand.Read(content)
+		w, err := s.CreateBlob("blob")
+		if err != nil {
+			t.Fatalf("s.CreateBlob: %v", err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatalf("w.Write: %v", err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatalf("w.Commit: %v", err)
+		}
+		if got := readBlob(t, s, "blob"); !bytes.Equal(content, got) {
+			t.Errorf("Unexpected content for size %d", size)
+		}
+	}
+}
+
+func TestCompressedDataFile(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, aesEncryptionKey(), WithCompression())
+
+	want := map[string]string{"foo": "bar"}
+	if err := s.SaveDataFile("file", want); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	var got map[string]string
+	if err := s.ReadDataFile("file", &got); err != nil {
+		t.Fatalf("s.ReadDataFile: %v", err)
+	}
+	if got["foo"] != "bar" {
+		t.Errorf("Unexpected value: %v", got)
+	}
+}
@@ -0,0 +1,320 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package config binds a Go struct to a data file in an encrypted storage,
+// and reloads it when the file changes.
+//
+// The file is validated when it is loaded, and when it is updated. Changes
+// made with Update are delivered immediately. Changes made by other processes
+// are detected by reading the file periodically.
+//
+// Example:
+//
+//	type Settings struct {
+//		Port int
+//	}
+//	cfg, err := config.Open(s, "settings", config.WithDefault(Settings{Port: 8080}))
+//	if err != nil {
+//		return err
+//	}
+//	defer cfg.Close()
+//	cancel := cfg.Subscribe(func(v Settings) {
+//		restart(v.Port)
+//	})
+//	defer cancel()
+//	...
+//	err = cfg.Update(func(v *Settings) error {
+//		v.Port = 8443
+//		return nil
+//	})
+package config
+
+import (
+	"errors"
+	"io/fs"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+)
+
+// ErrClosed is returned when the config is closed.
+var ErrClosed = errors.New("config is closed")
+
+const defaultPollInterval = 10 * time.Second
+
+// Option is used to specify optional parameters of Open.
+type Option[T any] func(*Config[T])
+
+// WithDefault specifies the value of the config when the file doesn't exist.
+// The file is created with this value.
+func WithDefault[T any](v T) Option[T] {
+	return func(c *Config[T]) {
+		c.def = &v
+	}
+}
+
+// WithValidator specifies a function that validates the config when it is
+// loaded or updated. Invalid values are rejected by Open and Update, and
+// ignored when the file is reloaded.
+func WithValidator[T any](fn func(*T) error) Option[T] {
+	return func(c *Config[T]) {
+		c.validate = fn
+	}
+}
+
+// WithPollInterval specifies how often the file is read to detect changes made
+// by other processes. The default is 10 seconds. A zero or negative value
+// disables polling.
+func WithPollInterval[T any](d time.Duration) Option[T] {
+	return func(c *Config[T]) {
+		c.pollInterval = d
+	}
+}
+
+// Config is a config of type T, stored in a data file. It is safe for
+// concurrent use.
+type Config[T any] struct {
+	s            *storage.Storage
+	name         string
+	def          *T
+	validate     func(*T) error
+	pollInterval time.Duration
+
+	mu     sync.Mutex
+	closed bool
+	value  *T
+	nextID int
+	subs   map[int]func(T)
+
+	// notifyMu serializes the notifications.
+	notifyMu sync.Mutex
+
+	stop sync.Once
+	done chan struct{}
+	ch   chan struct{}
+}
+
+// Open loads the config from the data file name, and starts watching it for
+// changes.
+func Open[T any](s *storage.Storage, name string, opts ...Option[T]) (*Config[T], error) {
+	c := &Config[T]{
+		s:            s,
+		name:         name,
+		pollInterval: defaultPollInterval,
+		subs:         make(map[int]func(T)),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	v, err := c.load()
+	if errors.Is(err, fs.ErrNotExist) && c.def != nil {
+		v, err = c.create()
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.value = v
+	if c.pollInterval > 0 {
+		c.done = make(chan struct{})
+		c.ch = make(chan struct{})
+		go c.pollLoop()
+	}
+	return c, nil
+}
+
+// create creates the file with the default value, unless another process
+// created it first.
+func (c *Config[T]) create() (_ *T, retErr error) {
+	if err := c.s.Lock(c.name); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := c.s.Unlock(c.name); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	if v, err := c.load(); !errors.Is(err, fs.ErrNotExist) {
+		return v, err
+	}
+	v := new(T)
+	*v = *c.def
+	if err := c.check(v); err != nil {
+		return nil, err
+	}
+	if err := c.s.SaveDataFile(c.name, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (c *Config[T]) check(v *T) error {
+	if c.validate == nil {
+		return nil
+	}
+	return c.validate(v)
+}
+
+// load reads and validates the file.
+func (c *Config[T]) load() (*T, error) {
+	v := new(T)
+	if err := c.s.ReadDataFile(c.name, v); err != nil {
+		return nil, err
+	}
+	if err := c.check(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (c *Config[T]) pollLoop() {
+	defer close(c.ch)
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.Reload(); err != nil && !errors.Is(err, ErrClosed) {
+				c.s.Logger().Errorf("config: %s: Reload: %v", c.name, err)
+			}
+		}
+	}
+}
+
+// Close stops watching the file.
+func (c *Config[T]) Close() error {
+	c.stop.Do(func() {
+		if c.done != nil {
+			close(c.done)
+			<-c.ch
+		}
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.subs = nil
+	return nil
+}
+
+// Get returns a copy of the current config. Maps, slices, and pointers in the
+// config are shared, and they must not be modified.
+func (c *Config[T]) Get() T {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return *c.value
+}
+
+// Subscribe registers fn to be called with a copy of the config each time it
+// changes. The returned function cancels the subscription. The callbacks are
+// called sequentially, and they should return quickly. They must not call
+// Update or Reload.
+func (c *Config[T]) Subscribe(fn func(T)) (cancel func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return func() {}
+	}
+	id := c.nextID
+	c.nextID++
+	c.subs[id] = fn
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.subs, id)
+	}
+}
+
+// Watch returns a channel that receives a copy of the config each time it
+// changes. If the receiver falls behind, only the latest value is kept. The
+// returned function cancels the subscription.
+func (c *Config[T]) Watch() (<-chan T, func()) {
+	ch := make(chan T, 1)
+	cancel := c.Subscribe(func(v T) {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- v
+	})
+	return ch, cancel
+}
+
+// Update calls fn with a copy of the config, and saves the result if fn
+// returns nil and the new value is valid. The subscribers are notified before
+// Update returns.
+func (c *Config[T]) Update(fn func(*T) error) (retErr error) {
+	v := new(T)
+	commit, err := c.s.OpenForUpdate(c.name, v)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	if err := fn(v); err != nil {
+		return err
+	}
+	if err := c.check(v); err != nil {
+		return err
+	}
+	if err := commit(true, nil); err != nil {
+		return err
+	}
+	return c.set(v)
+}
+
+// Reload reads the file, and notifies the subscribers if the config changed.
+// It is called periodically, unless polling is disabled.
+func (c *Config[T]) Reload() error {
+	v, err := c.load()
+	if err != nil {
+		return err
+	}
+	return c.set(v)
+}
+
+// set replaces the config with v, and notifies the subscribers if it changed.
+func (c *Config[T]) set(v *T) error {
+	c.notifyMu.Lock()
+	defer c.notifyMu.Unlock()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	if reflect.DeepEqual(c.value, v) {
+		c.mu.Unlock()
+		return nil
+	}
+	c.value = v
+	subs := make([]func(T), 0, len(c.subs))
+	for _, fn := range c.subs {
+		subs = append(subs, fn)
+	}
+	c.mu.Unlock()
+	for _, fn := range subs {
+		fn(*v)
+	}
+	return nil
+}
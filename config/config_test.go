@@ -0,0 +1,155 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package config_test
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage/config"
+	"github.com/c2FmZQ/storage/internal/storagetest"
+)
+
+type settings struct {
+	Name string
+	Port int
+}
+
+func validate(v *settings) error {
+	if v.Port <= 0 {
+		return errors.New("invalid port")
+	}
+	return nil
+}
+
+func TestOpen(t *testing.T) {
+	s := storagetest.New(t)
+	if _, err := config.Open[settings](s, "settings"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open() = %v, want ErrNotExist", err)
+	}
+	if _, err := config.Open(s, "settings", config.WithDefault(settings{}), config.WithValidator(validate)); err == nil {
+		t.Error("Open() with invalid default succeeded")
+	}
+	cfg, err := config.Open(s, "settings", config.WithDefault(settings{Name: "foo", Port: 80}), config.WithValidator(validate))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer cfg.Close()
+	if got, want := cfg.Get(), (settings{Name: "foo", Port: 80}); got != want {
+		t.Errorf("Get() = %+v, want %+v", got, want)
+	}
+	var v settings
+	if err := s.ReadDataFile("settings", &v); err != nil || v.Port != 80 {
+		t.Errorf("ReadDataFile() = %+v, %v", v, err)
+	}
+
+	// The default doesn't replace an existing file.
+	cfg2, err := config.Open(s, "settings", config.WithDefault(settings{Port: 1}))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer cfg2.Close()
+	if got := cfg2.Get(); got.Port != 80 {
+		t.Errorf("Get() = %+v", got)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	s := storagetest.New(t)
+	cfg, err := config.Open(s, "settings", config.WithDefault(settings{Port: 80}), config.WithValidator(validate))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer cfg.Close()
+
+	var got []settings
+	cancel := cfg.Subscribe(func(v settings) {
+		got = append(got, v)
+	})
+	if err := cfg.Update(func(v *settings) error {
+		v.Port = 8080
+		return nil
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := cfg.Update(func(v *settings) error {
+		v.Port = -1
+		return nil
+	}); err == nil {
+		t.Error("Update() with invalid value succeeded")
+	}
+	if err := cfg.Update(func(v *settings) error {
+		return nil
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if len(got) != 1 || got[0].Port != 8080 {
+		t.Errorf("Subscriber got %+v", got)
+	}
+	if v := cfg.Get(); v.Port != 8080 {
+		t.Errorf("Get() = %+v", v)
+	}
+	cancel()
+	if err := cfg.Update(func(v *settings) error {
+		v.Port = 443
+		return nil
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if len(got) != 1 {
+		t.Errorf("Subscriber got %+v after cancel", got)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s := storagetest.New(t)
+	cfg, err := config.Open(s, "settings", config.WithDefault(settings{Port: 80}), config.WithValidator(validate), config.WithPollInterval[settings](10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer cfg.Close()
+	ch, cancel := cfg.Watch()
+	defer cancel()
+
+	// An invalid change by another process is ignored.
+	if err := s.SaveDataFile("settings", &settings{Port: 0}); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+	if err := cfg.Reload(); err == nil {
+		t.Error("Reload() with invalid value succeeded")
+	}
+	if err := s.SaveDataFile("settings", &settings{Name: "bar", Port: 9000}); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+	select {
+	case v := <-ch:
+		if v.Name != "bar" || v.Port != 9000 {
+			t.Errorf("Watch() got %+v", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for change")
+	}
+}
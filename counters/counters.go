@@ -0,0 +1,198 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package counters implements persistent named counters and token bucket rate
+// limiters, on top of an encrypted storage.
+//
+// Each counter and each rate limiter is stored in its own small file, which is
+// locked only while it is updated, so that concurrent updates of different
+// counters don't contend with each other. The state survives restarts, and it
+// is shared by all the processes that use the same storage.
+//
+// Example:
+//
+//	cs := counters.New(s, "counters")
+//	n, err := cs.Increment("logins")
+//	if err != nil {
+//		return err
+//	}
+//	...
+//	ok, err := cs.Allow("login:"+user, counters.Limit{Rate: 1, Burst: 5})
+//	if err != nil {
+//		return err
+//	}
+//	if !ok {
+//		return errTooManyRequests
+//	}
+package counters
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"path/filepath"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+)
+
+// Limit is the limit of a token bucket rate limiter.
+type Limit struct {
+	// Rate is the number of tokens added to the bucket per second.
+	Rate float64
+	// Burst is the size of the bucket.
+	Burst int
+}
+
+// counter is a counter, as it is stored.
+type counter struct {
+	Value int64 `json:"value"`
+}
+
+// bucket is the state of a rate limiter, as it is stored.
+type bucket struct {
+	Tokens float64   `json:"tokens"`
+	Last   time.Time `json:"last"`
+}
+
+// Store stores counters and rate limiters.
+type Store struct {
+	s   *storage.Storage
+	dir string
+}
+
+// New returns a Store that keeps its files in dir.
+func New(s *storage.Storage, dir string) *Store {
+	return &Store{s: s, dir: dir}
+}
+
+// counterFile returns the name of the file of a counter. The names of the
+// counters are not visible in the file names.
+func (cs *Store) counterFile(name string) string {
+	return filepath.Join(cs.dir, "counters", cs.s.HashString(name))
+}
+
+// limiterFile returns the name of the file of a rate limiter.
+func (cs *Store) limiterFile(name string) string {
+	return filepath.Join(cs.dir, "limiters", cs.s.HashString(name))
+}
+
+// update calls fn with the content of filename in a transaction, and commits
+// the changes if fn returns nil. obj is left unchanged if the file doesn't
+// exist.
+func (cs *Store) update(filename string, obj any, fn func() error) error {
+	tx, err := cs.s.Begin(filename)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.Read(filename, obj); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	if err := tx.Write(filename, obj); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Add adds delta to a counter atomically, and returns the new value. Counters
+// that don't exist have a value of zero.
+func (cs *Store) Add(name string, delta int64) (int64, error) {
+	var c counter
+	err := cs.update(cs.counterFile(name), &c, func() error {
+		c.Value += delta
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return c.Value, nil
+}
+
+// Increment adds one to a counter atomically, and returns the new value.
+func (cs *Store) Increment(name string) (int64, error) {
+	return cs.Add(name, 1)
+}
+
+// Get returns the value of a counter.
+func (cs *Store) Get(name string) (int64, error) {
+	var c counter
+	if err := cs.s.ReadDataFile(cs.counterFile(name), &c); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	return c.Value, nil
+}
+
+// Delete deletes a counter, which resets it to zero. Deleting a counter that
+// doesn't exist isn't an error.
+func (cs *Store) Delete(name string) error {
+	if err := cs.s.DeleteFile(cs.counterFile(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Allow is like AllowN with n = 1.
+func (cs *Store) Allow(name string, limit Limit) (bool, error) {
+	return cs.AllowN(name, limit, 1)
+}
+
+// AllowN reports whether n tokens can be taken from the bucket of a rate
+// limiter now, and takes them if they can. A new bucket is full.
+func (cs *Store) AllowN(name string, limit Limit, n int) (bool, error) {
+	if limit.Rate < 0 || limit.Burst < 0 || n < 0 {
+		return false, fmt.Errorf("invalid limit %+v or n %d", limit, n)
+	}
+	var b bucket
+	var ok bool
+	err := cs.update(cs.limiterFile(name), &b, func() error {
+		now := time.Now().UTC()
+		if b.Last.IsZero() {
+			b.Tokens = float64(limit.Burst)
+		} else if elapsed := now.Sub(b.Last); elapsed > 0 {
+			b.Tokens += elapsed.Seconds() * limit.Rate
+		}
+		b.Tokens = math.Min(b.Tokens, float64(limit.Burst))
+		b.Last = now
+		if ok = b.Tokens >= float64(n); ok {
+			b.Tokens -= float64(n)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+// ResetLimiter deletes the state of a rate limiter, which refills its bucket.
+func (cs *Store) ResetLimiter(name string) error {
+	if err := cs.s.DeleteFile(cs.limiterFile(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
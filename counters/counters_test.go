@@ -0,0 +1,107 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package counters_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage/counters"
+	"github.com/c2FmZQ/storage/internal/storagetest"
+)
+
+func TestCounters(t *testing.T) {
+	s := storagetest.New(t)
+	cs := counters.New(s, "counters")
+	if n, err := cs.Get("foo"); err != nil || n != 0 {
+		t.Errorf("Get() = %d, %v, want 0", n, err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cs.Increment("foo"); err != nil {
+				t.Errorf("Increment: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n, err := cs.Add("foo", -3); err != nil || n != 7 {
+		t.Errorf("Add() = %d, %v, want 7", n, err)
+	}
+	if n, err := cs.Add("bar", 5); err != nil || n != 5 {
+		t.Errorf("Add() = %d, %v, want 5", n, err)
+	}
+
+	// The counters persist.
+	cs = counters.New(s, "counters")
+	if n, err := cs.Get("foo"); err != nil || n != 7 {
+		t.Errorf("Get() = %d, %v, want 7", n, err)
+	}
+	if err := cs.Delete("foo"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if n, err := cs.Get("foo"); err != nil || n != 0 {
+		t.Errorf("Get() = %d, %v, want 0", n, err)
+	}
+	if err := cs.Delete("foo"); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	cs := counters.New(storagetest.New(t), "counters")
+	limit := counters.Limit{Rate: 0.01, Burst: 3}
+	for i := 0; i < 3; i++ {
+		if ok, err := cs.Allow("foo", limit); err != nil || !ok {
+			t.Fatalf("Allow() = %v, %v, want true", ok, err)
+		}
+	}
+	if ok, err := cs.Allow("foo", limit); err != nil || ok {
+		t.Errorf("Allow() = %v, %v, want false", ok, err)
+	}
+	if ok, err := cs.Allow("bar", limit); err != nil || !ok {
+		t.Errorf("Allow(bar) = %v, %v, want true", ok, err)
+	}
+	if ok, err := cs.AllowN("bar", limit, 10); err != nil || ok {
+		t.Errorf("AllowN(10) = %v, %v, want false", ok, err)
+	}
+
+	fast := counters.Limit{Rate: 100, Burst: 3}
+	if ok, err := cs.AllowN("baz", fast, 3); err != nil || !ok {
+		t.Fatalf("AllowN() = %v, %v, want true", ok, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if ok, err := cs.AllowN("baz", fast, 3); err != nil || !ok {
+		t.Errorf("AllowN() after refill = %v, %v, want true", ok, err)
+	}
+	if err := cs.ResetLimiter("foo"); err != nil {
+		t.Fatalf("ResetLimiter: %v", err)
+	}
+	if ok, err := cs.AllowN("foo", limit, 3); err != nil || !ok {
+		t.Errorf("AllowN() after reset = %v, %v, want true", ok, err)
+	}
+}
@@ -37,8 +37,9 @@ import (
 	"io"
 	"io/fs"
 	"os"
-	"path/filepath"
 	"runtime"
+	"slices"
+	"sync/atomic"
 
 	"github.com/c2FmZQ/tpm"
 	"golang.org/x/crypto/cryptobyte"
@@ -46,9 +47,23 @@ import (
 )
 
 const (
-	// The size of an encrypted key.
+	// The size of an encrypted key in the version 1 format.
 	aesEncryptedKeySize = 129 // 1 (version) + 16 (iv) + 64 (key) + 16 (pad) + 32 (mac)
 
+	// The version byte of the version 2 small-data format of AES keys:
+	// AES-256-GCM with a random nonce. Version 1 is AES-256-CBC with
+	// HMAC-SHA256, and is only decrypted. The version byte 2 is already used
+	// by Chacha20Poly1305 keys.
+	aesGCMVersion = 18
+	// The size of an encrypted key in the version 2 format.
+	aesGCMEncryptedKeySize = 93 // 1 (version) + 12 (nonce) + 64 (key) + 16 (tag)
+
+	// The version byte of ciphertexts, and of master key files, of AES keys
+	// that encrypt with AES-GCM-SIV.
+	aesGCMSIVVersion = 16
+	// The size of an encrypted key with AES-GCM-SIV.
+	aesGCMSIVEncryptedKeySize = 93 // 1 (version) + 12 (nonce) + 64 (key) + 16 (tag)
+
 	// The size of encrypted chunks in streams.
 	aesFileChunkSize = 1 << 20
 )
@@ -63,6 +78,26 @@ type AESKey struct {
 	logger     Logger
 	strictWipe bool
 	tpmKey     *tpm.Key
+	// The TPM of tpmKey, if any. It is used to read the key file again.
+	tpm *tpm.TPM
+	// The ECC key in the TPM, if any. It is used instead of tpmKey.
+	eccKey *tpmECCKey
+	// The key of streams and derived keys when tpmKey or eccKey is set. It
+	// is derived from the TPM when the master key is unlocked, and is never
+	// saved.
+	streamKey *AESKey
+	// Whether Encrypt uses AES-GCM-SIV instead of AES-CBC and HMAC. With
+	// AES-GCM-SIV, a repeated nonce, e.g. after a VM snapshot is restored,
+	// doesn't reveal the plaintext or the key. It is inherited by the keys
+	// that this key creates.
+	siv bool
+	// The KDF parameters used by Save.
+	kdf kdfParams
+	// Whether Save keeps a copy of the file that it replaces.
+	backup bool
+	// The number of goroutines that process the chunks of streams. It is
+	// inherited by the keys that this key creates.
+	workers int
 }
 
 func (k *AESKey) Logger() Logger {
@@ -74,6 +109,9 @@ func (k *AESKey) Wipe() {
 	for i := range k.maskedKey {
 		k.maskedKey[i] = 0
 	}
+	if k.streamKey != nil {
+		k.streamKey.Wipe()
+	}
 	runtime.SetFinalizer(k, nil)
 }
 
@@ -105,13 +143,24 @@ type AESMasterKey struct {
 func CreateAESMasterKey(opts ...Option) (MasterKey, error) {
 	var opt option
 	opt.apply(opts)
+	if opt.alg == AES256GCMSIV && opt.hasTPM() {
+		return nil, errors.New("tpm key not implemented with AES256GCMSIV")
+	}
+	kdf, err := opt.pbkdf2Params(kdfParams{})
+	if err != nil {
+		return nil, err
+	}
 	b := make([]byte, 64)
 	if _, err := rand.Read(b); err != nil {
 		return nil, err
 	}
 	key := aesKeyFromBytes(b)
+	key.siv = opt.alg == AES256GCMSIV
 	key.logger = opt.logger
 	key.strictWipe = opt.strictWipe
+	key.backup = opt.backup
+	key.workers = opt.workers
+	key.kdf = kdf
 	mk := &AESMasterKey{key}
 	if opt.tpm != nil {
 		tpmkey, err := opt.tpm.CreateKey()
@@ -119,10 +168,46 @@ func CreateAESMasterKey(opts ...Option) (MasterKey, error) {
 			return nil, err
 		}
 		mk.tpmKey = tpmkey
+		mk.tpm = opt.tpm
+		if mk.streamKey, err = tpmStreamKey(tpmkey, opt); err != nil {
+			return nil, err
+		}
+	} else if opt.tpmECC != nil {
+		if mk.eccKey, err = createTPMECCKey(opt.tpmECC); err != nil {
+			return nil, err
+		}
+		if mk.streamKey, err = mk.eccKey.streamKey(opt); err != nil {
+			return nil, err
+		}
 	}
 	return mk, nil
 }
 
+// inTPM returns true if the key is protected by a key in the TPM.
+func (k AESKey) inTPM() bool {
+	return k.tpmKey != nil || k.eccKey != nil
+}
+
+// tpmStreamKey derives the key of streams and derived keys from a TPM key.
+// RSA PKCS#1 v1.5 signatures are deterministic, so the same key is derived
+// every time, but only with the TPM.
+func tpmStreamKey(tpmKey *tpm.Key, opt option) (*AESKey, error) {
+	hashed := sha256.Sum256([]byte("c2FmZQ storage TPM stream key"))
+	sig, err := tpmKey.Sign(nil, hashed[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(sig)
+	b, err := deriveKeyBytes(sig, nil)
+	if err != nil {
+		return nil, err
+	}
+	k := aesKeyFromBytes(b)
+	k.logger = opt.logger
+	k.workers = opt.workers
+	return k, nil
+}
+
 // CreateAESMasterKeyForTest creates a new master key to tests.
 func CreateAESMasterKeyForTest() (MasterKey, error) {
 	b := make([]byte, 64)
@@ -152,11 +237,11 @@ func ReadAESMasterKey(passphrase []byte, file string, opts ...Option) (MasterKey
 	if !str.ReadUint8(&version) {
 		return nil, ErrDecryptFailed
 	}
-	if version != 1 && version != 3 {
+	if version != 1 && version != 3 && version != tpmECCVersion && version != aesGCMSIVVersion {
 		opt.logger.Debugf("ReadMasterKey: unexpected version: %d", version)
 		return nil, ErrDecryptFailed
 	}
-	if version == 1 && opt.tpm != nil {
+	if (version == 1 || version == aesGCMSIVVersion) && opt.hasTPM() {
 		opt.logger.Error("ReadMasterKey: TPM option selected but master key was created without TPM")
 		return nil, ErrDecryptFailed
 	}
@@ -164,6 +249,10 @@ func ReadAESMasterKey(passphrase []byte, file string, opts ...Option) (MasterKey
 		opt.logger.Error("ReadMasterKey: master key was created with TPM but TPM option not selected")
 		return nil, ErrDecryptFailed
 	}
+	if version == tpmECCVersion && opt.tpmECC == nil {
+		opt.logger.Error("ReadMasterKey: master key was created with TPM ECC but TPM ECC option not selected")
+		return nil, ErrDecryptFailed
+	}
 	salt := make([]byte, 16)
 	if !str.ReadBytes(&salt, 16) {
 		return nil, ErrDecryptFailed
@@ -172,6 +261,14 @@ func ReadAESMasterKey(passphrase []byte, file string, opts ...Option) (MasterKey
 	if !str.ReadUint32(&numIter) {
 		return nil, ErrDecryptFailed
 	}
+	var fileKDF kdfParams
+	if len(passphrase) > 0 {
+		fileKDF.iter = int(numIter)
+	}
+	kdf, err := opt.pbkdf2Params(fileKDF)
+	if err != nil {
+		return nil, err
+	}
 	dk := pbkdf2.Key(passphrase, salt, int(numIter), 32, sha256.New)
 	block, err := aes.NewCipher(dk)
 	if err != nil {
@@ -193,8 +290,13 @@ func ReadAESMasterKey(passphrase []byte, file string, opts ...Option) (MasterKey
 		return nil, ErrDecryptFailed
 	}
 	var key *AESKey
-	if version == 1 {
+	if version == 1 || version == aesGCMSIVVersion {
 		key = aesKeyFromBytes(mkBytes)
+		key.siv = version == aesGCMSIVVersion
+	} else if version == tpmECCVersion {
+		if key, err = readTPMECCPayload(mkBytes, opt); err != nil {
+			return nil, err
+		}
 	} else { // version == 3
 		str := cryptobyte.String(mkBytes)
 		var length uint16
@@ -223,19 +325,48 @@ func ReadAESMasterKey(passphrase []byte, file string, opts ...Option) (MasterKey
 		}
 		key = aesKeyFromBytes(decKey)
 		key.tpmKey = tpmKey
+		key.tpm = opt.tpm
+		if key.streamKey, err = tpmStreamKey(tpmKey, opt); err != nil {
+			key.Wipe()
+			return nil, err
+		}
 	}
 	key.logger = opt.logger
 	key.strictWipe = opt.strictWipe
+	key.backup = opt.backup
+	key.workers = opt.workers
+	key.kdf = kdf
 	return &AESMasterKey{key}, nil
 }
 
+// ChangePassphrase checks that file contains the key encrypted with
+// oldPassphrase, and atomically replaces it with the key encrypted with
+// newPassphrase.
+func (mk AESMasterKey) ChangePassphrase(oldPassphrase, newPassphrase []byte, file string) error {
+	opts := []Option{WithLogger(mk.logger)}
+	if mk.tpm != nil {
+		opts = append(opts, WithTPM(mk.tpm))
+	}
+	if mk.eccKey != nil {
+		opts = append(opts, WithTPMECC(mk.eccKey.rw))
+	}
+	return changePassphrase(&mk, oldPassphrase, func() (MasterKey, error) {
+		return ReadAESMasterKey(oldPassphrase, file, opts...)
+	}, newPassphrase, file)
+}
+
+// ExportMnemonic returns a recovery phrase that encodes the key.
+func (mk AESMasterKey) ExportMnemonic() (string, error) {
+	return exportMnemonic(&mk)
+}
+
 // Save encrypts the key with passphrase and saves it to file.
 func (mk AESMasterKey) Save(passphrase []byte, file string) error {
 	salt := make([]byte, 16)
 	if _, err := rand.Read(salt); err != nil {
 		return err
 	}
-	numIter := 200000
+	numIter := mk.kdf.pbkdf2Iter()
 	if len(passphrase) == 0 {
 		numIter = 10
 	}
@@ -257,8 +388,17 @@ func (mk AESMasterKey) Save(passphrase []byte, file string) error {
 	}
 	var version uint8
 	var payload []byte
-	if mk.tpmKey == nil {
+	if mk.eccKey != nil {
+		version = tpmECCVersion
+		if payload, err = mk.tpmECCPayload(); err != nil {
+			mk.Logger().Debug(err)
+			return ErrEncryptFailed
+		}
+	} else if mk.tpmKey == nil {
 		version = 1
+		if mk.siv {
+			version = aesGCMSIVVersion
+		}
 		payload = mk.key()
 	} else {
 		version = 3
@@ -293,14 +433,7 @@ func (mk AESMasterKey) Save(passphrase []byte, file string) error {
 		mk.Logger().Debug(err)
 		return ErrEncryptFailed
 	}
-	dir, _ := filepath.Split(file)
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return err
-	}
-	if err := os.WriteFile(file, data, 0600); err != nil {
-		return err
-	}
-	return nil
+	return writeKeyFile(file, data, mk.backup)
 }
 
 func (k AESKey) key() []byte {
@@ -316,6 +449,23 @@ func (k AESKey) Hash(b []byte) []byte {
 
 // Decrypt decrypts data that was encrypted with Encrypt and the same key.
 func (k AESKey) Decrypt(data []byte) ([]byte, error) {
+	return k.DecryptWithAAD(data, nil)
+}
+
+// DecryptWithAAD decrypts data that was encrypted with EncryptWithAAD, the
+// same key, and the same additional data.
+func (k AESKey) DecryptWithAAD(data, additionalData []byte) ([]byte, error) {
+	if k.eccKey != nil {
+		if len(data) < 1+tpmECCSigSize || data[0] != tpmECCVersion {
+			return nil, ErrDecryptFailed
+		}
+		encData, sig := data[1:len(data)-tpmECCSigSize], data[len(data)-tpmECCSigSize:]
+		hashed := sha256.Sum256(encData)
+		if !k.eccKey.verify(hashed[:], sig) {
+			return nil, ErrDecryptFailed
+		}
+		return k.eccKey.decrypt(encData, additionalData)
+	}
 	if k.tpmKey != nil {
 		sigSize := k.tpmKey.Bits() / 8
 		if len(data) < 1+sigSize {
@@ -327,7 +477,7 @@ func (k AESKey) Decrypt(data []byte) ([]byte, error) {
 		}
 		encData, data := data[:len(data)-sigSize], data[len(data)-sigSize:]
 		sig := data[:sigSize]
-		hashed := sha256.Sum256(encData)
+		hashed := tpmSignedDigest(encData, additionalData)
 		if err := rsa.VerifyPKCS1v15(k.tpmKey.Public().(*rsa.PublicKey), crypto.SHA256, hashed[:], sig); err != nil {
 			return nil, ErrDecryptFailed
 		}
@@ -336,6 +486,10 @@ func (k AESKey) Decrypt(data []byte) ([]byte, error) {
 	if len(k.maskedKey) == 0 {
 		k.Logger().Fatal("key is not set")
 	}
+	if len(data) > 0 && (data[0] == aesGCMVersion || data[0] == aesGCMSIVVersion) {
+		return k.decryptAEAD(data, additionalData)
+	}
+	// Version 1: AES-256-CBC with HMAC-SHA256.
 	if (len(data)-1)%aes.BlockSize != 0 || len(data)-1 < aes.BlockSize+32 {
 		return nil, ErrDecryptFailed
 	}
@@ -346,7 +500,7 @@ func (k AESKey) Decrypt(data []byte) ([]byte, error) {
 	iv, data := data[:aes.BlockSize], data[aes.BlockSize:]
 	encData, data := data[:len(data)-32], data[len(data)-32:]
 	hm := data[:32]
-	if !hmac.Equal(hm, k.Hash(encData)) {
+	if !hmac.Equal(hm, k.mac(encData, additionalData)) {
 		return nil, ErrDecryptFailed
 	}
 	block, err := aes.NewCipher(k.key()[:32])
@@ -370,13 +524,35 @@ func (k AESKey) Decrypt(data []byte) ([]byte, error) {
 
 // Encrypt encrypts data using the key.
 func (k AESKey) Encrypt(data []byte) ([]byte, error) {
+	return k.EncryptWithAAD(data, nil)
+}
+
+// EncryptWithAAD encrypts data using the key, and authenticates
+// additionalData.
+func (k AESKey) EncryptWithAAD(data, additionalData []byte) ([]byte, error) {
+	if k.eccKey != nil {
+		encData, err := k.eccKey.encrypt(data, additionalData)
+		if err != nil {
+			return nil, ErrEncryptFailed
+		}
+		hashed := sha256.Sum256(encData)
+		sig, err := k.eccKey.sign(hashed[:])
+		if err != nil {
+			k.Logger().Debug(err)
+			return nil, ErrEncryptFailed
+		}
+		out := make([]byte, 0, 1+len(encData)+len(sig))
+		out = append(out, tpmECCVersion)
+		out = append(out, encData...)
+		return append(out, sig...), nil
+	}
 	if k.tpmKey != nil {
 		// encData, err := k.tpmKey.Encrypt(data)
 		encData, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, k.tpmKey.Public().(*rsa.PublicKey), data, nil)
 		if err != nil {
 			return nil, ErrEncryptFailed
 		}
-		hashed := sha256.Sum256(encData)
+		hashed := tpmSignedDigest(encData, additionalData)
 		sig, err := k.tpmKey.Sign(nil, hashed[:], crypto.SHA256)
 		if err != nil {
 			return nil, ErrEncryptFailed
@@ -390,35 +566,10 @@ func (k AESKey) Encrypt(data []byte) ([]byte, error) {
 	if len(k.maskedKey) == 0 {
 		k.Logger().Fatal("key is not set")
 	}
-	block, err := aes.NewCipher(k.key()[:32])
-	if err != nil {
-		return nil, ErrEncryptFailed
-	}
-	iv := make([]byte, aes.BlockSize)
-	if _, err := rand.Read(iv); err != nil {
-		return nil, ErrEncryptFailed
+	if k.siv {
+		return k.encryptAEAD(aesGCMSIVVersion, data, additionalData)
 	}
-	padSize := aes.BlockSize - len(data)%aes.BlockSize
-	pData := make([]byte, len(data)+padSize)
-	copy(pData, data)
-	for i := 0; i < padSize; i++ {
-		pData[len(data)+i] = byte(padSize)
-	}
-
-	mode := cipher.NewCBCEncrypter(block, iv)
-	encData := make([]byte, len(pData))
-	mode.CryptBlocks(encData, pData)
-	for i := range pData {
-		pData[i] = 0
-	}
-	hmac := k.Hash(encData)
-
-	out := make([]byte, 1+len(iv)+len(encData)+len(hmac))
-	out[0] = 1 // version
-	copy(out[1:], iv)
-	copy(out[1+len(iv):], encData)
-	copy(out[1+len(iv)+len(encData):], hmac)
-	return out, nil
+	return k.encryptAEAD(aesGCMVersion, data, additionalData)
 }
 
 // aesKeyFromBytes returns an AESKey with the raw bytes provided.
@@ -443,6 +594,92 @@ func aesKeyFromBytes(b []byte) *AESKey {
 	return ek
 }
 
+// mac returns the HMAC of encData. Without additional data, it is the same
+// as Hash. With additional data, the HMAC key is derived from the Hash key,
+// so that ciphertexts with and without additional data can't be confused.
+func (k AESKey) mac(encData, additionalData []byte) []byte {
+	if len(additionalData) == 0 {
+		return k.Hash(encData)
+	}
+	key := k.key()
+	defer clear(key)
+	kmac := hmac.New(sha256.New, key[32:])
+	kmac.Write([]byte("c2FmZQ storage aad"))
+	mac := hmac.New(sha256.New, kmac.Sum(nil))
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(len(additionalData))))
+	mac.Write(additionalData)
+	mac.Write(encData)
+	return mac.Sum(nil)
+}
+
+// tpmSignedDigest returns the digest that the TPM RSA key signs. The TPM
+// doesn't support OAEP labels, so additional data is only bound by the
+// signature.
+func tpmSignedDigest(encData, additionalData []byte) [32]byte {
+	if len(additionalData) == 0 {
+		return sha256.Sum256(encData)
+	}
+	h := sha256.New()
+	h.Write([]byte("c2FmZQ storage aad\x00"))
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(additionalData))))
+	h.Write(additionalData)
+	h.Write(encData)
+	var out [32]byte
+	h.Sum(out[:0])
+	return out
+}
+
+// aead returns the AEAD of a small-data format version: AES-GCM or
+// AES-GCM-SIV.
+func (k AESKey) aead(version byte) (cipher.AEAD, error) {
+	key := k.key()
+	defer clear(key)
+	if version == aesGCMSIVVersion {
+		return newGCMSIV(key[:32])
+	}
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptAEAD encrypts data with the AEAD of version and a random nonce.
+func (k AESKey) encryptAEAD(version byte, data, additionalData []byte) ([]byte, error) {
+	aead, err := k.aead(version)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrEncryptFailed
+	}
+	out := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(data)+aead.Overhead())
+	out[0] = version
+	nonce := out[1:]
+	if _, err := rand.Read(nonce); err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrEncryptFailed
+	}
+	return aead.Seal(out, nonce, data, additionalData), nil
+}
+
+// decryptAEAD decrypts data that was encrypted with encryptAEAD.
+func (k AESKey) decryptAEAD(data, additionalData []byte) ([]byte, error) {
+	aead, err := k.aead(data[0])
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	if len(data) < 1+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrDecryptFailed
+	}
+	nonce, data := data[1:1+aead.NonceSize()], data[1+aead.NonceSize():]
+	dec, err := aead.Open(nil, nonce, data, additionalData)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	return dec, nil
+}
+
 // NewKey creates a new encryption key.
 func (k AESKey) NewKey() (EncryptionKey, error) {
 	b := make([]byte, 64)
@@ -455,25 +692,63 @@ func (k AESKey) NewKey() (EncryptionKey, error) {
 		return nil, err
 	}
 	ek := aesKeyFromBytes(b)
-	ek.encryptedKey = enc
+	ek.encryptedKey = tagEncryptedKey(k, enc)
+	ek.siv = k.siv
+	ek.logger = k.logger
+	ek.workers = k.workers
+	return ek, nil
+}
+
+// DeriveKey derives a new encryption key from this key and info.
+func (k AESKey) DeriveKey(info []byte) (EncryptionKey, error) {
+	if k.inTPM() {
+		return k.streamKey.DeriveKey(info)
+	}
+	key := k.key()
+	defer clear(key)
+	b, err := deriveKeyBytes(key, info)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrEncryptFailed
+	}
+	ek := aesKeyFromBytes(b)
+	ek.siv = k.siv
 	ek.logger = k.logger
+	ek.workers = k.workers
 	return ek, nil
 }
 
-func (k AESKey) keysize() int {
+// keysize returns the size of the encrypted keys whose version byte is
+// version.
+func (k AESKey) keysize(version byte) int {
+	if k.eccKey != nil {
+		return 1 + tpmECCOverhead + 64 + tpmECCSigSize
+	}
 	if k.tpmKey != nil {
 		return 2*k.tpmKey.Bits()/8 + 1
 	}
-	return aesEncryptedKeySize
+	switch version {
+	case aesGCMVersion:
+		return aesGCMEncryptedKeySize
+	case aesGCMSIVVersion:
+		return aesGCMSIVEncryptedKeySize
+	default:
+		return aesEncryptedKeySize
+	}
 }
 
 // DecryptKey decrypts an encrypted key.
 func (k AESKey) DecryptKey(encryptedKey []byte) (EncryptionKey, error) {
-	if len(encryptedKey) != k.keysize() {
-		k.Logger().Debugf("DecryptKey: unexpected encrypted key size %d != %d", len(encryptedKey), k.keysize())
+	enc, err := untagEncryptedKey(k, encryptedKey)
+	if err != nil {
+		k.Logger().Debug("DecryptKey: key ID mismatch")
+		return nil, err
+	}
+	if len(enc) == 0 || len(enc) != k.keysize(enc[0]) {
+		k.Logger().Debugf("DecryptKey: unexpected encrypted key size %d", len(enc))
 		return nil, ErrDecryptFailed
 	}
-	b, err := k.Decrypt(encryptedKey)
+	b, err := k.Decrypt(enc)
 	if err != nil {
 		return nil, err
 	}
@@ -484,7 +759,9 @@ func (k AESKey) DecryptKey(encryptedKey []byte) (EncryptionKey, error) {
 	ek := aesKeyFromBytes(b)
 	ek.encryptedKey = make([]byte, len(encryptedKey))
 	copy(ek.encryptedKey, encryptedKey)
+	ek.siv = k.siv
 	ek.logger = k.logger
+	ek.workers = k.workers
 	return ek, nil
 }
 
@@ -498,6 +775,26 @@ type AESStreamReader struct {
 	start int64
 	off   int64
 	buf   []byte
+	chunk *[]byte
+	// version is the stream format version, detected from the first
+	// chunk that is read.
+	version byte
+	// more is true when the last chunk that was read isn't the final
+	// chunk of a version 2 stream.
+	more bool
+	// raVersion is the stream format version detected by ReadAt.
+	raVersion atomic.Uint32
+	// full is true when the last chunk that was read is a full chunk.
+	full bool
+	// next is the number of the next chunk.
+	next int64
+	// carry is the input that was read after a flushed chunk.
+	carry []byte
+	// workers is the number of goroutines that decrypt chunks. When it is
+	// more than 1, the chunks that follow a full chunk are read ahead by
+	// cr, and decrypted in parallel.
+	workers int
+	cr      *chunkReader
 }
 
 func gcmNonce(ctx []byte, counter int64) []byte {
@@ -521,10 +818,17 @@ func (r *AESStreamReader) Seek(offset int64, whence int) (int64, error) {
 		if !ok {
 			return 0, errors.New("input is not seekable")
 		}
+		cur, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
 		size, err := seeker.Seek(0, io.SeekEnd)
 		if err != nil {
 			return 0, err
 		}
+		if _, err := seeker.Seek(cur, io.SeekStart); err != nil {
+			return 0, err
+		}
 		nChunks := (size - r.start) / int64(aesFileChunkSize+r.gcm.Overhead())
 		lastChunkSize := (size - r.start) % int64(aesFileChunkSize+r.gcm.Overhead())
 		if lastChunkSize > 0 {
@@ -565,6 +869,12 @@ func (r *AESStreamReader) Seek(offset int64, whence int) (int64, error) {
 		return 0, err
 	}
 	r.buf = nil
+	r.more = false
+	r.carry = nil
+	r.next = r.off/int64(aesFileChunkSize) + 1
+	if r.cr != nil {
+		r.cr.seek(r.next)
+	}
 	if err := r.readChunk(); err != nil && err != io.EOF {
 		return 0, err
 	}
@@ -576,21 +886,41 @@ func (r *AESStreamReader) Seek(offset int64, whence int) (int64, error) {
 	return r.off, nil
 }
 
+// readChunk reads and decrypts the next chunk. It is only called when r.buf
+// is empty. The chunk is decrypted in place in the reader's chunk buffer. The
+// input that follows a flushed chunk is kept for the next chunk.
 func (r *AESStreamReader) readChunk() error {
-	in := make([]byte, aesFileChunkSize+r.gcm.Overhead())
-	n, err := io.ReadFull(r.r, in)
-	if n > 0 {
-		nonce := gcmNonce(r.ctx, r.off/int64(aesFileChunkSize)+1)
-		if n <= r.gcm.Overhead() {
+	if r.cr != nil || (r.workers > 1 && r.full) {
+		return r.readChunkAhead()
+	}
+	r.full = false
+	if r.chunk == nil {
+		r.chunk = getChunkBuffer()
+	}
+	in := (*r.chunk)[:aesFileChunkSize+r.gcm.Overhead()]
+	m := copy(in, r.carry)
+	r.carry = r.carry[m:]
+	n, err := io.ReadFull(r.r, in[m:])
+	if n += m; n > 0 {
+		if n < r.gcm.Overhead() {
 			r.logger.Debugf("StreamReader.Read: short chunk %d", n)
 			return ErrDecryptFailed
 		}
-		dec, err := r.gcm.Open(nil, nonce, in[:n], nil)
+		dec, size, kind, err := openNextChunk(r.gcm, gcmNonce(r.ctx, r.next), in[:n], aesFileChunkSize, &r.version)
 		if err != nil {
 			r.logger.Debug(err)
 			return ErrDecryptFailed
 		}
-		r.buf = append(r.buf, dec...)
+		if size < n {
+			r.carry = append(slices.Clone(in[size:n]), r.carry...)
+		}
+		r.next++
+		r.buf = dec
+		r.more = r.version == streamVersion2 && kind != chunkFinal
+		r.full = kind == chunkFull && n == len(in)
+	} else if err == io.EOF && r.more {
+		r.logger.Debugf("StreamReader.Read: missing final chunk at %d", r.off)
+		return ErrStreamTruncated
 	}
 	if err == io.ErrUnexpectedEOF {
 		err = io.EOF
@@ -601,6 +931,65 @@ func (r *AESStreamReader) readChunk() error {
 	return err
 }
 
+// readChunkAhead is like readChunk, but the chunks are read ahead and
+// decrypted in parallel.
+func (r *AESStreamReader) readChunkAhead() error {
+	if r.cr == nil {
+		r.cr = &chunkReader{
+			p:            newChunkPipeline(r.workers, r.openJob),
+			r:            r.r,
+			encChunkSize: aesFileChunkSize + r.gcm.Overhead(),
+			version:      r.version,
+			next:         r.next,
+		}
+	}
+	j, err := r.cr.read()
+	if err == io.EOF && r.more {
+		r.logger.Debugf("StreamReader.Read: missing final chunk at %d", r.off)
+		return ErrStreamTruncated
+	}
+	if err != nil {
+		return err
+	}
+	if j.err != nil {
+		r.logger.Debug(j.err)
+		if r.version != streamVersion2 {
+			j.release()
+			return ErrDecryptFailed
+		}
+		// It may be a flushed chunk, which isn't where the pipeline
+		// expects chunks to be. Read the rest of the stream
+		// sequentially.
+		r.next = j.c
+		r.carry = r.cr.stop(j)
+		r.cr = nil
+		r.workers = 1
+		return r.readChunk()
+	}
+	if r.chunk != nil {
+		putChunkBuffer(r.chunk)
+	}
+	r.chunk, j.dst = j.dst, nil
+	r.buf = j.out
+	r.next = j.c + 1
+	r.more = r.version == streamVersion2 && j.kind != chunkFinal
+	j.release()
+	if len(r.buf) == 0 {
+		return io.EOF
+	}
+	return nil
+}
+
+// openJob decrypts a chunk in a pipeline worker.
+func (r *AESStreamReader) openJob(j *chunkJob) {
+	if j.n < r.gcm.Overhead() {
+		j.err = fmt.Errorf("short chunk %d", j.n)
+		return
+	}
+	j.dst = getChunkBuffer()
+	j.out, _, j.err = openStreamChunk(r.gcm, gcmNonce(r.ctx, j.c), (*j.dst)[:0], (*j.in)[:j.n], aesFileChunkSize, &j.version)
+}
+
 func (r *AESStreamReader) Read(b []byte) (n int, err error) {
 	for err == nil {
 		nn := copy(b[n:], r.buf)
@@ -618,7 +1007,51 @@ func (r *AESStreamReader) Read(b []byte) (n int, err error) {
 	return n, err
 }
 
+// WriteTo writes the rest of the decrypted stream to w. The chunks are written
+// directly from the chunk buffer.
+func (r *AESStreamReader) WriteTo(w io.Writer) (total int64, err error) {
+	for {
+		if len(r.buf) > 0 {
+			n, err := w.Write(r.buf)
+			r.buf = r.buf[n:]
+			r.off += int64(n)
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+			if len(r.buf) > 0 {
+				return total, io.ErrShortWrite
+			}
+		}
+		if err := r.readChunk(); err == io.EOF && len(r.buf) == 0 {
+			return total, nil
+		} else if err != nil && err != io.EOF {
+			return total, err
+		}
+	}
+}
+
+// ReadAt reads len(b) bytes of the decrypted stream starting at offset off.
+// It is safe for concurrent use.
+func (r *AESStreamReader) ReadAt(b []byte, off int64) (int, error) {
+	ra, ok := r.r.(io.ReaderAt)
+	if !ok {
+		return 0, errNotReaderAt
+	}
+	nonce := func(c int64) []byte { return gcmNonce(r.ctx, c) }
+	return readStreamAt(ra, r.start, r.gcm, aesFileChunkSize, nonce, &r.raVersion, r.logger, b, off)
+}
+
 func (r *AESStreamReader) Close() error {
+	if r.cr != nil {
+		r.cr.p.close()
+		r.cr = nil
+	}
+	r.buf = nil
+	if r.chunk != nil {
+		putChunkBuffer(r.chunk)
+		r.chunk = nil
+	}
 	if c, ok := r.r.(io.Closer); ok {
 		if err := c.Close(); err != nil {
 			return err
@@ -629,8 +1062,8 @@ func (r *AESStreamReader) Close() error {
 
 // StartReader opens a reader to decrypt a stream of data.
 func (k AESKey) StartReader(ctx []byte, r io.Reader) (StreamReader, error) {
-	if k.tpmKey != nil {
-		return nil, errors.New("operation not supported with TPM key")
+	if k.inTPM() {
+		return k.streamKey.StartReader(ctx, r)
 	}
 	var start int64
 	if seeker, ok := r.(io.Seeker); ok {
@@ -651,7 +1084,7 @@ func (k AESKey) StartReader(ctx []byte, r io.Reader) (StreamReader, error) {
 		k.Logger().Debug(err)
 		return nil, ErrDecryptFailed
 	}
-	return &AESStreamReader{logger: k.logger, gcm: gcm, r: r, ctx: ctx, start: start}, nil
+	return &AESStreamReader{logger: k.logger, gcm: gcm, r: r, ctx: ctx, start: start, workers: k.workers, next: 1}, nil
 }
 
 // AESStreamWriter encrypts a stream of data.
@@ -661,23 +1094,97 @@ type AESStreamWriter struct {
 	ctx []byte
 	c   int64
 	buf []byte
+	// workers is the number of goroutines that encrypt chunks. When it is
+	// more than 1, all the chunks but a short first chunk are encrypted in
+	// parallel by p.
+	workers int
+	p       *chunkPipeline
+	// err is the first error from w, when chunks are written by p.
+	err error
+	// out is the buffer of encrypted chunks, when they are written
+	// sequentially.
+	out *[]byte
 }
 
-func (w *AESStreamWriter) writeChunk(b []byte) (int, error) {
-	w.c++
-	nonce := gcmNonce(w.ctx, w.c)
-	out := w.gcm.Seal(nil, nonce, b, nil)
-	for i := range b {
-		b[i] = 0
+func (w *AESStreamWriter) writeChunk(b []byte, kind byte) (int, error) {
+	if w.p != nil || (w.workers > 1 && kind == chunkFull) {
+		return len(b), w.submitChunk(b, kind)
 	}
+	if w.out == nil {
+		w.out = getChunkBuffer()
+	}
+	w.c++
+	out := sealStreamChunk((*w.out)[:0], w.gcm, gcmNonce(w.ctx, w.c), b, kind)
+	clear(b)
 	return w.w.Write(out)
 }
 
+// submitChunk submits a chunk to be encrypted in parallel. The encrypted
+// chunks are written in order, when they are ready.
+func (w *AESStreamWriter) submitChunk(b []byte, kind byte) error {
+	if w.p == nil {
+		w.p = newChunkPipeline(w.workers, w.sealJob)
+	}
+	if w.p.full() {
+		w.writeJob(w.p.next())
+	}
+	in := getChunkBuffer()
+	n := copy(*in, b)
+	clear(b)
+	w.c++
+	w.p.submit(&chunkJob{c: w.c, in: in, n: n, kind: kind})
+	return w.err
+}
+
+// sealJob encrypts a chunk in a pipeline worker.
+func (w *AESStreamWriter) sealJob(j *chunkJob) {
+	j.out = sealStreamChunk(nil, w.gcm, gcmNonce(w.ctx, j.c), (*j.in)[:j.n], j.kind)
+	putChunkBuffer(j.in)
+	j.in = nil
+}
+
+// writeJob writes a chunk that was encrypted by sealJob. After an error, the
+// chunks are discarded.
+func (w *AESStreamWriter) writeJob(j *chunkJob) {
+	if w.err == nil {
+		_, w.err = w.w.Write(j.out)
+	}
+	j.release()
+}
+
+// ReadFrom reads data from r until EOF, and encrypts it. Full chunks are read
+// directly in a chunk buffer, instead of being appended to the write buffer.
+func (w *AESStreamWriter) ReadFrom(r io.Reader) (total int64, err error) {
+	bufp := getChunkBuffer()
+	defer putChunkBuffer(bufp)
+	in := (*bufp)[:aesFileChunkSize]
+	m := copy(in, w.buf)
+	clear(w.buf)
+	w.buf = w.buf[:0]
+	for {
+		n, rerr := io.ReadFull(r, in[m:])
+		total += int64(n)
+		if m += n; m == len(in) {
+			if _, err := w.writeChunk(in, chunkFull); err != nil {
+				return total, err
+			}
+			m = 0
+		}
+		if rerr != nil {
+			w.buf = append(w.buf, in[:m]...)
+			if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+				rerr = nil
+			}
+			return total, rerr
+		}
+	}
+}
+
 func (w *AESStreamWriter) Write(b []byte) (n int, err error) {
 	w.buf = append(w.buf, b...)
 	n = len(b)
 	for len(w.buf) >= aesFileChunkSize {
-		_, err = w.writeChunk(w.buf[:aesFileChunkSize])
+		_, err = w.writeChunk(w.buf[:aesFileChunkSize], chunkFull)
 		w.buf = w.buf[aesFileChunkSize:]
 		if err != nil {
 			break
@@ -686,9 +1193,49 @@ func (w *AESStreamWriter) Write(b []byte) (n int, err error) {
 	return
 }
 
+// Flush writes the buffered data in flushed chunks, and flushes the
+// underlying writer if it has a Flush method. The size of flushed chunks
+// leaves room for their size prefix in the space of a full chunk.
+func (w *AESStreamWriter) Flush() error {
+	for len(w.buf) > 0 {
+		n := min(len(w.buf), aesFileChunkSize-4)
+		if _, err := w.writeChunk(w.buf[:n], chunkFlushed); err != nil {
+			return err
+		}
+		w.buf = w.buf[n:]
+	}
+	if err := w.drain(); err != nil {
+		return err
+	}
+	if f, ok := w.w.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// drain writes all the chunks that are in the pipeline.
+func (w *AESStreamWriter) drain() error {
+	if w.p != nil {
+		for j := w.p.next(); j != nil; j = w.p.next() {
+			w.writeJob(j)
+		}
+	}
+	return w.err
+}
+
+// Close writes the final chunk, which is empty if the size of the stream is a
+// multiple of the chunk size.
 func (w *AESStreamWriter) Close() (err error) {
-	if len(w.buf) > 0 {
-		_, err = w.writeChunk(w.buf)
+	_, err = w.writeChunk(w.buf, chunkFinal)
+	if w.p != nil {
+		if e := w.drain(); err == nil {
+			err = e
+		}
+		w.p.close()
+	}
+	if w.out != nil {
+		putChunkBuffer(w.out)
+		w.out = nil
 	}
 	if c, ok := w.w.(io.Closer); ok {
 		if e := c.Close(); err == nil {
@@ -700,8 +1247,8 @@ func (w *AESStreamWriter) Close() (err error) {
 
 // StartWriter opens a writer to encrypt a stream of data.
 func (k AESKey) StartWriter(ctx []byte, w io.Writer) (StreamWriter, error) {
-	if k.tpmKey != nil {
-		return nil, errors.New("operation not supported with TPM key")
+	if k.inTPM() {
+		return k.streamKey.StartWriter(ctx, w)
 	}
 	block, err := aes.NewCipher(k.key()[:32])
 	if err != nil {
@@ -713,13 +1260,30 @@ func (k AESKey) StartWriter(ctx []byte, w io.Writer) (StreamWriter, error) {
 		k.Logger().Debug(err)
 		return nil, ErrEncryptFailed
 	}
-	return &AESStreamWriter{gcm: gcm, w: w, ctx: ctx}, nil
+	return &AESStreamWriter{gcm: gcm, w: w, ctx: ctx, workers: k.workers}, nil
+}
+
+// StartAppendWriter opens a writer to append to an encrypted stream.
+func (k AESKey) StartAppendWriter(ctx []byte, rw TruncatableStream) (StreamWriter, int64, error) {
+	if k.inTPM() {
+		return k.streamKey.StartAppendWriter(ctx, rw)
+	}
+	sw, err := k.StartWriter(ctx, rw)
+	if err != nil {
+		return nil, 0, err
+	}
+	w := sw.(*AESStreamWriter)
+	nonce := func(c int64) []byte { return gcmNonce(ctx, c) }
+	if w.c, err = prepareAppend(rw, w.gcm, aesFileChunkSize, nonce, k.logger); err != nil {
+		return nil, 0, err
+	}
+	return w, w.c * aesFileChunkSize, nil
 }
 
 // ReadEncryptedKey reads an encrypted key and decrypts it.
 func (k AESKey) ReadEncryptedKey(r io.Reader) (EncryptionKey, error) {
-	buf := make([]byte, k.keysize())
-	if _, err := io.ReadFull(r, buf); err != nil {
+	buf, err := readVersionedEncryptedKeyBytes(r, k.keysize)
+	if err != nil {
 		k.Logger().Debug(err)
 		return nil, ErrDecryptFailed
 	}
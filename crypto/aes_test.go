@@ -25,11 +25,14 @@ package crypto
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"io"
 	"os"
 	"path/filepath"
 	"reflect"
+	"slices"
 	"testing"
 
 	"github.com/c2FmZQ/tpm"
@@ -236,6 +239,170 @@ func TestAESStreamRead(t *testing.T) {
 	}
 }
 
+func TestTPMAESStream(t *testing.T) {
+	passphrase := []byte("foo")
+	keyFile := filepath.Join(t.TempDir(), "key")
+	rwc, err := simulator.Get()
+	if err != nil {
+		t.Fatalf("simulator.Get: %v", err)
+	}
+	tpm, err := tpm.New(tpm.WithTPM(rwc), tpm.WithObjectAuth([]byte(passphrase)))
+	if err != nil {
+		t.Fatalf("tpm.New: %v", err)
+	}
+	defer tpm.Close()
+
+	mk, err := CreateAESMasterKey(WithTPM(tpm))
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	if err := mk.Save(passphrase, keyFile); err != nil {
+		t.Fatalf("mk.Save: %v", err)
+	}
+	content := []byte("Hello TPM stream")
+	ctx := []byte{0x12, 0x12, 0x12, 0x12}
+	var buf bytes.Buffer
+	w, err := mk.StartWriter(ctx, &buf)
+	if err != nil {
+		t.Fatalf("StartWriter: %v", err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatalf("StartWriter.Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("StartWriter.Close: %v", err)
+	}
+	if bytes.Contains(buf.Bytes(), content) {
+		t.Fatal("stream isn't encrypted")
+	}
+
+	// The stream key is derived from the TPM again when the key is read.
+	mk2, err := ReadAESMasterKey(passphrase, keyFile, WithTPM(tpm))
+	if err != nil {
+		t.Fatalf("ReadMasterKey(%q): %v", passphrase, err)
+	}
+	defer mk2.Wipe()
+	r, err := mk2.StartReader(ctx, &buf)
+	if err != nil {
+		t.Fatalf("StartReader: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("StartReader.Read: %v", err)
+	}
+	r.Close()
+	if !bytes.Equal(got, content) {
+		t.Errorf("Read different content. Want %q, got %q", content, got)
+	}
+
+	dk1, err := mk.DeriveKey([]byte("foo"))
+	if err != nil {
+		t.Fatalf("DeriveKey: %v", err)
+	}
+	defer dk1.Wipe()
+	dk2, err := mk2.DeriveKey([]byte("foo"))
+	if err != nil {
+		t.Fatalf("DeriveKey: %v", err)
+	}
+	defer dk2.Wipe()
+	if !bytes.Equal(dk1.(*AESKey).key(), dk2.(*AESKey).key()) {
+		t.Error("DeriveKey returned different keys")
+	}
+}
+
+func TestTPMECCAESMasterKey(t *testing.T) {
+	passphrase := []byte("foo")
+	keyFile := filepath.Join(t.TempDir(), "key")
+	rwc, err := simulator.Get()
+	if err != nil {
+		t.Fatalf("simulator.Get: %v", err)
+	}
+	defer rwc.Close()
+
+	mk, err := CreateMasterKey(WithTPMECC(rwc))
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	if err := mk.Save(passphrase, keyFile); err != nil {
+		t.Fatalf("mk.Save: %v", err)
+	}
+	if _, err := ReadMasterKey(passphrase, keyFile); err == nil {
+		t.Error("ReadMasterKey() without TPM ECC option didn't fail")
+	}
+	mk2, err := ReadMasterKey(passphrase, keyFile, WithTPMECC(rwc))
+	if err != nil {
+		t.Fatalf("ReadMasterKey(%q): %v", passphrase, err)
+	}
+	defer mk2.Wipe()
+	if want, got := mk.(*AESMasterKey).key(), mk2.(*AESMasterKey).key(); !bytes.Equal(want, got) {
+		t.Errorf("Mismatch keys: %v != %v", want, got)
+	}
+
+	m := []byte("Hello ECC")
+	enc, err := mk.Encrypt(m)
+	if err != nil {
+		t.Fatalf("mk.Encrypt: %v", err)
+	}
+	dec, err := mk2.Decrypt(enc)
+	if err != nil {
+		t.Fatalf("mk2.Decrypt: %v", err)
+	}
+	if !bytes.Equal(dec, m) {
+		t.Errorf("Decrypt() = %q, want %q", dec, m)
+	}
+	enc[len(enc)-1] ^= 1
+	if _, err := mk2.Decrypt(enc); err != ErrDecryptFailed {
+		t.Errorf("Decrypt() with bad signature = %v, want %v", err, ErrDecryptFailed)
+	}
+
+	ek, err := mk.NewKey()
+	if err != nil {
+		t.Fatalf("mk.NewKey: %v", err)
+	}
+	defer ek.Wipe()
+	var buf bytes.Buffer
+	if err := ek.WriteEncryptedKey(&buf); err != nil {
+		t.Fatalf("ek.WriteEncryptedKey: %v", err)
+	}
+	ek2, err := mk2.ReadEncryptedKey(&buf)
+	if err != nil {
+		t.Fatalf("mk2.ReadEncryptedKey: %v", err)
+	}
+	defer ek2.Wipe()
+	if want, got := ek.(*AESKey).key(), ek2.(*AESKey).key(); !bytes.Equal(want, got) {
+		t.Errorf("Unexpected key. Want %+v, got %+v", want, got)
+	}
+
+	ctx := []byte{0x12, 0x12, 0x12, 0x12}
+	buf.Reset()
+	w, err := mk.StartWriter(ctx, &buf)
+	if err != nil {
+		t.Fatalf("StartWriter: %v", err)
+	}
+	w.Write(m)
+	if err := w.Close(); err != nil {
+		t.Fatalf("StartWriter.Close: %v", err)
+	}
+	r, err := mk2.StartReader(ctx, &buf)
+	if err != nil {
+		t.Fatalf("StartReader: %v", err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, m) {
+		t.Errorf("StartReader.Read = %q, %v, want %q", got, err, m)
+	}
+
+	if err := mk2.ChangePassphrase(passphrase, []byte("bar"), keyFile); err != nil {
+		t.Fatalf("ChangePassphrase: %v", err)
+	}
+	mk3, err := ReadMasterKey([]byte("bar"), keyFile, WithTPMECC(rwc))
+	if err != nil {
+		t.Fatalf("ReadMasterKey(bar): %v", err)
+	}
+	mk3.Wipe()
+}
+
 func TestAESStreamSeek(t *testing.T) {
 	v := func(off int64) byte {
 		return byte((off >> 24) + (off >> 16) + (off >> 8) + off)
@@ -346,3 +513,367 @@ func TestAESStreamInvalidMAC(t *testing.T) {
 		t.Errorf("StartReader.Read: %d, %v", n, err)
 	}
 }
+
+func TestAESStreamAppend(t *testing.T) {
+	mk, err := CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	fn := filepath.Join(t.TempDir(), "appendfile")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	content := make([]byte, 5*1024*1024+100)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+	ctx := []byte{0x12, 0x12, 0x12, 0x12}
+	w, err := mk.StartWriter(ctx, f)
+	if err != nil {
+		t.Fatalf("StartWriter: %v", err)
+	}
+	// Interrupted write: only the complete chunks are written.
+	if _, err := w.Write(content[:2*1024*1024+500]); err != nil {
+		t.Fatalf("StartWriter.Write: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	// Partially written chunk. It is truncated, but its nonce can't be
+	// used again.
+	if _, err := f.Write([]byte("garbage")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if _, _, err := mk.StartAppendWriter(ctx, f); err != ErrStreamNotAppendable {
+		t.Fatalf("StartAppendWriter() = %v, want ErrStreamNotAppendable", err)
+	}
+	if fi2, err := f.Stat(); err != nil || fi2.Size() != fi.Size() {
+		t.Fatalf("Stat() = %v, %v, want size %d", fi2, err, fi.Size())
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	aw, off, err := mk.StartAppendWriter(ctx, f)
+	if err != nil {
+		t.Fatalf("StartAppendWriter: %v", err)
+	}
+	if want := int64(2 * 1024 * 1024); off != want {
+		t.Fatalf("StartAppendWriter offset = %d, want %d", off, want)
+	}
+	if _, err := aw.Write(content[off:]); err != nil {
+		t.Fatalf("StartAppendWriter.Write: %v", err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatalf("StartAppendWriter.Close: %v", err)
+	}
+
+	if f, err = os.OpenFile(fn, os.O_RDWR, 0600); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	r, err := mk.StartReader(ctx, f)
+	if err != nil {
+		t.Fatalf("StartReader: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(content, got) {
+		t.Error("Read different content")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if _, _, err := mk.StartAppendWriter(ctx, f); err != ErrStreamNotAppendable {
+		t.Errorf("StartAppendWriter() = %v, want ErrStreamNotAppendable", err)
+	}
+	f.Close()
+}
+
+func TestAESStreamTruncation(t *testing.T) {
+	mk, err := CreateAESMasterKey()
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	aeadOf := func(w StreamWriter) cipher.AEAD { return w.(*AESStreamWriter).gcm }
+	testStreamTruncation(t, mk, aesFileChunkSize, aeadOf, gcmNonce)
+}
+
+func TestAESStreamReadAt(t *testing.T) {
+	mk, err := CreateAESMasterKey()
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	testStreamReadAt(t, mk, aesFileChunkSize, 16)
+}
+
+func TestAESStreamWorkers(t *testing.T) {
+	mk, err := CreateAESMasterKey(WithStreamWorkers(4))
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	k := mk.(*AESMasterKey)
+	if k.workers != 4 {
+		t.Fatalf("workers = %d, want 4", k.workers)
+	}
+	testStreamWorkers(t, mk, func(n int) { k.workers = n }, aesFileChunkSize)
+}
+
+func TestAESStreamFlush(t *testing.T) {
+	mk, err := CreateAESMasterKey()
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	k := mk.(*AESMasterKey)
+	testStreamFlush(t, mk, func(n int) { k.workers = n }, aesFileChunkSize)
+}
+
+func TestAESStreamCopy(t *testing.T) {
+	mk, err := CreateAESMasterKey()
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	k := mk.(*AESMasterKey)
+	testStreamCopy(t, mk, func(n int) { k.workers = n }, aesFileChunkSize)
+}
+
+func TestAESDeriveKey(t *testing.T) {
+	mk, err := CreateAESMasterKey()
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	testDeriveKey(t, mk)
+}
+
+func testDeriveKey(t *testing.T, mk EncryptionKey) {
+	derive := func(info string) EncryptionKey {
+		k, err := mk.DeriveKey([]byte(info))
+		if err != nil {
+			t.Fatalf("mk.DeriveKey: %v", err)
+		}
+		t.Cleanup(k.Wipe)
+		return k
+	}
+	k1, k2, k3 := derive("foo"), derive("foo"), derive("bar")
+
+	m := []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	enc, err := k1.Encrypt(m)
+	if err != nil {
+		t.Fatalf("k1.Encrypt: %v", err)
+	}
+	if dec, err := k2.Decrypt(enc); err != nil || !reflect.DeepEqual(m, dec) {
+		t.Errorf("k2.Decrypt() = %q, %v", dec, err)
+	}
+	if _, err := k3.Decrypt(enc); err == nil {
+		t.Error("k3.Decrypt() didn't fail")
+	}
+	if _, err := mk.Decrypt(enc); err == nil {
+		t.Error("mk.Decrypt() didn't fail")
+	}
+	if reflect.DeepEqual(k1.Hash(m), k3.Hash(m)) {
+		t.Error("k1 and k3 have the same hash")
+	}
+
+	// The derived key can be used as a master key.
+	fk, err := k1.NewKey()
+	if err != nil {
+		t.Fatalf("k1.NewKey: %v", err)
+	}
+	defer fk.Wipe()
+	var buf bytes.Buffer
+	if err := fk.WriteEncryptedKey(&buf); err != nil {
+		t.Fatalf("fk.WriteEncryptedKey: %v", err)
+	}
+	fk2, err := k2.ReadEncryptedKey(&buf)
+	if err != nil {
+		t.Fatalf("k2.ReadEncryptedKey: %v", err)
+	}
+	fk2.Wipe()
+}
+
+func TestAESGCMSIVMasterKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+
+	mk, err := CreateMasterKey(WithAlgo(AES256GCMSIV))
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+
+	m := []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	for i := 0; i < len(m); i++ {
+		enc, err := mk.Encrypt(m[:i])
+		if err != nil {
+			t.Fatalf("Encrypt: %v", err)
+		}
+		if enc[0] != aesGCMSIVVersion {
+			t.Fatalf("Version = %d, want %d", enc[0], aesGCMSIVVersion)
+		}
+		if got, want := len(enc), 1+gcmSIVNonceSize+i+gcmSIVTagSize; got != want {
+			t.Errorf("len(enc) = %d, want %d", got, want)
+		}
+		dec, err := mk.Decrypt(enc)
+		if err != nil {
+			t.Fatalf("Decrypt: %v", err)
+		}
+		if !bytes.Equal(m[:i], dec) {
+			t.Errorf("Decrypted data[%d] doesn't match. Want %q, got %q", i, m[:i], dec)
+		}
+		enc[len(enc)-1] ^= 1
+		if _, err := mk.Decrypt(enc); err != ErrDecryptFailed {
+			t.Errorf("Decrypt(tampered): err = %v, want %v", err, ErrDecryptFailed)
+		}
+	}
+
+	if err := mk.Save([]byte("foo"), keyFile); err != nil {
+		t.Fatalf("mk.Save: %v", err)
+	}
+	mk2, err := ReadMasterKey([]byte("foo"), keyFile)
+	if err != nil {
+		t.Fatalf("ReadMasterKey: %v", err)
+	}
+	defer mk2.Wipe()
+	if !mk2.(*AESMasterKey).siv {
+		t.Error("ReadMasterKey returned a key without AES-GCM-SIV")
+	}
+
+	ek, err := mk.NewKey()
+	if err != nil {
+		t.Fatalf("NewKey: %v", err)
+	}
+	defer ek.Wipe()
+	var buf bytes.Buffer
+	if err := ek.WriteEncryptedKey(&buf); err != nil {
+		t.Fatalf("WriteEncryptedKey: %v", err)
+	}
+	if got, want := buf.Len(), 1+keyIDSize+aesGCMSIVEncryptedKeySize; got != want {
+		t.Errorf("Encrypted key size = %d, want %d", got, want)
+	}
+	ek2, err := mk2.ReadEncryptedKey(&buf)
+	if err != nil {
+		t.Fatalf("ReadEncryptedKey: %v", err)
+	}
+	defer ek2.Wipe()
+	enc, err := ek.Encrypt(m)
+	if err != nil {
+		t.Fatalf("ek.Encrypt: %v", err)
+	}
+	if enc[0] != aesGCMSIVVersion {
+		t.Errorf("File key version = %d, want %d", enc[0], aesGCMSIVVersion)
+	}
+	if dec, err := ek2.Decrypt(enc); err != nil || !bytes.Equal(dec, m) {
+		t.Errorf("ek2.Decrypt = %q, %v, want %q", dec, err, m)
+	}
+
+	phrase, err := mk.ExportMnemonic()
+	if err != nil {
+		t.Fatalf("ExportMnemonic: %v", err)
+	}
+	mk3, err := CreateMasterKeyFromMnemonic(phrase)
+	if err != nil {
+		t.Fatalf("CreateMasterKeyFromMnemonic: %v", err)
+	}
+	defer mk3.Wipe()
+	if !mk3.(*AESMasterKey).siv {
+		t.Error("CreateMasterKeyFromMnemonic returned a key without AES-GCM-SIV")
+	}
+}
+
+// encryptAESv1 encrypts data with the version 1 format of AES keys:
+// AES-256-CBC with HMAC-SHA256. AESKey.Encrypt doesn't use it anymore.
+func encryptAESv1(t *testing.T, k *AESKey, data []byte) []byte {
+	block, err := aes.NewCipher(k.key()[:32])
+	if err != nil {
+		t.Fatalf("aes.NewCipher: %v", err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	padSize := aes.BlockSize - len(data)%aes.BlockSize
+	pData := append(slices.Clone(data), bytes.Repeat([]byte{byte(padSize)}, padSize)...)
+	encData := make([]byte, len(pData))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encData, pData)
+	out := append([]byte{1}, iv...)
+	out = append(out, encData...)
+	return append(out, k.Hash(encData)...)
+}
+
+func TestAESVersion2(t *testing.T) {
+	mk, err := CreateAESMasterKey()
+	if err != nil {
+		t.Fatalf("CreateAESMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	k := mk.(*AESMasterKey).AESKey
+
+	m := []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	enc, err := mk.Encrypt(m)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if enc[0] != aesGCMVersion {
+		t.Errorf("Version = %d, want %d", enc[0], aesGCMVersion)
+	}
+	if got, want := len(enc), 1+12+len(m)+16; got != want {
+		t.Errorf("len(enc) = %d, want %d", got, want)
+	}
+
+	// Data in the version 1 format can still be decrypted.
+	for i := 0; i < len(m); i++ {
+		v1 := encryptAESv1(t, k, m[:i])
+		dec, err := mk.Decrypt(v1)
+		if err != nil {
+			t.Fatalf("Decrypt(v1): %v", err)
+		}
+		if !bytes.Equal(dec, m[:i]) {
+			t.Errorf("Decrypt(v1) = %q, want %q", dec, m[:i])
+		}
+		v1[len(v1)-1] ^= 1
+		if _, err := mk.Decrypt(v1); err != ErrDecryptFailed {
+			t.Errorf("Decrypt(tampered v1): err = %v, want %v", err, ErrDecryptFailed)
+		}
+	}
+
+	// Encrypted keys in both formats, tagged or not, can be read from
+	// streams.
+	fileKey := make([]byte, 64)
+	if _, err := rand.Read(fileKey); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	v1Key := encryptAESv1(t, k, fileKey)
+	ek, err := mk.NewKey()
+	if err != nil {
+		t.Fatalf("NewKey: %v", err)
+	}
+	defer ek.Wipe()
+	var buf bytes.Buffer
+	if err := ek.WriteEncryptedKey(&buf); err != nil {
+		t.Fatalf("WriteEncryptedKey: %v", err)
+	}
+	if got, want := buf.Len(), 1+keyIDSize+aesGCMEncryptedKeySize; got != want {
+		t.Errorf("Encrypted key size = %d, want %d", got, want)
+	}
+	for _, encKey := range [][]byte{v1Key, tagEncryptedKey(k, v1Key), buf.Bytes()} {
+		r := bytes.NewReader(append(slices.Clone(encKey), "trailing data"...))
+		ek2, err := mk.ReadEncryptedKey(r)
+		if err != nil {
+			t.Fatalf("ReadEncryptedKey: %v", err)
+		}
+		ek2.Wipe()
+		if got, want := r.Len(), len("trailing data"); got != want {
+			t.Errorf("ReadEncryptedKey left %d bytes, want %d", got, want)
+		}
+	}
+}
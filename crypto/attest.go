@@ -0,0 +1,354 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// The number of PCRs of PC Client TPMs.
+const numPCRs = 24
+
+var (
+	// ErrNotAttestable indicates that the master key isn't protected by a
+	// TPM key that can be attested. Only keys created with WithTPMECC can
+	// be.
+	ErrNotAttestable = errors.New("master key can't be attested")
+	// ErrAttestationFailed indicates that an attestation isn't valid.
+	ErrAttestationFailed = errors.New("attestation verification failed")
+)
+
+// akTemplate is the template of the attestation key. It is a primary key
+// in the endorsement hierarchy, i.e. it is derived from the endorsement
+// seed, and is the same every time.
+var akTemplate = tpm2.TPMTPublic{
+	Type:    tpm2.TPMAlgECC,
+	NameAlg: tpm2.TPMAlgSHA256,
+	ObjectAttributes: tpm2.TPMAObject{
+		FixedTPM:            true,
+		FixedParent:         true,
+		SensitiveDataOrigin: true,
+		UserWithAuth:        true,
+		NoDA:                true,
+		Restricted:          true,
+		SignEncrypt:         true,
+	},
+	Parameters: tpm2.NewTPMUPublicParms(tpm2.TPMAlgECC, &tpm2.TPMSECCParms{
+		Scheme: tpm2.TPMTECCScheme{
+			Scheme:  tpm2.TPMAlgECDSA,
+			Details: tpm2.NewTPMUAsymScheme(tpm2.TPMAlgECDSA, &tpm2.TPMSSigSchemeECDSA{HashAlg: tpm2.TPMAlgSHA256}),
+		},
+		CurveID: tpm2.TPMECCNistP256,
+	}),
+	Unique: tpm2.NewTPMUPublicID(tpm2.TPMAlgECC, &tpm2.TPMSECCPoint{}),
+}
+
+// Attestation is evidence, signed by a TPM, that a master key is protected
+// by a key that was created in the TPM and can't leave it. It contains:
+//   - the result of TPM2_Certify on the key that protects the master key,
+//   - the result of TPM2_Quote on some PCRs, i.e. the boot state of the
+//     system,
+//
+// both signed by the attestation key (AK) of the TPM, with the verifier's
+// nonce.
+//
+// An attestation only proves something if the verifier trusts the AK, e.g.
+// because it was enrolled when the system was provisioned, or with
+// credential activation against the TPM's endorsement key. AKPublicKey
+// returns it.
+//
+// All the TPM structures are in the TPM wire format.
+type Attestation struct {
+	// AKPublic is the TPMT_PUBLIC of the attestation key.
+	AKPublic []byte `json:"akPublic"`
+	// KeyPublic is the TPMT_PUBLIC of the key that protects the master
+	// key.
+	KeyPublic []byte `json:"keyPublic"`
+	// CertifyInfo is the TPMS_ATTEST returned by TPM2_Certify.
+	CertifyInfo []byte `json:"certifyInfo"`
+	// CertifySignature is the TPMT_SIGNATURE of CertifyInfo.
+	CertifySignature []byte `json:"certifySignature"`
+	// Quote is the TPMS_ATTEST returned by TPM2_Quote.
+	Quote []byte `json:"quote"`
+	// QuoteSignature is the TPMT_SIGNATURE of Quote.
+	QuoteSignature []byte `json:"quoteSignature"`
+	// PCRs are the SHA256 values of the quoted PCRs.
+	PCRs map[int][]byte `json:"pcrs"`
+}
+
+// AttestMasterKey returns an Attestation of the TPM key that protects mk,
+// and of the given PCRs. The nonce should come from the verifier, to prove
+// that the attestation is fresh. mk must have been created with WithTPMECC.
+func AttestMasterKey(mk MasterKey, nonce []byte, pcrs []int) (*Attestation, error) {
+	m, ok := mk.(*AESMasterKey)
+	if !ok || m.eccKey == nil {
+		return nil, ErrNotAttestable
+	}
+	return m.eccKey.attest(nonce, pcrs)
+}
+
+func (k *tpmECCKey) attest(nonce []byte, pcrs []int) (*Attestation, error) {
+	pcrs = slices.Clone(pcrs)
+	slices.Sort(pcrs)
+	pcrs = slices.Compact(pcrs)
+	sel := make([]uint, 0, len(pcrs))
+	for _, pcr := range pcrs {
+		if pcr < 0 || pcr >= numPCRs {
+			return nil, fmt.Errorf("invalid pcr %d", pcr)
+		}
+		sel = append(sel, uint(pcr))
+	}
+	selection := tpm2.TPMLPCRSelection{
+		PCRSelections: []tpm2.TPMSPCRSelection{{
+			Hash:      tpm2.TPMAlgSHA256,
+			PCRSelect: tpm2.PCClientCompatible.PCRs(sel...),
+		}},
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	ak, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.TPMRHEndorsement,
+		InPublic:      tpm2.New2B(akTemplate),
+	}.Execute(k.tpm)
+	if err != nil {
+		return nil, fmt.Errorf("TPM2_CreatePrimary: %w", err)
+	}
+	defer k.flush(ak.ObjectHandle)
+	akHandle := tpm2.AuthHandle{
+		Handle: ak.ObjectHandle,
+		Name:   ak.Name,
+		Auth:   tpm2.PasswordAuth(nil),
+	}
+	scheme := tpm2.TPMTSigScheme{
+		Scheme:  tpm2.TPMAlgECDSA,
+		Details: tpm2.NewTPMUSigScheme(tpm2.TPMAlgECDSA, &tpm2.TPMSSchemeHash{HashAlg: tpm2.TPMAlgSHA256}),
+	}
+
+	h, flush, err := k.load()
+	if err != nil {
+		return nil, err
+	}
+	defer flush()
+	cert, err := tpm2.Certify{
+		ObjectHandle:   h,
+		SignHandle:     akHandle,
+		QualifyingData: tpm2.TPM2BData{Buffer: nonce},
+		InScheme:       scheme,
+	}.Execute(k.tpm)
+	if err != nil {
+		return nil, fmt.Errorf("TPM2_Certify: %w", err)
+	}
+	quote, err := tpm2.Quote{
+		SignHandle:     akHandle,
+		QualifyingData: tpm2.TPM2BData{Buffer: nonce},
+		InScheme:       scheme,
+		PCRSelect:      selection,
+	}.Execute(k.tpm)
+	if err != nil {
+		return nil, fmt.Errorf("TPM2_Quote: %w", err)
+	}
+	values := make(map[int][]byte, len(pcrs))
+	for i, pcr := range pcrs {
+		resp, err := tpm2.PCRRead{
+			PCRSelectionIn: tpm2.TPMLPCRSelection{
+				PCRSelections: []tpm2.TPMSPCRSelection{{
+					Hash:      tpm2.TPMAlgSHA256,
+					PCRSelect: tpm2.PCClientCompatible.PCRs(sel[i]),
+				}},
+			},
+		}.Execute(k.tpm)
+		if err != nil {
+			return nil, fmt.Errorf("TPM2_PCR_Read: %w", err)
+		}
+		if len(resp.PCRValues.Digests) != 1 {
+			return nil, fmt.Errorf("TPM2_PCR_Read: pcr %d isn't allocated", pcr)
+		}
+		values[pcr] = resp.PCRValues.Digests[0].Buffer
+	}
+	return &Attestation{
+		AKPublic:         ak.OutPublic.Bytes(),
+		KeyPublic:        k.pub.Bytes(),
+		CertifyInfo:      cert.CertifyInfo.Bytes(),
+		CertifySignature: tpm2.Marshal(cert.Signature),
+		Quote:            quote.Quoted.Bytes(),
+		QuoteSignature:   tpm2.Marshal(quote.Signature),
+		PCRs:             values,
+	}, nil
+}
+
+// AKPublicKey returns the public key of the attestation key. Verifiers
+// should check that they trust it before calling Verify.
+func (a *Attestation) AKPublicKey() (*ecdsa.PublicKey, error) {
+	pub, err := tpm2.Unmarshal[tpm2.TPMTPublic](a.AKPublic)
+	if err != nil {
+		return nil, ErrAttestationFailed
+	}
+	attr := pub.ObjectAttributes
+	if pub.Type != tpm2.TPMAlgECC || !attr.FixedTPM || !attr.Restricted || !attr.SignEncrypt {
+		return nil, ErrAttestationFailed
+	}
+	return eccPublicKey(pub)
+}
+
+// PublicKey returns the public key of the TPM key that protects the master
+// key. The ciphertexts of the master key are signed with it.
+func (a *Attestation) PublicKey() (*ecdsa.PublicKey, error) {
+	pub, err := tpm2.Unmarshal[tpm2.TPMTPublic](a.KeyPublic)
+	if err != nil {
+		return nil, ErrAttestationFailed
+	}
+	return eccPublicKey(pub)
+}
+
+func eccPublicKey(pub *tpm2.TPMTPublic) (*ecdsa.PublicKey, error) {
+	parms, err := pub.Parameters.ECCDetail()
+	if err != nil {
+		return nil, ErrAttestationFailed
+	}
+	point, err := pub.Unique.ECC()
+	if err != nil {
+		return nil, ErrAttestationFailed
+	}
+	key, err := tpm2.ECDSAPub(parms, point)
+	if err != nil {
+		return nil, ErrAttestationFailed
+	}
+	return key, nil
+}
+
+// Verify checks that the attestation is signed by ak, with nonce, and that
+// it certifies a key that was created in the TPM and can't leave it. The
+// caller should then check the PCR values.
+func (a *Attestation) Verify(ak *ecdsa.PublicKey, nonce []byte) error {
+	if got, err := a.AKPublicKey(); err != nil || !got.Equal(ak) {
+		return ErrAttestationFailed
+	}
+	keyPub, err := tpm2.Unmarshal[tpm2.TPMTPublic](a.KeyPublic)
+	if err != nil {
+		return ErrAttestationFailed
+	}
+	attr := keyPub.ObjectAttributes
+	if !attr.FixedTPM || !attr.FixedParent || !attr.SensitiveDataOrigin {
+		return ErrAttestationFailed
+	}
+	name, err := tpm2.ObjectName(keyPub)
+	if err != nil {
+		return ErrAttestationFailed
+	}
+
+	cert, err := verifyAttest(ak, a.CertifyInfo, a.CertifySignature, tpm2.TPMSTAttestCertify, nonce)
+	if err != nil {
+		return err
+	}
+	certInfo, err := cert.Attested.Certify()
+	if err != nil || !bytes.Equal(certInfo.Name.Buffer, name.Buffer) {
+		return ErrAttestationFailed
+	}
+
+	quote, err := verifyAttest(ak, a.Quote, a.QuoteSignature, tpm2.TPMSTAttestQuote, nonce)
+	if err != nil {
+		return err
+	}
+	quoteInfo, err := quote.Attested.Quote()
+	if err != nil || len(quoteInfo.PCRSelect.PCRSelections) != 1 {
+		return ErrAttestationFailed
+	}
+	sel := quoteInfo.PCRSelect.PCRSelections[0]
+	if sel.Hash != tpm2.TPMAlgSHA256 {
+		return ErrAttestationFailed
+	}
+	// The PCR digest is the hash of the values of the selected PCRs, in
+	// ascending order.
+	h := sha256.New()
+	n := 0
+	for i, b := range sel.PCRSelect {
+		for bit := 0; bit < 8; bit++ {
+			if b&(1<<bit) == 0 {
+				continue
+			}
+			v, ok := a.PCRs[8*i+bit]
+			if !ok {
+				return ErrAttestationFailed
+			}
+			h.Write(v)
+			n++
+		}
+	}
+	if n != len(a.PCRs) || !bytes.Equal(h.Sum(nil), quoteInfo.PCRDigest.Buffer) {
+		return ErrAttestationFailed
+	}
+	return nil
+}
+
+// verifyAttest checks the signature and the nonce of a TPMS_ATTEST.
+func verifyAttest(ak *ecdsa.PublicKey, info, sig []byte, typ tpm2.TPMISTAttest, nonce []byte) (*tpm2.TPMSAttest, error) {
+	attest, err := tpm2.Unmarshal[tpm2.TPMSAttest](info)
+	if err != nil || attest.Type != typ || !bytes.Equal(attest.ExtraData.Buffer, nonce) {
+		return nil, ErrAttestationFailed
+	}
+	s, err := tpm2.Unmarshal[tpm2.TPMTSignature](sig)
+	if err != nil || s.SigAlg != tpm2.TPMAlgECDSA {
+		return nil, ErrAttestationFailed
+	}
+	ecdsaSig, err := s.Signature.ECDSA()
+	if err != nil || ecdsaSig.Hash != tpm2.TPMAlgSHA256 {
+		return nil, ErrAttestationFailed
+	}
+	hashed := sha256.Sum256(info)
+	r := new(big.Int).SetBytes(ecdsaSig.SignatureR.Buffer)
+	ss := new(big.Int).SetBytes(ecdsaSig.SignatureS.Buffer)
+	if !ecdsa.Verify(ak, hashed[:], r, ss) {
+		return nil, ErrAttestationFailed
+	}
+	return attest, nil
+}
+
+// VerifyCiphertext checks that ciphertext was produced by the master key
+// whose TPM key is attested by a. It doesn't decrypt it.
+func (a *Attestation) VerifyCiphertext(ciphertext []byte) error {
+	pub, err := a.PublicKey()
+	if err != nil {
+		return err
+	}
+	if len(ciphertext) < 1+tpmECCSigSize || ciphertext[0] != tpmECCVersion {
+		return ErrAttestationFailed
+	}
+	encData, sig := ciphertext[1:len(ciphertext)-tpmECCSigSize], ciphertext[len(ciphertext)-tpmECCSigSize:]
+	hashed := sha256.Sum256(encData)
+	r := new(big.Int).SetBytes(sig[:p256Size])
+	s := new(big.Int).SetBytes(sig[p256Size:])
+	if !ecdsa.Verify(pub, hashed[:], r, s) {
+		return ErrAttestationFailed
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+)
+
+func TestAttestMasterKey(t *testing.T) {
+	rwc, err := simulator.Get()
+	if err != nil {
+		t.Fatalf("simulator.Get: %v", err)
+	}
+	defer rwc.Close()
+
+	mk, err := CreateMasterKey(WithTPMECC(rwc))
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+
+	nonce := []byte("nonce")
+	a, err := AttestMasterKey(mk, nonce, []int{16, 0, 16})
+	if err != nil {
+		t.Fatalf("AttestMasterKey: %v", err)
+	}
+	if got, want := len(a.PCRs), 2; got != want {
+		t.Errorf("len(PCRs) = %d, want %d", got, want)
+	}
+	ak, err := a.AKPublicKey()
+	if err != nil {
+		t.Fatalf("AKPublicKey: %v", err)
+	}
+	if err := a.Verify(ak, nonce); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	if err := a.Verify(ak, []byte("other nonce")); !errors.Is(err, ErrAttestationFailed) {
+		t.Errorf("Verify(other nonce) = %v, want ErrAttestationFailed", err)
+	}
+
+	// The AK is the same for all the keys of the TPM.
+	mk2, err := CreateMasterKey(WithTPMECC(rwc))
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	defer mk2.Wipe()
+	a2, err := AttestMasterKey(mk2, nonce, nil)
+	if err != nil {
+		t.Fatalf("AttestMasterKey: %v", err)
+	}
+	if err := a2.Verify(ak, nonce); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+
+	// Mixing the parts of different attestations fails.
+	bad := *a
+	bad.KeyPublic = a2.KeyPublic
+	if err := bad.Verify(ak, nonce); !errors.Is(err, ErrAttestationFailed) {
+		t.Errorf("Verify(other key) = %v, want ErrAttestationFailed", err)
+	}
+	bad = *a
+	bad.PCRs = map[int][]byte{0: a.PCRs[0], 16: bytes.Repeat([]byte{0xff}, 32)}
+	if err := bad.Verify(ak, nonce); !errors.Is(err, ErrAttestationFailed) {
+		t.Errorf("Verify(wrong pcrs) = %v, want ErrAttestationFailed", err)
+	}
+
+	ct, err := mk.Encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if err := a.VerifyCiphertext(ct); err != nil {
+		t.Errorf("VerifyCiphertext: %v", err)
+	}
+	if err := a2.VerifyCiphertext(ct); !errors.Is(err, ErrAttestationFailed) {
+		t.Errorf("VerifyCiphertext(other key) = %v, want ErrAttestationFailed", err)
+	}
+
+	mk3, err := CreateMasterKey()
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	defer mk3.Wipe()
+	if _, err := AttestMasterKey(mk3, nonce, nil); !errors.Is(err, ErrNotAttestable) {
+		t.Errorf("AttestMasterKey(software key) = %v, want ErrNotAttestable", err)
+	}
+}
@@ -34,8 +34,9 @@ import (
 	"io"
 	"io/fs"
 	"os"
-	"path/filepath"
 	"runtime"
+	"slices"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/argon2"
@@ -59,6 +60,13 @@ type Chacha20Poly1305Key struct {
 
 	logger     Logger
 	strictWipe bool
+	// The KDF parameters used by Save.
+	kdf kdfParams
+	// Whether Save keeps a copy of the file that it replaces.
+	backup bool
+	// The number of goroutines that process the chunks of streams. It is
+	// inherited by the keys that this key creates.
+	workers int
 }
 
 func (k *Chacha20Poly1305Key) Logger() Logger {
@@ -98,9 +106,13 @@ type Chacha20Poly1305MasterKey struct {
 func CreateChacha20Poly1305MasterKey(opts ...Option) (MasterKey, error) {
 	var opt option
 	opt.apply(opts)
-	if opt.tpm != nil {
+	if opt.hasTPM() {
 		return nil, errors.New("tpm key not implemented with chacha20poly1305")
 	}
+	kdf, err := opt.argon2Params(kdfParams{})
+	if err != nil {
+		return nil, err
+	}
 	b := make([]byte, 64)
 	if _, err := rand.Read(b); err != nil {
 		return nil, err
@@ -108,6 +120,9 @@ func CreateChacha20Poly1305MasterKey(opts ...Option) (MasterKey, error) {
 	key := chacha20poly1305KeyFromBytes(b)
 	key.logger = opt.logger
 	key.strictWipe = opt.strictWipe
+	key.backup = opt.backup
+	key.workers = opt.workers
+	key.kdf = kdf
 	return &Chacha20Poly1305MasterKey{key}, nil
 }
 
@@ -137,13 +152,17 @@ func ReadChacha20Poly1305MasterKey(passphrase []byte, file string, opts ...Optio
 		opt.logger.Debugf("ReadMasterKey: unexpected version: %d", version)
 		return nil, ErrDecryptFailed
 	}
-	if opt.tpm != nil {
+	if opt.hasTPM() {
 		opt.logger.Error("ReadMasterKey: TPM option selected but master key was created without TPM")
 		return nil, ErrDecryptFailed
 	}
 	salt, b := b[:16], b[16:]
 	time, b := uint32(b[0]), b[1:]
 	memory, b := binary.LittleEndian.Uint32(b[:4]), b[4:]
+	kdf, err := opt.argon2Params(kdfParams{time: time, memory: memory})
+	if err != nil {
+		return nil, err
+	}
 	dk := argon2.IDKey(passphrase, salt, time, memory, 1, 32)
 	ccp, err := chacha20poly1305.NewX(dk)
 	if err != nil {
@@ -160,17 +179,33 @@ func ReadChacha20Poly1305MasterKey(passphrase []byte, file string, opts ...Optio
 	key := chacha20poly1305KeyFromBytes(mkBytes)
 	key.logger = opt.logger
 	key.strictWipe = opt.strictWipe
+	key.backup = opt.backup
+	key.workers = opt.workers
+	key.kdf = kdf
 	return &Chacha20Poly1305MasterKey{key}, nil
 }
 
+// ChangePassphrase checks that file contains the key encrypted with
+// oldPassphrase, and atomically replaces it with the key encrypted with
+// newPassphrase.
+func (mk Chacha20Poly1305MasterKey) ChangePassphrase(oldPassphrase, newPassphrase []byte, file string) error {
+	return changePassphrase(&mk, oldPassphrase, func() (MasterKey, error) {
+		return ReadChacha20Poly1305MasterKey(oldPassphrase, file, WithLogger(mk.logger))
+	}, newPassphrase, file)
+}
+
+// ExportMnemonic returns a recovery phrase that encodes the key.
+func (mk Chacha20Poly1305MasterKey) ExportMnemonic() (string, error) {
+	return exportMnemonic(&mk)
+}
+
 // Save encrypts the key with passphrase and saves it to file.
 func (mk Chacha20Poly1305MasterKey) Save(passphrase []byte, file string) error {
 	salt := make([]byte, 16)
 	if _, err := rand.Read(salt); err != nil {
 		return err
 	}
-	time := uint32(2)
-	memory := uint32(128 * 1024)
+	time, memory := mk.kdf.argon2()
 	dk := argon2.IDKey(passphrase, salt, time, memory, 1, 32)
 	ccp, err := chacha20poly1305.NewX(dk)
 	if err != nil {
@@ -191,14 +226,7 @@ func (mk Chacha20Poly1305MasterKey) Save(passphrase []byte, file string) error {
 	data = append(data, byte(time))
 	data = append(data, memoryb...)
 	data = append(data, encMasterKey...)
-	dir, _ := filepath.Split(file)
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return err
-	}
-	if err := os.WriteFile(file, data, 0600); err != nil {
-		return err
-	}
-	return nil
+	return writeKeyFile(file, data, mk.backup)
 }
 
 func (k Chacha20Poly1305Key) key() []byte {
@@ -214,6 +242,12 @@ func (k Chacha20Poly1305Key) Hash(b []byte) []byte {
 
 // Decrypt decrypts data that was encrypted with Encrypt and the same key.
 func (k Chacha20Poly1305Key) Decrypt(data []byte) ([]byte, error) {
+	return k.DecryptWithAAD(data, nil)
+}
+
+// DecryptWithAAD decrypts data that was encrypted with EncryptWithAAD, the
+// same key, and the same additional data.
+func (k Chacha20Poly1305Key) DecryptWithAAD(data, additionalData []byte) ([]byte, error) {
 	if len(k.maskedKey) == 0 {
 		k.Logger().Fatal("key is not set")
 	}
@@ -227,7 +261,7 @@ func (k Chacha20Poly1305Key) Decrypt(data []byte) ([]byte, error) {
 		return nil, ErrEncryptFailed
 	}
 	nonce := data[:ccp.NonceSize()]
-	b, err := ccp.Open(nil, nonce, data[ccp.NonceSize():], nil)
+	b, err := ccp.Open(nil, nonce, data[ccp.NonceSize():], additionalData)
 	if err != nil {
 		k.Logger().Debug(err)
 		return nil, ErrDecryptFailed
@@ -237,6 +271,12 @@ func (k Chacha20Poly1305Key) Decrypt(data []byte) ([]byte, error) {
 
 // Encrypt encrypts data using the key.
 func (k Chacha20Poly1305Key) Encrypt(data []byte) ([]byte, error) {
+	return k.EncryptWithAAD(data, nil)
+}
+
+// EncryptWithAAD encrypts data using the key, and authenticates
+// additionalData.
+func (k Chacha20Poly1305Key) EncryptWithAAD(data, additionalData []byte) ([]byte, error) {
 	if len(k.maskedKey) == 0 {
 		k.Logger().Fatal("key is not set")
 	}
@@ -254,7 +294,7 @@ func (k Chacha20Poly1305Key) Encrypt(data []byte) ([]byte, error) {
 		k.Logger().Debug(err)
 		return nil, ErrEncryptFailed
 	}
-	return ccp.Seal(out, out[1:1+ccp.NonceSize()], data, nil), nil
+	return ccp.Seal(out, out[1:1+ccp.NonceSize()], data, additionalData), nil
 }
 
 // chacha20poly1305KeyFromBytes returns an Chacha20Poly1305Key with the raw
@@ -291,18 +331,39 @@ func (k Chacha20Poly1305Key) NewKey() (EncryptionKey, error) {
 		return nil, err
 	}
 	ek := chacha20poly1305KeyFromBytes(b)
-	ek.encryptedKey = enc
+	ek.encryptedKey = tagEncryptedKey(k, enc)
+	ek.logger = k.logger
+	ek.workers = k.workers
+	return ek, nil
+}
+
+// DeriveKey derives a new encryption key from this key and info.
+func (k Chacha20Poly1305Key) DeriveKey(info []byte) (EncryptionKey, error) {
+	key := k.key()
+	defer clear(key)
+	b, err := deriveKeyBytes(key, info)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrEncryptFailed
+	}
+	ek := chacha20poly1305KeyFromBytes(b)
 	ek.logger = k.logger
+	ek.workers = k.workers
 	return ek, nil
 }
 
 // DecryptKey decrypts an encrypted key.
 func (k Chacha20Poly1305Key) DecryptKey(encryptedKey []byte) (EncryptionKey, error) {
-	if len(encryptedKey) != chachaEncryptedKeySize {
-		k.Logger().Debugf("DecryptKey: unexpected encrypted key size %d != %d", len(encryptedKey), chachaEncryptedKeySize)
+	enc, err := untagEncryptedKey(k, encryptedKey)
+	if err != nil {
+		k.Logger().Debug("DecryptKey: key ID mismatch")
+		return nil, err
+	}
+	if len(enc) != chachaEncryptedKeySize {
+		k.Logger().Debugf("DecryptKey: unexpected encrypted key size %d != %d", len(enc), chachaEncryptedKeySize)
 		return nil, ErrDecryptFailed
 	}
-	b, err := k.Decrypt(encryptedKey)
+	b, err := k.Decrypt(enc)
 	if err != nil {
 		return nil, err
 	}
@@ -314,6 +375,7 @@ func (k Chacha20Poly1305Key) DecryptKey(encryptedKey []byte) (EncryptionKey, err
 	ek.encryptedKey = make([]byte, len(encryptedKey))
 	copy(ek.encryptedKey, encryptedKey)
 	ek.logger = k.logger
+	ek.workers = k.workers
 	return ek, nil
 }
 
@@ -334,6 +396,26 @@ type Chacha20Poly1305StreamReader struct {
 	start  int64
 	off    int64
 	buf    []byte
+	chunk  *[]byte
+	// version is the stream format version, detected from the first
+	// chunk that is read.
+	version byte
+	// more is true when the last chunk that was read isn't the final
+	// chunk of a version 2 stream.
+	more bool
+	// raVersion is the stream format version detected by ReadAt.
+	raVersion atomic.Uint32
+	// full is true when the last chunk that was read is a full chunk.
+	full bool
+	// next is the number of the next chunk.
+	next int64
+	// carry is the input that was read after a flushed chunk.
+	carry []byte
+	// workers is the number of goroutines that decrypt chunks. When it is
+	// more than 1, the chunks that follow a full chunk are read ahead by
+	// cr, and decrypted in parallel.
+	workers int
+	cr      *chunkReader
 }
 
 // Seek moves the next read to a new offset. The offset is in the decrypted
@@ -350,10 +432,17 @@ func (r *Chacha20Poly1305StreamReader) Seek(offset int64, whence int) (int64, er
 		if !ok {
 			return 0, errors.New("input is not seekable")
 		}
+		cur, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
 		size, err := seeker.Seek(0, io.SeekEnd)
 		if err != nil {
 			return 0, err
 		}
+		if _, err := seeker.Seek(cur, io.SeekStart); err != nil {
+			return 0, err
+		}
 		nChunks := (size - r.start) / int64(chachaFileChunkSize+r.ccp.Overhead())
 		lastChunkSize := (size - r.start) % int64(chachaFileChunkSize+r.ccp.Overhead())
 		if lastChunkSize > 0 {
@@ -394,6 +483,12 @@ func (r *Chacha20Poly1305StreamReader) Seek(offset int64, whence int) (int64, er
 		return 0, err
 	}
 	r.buf = nil
+	r.more = false
+	r.carry = nil
+	r.next = r.off/int64(chachaFileChunkSize) + 1
+	if r.cr != nil {
+		r.cr.seek(r.next)
+	}
 	if err := r.readChunk(); err != nil && err != io.EOF {
 		return 0, err
 	}
@@ -405,16 +500,41 @@ func (r *Chacha20Poly1305StreamReader) Seek(offset int64, whence int) (int64, er
 	return r.off, nil
 }
 
+// readChunk reads and decrypts the next chunk. It is only called when r.buf
+// is empty. The chunk is decrypted in place in the reader's chunk buffer. The
+// input that follows a flushed chunk is kept for the next chunk.
 func (r *Chacha20Poly1305StreamReader) readChunk() error {
-	in := make([]byte, chachaFileChunkSize+r.ccp.Overhead())
-	n, err := io.ReadFull(r.r, in)
-	if n > 0 {
-		dec, err := r.ccp.Open(in[:0], chachaNonce(r.ctx, r.off/int64(chachaFileChunkSize)+1), in[:n], nil)
+	if r.cr != nil || (r.workers > 1 && r.full) {
+		return r.readChunkAhead()
+	}
+	r.full = false
+	if r.chunk == nil {
+		r.chunk = getChunkBuffer()
+	}
+	in := (*r.chunk)[:chachaFileChunkSize+r.ccp.Overhead()]
+	m := copy(in, r.carry)
+	r.carry = r.carry[m:]
+	n, err := io.ReadFull(r.r, in[m:])
+	if n += m; n > 0 {
+		if n < r.ccp.Overhead() {
+			r.logger.Debugf("StreamReader.Read: short chunk %d", n)
+			return ErrDecryptFailed
+		}
+		dec, size, kind, err := openNextChunk(r.ccp, chachaNonce(r.ctx, r.next), in[:n], chachaFileChunkSize, &r.version)
 		if err != nil {
 			r.logger.Debug(err)
 			return ErrDecryptFailed
 		}
-		r.buf = append(r.buf, dec...)
+		if size < n {
+			r.carry = append(slices.Clone(in[size:n]), r.carry...)
+		}
+		r.next++
+		r.buf = dec
+		r.more = r.version == streamVersion2 && kind != chunkFinal
+		r.full = kind == chunkFull && n == len(in)
+	} else if err == io.EOF && r.more {
+		r.logger.Debugf("StreamReader.Read: missing final chunk at %d", r.off)
+		return ErrStreamTruncated
 	}
 	if err == io.ErrUnexpectedEOF {
 		err = io.EOF
@@ -425,6 +545,65 @@ func (r *Chacha20Poly1305StreamReader) readChunk() error {
 	return err
 }
 
+// readChunkAhead is like readChunk, but the chunks are read ahead and
+// decrypted in parallel.
+func (r *Chacha20Poly1305StreamReader) readChunkAhead() error {
+	if r.cr == nil {
+		r.cr = &chunkReader{
+			p:            newChunkPipeline(r.workers, r.openJob),
+			r:            r.r,
+			encChunkSize: chachaFileChunkSize + r.ccp.Overhead(),
+			version:      r.version,
+			next:         r.next,
+		}
+	}
+	j, err := r.cr.read()
+	if err == io.EOF && r.more {
+		r.logger.Debugf("StreamReader.Read: missing final chunk at %d", r.off)
+		return ErrStreamTruncated
+	}
+	if err != nil {
+		return err
+	}
+	if j.err != nil {
+		r.logger.Debug(j.err)
+		if r.version != streamVersion2 {
+			j.release()
+			return ErrDecryptFailed
+		}
+		// It may be a flushed chunk, which isn't where the pipeline
+		// expects chunks to be. Read the rest of the stream
+		// sequentially.
+		r.next = j.c
+		r.carry = r.cr.stop(j)
+		r.cr = nil
+		r.workers = 1
+		return r.readChunk()
+	}
+	if r.chunk != nil {
+		putChunkBuffer(r.chunk)
+	}
+	r.chunk, j.dst = j.dst, nil
+	r.buf = j.out
+	r.next = j.c + 1
+	r.more = r.version == streamVersion2 && j.kind != chunkFinal
+	j.release()
+	if len(r.buf) == 0 {
+		return io.EOF
+	}
+	return nil
+}
+
+// openJob decrypts a chunk in a pipeline worker.
+func (r *Chacha20Poly1305StreamReader) openJob(j *chunkJob) {
+	if j.n < r.ccp.Overhead() {
+		j.err = fmt.Errorf("short chunk %d", j.n)
+		return
+	}
+	j.dst = getChunkBuffer()
+	j.out, _, j.err = openStreamChunk(r.ccp, chachaNonce(r.ctx, j.c), (*j.dst)[:0], (*j.in)[:j.n], chachaFileChunkSize, &j.version)
+}
+
 func (r *Chacha20Poly1305StreamReader) Read(b []byte) (n int, err error) {
 	for err == nil {
 		nn := copy(b[n:], r.buf)
@@ -442,7 +621,51 @@ func (r *Chacha20Poly1305StreamReader) Read(b []byte) (n int, err error) {
 	return n, err
 }
 
+// WriteTo writes the rest of the decrypted stream to w. The chunks are written
+// directly from the chunk buffer.
+func (r *Chacha20Poly1305StreamReader) WriteTo(w io.Writer) (total int64, err error) {
+	for {
+		if len(r.buf) > 0 {
+			n, err := w.Write(r.buf)
+			r.buf = r.buf[n:]
+			r.off += int64(n)
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+			if len(r.buf) > 0 {
+				return total, io.ErrShortWrite
+			}
+		}
+		if err := r.readChunk(); err == io.EOF && len(r.buf) == 0 {
+			return total, nil
+		} else if err != nil && err != io.EOF {
+			return total, err
+		}
+	}
+}
+
+// ReadAt reads len(b) bytes of the decrypted stream starting at offset off.
+// It is safe for concurrent use.
+func (r *Chacha20Poly1305StreamReader) ReadAt(b []byte, off int64) (int, error) {
+	ra, ok := r.r.(io.ReaderAt)
+	if !ok {
+		return 0, errNotReaderAt
+	}
+	nonce := func(c int64) []byte { return chachaNonce(r.ctx, c) }
+	return readStreamAt(ra, r.start, r.ccp, chachaFileChunkSize, nonce, &r.raVersion, r.logger, b, off)
+}
+
 func (r *Chacha20Poly1305StreamReader) Close() error {
+	if r.cr != nil {
+		r.cr.p.close()
+		r.cr = nil
+	}
+	r.buf = nil
+	if r.chunk != nil {
+		putChunkBuffer(r.chunk)
+		r.chunk = nil
+	}
 	if c, ok := r.r.(io.Closer); ok {
 		if err := c.Close(); err != nil {
 			return err
@@ -466,7 +689,7 @@ func (k Chacha20Poly1305Key) StartReader(ctx []byte, r io.Reader) (StreamReader,
 	if err != nil {
 		return nil, err
 	}
-	return &Chacha20Poly1305StreamReader{logger: k.logger, ccp: ccp, r: r, ctx: ctx, start: start}, nil
+	return &Chacha20Poly1305StreamReader{logger: k.logger, ccp: ccp, r: r, ctx: ctx, start: start, workers: k.workers, next: 1}, nil
 }
 
 // Chacha20Poly1305StreamWriter encrypts a stream of data.
@@ -476,22 +699,97 @@ type Chacha20Poly1305StreamWriter struct {
 	ctx []byte
 	c   int64
 	buf []byte
+	// workers is the number of goroutines that encrypt chunks. When it is
+	// more than 1, all the chunks but a short first chunk are encrypted in
+	// parallel by p.
+	workers int
+	p       *chunkPipeline
+	// err is the first error from w, when chunks are written by p.
+	err error
+	// out is the buffer of encrypted chunks, when they are written
+	// sequentially.
+	out *[]byte
 }
 
-func (w *Chacha20Poly1305StreamWriter) writeChunk(b []byte) (int, error) {
+func (w *Chacha20Poly1305StreamWriter) writeChunk(b []byte, kind byte) (int, error) {
+	if w.p != nil || (w.workers > 1 && kind == chunkFull) {
+		return len(b), w.submitChunk(b, kind)
+	}
+	if w.out == nil {
+		w.out = getChunkBuffer()
+	}
 	w.c++
-	enc := w.ccp.Seal(nil, chachaNonce(w.ctx, w.c), b, nil)
-	for i := 0; i < len(b); i++ {
-		b[i] = 0
+	out := sealStreamChunk((*w.out)[:0], w.ccp, chachaNonce(w.ctx, w.c), b, kind)
+	clear(b)
+	return w.w.Write(out)
+}
+
+// submitChunk submits a chunk to be encrypted in parallel. The encrypted
+// chunks are written in order, when they are ready.
+func (w *Chacha20Poly1305StreamWriter) submitChunk(b []byte, kind byte) error {
+	if w.p == nil {
+		w.p = newChunkPipeline(w.workers, w.sealJob)
+	}
+	if w.p.full() {
+		w.writeJob(w.p.next())
+	}
+	in := getChunkBuffer()
+	n := copy(*in, b)
+	clear(b)
+	w.c++
+	w.p.submit(&chunkJob{c: w.c, in: in, n: n, kind: kind})
+	return w.err
+}
+
+// sealJob encrypts a chunk in a pipeline worker.
+func (w *Chacha20Poly1305StreamWriter) sealJob(j *chunkJob) {
+	j.out = sealStreamChunk(nil, w.ccp, chachaNonce(w.ctx, j.c), (*j.in)[:j.n], j.kind)
+	putChunkBuffer(j.in)
+	j.in = nil
+}
+
+// writeJob writes a chunk that was encrypted by sealJob. After an error, the
+// chunks are discarded.
+func (w *Chacha20Poly1305StreamWriter) writeJob(j *chunkJob) {
+	if w.err == nil {
+		_, w.err = w.w.Write(j.out)
+	}
+	j.release()
+}
+
+// ReadFrom reads data from r until EOF, and encrypts it. Full chunks are read
+// directly in a chunk buffer, instead of being appended to the write buffer.
+func (w *Chacha20Poly1305StreamWriter) ReadFrom(r io.Reader) (total int64, err error) {
+	bufp := getChunkBuffer()
+	defer putChunkBuffer(bufp)
+	in := (*bufp)[:chachaFileChunkSize]
+	m := copy(in, w.buf)
+	clear(w.buf)
+	w.buf = w.buf[:0]
+	for {
+		n, rerr := io.ReadFull(r, in[m:])
+		total += int64(n)
+		if m += n; m == len(in) {
+			if _, err := w.writeChunk(in, chunkFull); err != nil {
+				return total, err
+			}
+			m = 0
+		}
+		if rerr != nil {
+			w.buf = append(w.buf, in[:m]...)
+			if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+				rerr = nil
+			}
+			return total, rerr
+		}
 	}
-	return w.w.Write(enc)
 }
 
 func (w *Chacha20Poly1305StreamWriter) Write(b []byte) (n int, err error) {
 	w.buf = append(w.buf, b...)
 	n = len(b)
 	for len(w.buf) >= chachaFileChunkSize {
-		_, err = w.writeChunk(w.buf[:chachaFileChunkSize])
+		_, err = w.writeChunk(w.buf[:chachaFileChunkSize], chunkFull)
 		w.buf = w.buf[chachaFileChunkSize:]
 		if err != nil {
 			break
@@ -500,9 +798,49 @@ func (w *Chacha20Poly1305StreamWriter) Write(b []byte) (n int, err error) {
 	return
 }
 
+// Flush writes the buffered data in flushed chunks, and flushes the
+// underlying writer if it has a Flush method. The size of flushed chunks
+// leaves room for their size prefix in the space of a full chunk.
+func (w *Chacha20Poly1305StreamWriter) Flush() error {
+	for len(w.buf) > 0 {
+		n := min(len(w.buf), chachaFileChunkSize-4)
+		if _, err := w.writeChunk(w.buf[:n], chunkFlushed); err != nil {
+			return err
+		}
+		w.buf = w.buf[n:]
+	}
+	if err := w.drain(); err != nil {
+		return err
+	}
+	if f, ok := w.w.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// drain writes all the chunks that are in the pipeline.
+func (w *Chacha20Poly1305StreamWriter) drain() error {
+	if w.p != nil {
+		for j := w.p.next(); j != nil; j = w.p.next() {
+			w.writeJob(j)
+		}
+	}
+	return w.err
+}
+
+// Close writes the final chunk, which is empty if the size of the stream is a
+// multiple of the chunk size.
 func (w *Chacha20Poly1305StreamWriter) Close() (err error) {
-	if len(w.buf) > 0 {
-		_, err = w.writeChunk(w.buf)
+	_, err = w.writeChunk(w.buf, chunkFinal)
+	if w.p != nil {
+		if e := w.drain(); err == nil {
+			err = e
+		}
+		w.p.close()
+	}
+	if w.out != nil {
+		putChunkBuffer(w.out)
+		w.out = nil
 	}
 	if c, ok := w.w.(io.Closer); ok {
 		if e := c.Close(); err == nil {
@@ -518,13 +856,27 @@ func (k Chacha20Poly1305Key) StartWriter(ctx []byte, w io.Writer) (StreamWriter,
 	if err != nil {
 		return nil, err
 	}
-	return &Chacha20Poly1305StreamWriter{ccp: ccp, w: w, ctx: ctx}, nil
+	return &Chacha20Poly1305StreamWriter{ccp: ccp, w: w, ctx: ctx, workers: k.workers}, nil
+}
+
+// StartAppendWriter opens a writer to append to an encrypted stream.
+func (k Chacha20Poly1305Key) StartAppendWriter(ctx []byte, rw TruncatableStream) (StreamWriter, int64, error) {
+	sw, err := k.StartWriter(ctx, rw)
+	if err != nil {
+		return nil, 0, err
+	}
+	w := sw.(*Chacha20Poly1305StreamWriter)
+	nonce := func(c int64) []byte { return chachaNonce(ctx, c) }
+	if w.c, err = prepareAppend(rw, w.ccp, chachaFileChunkSize, nonce, k.logger); err != nil {
+		return nil, 0, err
+	}
+	return w, w.c * chachaFileChunkSize, nil
 }
 
 // ReadEncryptedKey reads an encrypted key and decrypts it.
 func (k Chacha20Poly1305Key) ReadEncryptedKey(r io.Reader) (EncryptionKey, error) {
-	buf := make([]byte, chachaEncryptedKeySize)
-	if _, err := io.ReadFull(r, buf); err != nil {
+	buf, err := readEncryptedKeyBytes(r, chachaEncryptedKeySize)
+	if err != nil {
 		k.Logger().Debugf("ReadEncryptedKey: %v", err)
 		return nil, ErrDecryptFailed
 	}
@@ -534,7 +886,7 @@ func (k Chacha20Poly1305Key) ReadEncryptedKey(r io.Reader) (EncryptionKey, error
 // WriteEncryptedKey writes the encrypted key to the writer.
 func (k Chacha20Poly1305Key) WriteEncryptedKey(w io.Writer) error {
 	n, err := w.Write(k.encryptedKey)
-	if n != chachaEncryptedKeySize {
+	if n != chachaEncryptedKeySize && n != 1+keyIDSize+chachaEncryptedKeySize {
 		k.Logger().Debugf("WriteEncryptedKey: unexpected key size: %d != %d", n, chachaEncryptedKeySize)
 		return ErrEncryptFailed
 	}
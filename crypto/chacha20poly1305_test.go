@@ -25,6 +25,7 @@ package crypto
 
 import (
 	"bytes"
+	"crypto/cipher"
 	"crypto/rand"
 	"io"
 	"os"
@@ -265,3 +266,145 @@ func TestChachaStreamInvalidMAC(t *testing.T) {
 		t.Errorf("StartReader.Read: %d, %v", n, err)
 	}
 }
+
+func TestChachaStreamAppend(t *testing.T) {
+	mk, err := CreateChacha20Poly1305MasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	fn := filepath.Join(t.TempDir(), "appendfile")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	content := make([]byte, 5*1024*1024+100)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+	ctx := []byte{0x12, 0x12, 0x12, 0x12}
+	w, err := mk.StartWriter(ctx, f)
+	if err != nil {
+		t.Fatalf("StartWriter: %v", err)
+	}
+	// Interrupted write: only the complete chunks are written.
+	if _, err := w.Write(content[:2*1024*1024+500]); err != nil {
+		t.Fatalf("StartWriter.Write: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	// Partially written chunk. It is truncated, but its nonce can't be
+	// used again.
+	if _, err := f.Write([]byte("garbage")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if _, _, err := mk.StartAppendWriter(ctx, f); err != ErrStreamNotAppendable {
+		t.Fatalf("StartAppendWriter() = %v, want ErrStreamNotAppendable", err)
+	}
+	if fi2, err := f.Stat(); err != nil || fi2.Size() != fi.Size() {
+		t.Fatalf("Stat() = %v, %v, want size %d", fi2, err, fi.Size())
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	aw, off, err := mk.StartAppendWriter(ctx, f)
+	if err != nil {
+		t.Fatalf("StartAppendWriter: %v", err)
+	}
+	if want := int64(2 * 1024 * 1024); off != want {
+		t.Fatalf("StartAppendWriter offset = %d, want %d", off, want)
+	}
+	if _, err := aw.Write(content[off:]); err != nil {
+		t.Fatalf("StartAppendWriter.Write: %v", err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatalf("StartAppendWriter.Close: %v", err)
+	}
+
+	if f, err = os.OpenFile(fn, os.O_RDWR, 0600); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	r, err := mk.StartReader(ctx, f)
+	if err != nil {
+		t.Fatalf("StartReader: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(content, got) {
+		t.Error("Read different content")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if _, _, err := mk.StartAppendWriter(ctx, f); err != ErrStreamNotAppendable {
+		t.Errorf("StartAppendWriter() = %v, want ErrStreamNotAppendable", err)
+	}
+	f.Close()
+}
+
+func TestChachaStreamTruncation(t *testing.T) {
+	mk, err := CreateChacha20Poly1305MasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	aeadOf := func(w StreamWriter) cipher.AEAD { return w.(*Chacha20Poly1305StreamWriter).ccp }
+	testStreamTruncation(t, mk, chachaFileChunkSize, aeadOf, chachaNonce)
+}
+
+func TestChachaStreamReadAt(t *testing.T) {
+	mk, err := CreateChacha20Poly1305MasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	testStreamReadAt(t, mk, chachaFileChunkSize, 16)
+}
+
+func TestChachaStreamWorkers(t *testing.T) {
+	mk, err := CreateChacha20Poly1305MasterKey(WithStreamWorkers(4))
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	k := mk.(*Chacha20Poly1305MasterKey)
+	if k.workers != 4 {
+		t.Fatalf("workers = %d, want 4", k.workers)
+	}
+	testStreamWorkers(t, mk, func(n int) { k.workers = n }, chachaFileChunkSize)
+}
+
+func TestChachaStreamFlush(t *testing.T) {
+	mk, err := CreateChacha20Poly1305MasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	k := mk.(*Chacha20Poly1305MasterKey)
+	testStreamFlush(t, mk, func(n int) { k.workers = n }, chachaFileChunkSize)
+}
+
+func TestChachaStreamCopy(t *testing.T) {
+	mk, err := CreateChacha20Poly1305MasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	k := mk.(*Chacha20Poly1305MasterKey)
+	testStreamCopy(t, mk, func(n int) { k.workers = n }, chachaFileChunkSize)
+}
+
+func TestChachaDeriveKey(t *testing.T) {
+	mk, err := CreateChacha20Poly1305MasterKey()
+	if err != nil {
+		t.Fatalf("CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	testDeriveKey(t, mk)
+}
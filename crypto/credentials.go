@@ -0,0 +1,61 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNoCredentials indicates that the process has no systemd credentials,
+// i.e. CREDENTIALS_DIRECTORY isn't set.
+var ErrNoCredentials = errors.New("no systemd credentials")
+
+// CredentialPath returns the path of a systemd credential, i.e. a file that
+// systemd set up with LoadCredential= or LoadCredentialEncrypted=. Unlike
+// environment variables, credentials are only readable by the service, and
+// can be encrypted with the TPM by systemd-creds. A master key file can be a
+// credential too.
+func CredentialPath(name string) (string, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return "", ErrNoCredentials
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", errors.New("invalid credential name")
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// ReadCredential returns the content of a systemd credential, e.g. the
+// passphrase of a master key.
+func ReadCredential(name string) ([]byte, error) {
+	file, err := CredentialPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(file)
+}
@@ -0,0 +1,58 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCredentials(t *testing.T) {
+	t.Setenv("CREDENTIALS_DIRECTORY", "")
+	if _, err := ReadCredential("passphrase"); err != ErrNoCredentials {
+		t.Errorf("ReadCredential() = %v, want %v", err, ErrNoCredentials)
+	}
+
+	dir := t.TempDir()
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+	if err := os.WriteFile(filepath.Join(dir, "passphrase"), []byte("foo"), 0o400); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	got, err := ReadCredential("passphrase")
+	if err != nil {
+		t.Fatalf("ReadCredential: %v", err)
+	}
+	if string(got) != "foo" {
+		t.Errorf("ReadCredential() = %q, want %q", got, "foo")
+	}
+	if _, err := ReadCredential("missing"); !os.IsNotExist(err) {
+		t.Errorf("ReadCredential(missing) = %v, want not exist", err)
+	}
+	for _, name := range []string{"", ".", "..", "../passphrase", "a/b"} {
+		if _, err := CredentialPath(name); err == nil {
+			t.Errorf("CredentialPath(%q) didn't fail", name)
+		}
+	}
+}
@@ -26,19 +26,34 @@
 package crypto
 
 import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/c2FmZQ/tpm"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
 )
 
 const (
 	AES256               int = iota // AES256-GCM, AES256-CBC+HMAC-SHA256, PBKDF2.
 	Chacha20Poly1305                // Chacha20Poly1305, Argon2.
 	AES256WithTPMRSA2048            // Like AES256, with RSA2048 masterkey on TPM.
+	AES256WithTPMECCP256            // Like AES256, with ECC P-256 masterkey on TPM.
+	AES256GCMSIV                    // Like AES256, with AES256-GCM-SIV instead of AES256-CBC+HMAC-SHA256.
 
 	DefaultAlgo = AES256
 	PickFastest = -1
@@ -51,6 +66,13 @@ var (
 	ErrEncryptFailed = errors.New("encryption failed")
 	// Indicates an invalid alg value.
 	ErrUnexpectedAlgo = errors.New("unexpected algorithm")
+	// Indicates that a stream ends with a short chunk, i.e. it was closed,
+	// and can't be appended to without re-encrypting the last chunk.
+	ErrStreamNotAppendable = errors.New("stream is not appendable")
+	// Indicates that a stream ends before its last chunk.
+	ErrStreamTruncated = errors.New("stream is truncated")
+	// Indicates that a signature doesn't match the signed data.
+	ErrInvalidSignature = errors.New("invalid signature")
 )
 
 // Logger is the interface for writing debug logs.
@@ -73,6 +95,16 @@ type MasterKey interface {
 
 	// Save encrypts the MasterKey with passphrase and saves it to file.
 	Save(passphrase []byte, file string) error
+	// ChangePassphrase checks that file contains the MasterKey encrypted
+	// with oldPassphrase, and atomically replaces it with the MasterKey
+	// encrypted with newPassphrase. The key itself doesn't change. If
+	// file is a key slots file, only the slot of oldPassphrase changes.
+	ChangePassphrase(oldPassphrase, newPassphrase []byte, file string) error
+	// ExportMnemonic returns a recovery phrase that encodes the MasterKey,
+	// e.g. to write it down for offline backup. It doesn't depend on the
+	// passphrase, and must be kept secret. The MasterKey is re-created
+	// with CreateMasterKeyFromMnemonic.
+	ExportMnemonic() (string, error)
 }
 
 // Option is used to specify the parameters of MasterKey.
@@ -83,7 +115,12 @@ type option struct {
 	logger     Logger
 	strictWipe bool
 	tpm        *tpm.TPM
+	tpmECC     io.ReadWriter
 	passphrase []byte
+	kdfTarget  time.Duration
+	kdf        *KDFParams
+	backup     bool
+	workers    int
 }
 
 func (o *option) apply(opts []Option) {
@@ -120,7 +157,8 @@ func WithStrictWipe(v bool) Option {
 // WithTPM specifies that the master key should be in the Trusted Platform
 // Module (TPM).
 // When this option is used, the data encrypted with the master key can only
-// ever be decrypted with the same TPM.
+// ever be decrypted with the same TPM. To also bind the master key to the
+// boot state of the machine, seal it with the tpmkms package instead.
 func WithTPM(tpm *tpm.TPM) Option {
 	return func(opt *option) {
 		opt.tpm = tpm
@@ -130,11 +168,54 @@ func WithTPM(tpm *tpm.TPM) Option {
 	}
 }
 
+// WithTPMECC specifies that the master key should be protected by an ECC
+// P-256 key in the Trusted Platform Module (TPM) rw, e.g. /dev/tpmrm0,
+// instead of the RSA key of WithTPM. ECC keys are much faster with most
+// TPMs.
+// When this option is used, the data encrypted with the master key can only
+// ever be decrypted with the same TPM. AttestMasterKey proves it to remote
+// systems.
+func WithTPMECC(rw io.ReadWriter) Option {
+	return func(opt *option) {
+		opt.tpmECC = rw
+		if opt.alg == DefaultAlgo {
+			opt.alg = AES256WithTPMECCP256
+		}
+	}
+}
+
+// WithStreamWorkers specifies the number of goroutines that encrypt and decrypt
+// the chunks of each stream. The default is 1, i.e. the chunks are processed
+// sequentially by the reader or writer. With more workers, the chunks are
+// processed in parallel, and up to 2 chunks per worker are buffered to keep
+// them in order. It only has an effect on streams that are larger than one
+// chunk. The readers and writers must be closed to stop the goroutines.
+func WithStreamWorkers(n int) Option {
+	return func(opt *option) {
+		opt.workers = n
+	}
+}
+
+// hasTPM returns true if a TPM option was used.
+func (o *option) hasTPM() bool {
+	return o.tpm != nil || o.tpmECC != nil
+}
+
+// WithKeyFileBackup specifies whether Save should keep a copy of the key
+// file that it replaces, as file.prev. ReadMasterKey falls back to the copy
+// when the key file is missing or damaged. ChangePassphrase removes the copy
+// so that the old passphrase can't be used anymore.
+func WithKeyFileBackup(v bool) Option {
+	return func(opt *option) {
+		opt.backup = v
+	}
+}
+
 // CreateMasterKey creates a new master key.
 func CreateMasterKey(opts ...Option) (MasterKey, error) {
-	alg := DefaultAlgo
 	var opt option
 	opt.apply(opts)
+	alg := opt.alg
 	if alg == PickFastest {
 		var err error
 		if alg, err = Fastest(opts...); err != nil {
@@ -142,7 +223,7 @@ func CreateMasterKey(opts ...Option) (MasterKey, error) {
 		}
 	}
 	switch alg {
-	case AES256, AES256WithTPMRSA2048:
+	case AES256, AES256WithTPMRSA2048, AES256WithTPMECCP256, AES256GCMSIV:
 		return CreateAESMasterKey(opts...)
 	case Chacha20Poly1305:
 		return CreateChacha20Poly1305MasterKey(opts...)
@@ -153,6 +234,19 @@ func CreateMasterKey(opts ...Option) (MasterKey, error) {
 
 // ReadMasterKey reads an encrypted master key from file and decrypts it.
 func ReadMasterKey(passphrase []byte, file string, opts ...Option) (MasterKey, error) {
+	mk, err := readMasterKey(passphrase, file, opts...)
+	if err != nil && (errors.Is(err, os.ErrNotExist) || errors.Is(err, ErrUnexpectedAlgo)) {
+		if _, serr := os.Stat(file + backupSuffix); serr == nil {
+			var opt option
+			opt.apply(opts)
+			opt.logger.Errorf("ReadMasterKey: %s: %v, using %s%s", file, err, file, backupSuffix)
+			return readMasterKey(passphrase, file+backupSuffix, opts...)
+		}
+	}
+	return mk, err
+}
+
+func readMasterKey(passphrase []byte, file string, opts ...Option) (MasterKey, error) {
 	b, err := os.ReadFile(file)
 	if err != nil {
 		return nil, err
@@ -161,10 +255,24 @@ func ReadMasterKey(passphrase []byte, file string, opts ...Option) (MasterKey, e
 		return nil, ErrUnexpectedAlgo
 	}
 	switch b[0] {
-	case 1, 3: // AES256 or AES256WithTPM
+	case 1, 3, tpmECCVersion, aesGCMSIVVersion: // AES256, AES256WithTPMRSA2048, AES256WithTPMECCP256 or AES256GCMSIV
 		return ReadAESMasterKey(passphrase, file, opts...)
 	case 2: // Chacha20Poly1305
 		return ReadChacha20Poly1305MasterKey(passphrase, file, opts...)
+	case x25519Version:
+		return ReadX25519MasterKey(passphrase, file, opts...)
+	case hybridVersion:
+		return ReadX25519MLKEM768MasterKey(passphrase, file, opts...)
+	case hybridWrapVersion:
+		return nil, ErrWrappedKey
+	case thresholdVersion:
+		return nil, ErrThresholdKey
+	case keySlotsVersion:
+		return readKeySlotsMasterKey(passphrase, file, opts...)
+	case scryptVersion:
+		return readScryptMasterKey(passphrase, file, opts...)
+	case kmsVersion:
+		return nil, ErrKMSKey
 	default:
 		return nil, ErrUnexpectedAlgo
 	}
@@ -179,14 +287,39 @@ type EncryptionKey interface {
 	Encrypt(data []byte) ([]byte, error)
 	// Decrypt decrypts data that was encrypted with Encrypt and the same key.
 	Decrypt(data []byte) ([]byte, error)
+	// EncryptWithAAD is like Encrypt, but it also authenticates
+	// additionalData, e.g. a record ID or a file name, so that the
+	// ciphertext can only be decrypted with the same additional data. The
+	// additional data isn't part of the ciphertext. Encrypt is the same as
+	// EncryptWithAAD with empty additional data.
+	EncryptWithAAD(data, additionalData []byte) ([]byte, error)
+	// DecryptWithAAD decrypts data that was encrypted with EncryptWithAAD,
+	// the same key, and the same additional data.
+	DecryptWithAAD(data, additionalData []byte) ([]byte, error)
 	// Hash returns a cryptographially secure hash of b.
 	Hash(b []byte) []byte
 	// StartReader opens a reader to decrypt a stream of data.
 	StartReader(ctx []byte, r io.Reader) (StreamReader, error)
 	// StartWriter opens a writer to encrypt a stream of data.
 	StartWriter(ctx []byte, w io.Writer) (StreamWriter, error)
+	// StartAppendWriter opens a writer to append to a stream of data that
+	// was encrypted with StartWriter and the same ctx, e.g. after the
+	// writer was interrupted. rw must be positioned at the start of the
+	// encrypted stream. It returns the offset in the decrypted stream where
+	// the new data will be appended. A partially written chunk at the end
+	// of the stream is truncated, and ErrStreamNotAppendable is returned
+	// because its nonce can't be used again: the stream must be
+	// re-encrypted with a new key. If the stream ends with a complete
+	// short chunk, i.e. the writer was closed, if it contains flushed
+	// chunks, or if the stream uses the version 1 format, it returns
+	// ErrStreamNotAppendable.
+	StartAppendWriter(ctx []byte, rw TruncatableStream) (StreamWriter, int64, error)
 	// NewKey creates a new encryption key.
 	NewKey() (EncryptionKey, error)
+	// DeriveKey derives a new encryption key from this key and info. The
+	// same key and info always produce the same derived key, and keys
+	// derived with different info are independent.
+	DeriveKey(info []byte) (EncryptionKey, error)
 	// DecryptKey decrypts an encrypted key.
 	DecryptKey(encryptedKey []byte) (EncryptionKey, error)
 	// ReadEncryptedKey reads an encrypted key and decrypts it.
@@ -198,18 +331,588 @@ type EncryptionKey interface {
 }
 
 // StreamReader decrypts a stream.
+//
+// The stream readers of this package also implement io.ReaderAt, when the
+// underlying stream implements io.ReaderAt. ReadAt doesn't change the offset
+// of Read and Seek, and it can be called concurrently. They implement
+// io.WriterTo too, to write the decrypted chunks directly, e.g. with io.Copy.
 type StreamReader interface {
 	io.Reader
 	io.Seeker
 	io.Closer
 }
 
+var (
+	_ io.ReaderAt   = (*AESStreamReader)(nil)
+	_ io.ReaderAt   = (*Chacha20Poly1305StreamReader)(nil)
+	_ io.WriterTo   = (*AESStreamReader)(nil)
+	_ io.WriterTo   = (*Chacha20Poly1305StreamReader)(nil)
+	_ io.ReaderFrom = (*AESStreamWriter)(nil)
+	_ io.ReaderFrom = (*Chacha20Poly1305StreamWriter)(nil)
+	_ flusher       = (*AESStreamWriter)(nil)
+	_ flusher       = (*Chacha20Poly1305StreamWriter)(nil)
+)
+
 // StreamWriter encrypts a stream.
+//
+// The stream writers of this package also implement io.ReaderFrom, to read
+// the chunks directly, e.g. with io.Copy. They have a Flush() error method
+// too. It writes the buffered data in a short chunk, so that it can be read
+// before the stream is closed, e.g. for logs and network pipes. Streams with
+// flushed chunks can only be read sequentially. Seek and ReadAt don't work
+// with them, and StartAppendWriter returns ErrStreamNotAppendable.
 type StreamWriter interface {
 	io.Writer
 	io.Closer
 }
 
+// flusher is implemented by writers that have a Flush method.
+type flusher interface {
+	Flush() error
+}
+
+// TruncatableStream is a stream that can be read, written, and truncated,
+// e.g. *os.File.
+type TruncatableStream interface {
+	io.ReadWriteSeeker
+	Truncate(size int64) error
+}
+
+// deriveKeyBytes derives 64 bytes of key material from key and info with
+// HKDF-SHA256. The caller must wipe the returned bytes, e.g. with
+// aesKeyFromBytes.
+func deriveKeyBytes(key, info []byte) ([]byte, error) {
+	b := make([]byte, 64)
+	r := hkdf.New(sha256.New, key, nil, append([]byte("c2FmZQ storage derived key\x00"), info...))
+	if _, err := io.ReadFull(r, b); err != nil {
+		clear(b)
+		return nil, err
+	}
+	return b, nil
+}
+
+// changePassphrase checks that the key returned by read, from file, is mk,
+// and atomically replaces file with mk encrypted with newPassphrase. If file
+// is a key slots file, only the slot of oldPassphrase is changed. If file was
+// saved with SaveWithScrypt, its scrypt parameters are kept.
+func changePassphrase(mk MasterKey, oldPassphrase []byte, read func() (MasterKey, error), newPassphrase []byte, file string) error {
+	if isKeySlotsFile(file) {
+		return changeKeySlotPassphrase(mk, oldPassphrase, newPassphrase, file)
+	}
+	save := func(name string) error {
+		return mk.Save(newPassphrase, name)
+	}
+	if params, ok := readScryptParams(file); ok {
+		read = func() (MasterKey, error) {
+			return readScryptMasterKey(oldPassphrase, file, WithLogger(mk.Logger()))
+		}
+		save = func(name string) error {
+			return SaveWithScrypt(mk, newPassphrase, name, params)
+		}
+	}
+	cur, err := read()
+	if err != nil {
+		return err
+	}
+	same := KeyID(cur) == KeyID(mk)
+	cur.Wipe()
+	if !same {
+		return errors.New("file contains a different key")
+	}
+	if err := replaceFile(file, save); err != nil {
+		return err
+	}
+	if err := os.Remove(file + backupSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// The suffix of the copy of a key file that Save keeps.
+const backupSuffix = ".prev"
+
+// writeKeyFile atomically replaces file with data, so that a crash never
+// leaves a partially written key file. With backup, the file that is replaced
+// is kept as file.prev.
+func writeKeyFile(file string, data []byte, backup bool) error {
+	dir, _ := filepath.Split(file)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if backup {
+		old, err := os.ReadFile(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err == nil {
+			if err := replaceFile(file+backupSuffix, func(name string) error {
+				return os.WriteFile(name, old, 0600)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return replaceFile(file, func(name string) error {
+		return os.WriteFile(name, data, 0600)
+	})
+}
+
+// replaceFile atomically replaces file with the file that save writes to the
+// name it is given.
+func replaceFile(file string, save func(name string) error) error {
+	tmp := fmt.Sprintf("%s.tmp-%d", file, time.Now().UnixNano())
+	if err := save(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := syncFile(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncFile(filepath.Dir(file))
+}
+
+// masterKeyBytes returns the version and the raw bytes of mk. The caller
+// should clear the bytes when they are no longer needed. TPM keys can't be
+// exported.
+func masterKeyBytes(mk MasterKey) (byte, []byte, error) {
+	switch mk := mk.(type) {
+	case *AESMasterKey:
+		if mk.inTPM() {
+			return 0, nil, errors.New("tpm keys can't be exported")
+		}
+		if mk.siv {
+			return aesGCMSIVVersion, mk.key(), nil
+		}
+		return 1, mk.key(), nil
+	case *Chacha20Poly1305MasterKey:
+		return 2, mk.key(), nil
+	case *X25519Key:
+		return x25519Version, mk.key(), nil
+	case *X25519MLKEM768Key:
+		return hybridVersion, mk.key(), nil
+	default:
+		return 0, nil, ErrUnexpectedAlgo
+	}
+}
+
+// masterKeyFromBytes returns the master key whose version and raw bytes were
+// returned by masterKeyBytes.
+func masterKeyFromBytes(version byte, key []byte, opt option) (MasterKey, error) {
+	switch version {
+	case 1, aesGCMSIVVersion:
+		k := aesKeyFromBytes(key)
+		k.siv = version == aesGCMSIVVersion
+		k.logger = opt.logger
+		k.strictWipe = opt.strictWipe
+		k.backup = opt.backup
+		k.workers = opt.workers
+		return &AESMasterKey{k}, nil
+	case 2:
+		k := chacha20poly1305KeyFromBytes(key)
+		k.logger = opt.logger
+		k.strictWipe = opt.strictWipe
+		k.backup = opt.backup
+		k.workers = opt.workers
+		return &Chacha20Poly1305MasterKey{k}, nil
+	case x25519Version:
+		return x25519KeyFromBytes(key, opt)
+	case hybridVersion:
+		return hybridKeyFromBytes(key, opt)
+	default:
+		return nil, ErrUnexpectedAlgo
+	}
+}
+
+// syncFile commits the content of a file or directory to stable storage.
+func syncFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// wrappedFileKey is a file key whose encrypted key was wrapped by a key of a
+// different type, e.g. sealed to an X25519 public key. Its encrypted key
+// doesn't have the fixed size of the file key type.
+type wrappedFileKey struct {
+	*Chacha20Poly1305Key
+}
+
+// WriteEncryptedKey writes the encrypted key to the writer.
+func (k wrappedFileKey) WriteEncryptedKey(w io.Writer) error {
+	n, err := w.Write(k.encryptedKey)
+	if n == 0 || n != len(k.encryptedKey) {
+		k.Logger().Debugf("WriteEncryptedKey: unexpected key size: %d", n)
+		return ErrEncryptFailed
+	}
+	return err
+}
+
+// encryptWithPassphrase encrypts secret with a key derived from passphrase
+// with Argon2 and the KDF parameters. The output starts with the version
+// byte.
+func encryptWithPassphrase(version byte, secret, passphrase []byte, kdf kdfParams) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	time, memory := kdf.argon2()
+	dk := argon2.IDKey(passphrase, salt, time, memory, 1, 32)
+	ccp, err := chacha20poly1305.NewX(dk)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, ccp.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	encKey := ccp.Seal(nonce, nonce, secret, nil)
+	data := []byte{version}
+	data = append(data, salt...)
+	data = append(data, byte(time))
+	data = binary.LittleEndian.AppendUint32(data, memory)
+	return append(data, encKey...), nil
+}
+
+// decryptWithPassphrase decrypts a secret that was encrypted with
+// encryptWithPassphrase.
+func decryptWithPassphrase(version byte, b, passphrase []byte, logger Logger) ([]byte, error) {
+	if len(b) < 1+16+1+4 {
+		return nil, ErrDecryptFailed
+	}
+	if b[0] != version {
+		logger.Debugf("unexpected version: %d", b[0])
+		return nil, ErrDecryptFailed
+	}
+	b = b[1:]
+	salt, b := b[:16], b[16:]
+	time, b := uint32(b[0]), b[1:]
+	memory, b := binary.LittleEndian.Uint32(b[:4]), b[4:]
+	dk := argon2.IDKey(passphrase, salt, time, memory, 1, 32)
+	ccp, err := chacha20poly1305.NewX(dk)
+	if err != nil {
+		logger.Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	if len(b) < ccp.NonceSize() {
+		return nil, ErrDecryptFailed
+	}
+	secret, err := ccp.Open(nil, b[:ccp.NonceSize()], b[ccp.NonceSize():], nil)
+	if err != nil {
+		logger.Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	return secret, nil
+}
+
+// savePassphraseEncrypted encrypts secret with encryptWithPassphrase, and
+// saves it to file.
+func savePassphraseEncrypted(version byte, secret, passphrase []byte, kdf kdfParams, file string) error {
+	data, err := encryptWithPassphrase(version, secret, passphrase, kdf)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(file, data, false)
+}
+
+// readPassphraseEncrypted reads a secret that was saved with
+// savePassphraseEncrypted and decrypts it.
+func readPassphraseEncrypted(version byte, passphrase []byte, file string, logger Logger) ([]byte, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return decryptWithPassphrase(version, b, passphrase, logger)
+}
+
+// Encrypted streams are sequences of chunks. Each chunk is encrypted with the
+// stream's AEAD and a nonce derived from the stream context and the chunk
+// number. All chunks are full, except the last one.
+//
+// In version 1, chunks have no additional data. A stream that is truncated at
+// a chunk boundary can't be distinguished from a complete stream.
+//
+// In version 2, the additional data of each chunk is streamChunkAAD, which
+// marks the last chunk. The last chunk is always short, and it is empty when
+// the size of the stream is a multiple of the chunk size. So, a stream that
+// doesn't end with a final chunk was truncated.
+//
+// Version 2 streams can also have flushed chunks, written by Flush before the
+// stream is closed. They are short, and they are prefixed with the size of
+// their ciphertext (uint32), so that readers can find the next chunk.
+const (
+	streamVersion1 = 1
+	streamVersion2 = 2
+)
+
+// The kinds of chunks of version 2 streams.
+const (
+	chunkFull    = 0
+	chunkFinal   = 1
+	chunkFlushed = 2
+)
+
+// streamChunkAAD returns the additional data of a version 2 chunk.
+func streamChunkAAD(kind byte) []byte {
+	return []byte{streamVersion2, kind}
+}
+
+// sealStreamChunk encrypts a chunk of a version 2 stream, and appends it to
+// dst.
+func sealStreamChunk(dst []byte, aead cipher.AEAD, nonce, b []byte, kind byte) []byte {
+	if kind != chunkFlushed {
+		return aead.Seal(dst, nonce, b, streamChunkAAD(kind))
+	}
+	out := aead.Seal(append(dst, 0, 0, 0, 0), nonce, b, streamChunkAAD(kind))
+	binary.BigEndian.PutUint32(out[len(dst):], uint32(len(out)-len(dst)-4))
+	return out
+}
+
+// openStreamChunk decrypts a chunk into dst, which can be in[:0]. A short
+// chunk is the final chunk of the stream. version is the format of the
+// stream. When it is 0, it is detected from the chunk and updated.
+func openStreamChunk(aead cipher.AEAD, nonce, dst, in []byte, chunkSize int, version *byte) ([]byte, bool, error) {
+	final := len(in) < chunkSize+aead.Overhead()
+	kind := byte(chunkFull)
+	if final {
+		kind = chunkFinal
+	}
+	switch *version {
+	case streamVersion1:
+		dec, err := aead.Open(dst, nonce, in, nil)
+		return dec, false, err
+	case streamVersion2:
+		dec, err := aead.Open(dst, nonce, in, streamChunkAAD(kind))
+		return dec, final, err
+	}
+	// Open wipes its output when it fails, so the first attempt can't
+	// decrypt in place.
+	if dec, err := aead.Open(nil, nonce, in, streamChunkAAD(kind)); err == nil {
+		*version = streamVersion2
+		out := append(dst, dec...)
+		clear(dec)
+		return out, final, nil
+	}
+	dec, err := aead.Open(dst, nonce, in, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	*version = streamVersion1
+	return dec, false, nil
+}
+
+// openNextChunk decrypts the chunk at the start of in, in place. in contains
+// the next bytes of the stream, up to the size of a full chunk. It returns the
+// plaintext, the size of the chunk, and its kind. Flushed chunks are shorter
+// than in, unless they are at the end of the stream.
+func openNextChunk(aead cipher.AEAD, nonce, in []byte, chunkSize int, version *byte) ([]byte, int, byte, error) {
+	if *version != streamVersion1 && len(in) > 4 {
+		// The size prefix of other chunks is random, and it is rarely
+		// small enough to try it.
+		if size := int64(binary.BigEndian.Uint32(in)); size >= int64(aead.Overhead()) && size <= int64(len(in)-4) {
+			// Decrypt a copy to leave in intact if it isn't a
+			// flushed chunk.
+			if dec, err := aead.Open(nil, nonce, in[4:4+size], streamChunkAAD(chunkFlushed)); err == nil {
+				*version = streamVersion2
+				n := copy(in, dec)
+				clear(dec)
+				return in[:n], 4 + int(size), chunkFlushed, nil
+			}
+		}
+	}
+	dec, final, err := openStreamChunk(aead, nonce, in[:0], in, chunkSize, version)
+	if final {
+		return dec, len(in), chunkFinal, err
+	}
+	return dec, len(in), chunkFull, err
+}
+
+// errNotReaderAt is returned by ReadAt when the underlying stream doesn't
+// implement io.ReaderAt.
+var errNotReaderAt = errors.New("input doesn't implement io.ReaderAt")
+
+// readStreamAt implements io.ReaderAt for encrypted streams. The stream
+// starts at offset start in ra. Only the chunks that cover b are read and
+// decrypted. version is the format of the stream, shared by concurrent
+// calls. It is 0 until it is detected.
+func readStreamAt(ra io.ReaderAt, start int64, aead cipher.AEAD, chunkSize int, nonce func(int64) []byte, version *atomic.Uint32, logger Logger, b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fs.ErrInvalid
+	}
+	bufp := getChunkBuffer()
+	defer putChunkBuffer(bufp)
+	encChunkSize := chunkSize + aead.Overhead()
+	v := byte(version.Load())
+
+	var n int
+	var more bool
+	for n < len(b) {
+		pos := off + int64(n)
+		c := pos / int64(chunkSize)
+		in := (*bufp)[:encChunkSize]
+		nn, err := ra.ReadAt(in, start+c*int64(encChunkSize))
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if nn == 0 {
+			if more {
+				logger.Debugf("StreamReader.ReadAt: missing final chunk at %d", pos)
+				return n, ErrStreamTruncated
+			}
+			return n, io.EOF
+		}
+		if nn < aead.Overhead() {
+			logger.Debugf("StreamReader.ReadAt: short chunk %d", nn)
+			return n, ErrDecryptFailed
+		}
+		dec, final, err := openStreamChunk(aead, nonce(c+1), in[:0], in[:nn], chunkSize, &v)
+		if err != nil {
+			logger.Debug(err)
+			return n, ErrDecryptFailed
+		}
+		version.Store(uint32(v))
+		if chunkOff := int(pos % int64(chunkSize)); chunkOff < len(dec) {
+			n += copy(b[n:], dec[chunkOff:])
+		}
+		if nn < encChunkSize && n < len(b) {
+			return n, io.EOF
+		}
+		more = v == streamVersion2 && !final
+	}
+	return n, nil
+}
+
+// prepareAppend finds where new chunks can be appended to an encrypted
+// stream. It returns the number of complete chunks in the stream, and leaves
+// rw positioned at the end of the last complete chunk. The last complete chunk
+// is verified: it returns ErrDecryptFailed when it fails authentication.
+//
+// A partially written chunk at the end of the stream is truncated. Since it
+// may have reached the disk, or a copy of it, its nonce can't be used again
+// for different data, and the stream isn't appendable after the truncation.
+// Closed streams are not appendable, even when the final chunk is empty,
+// because the nonce of the final chunk would be used again for the next
+// chunk. Streams with flushed chunks are not appendable either. Version 1
+// streams are not appendable, to avoid mixing formats.
+func prepareAppend(rw TruncatableStream, aead cipher.AEAD, chunkSize int, nonce func(int64) []byte, logger Logger) (int64, error) {
+	start, err := rw.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	size, err := rw.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	encChunkSize := int64(chunkSize + aead.Overhead())
+	n := (size - start) / encChunkSize
+	rem := (size - start) % encChunkSize
+
+	bufp := getChunkBuffer()
+	defer putChunkBuffer(bufp)
+	read := func(off, size int64) ([]byte, error) {
+		buf := (*bufp)[:size]
+		if _, err := rw.Seek(off, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(rw, buf); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+	open := func(c, off, size int64, additionalData []byte) error {
+		buf, err := read(off, size)
+		if err != nil {
+			return err
+		}
+		if _, err := aead.Open(buf[:0], nonce(c), buf, additionalData); err != nil {
+			logger.Debug(err)
+			return ErrDecryptFailed
+		}
+		return nil
+	}
+	// flushed reports whether chunk c, at offset off, is a flushed chunk.
+	// The chunks that follow a flushed chunk aren't aligned, so the stream
+	// can't be appended to.
+	flushed := func(c, off int64) bool {
+		if size-off <= 4 {
+			return false
+		}
+		buf, err := read(off, 4)
+		if err != nil {
+			return false
+		}
+		s := int64(binary.BigEndian.Uint32(buf))
+		if s < int64(aead.Overhead()) || s > min(size-off-4, encChunkSize) {
+			return false
+		}
+		return open(c, off+4, s, streamChunkAAD(chunkFlushed)) == nil
+	}
+	if n > 0 {
+		if err := open(n, start+(n-1)*encChunkSize, encChunkSize, streamChunkAAD(chunkFull)); err != nil {
+			if open(n, start+(n-1)*encChunkSize, encChunkSize, nil) == nil {
+				return 0, ErrStreamNotAppendable
+			}
+			// Only flushed chunks move the chunks that follow them.
+			for c := int64(1); c <= n; c++ {
+				if flushed(c, start+(c-1)*encChunkSize) {
+					logger.Debugf("StartAppendWriter: flushed chunk %d", c)
+					return 0, ErrStreamNotAppendable
+				}
+			}
+			return 0, err
+		}
+	}
+	end := start + n*encChunkSize
+	if rem > 0 {
+		if rem >= int64(aead.Overhead()) && (open(n+1, end, rem, streamChunkAAD(chunkFinal)) == nil || open(n+1, end, rem, nil) == nil) {
+			return 0, ErrStreamNotAppendable
+		}
+		if flushed(n+1, end) {
+			logger.Debugf("StartAppendWriter: flushed chunk %d", n+1)
+			return 0, ErrStreamNotAppendable
+		}
+		logger.Debugf("StartAppendWriter: truncating partial chunk of %d bytes", rem)
+		if err := rw.Truncate(end); err != nil {
+			return 0, err
+		}
+		return 0, ErrStreamNotAppendable
+	}
+	if _, err := rw.Seek(end, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// chunkBufferSize is large enough to hold an encrypted chunk with any of the
+// supported algorithms.
+const chunkBufferSize = 1<<20 + 64
+
+// chunkPool contains the buffers used by the stream readers to read and
+// decrypt chunks.
+var chunkPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, chunkBufferSize)
+		return &b
+	},
+}
+
+func getChunkBuffer() *[]byte {
+	return chunkPool.Get().(*[]byte)
+}
+
+// putChunkBuffer wipes a buffer and returns it to the pool.
+func putChunkBuffer(b *[]byte) {
+	clear(*b)
+	chunkPool.Put(b)
+}
+
 func stack() string {
 	buf := make([]byte, 4096)
 	n := runtime.Stack(buf, false)
@@ -0,0 +1,680 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/c2FmZQ/tpm"
+	"github.com/google/go-tpm-tools/simulator"
+)
+
+func TestChangePassphrase(t *testing.T) {
+	rwc, err := simulator.Get()
+	if err != nil {
+		t.Fatalf("simulator.Get: %v", err)
+	}
+	tpm, err := tpm.New(tpm.WithTPM(rwc))
+	if err != nil {
+		t.Fatalf("tpm.New: %v", err)
+	}
+	defer tpm.Close()
+
+	for _, tc := range []struct {
+		name   string
+		create func() (MasterKey, error)
+		opts   []Option
+	}{
+		{"AES", func() (MasterKey, error) { return CreateAESMasterKey() }, nil},
+		{"AES+TPM", func() (MasterKey, error) { return CreateAESMasterKey(WithTPM(tpm)) }, []Option{WithTPM(tpm)}},
+		{"Chacha20Poly1305", func() (MasterKey, error) { return CreateChacha20Poly1305MasterKey() }, nil},
+		{"X25519", func() (MasterKey, error) { return CreateX25519MasterKey() }, nil},
+	} {
+		mk, err := tc.create()
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		defer mk.Wipe()
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			keyFile := filepath.Join(dir, "key")
+			if err := mk.Save([]byte("foo"), keyFile); err != nil {
+				t.Fatalf("mk.Save: %v", err)
+			}
+			if err := mk.ChangePassphrase([]byte("bar"), []byte("baz"), keyFile); err == nil {
+				t.Fatal("ChangePassphrase with wrong passphrase should have failed, but didn't")
+			}
+			if err := mk.ChangePassphrase([]byte("foo"), []byte("bar"), keyFile); err != nil {
+				t.Fatalf("ChangePassphrase: %v", err)
+			}
+			if _, err := ReadMasterKey([]byte("foo"), keyFile, tc.opts...); err == nil {
+				t.Error("ReadMasterKey with old passphrase should have failed, but didn't")
+			}
+			got, err := ReadMasterKey([]byte("bar"), keyFile, tc.opts...)
+			if err != nil {
+				t.Fatalf("ReadMasterKey with new passphrase: %v", err)
+			}
+			defer got.Wipe()
+			if KeyID(got) != KeyID(mk) {
+				t.Error("ReadMasterKey returned a different key")
+			}
+			if files, err := os.ReadDir(dir); err != nil || len(files) != 1 {
+				t.Errorf("ReadDir() = %v, %v, want only the key file", files, err)
+			}
+
+			other, err := tc.create()
+			if err != nil {
+				t.Fatalf("create: %v", err)
+			}
+			defer other.Wipe()
+			if err := other.ChangePassphrase([]byte("bar"), []byte("baz"), keyFile); err == nil {
+				t.Error("ChangePassphrase with other key should have failed, but didn't")
+			}
+		})
+	}
+}
+
+func TestKeyFileBackup(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	prevFile := keyFile + ".prev"
+
+	mk, err := CreateChacha20Poly1305MasterKey(WithKeyFileBackup(true))
+	if err != nil {
+		t.Fatalf("CreateChacha20Poly1305MasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	if err := mk.Save([]byte("foo"), keyFile); err != nil {
+		t.Fatalf("mk.Save: %v", err)
+	}
+	if _, err := os.Stat(prevFile); !os.IsNotExist(err) {
+		t.Fatalf("Stat(%q) = %v, want not exist", prevFile, err)
+	}
+	if err := mk.Save([]byte("foo"), keyFile); err != nil {
+		t.Fatalf("mk.Save: %v", err)
+	}
+	if files, err := os.ReadDir(dir); err != nil || len(files) != 2 {
+		t.Fatalf("ReadDir() = %v, %v, want key and key.prev", files, err)
+	}
+
+	for _, damage := range []func() error{
+		func() error { return os.Remove(keyFile) },
+		func() error { return os.WriteFile(keyFile, nil, 0600) },
+		func() error { return os.WriteFile(keyFile, []byte{0xff, 1, 2, 3}, 0600) },
+	} {
+		if err := damage(); err != nil {
+			t.Fatalf("damage: %v", err)
+		}
+		got, err := ReadMasterKey([]byte("foo"), keyFile)
+		if err != nil {
+			t.Fatalf("ReadMasterKey: %v", err)
+		}
+		if KeyID(got) != KeyID(mk) {
+			t.Error("ReadMasterKey returned a different key")
+		}
+		got.Wipe()
+	}
+
+	if err := mk.Save([]byte("foo"), keyFile); err != nil {
+		t.Fatalf("mk.Save: %v", err)
+	}
+	if err := mk.ChangePassphrase([]byte("foo"), []byte("bar"), keyFile); err != nil {
+		t.Fatalf("ChangePassphrase: %v", err)
+	}
+	if _, err := os.Stat(prevFile); !os.IsNotExist(err) {
+		t.Errorf("Stat(%q) after ChangePassphrase = %v, want not exist", prevFile, err)
+	}
+	if err := os.Remove(keyFile); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := ReadMasterKey([]byte("foo"), keyFile); !os.IsNotExist(err) {
+		t.Errorf("ReadMasterKey() = %v, want not exist", err)
+	}
+}
+
+func TestEncryptWithAAD(t *testing.T) {
+	rwc, err := simulator.Get()
+	if err != nil {
+		t.Fatalf("simulator.Get: %v", err)
+	}
+	defer rwc.Close()
+	tpm, err := tpm.New(tpm.WithTPM(rwc))
+	if err != nil {
+		t.Fatalf("tpm.New: %v", err)
+	}
+	defer tpm.Close()
+
+	for _, tc := range []struct {
+		name   string
+		create func() (EncryptionKey, error)
+	}{
+		{"AES", func() (EncryptionKey, error) { return CreateAESMasterKey() }},
+		{"AES+GCM-SIV", func() (EncryptionKey, error) { return CreateMasterKey(WithAlgo(AES256GCMSIV)) }},
+		{"AES+TPM", func() (EncryptionKey, error) { return CreateAESMasterKey(WithTPM(tpm)) }},
+		{"AES+TPM ECC", func() (EncryptionKey, error) { return CreateAESMasterKey(WithTPMECC(rwc)) }},
+		{"Chacha20Poly1305", func() (EncryptionKey, error) { return CreateChacha20Poly1305MasterKey() }},
+		{"X25519", func() (EncryptionKey, error) { return CreateX25519MasterKey() }},
+		{"X25519MLKEM768", func() (EncryptionKey, error) { return CreateX25519MLKEM768MasterKey() }},
+		{"MultiKey", func() (EncryptionKey, error) {
+			mk, err := CreateChacha20Poly1305MasterKey()
+			if err != nil {
+				return nil, err
+			}
+			return NewMultiKey(mk)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			k, err := tc.create()
+			if errors.Is(err, ErrMLKEMNotSupported) {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatalf("create: %v", err)
+			}
+			defer k.Wipe()
+			data := []byte("hello")
+			enc, err := k.EncryptWithAAD(data, []byte("record 1"))
+			if err != nil {
+				t.Fatalf("EncryptWithAAD: %v", err)
+			}
+			dec, err := k.DecryptWithAAD(enc, []byte("record 1"))
+			if err != nil {
+				t.Fatalf("DecryptWithAAD: %v", err)
+			}
+			if !bytes.Equal(dec, data) {
+				t.Errorf("DecryptWithAAD = %q, want %q", dec, data)
+			}
+			for _, aad := range [][]byte{nil, []byte("record 2")} {
+				if _, err := k.DecryptWithAAD(enc, aad); err == nil {
+					t.Errorf("DecryptWithAAD(%q) should have failed, but didn't", aad)
+				}
+			}
+			if _, err := k.Decrypt(enc); err == nil {
+				t.Error("Decrypt should have failed, but didn't")
+			}
+
+			// Encrypt is the same as EncryptWithAAD without additional
+			// data.
+			enc, err = k.Encrypt(data)
+			if err != nil {
+				t.Fatalf("Encrypt: %v", err)
+			}
+			if dec, err := k.DecryptWithAAD(enc, nil); err != nil || !bytes.Equal(dec, data) {
+				t.Errorf("DecryptWithAAD(nil) = %q, %v, want %q", dec, err, data)
+			}
+			if _, err := k.DecryptWithAAD(enc, []byte("record 1")); err == nil {
+				t.Error("DecryptWithAAD(record 1) should have failed, but didn't")
+			}
+		})
+	}
+}
+
+// testStreamTruncation verifies that streams written by mk detect truncation,
+// and that version 1 streams can still be read. aeadOf returns the AEAD of a
+// stream writer, and nonce returns the nonce of a chunk.
+func testStreamTruncation(t *testing.T, mk EncryptionKey, chunkSize int, aeadOf func(StreamWriter) cipher.AEAD, nonce func(ctx []byte, c int64) []byte) {
+	ctx := []byte{0x12, 0x12, 0x12, 0x12}
+	content := make([]byte, 2*chunkSize+100)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+	w, err := mk.StartWriter(ctx, io.Discard)
+	if err != nil {
+		t.Fatalf("StartWriter: %v", err)
+	}
+	aead := aeadOf(w)
+	encChunkSize := int64(chunkSize + aead.Overhead())
+
+	fn := filepath.Join(t.TempDir(), "stream")
+	write := func(content []byte) {
+		f, err := os.Create(fn)
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		w, err := mk.StartWriter(ctx, f)
+		if err != nil {
+			t.Fatalf("StartWriter: %v", err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+	read := func() ([]byte, error) {
+		f, err := os.Open(fn)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		r, err := mk.StartReader(ctx, f)
+		if err != nil {
+			t.Fatalf("StartReader: %v", err)
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+
+	for _, size := range []int{0, 100, chunkSize, 2*chunkSize + 100} {
+		write(content[:size])
+		got, err := read()
+		if err != nil {
+			t.Fatalf("[%d] ReadAll: %v", size, err)
+		}
+		if !bytes.Equal(got, content[:size]) {
+			t.Errorf("[%d] Read different content", size)
+		}
+		// Truncate the stream at each chunk boundary.
+		for n := int64(1); n*int64(chunkSize) <= int64(size); n++ {
+			if err := os.Truncate(fn, n*encChunkSize); err != nil {
+				t.Fatalf("Truncate: %v", err)
+			}
+			if _, err := read(); err != ErrStreamTruncated {
+				t.Errorf("[%d] ReadAll after truncation to %d chunks: err = %v, want %v", size, n, err, ErrStreamTruncated)
+			}
+		}
+	}
+
+	// A closed stream that ends with an empty final chunk isn't appendable.
+	write(content[:chunkSize])
+	f, err := os.OpenFile(fn, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, _, err := mk.StartAppendWriter(ctx, f); err != ErrStreamNotAppendable {
+		t.Errorf("StartAppendWriter(aligned) = %v, want ErrStreamNotAppendable", err)
+	}
+	f.Close()
+	if got, err := read(); err != nil || !bytes.Equal(got, content[:chunkSize]) {
+		t.Errorf("ReadAll(aligned): err = %v, same content = %v", err, bytes.Equal(got, content[:chunkSize]))
+	}
+
+	// Version 1 streams have no additional data.
+	f, err = os.Create(fn)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	for c, b := int64(1), content; len(b) > 0; c++ {
+		n := min(len(b), chunkSize)
+		if _, err := f.Write(aead.Seal(nil, nonce(ctx, c), b[:n], nil)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		b = b[n:]
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if _, _, err := mk.StartAppendWriter(ctx, f); err != ErrStreamNotAppendable {
+		t.Errorf("StartAppendWriter(v1) = %v, want ErrStreamNotAppendable", err)
+	}
+	f.Close()
+	if got, err := read(); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("ReadAll(v1): err = %v, same content = %v", err, bytes.Equal(got, content))
+	}
+}
+
+// testStreamReadAt verifies that the stream readers of mk implement
+// io.ReaderAt with concurrent calls. overhead is the size of the
+// authentication tag of each chunk.
+func testStreamReadAt(t *testing.T, mk EncryptionKey, chunkSize, overhead int) {
+	ctx := []byte{0x12, 0x12, 0x12, 0x12}
+	content := make([]byte, 3*chunkSize+123)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+	fn := filepath.Join(t.TempDir(), "stream")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	// The stream doesn't start at the beginning of the file.
+	if _, err := f.Write([]byte("header")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	w, err := mk.StartWriter(ctx, f)
+	if err != nil {
+		t.Fatalf("StartWriter: %v", err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if f, err = os.Open(fn); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := f.Seek(6, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	r, err := mk.StartReader(ctx, f)
+	if err != nil {
+		t.Fatalf("StartReader: %v", err)
+	}
+	defer r.Close()
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		t.Fatal("StreamReader doesn't implement io.ReaderAt")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				off := mrand.Intn(len(content))
+				size := mrand.Intn(2 * chunkSize)
+				b := make([]byte, size)
+				n, err := ra.ReadAt(b, int64(off))
+				want := min(size, len(content)-off)
+				if n != want {
+					t.Errorf("ReadAt(%d, %d) = %d, want %d", size, off, n, want)
+				}
+				if n < size && err != io.EOF {
+					t.Errorf("ReadAt(%d, %d): err = %v, want io.EOF", size, off, err)
+				}
+				if n == size && err != nil && err != io.EOF {
+					t.Errorf("ReadAt(%d, %d): err = %v", size, off, err)
+				}
+				if !bytes.Equal(b[:n], content[off:off+n]) {
+					t.Errorf("ReadAt(%d, %d) returned different content", size, off)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// ReadAt doesn't change the offset of Read.
+	b := make([]byte, 10)
+	if _, err := ra.ReadAt(b, 1000); err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bytes.Equal(b, content[:10]) {
+		t.Errorf("Read after ReadAt returned different content")
+	}
+	if n, err := ra.ReadAt(b, int64(len(content))); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt(end) = %d, %v, want 0, io.EOF", n, err)
+	}
+
+	// Truncation at a chunk boundary is detected.
+	if err := os.Truncate(fn, 6+int64(chunkSize+overhead)); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+	if _, err := ra.ReadAt(make([]byte, 100), int64(chunkSize)-50); err != ErrStreamTruncated {
+		t.Errorf("ReadAt after truncation: err = %v, want %v", err, ErrStreamTruncated)
+	}
+
+	r2, err := mk.StartReader(ctx, bytes.NewBuffer(nil))
+	if err != nil {
+		t.Fatalf("StartReader: %v", err)
+	}
+	if _, err := r2.(io.ReaderAt).ReadAt(b, 0); err != errNotReaderAt {
+		t.Errorf("ReadAt() = %v, want %v", err, errNotReaderAt)
+	}
+}
+
+// testStreamWorkers verifies that streams are the same when their chunks are
+// processed in parallel. setWorkers changes the number of workers of mk.
+func testStreamWorkers(t *testing.T, mk EncryptionKey, setWorkers func(int), chunkSize int) {
+	ctx := []byte{0x12, 0x12, 0x12, 0x12}
+	content := make([]byte, 10*chunkSize+123)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+	encrypt := func(workers int) []byte {
+		setWorkers(workers)
+		var buf bytes.Buffer
+		w, err := mk.StartWriter(ctx, &buf)
+		if err != nil {
+			t.Fatalf("StartWriter: %v", err)
+		}
+		for b := content; len(b) > 0; {
+			n := min(len(b), 1000+mrand.Intn(chunkSize))
+			if _, err := w.Write(b[:n]); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			b = b[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		return buf.Bytes()
+	}
+	enc := encrypt(1)
+	if !bytes.Equal(encrypt(4), enc) {
+		t.Fatal("Parallel writer returned different ciphertext")
+	}
+
+	setWorkers(4)
+	r, err := mk.StartReader(ctx, bytes.NewReader(enc))
+	if err != nil {
+		t.Fatalf("StartReader: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("Parallel reader returned different content")
+	}
+	for _, off := range []int{5*chunkSize + 10, 100, 9 * chunkSize, 3*chunkSize - 1} {
+		if _, err := r.Seek(int64(off), io.SeekStart); err != nil {
+			t.Fatalf("Seek: %v", err)
+		}
+		b := make([]byte, chunkSize+20)
+		n, err := io.ReadFull(r, b)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			t.Fatalf("ReadFull: %v", err)
+		}
+		if !bytes.Equal(b[:n], content[off:off+n]) {
+			t.Errorf("Read after Seek(%d) returned different content", off)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Truncation at a chunk boundary is detected.
+	overhead := (len(enc) - len(content)) / 11
+	encChunkSize := chunkSize + overhead
+	r, err = mk.StartReader(ctx, bytes.NewReader(enc[:5*encChunkSize]))
+	if err != nil {
+		t.Fatalf("StartReader: %v", err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); err != ErrStreamTruncated {
+		t.Errorf("ReadAll after truncation: err = %v, want %v", err, ErrStreamTruncated)
+	}
+}
+
+// testStreamFlush verifies that flushed data can be read before the stream is
+// closed. setWorkers changes the number of workers of mk.
+func testStreamFlush(t *testing.T, mk EncryptionKey, setWorkers func(int), chunkSize int) {
+	ctx := []byte{0x12, 0x12, 0x12, 0x12}
+	content := make([]byte, 5*chunkSize)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+	read := func(workers int, enc []byte) ([]byte, error) {
+		setWorkers(workers)
+		r, err := mk.StartReader(ctx, bytes.NewReader(enc))
+		if err != nil {
+			t.Fatalf("StartReader: %v", err)
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+	fn := filepath.Join(t.TempDir(), "stream")
+	appendTo := func(enc []byte) error {
+		if err := os.WriteFile(fn, enc, 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		f, err := os.OpenFile(fn, os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatalf("OpenFile: %v", err)
+		}
+		defer f.Close()
+		_, _, err = mk.StartAppendWriter(ctx, f)
+		if b, _ := os.ReadFile(fn); !bytes.Equal(b, enc) {
+			t.Errorf("StartAppendWriter modified the stream")
+		}
+		return err
+	}
+	sizes := []int{10, 0, 1000, chunkSize + 500, 2 * chunkSize, chunkSize - 2}
+	encrypt := func(workers int) []byte {
+		setWorkers(workers)
+		var buf bytes.Buffer
+		bw := bufio.NewWriter(&buf)
+		w, err := mk.StartWriter(ctx, bw)
+		if err != nil {
+			t.Fatalf("StartWriter: %v", err)
+		}
+		var off int
+		for _, size := range sizes {
+			if _, err := w.Write(content[off : off+size]); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			off += size
+			if err := w.(flusher).Flush(); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+			// The flushed data can be read, and the stream isn't
+			// closed yet.
+			got, err := read(1, buf.Bytes())
+			if err != ErrStreamTruncated {
+				t.Errorf("[%d] ReadAll: err = %v, want %v", off, err, ErrStreamTruncated)
+			}
+			if !bytes.Equal(got, content[:off]) {
+				t.Errorf("[%d] ReadAll returned %d bytes, want %d", off, len(got), off)
+			}
+			// The chunks after a flushed chunk aren't aligned.
+			if err := appendTo(buf.Bytes()); err != ErrStreamNotAppendable {
+				t.Errorf("[%d] StartAppendWriter: err = %v, want %v", off, err, ErrStreamNotAppendable)
+			}
+			setWorkers(workers)
+		}
+		if _, err := w.Write(content[off:]); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		if err := bw.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		return buf.Bytes()
+	}
+	enc := encrypt(1)
+	if !bytes.Equal(encrypt(4), enc) {
+		t.Fatal("Parallel writer returned different ciphertext")
+	}
+	for _, workers := range []int{1, 4} {
+		got, err := read(workers, enc)
+		if err != nil {
+			t.Fatalf("ReadAll(%d workers): %v", workers, err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("ReadAll(%d workers) returned different content", workers)
+		}
+	}
+}
+
+// testStreamCopy verifies that io.Copy works with the ReadFrom and WriteTo
+// methods of the streams of mk. setWorkers changes the number of workers of
+// mk.
+func testStreamCopy(t *testing.T, mk EncryptionKey, setWorkers func(int), chunkSize int) {
+	ctx := []byte{0x12, 0x12, 0x12, 0x12}
+	content := make([]byte, 3*chunkSize+77)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+	for _, workers := range []int{1, 4} {
+		setWorkers(workers)
+		var want bytes.Buffer
+		w, err := mk.StartWriter(ctx, &want)
+		if err != nil {
+			t.Fatalf("StartWriter: %v", err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+
+		var enc bytes.Buffer
+		if w, err = mk.StartWriter(ctx, &enc); err != nil {
+			t.Fatalf("StartWriter: %v", err)
+		}
+		if _, err := w.Write(content[:100]); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		// Hide the WriterTo method of bytes.Reader to use ReadFrom.
+		src := struct{ io.Reader }{bytes.NewReader(content[100:])}
+		if n, err := io.Copy(w, src); err != nil || n != int64(len(content)-100) {
+			t.Fatalf("io.Copy() = %d, %v, want %d, nil", n, err, len(content)-100)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		if !bytes.Equal(enc.Bytes(), want.Bytes()) {
+			t.Fatalf("[%d] ReadFrom returned different ciphertext", workers)
+		}
+
+		r, err := mk.StartReader(ctx, bytes.NewReader(enc.Bytes()))
+		if err != nil {
+			t.Fatalf("StartReader: %v", err)
+		}
+		b := make([]byte, 100)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		var got bytes.Buffer
+		got.Write(b)
+		if n, err := io.Copy(&got, r); err != nil || n != int64(len(content)-100) {
+			t.Fatalf("io.Copy() = %d, %v, want %d, nil", n, err, len(content)-100)
+		}
+		if !bytes.Equal(got.Bytes(), content) {
+			t.Errorf("[%d] WriteTo returned different content", workers)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+}
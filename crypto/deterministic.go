@@ -0,0 +1,89 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"crypto/cipher"
+)
+
+// The version byte of deterministic ciphertexts.
+const deterministicVersion = 17
+
+// EncryptDeterministic encrypts plaintext with a key that is derived from k
+// and context, so that the same key, context and plaintext always produce
+// the same ciphertext. It can be used for encrypted lookup keys, e.g. to
+// find a record by an encrypted email address.
+//
+// The ciphertexts only reveal which plaintexts are equal, and their
+// lengths. They are encrypted with AES-GCM-SIV, and a nonce that is derived
+// from k and context. Use a different context for each kind of value, so
+// that equal values of different kinds can't be linked.
+//
+// The key is derived with k.DeriveKey, so public keys can't be used, and a
+// Keyset uses its primary key.
+func EncryptDeterministic(k EncryptionKey, context, plaintext []byte) ([]byte, error) {
+	aead, nonce, err := deterministicAEAD(k, context)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrEncryptFailed
+	}
+	out := make([]byte, 1, 1+len(plaintext)+aead.Overhead())
+	out[0] = deterministicVersion
+	return aead.Seal(out, nonce, plaintext, nil), nil
+}
+
+// DecryptDeterministic decrypts a ciphertext that was encrypted with
+// EncryptDeterministic and the same key and context.
+func DecryptDeterministic(k EncryptionKey, context, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < 1+gcmSIVTagSize || ciphertext[0] != deterministicVersion {
+		return nil, ErrDecryptFailed
+	}
+	aead, nonce, err := deterministicAEAD(k, context)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	b, err := aead.Open(nil, nonce, ciphertext[1:], nil)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	return b, nil
+}
+
+// deterministicAEAD returns the AEAD and the nonce of context.
+func deterministicAEAD(k EncryptionKey, context []byte) (cipher.AEAD, []byte, error) {
+	dk, err := k.DeriveKey(append([]byte("c2FmZQ storage deterministic\x00"), context...))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer dk.Wipe()
+	key := dk.Hash([]byte("key"))
+	defer clear(key)
+	aead, err := newGCMSIV(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, dk.Hash([]byte("nonce"))[:gcmSIVNonceSize], nil
+}
@@ -0,0 +1,91 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDeterministic(t *testing.T) {
+	aesKey, err := CreateAESMasterKey()
+	if err != nil {
+		t.Fatalf("CreateAESMasterKey: %v", err)
+	}
+	defer aesKey.Wipe()
+	ccpKey, err := CreateChacha20Poly1305MasterKey()
+	if err != nil {
+		t.Fatalf("CreateChacha20Poly1305MasterKey: %v", err)
+	}
+	defer ccpKey.Wipe()
+
+	for _, mk := range []MasterKey{aesKey, ccpKey} {
+		email := []byte("alice@example.com")
+		enc1, err := EncryptDeterministic(mk, []byte("email"), email)
+		if err != nil {
+			t.Fatalf("EncryptDeterministic: %v", err)
+		}
+		enc2, err := EncryptDeterministic(mk, []byte("email"), email)
+		if err != nil {
+			t.Fatalf("EncryptDeterministic: %v", err)
+		}
+		if !bytes.Equal(enc1, enc2) {
+			t.Errorf("Ciphertexts of the same plaintext are different: %x != %x", enc1, enc2)
+		}
+		if enc3, _ := EncryptDeterministic(mk, []byte("name"), email); bytes.Equal(enc1, enc3) {
+			t.Error("Ciphertexts with different contexts are the same")
+		}
+		if enc4, _ := EncryptDeterministic(mk, []byte("email"), []byte("bob@example.com")); bytes.Equal(enc1, enc4) {
+			t.Error("Ciphertexts of different plaintexts are the same")
+		}
+
+		dec, err := DecryptDeterministic(mk, []byte("email"), enc1)
+		if err != nil {
+			t.Fatalf("DecryptDeterministic: %v", err)
+		}
+		if !bytes.Equal(dec, email) {
+			t.Errorf("DecryptDeterministic = %q, want %q", dec, email)
+		}
+		if _, err := DecryptDeterministic(mk, []byte("name"), enc1); err != ErrDecryptFailed {
+			t.Errorf("DecryptDeterministic(other context): err = %v, want %v", err, ErrDecryptFailed)
+		}
+		enc1[len(enc1)-1] ^= 1
+		if _, err := DecryptDeterministic(mk, []byte("email"), enc1); err != ErrDecryptFailed {
+			t.Errorf("DecryptDeterministic(tampered): err = %v, want %v", err, ErrDecryptFailed)
+		}
+	}
+
+	if _, err := EncryptDeterministic(aesKey, []byte("email"), nil); err != nil {
+		t.Errorf("EncryptDeterministic(empty): %v", err)
+	}
+
+	xk, err := CreateX25519MasterKey()
+	if err != nil {
+		t.Fatalf("CreateX25519MasterKey: %v", err)
+	}
+	defer xk.Wipe()
+	if _, err := EncryptDeterministic(xk.(*X25519Key).PublicKey(), []byte("email"), []byte("x")); err != ErrEncryptFailed {
+		t.Errorf("EncryptDeterministic(public key): err = %v, want %v", err, ErrEncryptFailed)
+	}
+}
@@ -0,0 +1,210 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"runtime"
+)
+
+// The version byte of Ed25519 signing key files.
+const ed25519Version = 5
+
+// SigningKey signs data. The signatures can be verified with its
+// VerifyingKey, by anyone who has it, without access to the SigningKey.
+type SigningKey interface {
+	// Logger returns the logger associated with this key.
+	Logger() Logger
+	// Sign returns the signature of data.
+	Sign(data []byte) ([]byte, error)
+	// VerifyingKey returns the key that verifies the signatures.
+	VerifyingKey() VerifyingKey
+	// Save encrypts the key with passphrase and saves it to file.
+	Save(passphrase []byte, file string) error
+	// Wipe zeros the key material.
+	Wipe()
+}
+
+// VerifyingKey verifies the signatures of a SigningKey.
+type VerifyingKey interface {
+	// Verify returns ErrInvalidSignature if sig isn't a valid signature
+	// of data.
+	Verify(data, sig []byte) error
+	// SignatureSize returns the size of the signatures.
+	SignatureSize() int
+	// Bytes returns the encoding of the key.
+	Bytes() []byte
+}
+
+// Ed25519VerifyingKey is an Ed25519 public key.
+type Ed25519VerifyingKey struct {
+	pub ed25519.PublicKey
+}
+
+// NewEd25519VerifyingKey returns the Ed25519 public key whose encoding is b,
+// as returned by Bytes.
+func NewEd25519VerifyingKey(b []byte) (*Ed25519VerifyingKey, error) {
+	if len(b) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid ed25519 public key size")
+	}
+	return &Ed25519VerifyingKey{pub: append(ed25519.PublicKey(nil), b...)}, nil
+}
+
+// Verify returns ErrInvalidSignature if sig isn't a valid signature of data.
+func (k *Ed25519VerifyingKey) Verify(data, sig []byte) error {
+	if !ed25519.Verify(k.pub, data, sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// SignatureSize returns the size of the signatures.
+func (k *Ed25519VerifyingKey) SignatureSize() int {
+	return ed25519.SignatureSize
+}
+
+// Bytes returns the encoding of the public key.
+func (k *Ed25519VerifyingKey) Bytes() []byte {
+	return append([]byte(nil), k.pub...)
+}
+
+// Ed25519SigningKey is an Ed25519 private key.
+type Ed25519SigningKey struct {
+	maskedSeed []byte
+	xor        func([]byte) []byte
+	pub        *Ed25519VerifyingKey
+
+	logger     Logger
+	strictWipe bool
+}
+
+// CreateEd25519SigningKey creates a new Ed25519 signing key.
+func CreateEd25519SigningKey(opts ...Option) (*Ed25519SigningKey, error) {
+	var opt option
+	opt.apply(opts)
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	return ed25519KeyFromSeed(seed, opt)
+}
+
+// ReadEd25519SigningKey reads an encrypted Ed25519 signing key from file and
+// decrypts it.
+func ReadEd25519SigningKey(passphrase []byte, file string, opts ...Option) (*Ed25519SigningKey, error) {
+	var opt option
+	opt.apply(opts)
+	seed, err := readPassphraseEncrypted(ed25519Version, passphrase, file, opt.logger)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		opt.logger.Debugf("ReadEd25519SigningKey: unexpected seed size %d", len(seed))
+		return nil, ErrDecryptFailed
+	}
+	return ed25519KeyFromSeed(seed, opt)
+}
+
+// ed25519KeyFromSeed returns an Ed25519SigningKey with the seed provided.
+// Internally, the seed is masked with a ephemeral key in memory.
+func ed25519KeyFromSeed(seed []byte, opt option) (*Ed25519SigningKey, error) {
+	defer clear(seed)
+	mask := make([]byte, len(seed))
+	if _, err := rand.Read(mask); err != nil {
+		return nil, err
+	}
+	xor := func(in []byte) []byte {
+		out := make([]byte, len(mask))
+		for i := range mask {
+			out[i] = in[i] ^ mask[i]
+		}
+		return out
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	defer clear(priv)
+	k := &Ed25519SigningKey{
+		maskedSeed: xor(seed),
+		xor:        xor,
+		pub:        &Ed25519VerifyingKey{pub: append(ed25519.PublicKey(nil), priv.Public().(ed25519.PublicKey)...)},
+		logger:     opt.logger,
+		strictWipe: opt.strictWipe,
+	}
+	k.setFinalizer()
+	return k, nil
+}
+
+func (k *Ed25519SigningKey) Logger() Logger {
+	return k.logger
+}
+
+// VerifyingKey returns the public key.
+func (k *Ed25519SigningKey) VerifyingKey() VerifyingKey {
+	return k.pub
+}
+
+// Sign returns the signature of data.
+func (k *Ed25519SigningKey) Sign(data []byte) ([]byte, error) {
+	if len(k.maskedSeed) == 0 {
+		k.Logger().Fatal("key is not set")
+	}
+	seed := k.xor(k.maskedSeed)
+	defer clear(seed)
+	priv := ed25519.NewKeyFromSeed(seed)
+	defer clear(priv)
+	return ed25519.Sign(priv, data), nil
+}
+
+// Save encrypts the signing key with passphrase and saves it to file.
+func (k *Ed25519SigningKey) Save(passphrase []byte, file string) error {
+	seed := k.xor(k.maskedSeed)
+	defer clear(seed)
+	return savePassphraseEncrypted(ed25519Version, seed, passphrase, kdfParams{}, file)
+}
+
+// Wipe zeros the key material.
+func (k *Ed25519SigningKey) Wipe() {
+	for i := range k.maskedSeed {
+		k.maskedSeed[i] = 0
+	}
+	runtime.SetFinalizer(k, nil)
+}
+
+func (k *Ed25519SigningKey) setFinalizer() {
+	stack := stack()
+	runtime.SetFinalizer(k, func(obj interface{}) {
+		key := obj.(*Ed25519SigningKey)
+		for i := range key.maskedSeed {
+			if key.maskedSeed[i] != 0 {
+				if key.strictWipe {
+					key.Logger().Fatalf("WIPEME: Ed25519SigningKey not wiped. Call stack: %s", stack)
+				}
+				key.Logger().Errorf("WIPEME: Ed25519SigningKey not wiped. Call stack: %s", stack)
+				key.Wipe()
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,95 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestEd25519SigningKey(t *testing.T) {
+	sk, err := CreateEd25519SigningKey()
+	if err != nil {
+		t.Fatalf("CreateEd25519SigningKey: %v", err)
+	}
+	defer sk.Wipe()
+
+	data := []byte("Hello world")
+	sig, err := sk.Sign(data)
+	if err != nil {
+		t.Fatalf("sk.Sign: %v", err)
+	}
+	if got, want := len(sig), sk.VerifyingKey().SignatureSize(); got != want {
+		t.Errorf("len(sig) = %d, want %d", got, want)
+	}
+	vk, err := NewEd25519VerifyingKey(sk.VerifyingKey().Bytes())
+	if err != nil {
+		t.Fatalf("NewEd25519VerifyingKey: %v", err)
+	}
+	if err := vk.Verify(data, sig); err != nil {
+		t.Errorf("vk.Verify: %v", err)
+	}
+	if err := vk.Verify([]byte("Hello World"), sig); err != ErrInvalidSignature {
+		t.Errorf("vk.Verify(other data) = %v, want %v", err, ErrInvalidSignature)
+	}
+	sig[0] ^= 1
+	if err := vk.Verify(data, sig); err != ErrInvalidSignature {
+		t.Errorf("vk.Verify(tampered sig) = %v, want %v", err, ErrInvalidSignature)
+	}
+	if _, err := NewEd25519VerifyingKey([]byte("foo")); err == nil {
+		t.Error("NewEd25519VerifyingKey('foo') should have failed, but didn't")
+	}
+}
+
+func TestEd25519SaveRead(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	sk, err := CreateEd25519SigningKey()
+	if err != nil {
+		t.Fatalf("CreateEd25519SigningKey: %v", err)
+	}
+	defer sk.Wipe()
+	if err := sk.Save([]byte("foo"), keyFile); err != nil {
+		t.Fatalf("sk.Save: %v", err)
+	}
+
+	got, err := ReadEd25519SigningKey([]byte("foo"), keyFile)
+	if err != nil {
+		t.Fatalf("ReadEd25519SigningKey('foo'): %v", err)
+	}
+	defer got.Wipe()
+	data := []byte("Hello world")
+	sig, err := got.Sign(data)
+	if err != nil {
+		t.Fatalf("got.Sign: %v", err)
+	}
+	if err := sk.VerifyingKey().Verify(data, sig); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	if _, err := ReadEd25519SigningKey([]byte("bar"), keyFile); err == nil {
+		t.Errorf("ReadEd25519SigningKey('bar') should have failed, but didn't")
+	}
+	if _, err := ReadMasterKey([]byte("foo"), keyFile); err == nil {
+		t.Errorf("ReadMasterKey should have failed, but didn't")
+	}
+}
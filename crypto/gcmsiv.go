@@ -0,0 +1,237 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	gcmSIVNonceSize = 12
+	gcmSIVTagSize   = 16
+)
+
+var errGCMSIVOpen = errors.New("gcmsiv: message authentication failed")
+
+// gcmSIV implements AEAD_AES_256_GCM_SIV from RFC 8452. Unlike AES-GCM, a
+// repeated nonce only reveals whether the same message was encrypted twice.
+// It is only used to encrypt small data, and favors simplicity over speed.
+type gcmSIV struct {
+	block cipher.Block
+}
+
+// newGCMSIV returns AES-256-GCM-SIV with the 32-byte key-generating key.
+func newGCMSIV(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, aes.KeySizeError(len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmSIV{block: block}, nil
+}
+
+func (g *gcmSIV) NonceSize() int {
+	return gcmSIVNonceSize
+}
+
+func (g *gcmSIV) Overhead() int {
+	return gcmSIVTagSize
+}
+
+// deriveKeys derives the message authentication key and the message
+// encryption key of nonce.
+func (g *gcmSIV) deriveKeys(nonce []byte) (authKey []byte, encBlock cipher.Block) {
+	var in, out [16]byte
+	keys := make([]byte, 48)
+	copy(in[4:], nonce)
+	for i := 0; i < 6; i++ {
+		binary.LittleEndian.PutUint32(in[:4], uint32(i))
+		g.block.Encrypt(out[:], in[:])
+		copy(keys[8*i:], out[:8])
+	}
+	defer clear(keys)
+	block, err := aes.NewCipher(keys[16:])
+	if err != nil {
+		panic(err)
+	}
+	return append([]byte(nil), keys[:16]...), block
+}
+
+// tag computes the tag of plaintext and additionalData.
+func (g *gcmSIV) tag(authKey []byte, encBlock cipher.Block, nonce, plaintext, additionalData []byte) [16]byte {
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(len(additionalData))*8)
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(plaintext))*8)
+	p := newPolyval(authKey)
+	p.update(additionalData)
+	p.update(plaintext)
+	p.update(lengths[:])
+	s := p.sum()
+	for i := range nonce {
+		s[i] ^= nonce[i]
+	}
+	s[15] &= 0x7f
+	var tag [16]byte
+	encBlock.Encrypt(tag[:], s[:])
+	return tag
+}
+
+// ctr encrypts or decrypts in with the counter mode of RFC 8452, where the
+// first 32 bits of the counter block are a little endian counter.
+func ctr(encBlock cipher.Block, tag [16]byte, out, in []byte) {
+	counter := tag
+	counter[15] |= 0x80
+	var ks [16]byte
+	for len(in) > 0 {
+		encBlock.Encrypt(ks[:], counter[:])
+		n := subtle.XORBytes(out, in, ks[:])
+		in, out = in[n:], out[n:]
+		binary.LittleEndian.PutUint32(counter[:4], binary.LittleEndian.Uint32(counter[:4])+1)
+	}
+}
+
+func (g *gcmSIV) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != gcmSIVNonceSize {
+		panic("gcmsiv: incorrect nonce length")
+	}
+	authKey, encBlock := g.deriveKeys(nonce)
+	defer clear(authKey)
+	tag := g.tag(authKey, encBlock, nonce, plaintext, additionalData)
+	ret, out := sliceForAppend(dst, len(plaintext)+gcmSIVTagSize)
+	ctr(encBlock, tag, out, plaintext)
+	copy(out[len(plaintext):], tag[:])
+	return ret
+}
+
+func (g *gcmSIV) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != gcmSIVNonceSize {
+		panic("gcmsiv: incorrect nonce length")
+	}
+	if len(ciphertext) < gcmSIVTagSize {
+		return nil, errGCMSIVOpen
+	}
+	authKey, encBlock := g.deriveKeys(nonce)
+	defer clear(authKey)
+	var tag [16]byte
+	copy(tag[:], ciphertext[len(ciphertext)-gcmSIVTagSize:])
+	ciphertext = ciphertext[:len(ciphertext)-gcmSIVTagSize]
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	ctr(encBlock, tag, out, ciphertext)
+	want := g.tag(authKey, encBlock, nonce, out, additionalData)
+	if subtle.ConstantTimeCompare(tag[:], want[:]) != 1 {
+		clear(out)
+		return nil, errGCMSIVOpen
+	}
+	return ret, nil
+}
+
+// sliceForAppend extends in by n bytes. It returns the whole slice, and the
+// extension.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
+
+// polyval computes POLYVAL with the GHASH multiplication, as described in
+// appendix A of RFC 8452: POLYVAL(H, X) is the byte reversal of
+// GHASH(mulX(ByteReverse(H)), ByteReverse(X)).
+type polyval struct {
+	h [2]uint64
+	y [2]uint64
+}
+
+func newPolyval(key []byte) *polyval {
+	var h [16]byte
+	copy(h[:], key)
+	return &polyval{h: ghashMulX(reversedBlock(h[:]))}
+}
+
+// reversedBlock returns the bytes of b in reverse order, as a big endian
+// GHASH element.
+func reversedBlock(b []byte) [2]uint64 {
+	var r [16]byte
+	for i := range r {
+		r[i] = b[15-i]
+	}
+	return [2]uint64{binary.BigEndian.Uint64(r[:8]), binary.BigEndian.Uint64(r[8:])}
+}
+
+// ghashMulX multiplies v by x in the GHASH field. It runs in constant time.
+func ghashMulX(v [2]uint64) [2]uint64 {
+	mask := -(v[1] & 1)
+	v[1] = v[1]>>1 | v[0]<<63
+	v[0] >>= 1
+	v[0] ^= 0xe1 << 56 & mask
+	return v
+}
+
+// ghashMul multiplies x and y in the GHASH field. It runs in constant time:
+// the bits of x select the terms with masks instead of branches.
+func ghashMul(x, y [2]uint64) [2]uint64 {
+	var z [2]uint64
+	v := y
+	for i := 0; i < 128; i++ {
+		mask := -(x[i/64] >> (63 - i%64) & 1)
+		z[0] ^= v[0] & mask
+		z[1] ^= v[1] & mask
+		v = ghashMulX(v)
+	}
+	return z
+}
+
+// update processes b, padded with zeros to a multiple of 16 bytes.
+func (p *polyval) update(b []byte) {
+	for len(b) > 0 {
+		var block [16]byte
+		n := copy(block[:], b)
+		b = b[n:]
+		x := reversedBlock(block[:])
+		p.y[0] ^= x[0]
+		p.y[1] ^= x[1]
+		p.y = ghashMul(p.y, p.h)
+	}
+}
+
+// sum returns POLYVAL of the processed blocks.
+func (p *polyval) sum() [16]byte {
+	var r, out [16]byte
+	binary.BigEndian.PutUint64(r[:8], p.y[0])
+	binary.BigEndian.PutUint64(r[8:], p.y[1])
+	for i := range out {
+		out[i] = r[15-i]
+	}
+	return out
+}
@@ -0,0 +1,189 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestGCMSIV(t *testing.T) {
+	// RFC 8452, Appendix C.2.
+	for _, tc := range []struct {
+		key, nonce, plaintext, aad, result string
+	}{
+		{
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "",
+			aad:       "",
+			result:    "07f5f4169bbf55a8400cd47ea6fd400f",
+		},
+		{
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "0100000000000000",
+			aad:       "",
+			result:    "c2ef328e5c71c83b843122130f7364b761e0b97427e3df28",
+		},
+		{
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "010000000000000000000000",
+			aad:       "",
+			result:    "9aab2aeb3faa0a34aea8e2b18ca50da9ae6559e48fd10f6e5c9ca17e",
+		},
+		{
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "01000000000000000000000000000000",
+			aad:       "",
+			result:    "85a01b63025ba19b7fd3ddfc033b3e76c9eac6fa700942702e90862383c6c366",
+		},
+		{
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "0100000000000000000000000000000002000000000000000000000000000000",
+			aad:       "",
+			result:    "4a6a9db4c8c6549201b9edb53006cba821ec9cf850948a7c86c68ac7539d027fe819e63abcd020b006a976397632eb5d",
+		},
+		{
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "010000000000000000000000000000000200000000000000000000000000000003000000000000000000000000000000",
+			aad:       "",
+			result:    "c00d121893a9fa603f48ccc1ca3c57ce7499245ea0046db16c53c7c66fe717e39cf6c748837b61f6ee3adcee17534ed5790bc96880a99ba804bd12c0e6a22cc4",
+		},
+		{
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "01000000000000000000000000000000020000000000000000000000000000000300000000000000000000000000000004000000000000000000000000000000",
+			aad:       "",
+			result:    "c2d5160a1f8683834910acdafc41fbb1632d4a353e8b905ec9a5499ac34f96c7e1049eb080883891a4db8caaa1f99dd004d80487540735234e3744512c6f90ce112864c269fc0d9d88c61fa47e39aa08",
+		},
+		{
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "0200000000000000",
+			aad:       "01",
+			result:    "1de22967237a813291213f267e3b452f02d01ae33e4ec854",
+		},
+		{
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "020000000000000000000000",
+			aad:       "01",
+			result:    "163d6f9cc1b346cd453a2e4cc1a4a19ae800941ccdc57cc8413c277f",
+		},
+		{
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "02000000000000000000000000000000",
+			aad:       "01",
+			result:    "c91545823cc24f17dbb0e9e807d5ec17b292d28ff61189e8e49f3875ef91aff7",
+		},
+		{
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "0200000000000000000000000000000003000000000000000000000000000000",
+			aad:       "01",
+			result:    "07dad364bfc2b9da89116d7bef6daaaf6f255510aa654f920ac81b94e8bad365aea1bad12702e1965604374aab96dbbc",
+		},
+		{
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "020000000000000000000000000000000300000000000000000000000000000004000000000000000000000000000000",
+			aad:       "01",
+			result:    "c67a1f0f567a5198aa1fcc8e3f21314336f7f51ca8b1af61feac35a86416fa47fbca3b5f749cdf564527f2314f42fe2503332742b228c647173616cfd44c54eb",
+		},
+		{
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "02000000000000000000000000000000030000000000000000000000000000000400000000000000000000000000000005000000000000000000000000000000",
+			aad:       "01",
+			result:    "67fd45e126bfb9a79930c43aad2d36967d3f0e4d217c1e551f59727870beefc98cb933a8fce9de887b1e40799988db1fc3f91880ed405b2dd298318858467c895bde0285037c5de81e5b570a049b62a0",
+		},
+		{
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "02000000",
+			aad:       "010000000000000000000000",
+			result:    "22b3f4cd1835e517741dfddccfa07fa4661b74cf",
+		},
+		{
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "0300000000000000000000000000000004000000",
+			aad:       "010000000000000000000000000000000200",
+			result:    "43dd0163cdb48f9fe3212bf61b201976067f342bb879ad976d8242acc188ab59cabfe307",
+		},
+		{
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "030000000000000000000000000000000400",
+			aad:       "0100000000000000000000000000000002000000",
+			result:    "462401724b5ce6588d5a54aae5375513a075cfcdf5042112aa29685c912fc2056543",
+		},
+		// RFC 8452, Appendix C.3: the 32-bit counter wraps around.
+		{
+			key:       "0000000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "000000000000000000000000",
+			plaintext: "000000000000000000000000000000004db923dc793ee6497c76dcc03a98e108",
+			aad:       "",
+			result:    "f3f80f2cf0cb2dd9c5984fcda908456cc537703b5ba70324a6793a7bf218d3eaffffffff000000000000000000000000",
+		},
+		{
+			key:       "0000000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "000000000000000000000000",
+			plaintext: "eb3640277c7ffd1303c7a542d02d3e4c0000000000000000",
+			aad:       "",
+			result:    "18ce4f0b8cb4d0cac65fea8f79257b20888e53e72299e56dffffffff000000000000000000000000",
+		},
+	} {
+		key, _ := hex.DecodeString(tc.key)
+		nonce, _ := hex.DecodeString(tc.nonce)
+		plaintext, _ := hex.DecodeString(tc.plaintext)
+		aad, _ := hex.DecodeString(tc.aad)
+		aead, err := newGCMSIV(key)
+		if err != nil {
+			t.Fatalf("newGCMSIV: %v", err)
+		}
+		ct := aead.Seal(nil, nonce, plaintext, aad)
+		if got := hex.EncodeToString(ct); got != tc.result {
+			t.Errorf("Seal(%s) = %s, want %s", tc.plaintext, got, tc.result)
+		}
+		pt, err := aead.Open(nil, nonce, ct, aad)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		if !bytes.Equal(pt, plaintext) {
+			t.Errorf("Open = %x, want %x", pt, plaintext)
+		}
+		ct[0] ^= 1
+		if _, err := aead.Open(nil, nonce, ct, aad); err == nil {
+			t.Error("Open(tampered) didn't fail")
+		}
+	}
+}
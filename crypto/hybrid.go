@@ -0,0 +1,46 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import "errors"
+
+const (
+	// The version byte of data sealed to an X25519MLKEM768 public key, and
+	// of X25519MLKEM768 master key files.
+	hybridVersion = 14
+	// The version byte of master key files that are wrapped with an
+	// X25519MLKEM768 public key.
+	hybridWrapVersion = 15
+)
+
+var (
+	// ErrWrappedKey indicates that a master key file is wrapped with an
+	// X25519MLKEM768 public key. It must be read with
+	// ReadWrappedMasterKey.
+	ErrWrappedKey = errors.New("master key is wrapped with a public key")
+	// ErrMLKEMNotSupported is returned by the X25519MLKEM768 functions
+	// when the package is built with a Go version older than go1.24, which
+	// added crypto/mlkem.
+	ErrMLKEMNotSupported = errors.New("X25519MLKEM768 keys require go1.24 or later")
+)
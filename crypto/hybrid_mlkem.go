@@ -0,0 +1,576 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build go1.24
+
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// The size of the encoding of X25519MLKEM768 public keys.
+	hybridPublicKeySize = 32 + mlkem.EncapsulationKeySize768
+	// The size of the raw X25519MLKEM768 private keys: the X25519 private
+	// key and the ML-KEM seed.
+	hybridPrivateKeySize = 32 + mlkem.SeedSize
+
+	// The overhead of data sealed to an X25519MLKEM768 public key.
+	hybridSealOverhead = 1 + 32 + mlkem.CiphertextSize768 + 24 + 16 // version, ephemeral public key, ML-KEM ciphertext, nonce, tag
+
+	// The size of an encrypted key.
+	hybridEncryptedKeySize = hybridSealOverhead + 64
+)
+
+var errHybridNotSupported = errors.New("operation not supported with X25519MLKEM768 key")
+
+// X25519MLKEM768PublicKey is a hybrid X25519 and ML-KEM-768 public key. It is
+// like X25519PublicKey, but the keys that it wraps stay secret as long as
+// either X25519 or ML-KEM-768 isn't broken. ML-KEM is designed to resist
+// quantum computers, so data that is stored today can't be decrypted later
+// with one.
+type X25519MLKEM768PublicKey struct {
+	pub    *ecdh.PublicKey
+	ek     *mlkem.EncapsulationKey768
+	logger Logger
+	// The number of goroutines that process the chunks of streams.
+	workers int
+}
+
+// NewX25519MLKEM768PublicKey returns the public key whose encoding is b, as
+// returned by Bytes.
+func NewX25519MLKEM768PublicKey(b []byte, opts ...Option) (*X25519MLKEM768PublicKey, error) {
+	var opt option
+	opt.apply(opts)
+	if len(b) != hybridPublicKeySize {
+		return nil, errors.New("invalid X25519MLKEM768 public key")
+	}
+	pub, err := ecdh.X25519().NewPublicKey(b[:32])
+	if err != nil {
+		return nil, err
+	}
+	ek, err := mlkem.NewEncapsulationKey768(b[32:])
+	if err != nil {
+		return nil, err
+	}
+	return &X25519MLKEM768PublicKey{pub: pub, ek: ek, logger: opt.logger, workers: opt.workers}, nil
+}
+
+// Bytes returns the encoding of the public key: the X25519 public key,
+// followed by the ML-KEM-768 encapsulation key.
+func (k *X25519MLKEM768PublicKey) Bytes() []byte {
+	return append(k.pub.Bytes(), k.ek.Bytes()...)
+}
+
+func (k *X25519MLKEM768PublicKey) Logger() Logger {
+	return k.logger
+}
+
+// Hash returns the HMAC-SHA256 hash of b, keyed with the public key.
+func (k *X25519MLKEM768PublicKey) Hash(b []byte) []byte {
+	hk := sha256.Sum256(append([]byte("c2FmZQ storage x25519mlkem768 hash\x00"), k.Bytes()...))
+	mac := hmac.New(sha256.New, hk[:])
+	mac.Write(b)
+	return mac.Sum(nil)
+}
+
+// hybridKey combines the X25519 and ML-KEM shared secrets into the key of
+// the sealed data. The X25519 public keys are bound like in x25519AEAD, and
+// the ML-KEM ciphertext is bound too, so that the key depends on the whole
+// exchange.
+func hybridKey(mlkemShared, x25519Shared, ephPub, mlkemCiphertext []byte, k *X25519MLKEM768PublicKey) ([]byte, error) {
+	ikm := append(append([]byte(nil), mlkemShared...), x25519Shared...)
+	defer clear(ikm)
+	salt := append(append(append([]byte(nil), ephPub...), k.pub.Bytes()...), mlkemCiphertext...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	r := hkdf.New(sha256.New, ikm, salt, []byte("c2FmZQ storage x25519mlkem768"))
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Encrypt encrypts data for the holder of the private key. The data is
+// encrypted with a key that is derived from the shared secret of a new
+// ephemeral X25519 key and the X25519 public key, and from a new ML-KEM-768
+// shared secret.
+func (k *X25519MLKEM768PublicKey) Encrypt(data []byte) ([]byte, error) {
+	return k.EncryptWithAAD(data, nil)
+}
+
+// EncryptWithAAD is like Encrypt, and it also authenticates additionalData.
+func (k *X25519MLKEM768PublicKey) EncryptWithAAD(data, additionalData []byte) ([]byte, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrEncryptFailed
+	}
+	x25519Shared, err := eph.ECDH(k.pub)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrEncryptFailed
+	}
+	defer clear(x25519Shared)
+	mlkemShared, ct := k.ek.Encapsulate()
+	defer clear(mlkemShared)
+	ephPub := eph.PublicKey().Bytes()
+	key, err := hybridKey(mlkemShared, x25519Shared, ephPub, ct, k)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrEncryptFailed
+	}
+	defer clear(key)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrEncryptFailed
+	}
+	out := make([]byte, 0, hybridSealOverhead+len(data))
+	out = append(out, hybridVersion)
+	out = append(out, ephPub...)
+	out = append(out, ct...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrEncryptFailed
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, additionalData), nil
+}
+
+// Decrypt always fails. Only the private key can decrypt.
+func (k *X25519MLKEM768PublicKey) Decrypt(data []byte) ([]byte, error) {
+	return k.DecryptWithAAD(data, nil)
+}
+
+// DecryptWithAAD always fails. Only the private key can decrypt.
+func (k *X25519MLKEM768PublicKey) DecryptWithAAD(data, additionalData []byte) ([]byte, error) {
+	k.Logger().Debug("Decrypt: X25519MLKEM768 public key can't decrypt")
+	return nil, ErrDecryptFailed
+}
+
+// NewKey creates a new encryption key. The key is encrypted with the public
+// key, so that only the holder of the private key can decrypt it later.
+func (k *X25519MLKEM768PublicKey) NewKey() (EncryptionKey, error) {
+	b := make([]byte, 64)
+	if _, err := rand.Read(b); err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrEncryptFailed
+	}
+	enc, err := k.Encrypt(b)
+	if err != nil {
+		return nil, err
+	}
+	ek := chacha20poly1305KeyFromBytes(b)
+	ek.encryptedKey = tagEncryptedKey(k, enc)
+	ek.logger = k.logger
+	ek.workers = k.workers
+	return wrappedFileKey{ek}, nil
+}
+
+// DeriveKey isn't supported with a public key.
+func (k *X25519MLKEM768PublicKey) DeriveKey(info []byte) (EncryptionKey, error) {
+	return nil, errHybridNotSupported
+}
+
+// DecryptKey always fails. Only the private key can decrypt.
+func (k *X25519MLKEM768PublicKey) DecryptKey(encryptedKey []byte) (EncryptionKey, error) {
+	return nil, ErrDecryptFailed
+}
+
+// ReadEncryptedKey always fails. Only the private key can decrypt.
+func (k *X25519MLKEM768PublicKey) ReadEncryptedKey(r io.Reader) (EncryptionKey, error) {
+	return nil, ErrDecryptFailed
+}
+
+// WriteEncryptedKey isn't supported with X25519MLKEM768 keys.
+func (k *X25519MLKEM768PublicKey) WriteEncryptedKey(w io.Writer) error {
+	return errHybridNotSupported
+}
+
+// StartReader isn't supported with X25519MLKEM768 keys. Streams are
+// encrypted with the keys returned by NewKey.
+func (k *X25519MLKEM768PublicKey) StartReader(ctx []byte, r io.Reader) (StreamReader, error) {
+	return nil, errHybridNotSupported
+}
+
+// StartWriter isn't supported with X25519MLKEM768 keys. Streams are
+// encrypted with the keys returned by NewKey.
+func (k *X25519MLKEM768PublicKey) StartWriter(ctx []byte, w io.Writer) (StreamWriter, error) {
+	return nil, errHybridNotSupported
+}
+
+// StartAppendWriter isn't supported with X25519MLKEM768 keys.
+func (k *X25519MLKEM768PublicKey) StartAppendWriter(ctx []byte, rw TruncatableStream) (StreamWriter, int64, error) {
+	return nil, 0, errHybridNotSupported
+}
+
+// Wipe does nothing. A public key isn't secret.
+func (k *X25519MLKEM768PublicKey) Wipe() {
+}
+
+// X25519MLKEM768Key is a hybrid X25519 and ML-KEM-768 private key. It can do
+// everything that its public key can do, and it can also decrypt. It is a
+// MasterKey.
+type X25519MLKEM768Key struct {
+	*X25519MLKEM768PublicKey
+	maskedKey []byte
+	xor       func([]byte) []byte
+
+	logger     Logger
+	strictWipe bool
+	// The KDF parameters used by Save.
+	kdf kdfParams
+	// Whether Save keeps a copy of the file that it replaces.
+	backup bool
+}
+
+// CreateX25519MLKEM768MasterKey creates a new X25519MLKEM768 private key.
+func CreateX25519MLKEM768MasterKey(opts ...Option) (MasterKey, error) {
+	var opt option
+	opt.apply(opts)
+	if opt.hasTPM() {
+		return nil, errors.New("tpm key not implemented with x25519mlkem768")
+	}
+	kdf, err := opt.argon2Params(kdfParams{})
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, hybridPrivateKeySize)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	k, err := hybridKeyFromBytes(b, opt)
+	if err != nil {
+		return nil, err
+	}
+	k.kdf = kdf
+	return k, nil
+}
+
+// ReadX25519MLKEM768MasterKey reads an encrypted X25519MLKEM768 private key
+// from file and decrypts it.
+func ReadX25519MLKEM768MasterKey(passphrase []byte, file string, opts ...Option) (MasterKey, error) {
+	var opt option
+	opt.apply(opts)
+	if opt.hasTPM() {
+		opt.logger.Error("ReadMasterKey: TPM option selected but master key was created without TPM")
+		return nil, ErrDecryptFailed
+	}
+	enc, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	kdf, err := opt.argon2Params(passphraseKDFParams(enc))
+	if err != nil {
+		return nil, err
+	}
+	b, err := decryptWithPassphrase(hybridVersion, enc, passphrase, opt.logger)
+	if err != nil {
+		return nil, err
+	}
+	k, err := hybridKeyFromBytes(b, opt)
+	if err != nil {
+		return nil, err
+	}
+	k.kdf = kdf
+	return k, nil
+}
+
+// hybridKeyFromBytes returns an X25519MLKEM768Key with the raw private key
+// provided. Internally, the key is masked with a ephemeral key in memory.
+func hybridKeyFromBytes(b []byte, opt option) (*X25519MLKEM768Key, error) {
+	defer clear(b)
+	if len(b) != hybridPrivateKeySize {
+		return nil, ErrDecryptFailed
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(b[:32])
+	if err != nil {
+		opt.logger.Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	dk, err := mlkem.NewDecapsulationKey768(b[32:])
+	if err != nil {
+		opt.logger.Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	mask := make([]byte, len(b))
+	if _, err := rand.Read(mask); err != nil {
+		return nil, err
+	}
+	xor := func(in []byte) []byte {
+		out := make([]byte, len(mask))
+		for i := range mask {
+			out[i] = in[i] ^ mask[i]
+		}
+		return out
+	}
+	k := &X25519MLKEM768Key{
+		X25519MLKEM768PublicKey: &X25519MLKEM768PublicKey{
+			pub:     priv.PublicKey(),
+			ek:      dk.EncapsulationKey(),
+			logger:  opt.logger,
+			workers: opt.workers,
+		},
+		maskedKey:  xor(b),
+		xor:        xor,
+		logger:     opt.logger,
+		strictWipe: opt.strictWipe,
+		backup:     opt.backup,
+	}
+	k.setFinalizer()
+	return k, nil
+}
+
+func (k *X25519MLKEM768Key) Logger() Logger {
+	return k.logger
+}
+
+// PublicKey returns the public key.
+func (k *X25519MLKEM768Key) PublicKey() *X25519MLKEM768PublicKey {
+	return k.X25519MLKEM768PublicKey
+}
+
+// Wipe zeros the key material.
+func (k *X25519MLKEM768Key) Wipe() {
+	for i := range k.maskedKey {
+		k.maskedKey[i] = 0
+	}
+	runtime.SetFinalizer(k, nil)
+}
+
+func (k *X25519MLKEM768Key) setFinalizer() {
+	stack := stack()
+	runtime.SetFinalizer(k, func(obj interface{}) {
+		key := obj.(*X25519MLKEM768Key)
+		for i := range key.maskedKey {
+			if key.maskedKey[i] != 0 {
+				if key.strictWipe {
+					key.Logger().Fatalf("WIPEME: X25519MLKEM768Key not wiped. Call stack: %s", stack)
+				}
+				key.Logger().Errorf("WIPEME: X25519MLKEM768Key not wiped. Call stack: %s", stack)
+				key.Wipe()
+				return
+			}
+		}
+	})
+}
+
+func (k *X25519MLKEM768Key) key() []byte {
+	return k.xor(k.maskedKey)
+}
+
+// ChangePassphrase checks that file contains the private key encrypted with
+// oldPassphrase, and atomically replaces it with the private key encrypted
+// with newPassphrase.
+func (k *X25519MLKEM768Key) ChangePassphrase(oldPassphrase, newPassphrase []byte, file string) error {
+	return changePassphrase(k, oldPassphrase, func() (MasterKey, error) {
+		return ReadX25519MLKEM768MasterKey(oldPassphrase, file, WithLogger(k.logger))
+	}, newPassphrase, file)
+}
+
+// ExportMnemonic returns a recovery phrase that encodes the private key.
+func (k *X25519MLKEM768Key) ExportMnemonic() (string, error) {
+	return exportMnemonic(k)
+}
+
+// Save encrypts the private key with passphrase and saves it to file.
+func (k *X25519MLKEM768Key) Save(passphrase []byte, file string) error {
+	priv := k.key()
+	defer clear(priv)
+	data, err := encryptWithPassphrase(hybridVersion, priv, passphrase, k.kdf)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(file, data, k.backup)
+}
+
+// Decrypt decrypts data that was encrypted with Encrypt and the public key.
+func (k *X25519MLKEM768Key) Decrypt(data []byte) ([]byte, error) {
+	return k.DecryptWithAAD(data, nil)
+}
+
+// DecryptWithAAD decrypts data that was encrypted with EncryptWithAAD, the
+// public key, and the same additional data.
+func (k *X25519MLKEM768Key) DecryptWithAAD(data, additionalData []byte) ([]byte, error) {
+	if len(k.maskedKey) == 0 {
+		k.Logger().Fatal("key is not set")
+	}
+	if len(data) < hybridSealOverhead || data[0] != hybridVersion {
+		return nil, ErrDecryptFailed
+	}
+	ephPub, data := data[1:33], data[33:]
+	ct, data := data[:mlkem.CiphertextSize768], data[mlkem.CiphertextSize768:]
+	priv := k.key()
+	defer clear(priv)
+	pk, err := ecdh.X25519().NewPrivateKey(priv[:32])
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	dk, err := mlkem.NewDecapsulationKey768(priv[32:])
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	eph, err := ecdh.X25519().NewPublicKey(ephPub)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	x25519Shared, err := pk.ECDH(eph)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	defer clear(x25519Shared)
+	mlkemShared, err := dk.Decapsulate(ct)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	defer clear(mlkemShared)
+	key, err := hybridKey(mlkemShared, x25519Shared, ephPub, ct, k.X25519MLKEM768PublicKey)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	defer clear(key)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	nonce := data[:aead.NonceSize()]
+	b, err := aead.Open(nil, nonce, data[aead.NonceSize():], additionalData)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	return b, nil
+}
+
+// DeriveKey derives a new encryption key from the private key and info.
+func (k *X25519MLKEM768Key) DeriveKey(info []byte) (EncryptionKey, error) {
+	priv := k.key()
+	defer clear(priv)
+	b, err := deriveKeyBytes(priv, info)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrEncryptFailed
+	}
+	ek := chacha20poly1305KeyFromBytes(b)
+	ek.logger = k.logger
+	ek.workers = k.workers
+	return ek, nil
+}
+
+// DecryptKey decrypts an encrypted key that was created by NewKey.
+func (k *X25519MLKEM768Key) DecryptKey(encryptedKey []byte) (EncryptionKey, error) {
+	enc, err := untagEncryptedKey(k, encryptedKey)
+	if err != nil {
+		k.Logger().Debug("DecryptKey: key ID mismatch")
+		return nil, err
+	}
+	if len(enc) != hybridEncryptedKeySize {
+		k.Logger().Debugf("DecryptKey: unexpected encrypted key size %d != %d", len(enc), hybridEncryptedKeySize)
+		return nil, ErrDecryptFailed
+	}
+	b, err := k.Decrypt(enc)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 64 {
+		k.Logger().Debugf("DecryptKey: unexpected decrypted key size %d != %d", len(b), 64)
+		return nil, ErrDecryptFailed
+	}
+	ek := chacha20poly1305KeyFromBytes(b)
+	ek.encryptedKey = append([]byte(nil), encryptedKey...)
+	ek.logger = k.logger
+	ek.workers = k.workers
+	return wrappedFileKey{ek}, nil
+}
+
+// ReadEncryptedKey reads an encrypted key and decrypts it.
+func (k *X25519MLKEM768Key) ReadEncryptedKey(r io.Reader) (EncryptionKey, error) {
+	buf, err := readEncryptedKeyBytes(r, hybridEncryptedKeySize)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	return k.DecryptKey(buf)
+}
+
+// SaveWrapped wraps mk with the X25519MLKEM768 public key pub and saves it to
+// file, instead of encrypting it with a passphrase. The file can only be read
+// with ReadWrappedMasterKey and the private key, e.g. one that is kept
+// offline for recovery. TPM keys can't be wrapped.
+func SaveWrapped(mk MasterKey, pub *X25519MLKEM768PublicKey, file string) error {
+	version, key, err := masterKeyBytes(mk)
+	if err != nil {
+		return err
+	}
+	defer clear(key)
+	b := append([]byte{version}, key...)
+	defer clear(b)
+	enc, err := pub.Encrypt(b)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(file, append([]byte{hybridWrapVersion}, enc...), false)
+}
+
+// ReadWrappedMasterKey reads a master key file that was saved with
+// SaveWrapped, and unwraps it with priv.
+func ReadWrappedMasterKey(priv *X25519MLKEM768Key, file string, opts ...Option) (MasterKey, error) {
+	var opt option
+	opt.apply(opts)
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 || b[0] != hybridWrapVersion {
+		return nil, ErrUnexpectedAlgo
+	}
+	key, err := priv.Decrypt(b[1:])
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	if len(key) == 0 {
+		return nil, ErrDecryptFailed
+	}
+	return masterKeyFromBytes(key[0], key[1:], opt)
+}
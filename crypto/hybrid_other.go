@@ -0,0 +1,80 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !go1.24
+
+package crypto
+
+// The size of the raw X25519MLKEM768 private keys: the X25519 private key and
+// the ML-KEM seed.
+const hybridPrivateKeySize = 32 + 64
+
+// X25519MLKEM768PublicKey is a hybrid X25519 and ML-KEM-768 public key. It
+// requires go1.24 or later.
+type X25519MLKEM768PublicKey struct {
+	EncryptionKey
+}
+
+// X25519MLKEM768Key is a hybrid X25519 and ML-KEM-768 private key. It
+// requires go1.24 or later.
+type X25519MLKEM768Key struct {
+	MasterKey
+}
+
+// NewX25519MLKEM768PublicKey returns ErrMLKEMNotSupported.
+func NewX25519MLKEM768PublicKey([]byte, ...Option) (*X25519MLKEM768PublicKey, error) {
+	return nil, ErrMLKEMNotSupported
+}
+
+// CreateX25519MLKEM768MasterKey returns ErrMLKEMNotSupported.
+func CreateX25519MLKEM768MasterKey(...Option) (MasterKey, error) {
+	return nil, ErrMLKEMNotSupported
+}
+
+// ReadX25519MLKEM768MasterKey returns ErrMLKEMNotSupported.
+func ReadX25519MLKEM768MasterKey([]byte, string, ...Option) (MasterKey, error) {
+	return nil, ErrMLKEMNotSupported
+}
+
+func hybridKeyFromBytes([]byte, option) (*X25519MLKEM768Key, error) {
+	return nil, ErrMLKEMNotSupported
+}
+
+// PublicKey returns nil.
+func (k *X25519MLKEM768Key) PublicKey() *X25519MLKEM768PublicKey {
+	return nil
+}
+
+func (k *X25519MLKEM768Key) key() []byte {
+	return nil
+}
+
+// SaveWrapped returns ErrMLKEMNotSupported.
+func SaveWrapped(MasterKey, *X25519MLKEM768PublicKey, string) error {
+	return ErrMLKEMNotSupported
+}
+
+// ReadWrappedMasterKey returns ErrMLKEMNotSupported.
+func ReadWrappedMasterKey(*X25519MLKEM768Key, string, ...Option) (MasterKey, error) {
+	return nil, ErrMLKEMNotSupported
+}
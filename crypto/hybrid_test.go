@@ -0,0 +1,209 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build go1.24
+
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestX25519MLKEM768MasterKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	mk, err := CreateX25519MLKEM768MasterKey()
+	if err != nil {
+		t.Fatalf("CreateX25519MLKEM768MasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	if err := mk.Save([]byte("foo"), keyFile); err != nil {
+		t.Fatalf("mk.Save: %v", err)
+	}
+
+	got, err := ReadMasterKey([]byte("foo"), keyFile)
+	if err != nil {
+		t.Fatalf("ReadMasterKey('foo'): %v", err)
+	}
+	defer got.Wipe()
+	if want, got := mk.(*X25519MLKEM768Key).key(), got.(*X25519MLKEM768Key).key(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Mismatch keys: %v != %v", want, got)
+	}
+	if want, got := mk.(*X25519MLKEM768Key).PublicKey().Bytes(), got.(*X25519MLKEM768Key).PublicKey().Bytes(); !bytes.Equal(want, got) {
+		t.Errorf("Mismatch public keys: %x != %x", want, got)
+	}
+	if _, err := ReadMasterKey([]byte("bar"), keyFile); err == nil {
+		t.Errorf("ReadMasterKey('bar') should have failed, but didn't")
+	}
+
+	phrase, err := mk.ExportMnemonic()
+	if err != nil {
+		t.Fatalf("ExportMnemonic: %v", err)
+	}
+	mk2, err := CreateMasterKeyFromMnemonic(phrase)
+	if err != nil {
+		t.Fatalf("CreateMasterKeyFromMnemonic: %v", err)
+	}
+	defer mk2.Wipe()
+	if KeyID(mk) != KeyID(mk2) {
+		t.Error("CreateMasterKeyFromMnemonic returned a different key")
+	}
+}
+
+func TestX25519MLKEM768EncryptDecrypt(t *testing.T) {
+	mk, err := CreateX25519MLKEM768MasterKey()
+	if err != nil {
+		t.Fatalf("CreateX25519MLKEM768MasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	pub, err := NewX25519MLKEM768PublicKey(mk.(*X25519MLKEM768Key).PublicKey().Bytes())
+	if err != nil {
+		t.Fatalf("NewX25519MLKEM768PublicKey: %v", err)
+	}
+
+	m := []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	for i := 0; i < len(m); i++ {
+		enc, err := pub.Encrypt(m[:i])
+		if err != nil {
+			t.Fatalf("pub.Encrypt: %v", err)
+		}
+		if enc[0] != hybridVersion {
+			t.Errorf("Version = %d, want %d", enc[0], hybridVersion)
+		}
+		if _, err := pub.Decrypt(enc); err != ErrDecryptFailed {
+			t.Errorf("pub.Decrypt: err = %v, want %v", err, ErrDecryptFailed)
+		}
+		dec, err := mk.Decrypt(enc)
+		if err != nil {
+			t.Fatalf("mk.Decrypt: %v", err)
+		}
+		if !bytes.Equal(m[:i], dec) {
+			t.Errorf("Decrypted data[%d] doesn't match. Want %#v, got %#v", i, m[:i], dec)
+		}
+		// Tampering with either key exchange fails.
+		for _, off := range []int{1, 33, len(enc) - 1} {
+			enc[off] ^= 1
+			if _, err := mk.Decrypt(enc); err != ErrDecryptFailed {
+				t.Errorf("mk.Decrypt(tampered at %d): err = %v, want %v", off, err, ErrDecryptFailed)
+			}
+			enc[off] ^= 1
+		}
+	}
+
+	other, err := CreateX25519MLKEM768MasterKey()
+	if err != nil {
+		t.Fatalf("CreateX25519MLKEM768MasterKey: %v", err)
+	}
+	defer other.Wipe()
+	enc, err := pub.Encrypt(m)
+	if err != nil {
+		t.Fatalf("pub.Encrypt: %v", err)
+	}
+	if _, err := other.Decrypt(enc); err != ErrDecryptFailed {
+		t.Errorf("other.Decrypt: err = %v, want %v", err, ErrDecryptFailed)
+	}
+	if want, got := mk.Hash(m), pub.Hash(m); !bytes.Equal(want, got) {
+		t.Errorf("Hash mismatch: %x != %x", want, got)
+	}
+}
+
+func TestX25519MLKEM768EncryptedKey(t *testing.T) {
+	mk, err := CreateX25519MLKEM768MasterKey()
+	if err != nil {
+		t.Fatalf("CreateX25519MLKEM768MasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	pub := mk.(*X25519MLKEM768Key).PublicKey()
+
+	ek, err := pub.NewKey()
+	if err != nil {
+		t.Fatalf("pub.NewKey: %v", err)
+	}
+	defer ek.Wipe()
+
+	var buf bytes.Buffer
+	if err := ek.WriteEncryptedKey(&buf); err != nil {
+		t.Fatalf("ek.WriteEncryptedKey: %v", err)
+	}
+	if buf.Len() != 1+keyIDSize+hybridEncryptedKeySize {
+		t.Errorf("Encrypted key size = %d, want %d", buf.Len(), 1+keyIDSize+hybridEncryptedKeySize)
+	}
+	if _, err := pub.ReadEncryptedKey(bytes.NewReader(buf.Bytes())); err != ErrDecryptFailed {
+		t.Errorf("pub.ReadEncryptedKey: err = %v, want %v", err, ErrDecryptFailed)
+	}
+
+	ek2, err := mk.ReadEncryptedKey(&buf)
+	if err != nil {
+		t.Fatalf("mk.ReadEncryptedKey: %v", err)
+	}
+	defer ek2.Wipe()
+	if want, got := ek.(wrappedFileKey).key(), ek2.(wrappedFileKey).key(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Unexpected key. Want %+v, got %+v", want, got)
+	}
+	if _, err := pub.DeriveKey([]byte("foo")); err == nil {
+		t.Error("pub.DeriveKey should have failed, but didn't")
+	}
+}
+
+func TestSaveWrapped(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	wrapper, err := CreateX25519MLKEM768MasterKey()
+	if err != nil {
+		t.Fatalf("CreateX25519MLKEM768MasterKey: %v", err)
+	}
+	defer wrapper.Wipe()
+	priv := wrapper.(*X25519MLKEM768Key)
+
+	mk, err := CreateAESMasterKey()
+	if err != nil {
+		t.Fatalf("CreateAESMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	if err := SaveWrapped(mk, priv.PublicKey(), keyFile); err != nil {
+		t.Fatalf("SaveWrapped: %v", err)
+	}
+	if _, err := ReadMasterKey([]byte("foo"), keyFile); !errors.Is(err, ErrWrappedKey) {
+		t.Errorf("ReadMasterKey: err = %v, want %v", err, ErrWrappedKey)
+	}
+	got, err := ReadWrappedMasterKey(priv, keyFile)
+	if err != nil {
+		t.Fatalf("ReadWrappedMasterKey: %v", err)
+	}
+	defer got.Wipe()
+	if KeyID(got) != KeyID(mk) {
+		t.Error("ReadWrappedMasterKey returned a different key")
+	}
+
+	other, err := CreateX25519MLKEM768MasterKey()
+	if err != nil {
+		t.Fatalf("CreateX25519MLKEM768MasterKey: %v", err)
+	}
+	defer other.Wipe()
+	if _, err := ReadWrappedMasterKey(other.(*X25519MLKEM768Key), keyFile); err != ErrDecryptFailed {
+		t.Errorf("ReadWrappedMasterKey(other): err = %v, want %v", err, ErrDecryptFailed)
+	}
+}
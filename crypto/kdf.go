@@ -0,0 +1,182 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// The default KDF parameters.
+	defaultPBKDF2Iter   = 200000
+	defaultArgon2Time   = 2
+	defaultArgon2Memory = 128 * 1024
+
+	// The smallest KDF parameters that calibration can pick.
+	minPBKDF2Iter   = 10000
+	minArgon2Memory = 16 * 1024
+)
+
+// kdfParams are the parameters of the KDF that derives the key that
+// encrypts a master key file from the passphrase. The zero value uses the
+// default parameters.
+type kdfParams struct {
+	// The number of PBKDF2 iterations, for AES master keys.
+	iter int
+	// The argon2 time and memory (in KiB), for the other master keys.
+	time, memory uint32
+}
+
+// WithKDFTarget specifies that the KDF parameters of a new master key should
+// be calibrated so that unlocking it takes about d on this host. The host is
+// benchmarked when the key is created, and the chosen parameters are stored
+// in the key file when it is saved. The default parameters are too weak on
+// fast servers, and too slow on small devices. When it is used with
+// ReadMasterKey, the parameters are calibrated again, e.g. to update them
+// with ChangePassphrase. Otherwise, the parameters of the file are kept.
+func WithKDFTarget(d time.Duration) Option {
+	return func(opt *option) {
+		opt.kdfTarget = d
+	}
+}
+
+// KDFParams are the work factors of the KDF that derives the key that
+// encrypts a master key file from the passphrase. AES master keys use
+// PBKDF2, and the other master keys use Argon2id. Zero values select the
+// default parameters.
+type KDFParams struct {
+	// The number of PBKDF2 iterations. The default is 200000.
+	PBKDF2Iterations int
+	// The number of Argon2 passes, at most 255. The default is 2.
+	Argon2Time uint32
+	// The Argon2 memory in KiB. The default is 128 MiB.
+	Argon2Memory uint32
+}
+
+// WithKDFParams specifies the KDF parameters to use when a master key is
+// created, or when it is read to be saved again, e.g. with
+// ChangePassphrase. They take precedence over WithKDFTarget.
+func WithKDFParams(p KDFParams) Option {
+	return func(opt *option) {
+		opt.kdf = &p
+	}
+}
+
+// pbkdf2Params returns the PBKDF2 parameters selected by the options, or cur
+// when there are none.
+func (o option) pbkdf2Params(cur kdfParams) (kdfParams, error) {
+	switch {
+	case o.kdf != nil && o.kdf.PBKDF2Iterations != 0:
+		if n := o.kdf.PBKDF2Iterations; n < 1 || n > math.MaxUint32 {
+			return kdfParams{}, fmt.Errorf("invalid number of PBKDF2 iterations: %d", n)
+		}
+		return kdfParams{iter: o.kdf.PBKDF2Iterations}, nil
+	case o.kdfTarget > 0:
+		return calibratePBKDF2(o.kdfTarget), nil
+	}
+	return cur, nil
+}
+
+// argon2Params returns the Argon2 parameters selected by the options, or cur
+// when there are none.
+func (o option) argon2Params(cur kdfParams) (kdfParams, error) {
+	switch {
+	case o.kdf != nil && (o.kdf.Argon2Time != 0 || o.kdf.Argon2Memory != 0):
+		p := kdfParams{time: defaultArgon2Time, memory: defaultArgon2Memory}
+		if o.kdf.Argon2Time != 0 {
+			p.time = o.kdf.Argon2Time
+		}
+		if o.kdf.Argon2Memory != 0 {
+			p.memory = o.kdf.Argon2Memory
+		}
+		if p.time > math.MaxUint8 {
+			return kdfParams{}, fmt.Errorf("invalid Argon2 time: %d", p.time)
+		}
+		return p, nil
+	case o.kdfTarget > 0:
+		return calibrateArgon2(o.kdfTarget), nil
+	}
+	return cur, nil
+}
+
+// pbkdf2Iter returns the number of PBKDF2 iterations to use.
+func (p kdfParams) pbkdf2Iter() int {
+	if p.iter <= 0 {
+		return defaultPBKDF2Iter
+	}
+	return p.iter
+}
+
+// argon2 returns the argon2 time and memory to use.
+func (p kdfParams) argon2() (uint32, uint32) {
+	if p.time == 0 || p.memory == 0 {
+		return defaultArgon2Time, defaultArgon2Memory
+	}
+	return p.time, p.memory
+}
+
+// calibratePBKDF2 returns the number of PBKDF2 iterations that take about
+// target on this host.
+func calibratePBKDF2(target time.Duration) kdfParams {
+	const n = 20000
+	start := time.Now()
+	pbkdf2.Key([]byte("calibration"), make([]byte, 16), n, 32, sha256.New)
+	elapsed := max(time.Since(start), time.Microsecond)
+	iter := float64(n) * float64(target) / float64(elapsed)
+	return kdfParams{iter: int(max(minPBKDF2Iter, min(iter, math.MaxUint32)))}
+}
+
+// calibrateArgon2 returns the argon2 time and memory that take about target
+// on this host. The memory is reduced only when a single pass with the
+// default memory takes longer than target.
+func calibrateArgon2(target time.Duration) kdfParams {
+	memory := uint32(defaultArgon2Memory)
+	for {
+		start := time.Now()
+		argon2.IDKey([]byte("calibration"), make([]byte, 16), 1, memory, 1, 32)
+		elapsed := max(time.Since(start), time.Microsecond)
+		if elapsed > target && memory/2 >= minArgon2Memory {
+			memory /= 2
+			continue
+		}
+		t := math.Round(float64(target) / float64(elapsed))
+		return kdfParams{time: uint32(max(1, min(t, math.MaxUint8))), memory: memory}
+	}
+}
+
+// passphraseKDFParams returns the KDF parameters of a secret that was
+// encrypted with encryptWithPassphrase.
+func passphraseKDFParams(b []byte) kdfParams {
+	if len(b) < 1+16+1+4 {
+		return kdfParams{}
+	}
+	return kdfParams{time: uint32(b[17]), memory: binary.LittleEndian.Uint32(b[18:22])}
+}
@@ -0,0 +1,164 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func kdfOf(t *testing.T, mk MasterKey) kdfParams {
+	switch mk := mk.(type) {
+	case *AESMasterKey:
+		return mk.kdf
+	case *Chacha20Poly1305MasterKey:
+		return mk.kdf
+	case *X25519Key:
+		return mk.kdf
+	}
+	t.Fatalf("unexpected key type %T", mk)
+	return kdfParams{}
+}
+
+func TestKDFTarget(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		create func(...Option) (MasterKey, error)
+	}{
+		{"AES", CreateAESMasterKey},
+		{"Chacha20Poly1305", CreateChacha20Poly1305MasterKey},
+		{"X25519", CreateX25519MasterKey},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mk, err := tc.create(WithKDFTarget(20 * time.Millisecond))
+			if err != nil {
+				t.Fatalf("create: %v", err)
+			}
+			defer mk.Wipe()
+			kdf := kdfOf(t, mk)
+			if kdf == (kdfParams{}) {
+				t.Fatal("KDF parameters weren't calibrated")
+			}
+			file := filepath.Join(t.TempDir(), "key")
+			if err := mk.Save([]byte("foo"), file); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			got, err := ReadMasterKey([]byte("foo"), file)
+			if err != nil {
+				t.Fatalf("ReadMasterKey: %v", err)
+			}
+			defer got.Wipe()
+			if got := kdfOf(t, got); got != kdf {
+				t.Errorf("KDF parameters of file = %+v, want %+v", got, kdf)
+			}
+			if err := got.ChangePassphrase([]byte("foo"), []byte("bar"), file); err != nil {
+				t.Fatalf("ChangePassphrase: %v", err)
+			}
+			got2, err := ReadMasterKey([]byte("bar"), file)
+			if err != nil {
+				t.Fatalf("ReadMasterKey: %v", err)
+			}
+			defer got2.Wipe()
+			if got := kdfOf(t, got2); got != kdf {
+				t.Errorf("KDF parameters after ChangePassphrase = %+v, want %+v", got, kdf)
+			}
+		})
+	}
+}
+
+func TestCalibrateKDF(t *testing.T) {
+	if got := calibratePBKDF2(time.Nanosecond); got.iter != minPBKDF2Iter {
+		t.Errorf("calibratePBKDF2(1ns) = %+v, want %d iterations", got, minPBKDF2Iter)
+	}
+	if got := calibrateArgon2(time.Nanosecond); got.time != 1 || got.memory != minArgon2Memory {
+		t.Errorf("calibrateArgon2(1ns) = %+v, want time 1 and memory %d", got, minArgon2Memory)
+	}
+	short, long := calibratePBKDF2(10*time.Millisecond), calibratePBKDF2(time.Second)
+	if short.iter >= long.iter {
+		t.Errorf("calibratePBKDF2(10ms) = %d iterations, calibratePBKDF2(1s) = %d iterations", short.iter, long.iter)
+	}
+}
+
+func TestKDFParams(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		create func(...Option) (MasterKey, error)
+		params KDFParams
+		want   kdfParams
+		resave KDFParams
+		want2  kdfParams
+	}{
+		{"AES", CreateAESMasterKey,
+			KDFParams{PBKDF2Iterations: 300000}, kdfParams{iter: 300000},
+			KDFParams{PBKDF2Iterations: 400000}, kdfParams{iter: 400000},
+		},
+		{"Chacha20Poly1305", CreateChacha20Poly1305MasterKey,
+			KDFParams{Argon2Time: 3, Argon2Memory: 32 * 1024}, kdfParams{time: 3, memory: 32 * 1024},
+			KDFParams{Argon2Time: 1}, kdfParams{time: 1, memory: defaultArgon2Memory},
+		},
+		{"X25519", CreateX25519MasterKey,
+			KDFParams{Argon2Memory: 32 * 1024}, kdfParams{time: defaultArgon2Time, memory: 32 * 1024},
+			KDFParams{Argon2Time: 1, Argon2Memory: 16 * 1024}, kdfParams{time: 1, memory: 16 * 1024},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mk, err := tc.create(WithKDFParams(tc.params), WithKDFTarget(time.Hour))
+			if err != nil {
+				t.Fatalf("create: %v", err)
+			}
+			defer mk.Wipe()
+			if got := kdfOf(t, mk); got != tc.want {
+				t.Errorf("KDF parameters = %+v, want %+v", got, tc.want)
+			}
+			file := filepath.Join(t.TempDir(), "key")
+			if err := mk.Save([]byte("foo"), file); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			got, err := ReadMasterKey([]byte("foo"), file, WithKDFParams(tc.resave))
+			if err != nil {
+				t.Fatalf("ReadMasterKey: %v", err)
+			}
+			defer got.Wipe()
+			if err := got.ChangePassphrase([]byte("foo"), []byte("bar"), file); err != nil {
+				t.Fatalf("ChangePassphrase: %v", err)
+			}
+			got2, err := ReadMasterKey([]byte("bar"), file)
+			if err != nil {
+				t.Fatalf("ReadMasterKey: %v", err)
+			}
+			defer got2.Wipe()
+			if got := kdfOf(t, got2); got != tc.want2 {
+				t.Errorf("KDF parameters after ChangePassphrase = %+v, want %+v", got, tc.want2)
+			}
+		})
+	}
+
+	if _, err := CreateAESMasterKey(WithKDFParams(KDFParams{PBKDF2Iterations: -1})); err == nil {
+		t.Error("CreateAESMasterKey with -1 iterations should have failed, but didn't")
+	}
+	if _, err := CreateChacha20Poly1305MasterKey(WithKDFParams(KDFParams{Argon2Time: 256})); err == nil {
+		t.Error("CreateChacha20Poly1305MasterKey with time 256 should have failed, but didn't")
+	}
+}
@@ -0,0 +1,131 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+)
+
+const (
+	// The version byte of encrypted keys that are tagged with the ID of the
+	// key that encrypted them.
+	keyIDVersion = 9
+
+	// The size of key IDs.
+	keyIDSize = 8
+)
+
+// hasher is implemented by all the keys.
+type hasher interface {
+	Hash(b []byte) []byte
+}
+
+// KeyID returns a short identifier of k. The encrypted keys created by
+// NewKey are tagged with the ID of the key that encrypted them. It is derived
+// with Hash, and doesn't reveal anything about the key. The ID of a Keyset is
+// the ID of its primary key, and the ID of a MultiKey is the ID of its first
+// key.
+func KeyID(k EncryptionKey) string {
+	return hex.EncodeToString(keyIDBytes(k))
+}
+
+// EncryptedKeyID returns the ID of the key that encrypted encryptedKey, or an
+// empty string if encryptedKey isn't tagged with a key ID. Only the first
+// bytes of the encrypted key are needed.
+func EncryptedKeyID(encryptedKey []byte) string {
+	if len(encryptedKey) < 1+keyIDSize || encryptedKey[0] != keyIDVersion {
+		return ""
+	}
+	return hex.EncodeToString(encryptedKey[1 : 1+keyIDSize])
+}
+
+func keyIDBytes(k hasher) []byte {
+	switch k := k.(type) {
+	case *Keyset:
+		return keyIDBytes(k.keys[0])
+	case *MultiKey:
+		return keyIDBytes(k.keys[0])
+	}
+	return k.Hash([]byte("c2FmZQ storage key id"))[:keyIDSize]
+}
+
+// tagEncryptedKey prepends the ID of k to an encrypted key.
+func tagEncryptedKey(k hasher, enc []byte) []byte {
+	out := make([]byte, 0, 1+keyIDSize+len(enc))
+	out = append(out, keyIDVersion)
+	out = append(out, keyIDBytes(k)...)
+	return append(out, enc...)
+}
+
+// untagEncryptedKey removes the key ID from an encrypted key, after checking
+// that it is the ID of k. Encrypted keys that aren't tagged are returned as
+// is.
+func untagEncryptedKey(k hasher, enc []byte) ([]byte, error) {
+	if len(enc) == 0 || enc[0] != keyIDVersion {
+		return enc, nil
+	}
+	if len(enc) < 1+keyIDSize || !bytes.Equal(enc[1:1+keyIDSize], keyIDBytes(k)) {
+		return nil, ErrDecryptFailed
+	}
+	return enc[1+keyIDSize:], nil
+}
+
+// readEncryptedKeyBytes reads an encrypted key of size bytes, which may be
+// tagged with a key ID.
+func readEncryptedKeyBytes(r io.Reader, size int) ([]byte, error) {
+	buf := make([]byte, 1+keyIDSize+size)
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return nil, err
+	}
+	if buf[0] != keyIDVersion {
+		buf = buf[:size]
+	}
+	if _, err := io.ReadFull(r, buf[1:]); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// readVersionedEncryptedKeyBytes is like readEncryptedKeyBytes, for encrypted
+// keys whose size depends on their version byte.
+func readVersionedEncryptedKeyBytes(r io.Reader, size func(version byte) int) ([]byte, error) {
+	buf := make([]byte, 1, 2+keyIDSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if buf[0] == keyIDVersion {
+		buf = buf[:2+keyIDSize]
+		if _, err := io.ReadFull(r, buf[1:]); err != nil {
+			return nil, err
+		}
+	}
+	n := size(buf[len(buf)-1])
+	buf = append(buf, make([]byte, n-1)...)
+	if _, err := io.ReadFull(r, buf[len(buf)-n+1:]); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
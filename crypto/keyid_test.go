@@ -0,0 +1,114 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestKeyID(t *testing.T) {
+	aesKey, err := CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateAESMasterKeyForTest: %v", err)
+	}
+	defer aesKey.Wipe()
+	ccKey, err := CreateChacha20Poly1305MasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateChacha20Poly1305MasterKeyForTest: %v", err)
+	}
+	defer ccKey.Wipe()
+	xKey, err := CreateX25519MasterKey()
+	if err != nil {
+		t.Fatalf("CreateX25519MasterKey: %v", err)
+	}
+	defer xKey.Wipe()
+
+	if got, want := KeyID(xKey.(*X25519Key).PublicKey()), KeyID(xKey); got != want {
+		t.Errorf("KeyID(public key) = %q, want %q", got, want)
+	}
+	for _, mk := range []MasterKey{aesKey, ccKey, xKey} {
+		id := KeyID(mk)
+		if len(id) != 2*keyIDSize {
+			t.Errorf("KeyID() = %q", id)
+		}
+		ek, err := mk.NewKey()
+		if err != nil {
+			t.Fatalf("NewKey: %v", err)
+		}
+		defer ek.Wipe()
+		var buf bytes.Buffer
+		if err := ek.WriteEncryptedKey(&buf); err != nil {
+			t.Fatalf("WriteEncryptedKey: %v", err)
+		}
+		if got := EncryptedKeyID(buf.Bytes()); got != id {
+			t.Errorf("EncryptedKeyID() = %q, want %q", got, id)
+		}
+		ek2, err := mk.ReadEncryptedKey(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("ReadEncryptedKey: %v", err)
+		}
+		ek2.Wipe()
+		if _, err := mk.DecryptKey(buf.Bytes()); err != nil {
+			t.Errorf("DecryptKey: %v", err)
+		}
+		for _, other := range []MasterKey{aesKey, ccKey, xKey} {
+			if other == mk {
+				continue
+			}
+			if _, err := other.DecryptKey(buf.Bytes()); err != ErrDecryptFailed {
+				t.Errorf("DecryptKey with other key = %v, want %v", err, ErrDecryptFailed)
+			}
+		}
+	}
+}
+
+func TestKeyIDUntagged(t *testing.T) {
+	mk, err := CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateAESMasterKeyForTest: %v", err)
+	}
+	defer mk.Wipe()
+	// Encrypted keys created before key IDs were added aren't tagged.
+	b := make([]byte, 64)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+	enc, err := mk.Encrypt(b)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if got := EncryptedKeyID(enc); got != "" {
+		t.Errorf("EncryptedKeyID() = %q, want empty", got)
+	}
+	ek, err := mk.ReadEncryptedKey(bytes.NewReader(enc))
+	if err != nil {
+		t.Fatalf("ReadEncryptedKey: %v", err)
+	}
+	defer ek.Wipe()
+	if got := ek.(*AESKey).key(); !bytes.Equal(got, b) {
+		t.Errorf("Unexpected key. Want %v, got %v", b, got)
+	}
+}
@@ -0,0 +1,83 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrKeyringNotSupported is returned by the keyring functions on
+	// platforms other than Linux.
+	ErrKeyringNotSupported = errors.New("kernel keyring is not supported on this platform")
+	// ErrNotInKeyring indicates that the key isn't in the keyring, or that
+	// it expired.
+	ErrNotInKeyring = errors.New("key not in keyring")
+)
+
+// SaveToKeyring stores the unlocked mk in the user keyring of the Linux
+// kernel, so that a service can restart without asking for the passphrase
+// again. The key is removed by the kernel after timeout, unless timeout is
+// zero. Saving a key with the same description replaces it, and resets the
+// timeout.
+//
+// Only the processes of the same user can read the key, and only if they
+// possess the user keyring, e.g. because it is linked to their session
+// keyring. TPM keys can't be saved.
+func SaveToKeyring(mk MasterKey, desc string, timeout time.Duration) error {
+	if timeout < 0 {
+		return errors.New("invalid timeout")
+	}
+	version, key, err := masterKeyBytes(mk)
+	if err != nil {
+		return err
+	}
+	defer clear(key)
+	b := append([]byte{version}, key...)
+	defer clear(b)
+	return keyringAdd(desc, b, timeout)
+}
+
+// ReadMasterKeyFromKeyring reads a master key that was saved with
+// SaveToKeyring. It returns ErrNotInKeyring when the key isn't there.
+func ReadMasterKeyFromKeyring(desc string, opts ...Option) (MasterKey, error) {
+	var opt option
+	opt.apply(opts)
+	b, err := keyringRead(desc)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(b)
+	if len(b) == 0 {
+		return nil, ErrUnexpectedAlgo
+	}
+	return masterKeyFromBytes(b[0], b[1:], opt)
+}
+
+// RemoveFromKeyring removes a master key from the user keyring. It returns
+// ErrNotInKeyring when the key isn't there.
+func RemoveFromKeyring(desc string) error {
+	return keyringRemove(desc)
+}
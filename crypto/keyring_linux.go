@@ -0,0 +1,98 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The permissions of the keys: all for the possessor, and view, read and
+// search for the user.
+const keyringPerm = 0x3f0b0000
+
+func keyringAdd(desc string, data []byte, timeout time.Duration) error {
+	id, err := unix.AddKey("user", desc, data, unix.KEY_SPEC_USER_KEYRING)
+	if err != nil {
+		return fmt.Errorf("add_key: %w", err)
+	}
+	// A timeout of zero clears the timeout of the key that was replaced.
+	secs := int((timeout + time.Second - 1) / time.Second)
+	if _, err := unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, secs, 0, 0); err != nil {
+		unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+		return fmt.Errorf("keyctl set_timeout: %w", err)
+	}
+	if err := unix.KeyctlSetperm(id, keyringPerm); err != nil {
+		unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+		return fmt.Errorf("keyctl setperm: %w", err)
+	}
+	return nil
+}
+
+func keyringSearch(desc string) (int, error) {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", desc, 0)
+	if errors.Is(err, unix.ENOKEY) || errors.Is(err, unix.EKEYEXPIRED) || errors.Is(err, unix.EKEYREVOKED) {
+		return 0, ErrNotInKeyring
+	}
+	if err != nil {
+		return 0, fmt.Errorf("keyctl search: %w", err)
+	}
+	return id, nil
+}
+
+func keyringRead(desc string) ([]byte, error) {
+	id, err := keyringSearch(desc)
+	if err != nil {
+		return nil, err
+	}
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return nil, fmt.Errorf("keyctl read: %w", err)
+	}
+	b := make([]byte, size)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, b, 0)
+	if err != nil {
+		clear(b)
+		return nil, fmt.Errorf("keyctl read: %w", err)
+	}
+	if n > size {
+		clear(b)
+		return nil, errors.New("keyctl read: key was updated")
+	}
+	return b[:n], nil
+}
+
+func keyringRemove(desc string) error {
+	id, err := keyringSearch(desc)
+	if err != nil {
+		return err
+	}
+	if _, err := unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0); err != nil {
+		return fmt.Errorf("keyctl invalidate: %w", err)
+	}
+	return nil
+}
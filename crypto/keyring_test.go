@@ -0,0 +1,72 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestKeyring(t *testing.T) {
+	mk, err := CreateChacha20Poly1305MasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateChacha20Poly1305MasterKeyForTest: %v", err)
+	}
+	defer mk.Wipe()
+	desc := fmt.Sprintf("c2FmZQ-storage-test:%d:%d", os.Getpid(), time.Now().UnixNano())
+	if err := SaveToKeyring(mk, desc, time.Minute); err != nil {
+		if errors.Is(err, ErrKeyringNotSupported) {
+			t.Skip(err)
+		}
+		t.Fatalf("SaveToKeyring: %v", err)
+	}
+	got, err := ReadMasterKeyFromKeyring(desc)
+	if err != nil {
+		t.Fatalf("ReadMasterKeyFromKeyring: %v", err)
+	}
+	defer got.Wipe()
+	if _, ok := got.(*Chacha20Poly1305MasterKey); !ok || KeyID(got) != KeyID(mk) {
+		t.Errorf("ReadMasterKeyFromKeyring returned a different key")
+	}
+	if err := RemoveFromKeyring(desc); err != nil {
+		t.Fatalf("RemoveFromKeyring: %v", err)
+	}
+	if _, err := ReadMasterKeyFromKeyring(desc); err != ErrNotInKeyring {
+		t.Errorf("ReadMasterKeyFromKeyring() = %v, want %v", err, ErrNotInKeyring)
+	}
+	if err := RemoveFromKeyring(desc); err != ErrNotInKeyring {
+		t.Errorf("RemoveFromKeyring() = %v, want %v", err, ErrNotInKeyring)
+	}
+
+	if err := SaveToKeyring(mk, desc, time.Second); err != nil {
+		t.Fatalf("SaveToKeyring: %v", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := ReadMasterKeyFromKeyring(desc); err != ErrNotInKeyring {
+		t.Errorf("ReadMasterKeyFromKeyring() after timeout = %v, want %v", err, ErrNotInKeyring)
+	}
+}
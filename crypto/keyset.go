@@ -0,0 +1,252 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// Keyset is an EncryptionKey made of a primary key, used to encrypt new data
+// and files, and of legacy keys, retained to decrypt the data and files that
+// were encrypted before the primary key was rotated. Files are re-encrypted
+// with the primary key when they are written again, so that the rotation
+// happens gradually instead of with a full re-encryption of the storage.
+//
+// Hash uses the oldest key, i.e. the last legacy key, so that the names
+// returned by HashString don't change when the primary key is rotated. That
+// key must be retained for as long as hashed names are used.
+type Keyset struct {
+	// keys has the primary key first, followed by the legacy keys.
+	keys []EncryptionKey
+}
+
+// NewKeyset returns a Keyset with the primary key and the legacy keys, from
+// newest to oldest. The Keyset owns the keys, and wipes them when it is
+// wiped.
+func NewKeyset(primary EncryptionKey, legacy ...EncryptionKey) (*Keyset, error) {
+	if primary == nil {
+		return nil, errors.New("missing primary key")
+	}
+	return &Keyset{keys: append([]EncryptionKey{primary}, legacy...)}, nil
+}
+
+// Primary returns the primary key.
+func (k *Keyset) Primary() EncryptionKey {
+	return k.keys[0]
+}
+
+func (k *Keyset) Logger() Logger {
+	return k.keys[0].Logger()
+}
+
+// Hash returns the hash of b with the oldest key.
+func (k *Keyset) Hash(b []byte) []byte {
+	return k.keys[len(k.keys)-1].Hash(b)
+}
+
+// DeriveKey returns a Keyset of keys derived from each of the keys.
+func (k *Keyset) DeriveKey(info []byte) (EncryptionKey, error) {
+	keys := make([]EncryptionKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		dk, err := key.DeriveKey(info)
+		if err != nil {
+			for _, dk := range keys {
+				dk.Wipe()
+			}
+			return nil, err
+		}
+		keys = append(keys, dk)
+	}
+	return &Keyset{keys: keys}, nil
+}
+
+// NewKey creates a new encryption key with the primary key.
+func (k *Keyset) NewKey() (EncryptionKey, error) {
+	return k.keys[0].NewKey()
+}
+
+// Encrypt encrypts data with the primary key.
+func (k *Keyset) Encrypt(data []byte) ([]byte, error) {
+	return k.keys[0].Encrypt(data)
+}
+
+// EncryptWithAAD encrypts data with the primary key, and authenticates
+// additionalData.
+func (k *Keyset) EncryptWithAAD(data, additionalData []byte) ([]byte, error) {
+	return k.keys[0].EncryptWithAAD(data, additionalData)
+}
+
+// Decrypt decrypts data with the first key that can.
+func (k *Keyset) Decrypt(data []byte) ([]byte, error) {
+	for _, key := range k.keys {
+		if dec, err := key.Decrypt(data); err == nil {
+			return dec, nil
+		}
+	}
+	return nil, ErrDecryptFailed
+}
+
+// DecryptWithAAD decrypts data with the first key that can, with the same
+// additional data.
+func (k *Keyset) DecryptWithAAD(data, additionalData []byte) ([]byte, error) {
+	for _, key := range k.keys {
+		if dec, err := key.DecryptWithAAD(data, additionalData); err == nil {
+			return dec, nil
+		}
+	}
+	return nil, ErrDecryptFailed
+}
+
+// DecryptKey decrypts an encrypted key with the first key that can.
+func (k *Keyset) DecryptKey(encryptedKey []byte) (EncryptionKey, error) {
+	for _, key := range k.keys {
+		if ek, err := key.DecryptKey(encryptedKey); err == nil {
+			return ek, nil
+		}
+	}
+	return nil, ErrDecryptFailed
+}
+
+// ReadEncryptedKey reads an encrypted key and decrypts it with the key whose
+// ID it is tagged with. Encrypted keys that aren't tagged are decrypted with
+// the first key that can. Only the keys that create encrypted keys with the
+// version byte of the encrypted key are tried.
+func (k *Keyset) ReadEncryptedKey(r io.Reader) (EncryptionKey, error) {
+	rr := &rewindReader{r: r}
+	var version [1]byte
+	if _, err := io.ReadFull(rr, version[:]); err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	var id []byte
+	if version[0] == keyIDVersion {
+		id = make([]byte, keyIDSize)
+		if _, err := io.ReadFull(rr, id); err != nil {
+			k.Logger().Debug(err)
+			return nil, ErrDecryptFailed
+		}
+	}
+	for _, key := range k.keys {
+		if id != nil && !bytes.Equal(id, keyIDBytes(key)) {
+			continue
+		}
+		if v, ok := encryptedKeyVersion(key); id == nil && ok && v != version[0] {
+			continue
+		}
+		rr.off = 0
+		ek, err := key.ReadEncryptedKey(rr)
+		if err != nil {
+			continue
+		}
+		if rr.off != len(rr.buf) {
+			// A previous attempt read more than this key's encrypted
+			// key. The stream can't be rewound.
+			ek.Wipe()
+			k.Logger().Debug("ReadEncryptedKey: encrypted key size mismatch")
+			return nil, ErrDecryptFailed
+		}
+		return ek, nil
+	}
+	return nil, ErrDecryptFailed
+}
+
+// WriteEncryptedKey writes the encrypted key of the primary key.
+func (k *Keyset) WriteEncryptedKey(w io.Writer) error {
+	return k.keys[0].WriteEncryptedKey(w)
+}
+
+// StartReader opens a reader to decrypt a stream of data with the primary key.
+func (k *Keyset) StartReader(ctx []byte, r io.Reader) (StreamReader, error) {
+	return k.keys[0].StartReader(ctx, r)
+}
+
+// StartWriter opens a writer to encrypt a stream of data with the primary key.
+func (k *Keyset) StartWriter(ctx []byte, w io.Writer) (StreamWriter, error) {
+	return k.keys[0].StartWriter(ctx, w)
+}
+
+// StartAppendWriter opens a writer to append to a stream encrypted with the
+// primary key.
+func (k *Keyset) StartAppendWriter(ctx []byte, rw TruncatableStream) (StreamWriter, int64, error) {
+	return k.keys[0].StartAppendWriter(ctx, rw)
+}
+
+// Wipe wipes all the keys.
+func (k *Keyset) Wipe() {
+	for _, key := range k.keys {
+		key.Wipe()
+	}
+}
+
+// encryptedKeyVersion returns the version byte of the encrypted keys created
+// by k, if it is known. It is only used for encrypted keys that aren't tagged
+// with a key ID, i.e. old ones, so it is 1 for AES keys, even though they now
+// create keys with the version 2 format.
+func encryptedKeyVersion(k EncryptionKey) (byte, bool) {
+	switch k := k.(type) {
+	case *AESMasterKey:
+		return encryptedKeyVersion(k.AESKey)
+	case *AESKey:
+		if k.tpmKey != nil {
+			return 3, true
+		}
+		if k.eccKey != nil {
+			return tpmECCVersion, true
+		}
+		if k.siv {
+			return aesGCMSIVVersion, true
+		}
+		return 1, true
+	case *Chacha20Poly1305MasterKey, *Chacha20Poly1305Key:
+		return 2, true
+	case *X25519Key, *X25519PublicKey:
+		return x25519Version, true
+	case *X25519MLKEM768Key, *X25519MLKEM768PublicKey:
+		return hybridVersion, true
+	default:
+		return 0, false
+	}
+}
+
+// rewindReader records what it reads so that it can be read again from the
+// start.
+type rewindReader struct {
+	r   io.Reader
+	buf []byte
+	off int
+}
+
+func (rr *rewindReader) Read(p []byte) (int, error) {
+	if rr.off < len(rr.buf) {
+		n := copy(p, rr.buf[rr.off:])
+		rr.off += n
+		return n, nil
+	}
+	n, err := rr.r.Read(p)
+	rr.buf = append(rr.buf, p[:n]...)
+	rr.off += n
+	return n, err
+}
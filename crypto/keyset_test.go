@@ -0,0 +1,123 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyset(t *testing.T) {
+	newKey := func(create func() (MasterKey, error)) MasterKey {
+		mk, err := create()
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		return mk
+	}
+	aes1 := newKey(CreateAESMasterKeyForTest)
+	defer aes1.Wipe()
+	aes2 := newKey(CreateAESMasterKeyForTest)
+	defer aes2.Wipe()
+	cc := newKey(CreateChacha20Poly1305MasterKeyForTest)
+	defer cc.Wipe()
+
+	data := []byte("Hello world")
+	var buf bytes.Buffer
+	for _, key := range []EncryptionKey{aes1, aes2} {
+		ek, err := key.NewKey()
+		if err != nil {
+			t.Fatalf("NewKey: %v", err)
+		}
+		if err := ek.WriteEncryptedKey(&buf); err != nil {
+			t.Fatalf("WriteEncryptedKey: %v", err)
+		}
+		ek.Wipe()
+	}
+	enc, err := aes1.Encrypt(data)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+
+	// The primary key is rotated twice, to aes2, and then to cc.
+	ks, err := NewKeyset(cc, aes2, aes1)
+	if err != nil {
+		t.Fatalf("NewKeyset: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		ek, err := ks.ReadEncryptedKey(&buf)
+		if err != nil {
+			t.Fatalf("ReadEncryptedKey #%d: %v", i, err)
+		}
+		ek.Wipe()
+	}
+	dec, err := ks.Decrypt(enc)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if !bytes.Equal(dec, data) {
+		t.Errorf("Decrypt() = %q, want %q", dec, data)
+	}
+	if want, got := aes1.Hash(data), ks.Hash(data); !bytes.Equal(want, got) {
+		t.Errorf("Hash() = %x, want %x", got, want)
+	}
+
+	// New keys are encrypted with the primary key.
+	ek, err := ks.NewKey()
+	if err != nil {
+		t.Fatalf("NewKey: %v", err)
+	}
+	defer ek.Wipe()
+	if err := ek.WriteEncryptedKey(&buf); err != nil {
+		t.Fatalf("WriteEncryptedKey: %v", err)
+	}
+	ek2, err := cc.ReadEncryptedKey(&buf)
+	if err != nil {
+		t.Fatalf("cc.ReadEncryptedKey: %v", err)
+	}
+	ek2.Wipe()
+	if enc, err = ks.Encrypt(data); err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if _, err := cc.Decrypt(enc); err != nil {
+		t.Errorf("cc.Decrypt: %v", err)
+	}
+
+	// Keys that aren't in the keyset can't be read.
+	ek, err = aes2.NewKey()
+	if err != nil {
+		t.Fatalf("NewKey: %v", err)
+	}
+	defer ek.Wipe()
+	if err := ek.WriteEncryptedKey(&buf); err != nil {
+		t.Fatalf("WriteEncryptedKey: %v", err)
+	}
+	ks2, err := NewKeyset(cc, aes1)
+	if err != nil {
+		t.Fatalf("NewKeyset: %v", err)
+	}
+	if _, err := ks2.ReadEncryptedKey(&buf); err != ErrDecryptFailed {
+		t.Errorf("ReadEncryptedKey() = %v, want %v", err, ErrDecryptFailed)
+	}
+}
@@ -0,0 +1,275 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"os"
+	"strings"
+)
+
+// The version byte of master key files with several passphrase slots.
+const keySlotsVersion = 10
+
+var (
+	// ErrKeySlotExists indicates that a key slot with the same name
+	// already exists.
+	ErrKeySlotExists = errors.New("key slot already exists")
+	// ErrKeySlotNotFound indicates that a key slot doesn't exist.
+	ErrKeySlotNotFound = errors.New("key slot not found")
+)
+
+// keySlots is the content of a key slots file: the ID of the master key, and
+// named slots that each contain the master key encrypted with a different
+// passphrase.
+type keySlots struct {
+	id    []byte
+	names []string
+	slots [][]byte
+}
+
+// AddKeySlot adds a slot named name to a key slots file, so that mk can also
+// be unlocked with passphrase, e.g. separate passphrases for admin, recovery,
+// and automation. The file is created if it doesn't exist. Otherwise, it must
+// be a key slots file of mk. Key slots files are read with ReadMasterKey,
+// which tries the passphrase with every slot. TPM keys can't be saved in key
+// slots. Names that start with # are reserved, e.g. for AddRecoveryKey.
+func AddKeySlot(mk MasterKey, name string, passphrase []byte, file string) error {
+	if strings.HasPrefix(name, "#") {
+		return errors.New("invalid key slot name")
+	}
+	return addKeySlot(mk, name, passphrase, file)
+}
+
+func addKeySlot(mk MasterKey, name string, passphrase []byte, file string) error {
+	if name == "" || len(name) > 255 {
+		return errors.New("invalid key slot name")
+	}
+	ks, err := readKeySlots(file)
+	if errors.Is(err, os.ErrNotExist) {
+		ks, err = &keySlots{id: keyIDBytes(mk)}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(ks.id, keyIDBytes(mk)) {
+		return errors.New("file contains a different key")
+	}
+	if ks.index(name) >= 0 {
+		return ErrKeySlotExists
+	}
+	if len(ks.slots) == 255 {
+		return errors.New("too many key slots")
+	}
+	slot, err := encryptKeySlot(mk, passphrase)
+	if err != nil {
+		return err
+	}
+	ks.names = append(ks.names, name)
+	ks.slots = append(ks.slots, slot)
+	return ks.save(file)
+}
+
+// RemoveKeySlot removes the slot named name from a key slots file of mk, so
+// that its passphrase can no longer unlock the key. The last slot can't be
+// removed.
+func RemoveKeySlot(mk MasterKey, name string, file string) error {
+	ks, err := readKeySlots(file)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(ks.id, keyIDBytes(mk)) {
+		return errors.New("file contains a different key")
+	}
+	i := ks.index(name)
+	if i < 0 {
+		return ErrKeySlotNotFound
+	}
+	if len(ks.slots) == 1 {
+		return errors.New("the last key slot can't be removed")
+	}
+	ks.names = append(ks.names[:i], ks.names[i+1:]...)
+	ks.slots = append(ks.slots[:i], ks.slots[i+1:]...)
+	return ks.save(file)
+}
+
+// KeySlots returns the names of the slots of a key slots file.
+func KeySlots(file string) ([]string, error) {
+	ks, err := readKeySlots(file)
+	if err != nil {
+		return nil, err
+	}
+	return ks.names, nil
+}
+
+// isKeySlotsFile returns true if file is a key slots file.
+func isKeySlotsFile(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var b [1]byte
+	_, err = f.Read(b[:])
+	return err == nil && b[0] == keySlotsVersion
+}
+
+// readKeySlotsMasterKey reads the master key from a key slots file, with the
+// first slot that passphrase unlocks.
+func readKeySlotsMasterKey(passphrase []byte, file string, opts ...Option) (MasterKey, error) {
+	var opt option
+	opt.apply(opts)
+	ks, err := readKeySlots(file)
+	if err != nil {
+		return nil, err
+	}
+	_, mk, err := ks.unlock(passphrase, opt)
+	return mk, err
+}
+
+// changeKeySlotPassphrase replaces the slot that oldPassphrase unlocks with
+// one that newPassphrase unlocks.
+func changeKeySlotPassphrase(mk MasterKey, oldPassphrase, newPassphrase []byte, file string) error {
+	var opt option
+	opt.apply([]Option{WithLogger(mk.Logger())})
+	ks, err := readKeySlots(file)
+	if err != nil {
+		return err
+	}
+	i, cur, err := ks.unlock(oldPassphrase, opt)
+	if err != nil {
+		return err
+	}
+	cur.Wipe()
+	if ks.names[i] == recoveryKeySlot {
+		return errors.New("the recovery key can only be rotated")
+	}
+	if !bytes.Equal(ks.id, keyIDBytes(mk)) {
+		return errors.New("file contains a different key")
+	}
+	if ks.slots[i], err = encryptKeySlot(mk, newPassphrase); err != nil {
+		return err
+	}
+	return ks.save(file)
+}
+
+// encryptKeySlot encrypts the raw bytes of mk with passphrase.
+func encryptKeySlot(mk MasterKey, passphrase []byte) ([]byte, error) {
+	version, key, err := masterKeyBytes(mk)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	b := append([]byte{version}, key...)
+	defer clear(b)
+	return encryptWithPassphrase(keySlotsVersion, b, passphrase, kdfParams{})
+}
+
+// readKeySlots reads a key slots file.
+func readKeySlots(file string) (*keySlots, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 1+keyIDSize+1 || b[0] != keySlotsVersion {
+		return nil, ErrUnexpectedAlgo
+	}
+	ks := &keySlots{id: b[1 : 1+keyIDSize]}
+	n := int(b[1+keyIDSize])
+	b = b[1+keyIDSize+1:]
+	for range n {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return nil, ErrDecryptFailed
+		}
+		ks.names = append(ks.names, string(b[1:1+int(b[0])]))
+		b = b[1+int(b[0]):]
+		if len(b) < 2 {
+			return nil, ErrDecryptFailed
+		}
+		size := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+size {
+			return nil, ErrDecryptFailed
+		}
+		ks.slots = append(ks.slots, b[2:2+size])
+		b = b[2+size:]
+	}
+	return ks, nil
+}
+
+// index returns the index of the slot named name, or -1.
+func (ks *keySlots) index(name string) int {
+	for i, n := range ks.names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// unlock returns the index of the first slot that passphrase unlocks, and
+// the master key that it contains.
+func (ks *keySlots) unlock(passphrase []byte, opt option) (int, MasterKey, error) {
+	for i, slot := range ks.slots {
+		p := passphrase
+		if ks.names[i] == recoveryKeySlot {
+			p = normalizeRecoveryKey(p)
+		}
+		b, err := decryptWithPassphrase(keySlotsVersion, slot, p, opt.logger)
+		if err != nil {
+			continue
+		}
+		if len(b) < 1 {
+			return 0, nil, ErrDecryptFailed
+		}
+		mk, err := masterKeyFromBytes(b[0], b[1:], opt)
+		clear(b)
+		if err != nil {
+			return 0, nil, err
+		}
+		if subtle.ConstantTimeCompare(keyIDBytes(mk), ks.id) != 1 {
+			mk.Wipe()
+			opt.logger.Debug("ReadMasterKey: key slot contains a different key")
+			return 0, nil, ErrDecryptFailed
+		}
+		return i, mk, nil
+	}
+	return 0, nil, ErrDecryptFailed
+}
+
+// save atomically replaces file with the key slots.
+func (ks *keySlots) save(file string) error {
+	data := []byte{keySlotsVersion}
+	data = append(data, ks.id...)
+	data = append(data, byte(len(ks.slots)))
+	for i, slot := range ks.slots {
+		data = append(data, byte(len(ks.names[i])))
+		data = append(data, ks.names[i]...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(slot)))
+		data = append(data, slot...)
+	}
+	return writeKeyFile(file, data, false)
+}
@@ -0,0 +1,108 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestKeySlots(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "key")
+	mk, err := CreateChacha20Poly1305MasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateChacha20Poly1305MasterKeyForTest: %v", err)
+	}
+	defer mk.Wipe()
+
+	for _, slot := range []string{"admin", "recovery", "automation"} {
+		if err := AddKeySlot(mk, slot, []byte(slot+" passphrase"), file); err != nil {
+			t.Fatalf("AddKeySlot(%q): %v", slot, err)
+		}
+	}
+	if err := AddKeySlot(mk, "admin", []byte("foo"), file); err != ErrKeySlotExists {
+		t.Errorf("AddKeySlot(admin) again = %v, want %v", err, ErrKeySlotExists)
+	}
+	other, err := CreateChacha20Poly1305MasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateChacha20Poly1305MasterKeyForTest: %v", err)
+	}
+	defer other.Wipe()
+	if err := AddKeySlot(other, "other", []byte("foo"), file); err == nil {
+		t.Error("AddKeySlot with other key should have failed, but didn't")
+	}
+	names, err := KeySlots(file)
+	if err != nil {
+		t.Fatalf("KeySlots: %v", err)
+	}
+	if want := []string{"admin", "recovery", "automation"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("KeySlots() = %q, want %q", names, want)
+	}
+
+	for _, slot := range names {
+		got, err := ReadMasterKey([]byte(slot+" passphrase"), file)
+		if err != nil {
+			t.Fatalf("ReadMasterKey(%q): %v", slot, err)
+		}
+		if KeyID(got) != KeyID(mk) {
+			t.Errorf("ReadMasterKey(%q) returned a different key", slot)
+		}
+		got.Wipe()
+	}
+	if _, err := ReadMasterKey([]byte("foo"), file); err != ErrDecryptFailed {
+		t.Errorf("ReadMasterKey(foo) = %v, want %v", err, ErrDecryptFailed)
+	}
+
+	if err := mk.ChangePassphrase([]byte("automation passphrase"), []byte("new passphrase"), file); err != nil {
+		t.Fatalf("ChangePassphrase: %v", err)
+	}
+	if _, err := ReadMasterKey([]byte("automation passphrase"), file); err != ErrDecryptFailed {
+		t.Errorf("ReadMasterKey(old passphrase) = %v, want %v", err, ErrDecryptFailed)
+	}
+	got, err := ReadMasterKey([]byte("new passphrase"), file)
+	if err != nil {
+		t.Fatalf("ReadMasterKey(new passphrase): %v", err)
+	}
+	got.Wipe()
+
+	if err := RemoveKeySlot(mk, "recovery", file); err != nil {
+		t.Fatalf("RemoveKeySlot(recovery): %v", err)
+	}
+	if err := RemoveKeySlot(mk, "recovery", file); err != ErrKeySlotNotFound {
+		t.Errorf("RemoveKeySlot(recovery) again = %v, want %v", err, ErrKeySlotNotFound)
+	}
+	if _, err := ReadMasterKey([]byte("recovery passphrase"), file); err != ErrDecryptFailed {
+		t.Errorf("ReadMasterKey(recovery) = %v, want %v", err, ErrDecryptFailed)
+	}
+	if err := RemoveKeySlot(mk, "automation", file); err != nil {
+		t.Fatalf("RemoveKeySlot(automation): %v", err)
+	}
+	if err := RemoveKeySlot(mk, "admin", file); err == nil {
+		t.Error("RemoveKeySlot of the last slot should have failed, but didn't")
+	}
+	if names, err := KeySlots(file); err != nil || !reflect.DeepEqual(names, []string{"admin"}) {
+		t.Errorf("KeySlots() = %q, %v, want [admin]", names, err)
+	}
+}
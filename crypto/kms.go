@@ -0,0 +1,112 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// The version byte of master key files that are sealed by a KMS.
+const kmsVersion = 12
+
+// ErrKMSKey indicates that a master key file is sealed by a KMS. It must be
+// read with ReadMasterKeyWithKMS.
+var ErrKMSKey = errors.New("master key is sealed by a KMS")
+
+// KMS is a key management service that seals master keys with a key that
+// never leaves the service, e.g. the transit engine of HashiCorp Vault. See
+// the vaultkms package.
+type KMS interface {
+	// Encrypt encrypts plaintext.
+	Encrypt(ctx context.Context, plaintext []byte) ([]byte, error)
+	// Decrypt decrypts ciphertext that was returned by Encrypt.
+	Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+// SaveWithKMS seals mk with kms and saves it to file, instead of encrypting
+// it with a passphrase. The file can only be read with ReadMasterKeyWithKMS
+// and access to the same KMS key. TPM keys can't be sealed by a KMS.
+func SaveWithKMS(ctx context.Context, mk MasterKey, kms KMS, file string) error {
+	version, key, err := masterKeyBytes(mk)
+	if err != nil {
+		return err
+	}
+	defer clear(key)
+	b := append([]byte{version}, key...)
+	defer clear(b)
+	enc, err := kms.Encrypt(ctx, b)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(file, append([]byte{kmsVersion}, enc...), false)
+}
+
+// ReadMasterKeyWithKMS reads a master key file that was saved with
+// SaveWithKMS, and unseals it with kms. The errors of the KMS are returned
+// as is.
+func ReadMasterKeyWithKMS(ctx context.Context, kms KMS, file string, opts ...Option) (MasterKey, error) {
+	var opt option
+	opt.apply(opts)
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 || b[0] != kmsVersion {
+		return nil, ErrUnexpectedAlgo
+	}
+	key, err := kms.Decrypt(ctx, b[1:])
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	if len(key) == 0 {
+		return nil, ErrDecryptFailed
+	}
+	return masterKeyFromBytes(key[0], key[1:], opt)
+}
+
+// ResealWithKMS unseals a master key file that was saved with SaveWithKMS
+// with from, and seals it again with to, e.g. to rotate the key of the KMS,
+// or to seal it to a new TPM policy. The file is replaced atomically.
+func ResealWithKMS(ctx context.Context, from, to KMS, file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 || b[0] != kmsVersion {
+		return ErrUnexpectedAlgo
+	}
+	key, err := from.Decrypt(ctx, b[1:])
+	if err != nil {
+		return err
+	}
+	defer clear(key)
+	enc, err := to.Encrypt(ctx, key)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(file, append([]byte{kmsVersion}, enc...), false)
+}
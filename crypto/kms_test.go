@@ -0,0 +1,124 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// testKMS encrypts with a master key, like a KMS would with a key that never
+// leaves it.
+type testKMS struct {
+	key EncryptionKey
+	err error
+}
+
+func (k testKMS) Encrypt(_ context.Context, b []byte) ([]byte, error) {
+	if k.err != nil {
+		return nil, k.err
+	}
+	return k.key.Encrypt(b)
+}
+
+func (k testKMS) Decrypt(_ context.Context, b []byte) ([]byte, error) {
+	if k.err != nil {
+		return nil, k.err
+	}
+	return k.key.Decrypt(b)
+}
+
+func TestKMS(t *testing.T) {
+	ctx := context.Background()
+	kek, err := CreateChacha20Poly1305MasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateChacha20Poly1305MasterKeyForTest: %v", err)
+	}
+	defer kek.Wipe()
+	kms := testKMS{key: kek}
+
+	mk, err := CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateAESMasterKeyForTest: %v", err)
+	}
+	defer mk.Wipe()
+	file := filepath.Join(t.TempDir(), "key")
+	if err := SaveWithKMS(ctx, mk, kms, file); err != nil {
+		t.Fatalf("SaveWithKMS: %v", err)
+	}
+	if _, err := ReadMasterKey([]byte("foo"), file); err != ErrKMSKey {
+		t.Errorf("ReadMasterKey() = %v, want %v", err, ErrKMSKey)
+	}
+	got, err := ReadMasterKeyWithKMS(ctx, kms, file)
+	if err != nil {
+		t.Fatalf("ReadMasterKeyWithKMS: %v", err)
+	}
+	defer got.Wipe()
+	if _, ok := got.(*AESMasterKey); !ok || KeyID(got) != KeyID(mk) {
+		t.Errorf("ReadMasterKeyWithKMS() returned a different key: %T", got)
+	}
+
+	unavailable := errors.New("unavailable")
+	if _, err := ReadMasterKeyWithKMS(ctx, testKMS{err: unavailable}, file); err != unavailable {
+		t.Errorf("ReadMasterKeyWithKMS() = %v, want %v", err, unavailable)
+	}
+}
+
+func TestResealWithKMS(t *testing.T) {
+	ctx := context.Background()
+	var kms [2]testKMS
+	for i := range kms {
+		kek, err := CreateChacha20Poly1305MasterKeyForTest()
+		if err != nil {
+			t.Fatalf("CreateChacha20Poly1305MasterKeyForTest: %v", err)
+		}
+		defer kek.Wipe()
+		kms[i] = testKMS{key: kek}
+	}
+	mk, err := CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateAESMasterKeyForTest: %v", err)
+	}
+	defer mk.Wipe()
+	file := filepath.Join(t.TempDir(), "key")
+	if err := SaveWithKMS(ctx, mk, kms[0], file); err != nil {
+		t.Fatalf("SaveWithKMS: %v", err)
+	}
+	if err := ResealWithKMS(ctx, kms[0], kms[1], file); err != nil {
+		t.Fatalf("ResealWithKMS: %v", err)
+	}
+	if _, err := ReadMasterKeyWithKMS(ctx, kms[0], file); err == nil {
+		t.Error("ReadMasterKeyWithKMS() with the old KMS didn't fail")
+	}
+	got, err := ReadMasterKeyWithKMS(ctx, kms[1], file)
+	if err != nil {
+		t.Fatalf("ReadMasterKeyWithKMS: %v", err)
+	}
+	defer got.Wipe()
+	if KeyID(got) != KeyID(mk) {
+		t.Error("ReadMasterKeyWithKMS() returned a different key")
+	}
+}
@@ -0,0 +1,158 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidMnemonic indicates that a recovery phrase is invalid, e.g. a word
+// is misspelled or the checksum doesn't match.
+var ErrInvalidMnemonic = errors.New("invalid mnemonic")
+
+// The BIP39 English word list.
+//
+//go:embed bip39_english.txt
+var bip39English string
+
+var bip39Words = sync.OnceValues(func() ([]string, map[string]int) {
+	words := strings.Fields(bip39English)
+	index := make(map[string]int, len(words))
+	for i, w := range words {
+		index[w] = i
+	}
+	return words, index
+})
+
+// exportMnemonic returns a recovery phrase that encodes the version and the
+// raw bytes of mk. The phrase uses the BIP39 word list and checksum. It is
+// longer than the usual 12 to 24 words because it also encodes the type of
+// key, and master keys can have 512 bits.
+func exportMnemonic(mk MasterKey) (string, error) {
+	version, key, err := masterKeyBytes(mk)
+	if err != nil {
+		return "", err
+	}
+	defer clear(key)
+	entropy := make([]byte, (1+len(key)+3)/4*4)
+	defer clear(entropy)
+	entropy[0] = version
+	copy(entropy[1:], key)
+	return encodeMnemonic(entropy), nil
+}
+
+// CreateMasterKeyFromMnemonic re-creates a master key from a recovery phrase
+// that was returned by MasterKey.ExportMnemonic. The key can then be saved
+// with a new passphrase. TPM keys can't be exported or imported.
+func CreateMasterKeyFromMnemonic(mnemonic string, opts ...Option) (MasterKey, error) {
+	var opt option
+	opt.apply(opts)
+	if opt.hasTPM() {
+		return nil, errors.New("tpm keys can't be imported")
+	}
+	entropy, err := decodeMnemonic(mnemonic)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(entropy)
+	var size int
+	switch entropy[0] {
+	case 1, 2, aesGCMSIVVersion:
+		size = 64
+	case x25519Version:
+		size = 32
+	case hybridVersion:
+		size = hybridPrivateKeySize
+	default:
+		return nil, ErrUnexpectedAlgo
+	}
+	if len(entropy) != (1+size+3)/4*4 {
+		return nil, ErrInvalidMnemonic
+	}
+	for _, b := range entropy[1+size:] {
+		if b != 0 {
+			return nil, ErrInvalidMnemonic
+		}
+	}
+	return masterKeyFromBytes(entropy[0], append([]byte(nil), entropy[1:1+size]...), opt)
+}
+
+// encodeMnemonic encodes entropy with the BIP39 algorithm. The length of
+// entropy must be a multiple of 4 bytes.
+func encodeMnemonic(entropy []byte) string {
+	words, _ := bip39Words()
+	h := sha256.Sum256(entropy)
+	data := append(append([]byte(nil), entropy...), h[:]...)
+	defer clear(data)
+	n := (len(entropy)*8 + len(entropy)/4) / 11
+	out := make([]string, n)
+	for i := range out {
+		var idx int
+		for j := 0; j < 11; j++ {
+			bit := i*11 + j
+			idx = idx<<1 | int(data[bit/8]>>(7-bit%8)&1)
+		}
+		out[i] = words[idx]
+	}
+	return strings.Join(out, " ")
+}
+
+// decodeMnemonic decodes a phrase that was encoded with encodeMnemonic, and
+// verifies its checksum.
+func decodeMnemonic(mnemonic string) ([]byte, error) {
+	_, index := bip39Words()
+	words := strings.Fields(strings.ToLower(mnemonic))
+	if len(words) == 0 || len(words)%3 != 0 {
+		return nil, ErrInvalidMnemonic
+	}
+	data := make([]byte, (len(words)*11+7)/8)
+	defer clear(data)
+	for i, w := range words {
+		idx, ok := index[w]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown word %q", ErrInvalidMnemonic, w)
+		}
+		for j := 0; j < 11; j++ {
+			if idx&(1<<(10-j)) != 0 {
+				bit := i*11 + j
+				data[bit/8] |= 1 << (7 - bit%8)
+			}
+		}
+	}
+	n := len(words) * 4 / 3
+	entropy := append([]byte(nil), data[:n]...)
+	h := sha256.Sum256(entropy)
+	for bit := 0; bit < n/4; bit++ {
+		if (data[n+bit/8]>>(7-bit%8))&1 != (h[bit/8]>>(7-bit%8))&1 {
+			clear(entropy)
+			return nil, fmt.Errorf("%w: bad checksum", ErrInvalidMnemonic)
+		}
+	}
+	return entropy, nil
+}
@@ -0,0 +1,115 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestBIP39Vectors(t *testing.T) {
+	for _, tc := range []struct {
+		entropy  string
+		mnemonic string
+	}{
+		{"00000000000000000000000000000000", "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"},
+		{"7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f", "legal winner thank year wave sausage worth useful legal winner thank yellow"},
+		{"80808080808080808080808080808080", "letter advice cage absurd amount doctor acoustic avoid letter advice cage above"},
+		{"ffffffffffffffffffffffffffffffff", "zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo wrong"},
+		{"9e885d952ad362caeb4efe34a8e91bd2", "ozone drill grab fiber curtain grace pudding thank cruise elder eight picnic"},
+		{"68a79eaca2324873eacc50cb9c6eca8cc68ea5d936f98787c60c7ebc74e6ce7c", "hamster diagram private dutch cause delay private meat slide toddler razor book happy fancy gospel tennis maple dilemma loan word shrug inflict delay length"},
+	} {
+		entropy, _ := hex.DecodeString(tc.entropy)
+		if got := encodeMnemonic(entropy); got != tc.mnemonic {
+			t.Errorf("encodeMnemonic(%s) = %q, want %q", tc.entropy, got, tc.mnemonic)
+		}
+		got, err := decodeMnemonic(tc.mnemonic)
+		if err != nil {
+			t.Errorf("decodeMnemonic(%q): %v", tc.mnemonic, err)
+			continue
+		}
+		if hex.EncodeToString(got) != tc.entropy {
+			t.Errorf("decodeMnemonic(%q) = %x, want %s", tc.mnemonic, got, tc.entropy)
+		}
+	}
+	for _, m := range []string{
+		"",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon foo",
+	} {
+		if _, err := decodeMnemonic(m); !errors.Is(err, ErrInvalidMnemonic) {
+			t.Errorf("decodeMnemonic(%q) = %v, want %v", m, err, ErrInvalidMnemonic)
+		}
+	}
+}
+
+func TestMnemonic(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		create func(...Option) (MasterKey, error)
+		words  int
+	}{
+		{"AES", CreateAESMasterKey, 51},
+		{"Chacha20Poly1305", CreateChacha20Poly1305MasterKey, 51},
+		{"X25519", CreateX25519MasterKey, 27},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mk, err := tc.create()
+			if err != nil {
+				t.Fatalf("create: %v", err)
+			}
+			defer mk.Wipe()
+			m, err := mk.ExportMnemonic()
+			if err != nil {
+				t.Fatalf("ExportMnemonic: %v", err)
+			}
+			if got := len(strings.Fields(m)); got != tc.words {
+				t.Errorf("ExportMnemonic() has %d words, want %d", got, tc.words)
+			}
+			got, err := CreateMasterKeyFromMnemonic(strings.ToUpper(m))
+			if err != nil {
+				t.Fatalf("CreateMasterKeyFromMnemonic: %v", err)
+			}
+			defer got.Wipe()
+			if KeyID(got) != KeyID(mk) {
+				t.Error("CreateMasterKeyFromMnemonic returned a different key")
+			}
+			if g, w := fmt.Sprintf("%T", got), fmt.Sprintf("%T", mk); g != w {
+				t.Errorf("CreateMasterKeyFromMnemonic returned %s, want %s", g, w)
+			}
+
+			// Flip a checksum bit in the last word.
+			list, index := bip39Words()
+			words := strings.Fields(m)
+			words[len(words)-1] = list[index[words[len(words)-1]]^1]
+			if _, err := CreateMasterKeyFromMnemonic(strings.Join(words, " ")); !errors.Is(err, ErrInvalidMnemonic) {
+				t.Errorf("CreateMasterKeyFromMnemonic with wrong word = %v, want %v", err, ErrInvalidMnemonic)
+			}
+		})
+	}
+}
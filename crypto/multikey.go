@@ -0,0 +1,237 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+)
+
+// The version byte of keys and data wrapped by a MultiKey.
+const multiKeyVersion = 6
+
+// MultiKey is an EncryptionKey that wraps the keys that it creates under
+// several keys, e.g. a primary key, a recovery key, and an auditor's
+// X25519PublicKey. The holder of any one of them can decrypt the files, with
+// a MultiKey that has that key.
+//
+// When decrypting, each of the keys is tried in turn. Files that were
+// encrypted with the first key alone, before it was used in a MultiKey, can
+// also be decrypted.
+//
+// Hash and DeriveKey use the first key. The names returned by HashString, and
+// the subdirectories returned by Sub, are only the same with MultiKeys that
+// have the same first key.
+type MultiKey struct {
+	keys []EncryptionKey
+}
+
+// NewMultiKey returns a MultiKey for keys. The MultiKey owns the keys, and
+// wipes them when it is wiped.
+func NewMultiKey(keys ...EncryptionKey) (*MultiKey, error) {
+	if len(keys) == 0 || len(keys) > 255 {
+		return nil, errors.New("invalid number of keys")
+	}
+	return &MultiKey{keys: keys}, nil
+}
+
+func (k *MultiKey) Logger() Logger {
+	return k.keys[0].Logger()
+}
+
+// Hash returns the hash of b with the first key.
+func (k *MultiKey) Hash(b []byte) []byte {
+	return k.keys[0].Hash(b)
+}
+
+// DeriveKey derives a new encryption key from the first key.
+func (k *MultiKey) DeriveKey(info []byte) (EncryptionKey, error) {
+	return k.keys[0].DeriveKey(info)
+}
+
+// NewKey creates a new encryption key, and wraps it under each of the keys.
+func (k *MultiKey) NewKey() (EncryptionKey, error) {
+	b := make([]byte, 64)
+	if _, err := rand.Read(b); err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrEncryptFailed
+	}
+	enc := []byte{multiKeyVersion, byte(len(k.keys))}
+	for _, key := range k.keys {
+		wrapped, err := key.Encrypt(b)
+		if err != nil {
+			clear(b)
+			return nil, err
+		}
+		if len(wrapped) > 0xFFFF {
+			clear(b)
+			return nil, ErrEncryptFailed
+		}
+		enc = binary.BigEndian.AppendUint16(enc, uint16(len(wrapped)))
+		enc = append(enc, wrapped...)
+	}
+	ek := chacha20poly1305KeyFromBytes(b)
+	ek.encryptedKey = enc
+	ek.logger = k.Logger()
+	return wrappedFileKey{ek}, nil
+}
+
+// readWrappedKey reads a key wrapped by NewKey, and unwraps it with the first
+// key that can.
+func (k *MultiKey) readWrappedKey(r io.Reader) (EncryptionKey, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	if hdr[0] != multiKeyVersion {
+		// Not wrapped by a MultiKey.
+		return k.keys[0].ReadEncryptedKey(io.MultiReader(bytes.NewReader(hdr), r))
+	}
+	enc := hdr
+	var b []byte
+	for i := 0; i < int(hdr[1]); i++ {
+		var size [2]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			k.Logger().Debug(err)
+			return nil, ErrDecryptFailed
+		}
+		wrapped := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(r, wrapped); err != nil {
+			k.Logger().Debug(err)
+			return nil, ErrDecryptFailed
+		}
+		enc = append(append(enc, size[:]...), wrapped...)
+		for _, key := range k.keys {
+			if b != nil {
+				break
+			}
+			if d, err := key.Decrypt(wrapped); err == nil && len(d) == 64 {
+				b = d
+			}
+		}
+	}
+	if b == nil {
+		k.Logger().Debug("ReadEncryptedKey: no key can unwrap the file key")
+		return nil, ErrDecryptFailed
+	}
+	ek := chacha20poly1305KeyFromBytes(b)
+	ek.encryptedKey = enc
+	ek.logger = k.Logger()
+	return wrappedFileKey{ek}, nil
+}
+
+// ReadEncryptedKey reads an encrypted key and decrypts it with any of the
+// keys.
+func (k *MultiKey) ReadEncryptedKey(r io.Reader) (EncryptionKey, error) {
+	return k.readWrappedKey(r)
+}
+
+// DecryptKey decrypts an encrypted key with any of the keys.
+func (k *MultiKey) DecryptKey(encryptedKey []byte) (EncryptionKey, error) {
+	r := bytes.NewReader(encryptedKey)
+	ek, err := k.readWrappedKey(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		ek.Wipe()
+		return nil, ErrDecryptFailed
+	}
+	return ek, nil
+}
+
+// Encrypt encrypts data with a new key that is wrapped under each of the
+// keys.
+func (k *MultiKey) Encrypt(data []byte) ([]byte, error) {
+	return k.EncryptWithAAD(data, nil)
+}
+
+// EncryptWithAAD is like Encrypt, and it also authenticates additionalData.
+func (k *MultiKey) EncryptWithAAD(data, additionalData []byte) ([]byte, error) {
+	ek, err := k.NewKey()
+	if err != nil {
+		return nil, err
+	}
+	defer ek.Wipe()
+	enc, err := ek.EncryptWithAAD(data, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	return append(slices.Clone(ek.(wrappedFileKey).encryptedKey), enc...), nil
+}
+
+// Decrypt decrypts data that was encrypted with Encrypt, with any of the
+// keys.
+func (k *MultiKey) Decrypt(data []byte) ([]byte, error) {
+	return k.DecryptWithAAD(data, nil)
+}
+
+// DecryptWithAAD decrypts data that was encrypted with EncryptWithAAD and the
+// same additional data, with any of the keys.
+func (k *MultiKey) DecryptWithAAD(data, additionalData []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != multiKeyVersion {
+		return k.keys[0].DecryptWithAAD(data, additionalData)
+	}
+	r := bytes.NewReader(data)
+	ek, err := k.readWrappedKey(r)
+	if err != nil {
+		return nil, err
+	}
+	defer ek.Wipe()
+	return ek.DecryptWithAAD(data[len(data)-r.Len():], additionalData)
+}
+
+// WriteEncryptedKey isn't supported with MultiKeys.
+func (k *MultiKey) WriteEncryptedKey(w io.Writer) error {
+	return errors.New("operation not supported with MultiKey")
+}
+
+// StartReader isn't supported with MultiKeys. Streams are encrypted with the
+// keys returned by NewKey.
+func (k *MultiKey) StartReader(ctx []byte, r io.Reader) (StreamReader, error) {
+	return nil, errors.New("operation not supported with MultiKey")
+}
+
+// StartWriter isn't supported with MultiKeys. Streams are encrypted with the
+// keys returned by NewKey.
+func (k *MultiKey) StartWriter(ctx []byte, w io.Writer) (StreamWriter, error) {
+	return nil, errors.New("operation not supported with MultiKey")
+}
+
+// StartAppendWriter isn't supported with MultiKeys.
+func (k *MultiKey) StartAppendWriter(ctx []byte, rw TruncatableStream) (StreamWriter, int64, error) {
+	return nil, 0, errors.New("operation not supported with MultiKey")
+}
+
+// Wipe wipes all the keys.
+func (k *MultiKey) Wipe() {
+	for _, key := range k.keys {
+		key.Wipe()
+	}
+}
@@ -0,0 +1,150 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMultiKey(t *testing.T) {
+	primary, err := CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateAESMasterKeyForTest: %v", err)
+	}
+	defer primary.Wipe()
+	recovery, err := CreateChacha20Poly1305MasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateChacha20Poly1305MasterKeyForTest: %v", err)
+	}
+	defer recovery.Wipe()
+	auditor, err := CreateX25519MasterKey()
+	if err != nil {
+		t.Fatalf("CreateX25519MasterKey: %v", err)
+	}
+	defer auditor.Wipe()
+	other, err := CreateChacha20Poly1305MasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateChacha20Poly1305MasterKeyForTest: %v", err)
+	}
+	defer other.Wipe()
+
+	mk, err := NewMultiKey(primary, recovery, auditor.(*X25519Key).PublicKey())
+	if err != nil {
+		t.Fatalf("NewMultiKey: %v", err)
+	}
+	ek, err := mk.NewKey()
+	if err != nil {
+		t.Fatalf("mk.NewKey: %v", err)
+	}
+	defer ek.Wipe()
+	var buf bytes.Buffer
+	if err := ek.WriteEncryptedKey(&buf); err != nil {
+		t.Fatalf("ek.WriteEncryptedKey: %v", err)
+	}
+	data := []byte("Hello world")
+	enc, err := mk.Encrypt(data)
+	if err != nil {
+		t.Fatalf("mk.Encrypt: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		key  EncryptionKey
+		ok   bool
+	}{
+		{"primary", primary, true},
+		{"recovery", recovery, true},
+		{"auditor", auditor, true},
+		{"other", other, false},
+	} {
+		id, err := NewMultiKey(tc.key)
+		if err != nil {
+			t.Fatalf("NewMultiKey: %v", err)
+		}
+		ek2, err := id.ReadEncryptedKey(bytes.NewReader(buf.Bytes()))
+		if !tc.ok {
+			if err != ErrDecryptFailed {
+				t.Errorf("%s: ReadEncryptedKey() err = %v, want %v", tc.name, err, ErrDecryptFailed)
+			}
+			if _, err := id.Decrypt(enc); err != ErrDecryptFailed {
+				t.Errorf("%s: Decrypt() err = %v, want %v", tc.name, err, ErrDecryptFailed)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: ReadEncryptedKey: %v", tc.name, err)
+		}
+		if want, got := ek.(wrappedFileKey).key(), ek2.(wrappedFileKey).key(); !reflect.DeepEqual(want, got) {
+			t.Errorf("%s: Unexpected key. Want %+v, got %+v", tc.name, want, got)
+		}
+		ek2.Wipe()
+		ek3, err := id.DecryptKey(buf.Bytes())
+		if err != nil {
+			t.Fatalf("%s: DecryptKey: %v", tc.name, err)
+		}
+		ek3.Wipe()
+		dec, err := id.Decrypt(enc)
+		if err != nil {
+			t.Fatalf("%s: Decrypt: %v", tc.name, err)
+		}
+		if !bytes.Equal(data, dec) {
+			t.Errorf("%s: Decrypt() = %q, want %q", tc.name, dec, data)
+		}
+	}
+}
+
+func TestMultiKeyUnwrapped(t *testing.T) {
+	primary, err := CreateChacha20Poly1305MasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateChacha20Poly1305MasterKeyForTest: %v", err)
+	}
+	defer primary.Wipe()
+	ek, err := primary.NewKey()
+	if err != nil {
+		t.Fatalf("primary.NewKey: %v", err)
+	}
+	defer ek.Wipe()
+	var buf bytes.Buffer
+	if err := ek.WriteEncryptedKey(&buf); err != nil {
+		t.Fatalf("ek.WriteEncryptedKey: %v", err)
+	}
+
+	mk, err := NewMultiKey(primary)
+	if err != nil {
+		t.Fatalf("NewMultiKey: %v", err)
+	}
+	ek2, err := mk.ReadEncryptedKey(&buf)
+	if err != nil {
+		t.Fatalf("mk.ReadEncryptedKey: %v", err)
+	}
+	defer ek2.Wipe()
+	if want, got := ek.(*Chacha20Poly1305Key).key(), ek2.(*Chacha20Poly1305Key).key(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Unexpected key. Want %+v, got %+v", want, got)
+	}
+	if _, err := NewMultiKey(); err == nil {
+		t.Error("NewMultiKey() should have failed, but didn't")
+	}
+}
@@ -0,0 +1,181 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	paperKeyBegin = "-----BEGIN C2FMZQ STORAGE KEY-----"
+	paperKeyEnd   = "-----END C2FMZQ STORAGE KEY-----"
+	paperKeyQR    = "C2FMZQKEY:"
+
+	// The number of bytes on each line of a paper key.
+	paperKeyLineSize = 20
+)
+
+// ErrInvalidPaperKey indicates that a paper key can't be parsed, e.g. a line
+// is missing or was mistyped.
+var ErrInvalidPaperKey = errors.New("invalid paper key")
+
+var paperKeyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ExportPaperKey returns the content of a master key file as a text block
+// that can be printed, e.g. for an offline copy in a disaster recovery plan.
+// The key remains encrypted with its passphrase. Each line has a number and a
+// checksum, so that typing errors are found when the key is recovered with
+// ImportPaperKey.
+//
+//	-----BEGIN C2FMZQ STORAGE KEY-----
+//	01: AEAAAAAA AAAAAAAA AAAAAAAA AAAAAAAA TPUJA
+//	...
+//	SHA256: 2DP4HFXM
+//	-----END C2FMZQ STORAGE KEY-----
+func ExportPaperKey(file string) (string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	sb.WriteString(paperKeyBegin + "\n")
+	for i, n := 0, 1; i < len(b); i, n = i+paperKeyLineSize, n+1 {
+		chunk := b[i:min(i+paperKeyLineSize, len(b))]
+		data := paperKeyEncoding.EncodeToString(chunk)
+		fmt.Fprintf(&sb, "%02d:", n)
+		for j := 0; j < len(data); j += 8 {
+			sb.WriteString(" " + data[j:min(j+8, len(data))])
+		}
+		sb.WriteString(" " + paperKeyLineChecksum(n, chunk) + "\n")
+	}
+	sb.WriteString("SHA256: " + paperKeyChecksum(b) + "\n")
+	sb.WriteString(paperKeyEnd + "\n")
+	return sb.String(), nil
+}
+
+// ExportPaperKeyQR returns the content of a master key file as a compact
+// payload for a QR code. It only uses characters of the QR alphanumeric mode.
+// It is recovered with ImportPaperKey.
+func ExportPaperKeyQR(file string) (string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return paperKeyQR + paperKeyEncoding.EncodeToString(b) + paperKeyChecksum(b), nil
+}
+
+// ImportPaperKey parses a paper key returned by ExportPaperKey or
+// ExportPaperKeyQR, verifies its checksums, and saves the master key file.
+// Spaces and letter case are ignored, and the digits 0, 1, and 8 are read as
+// the letters O, I, and B.
+func ImportPaperKey(text, file string) error {
+	b, err := parsePaperKey(text)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(file, b, false)
+}
+
+func paperKeyLineChecksum(n int, chunk []byte) string {
+	h := sha256.Sum256(append([]byte{byte(n)}, chunk...))
+	return paperKeyEncoding.EncodeToString(h[:3])
+}
+
+func paperKeyChecksum(b []byte) string {
+	h := sha256.Sum256(b)
+	return paperKeyEncoding.EncodeToString(h[:5])
+}
+
+// normalizePaperKey removes the spaces, and fixes the case and the digits
+// that are commonly mistyped.
+func normalizePaperKey(s string) string {
+	return strings.NewReplacer(" ", "", "\t", "", "0", "O", "1", "I", "8", "B").Replace(strings.ToUpper(s))
+}
+
+func parsePaperKey(text string) ([]byte, error) {
+	text = strings.TrimSpace(text)
+	if qr, ok := strings.CutPrefix(strings.ToUpper(text), paperKeyQR); ok {
+		qr = normalizePaperKey(qr)
+		if len(qr) < 8 {
+			return nil, ErrInvalidPaperKey
+		}
+		b, err := paperKeyEncoding.DecodeString(qr[:len(qr)-8])
+		if err != nil || paperKeyChecksum(b) != qr[len(qr)-8:] {
+			return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidPaperKey)
+		}
+		return b, nil
+	}
+
+	var b []byte
+	var sum string
+	var begin, end bool
+	next := 1
+	s := bufio.NewScanner(strings.NewReader(text))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case line == "":
+		case normalizePaperKey(line) == normalizePaperKey(paperKeyBegin):
+			begin = true
+		case normalizePaperKey(line) == normalizePaperKey(paperKeyEnd):
+			end = true
+		case !begin || end:
+		case strings.HasPrefix(strings.ToUpper(line), "SHA256:"):
+			sum = normalizePaperKey(line[len("SHA256:"):])
+		default:
+			num, data, ok := strings.Cut(line, ":")
+			if !ok {
+				return nil, fmt.Errorf("%w: unexpected line %q", ErrInvalidPaperKey, line)
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(num))
+			if err != nil || n != next {
+				return nil, fmt.Errorf("%w: expected line %02d, got %q", ErrInvalidPaperKey, next, num)
+			}
+			next++
+			data = normalizePaperKey(data)
+			if len(data) < 5 {
+				return nil, fmt.Errorf("%w: line %02d is too short", ErrInvalidPaperKey, n)
+			}
+			chunk, err := paperKeyEncoding.DecodeString(data[:len(data)-5])
+			if err != nil || paperKeyLineChecksum(n, chunk) != data[len(data)-5:] {
+				return nil, fmt.Errorf("%w: line %02d: checksum mismatch", ErrInvalidPaperKey, n)
+			}
+			b = append(b, chunk...)
+		}
+	}
+	if !begin || !end || len(b) == 0 {
+		return nil, fmt.Errorf("%w: incomplete", ErrInvalidPaperKey)
+	}
+	if sum != paperKeyChecksum(b) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidPaperKey)
+	}
+	return b, nil
+}
@@ -0,0 +1,106 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPaperKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	mk, err := CreateChacha20Poly1305MasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateChacha20Poly1305MasterKeyForTest: %v", err)
+	}
+	defer mk.Wipe()
+	if err := mk.Save([]byte("foo"), keyFile); err != nil {
+		t.Fatalf("mk.Save: %v", err)
+	}
+
+	text, err := ExportPaperKey(keyFile)
+	if err != nil {
+		t.Fatalf("ExportPaperKey: %v", err)
+	}
+	qr, err := ExportPaperKeyQR(keyFile)
+	if err != nil {
+		t.Fatalf("ExportPaperKeyQR: %v", err)
+	}
+	if i := strings.IndexFunc(qr, func(r rune) bool {
+		return !strings.ContainsRune("0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:", r)
+	}); i >= 0 {
+		t.Errorf("ExportPaperKeyQR() = %q, has non-alphanumeric character at %d", qr, i)
+	}
+
+	for i, in := range []string{
+		text,
+		strings.ToLower(text),
+		strings.ReplaceAll(strings.ReplaceAll(text, "O", "0"), "I", "1"),
+		"Printed on Monday\n\n" + text + "\nKeep in a safe place\n",
+		qr,
+	} {
+		file := filepath.Join(dir, "imported")
+		if err := ImportPaperKey(in, file); err != nil {
+			t.Fatalf("[%d] ImportPaperKey: %v", i, err)
+		}
+		got, err := ReadMasterKey([]byte("foo"), file)
+		if err != nil {
+			t.Fatalf("[%d] ReadMasterKey: %v", i, err)
+		}
+		if KeyID(got) != KeyID(mk) {
+			t.Errorf("[%d] ReadMasterKey returned a different key", i)
+		}
+		got.Wipe()
+	}
+
+	mistype := func(s string, i int) string {
+		c := "A"
+		if s[i] == 'A' {
+			c = "B"
+		}
+		return s[:i] + c + s[i+1:]
+	}
+	lines := strings.Split(text, "\n")
+	typo := append([]string(nil), lines...)
+	typo[2] = mistype(typo[2], 5)
+	missing := append(append([]string(nil), lines[:2]...), lines[3:]...)
+	for _, tc := range []struct {
+		name string
+		text string
+		want string
+	}{
+		{"typo", strings.Join(typo, "\n"), "line 02: checksum mismatch"},
+		{"missing line", strings.Join(missing, "\n"), "expected line 02"},
+		{"truncated", strings.Join(lines[:3], "\n"), "incomplete"},
+		{"qr typo", mistype(qr, len(qr)-1), "checksum mismatch"},
+	} {
+		err := ImportPaperKey(tc.text, filepath.Join(dir, "bad"))
+		if !errors.Is(err, ErrInvalidPaperKey) || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: ImportPaperKey() = %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"io"
+	"sync"
+)
+
+// chunkJob is a chunk of a stream that is encrypted or decrypted by a
+// chunkPipeline.
+type chunkJob struct {
+	// c is the chunk number, used to compute the nonce.
+	c int64
+	// in is the input of the job, in a buffer from the chunk pool.
+	in *[]byte
+	// n is the size of the input.
+	n int
+	// kind is the kind of chunk. When decrypting, it is chunkFinal for
+	// short chunks.
+	kind byte
+	// version is the stream format version, when decrypting.
+	version byte
+	// dst is the buffer of the output, when decrypting. The input is kept
+	// intact.
+	dst *[]byte
+
+	out  []byte
+	err  error
+	done chan struct{}
+}
+
+// release returns the buffers of the job to the chunk pool.
+func (j *chunkJob) release() {
+	if j.in != nil {
+		putChunkBuffer(j.in)
+		j.in = nil
+	}
+	if j.dst != nil {
+		putChunkBuffer(j.dst)
+		j.dst = nil
+	}
+	j.out = nil
+}
+
+// chunkPipeline encrypts or decrypts the chunks of a stream on multiple
+// goroutines, and returns the results in order. The number of chunks in
+// flight is bounded by the size of the re-ordering window.
+type chunkPipeline struct {
+	work    chan *chunkJob
+	pending []*chunkJob
+	window  int
+	once    sync.Once
+}
+
+// newChunkPipeline starts workers goroutines that call fn for each job. The
+// goroutines stop when the pipeline is closed.
+func newChunkPipeline(workers int, fn func(*chunkJob)) *chunkPipeline {
+	p := &chunkPipeline{
+		work:   make(chan *chunkJob),
+		window: 2 * workers,
+	}
+	for range workers {
+		go func() {
+			for j := range p.work {
+				fn(j)
+				close(j.done)
+			}
+		}()
+	}
+	return p
+}
+
+// full returns true when the re-ordering window is full, i.e. next must be
+// called before submit.
+func (p *chunkPipeline) full() bool {
+	return len(p.pending) >= p.window
+}
+
+// submit sends a job to the workers.
+func (p *chunkPipeline) submit(j *chunkJob) {
+	j.done = make(chan struct{})
+	p.pending = append(p.pending, j)
+	p.work <- j
+}
+
+// next waits for the oldest job to be done, and returns it. It returns nil
+// when there are no pending jobs.
+func (p *chunkPipeline) next() *chunkJob {
+	if len(p.pending) == 0 {
+		return nil
+	}
+	j := p.pending[0]
+	p.pending[0] = nil
+	p.pending = p.pending[1:]
+	<-j.done
+	return j
+}
+
+// reset discards all the pending jobs.
+func (p *chunkPipeline) reset() {
+	for j := p.next(); j != nil; j = p.next() {
+		j.release()
+	}
+}
+
+// close discards all the pending jobs, and stops the workers.
+func (p *chunkPipeline) close() {
+	p.reset()
+	p.once.Do(func() { close(p.work) })
+}
+
+// chunkReader reads the encrypted chunks of a stream ahead, and submits them
+// to a chunkPipeline to be decrypted.
+type chunkReader struct {
+	p            *chunkPipeline
+	r            io.Reader
+	encChunkSize int
+	// version is the stream format version, copied to the jobs.
+	version byte
+	// next is the number of the next chunk to read.
+	next int64
+	eof  bool
+	err  error
+}
+
+// read returns the next decrypted chunk. The kind of the job is chunkFinal
+// when the chunk is short, i.e. it is the last chunk of the stream. It returns
+// io.EOF at the end of the stream.
+func (cr *chunkReader) read() (*chunkJob, error) {
+	for !cr.eof && !cr.p.full() {
+		in := getChunkBuffer()
+		n, err := io.ReadFull(cr.r, (*in)[:cr.encChunkSize])
+		if n > 0 {
+			kind := byte(chunkFull)
+			if n < cr.encChunkSize {
+				kind = chunkFinal
+			}
+			cr.p.submit(&chunkJob{c: cr.next, in: in, n: n, kind: kind, version: cr.version})
+			cr.next++
+		} else {
+			putChunkBuffer(in)
+		}
+		if err != nil {
+			cr.eof = true
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				cr.err = err
+			}
+		}
+	}
+	if j := cr.p.next(); j != nil {
+		return j, nil
+	}
+	if cr.err != nil {
+		return nil, cr.err
+	}
+	return nil, io.EOF
+}
+
+// stop stops the pipeline, and returns the input of the chunks that were read
+// ahead, starting with the input of j, which failed to decrypt.
+func (cr *chunkReader) stop(j *chunkJob) []byte {
+	rest := append([]byte(nil), (*j.in)[:j.n]...)
+	j.release()
+	for j := cr.p.next(); j != nil; j = cr.p.next() {
+		rest = append(rest, (*j.in)[:j.n]...)
+		j.release()
+	}
+	cr.p.close()
+	return rest
+}
+
+// seek discards the chunks that were read ahead. The next chunk to read is
+// next.
+func (cr *chunkReader) seek(next int64) {
+	cr.p.reset()
+	cr.next = next
+	cr.eof = false
+	cr.err = nil
+}
@@ -0,0 +1,127 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// The name of the key slot of the recovery key. Names that start with # are
+// reserved.
+const recoveryKeySlot = "#recovery"
+
+// AddRecoveryKey generates a recovery key that can also unlock mk, and adds
+// it to a key slots file, e.g. right after the key is created. The recovery
+// key is returned so that it can be escrowed, and isn't stored anywhere else.
+// It has 48 digits in groups of 6, and can be used as the passphrase of
+// ReadMasterKey, with or without the dashes.
+func AddRecoveryKey(mk MasterKey, file string) (string, error) {
+	return setRecoveryKey(mk, file, false)
+}
+
+// RotateRecoveryKey replaces the recovery key of a key slots file with a new
+// one, e.g. after it was used. The old recovery key can no longer unlock the
+// master key.
+func RotateRecoveryKey(mk MasterKey, file string) (string, error) {
+	return setRecoveryKey(mk, file, true)
+}
+
+// RevokeRecoveryKey removes the recovery key of a key slots file.
+func RevokeRecoveryKey(mk MasterKey, file string) error {
+	return RemoveKeySlot(mk, recoveryKeySlot, file)
+}
+
+// HasRecoveryKey returns true if a key slots file has a recovery key.
+func HasRecoveryKey(file string) (bool, error) {
+	names, err := KeySlots(file)
+	if err != nil {
+		return false, err
+	}
+	for _, n := range names {
+		if n == recoveryKeySlot {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func setRecoveryKey(mk MasterKey, file string, rotate bool) (string, error) {
+	rk, err := newRecoveryKey()
+	if err != nil {
+		return "", err
+	}
+	if !rotate {
+		if err := addKeySlot(mk, recoveryKeySlot, normalizeRecoveryKey([]byte(rk)), file); err != nil {
+			return "", err
+		}
+		return rk, nil
+	}
+	ks, err := readKeySlots(file)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(ks.id, keyIDBytes(mk)) {
+		return "", errors.New("file contains a different key")
+	}
+	i := ks.index(recoveryKeySlot)
+	if i < 0 {
+		return "", ErrKeySlotNotFound
+	}
+	if ks.slots[i], err = encryptKeySlot(mk, normalizeRecoveryKey([]byte(rk))); err != nil {
+		return "", err
+	}
+	if err := ks.save(file); err != nil {
+		return "", err
+	}
+	return rk, nil
+}
+
+// newRecoveryKey returns 48 random digits in groups of 6.
+func newRecoveryKey() (string, error) {
+	groups := make([]string, 8)
+	for i := range groups {
+		n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+		if err != nil {
+			return "", err
+		}
+		groups[i] = fmt.Sprintf("%06d", n)
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// normalizeRecoveryKey removes the dashes and spaces from a recovery key.
+func normalizeRecoveryKey(rk []byte) []byte {
+	out := make([]byte, 0, len(rk))
+	for _, c := range rk {
+		if c != '-' && c != ' ' {
+			out = append(out, c)
+		}
+	}
+	return out
+}
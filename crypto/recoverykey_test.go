@@ -0,0 +1,105 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRecoveryKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "key")
+	mk, err := CreateChacha20Poly1305MasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateChacha20Poly1305MasterKeyForTest: %v", err)
+	}
+	defer mk.Wipe()
+	if err := AddKeySlot(mk, "admin", []byte("foo"), file); err != nil {
+		t.Fatalf("AddKeySlot: %v", err)
+	}
+	if err := AddKeySlot(mk, recoveryKeySlot, []byte("foo"), file); err == nil {
+		t.Error("AddKeySlot with reserved name should have failed, but didn't")
+	}
+	if ok, err := HasRecoveryKey(file); err != nil || ok {
+		t.Errorf("HasRecoveryKey() = %v, %v, want false", ok, err)
+	}
+	if _, err := RotateRecoveryKey(mk, file); err != ErrKeySlotNotFound {
+		t.Errorf("RotateRecoveryKey() = %v, want %v", err, ErrKeySlotNotFound)
+	}
+
+	rk, err := AddRecoveryKey(mk, file)
+	if err != nil {
+		t.Fatalf("AddRecoveryKey: %v", err)
+	}
+	if !regexp.MustCompile(`^[0-9]{6}(-[0-9]{6}){7}$`).MatchString(rk) {
+		t.Errorf("AddRecoveryKey() = %q, unexpected format", rk)
+	}
+	if _, err := AddRecoveryKey(mk, file); err != ErrKeySlotExists {
+		t.Errorf("AddRecoveryKey() again = %v, want %v", err, ErrKeySlotExists)
+	}
+	if ok, err := HasRecoveryKey(file); err != nil || !ok {
+		t.Errorf("HasRecoveryKey() = %v, %v, want true", ok, err)
+	}
+	for _, p := range []string{rk, strings.ReplaceAll(rk, "-", ""), strings.ReplaceAll(rk, "-", " "), "foo"} {
+		got, err := ReadMasterKey([]byte(p), file)
+		if err != nil {
+			t.Fatalf("ReadMasterKey(%q): %v", p, err)
+		}
+		if KeyID(got) != KeyID(mk) {
+			t.Errorf("ReadMasterKey(%q) returned a different key", p)
+		}
+		got.Wipe()
+	}
+	if err := mk.ChangePassphrase([]byte(rk), []byte("bar"), file); err == nil {
+		t.Error("ChangePassphrase of the recovery key should have failed, but didn't")
+	}
+
+	rk2, err := RotateRecoveryKey(mk, file)
+	if err != nil {
+		t.Fatalf("RotateRecoveryKey: %v", err)
+	}
+	if rk2 == rk {
+		t.Error("RotateRecoveryKey returned the same key")
+	}
+	if _, err := ReadMasterKey([]byte(rk), file); err != ErrDecryptFailed {
+		t.Errorf("ReadMasterKey(old recovery key) = %v, want %v", err, ErrDecryptFailed)
+	}
+	got, err := ReadMasterKey([]byte(rk2), file)
+	if err != nil {
+		t.Fatalf("ReadMasterKey(new recovery key): %v", err)
+	}
+	got.Wipe()
+
+	if err := RevokeRecoveryKey(mk, file); err != nil {
+		t.Fatalf("RevokeRecoveryKey: %v", err)
+	}
+	if _, err := ReadMasterKey([]byte(rk2), file); err != ErrDecryptFailed {
+		t.Errorf("ReadMasterKey(revoked recovery key) = %v, want %v", err, ErrDecryptFailed)
+	}
+	if ok, err := HasRecoveryKey(file); err != nil || ok {
+		t.Errorf("HasRecoveryKey() = %v, %v, want false", ok, err)
+	}
+}
@@ -0,0 +1,150 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// The version byte of master key files that use the scrypt KDF.
+const scryptVersion = 11
+
+// ScryptParams are the parameters of the scrypt KDF. N is the CPU/memory cost
+// and must be a power of 2 greater than 1, R is the block size, and P is the
+// parallelization.
+type ScryptParams struct {
+	N, R, P int
+}
+
+// DefaultScryptParams uses 128 MiB of memory, like the default argon2
+// parameters.
+var DefaultScryptParams = ScryptParams{N: 1 << 17, R: 8, P: 1}
+
+// SaveWithScrypt encrypts mk with a key derived from passphrase with scrypt
+// instead of the default KDF, and saves it to file. The file is read with
+// ReadMasterKey. ChangePassphrase keeps the scrypt parameters of the file.
+// TPM keys can't be saved with scrypt.
+func SaveWithScrypt(mk MasterKey, passphrase []byte, file string, params ScryptParams) error {
+	version, key, err := masterKeyBytes(mk)
+	if err != nil {
+		return err
+	}
+	defer clear(key)
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	dk, err := scrypt.Key(passphrase, salt, params.N, params.R, params.P, 32)
+	if err != nil {
+		return err
+	}
+	defer clear(dk)
+	ccp, err := chacha20poly1305.NewX(dk)
+	if err != nil {
+		mk.Logger().Debug(err)
+		return ErrEncryptFailed
+	}
+	nonce := make([]byte, ccp.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		mk.Logger().Debug(err)
+		return ErrEncryptFailed
+	}
+	data := []byte{scryptVersion}
+	data = append(data, salt...)
+	data = binary.LittleEndian.AppendUint32(data, uint32(params.N))
+	data = binary.LittleEndian.AppendUint32(data, uint32(params.R))
+	data = binary.LittleEndian.AppendUint32(data, uint32(params.P))
+	data = ccp.Seal(append(data, nonce...), nonce, append([]byte{version}, key...), nil)
+	return writeKeyFile(file, data, false)
+}
+
+// readScryptParams returns the scrypt parameters of file, if it was saved
+// with SaveWithScrypt.
+func readScryptParams(file string) (ScryptParams, bool) {
+	f, err := os.Open(file)
+	if err != nil {
+		return ScryptParams{}, false
+	}
+	defer f.Close()
+	b := make([]byte, 1+16+12)
+	if _, err := io.ReadFull(f, b); err != nil || b[0] != scryptVersion {
+		return ScryptParams{}, false
+	}
+	return ScryptParams{
+		N: int(binary.LittleEndian.Uint32(b[17:])),
+		R: int(binary.LittleEndian.Uint32(b[21:])),
+		P: int(binary.LittleEndian.Uint32(b[25:])),
+	}, true
+}
+
+// readScryptMasterKey reads a master key that was saved with SaveWithScrypt
+// and decrypts it.
+func readScryptMasterKey(passphrase []byte, file string, opts ...Option) (MasterKey, error) {
+	var opt option
+	opt.apply(opts)
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 1+16+12+chacha20poly1305.NonceSizeX || b[0] != scryptVersion {
+		return nil, ErrDecryptFailed
+	}
+	if opt.hasTPM() {
+		opt.logger.Error("ReadMasterKey: TPM option selected but master key was created without TPM")
+		return nil, ErrDecryptFailed
+	}
+	b = b[1:]
+	salt, b := b[:16], b[16:]
+	n, b := int(binary.LittleEndian.Uint32(b)), b[4:]
+	r, b := int(binary.LittleEndian.Uint32(b)), b[4:]
+	p, b := int(binary.LittleEndian.Uint32(b)), b[4:]
+	dk, err := scrypt.Key(passphrase, salt, n, r, p, 32)
+	if err != nil {
+		opt.logger.Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	defer clear(dk)
+	ccp, err := chacha20poly1305.NewX(dk)
+	if err != nil {
+		opt.logger.Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	key, err := ccp.Open(nil, b[:ccp.NonceSize()], b[ccp.NonceSize():], nil)
+	if err != nil {
+		opt.logger.Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	defer clear(key)
+	if len(key) < 1 {
+		return nil, errors.New("invalid key")
+	}
+	return masterKeyFromBytes(key[0], key[1:], opt)
+}
@@ -0,0 +1,82 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestScrypt(t *testing.T) {
+	params := ScryptParams{N: 1 << 10, R: 8, P: 1}
+	for _, tc := range []struct {
+		name   string
+		create func() (MasterKey, error)
+	}{
+		{"AES", func() (MasterKey, error) { return CreateAESMasterKey() }},
+		{"Chacha20Poly1305", CreateChacha20Poly1305MasterKeyForTest},
+		{"X25519", func() (MasterKey, error) { return CreateX25519MasterKey() }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mk, err := tc.create()
+			if err != nil {
+				t.Fatalf("create: %v", err)
+			}
+			defer mk.Wipe()
+			file := filepath.Join(t.TempDir(), "key")
+			if err := SaveWithScrypt(mk, []byte("foo"), file, ScryptParams{N: 3, R: 8, P: 1}); err == nil {
+				t.Fatal("SaveWithScrypt with invalid N should have failed, but didn't")
+			}
+			if err := SaveWithScrypt(mk, []byte("foo"), file, params); err != nil {
+				t.Fatalf("SaveWithScrypt: %v", err)
+			}
+			if _, err := ReadMasterKey([]byte("bar"), file); err != ErrDecryptFailed {
+				t.Errorf("ReadMasterKey(bar) = %v, want %v", err, ErrDecryptFailed)
+			}
+			got, err := ReadMasterKey([]byte("foo"), file)
+			if err != nil {
+				t.Fatalf("ReadMasterKey: %v", err)
+			}
+			defer got.Wipe()
+			if KeyID(got) != KeyID(mk) {
+				t.Error("ReadMasterKey returned a different key")
+			}
+
+			if err := mk.ChangePassphrase([]byte("foo"), []byte("bar"), file); err != nil {
+				t.Fatalf("ChangePassphrase: %v", err)
+			}
+			if p, ok := readScryptParams(file); !ok || p != params {
+				t.Errorf("readScryptParams() = %v, %v, want %v, true", p, ok, params)
+			}
+			got2, err := ReadMasterKey([]byte("bar"), file)
+			if err != nil {
+				t.Fatalf("ReadMasterKey(bar): %v", err)
+			}
+			defer got2.Wipe()
+			if KeyID(got2) != KeyID(mk) {
+				t.Error("ReadMasterKey returned a different key")
+			}
+		})
+	}
+}
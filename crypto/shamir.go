@@ -0,0 +1,220 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+)
+
+const (
+	// The version byte of share files.
+	shareVersion = 7
+
+	// The size of the header of a master key share.
+	shareHeaderSize = 10 // 1 (key version) + 1 (threshold) + 8 (check)
+)
+
+var (
+	// Indicates that shares can't be combined, e.g. because there are
+	// fewer of them than the threshold, or they are from different splits.
+	ErrInvalidShares = errors.New("invalid shares")
+
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	// Exponent and logarithm tables of GF(2^8) with the AES polynomial
+	// x^8+x^4+x^3+x+1, and generator 3.
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = byte(i)
+		x ^= x << 1
+		if x&0x100 != 0 {
+			x ^= 0x11b
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// Split splits secret into n shares with Shamir's secret sharing, such that
+// any k of them can be combined with Combine to recover the secret, and fewer
+// than k reveal nothing about it. Each share is one byte longer than the
+// secret. At most 255 shares can be created.
+func Split(secret []byte, n, k int) ([][]byte, error) {
+	if k < 1 || n < k || n > 255 {
+		return nil, errors.New("invalid number of shares or threshold")
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret")
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, 1+len(secret))
+		shares[i][0] = byte(i + 1)
+	}
+	// Each byte of the secret is the constant term of a random polynomial
+	// of degree k-1. The shares are points on the polynomials.
+	coef := make([]byte, k)
+	defer clear(coef)
+	for j, s := range secret {
+		coef[0] = s
+		if _, err := rand.Read(coef[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			x := shares[i][0]
+			var y byte
+			for c := k - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coef[c]
+			}
+			shares[i][1+j] = y
+		}
+	}
+	return shares, nil
+}
+
+// Combine recovers a secret from the shares returned by Split. It must be
+// given at least the threshold number of shares. Otherwise, the result is
+// wrong, and there is no way to tell.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, ErrInvalidShares
+	}
+	size := len(shares[0])
+	seen := make(map[byte]bool)
+	for _, s := range shares {
+		if len(s) != size || size < 2 || s[0] == 0 || seen[s[0]] {
+			return nil, ErrInvalidShares
+		}
+		seen[s[0]] = true
+	}
+	// Lagrange interpolation at x=0.
+	secret := make([]byte, size-1)
+	for i, si := range shares {
+		basis := byte(1)
+		for j, sj := range shares {
+			if i != j {
+				basis = gfMul(basis, gfDiv(sj[0], sj[0]^si[0]))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(basis, si[1+b])
+		}
+	}
+	return secret, nil
+}
+
+// shareCheck returns a value that verifies that a master key was combined
+// correctly.
+func shareCheck(version byte, key []byte) []byte {
+	h := sha256.Sum256(append([]byte{version}, key...))
+	return h[:8]
+}
+
+// SplitMasterKey splits mk into n shares, such that any k of them can be
+// combined with CombineMasterKey to recover it. The shares can be saved by
+// their custodians with SaveShare. TPM keys can't be split.
+func SplitMasterKey(mk MasterKey, n, k int) ([][]byte, error) {
+	version, key, err := masterKeyBytes(mk)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	parts, err := Split(key, n, k)
+	if err != nil {
+		return nil, err
+	}
+	hdr := append([]byte{version, byte(k)}, shareCheck(version, key)...)
+	shares := make([][]byte, n)
+	for i, p := range parts {
+		shares[i] = append(append([]byte(nil), hdr...), p...)
+		clear(p)
+	}
+	return shares, nil
+}
+
+// CombineMasterKey recovers a master key from at least the threshold number of
+// shares returned by SplitMasterKey.
+func CombineMasterKey(shares [][]byte, opts ...Option) (MasterKey, error) {
+	var opt option
+	opt.apply(opts)
+	if len(shares) == 0 || len(shares[0]) < shareHeaderSize {
+		return nil, ErrInvalidShares
+	}
+	hdr := shares[0][:shareHeaderSize]
+	parts := make([][]byte, len(shares))
+	for i, s := range shares {
+		if len(s) < shareHeaderSize || subtle.ConstantTimeCompare(s[:shareHeaderSize], hdr) != 1 {
+			opt.logger.Debug("CombineMasterKey: shares are from different splits")
+			return nil, ErrInvalidShares
+		}
+		parts[i] = s[shareHeaderSize:]
+	}
+	if len(shares) < int(hdr[1]) {
+		opt.logger.Debugf("CombineMasterKey: need %d shares, got %d", hdr[1], len(shares))
+		return nil, ErrInvalidShares
+	}
+	key, err := Combine(parts)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	version := hdr[0]
+	if subtle.ConstantTimeCompare(shareCheck(version, key), hdr[2:]) != 1 {
+		opt.logger.Debug("CombineMasterKey: check failed")
+		return nil, ErrInvalidShares
+	}
+	return masterKeyFromBytes(version, key, opt)
+}
+
+// SaveShare encrypts a share with passphrase and saves it to file.
+func SaveShare(share, passphrase []byte, file string) error {
+	return savePassphraseEncrypted(shareVersion, share, passphrase, kdfParams{}, file)
+}
+
+// ReadShare reads an encrypted share from file and decrypts it.
+func ReadShare(passphrase []byte, file string, opts ...Option) ([]byte, error) {
+	var opt option
+	opt.apply(opts)
+	return readPassphraseEncrypted(shareVersion, passphrase, file, opt.logger)
+}
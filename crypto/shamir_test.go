@@ -0,0 +1,154 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("This is a secret")
+	for _, tc := range []struct{ n, k int }{{1, 1}, {3, 2}, {5, 3}, {5, 5}, {255, 10}} {
+		shares, err := Split(secret, tc.n, tc.k)
+		if err != nil {
+			t.Fatalf("Split(%d, %d): %v", tc.n, tc.k, err)
+		}
+		if len(shares) != tc.n {
+			t.Fatalf("Split(%d, %d) returned %d shares", tc.n, tc.k, len(shares))
+		}
+		// Any k shares recover the secret.
+		for start := 0; start+tc.k <= tc.n; start += tc.k {
+			got, err := Combine(shares[start : start+tc.k])
+			if err != nil {
+				t.Fatalf("Combine: %v", err)
+			}
+			if !bytes.Equal(got, secret) {
+				t.Errorf("Split(%d, %d): Combine(shares[%d:%d]) = %q, want %q", tc.n, tc.k, start, start+tc.k, got, secret)
+			}
+		}
+		// Fewer than k shares don't.
+		if tc.k > 1 {
+			got, err := Combine(shares[:tc.k-1])
+			if err != nil {
+				t.Fatalf("Combine: %v", err)
+			}
+			if bytes.Equal(got, secret) {
+				t.Errorf("Split(%d, %d): Combine(%d shares) recovered the secret", tc.n, tc.k, tc.k-1)
+			}
+		}
+	}
+
+	for _, tc := range []struct{ n, k int }{{0, 0}, {2, 3}, {256, 2}} {
+		if _, err := Split(secret, tc.n, tc.k); err == nil {
+			t.Errorf("Split(%d, %d) should have failed, but didn't", tc.n, tc.k)
+		}
+	}
+	shares, err := Split(secret, 3, 2)
+	if err != nil {
+		t.Fatalf("Split: %v", err)
+	}
+	if _, err := Combine([][]byte{shares[0], shares[0]}); err != ErrInvalidShares {
+		t.Errorf("Combine(duplicate shares) = %v, want %v", err, ErrInvalidShares)
+	}
+}
+
+func TestSplitMasterKey(t *testing.T) {
+	aesKey, err := CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateAESMasterKeyForTest: %v", err)
+	}
+	defer aesKey.Wipe()
+	ccKey, err := CreateChacha20Poly1305MasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateChacha20Poly1305MasterKeyForTest: %v", err)
+	}
+	defer ccKey.Wipe()
+	xKey, err := CreateX25519MasterKey()
+	if err != nil {
+		t.Fatalf("CreateX25519MasterKey: %v", err)
+	}
+	defer xKey.Wipe()
+
+	for _, mk := range []MasterKey{aesKey, ccKey, xKey} {
+		t.Run(fmt.Sprintf("%T", mk), func(t *testing.T) {
+			shares, err := SplitMasterKey(mk, 5, 3)
+			if err != nil {
+				t.Fatalf("SplitMasterKey: %v", err)
+			}
+			dir := t.TempDir()
+			for i, s := range shares {
+				if err := SaveShare(s, []byte(fmt.Sprintf("custodian%d", i)), filepath.Join(dir, fmt.Sprintf("share%d", i))); err != nil {
+					t.Fatalf("SaveShare: %v", err)
+				}
+			}
+			var read [][]byte
+			for _, i := range []int{4, 1, 2} {
+				s, err := ReadShare([]byte(fmt.Sprintf("custodian%d", i)), filepath.Join(dir, fmt.Sprintf("share%d", i)))
+				if err != nil {
+					t.Fatalf("ReadShare: %v", err)
+				}
+				read = append(read, s)
+			}
+			if _, err := ReadShare([]byte("custodian0"), filepath.Join(dir, "share1")); err == nil {
+				t.Error("ReadShare with wrong passphrase should have failed, but didn't")
+			}
+
+			got, err := CombineMasterKey(read)
+			if err != nil {
+				t.Fatalf("CombineMasterKey: %v", err)
+			}
+			defer got.Wipe()
+			if reflect.TypeOf(got) != reflect.TypeOf(mk) {
+				t.Fatalf("CombineMasterKey() returned %T, want %T", got, mk)
+			}
+			data := []byte("Hello world")
+			enc, err := mk.Encrypt(data)
+			if err != nil {
+				t.Fatalf("mk.Encrypt: %v", err)
+			}
+			dec, err := got.Decrypt(enc)
+			if err != nil {
+				t.Fatalf("got.Decrypt: %v", err)
+			}
+			if !bytes.Equal(dec, data) {
+				t.Errorf("Decrypt() = %q, want %q", dec, data)
+			}
+
+			if _, err := CombineMasterKey(read[:2]); err != ErrInvalidShares {
+				t.Errorf("CombineMasterKey(2 shares) = %v, want %v", err, ErrInvalidShares)
+			}
+			other, err := SplitMasterKey(mk, 5, 3)
+			if err != nil {
+				t.Fatalf("SplitMasterKey: %v", err)
+			}
+			if _, err := CombineMasterKey([][]byte{read[0], read[1], other[0]}); err != ErrInvalidShares {
+				t.Errorf("CombineMasterKey(mixed shares) = %v, want %v", err, ErrInvalidShares)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+)
+
+// The version byte of master key files that require several passphrases.
+const thresholdVersion = 8
+
+// ErrThresholdKey indicates that a master key file requires several
+// passphrases to unlock. It must be read with a ThresholdUnlocker.
+var ErrThresholdKey = errors.New("master key requires several passphrases")
+
+// SaveThresholdMasterKey saves mk to file such that m of the n passphrases
+// are needed to unlock it, e.g. for dual control. The master key is split
+// with SplitMasterKey, and each share is encrypted with one of the
+// passphrases. The passphrases must be different. The file can be read with
+// a ThresholdUnlocker.
+func SaveThresholdMasterKey(mk MasterKey, passphrases [][]byte, m int, file string) error {
+	for i := range passphrases {
+		for j := i + 1; j < len(passphrases); j++ {
+			if bytes.Equal(passphrases[i], passphrases[j]) {
+				return errors.New("passphrases must be different")
+			}
+		}
+	}
+	shares, err := SplitMasterKey(mk, len(passphrases), m)
+	if err != nil {
+		return err
+	}
+	data := []byte{thresholdVersion, byte(m), byte(len(shares))}
+	for i, share := range shares {
+		enc, err := encryptWithPassphrase(shareVersion, share, passphrases[i], kdfParams{})
+		clear(share)
+		if err != nil {
+			return err
+		}
+		data = binary.BigEndian.AppendUint16(data, uint16(len(enc)))
+		data = append(data, enc...)
+	}
+	return writeKeyFile(file, data, false)
+}
+
+// ThresholdUnlocker unlocks a master key file that was saved with
+// SaveThresholdMasterKey. The passphrases are added one at a time, e.g. as
+// each operator enters theirs, until enough of them were added.
+//
+//	u, err := crypto.NewThresholdUnlocker(file)
+//	...
+//	for u.Needed() > 0 {
+//		if err := u.AddPassphrase(readPassphrase()); err != nil {
+//			...
+//		}
+//	}
+//	mk, err := u.MasterKey()
+type ThresholdUnlocker struct {
+	opts   []Option
+	logger Logger
+	m      int
+	slots  [][]byte
+	shares [][]byte
+}
+
+// NewThresholdUnlocker reads a master key file that was saved with
+// SaveThresholdMasterKey.
+func NewThresholdUnlocker(file string, opts ...Option) (*ThresholdUnlocker, error) {
+	var opt option
+	opt.apply(opts)
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 3 || b[0] != thresholdVersion {
+		return nil, ErrUnexpectedAlgo
+	}
+	u := &ThresholdUnlocker{
+		opts:   opts,
+		logger: opt.logger,
+		m:      int(b[1]),
+		slots:  make([][]byte, int(b[2])),
+		shares: make([][]byte, int(b[2])),
+	}
+	b = b[3:]
+	for i := range u.slots {
+		if len(b) < 2 {
+			return nil, ErrDecryptFailed
+		}
+		n := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+n {
+			return nil, ErrDecryptFailed
+		}
+		u.slots[i], b = b[2:2+n], b[2+n:]
+	}
+	return u, nil
+}
+
+// Needed returns the number of passphrases that are still needed.
+func (u *ThresholdUnlocker) Needed() int {
+	var n int
+	for _, s := range u.shares {
+		if s != nil {
+			n++
+		}
+	}
+	return max(0, u.m-n)
+}
+
+// AddPassphrase unlocks the share of passphrase. It returns ErrDecryptFailed
+// if passphrase doesn't unlock any share that isn't already unlocked.
+func (u *ThresholdUnlocker) AddPassphrase(passphrase []byte) error {
+	for i, slot := range u.slots {
+		if u.shares[i] != nil {
+			continue
+		}
+		if share, err := decryptWithPassphrase(shareVersion, slot, passphrase, u.logger); err == nil {
+			u.shares[i] = share
+			return nil
+		}
+	}
+	return ErrDecryptFailed
+}
+
+// MasterKey returns the master key, once enough passphrases were added. The
+// shares are wiped.
+func (u *ThresholdUnlocker) MasterKey() (MasterKey, error) {
+	if u.Needed() > 0 {
+		return nil, ErrInvalidShares
+	}
+	var shares [][]byte
+	for _, s := range u.shares {
+		if s != nil {
+			shares = append(shares, s)
+		}
+	}
+	defer u.Wipe()
+	return CombineMasterKey(shares, u.opts...)
+}
+
+// Wipe zeros the shares that were unlocked.
+func (u *ThresholdUnlocker) Wipe() {
+	for i, s := range u.shares {
+		clear(s)
+		u.shares[i] = nil
+	}
+}
@@ -0,0 +1,86 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestThresholdMasterKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "key")
+	mk, err := CreateChacha20Poly1305MasterKeyForTest()
+	if err != nil {
+		t.Fatalf("CreateChacha20Poly1305MasterKeyForTest: %v", err)
+	}
+	defer mk.Wipe()
+	passphrases := [][]byte{[]byte("alice"), []byte("bob"), []byte("carol")}
+	if err := SaveThresholdMasterKey(mk, [][]byte{[]byte("foo"), []byte("foo")}, 2, file); err == nil {
+		t.Fatal("SaveThresholdMasterKey with duplicate passphrases should have failed, but didn't")
+	}
+	if err := SaveThresholdMasterKey(mk, passphrases, 2, file); err != nil {
+		t.Fatalf("SaveThresholdMasterKey: %v", err)
+	}
+	if _, err := ReadMasterKey([]byte("alice"), file); err != ErrThresholdKey {
+		t.Errorf("ReadMasterKey() = %v, want %v", err, ErrThresholdKey)
+	}
+
+	u, err := NewThresholdUnlocker(file)
+	if err != nil {
+		t.Fatalf("NewThresholdUnlocker: %v", err)
+	}
+	if got, want := u.Needed(), 2; got != want {
+		t.Errorf("Needed() = %d, want %d", got, want)
+	}
+	if err := u.AddPassphrase([]byte("carol")); err != nil {
+		t.Fatalf("AddPassphrase(carol): %v", err)
+	}
+	if _, err := u.MasterKey(); err != ErrInvalidShares {
+		t.Errorf("MasterKey() with 1 passphrase = %v, want %v", err, ErrInvalidShares)
+	}
+	if err := u.AddPassphrase([]byte("carol")); err != ErrDecryptFailed {
+		t.Errorf("AddPassphrase(carol) again = %v, want %v", err, ErrDecryptFailed)
+	}
+	if err := u.AddPassphrase([]byte("mallory")); err != ErrDecryptFailed {
+		t.Errorf("AddPassphrase(mallory) = %v, want %v", err, ErrDecryptFailed)
+	}
+	if got, want := u.Needed(), 1; got != want {
+		t.Errorf("Needed() = %d, want %d", got, want)
+	}
+	if err := u.AddPassphrase([]byte("alice")); err != nil {
+		t.Fatalf("AddPassphrase(alice): %v", err)
+	}
+	if got, want := u.Needed(), 0; got != want {
+		t.Errorf("Needed() = %d, want %d", got, want)
+	}
+	got, err := u.MasterKey()
+	if err != nil {
+		t.Fatalf("MasterKey: %v", err)
+	}
+	defer got.Wipe()
+	if want, got := mk.(*Chacha20Poly1305MasterKey).key(), got.(*Chacha20Poly1305MasterKey).key(); !bytes.Equal(want, got) {
+		t.Errorf("Mismatch keys: %v != %v", want, got)
+	}
+}
@@ -0,0 +1,450 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// The version byte of master key files, and of ciphertexts, of AES master
+	// keys that are protected by an ECC key in the TPM.
+	tpmECCVersion = 13
+
+	// The size of P-256 coordinates and scalars.
+	p256Size = 32
+	// The size of uncompressed P-256 points.
+	p256PointSize = 1 + 2*p256Size
+	// The size added by tpmECCKey.encrypt: ephemeral point, nonce and tag.
+	tpmECCOverhead = p256PointSize + 12 + 16
+	// The size of the signatures of tpmECCKey.sign: r || s.
+	tpmECCSigSize = 2 * p256Size
+)
+
+// tpmECCKey is an ECC P-256 key in the TPM. Data is encrypted with ECIES:
+// encryption only needs the public key, and decryption uses TPM2_ECDH_ZGen.
+// The key is loaded for each operation, so that it doesn't compete with
+// other users of the TPM for object slots.
+type tpmECCKey struct {
+	mu  sync.Mutex
+	rw  io.ReadWriter
+	tpm transport.TPM
+
+	pub       tpm2.TPM2BPublic
+	priv      tpm2.TPM2BPrivate
+	publicKey *ecdh.PublicKey
+	// A random point whose product with the private key is the secret of
+	// the stream key.
+	streamPoint *ecdh.PublicKey
+}
+
+func createTPMECCKey(rw io.ReadWriter) (*tpmECCKey, error) {
+	k := &tpmECCKey{rw: rw, tpm: transport.FromReadWriter(rw)}
+	srk, err := k.srk()
+	if err != nil {
+		return nil, err
+	}
+	defer k.flush(srk.Handle)
+	resp, err := tpm2.Create{
+		ParentHandle: srk,
+		InPublic: tpm2.New2B(tpm2.TPMTPublic{
+			Type:    tpm2.TPMAlgECC,
+			NameAlg: tpm2.TPMAlgSHA256,
+			ObjectAttributes: tpm2.TPMAObject{
+				FixedTPM:            true,
+				FixedParent:         true,
+				SensitiveDataOrigin: true,
+				UserWithAuth:        true,
+				Decrypt:             true,
+				SignEncrypt:         true,
+			},
+			Parameters: tpm2.NewTPMUPublicParms(tpm2.TPMAlgECC, &tpm2.TPMSECCParms{
+				CurveID: tpm2.TPMECCNistP256,
+			}),
+			Unique: tpm2.NewTPMUPublicID(tpm2.TPMAlgECC, &tpm2.TPMSECCPoint{}),
+		}),
+	}.Execute(k.tpm)
+	if err != nil {
+		return nil, fmt.Errorf("TPM2_Create: %w", err)
+	}
+	k.pub, k.priv = resp.OutPublic, resp.OutPrivate
+	if err := k.setPublicKey(); err != nil {
+		return nil, err
+	}
+	sp, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	k.streamPoint = sp.PublicKey()
+	return k, nil
+}
+
+// unmarshalTPMECCKey returns the key that was marshaled by marshal.
+func unmarshalTPMECCKey(rw io.ReadWriter, b []byte) (*tpmECCKey, error) {
+	str := cryptobyte.String(b)
+	var pub, priv, sp cryptobyte.String
+	if !str.ReadUint16LengthPrefixed(&pub) || !str.ReadUint16LengthPrefixed(&priv) || !str.ReadUint16LengthPrefixed(&sp) || !str.Empty() {
+		return nil, ErrDecryptFailed
+	}
+	k := &tpmECCKey{rw: rw, tpm: transport.FromReadWriter(rw)}
+	p, err := tpm2.Unmarshal[tpm2.TPM2BPublic](pub)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	s, err := tpm2.Unmarshal[tpm2.TPM2BPrivate](priv)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	k.pub, k.priv = *p, *s
+	if err := k.setPublicKey(); err != nil {
+		return nil, err
+	}
+	if k.streamPoint, err = ecdh.P256().NewPublicKey(sp); err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return k, nil
+}
+
+func (k *tpmECCKey) marshal() ([]byte, error) {
+	b := cryptobyte.NewBuilder(nil)
+	for _, v := range [][]byte{tpm2.Marshal(k.pub), tpm2.Marshal(k.priv), k.streamPoint.Bytes()} {
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(v)
+		})
+	}
+	return b.Bytes()
+}
+
+func (k *tpmECCKey) setPublicKey() error {
+	pub, err := k.pub.Contents()
+	if err != nil {
+		return err
+	}
+	point, err := pub.Unique.ECC()
+	if err != nil {
+		return err
+	}
+	if k.publicKey, err = ecdh.P256().NewPublicKey(uncompressedPoint(point)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ecdsaPublicKey returns the public key as an ECDSA key.
+func (k *tpmECCKey) ecdsaPublicKey() *ecdsa.PublicKey {
+	b := k.publicKey.Bytes()
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(b[1 : 1+p256Size]),
+		Y:     new(big.Int).SetBytes(b[1+p256Size:]),
+	}
+}
+
+func uncompressedPoint(p *tpm2.TPMSECCPoint) []byte {
+	b := make([]byte, p256PointSize)
+	b[0] = 4
+	copy(b[1+p256Size-len(p.X.Buffer):1+p256Size], p.X.Buffer)
+	copy(b[p256PointSize-len(p.Y.Buffer):], p.Y.Buffer)
+	return b
+}
+
+// srk creates the storage root key in the owner hierarchy. It is derived
+// from the seed of the hierarchy, and is the same every time.
+func (k *tpmECCKey) srk() (tpm2.AuthHandle, error) {
+	resp, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.TPMRHOwner,
+		InPublic:      tpm2.New2B(tpm2.ECCSRKTemplate),
+	}.Execute(k.tpm)
+	if err != nil {
+		return tpm2.AuthHandle{}, fmt.Errorf("TPM2_CreatePrimary: %w", err)
+	}
+	return tpm2.AuthHandle{
+		Handle: resp.ObjectHandle,
+		Name:   resp.Name,
+		Auth:   tpm2.PasswordAuth(nil),
+	}, nil
+}
+
+func (k *tpmECCKey) flush(h tpm2.TPMHandle) {
+	tpm2.FlushContext{FlushHandle: h}.Execute(k.tpm)
+}
+
+// load loads the key in the TPM, and returns a function to flush it.
+func (k *tpmECCKey) load() (tpm2.AuthHandle, func(), error) {
+	srk, err := k.srk()
+	if err != nil {
+		return tpm2.AuthHandle{}, nil, err
+	}
+	defer k.flush(srk.Handle)
+	resp, err := tpm2.Load{
+		ParentHandle: srk,
+		InPrivate:    k.priv,
+		InPublic:     k.pub,
+	}.Execute(k.tpm)
+	if err != nil {
+		return tpm2.AuthHandle{}, nil, fmt.Errorf("TPM2_Load: %w", err)
+	}
+	h := tpm2.AuthHandle{
+		Handle: resp.ObjectHandle,
+		Name:   resp.Name,
+		Auth:   tpm2.PasswordAuth(nil),
+	}
+	return h, func() { k.flush(resp.ObjectHandle) }, nil
+}
+
+// ecdh returns the x coordinate of the product of the private key and p.
+func (k *tpmECCKey) ecdh(p *ecdh.PublicKey) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	h, flush, err := k.load()
+	if err != nil {
+		return nil, err
+	}
+	defer flush()
+	b := p.Bytes()
+	resp, err := tpm2.ECDHZGen{
+		KeyHandle: h,
+		InPoint: tpm2.New2B(tpm2.TPMSECCPoint{
+			X: tpm2.TPM2BECCParameter{Buffer: b[1 : 1+p256Size]},
+			Y: tpm2.TPM2BECCParameter{Buffer: b[1+p256Size:]},
+		}),
+	}.Execute(k.tpm)
+	if err != nil {
+		return nil, fmt.Errorf("TPM2_ECDH_ZGen: %w", err)
+	}
+	out, err := resp.OutPoint.Contents()
+	if err != nil {
+		return nil, err
+	}
+	z := make([]byte, p256Size)
+	copy(z[p256Size-len(out.X.Buffer):], out.X.Buffer)
+	return z, nil
+}
+
+// eciesKey derives the AES key of a ciphertext from the ECDH secret.
+func (k *tpmECCKey) eciesKey(z, ephemeral []byte) ([]byte, error) {
+	defer clear(z)
+	info := append([]byte("c2FmZQ storage TPM ECIES\x00"), ephemeral...)
+	info = append(info, k.publicKey.Bytes()...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, z, nil, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt encrypts b with the public key, and authenticates aad. It doesn't
+// use the TPM.
+func (k *tpmECCKey) encrypt(b, aad []byte) ([]byte, error) {
+	eph, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	z, err := eph.ECDH(k.publicKey)
+	if err != nil {
+		return nil, err
+	}
+	ephBytes := eph.PublicKey().Bytes()
+	key, err := k.eciesKey(z, ephBytes)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(ephBytes)+gcm.NonceSize(), len(ephBytes)+gcm.NonceSize()+len(b)+gcm.Overhead())
+	copy(out, ephBytes)
+	nonce := out[len(ephBytes):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(out, nonce, b, aad), nil
+}
+
+// decrypt decrypts b with the TPM.
+func (k *tpmECCKey) decrypt(b, aad []byte) ([]byte, error) {
+	if len(b) < tpmECCOverhead {
+		return nil, ErrDecryptFailed
+	}
+	ephBytes, b := b[:p256PointSize], b[p256PointSize:]
+	eph, err := ecdh.P256().NewPublicKey(ephBytes)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	z, err := k.ecdh(eph)
+	if err != nil {
+		return nil, err
+	}
+	key, err := k.eciesKey(z, ephBytes)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, b := b[:gcm.NonceSize()], b[gcm.NonceSize():]
+	out, err := gcm.Open(nil, nonce, b, aad)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return out, nil
+}
+
+// sign signs digest with ECDSA, and returns r || s.
+func (k *tpmECCKey) sign(digest []byte) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	h, flush, err := k.load()
+	if err != nil {
+		return nil, err
+	}
+	defer flush()
+	resp, err := tpm2.Sign{
+		KeyHandle: h,
+		Digest:    tpm2.TPM2BDigest{Buffer: digest},
+		InScheme: tpm2.TPMTSigScheme{
+			Scheme:  tpm2.TPMAlgECDSA,
+			Details: tpm2.NewTPMUSigScheme(tpm2.TPMAlgECDSA, &tpm2.TPMSSchemeHash{HashAlg: tpm2.TPMAlgSHA256}),
+		},
+		Validation: tpm2.TPMTTKHashCheck{Tag: tpm2.TPMSTHashCheck},
+	}.Execute(k.tpm)
+	if err != nil {
+		return nil, fmt.Errorf("TPM2_Sign: %w", err)
+	}
+	sig, err := resp.Signature.Signature.ECDSA()
+	if err != nil {
+		return nil, err
+	}
+	r, s := sig.SignatureR.Buffer, sig.SignatureS.Buffer
+	if len(r) > p256Size || len(s) > p256Size {
+		return nil, errors.New("unexpected signature size")
+	}
+	out := make([]byte, tpmECCSigSize)
+	copy(out[p256Size-len(r):p256Size], r)
+	copy(out[tpmECCSigSize-len(s):], s)
+	return out, nil
+}
+
+func (k *tpmECCKey) verify(digest, sig []byte) bool {
+	if len(sig) != tpmECCSigSize {
+		return false
+	}
+	r := new(big.Int).SetBytes(sig[:p256Size])
+	s := new(big.Int).SetBytes(sig[p256Size:])
+	return ecdsa.Verify(k.ecdsaPublicKey(), digest, r, s)
+}
+
+// streamKey derives the key of streams and derived keys. Only the TPM can
+// compute it.
+func (k *tpmECCKey) streamKey(opt option) (*AESKey, error) {
+	z, err := k.ecdh(k.streamPoint)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(z)
+	b, err := deriveKeyBytes(z, []byte("tpm stream key"))
+	if err != nil {
+		return nil, err
+	}
+	sk := aesKeyFromBytes(b)
+	sk.logger = opt.logger
+	sk.workers = opt.workers
+	return sk, nil
+}
+
+// tpmECCPayload returns the payload of the master key file of k: the key
+// encrypted with the ECC key, and the ECC key itself.
+func (k AESKey) tpmECCPayload() ([]byte, error) {
+	key := k.key()
+	defer clear(key)
+	encKey, err := k.eccKey.encrypt(key, nil)
+	if err != nil {
+		return nil, err
+	}
+	keyctx, err := k.eccKey.marshal()
+	if err != nil {
+		return nil, err
+	}
+	b := cryptobyte.NewBuilder(nil)
+	for _, v := range [][]byte{encKey, keyctx} {
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(v)
+		})
+	}
+	return b.Bytes()
+}
+
+// readTPMECCPayload returns the key whose payload was returned by
+// tpmECCPayload.
+func readTPMECCPayload(payload []byte, opt option) (*AESKey, error) {
+	str := cryptobyte.String(payload)
+	var encKey, keyctx cryptobyte.String
+	if !str.ReadUint16LengthPrefixed(&encKey) || !str.ReadUint16LengthPrefixed(&keyctx) {
+		return nil, ErrDecryptFailed
+	}
+	eccKey, err := unmarshalTPMECCKey(opt.tpmECC, keyctx)
+	if err != nil {
+		return nil, err
+	}
+	decKey, err := eccKey.decrypt(encKey, nil)
+	if err != nil {
+		opt.logger.Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	key := aesKeyFromBytes(decKey)
+	key.eccKey = eccKey
+	if key.streamKey, err = eccKey.streamKey(opt); err != nil {
+		key.Wipe()
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,474 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// The version byte of data sealed to an X25519 public key, and of
+	// X25519 master key files.
+	x25519Version = 4
+
+	// The overhead of data sealed to an X25519 public key.
+	x25519SealOverhead = 73 // 1 (version) + 32 (ephemeral public key) + 24 (nonce) + 16 (tag)
+
+	// The size of an encrypted key.
+	x25519EncryptedKeySize = x25519SealOverhead + 64
+)
+
+var errX25519NotSupported = errors.New("operation not supported with X25519 key")
+
+// X25519PublicKey is an X25519 public key. It can create file keys, and
+// encrypt data, that only the holder of the private key can decrypt. It can't
+// decrypt anything, not even the data that it encrypted.
+//
+// It can be used as the master key of a storage that is only written to, e.g.
+// by a log shipper. The hashes of the file names are keyed with the public
+// key, so anyone who has the public key can compute them.
+type X25519PublicKey struct {
+	pub    *ecdh.PublicKey
+	logger Logger
+	// The number of goroutines that process the chunks of streams.
+	workers int
+}
+
+// NewX25519PublicKey returns the X25519 public key whose encoding is b, as
+// returned by Bytes.
+func NewX25519PublicKey(b []byte, opts ...Option) (*X25519PublicKey, error) {
+	var opt option
+	opt.apply(opts)
+	pub, err := ecdh.X25519().NewPublicKey(b)
+	if err != nil {
+		return nil, err
+	}
+	return &X25519PublicKey{pub: pub, logger: opt.logger, workers: opt.workers}, nil
+}
+
+// Bytes returns the encoding of the public key.
+func (k *X25519PublicKey) Bytes() []byte {
+	return k.pub.Bytes()
+}
+
+func (k *X25519PublicKey) Logger() Logger {
+	return k.logger
+}
+
+// Hash returns the HMAC-SHA256 hash of b, keyed with the public key.
+func (k *X25519PublicKey) Hash(b []byte) []byte {
+	hk := sha256.Sum256(append([]byte("c2FmZQ storage x25519 hash\x00"), k.pub.Bytes()...))
+	mac := hmac.New(sha256.New, hk[:])
+	mac.Write(b)
+	return mac.Sum(nil)
+}
+
+// x25519AEAD returns the AEAD for data sealed with the shared secret of an
+// ephemeral key and a public key.
+func x25519AEAD(shared, ephPub, pub []byte) (cipher.AEAD, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	r := hkdf.New(sha256.New, shared, append(append([]byte(nil), ephPub...), pub...), []byte("c2FmZQ storage x25519"))
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+// Encrypt encrypts data for the holder of the private key. The data is
+// encrypted with a key that is derived from the shared secret of a new
+// ephemeral key and the public key.
+func (k *X25519PublicKey) Encrypt(data []byte) ([]byte, error) {
+	return k.EncryptWithAAD(data, nil)
+}
+
+// EncryptWithAAD is like Encrypt, and it also authenticates additionalData.
+func (k *X25519PublicKey) EncryptWithAAD(data, additionalData []byte) ([]byte, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrEncryptFailed
+	}
+	shared, err := eph.ECDH(k.pub)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrEncryptFailed
+	}
+	ephPub := eph.PublicKey().Bytes()
+	aead, err := x25519AEAD(shared, ephPub, k.pub.Bytes())
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrEncryptFailed
+	}
+	out := make([]byte, 0, x25519SealOverhead+len(data))
+	out = append(out, x25519Version)
+	out = append(out, ephPub...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrEncryptFailed
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, additionalData), nil
+}
+
+// Decrypt always fails. Only the private key can decrypt.
+func (k *X25519PublicKey) Decrypt(data []byte) ([]byte, error) {
+	return k.DecryptWithAAD(data, nil)
+}
+
+// DecryptWithAAD always fails. Only the private key can decrypt.
+func (k *X25519PublicKey) DecryptWithAAD(data, additionalData []byte) ([]byte, error) {
+	k.Logger().Debug("Decrypt: X25519 public key can't decrypt")
+	return nil, ErrDecryptFailed
+}
+
+// NewKey creates a new encryption key. The key is encrypted with the public
+// key, so that only the holder of the private key can decrypt it later.
+func (k *X25519PublicKey) NewKey() (EncryptionKey, error) {
+	b := make([]byte, 64)
+	if _, err := rand.Read(b); err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrEncryptFailed
+	}
+	enc, err := k.Encrypt(b)
+	if err != nil {
+		return nil, err
+	}
+	ek := chacha20poly1305KeyFromBytes(b)
+	ek.encryptedKey = tagEncryptedKey(k, enc)
+	ek.logger = k.logger
+	ek.workers = k.workers
+	return wrappedFileKey{ek}, nil
+}
+
+// DeriveKey isn't supported with a public key.
+func (k *X25519PublicKey) DeriveKey(info []byte) (EncryptionKey, error) {
+	return nil, errX25519NotSupported
+}
+
+// DecryptKey always fails. Only the private key can decrypt.
+func (k *X25519PublicKey) DecryptKey(encryptedKey []byte) (EncryptionKey, error) {
+	return nil, ErrDecryptFailed
+}
+
+// ReadEncryptedKey always fails. Only the private key can decrypt.
+func (k *X25519PublicKey) ReadEncryptedKey(r io.Reader) (EncryptionKey, error) {
+	return nil, ErrDecryptFailed
+}
+
+// WriteEncryptedKey isn't supported with X25519 keys.
+func (k *X25519PublicKey) WriteEncryptedKey(w io.Writer) error {
+	return errX25519NotSupported
+}
+
+// StartReader isn't supported with X25519 keys. Streams are encrypted with
+// the keys returned by NewKey.
+func (k *X25519PublicKey) StartReader(ctx []byte, r io.Reader) (StreamReader, error) {
+	return nil, errX25519NotSupported
+}
+
+// StartWriter isn't supported with X25519 keys. Streams are encrypted with
+// the keys returned by NewKey.
+func (k *X25519PublicKey) StartWriter(ctx []byte, w io.Writer) (StreamWriter, error) {
+	return nil, errX25519NotSupported
+}
+
+// StartAppendWriter isn't supported with X25519 keys.
+func (k *X25519PublicKey) StartAppendWriter(ctx []byte, rw TruncatableStream) (StreamWriter, int64, error) {
+	return nil, 0, errX25519NotSupported
+}
+
+// Wipe does nothing. A public key isn't secret.
+func (k *X25519PublicKey) Wipe() {
+}
+
+// X25519Key is an X25519 private key. It can do everything that its public
+// key can do, and it can also decrypt. It is a MasterKey.
+type X25519Key struct {
+	*X25519PublicKey
+	maskedKey []byte
+	xor       func([]byte) []byte
+
+	logger     Logger
+	strictWipe bool
+	// The KDF parameters used by Save.
+	kdf kdfParams
+	// Whether Save keeps a copy of the file that it replaces.
+	backup bool
+}
+
+// CreateX25519MasterKey creates a new X25519 private key.
+func CreateX25519MasterKey(opts ...Option) (MasterKey, error) {
+	var opt option
+	opt.apply(opts)
+	if opt.hasTPM() {
+		return nil, errors.New("tpm key not implemented with x25519")
+	}
+	kdf, err := opt.argon2Params(kdfParams{})
+	if err != nil {
+		return nil, err
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	k, err := x25519KeyFromBytes(priv.Bytes(), opt)
+	if err != nil {
+		return nil, err
+	}
+	k.kdf = kdf
+	return k, nil
+}
+
+// ReadX25519MasterKey reads an encrypted X25519 private key from file and
+// decrypts it.
+func ReadX25519MasterKey(passphrase []byte, file string, opts ...Option) (MasterKey, error) {
+	var opt option
+	opt.apply(opts)
+	if opt.hasTPM() {
+		opt.logger.Error("ReadMasterKey: TPM option selected but master key was created without TPM")
+		return nil, ErrDecryptFailed
+	}
+	enc, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	kdf, err := opt.argon2Params(passphraseKDFParams(enc))
+	if err != nil {
+		return nil, err
+	}
+	b, err := decryptWithPassphrase(x25519Version, enc, passphrase, opt.logger)
+	if err != nil {
+		return nil, err
+	}
+	k, err := x25519KeyFromBytes(b, opt)
+	if err != nil {
+		return nil, err
+	}
+	k.kdf = kdf
+	return k, nil
+}
+
+// x25519KeyFromBytes returns an X25519Key with the raw private key provided.
+// Internally, the key is masked with a ephemeral key in memory.
+func x25519KeyFromBytes(b []byte, opt option) (*X25519Key, error) {
+	defer clear(b)
+	priv, err := ecdh.X25519().NewPrivateKey(b)
+	if err != nil {
+		opt.logger.Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	mask := make([]byte, len(b))
+	if _, err := rand.Read(mask); err != nil {
+		return nil, err
+	}
+	xor := func(in []byte) []byte {
+		out := make([]byte, len(mask))
+		for i := range mask {
+			out[i] = in[i] ^ mask[i]
+		}
+		return out
+	}
+	k := &X25519Key{
+		X25519PublicKey: &X25519PublicKey{pub: priv.PublicKey(), logger: opt.logger, workers: opt.workers},
+		maskedKey:       xor(b),
+		xor:             xor,
+		logger:          opt.logger,
+		strictWipe:      opt.strictWipe,
+		backup:          opt.backup,
+	}
+	k.setFinalizer()
+	return k, nil
+}
+
+func (k *X25519Key) Logger() Logger {
+	return k.logger
+}
+
+// PublicKey returns the public key.
+func (k *X25519Key) PublicKey() *X25519PublicKey {
+	return k.X25519PublicKey
+}
+
+// Wipe zeros the key material.
+func (k *X25519Key) Wipe() {
+	for i := range k.maskedKey {
+		k.maskedKey[i] = 0
+	}
+	runtime.SetFinalizer(k, nil)
+}
+
+func (k *X25519Key) setFinalizer() {
+	stack := stack()
+	runtime.SetFinalizer(k, func(obj interface{}) {
+		key := obj.(*X25519Key)
+		for i := range key.maskedKey {
+			if key.maskedKey[i] != 0 {
+				if key.strictWipe {
+					key.Logger().Fatalf("WIPEME: X25519Key not wiped. Call stack: %s", stack)
+				}
+				key.Logger().Errorf("WIPEME: X25519Key not wiped. Call stack: %s", stack)
+				key.Wipe()
+				return
+			}
+		}
+	})
+}
+
+func (k *X25519Key) key() []byte {
+	return k.xor(k.maskedKey)
+}
+
+// ChangePassphrase checks that file contains the private key encrypted with
+// oldPassphrase, and atomically replaces it with the private key encrypted
+// with newPassphrase.
+func (k *X25519Key) ChangePassphrase(oldPassphrase, newPassphrase []byte, file string) error {
+	return changePassphrase(k, oldPassphrase, func() (MasterKey, error) {
+		return ReadX25519MasterKey(oldPassphrase, file, WithLogger(k.logger))
+	}, newPassphrase, file)
+}
+
+// ExportMnemonic returns a recovery phrase that encodes the private key.
+func (k *X25519Key) ExportMnemonic() (string, error) {
+	return exportMnemonic(k)
+}
+
+// Save encrypts the private key with passphrase and saves it to file.
+func (k *X25519Key) Save(passphrase []byte, file string) error {
+	priv := k.key()
+	defer clear(priv)
+	data, err := encryptWithPassphrase(x25519Version, priv, passphrase, k.kdf)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(file, data, k.backup)
+}
+
+// Decrypt decrypts data that was encrypted with Encrypt and the public key.
+func (k *X25519Key) Decrypt(data []byte) ([]byte, error) {
+	return k.DecryptWithAAD(data, nil)
+}
+
+// DecryptWithAAD decrypts data that was encrypted with EncryptWithAAD, the
+// public key, and the same additional data.
+func (k *X25519Key) DecryptWithAAD(data, additionalData []byte) ([]byte, error) {
+	if len(k.maskedKey) == 0 {
+		k.Logger().Fatal("key is not set")
+	}
+	if len(data) < x25519SealOverhead || data[0] != x25519Version {
+		return nil, ErrDecryptFailed
+	}
+	ephPub, data := data[1:33], data[33:]
+	priv := k.key()
+	defer clear(priv)
+	pk, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	eph, err := ecdh.X25519().NewPublicKey(ephPub)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	shared, err := pk.ECDH(eph)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	aead, err := x25519AEAD(shared, ephPub, k.pub.Bytes())
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	nonce := data[:aead.NonceSize()]
+	b, err := aead.Open(nil, nonce, data[aead.NonceSize():], additionalData)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	return b, nil
+}
+
+// DeriveKey derives a new encryption key from the private key and info.
+func (k *X25519Key) DeriveKey(info []byte) (EncryptionKey, error) {
+	priv := k.key()
+	defer clear(priv)
+	b, err := deriveKeyBytes(priv, info)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrEncryptFailed
+	}
+	ek := chacha20poly1305KeyFromBytes(b)
+	ek.logger = k.logger
+	ek.workers = k.workers
+	return ek, nil
+}
+
+// DecryptKey decrypts an encrypted key that was created by NewKey.
+func (k *X25519Key) DecryptKey(encryptedKey []byte) (EncryptionKey, error) {
+	enc, err := untagEncryptedKey(k, encryptedKey)
+	if err != nil {
+		k.Logger().Debug("DecryptKey: key ID mismatch")
+		return nil, err
+	}
+	if len(enc) != x25519EncryptedKeySize {
+		k.Logger().Debugf("DecryptKey: unexpected encrypted key size %d != %d", len(enc), x25519EncryptedKeySize)
+		return nil, ErrDecryptFailed
+	}
+	b, err := k.Decrypt(enc)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 64 {
+		k.Logger().Debugf("DecryptKey: unexpected decrypted key size %d != %d", len(b), 64)
+		return nil, ErrDecryptFailed
+	}
+	ek := chacha20poly1305KeyFromBytes(b)
+	ek.encryptedKey = append([]byte(nil), encryptedKey...)
+	ek.logger = k.logger
+	ek.workers = k.workers
+	return wrappedFileKey{ek}, nil
+}
+
+// ReadEncryptedKey reads an encrypted key and decrypts it.
+func (k *X25519Key) ReadEncryptedKey(r io.Reader) (EncryptionKey, error) {
+	buf, err := readEncryptedKeyBytes(r, x25519EncryptedKeySize)
+	if err != nil {
+		k.Logger().Debug(err)
+		return nil, ErrDecryptFailed
+	}
+	return k.DecryptKey(buf)
+}
@@ -0,0 +1,221 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// ErrNotJSON is returned by Decoder.Token and Decoder.More when the file
+// isn't JSON encoded.
+var ErrNotJSON = errors.New("file is not JSON encoded")
+
+// Decoder decodes the content of a data file as a stream, without reading
+// the whole file in memory.
+type Decoder struct {
+	rs   *readStream
+	gob  *gob.Decoder
+	json *json.Decoder
+	// unlock releases the shared lock on the file, if any.
+	unlock func()
+}
+
+// OpenDecoder opens a data file for streaming decoding. The file must be GOB
+// or JSON encoded.
+//
+// With JSON encoded files, Token and More can be used to iterate over large
+// arrays or objects, e.g.
+//
+//	dec, err := s.OpenDecoder(filename)
+//	if err != nil {
+//	  panic(err)
+//	}
+//	defer dec.Close()
+//	dec.Token() // [
+//	for dec.More() {
+//	  var item Item
+//	  if err := dec.Decode(&item); err != nil {
+//	    panic(err)
+//	  }
+//	}
+//	dec.Token() // ]
+//
+// With GOB encoded files, each call to Decode reads one of the values written
+// with Encoder.Encode. A file written with SaveDataFile contains only one
+// value.
+//
+// Like ReadDataFile, it waits for the recovery of the file, and with
+// WithReadLocks, it holds a shared lock on the file until the Decoder is
+// closed.
+func (s *Storage) OpenDecoder(filename string) (dec *Decoder, retErr error) {
+	if err := s.waitForRecovery(context.Background(), filename); err != nil {
+		return nil, err
+	}
+	var unlock func()
+	if s.readLocks {
+		if err := s.RLock(filename); err != nil {
+			return nil, err
+		}
+		unlock = func() { s.RUnlock(filename) }
+		defer func() {
+			if retErr != nil {
+				unlock()
+			}
+		}()
+	}
+	rs, err := s.openReadStream(filename)
+	if err != nil {
+		return nil, err
+	}
+	d := &Decoder{rs: rs, unlock: unlock}
+	switch enc := rs.flags & optEncodingMask; enc {
+	case optGOBEncoded:
+		d.gob = gob.NewDecoder(rs)
+	case optJSONEncoded:
+		d.json = json.NewDecoder(rs)
+	default:
+		rs.Close()
+		return nil, fmt.Errorf("unexpected encoding %x", enc)
+	}
+	return d, nil
+}
+
+// Decode decodes the next value from the stream. It returns io.EOF at the end
+// of the stream.
+func (d *Decoder) Decode(v any) error {
+	if d.gob != nil {
+		return d.gob.Decode(v)
+	}
+	return d.json.Decode(v)
+}
+
+// Token returns the next JSON token in the stream. See json.Decoder.Token.
+func (d *Decoder) Token() (json.Token, error) {
+	if d.json == nil {
+		return nil, ErrNotJSON
+	}
+	return d.json.Token()
+}
+
+// More reports whether there is another element in the current JSON array or
+// object being parsed. It always returns false if the file isn't JSON
+// encoded.
+func (d *Decoder) More() bool {
+	if d.json == nil {
+		return false
+	}
+	return d.json.More()
+}
+
+// Close closes the underlying file, and releases the shared lock on it.
+func (d *Decoder) Close() error {
+	err := d.rs.Close()
+	if d.unlock != nil {
+		d.unlock()
+		d.unlock = nil
+	}
+	return err
+}
+
+// Encoder encodes a stream of values in a data file. The file is atomically
+// replaced when Close is called.
+type Encoder struct {
+	s        *Storage
+	w        io.WriteCloser
+	tmp      string
+	filename string
+	gob      *gob.Encoder
+	json     *json.Encoder
+	done     bool
+}
+
+// OpenEncoder opens a data file for streaming encoding. The values passed to
+// Encode can be read back one at a time with OpenDecoder. The file isn't
+// modified until Close is called.
+func (s *Storage) OpenEncoder(filename string) (*Encoder, error) {
+	e := &Encoder{
+		s:        s,
+		tmp:      fmt.Sprintf("%s.tmp-%d", filename, time.Now().UnixNano()),
+		filename: filename,
+	}
+	fn := filepath.Join(s.dir, e.tmp)
+	if err := createParentIfNotExist(s.backend, fn); err != nil {
+		return nil, err
+	}
+	flags := byte(optJSONEncoded)
+	if s.useGOB {
+		flags = optGOBEncoded
+	}
+	flags |= s.streamFlags()
+	w, err := s.openWriteStream(fileContext(filename), fn, flags, 64*1024)
+	if err != nil {
+		return nil, err
+	}
+	e.w = w
+	if s.useGOB {
+		e.gob = gob.NewEncoder(w)
+	} else {
+		e.json = json.NewEncoder(w)
+	}
+	return e, nil
+}
+
+// Encode writes a value to the stream.
+func (e *Encoder) Encode(v any) error {
+	if e.gob != nil {
+		return e.gob.Encode(v)
+	}
+	return e.json.Encode(v)
+}
+
+// Close atomically replaces the file with the encoded values.
+func (e *Encoder) Close() error {
+	if e.done {
+		return ErrAlreadyCommitted
+	}
+	e.done = true
+	if err := e.w.Close(); err != nil {
+		e.s.backend.Remove(filepath.Join(e.s.dir, e.tmp))
+		return err
+	}
+	defer e.s.invalidateCache(e.filename)
+	return e.s.rename(filepath.Join(e.s.dir, e.tmp), filepath.Join(e.s.dir, e.filename))
+}
+
+// Abort discards the encoded values. The file isn't modified.
+func (e *Encoder) Abort() error {
+	if e.done {
+		return ErrAlreadyCommitted
+	}
+	e.done = true
+	e.w.Close()
+	return e.s.backend.Remove(filepath.Join(e.s.dir, e.tmp))
+}
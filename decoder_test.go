@@ -0,0 +1,179 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDecoderJSON(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey())
+	s.useGOB = false
+
+	type Item struct {
+		N int `json:"n"`
+	}
+	var items []Item
+	for i := 0; i < 1000; i++ {
+		items = append(items, Item{i})
+	}
+	if err := s.SaveDataFile("list", items); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	dec, err := s.OpenDecoder("list")
+	if err != nil {
+		t.Fatalf("s.OpenDecoder: %v", err)
+	}
+	defer dec.Close()
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		t.Fatalf("dec.Token() = %v, %v", tok, err)
+	}
+	n := 0
+	for dec.More() {
+		var item Item
+		if err := dec.Decode(&item); err != nil {
+			t.Fatalf("dec.Decode: %v", err)
+		}
+		if item.N != n {
+			t.Errorf("Unexpected item. Want %d, got %d", n, item.N)
+		}
+		n++
+	}
+	if tok, err := dec.Token(); err != nil || tok != json.Delim(']') {
+		t.Fatalf("dec.Token() = %v, %v", tok, err)
+	}
+	if n != len(items) {
+		t.Errorf("Unexpected number of items. Want %d, got %d", len(items), n)
+	}
+}
+
+func TestEncoderDecoderGOB(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey())
+
+	enc, err := s.OpenEncoder("stream")
+	if err != nil {
+		t.Fatalf("s.OpenEncoder: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := enc.Encode(i); err != nil {
+			t.Fatalf("enc.Encode: %v", err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatalf("enc.Close: %v", err)
+	}
+
+	dec, err := s.OpenDecoder("stream")
+	if err != nil {
+		t.Fatalf("s.OpenDecoder: %v", err)
+	}
+	defer dec.Close()
+	if _, err := dec.Token(); err != ErrNotJSON {
+		t.Errorf("dec.Token() = %v, want ErrNotJSON", err)
+	}
+	for i := 0; ; i++ {
+		var v int
+		if err := dec.Decode(&v); err == io.EOF {
+			if i != 100 {
+				t.Errorf("Unexpected number of values. Want 100, got %d", i)
+			}
+			break
+		} else if err != nil {
+			t.Fatalf("dec.Decode: %v", err)
+		}
+		if v != i {
+			t.Errorf("Unexpected value. Want %d, got %d", i, v)
+		}
+	}
+
+	enc, err = s.OpenEncoder("stream")
+	if err != nil {
+		t.Fatalf("s.OpenEncoder: %v", err)
+	}
+	if err := enc.Encode(-1); err != nil {
+		t.Fatalf("enc.Encode: %v", err)
+	}
+	if err := enc.Abort(); err != nil {
+		t.Fatalf("enc.Abort: %v", err)
+	}
+	var v int
+	if err := s.ReadDataFile("stream", &v); err != nil || v != 0 {
+		t.Errorf("s.ReadDataFile() = %d, %v, want 0, nil", v, err)
+	}
+	if _, err := s.OpenDecoder("does-not-exist"); !errors.Is(err, os.ErrNotExist) {
+		t.Error("s.OpenDecoder(does-not-exist) didn't fail")
+	}
+}
+
+func TestDecoderReadLocks(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey(), WithReadLocks())
+
+	if err := s.SaveDataFile("foo", "hello"); err != nil {
+		t.Fatalf("SaveDataFile() failed: %v", err)
+	}
+	var obj string
+	commit, err := s.OpenForUpdate("foo", &obj)
+	if err != nil {
+		t.Fatalf("OpenForUpdate() failed: %v", err)
+	}
+	ch := make(chan *Decoder)
+	go func() {
+		dec, err := s.OpenDecoder("foo")
+		if err != nil {
+			t.Errorf("OpenDecoder() failed: %v", err)
+		}
+		ch <- dec
+	}()
+	time.Sleep(200 * time.Millisecond)
+	obj = "world"
+	if err := commit(true, nil); err != nil {
+		t.Fatalf("commit() failed: %v", err)
+	}
+	// OpenDecoder waited for the commit.
+	dec := <-ch
+	if dec == nil {
+		t.FailNow()
+	}
+	var got string
+	if err := dec.Decode(&got); err != nil || got != "world" {
+		t.Errorf("Decode() = %q, %v, want world", got, err)
+	}
+	// The file stays locked until the decoder is closed.
+	if err := s.LockWithTimeout("foo", 200*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("LockWithTimeout() = %v, want DeadlineExceeded", err)
+	}
+	if err := dec.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if err := s.LockWithTimeout("foo", 5*time.Second); err != nil {
+		t.Fatalf("LockWithTimeout() failed: %v", err)
+	}
+	s.Unlock("foo")
+}
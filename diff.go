@@ -0,0 +1,279 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// hunk is a change between two versions of a text: lines a[aStart:aEnd] are
+// replaced with b[bStart:bEnd].
+type hunk struct {
+	aStart, aEnd int
+	bStart, bEnd int
+}
+
+// splitLines splits text into lines, keeping the line endings.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the hunks that transform a into b, using the Myers
+// algorithm.
+func diffLines(a, b []string) []hunk {
+	n, m := len(a), len(b)
+	max := n + m
+	off := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+	var d int
+search:
+	for d = 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// Walk back from the end to find the edit script.
+	type edit struct {
+		kind byte
+		a, b int
+	}
+	var edits []edit
+	x, y := n, m
+	for ; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[off+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			edits = append(edits, edit{'=', x - 1, y - 1})
+			x--
+			y--
+		}
+		if x == prevX {
+			edits = append(edits, edit{'+', x, y - 1})
+		} else {
+			edits = append(edits, edit{'-', x - 1, y})
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		edits = append(edits, edit{'=', x - 1, y - 1})
+		x--
+		y--
+	}
+
+	// Group the consecutive insertions and deletions.
+	var hunks []hunk
+	var cur *hunk
+	for i := len(edits) - 1; i >= 0; i-- {
+		e := edits[i]
+		switch e.kind {
+		case '=':
+			if cur != nil {
+				hunks = append(hunks, *cur)
+				cur = nil
+			}
+		case '-':
+			if cur == nil {
+				cur = &hunk{aStart: e.a, aEnd: e.a, bStart: e.b, bEnd: e.b}
+			}
+			cur.aEnd = e.a + 1
+		case '+':
+			if cur == nil {
+				cur = &hunk{aStart: e.a, aEnd: e.a, bStart: e.b, bEnd: e.b}
+			}
+			cur.bEnd = e.b + 1
+		}
+	}
+	if cur != nil {
+		hunks = append(hunks, *cur)
+	}
+	return hunks
+}
+
+// unifiedDiff returns the differences between a and b in the unified diff
+// format, with 3 lines of context. It returns an empty string when a and b
+// are the same.
+func unifiedDiff(a, b, nameA, nameB string) string {
+	const context = 3
+	al, bl := splitLines(a), splitLines(b)
+	hunks := diffLines(al, bl)
+	if len(hunks) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", nameA, nameB)
+	line := func(prefix, l string) {
+		sb.WriteString(prefix)
+		sb.WriteString(l)
+		if !strings.HasSuffix(l, "\n") {
+			sb.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+	for i := 0; i < len(hunks); {
+		// Hunks that are close to each other are shown together.
+		j := i
+		for j+1 < len(hunks) && hunks[j+1].aStart-hunks[j].aEnd <= 2*context {
+			j++
+		}
+		aStart := max(0, hunks[i].aStart-context)
+		aEnd := min(len(al), hunks[j].aEnd+context)
+		bStart := hunks[i].bStart - (hunks[i].aStart - aStart)
+		bEnd := hunks[j].bEnd + (aEnd - hunks[j].aEnd)
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(aStart, aEnd), hunkRange(bStart, bEnd))
+		pos := aStart
+		for _, h := range hunks[i : j+1] {
+			for _, l := range al[pos:h.aStart] {
+				line(" ", l)
+			}
+			for _, l := range al[h.aStart:h.aEnd] {
+				line("-", l)
+			}
+			for _, l := range bl[h.bStart:h.bEnd] {
+				line("+", l)
+			}
+			pos = h.aEnd
+		}
+		for _, l := range al[pos:aEnd] {
+			line(" ", l)
+		}
+		i = j + 1
+	}
+	return sb.String()
+}
+
+func hunkRange(start, end int) string {
+	if end-start == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	if end == start {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, end-start)
+}
+
+// merge3 merges the changes from base to mine and from base to theirs. Changes
+// that overlap, or that are adjacent, conflict unless they are identical.
+// Conflicts are marked like with diff3. It returns true if there are
+// conflicts.
+func merge3(base, mine, theirs string) (string, bool) {
+	bl, ml, tl := splitLines(base), splitLines(mine), splitLines(theirs)
+	h1, h2 := diffLines(bl, ml), diffLines(bl, tl)
+
+	// apply returns the lines of base[start:end] after the changes in hunks.
+	apply := func(hunks []hunk, lines []string, start, end int) []string {
+		var out []string
+		pos := start
+		for _, h := range hunks {
+			out = append(out, bl[pos:h.aStart]...)
+			out = append(out, lines[h.bStart:h.bEnd]...)
+			pos = h.aEnd
+		}
+		return append(out, bl[pos:end]...)
+	}
+	var out []string
+	conflict := false
+	pos := 0
+	for i, j := 0, 0; i < len(h1) || j < len(h2); {
+		// Find the next group of overlapping hunks.
+		var start int
+		if j >= len(h2) || (i < len(h1) && h1[i].aStart <= h2[j].aStart) {
+			start = h1[i].aStart
+		} else {
+			start = h2[j].aStart
+		}
+		end := start
+		gi, gj := i, j
+		for {
+			if i < len(h1) && h1[i].aStart <= end {
+				end = max(end, h1[i].aEnd)
+				i++
+				continue
+			}
+			if j < len(h2) && h2[j].aStart <= end {
+				end = max(end, h2[j].aEnd)
+				j++
+				continue
+			}
+			break
+		}
+		out = append(out, bl[pos:start]...)
+		m := apply(h1[gi:i], ml, start, end)
+		t := apply(h2[gj:j], tl, start, end)
+		switch {
+		case gj == j:
+			out = append(out, m...)
+		case gi == i:
+			out = append(out, t...)
+		case strings.Join(m, "") == strings.Join(t, ""):
+			out = append(out, m...)
+		default:
+			conflict = true
+			out = append(out, "<<<<<<< mine\n")
+			out = append(out, withNewline(m)...)
+			out = append(out, "=======\n")
+			out = append(out, withNewline(t)...)
+			out = append(out, ">>>>>>> theirs\n")
+		}
+		pos = end
+	}
+	out = append(out, bl[pos:]...)
+	return strings.Join(out, ""), conflict
+}
+
+// withNewline makes sure that the last line ends with a newline.
+func withNewline(lines []string) []string {
+	if n := len(lines); n > 0 && !strings.HasSuffix(lines[n-1], "\n") {
+		lines = append(lines[:n-1:n-1], lines[n-1]+"\n")
+	}
+	return lines
+}
@@ -0,0 +1,88 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	words := []string{"a\n", "b\n", "c\n", "d\n"}
+	for n := 0; n < 500; n++ {
+		var a, b []string
+		for i := rand.Intn(10); i > 0; i-- {
+			a = append(a, words[rand.Intn(len(words))])
+		}
+		for i := rand.Intn(10); i > 0; i-- {
+			b = append(b, words[rand.Intn(len(words))])
+		}
+		// Applying the hunks to a must produce b.
+		var got []string
+		pos := 0
+		for _, h := range diffLines(a, b) {
+			got = append(got, a[pos:h.aStart]...)
+			got = append(got, b[h.bStart:h.bEnd]...)
+			pos = h.aEnd
+		}
+		got = append(got, a[pos:]...)
+		if strings.Join(got, "") != strings.Join(b, "") {
+			t.Fatalf("diffLines(%q, %q) produced %q", a, b, got)
+		}
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+	b := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n"
+	want := "--- a\n+++ b\n" +
+		"@@ -1,6 +1,6 @@\n 1\n 2\n-3\n+three\n 4\n 5\n 6\n" +
+		"@@ -8,3 +8,4 @@\n 8\n 9\n 10\n+11\n"
+	if got := unifiedDiff(a, b, "a", "b"); got != want {
+		t.Errorf("unifiedDiff() = %q, want %q", got, want)
+	}
+	if got := unifiedDiff(a, a, "a", "b"); got != "" {
+		t.Errorf("unifiedDiff() = %q, want empty", got)
+	}
+}
+
+func TestMerge3(t *testing.T) {
+	base := "a: 1\nb: 2\nc: 3\nd: 4\ne: 5\n"
+	for _, tc := range []struct {
+		mine, theirs string
+		want         string
+		conflict     bool
+	}{
+		{"a: 10\nb: 2\nc: 3\nd: 4\ne: 5\n", "a: 1\nb: 2\nc: 3\nd: 4\ne: 50\n", "a: 10\nb: 2\nc: 3\nd: 4\ne: 50\n", false},
+		{"a: 10\nb: 2\nc: 3\nd: 4\ne: 5\n", "a: 10\nb: 2\nc: 3\nd: 4\ne: 5\n", "a: 10\nb: 2\nc: 3\nd: 4\ne: 5\n", false},
+		{base + "f: 6\n", "b: 2\nc: 3\nd: 4\ne: 5\n", "b: 2\nc: 3\nd: 4\ne: 5\nf: 6\n", false},
+		{"a: 1\nb: 2\nc: 30\nd: 4\ne: 5\n", "a: 1\nb: 2\nc: 300\nd: 4\ne: 5\n", "a: 1\nb: 2\n<<<<<<< mine\nc: 30\n=======\nc: 300\n>>>>>>> theirs\nd: 4\ne: 5\n", true},
+	} {
+		got, conflict := merge3(base, tc.mine, tc.theirs)
+		if got != tc.want || conflict != tc.conflict {
+			t.Errorf("merge3(%q, %q) = %q, %v, want %q, %v", tc.mine, tc.theirs, got, conflict, tc.want, tc.conflict)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package docstore is a document store with indexed field queries, on top of
+// an encrypted storage.
+//
+// Documents are encoded with JSON, and each document is stored in its own
+// encrypted file. The fields that are queried must be indexed with WithIndex.
+// The indexes are maintained with the index package, in the same transaction
+// as the documents, and they support equality and range queries.
+//
+// Example:
+//
+//	ds := docstore.New(s, "notes", docstore.WithIndex("author", "created"))
+//	id, err := ds.Insert(&Note{Author: "alice", Created: 1700000000, Text: "..."})
+//	if err != nil {
+//		return err
+//	}
+//	...
+//	ids, err := ds.Find(docstore.Query{Field: "author", Equal: "alice", Limit: 20})
+package docstore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/index"
+)
+
+var (
+	// ErrNotFound is returned when a document doesn't exist.
+	ErrNotFound = errors.New("document not found")
+	// ErrNotIndexed is returned by Find when the field isn't indexed.
+	ErrNotIndexed = errors.New("field isn't indexed")
+)
+
+const fanoutLevels = 2
+
+// Option is used to specify optional parameters of New.
+type Option func(*Store)
+
+// WithIndex specifies fields to index. A field is a dot-separated path in the
+// JSON encoding of the documents, e.g. "author.name". When a field is an
+// array, each of its elements is indexed.
+func WithIndex(fields ...string) Option {
+	return func(ds *Store) {
+		ds.fields = append(ds.fields, fields...)
+	}
+}
+
+// Query is a query on an indexed field.
+type Query struct {
+	// Field is the indexed field.
+	Field string
+	// Equal, if not nil, matches the documents whose field is equal to
+	// Equal.
+	Equal any
+	// From and To, if not nil, match the documents with From <= field < To.
+	// Values of different types don't match, e.g. numbers and strings.
+	From, To any
+	// Limit is the maximum number of IDs to return. Zero means no limit.
+	Limit int
+	// After is the last ID of the previous page. Only the IDs that are
+	// greater are returned.
+	After string
+}
+
+// record is the content of the file of a document.
+type record struct {
+	ID  string          `json:"id"`
+	Doc json.RawMessage `json:"doc"`
+}
+
+// Store is a document store.
+type Store struct {
+	s      *storage.Storage
+	dir    string
+	fields []string
+	idx    *index.Index
+}
+
+// New returns a Store that keeps its files under dir in s.
+func New(s *storage.Storage, dir string, opts ...Option) *Store {
+	ds := &Store{s: s, dir: dir, idx: index.New(s, filepath.Join(dir, "index"))}
+	for _, opt := range opts {
+		opt(ds)
+	}
+	for _, field := range ds.fields {
+		path := strings.Split(field, ".")
+		ds.idx.RegisterOrdered(field, func(obj any) []string {
+			var out []string
+			for _, v := range lookupPath(obj, path) {
+				if k, ok := indexKey(v); ok {
+					out = append(out, k)
+				}
+			}
+			return out
+		})
+	}
+	return ds
+}
+
+// fileName returns the name of the file of a document. The IDs are not
+// visible in the file names.
+func (ds *Store) fileName(id string) string {
+	return filepath.Join(ds.dir, "docs", ds.s.FanoutPath(id, fanoutLevels))
+}
+
+// indexName returns the name under which a document is indexed. It is the
+// hex encoded ID, so that it can be decoded back to the ID.
+func indexName(id string) string {
+	return hex.EncodeToString([]byte(id))
+}
+
+// Insert adds a document with a new random ID, and returns the ID.
+func (ds *Store) Insert(doc any) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	return id, ds.Put(id, doc)
+}
+
+// Put sets the document with the given ID, replacing the existing document,
+// if any.
+func (ds *Store) Put(id string, doc any) error {
+	if id == "" {
+		return errors.New("empty document id")
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	var generic any
+	if err := json.Unmarshal(b, &generic); err != nil {
+		return err
+	}
+	return ds.update(id, func(tx *storage.Tx) error {
+		if err := ds.idx.Reindex(tx, indexName(id), generic); err != nil {
+			return err
+		}
+		return tx.Write(ds.fileName(id), &record{ID: id, Doc: b})
+	})
+}
+
+// Get reads the document with the given ID into doc.
+func (ds *Store) Get(id string, doc any) error {
+	var rec record
+	if err := ds.s.ReadDataFile(ds.fileName(id), &rec); errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(rec.Doc, doc)
+}
+
+// Delete deletes the document with the given ID.
+func (ds *Store) Delete(id string) error {
+	return ds.update(id, func(tx *storage.Tx) error {
+		var rec record
+		if err := tx.Read(ds.fileName(id), &rec); errors.Is(err, fs.ErrNotExist) {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		if err := ds.idx.Reindex(tx, indexName(id), nil); err != nil {
+			return err
+		}
+		return tx.Delete(ds.fileName(id))
+	})
+}
+
+// update calls fn in a transaction that has the file of the document locked,
+// and commits the changes if fn returns nil.
+func (ds *Store) update(id string, fn func(tx *storage.Tx) error) error {
+	tx, err := ds.s.Begin(ds.fileName(id))
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Find returns the sorted IDs of the documents that match the query.
+func (ds *Store) Find(q Query) ([]string, error) {
+	if !slices.Contains(ds.fields, q.Field) {
+		return nil, ErrNotIndexed
+	}
+	var names []string
+	var err error
+	if q.Equal != nil {
+		k, ok := indexKey(normalize(q.Equal))
+		if !ok {
+			return nil, fmt.Errorf("invalid value %v", q.Equal)
+		}
+		names, err = ds.idx.Lookup(q.Field, k)
+	} else {
+		from, to, rerr := rangeKeys(normalize(q.From), normalize(q.To))
+		if rerr != nil {
+			return nil, rerr
+		}
+		names, err = ds.idx.Range(q.Field, from, to)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(names))
+	for _, n := range names {
+		b, err := hex.DecodeString(n)
+		if err != nil {
+			return nil, err
+		}
+		if id := string(b); id > q.After {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	if q.Limit > 0 && len(ids) > q.Limit {
+		ids = ids[:q.Limit]
+	}
+	return ids, nil
+}
+
+// normalize converts v to the type that it would have after a JSON round
+// trip, e.g. all numbers are float64.
+func normalize(v any) any {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var out any
+	if err := json.Unmarshal(b, &out); err != nil {
+		return v
+	}
+	return out
+}
+
+// lookupPath returns the values at path in a JSON document. The elements of
+// arrays are returned individually.
+func lookupPath(v any, path []string) []any {
+	if a, ok := v.([]any); ok {
+		var out []any
+		for _, e := range a {
+			out = append(out, lookupPath(e, path)...)
+		}
+		return out
+	}
+	if len(path) == 0 {
+		if v == nil {
+			return nil
+		}
+		return []any{v}
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil
+	}
+	return lookupPath(m[path[0]], path[1:])
+}
+
+// indexKey returns the string that is used to index a JSON value. The keys of
+// values of the same type sort in the same order as the values. The first
+// byte of the key is the type.
+func indexKey(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return "s" + v, true
+	case float64:
+		bits := math.Float64bits(v)
+		if v < 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		return fmt.Sprintf("n%016x", bits), true
+	case bool:
+		if v {
+			return "b1", true
+		}
+		return "b0", true
+	default:
+		return "", false
+	}
+}
+
+// rangeKeys returns the bounds of the index keys of a range query.
+func rangeKeys(from, to any) (string, string, error) {
+	if from == nil && to == nil {
+		return "", "", errors.New("query without Equal, From, or To")
+	}
+	var fromKey, toKey string
+	var ok bool
+	if from != nil {
+		if fromKey, ok = indexKey(from); !ok {
+			return "", "", fmt.Errorf("invalid value %v", from)
+		}
+	}
+	if to != nil {
+		if toKey, ok = indexKey(to); !ok {
+			return "", "", fmt.Errorf("invalid value %v", to)
+		}
+	}
+	switch {
+	case from == nil:
+		fromKey = toKey[:1]
+	case to == nil:
+		// JSON strings are valid UTF-8, which never has a 0xff byte.
+		toKey = fromKey[:1] + "\xff"
+	case fromKey[0] != toKey[0]:
+		return "", "", fmt.Errorf("From and To have different types: %T, %T", from, to)
+	}
+	return fromKey, toKey, nil
+}
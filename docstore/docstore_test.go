@@ -0,0 +1,131 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package docstore_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/c2FmZQ/storage/docstore"
+	"github.com/c2FmZQ/storage/internal/storagetest"
+)
+
+type author struct {
+	Name string `json:"name"`
+}
+
+type note struct {
+	Author author   `json:"author"`
+	Year   int      `json:"year"`
+	Tags   []string `json:"tags"`
+	Text   string   `json:"text"`
+}
+
+func find(t *testing.T, ds *docstore.Store, q docstore.Query, want []string) {
+	t.Helper()
+	got, err := ds.Find(q)
+	if err != nil {
+		t.Fatalf("Find(%+v): %v", q, err)
+	}
+	if len(got) == 0 {
+		got = nil
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Find(%+v) = %q, want %q", q, got, want)
+	}
+}
+
+func TestDocuments(t *testing.T) {
+	ds := docstore.New(storagetest.New(t), "notes", docstore.WithIndex("author.name", "year", "tags"))
+	id, err := ds.Insert(&note{Author: author{"alice"}, Year: 2021, Tags: []string{"a", "b"}, Text: "one"})
+	if err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	var n note
+	if err := ds.Get(id, &n); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if n.Author.Name != "alice" || n.Text != "one" {
+		t.Errorf("Get() = %+v", n)
+	}
+	find(t, ds, docstore.Query{Field: "author.name", Equal: "alice"}, []string{id})
+	find(t, ds, docstore.Query{Field: "tags", Equal: "b"}, []string{id})
+
+	if err := ds.Put(id, &note{Author: author{"bob"}, Year: 2021}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	find(t, ds, docstore.Query{Field: "author.name", Equal: "alice"}, nil)
+	find(t, ds, docstore.Query{Field: "author.name", Equal: "bob"}, []string{id})
+	find(t, ds, docstore.Query{Field: "tags", Equal: "b"}, nil)
+
+	if err := ds.Delete(id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := ds.Get(id, &n); !errors.Is(err, docstore.ErrNotFound) {
+		t.Errorf("Get() = %v, want ErrNotFound", err)
+	}
+	if err := ds.Delete(id); !errors.Is(err, docstore.ErrNotFound) {
+		t.Errorf("Delete() = %v, want ErrNotFound", err)
+	}
+	find(t, ds, docstore.Query{Field: "author.name", Equal: "bob"}, nil)
+	if _, err := ds.Find(docstore.Query{Field: "text", Equal: "one"}); !errors.Is(err, docstore.ErrNotIndexed) {
+		t.Errorf("Find() = %v, want ErrNotIndexed", err)
+	}
+}
+
+func TestRangeAndPagination(t *testing.T) {
+	ds := docstore.New(storagetest.New(t), "notes", docstore.WithIndex("year", "author.name"))
+	for i, y := range []int{-5, 1999, 2000, 2001, 2020, 2023} {
+		id := string(rune('a' + i))
+		if err := ds.Put(id, &note{Year: y, Author: author{"alice"}}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	find(t, ds, docstore.Query{Field: "year", From: 2000, To: 2021}, []string{"c", "d", "e"})
+	find(t, ds, docstore.Query{Field: "year", From: 2001}, []string{"d", "e", "f"})
+	find(t, ds, docstore.Query{Field: "year", To: 2000}, []string{"a", "b"})
+	find(t, ds, docstore.Query{Field: "year", Equal: 1999.0}, []string{"b"})
+	find(t, ds, docstore.Query{Field: "author.name", From: "a", To: "b"}, []string{"a", "b", "c", "d", "e", "f"})
+	if _, err := ds.Find(docstore.Query{Field: "year", From: 1, To: "x"}); err == nil {
+		t.Error("Find() with mixed types succeeded")
+	}
+
+	var all []string
+	q := docstore.Query{Field: "author.name", Equal: "alice", Limit: 4}
+	for {
+		page, err := ds.Find(q)
+		if err != nil {
+			t.Fatalf("Find: %v", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		all = append(all, page...)
+		q.After = page[len(page)-1]
+	}
+	if want := []string{"a", "b", "c", "d", "e", "f"}; !reflect.DeepEqual(all, want) {
+		t.Errorf("Pages = %q, want %q", all, want)
+	}
+}
@@ -0,0 +1,419 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EditFormat is the format of the text that is edited with EditDataFile.
+type EditFormat int
+
+const (
+	// EditJSON edits the object as indented JSON. This is the default.
+	EditJSON EditFormat = iota
+	// EditYAML edits the object as YAML. The field names are the same as
+	// with JSON, i.e. json struct tags are honored. Comments are allowed,
+	// and they are preserved when the editor is re-opened after an error,
+	// but they are not saved with the object.
+	EditYAML
+)
+
+// WithEditFormat specifies the default format used by EditDataFile.
+func WithEditFormat(f EditFormat) Option {
+	return func(opt *option) {
+		opt.editFormat = f
+	}
+}
+
+// EditOption is an option for EditDataFile.
+type EditOption func(*editOptions)
+
+type editOptions struct {
+	format     EditFormat
+	validate   func(obj interface{}) error
+	in         io.Reader
+	optimistic bool
+}
+
+// EditAs specifies the format of the text to edit, overriding the storage's
+// default.
+func EditAs(f EditFormat) EditOption {
+	return func(opt *editOptions) {
+		opt.format = f
+	}
+}
+
+// EditValidate specifies a function that validates the object after each
+// editor session. When it returns an error, the error is shown to the user,
+// who can then go back to the editor to fix it, or abort. The object is only
+// committed after it is successfully validated.
+func EditValidate(fn func(obj interface{}) error) EditOption {
+	return func(opt *editOptions) {
+		opt.validate = fn
+	}
+}
+
+// EditFromReader specifies that the edited content should be read from r
+// instead of using a text editor, e.g. for automation. The content must be in
+// the edit format. If it can't be decoded or validated, EditDataFile returns
+// an error without prompting.
+func EditFromReader(r io.Reader) EditOption {
+	return func(opt *editOptions) {
+		opt.in = r
+	}
+}
+
+// EditOptimistic specifies that the file should not be locked while it is
+// being edited, so that long edits don't block everyone else. If the file
+// changes in the meantime, the concurrent changes are merged with the edit.
+// When they conflict, the editor is re-opened with conflict markers to
+// resolve them, or with EditFromReader, EditDataFile returns ErrEditConflict.
+func EditOptimistic() EditOption {
+	return func(opt *editOptions) {
+		opt.optimistic = true
+	}
+}
+
+// ErrEditConflict is returned by EditDataFile when an optimistic edit
+// conflicts with a concurrent change, and it can't be resolved interactively.
+var ErrEditConflict = errors.New("edit conflicts with concurrent changes")
+
+// EditDataFile opens a file in a text editor.
+//
+// The editor is the one specified by the VISUAL or EDITOR environment
+// variables, which may include arguments, e.g. "code --wait". Otherwise, a
+// common editor for the platform is used: vim, vi, or nano, and on windows
+// VS Code or notepad.
+//
+// Before the change is committed, a diff is shown and the user is asked to
+// confirm it, unless EditFromReader is used.
+func (s *Storage) EditDataFile(filename string, obj interface{}, opts ...EditOption) (retErr error) {
+	opt := editOptions{format: s.editFormat}
+	for _, o := range opts {
+		o(&opt)
+	}
+	if opt.optimistic {
+		return s.editOptimistic(filename, obj, opt)
+	}
+	commit, err := s.OpenForUpdate(filename, obj)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+
+	orig, err := encodeForEdit(obj, opt.format)
+	if err != nil {
+		return err
+	}
+	if err := s.edit(orig, obj, opt); err != nil {
+		return err
+	}
+	if ok, err := confirmEdit(orig, obj, opt); err != nil || !ok {
+		commit(false, nil)
+		return err
+	}
+	return commit(true, nil)
+}
+
+// editOptimistic edits the file without holding the lock.
+func (s *Storage) editOptimistic(filename string, obj interface{}, opt editOptions) (retErr error) {
+	if err := s.ReadDataFile(filename, obj); err != nil {
+		return err
+	}
+	base, err := encodeForEdit(obj, opt.format)
+	if err != nil {
+		return err
+	}
+	text := base
+	for {
+		if err := s.edit(text, obj, opt); err != nil {
+			return err
+		}
+		mine, err := encodeForEdit(obj, opt.format)
+		if err != nil {
+			return err
+		}
+		current := reflect.New(reflect.TypeOf(obj).Elem()).Interface()
+		commit, err := s.OpenForUpdate(filename, current)
+		if err != nil {
+			return err
+		}
+		theirs, err := encodeForEdit(current, opt.format)
+		if err != nil {
+			commit(false, nil)
+			return err
+		}
+		if !bytes.Equal(base, theirs) {
+			merged, conflict := merge3(string(base), string(mine), string(theirs))
+			if !conflict {
+				err = decodeAndValidate([]byte(merged), obj, opt)
+			}
+			if conflict || err != nil {
+				commit(false, nil)
+				if opt.in != nil {
+					if err != nil {
+						return fmt.Errorf("%w: %w", ErrEditConflict, err)
+					}
+					return ErrEditConflict
+				}
+				if conflict {
+					fmt.Fprintf(os.Stderr, "The file was changed concurrently. Please resolve the conflicts.\n")
+				} else {
+					fmt.Fprintf(os.Stderr, "The file was changed concurrently, and the merged changes are invalid: %v\n", err)
+				}
+				text, base = []byte(merged), theirs
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "The file was changed concurrently. The changes were merged.\n")
+		}
+		if ok, err := confirmEdit(theirs, obj, opt); err != nil || !ok {
+			commit(false, nil)
+			return err
+		}
+		// The commit saves the object that was passed to OpenForUpdate.
+		reflect.ValueOf(current).Elem().Set(reflect.ValueOf(obj).Elem())
+		return commit(true, nil)
+	}
+}
+
+// confirmEdit shows the diff between orig and obj, and asks the user to
+// confirm it. It returns false, without error, when there are no changes.
+func confirmEdit(orig []byte, obj interface{}, opt editOptions) (bool, error) {
+	if opt.in != nil {
+		return true, nil
+	}
+	edited, err := encodeForEdit(obj, opt.format)
+	if err != nil {
+		return false, err
+	}
+	diff := unifiedDiff(string(orig), string(edited), "original", "edited")
+	if diff == "" {
+		fmt.Println("No changes.")
+		return false, nil
+	}
+	if reply := prompt(diff + "\nCommit (Y/n) ? "); reply == "n" {
+		return false, errors.New("aborted")
+	}
+	return true, nil
+}
+
+// prompt asks a question on stdout, and returns the reply from stdin in
+// lower case. It reads one byte at a time so that it never consumes more than
+// one line.
+func prompt(question string) string {
+	fmt.Print(question)
+	var reply []byte
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			reply = append(reply, b[0])
+		}
+		if err != nil {
+			break
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(string(reply)))
+}
+
+// edit lets the user edit text, and decodes the result into obj.
+func (s *Storage) edit(text []byte, obj interface{}, opt editOptions) error {
+	if opt.in != nil {
+		in, err := io.ReadAll(opt.in)
+		if err != nil {
+			return err
+		}
+		return decodeAndValidate(in, obj, opt)
+	}
+
+	tmpdir := os.TempDir()
+	if runtime.GOOS == "linux" {
+		// Keep the plaintext in memory when possible.
+		if _, err := os.Stat("/dev/shm"); err == nil {
+			tmpdir = "/dev/shm"
+		}
+	}
+	dir, err := os.MkdirTemp(tmpdir, "edit-*")
+	if err != nil {
+		return err
+	}
+	defer func() { os.RemoveAll(dir) }()
+	if err := os.Chmod(dir, 0700); err != nil {
+		return err
+	}
+	fn := filepath.Join(dir, "datafile")
+	if opt.format == EditYAML {
+		fn += ".yaml"
+	} else {
+		fn += ".json"
+	}
+	if err := os.WriteFile(fn, text, 0600); err != nil {
+		return err
+	}
+	editor, err := s.findEditor()
+	if err != nil {
+		return err
+	}
+	for {
+		cmd := exec.Command(editor[0], append(editor[1:], fn)...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return err
+		}
+
+		in, err := os.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		if err := decodeAndValidate(in, obj, opt); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			if reply := prompt("\nRetry (Y/n) ? "); reply == "n" {
+				return errors.New("aborted")
+			}
+			continue
+		}
+		return nil
+	}
+}
+
+// findEditor returns the command line of the text editor to use.
+func (s *Storage) findEditor() ([]string, error) {
+	var candidates [][]string
+	for _, env := range []string{"VISUAL", "EDITOR"} {
+		if ed := strings.Fields(os.Getenv(env)); len(ed) > 0 {
+			candidates = append(candidates, ed)
+		}
+	}
+	if runtime.GOOS == "windows" {
+		// VS Code returns immediately unless it is told to wait.
+		candidates = append(candidates, []string{"code", "--wait"}, []string{"notepad"})
+	} else {
+		candidates = append(candidates, []string{"vim"}, []string{"vi"}, []string{"nano"})
+	}
+	for _, ed := range candidates {
+		bin, err := exec.LookPath(ed[0])
+		if err != nil {
+			s.Logger().Debugf("LookPath(%q): %v", ed[0], err)
+			continue
+		}
+		return append([]string{bin}, ed[1:]...), nil
+	}
+	return nil, errors.New("cannot find any text editor")
+}
+
+// decodeAndValidate decodes the edited text into obj, and validates it.
+func decodeAndValidate(in []byte, obj interface{}, opt editOptions) error {
+	if err := decodeEdited(in, obj, opt.format); err != nil {
+		return err
+	}
+	if opt.validate != nil {
+		if err := opt.validate(obj); err != nil {
+			return fmt.Errorf("Invalid: %w", err)
+		}
+	}
+	return nil
+}
+
+// encodeForEdit returns the text representation of obj in the given format.
+func encodeForEdit(obj interface{}, format EditFormat) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(obj); err != nil {
+		return nil, err
+	}
+	if format != EditYAML {
+		return buf.Bytes(), nil
+	}
+	// JSON is valid YAML. Converting it via a yaml.Node preserves the
+	// field names and their order.
+	var node yaml.Node
+	if err := yaml.Unmarshal(buf.Bytes(), &node); err != nil {
+		return nil, err
+	}
+	clearStyle(&node)
+	buf.Reset()
+	enc2 := yaml.NewEncoder(&buf)
+	enc2.SetIndent(2)
+	if err := enc2.Encode(&node); err != nil {
+		return nil, err
+	}
+	if err := enc2.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// clearStyle changes the flow style of the JSON nodes to the block style.
+func clearStyle(n *yaml.Node) {
+	if n.Kind != yaml.ScalarNode {
+		n.Style = 0
+	} else if n.Style == yaml.DoubleQuotedStyle && n.Tag == "!!str" {
+		// Only quote strings that need it.
+		n.Style = 0
+	}
+	for _, c := range n.Content {
+		clearStyle(c)
+	}
+}
+
+// decodeEdited decodes the text in the given format into obj.
+func decodeEdited(in []byte, obj interface{}, format EditFormat) error {
+	if format == EditYAML {
+		var v interface{}
+		if err := yaml.Unmarshal(in, &v); err != nil {
+			return fmt.Errorf("YAML: %w", err)
+		}
+		var err error
+		if in, err = json.Marshal(v); err != nil {
+			return fmt.Errorf("YAML: %w", err)
+		}
+	}
+	// Clear the object before unmarshalling into it again.
+	data := reflect.Indirect(reflect.ValueOf(obj))
+	data.Set(reflect.Zero(data.Type()))
+
+	if err := json.NewDecoder(bytes.NewReader(in)).Decode(obj); err != nil {
+		return fmt.Errorf("JSON: %w", err)
+	}
+	return nil
+}
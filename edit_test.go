@@ -0,0 +1,353 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type editObj struct {
+	Name  string            `json:"name"`
+	Count int               `json:"count"`
+	Tags  []string          `json:"tags,omitempty"`
+	Attrs map[string]string `json:"attrs,omitempty"`
+}
+
+func TestEditFormats(t *testing.T) {
+	obj := editObj{Name: "foo", Count: 3, Tags: []string{"a", "b"}, Attrs: map[string]string{"x": "y"}}
+	for _, format := range []EditFormat{EditJSON, EditYAML} {
+		b, err := encodeForEdit(&obj, format)
+		if err != nil {
+			t.Fatalf("[%d] encodeForEdit: %v", format, err)
+		}
+		var got editObj
+		if err := decodeEdited(b, &got, format); err != nil {
+			t.Fatalf("[%d] decodeEdited: %v", format, err)
+		}
+		if !reflect.DeepEqual(got, obj) {
+			t.Errorf("[%d] got %+v, want %+v", format, got, obj)
+		}
+	}
+
+	b, err := encodeForEdit(&obj, EditYAML)
+	if err != nil {
+		t.Fatalf("encodeForEdit: %v", err)
+	}
+	want := "name: foo\ncount: 3\ntags:\n  - a\n  - b\nattrs:\n  x: y\n"
+	if got := string(b); got != want {
+		t.Errorf("encodeForEdit() = %q, want %q", got, want)
+	}
+
+	in := "# A comment.\nname: bar # Another comment.\ncount: 5\n"
+	var got editObj
+	if err := decodeEdited([]byte(in), &got, EditYAML); err != nil {
+		t.Fatalf("decodeEdited: %v", err)
+	}
+	if want := (editObj{Name: "bar", Count: 5}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if err := decodeEdited([]byte("count: [\n"), &got, EditYAML); err == nil {
+		t.Error("decodeEdited() succeeded with invalid YAML")
+	}
+}
+
+func TestEditDataFileYAML(t *testing.T) {
+	dir := t.TempDir()
+	editor := filepath.Join(dir, "editor.sh")
+	if err := os.WriteFile(editor, []byte("#!/bin/sh\nsed -i -e 's/count: 3/count: 4/' \"$1\"\n"), 0700); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", editor)
+
+	s := New(filepath.Join(dir, "data"), aesEncryptionKey(), WithEditFormat(EditYAML))
+	if err := s.SaveDataFile("obj", editObj{Name: "foo", Count: 3}); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+	var obj editObj
+	if err := s.EditDataFile("obj", &obj); err != nil {
+		t.Fatalf("EditDataFile: %v", err)
+	}
+	var got editObj
+	if err := s.ReadDataFile("obj", &got); err != nil {
+		t.Fatalf("ReadDataFile: %v", err)
+	}
+	if want := (editObj{Name: "foo", Count: 4}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	// With JSON, the sed command doesn't match anything.
+	if err := s.EditDataFile("obj", &obj, EditAs(EditJSON)); err != nil {
+		t.Fatalf("EditDataFile: %v", err)
+	}
+	if err := s.ReadDataFile("obj", &got); err != nil || got.Count != 4 {
+		t.Errorf("ReadDataFile() = %+v, %v", got, err)
+	}
+}
+
+func TestEditDataFileValidate(t *testing.T) {
+	dir := t.TempDir()
+	editor := filepath.Join(dir, "editor.sh")
+	if err := os.WriteFile(editor, []byte("#!/bin/sh\nsed -i -e 's/count: \\([0-9]*\\)/count: 1\\1/' \"$1\"\n"), 0700); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", editor)
+	validate := EditValidate(func(obj interface{}) error {
+		if obj.(*editObj).Count < 100 {
+			return errors.New("count is too small")
+		}
+		return nil
+	})
+
+	s := New(filepath.Join(dir, "data"), aesEncryptionKey(), WithEditFormat(EditYAML))
+	if err := s.SaveDataFile("obj", editObj{Name: "foo", Count: 3}); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+	for _, tc := range []struct {
+		reply   string
+		wantErr bool
+		want    int
+	}{
+		// 13 is rejected, the user aborts.
+		{"n\n", true, 3},
+		// 13 is rejected, the user retries, 113 is accepted.
+		{"y\n", false, 113},
+	} {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatalf("os.Pipe: %v", err)
+		}
+		w.WriteString(tc.reply)
+		w.Close()
+		stdin := os.Stdin
+		os.Stdin = r
+		var obj editObj
+		err = s.EditDataFile("obj", &obj, validate)
+		os.Stdin = stdin
+		r.Close()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("EditDataFile() = %v, want error %v", err, tc.wantErr)
+		}
+		var got editObj
+		if err := s.ReadDataFile("obj", &got); err != nil || got.Count != tc.want {
+			t.Errorf("ReadDataFile() = %+v, %v, want count %d", got, err, tc.want)
+		}
+	}
+}
+
+func TestEditDataFileFromReader(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey())
+	if err := s.SaveDataFile("obj", editObj{Name: "foo", Count: 3}); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+	var obj editObj
+	if err := s.EditDataFile("obj", &obj, EditAs(EditYAML), EditFromReader(strings.NewReader("name: bar\ncount: 7\n"))); err != nil {
+		t.Fatalf("EditDataFile: %v", err)
+	}
+	var got editObj
+	if err := s.ReadDataFile("obj", &got); err != nil {
+		t.Fatalf("ReadDataFile: %v", err)
+	}
+	if want := (editObj{Name: "bar", Count: 7}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Invalid content is rejected without prompting.
+	if err := s.EditDataFile("obj", &obj, EditFromReader(strings.NewReader("{"))); err == nil {
+		t.Error("EditDataFile() succeeded with invalid JSON")
+	}
+	validate := EditValidate(func(interface{}) error { return errors.New("no") })
+	if err := s.EditDataFile("obj", &obj, validate, EditFromReader(strings.NewReader(`{"count":1}`))); err == nil {
+		t.Error("EditDataFile() succeeded with invalid object")
+	}
+	if err := s.ReadDataFile("obj", &got); err != nil || got.Count != 7 {
+		t.Errorf("ReadDataFile() = %+v, %v", got, err)
+	}
+}
+
+func TestFindEditor(t *testing.T) {
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", "sh -c true")
+	s := New(t.TempDir(), nil)
+	ed, err := s.findEditor()
+	if err != nil {
+		t.Fatalf("findEditor: %v", err)
+	}
+	if len(ed) != 3 || filepath.Base(ed[0]) != "sh" || ed[1] != "-c" || ed[2] != "true" {
+		t.Errorf("findEditor() = %v", ed)
+	}
+}
+
+func TestEditDataFileAbort(t *testing.T) {
+	dir := t.TempDir()
+	editor := filepath.Join(dir, "editor.sh")
+	if err := os.WriteFile(editor, []byte("#!/bin/sh\nsed -i -e 's/\"count\": 3/\"count\": 4/' \"$1\"\n"), 0700); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", editor)
+
+	s := New(filepath.Join(dir, "data"), aesEncryptionKey())
+	if err := s.SaveDataFile("obj", editObj{Name: "foo", Count: 3}); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe: %v", err)
+	}
+	w.WriteString("n\n")
+	w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	// The user doesn't confirm the diff.
+	var obj editObj
+	if err := s.EditDataFile("obj", &obj); err == nil {
+		t.Error("EditDataFile() succeeded")
+	}
+	var got editObj
+	if err := s.ReadDataFile("obj", &got); err != nil || got.Count != 3 {
+		t.Errorf("ReadDataFile() = %+v, %v", got, err)
+	}
+}
+
+func TestEditDataFileOptimistic(t *testing.T) {
+	dir := t.TempDir()
+	editor := filepath.Join(dir, "editor.sh")
+	script := `#!/bin/sh
+if grep -q '^<<<<<<<' "$1"; then
+  awk '/^<<<<<<</{skip=1; print "count: 6"; next} /^>>>>>>>/{skip=0; next} !skip{print}' "$1" > "$1.new" && mv "$1.new" "$1"
+else
+  sleep 0.5
+  sed -i -e 's/- c$/- z/' -e "s/count: 3/count: $COUNT/" "$1"
+fi
+`
+	if err := os.WriteFile(editor, []byte(script), 0700); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", editor)
+
+	s := New(filepath.Join(dir, "data"), aesEncryptionKey(), WithEditFormat(EditYAML))
+	for _, tc := range []struct {
+		count  string
+		theirs editObj
+		want   editObj
+	}{
+		// The concurrent change is merged.
+		{"3", editObj{Name: "bar", Count: 3, Tags: []string{"a", "b", "c"}}, editObj{Name: "bar", Count: 3, Tags: []string{"a", "b", "z"}}},
+		// The concurrent change conflicts, and the conflict is resolved.
+		{"4", editObj{Name: "foo", Count: 5, Tags: []string{"a", "b", "c"}}, editObj{Name: "foo", Count: 6, Tags: []string{"a", "b", "z"}}},
+	} {
+		t.Setenv("COUNT", tc.count)
+		if err := s.SaveDataFile("obj", editObj{Name: "foo", Count: 3, Tags: []string{"a", "b", "c"}}); err != nil {
+			t.Fatalf("SaveDataFile: %v", err)
+		}
+		ch := make(chan error)
+		go func() {
+			var obj editObj
+			ch <- s.EditDataFile("obj", &obj, EditOptimistic())
+		}()
+		time.Sleep(200 * time.Millisecond)
+		// The file isn't locked during the edit.
+		if err := s.SaveDataFile("obj", tc.theirs); err != nil {
+			t.Fatalf("SaveDataFile: %v", err)
+		}
+		if err := <-ch; err != nil {
+			t.Fatalf("EditDataFile: %v", err)
+		}
+		var got editObj
+		if err := s.ReadDataFile("obj", &got); err != nil {
+			t.Fatalf("ReadDataFile: %v", err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("got %+v, want %+v", got, tc.want)
+		}
+	}
+}
+
+func TestEditDataFileOptimisticInvalidMerge(t *testing.T) {
+	dir := t.TempDir()
+	editor := filepath.Join(dir, "editor.sh")
+	if err := os.WriteFile(editor, []byte("#!/bin/sh\nsed -i -e 's/count: \\([0-9]*\\)/count: 1\\1/' \"$1\"\n"), 0700); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", editor)
+
+	s := New(filepath.Join(dir, "data"), aesEncryptionKey(), WithEditFormat(EditYAML))
+	if err := s.SaveDataFile("obj", editObj{Name: "foo", Count: 3, Tags: []string{"a", "b", "c"}}); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+	changed := false
+	validate := EditValidate(func(obj interface{}) error {
+		if !changed {
+			// The file is changed concurrently while the editor is
+			// open. The change merges cleanly.
+			changed = true
+			if err := s.SaveDataFile("obj", editObj{Name: "foo", Count: 3, Tags: []string{"a", "b", "x"}}); err != nil {
+				t.Errorf("SaveDataFile: %v", err)
+			}
+		}
+		if o := obj.(*editObj); o.Count < 100 && slices.Contains(o.Tags, "x") {
+			return errors.New("count is too small")
+		}
+		return nil
+	})
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe: %v", err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	var obj editObj
+	err = s.EditDataFile("obj", &obj, EditOptimistic(), validate)
+	os.Stderr = stderr
+	w.Close()
+	out, _ := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("EditDataFile: %v", err)
+	}
+	if !strings.Contains(string(out), "count is too small") || strings.Contains(string(out), "conflicts") {
+		t.Errorf("Unexpected output: %q", out)
+	}
+	var got editObj
+	if err := s.ReadDataFile("obj", &got); err != nil {
+		t.Fatalf("ReadDataFile: %v", err)
+	}
+	if want := (editObj{Name: "foo", Count: 113, Tags: []string{"a", "b", "x"}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,61 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+// EncodedObject is the encoded content of a data file. When it is used with
+// ReadDataFile, SaveDataFile, or OpenForUpdate, the content of the file is
+// passed through as is, without being decoded or encoded. It lets code that
+// doesn't know the type of the objects move data files around, e.g. to serve
+// them to remote clients that decode them.
+type EncodedObject struct {
+	// Encoding is one of json, gob, binary, or raw. See FileHeader.
+	Encoding string
+	// Data is the encoded object.
+	Data []byte
+}
+
+// encodingNames are the names of the encodings, as reported by FileHeader.
+var encodingNames = map[byte]string{
+	optJSONEncoded:   "json",
+	optGOBEncoded:    "gob",
+	optBinaryEncoded: "binary",
+	optRawBytes:      "raw",
+	optRecords:       "records",
+	optPaged:         "paged",
+}
+
+// objectEncoding returns the data file encoding with the given name.
+func objectEncoding(name string) (byte, bool) {
+	switch name {
+	case "json":
+		return optJSONEncoded, true
+	case "gob":
+		return optGOBEncoded, true
+	case "binary":
+		return optBinaryEncoded, true
+	case "raw":
+		return optRawBytes, true
+	}
+	return 0, false
+}
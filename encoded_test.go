@@ -0,0 +1,95 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestEncodedObject(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey(), WithCache(10))
+	type Foo struct {
+		A string
+		B int
+	}
+	if err := s.SaveDataFile("foo", Foo{A: "a", B: 1}); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	var e EncodedObject
+	if err := s.ReadDataFile("foo", &e); err != nil {
+		t.Fatalf("s.ReadDataFile: %v", err)
+	}
+	if e.Encoding != "gob" || len(e.Data) == 0 {
+		t.Fatalf("EncodedObject = %+v", e)
+	}
+
+	// The encoded object can be saved under another name, and decoded.
+	if err := s.SaveDataFile("bar", &e); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	var bar Foo
+	if err := s.ReadDataFile("bar", &bar); err != nil {
+		t.Fatalf("s.ReadDataFile: %v", err)
+	}
+	if want := (Foo{A: "a", B: 1}); bar != want {
+		t.Errorf("bar = %+v, want %+v", bar, want)
+	}
+	if h, err := s.ReadHeader("bar"); err != nil || h.Encoding != "gob" {
+		t.Errorf("s.ReadHeader(bar) = %v, %v", h, err)
+	}
+
+	// Update through an EncodedObject.
+	var obj EncodedObject
+	commit, err := s.OpenForUpdate("foo", &obj)
+	if err != nil {
+		t.Fatalf("s.OpenForUpdate: %v", err)
+	}
+	obj = EncodedObject{Encoding: "json", Data: []byte(`{"A":"json","B":2}`)}
+	if err := commit(true, nil); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	var foo Foo
+	if err := s.ReadDataFile("foo", &foo); err != nil {
+		t.Fatalf("s.ReadDataFile: %v", err)
+	}
+	if want := (Foo{A: "json", B: 2}); !reflect.DeepEqual(foo, want) {
+		t.Errorf("foo = %+v, want %+v", foo, want)
+	}
+
+	if err := s.SaveDataFile("bad", &EncodedObject{Encoding: "records"}); err == nil {
+		t.Error("s.SaveDataFile with records encoding succeeded")
+	}
+	if _, err := os.Stat(s.Dir() + "/bad"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("bad exists: %v", err)
+	}
+	if err := s.AppendRecord("records", "x"); err != nil {
+		t.Fatalf("s.AppendRecord: %v", err)
+	}
+	if err := s.ReadDataFile("records", &e); err == nil {
+		t.Error("s.ReadDataFile(records) succeeded")
+	}
+}
@@ -0,0 +1,162 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+)
+
+const (
+	// exportManifest is the name of the manifest in an export. It is the
+	// last entry of the archive.
+	exportManifest = "manifest.json"
+	// exportObjects is the directory of the file contents in an export,
+	// named after their SHA-256 hash.
+	exportObjects = "objects"
+)
+
+// ExportOption is used to specify optional parameters of Export.
+type ExportOption func(*exportOption)
+
+type exportOption struct {
+	base *Manifest
+}
+
+// WithBaseManifest specifies that the export is incremental, relative to the
+// export that base is the manifest of. Only the content that isn't in base
+// is written. The files whose size and modification time didn't change
+// since base aren't read at all.
+func WithBaseManifest(base *Manifest) ExportOption {
+	return func(opt *exportOption) {
+		opt.base = base
+	}
+}
+
+// Export writes a crash-consistent snapshot of the storage to w as a tar
+// archive, and returns its manifest. See Snapshot. The files are exported as
+// they are, i.e. encrypted.
+//
+// The content of the files is in objects/<sha256>, and it is written only
+// once when several files are identical. The manifest, which lists every
+// file with its hash, is the last entry, in manifest.json. With
+// WithBaseManifest, the objects that are in the base export are omitted, and
+// the export must be applied on top of the base.
+func (s *Storage) Export(w io.Writer, opts ...ExportOption) (_ *Manifest, retErr error) {
+	var opt exportOption
+	for _, o := range opts {
+		o(&opt)
+	}
+	st, err := s.barrier.stage(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := st.close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	m := &Manifest{Time: st.time, Files: make(map[string]ManifestEntry)}
+	written := make(map[string]bool)
+	if opt.base != nil {
+		t := opt.base.Time
+		m.Base = &t
+		for _, e := range opt.base.Files {
+			written[e.SHA256] = true
+		}
+	}
+	tw := tar.NewWriter(w)
+	for _, f := range st.files {
+		e := ManifestEntry{Size: f.fi.Size(), ModTime: f.fi.ModTime()}
+		if opt.base != nil {
+			if b, ok := opt.base.Files[f.name]; ok && b.Size == e.Size && b.ModTime.Equal(e.ModTime) {
+				e.SHA256 = b.SHA256
+			}
+		}
+		if e.SHA256 == "" {
+			err := st.read(f, false, func(name string) error {
+				var err error
+				e.SHA256, err = hashFile(st.b.Backend, name)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		m.Files[f.name] = e
+		if written[e.SHA256] {
+			continue
+		}
+		written[e.SHA256] = true
+		err := st.read(f, true, func(name string) error {
+			return writeTarEntry(tw, st.b.Backend, name, path.Join(exportObjects, e.SHA256), e)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	hdr := &tar.Header{Name: exportManifest, Mode: 0o600, Size: int64(len(data)), ModTime: m.Time}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeTarEntry writes the content of a file to tw, and verifies that it
+// matches its manifest entry.
+func writeTarEntry(tw *tar.Writer, b Backend, name, entryName string, e ManifestEntry) error {
+	f, err := b.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hdr := &tar.Header{Name: entryName, Mode: 0o600, Size: e.Size, ModTime: e.ModTime}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, h), io.LimitReader(f, e.Size)); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != e.SHA256 {
+		return fmt.Errorf("%s: changed during export", name)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// readExport returns the objects and the manifest of an export.
+func readExport(t *testing.T, data []byte) (map[string][]byte, *Manifest) {
+	t.Helper()
+	objects := make(map[string][]byte)
+	var m *Manifest
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tr.Next: %v", err)
+		}
+		if m != nil {
+			t.Fatalf("%s is after the manifest", hdr.Name)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("io.ReadAll: %v", err)
+		}
+		if hdr.Name == exportManifest {
+			m = &Manifest{}
+			if err := json.Unmarshal(b, m); err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+			continue
+		}
+		if h := sha256.Sum256(b); path.Join(exportObjects, hex.EncodeToString(h[:])) != hdr.Name {
+			t.Errorf("%s doesn't match its hash", hdr.Name)
+		}
+		objects[path.Base(hdr.Name)] = b
+	}
+	if m == nil {
+		t.Fatal("Export doesn't have a manifest")
+	}
+	return objects, m
+}
+
+func TestExport(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, nil)
+	for _, f := range []string{"foo", "bar", "dir/foo"} {
+		if err := s.SaveDataFile(f, "same content"); err != nil {
+			t.Fatalf("s.SaveDataFile: %v", err)
+		}
+	}
+	if err := s.SaveDataFile("other", "other content"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+
+	var buf bytes.Buffer
+	m, err := s.Export(&buf)
+	if err != nil {
+		t.Fatalf("s.Export: %v", err)
+	}
+	objects, got := readExport(t, buf.Bytes())
+	if len(got.Files) != 4 || len(m.Files) != 4 || got.Base != nil {
+		t.Errorf("Manifest = %+v, want 4 files", got)
+	}
+	// The identical files are written only once.
+	if len(objects) != 2 {
+		t.Errorf("Export has %d objects, want 2", len(objects))
+	}
+	for name, e := range got.Files {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("os.ReadFile: %v", err)
+		}
+		if !bytes.Equal(objects[e.SHA256], b) {
+			t.Errorf("Object of %s doesn't match the file", name)
+		}
+	}
+}
+
+func TestIncrementalExport(t *testing.T) {
+	mk := aesEncryptionKey()
+	dir := t.TempDir()
+	s := New(dir, mk)
+	for _, f := range []string{"foo", "bar", "baz"} {
+		if err := s.SaveDataFile(f, f); err != nil {
+			t.Fatalf("s.SaveDataFile: %v", err)
+		}
+	}
+	base, err := s.Export(io.Discard)
+	if err != nil {
+		t.Fatalf("s.Export: %v", err)
+	}
+
+	if err := s.SaveDataFile("foo", "new foo"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	if err := s.SaveDataFile("new", "new"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	if err := os.Remove(filepath.Join(dir, "baz")); err != nil {
+		t.Fatalf("os.Remove: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := s.Export(&buf, WithBaseManifest(base)); err != nil {
+		t.Fatalf("s.Export: %v", err)
+	}
+	objects, m := readExport(t, buf.Bytes())
+	if m.Base == nil || !m.Base.Equal(base.Time) {
+		t.Errorf("Base = %v, want %v", m.Base, base.Time)
+	}
+	if len(m.Files) != 3 {
+		t.Errorf("Manifest has %d files, want 3: %v", len(m.Files), m.Files)
+	}
+	if _, ok := m.Files["baz"]; ok {
+		t.Error("Deleted file is in the manifest")
+	}
+	if got, want := m.Files["bar"], base.Files["bar"]; got.SHA256 != want.SHA256 || got.Size != want.Size || !got.ModTime.Equal(want.ModTime) {
+		t.Errorf("bar = %+v, want %+v", m.Files["bar"], base.Files["bar"])
+	}
+	// Only the changed and new files are written.
+	if len(objects) != 2 {
+		t.Errorf("Export has %d objects, want 2", len(objects))
+	}
+	for _, f := range []string{"foo", "new"} {
+		if _, ok := objects[m.Files[f].SHA256]; !ok {
+			t.Errorf("%s isn't in the export", f)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// MkdirAll creates a directory, along with any necessary parents.
+func (s *Storage) MkdirAll(dir string) error {
+	return s.backend.MkdirAll(filepath.Join(s.dir, dir), 0700)
+}
+
+// DeleteFile deletes a file, or an empty directory. The file is locked while
+// it is deleted.
+func (s *Storage) DeleteFile(filename string) error {
+	if _, err := s.backend.Stat(filepath.Join(s.dir, filename)); err != nil {
+		return err
+	}
+	if err := s.Lock(filename); err != nil {
+		return err
+	}
+	defer s.Unlock(filename)
+	return s.deleteFile(filename)
+}
+
+// RenameFile renames a file, replacing newname if it exists. Both files are
+// locked during the operation.
+//
+// The content of most files is encrypted for their name. Those files are
+// copied with CopyFile, and then oldname is deleted. If the process dies in
+// the middle, both files may exist. Paged blob files are simply renamed.
+// Record files can't be renamed.
+func (s *Storage) RenameFile(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	if oldname == newname {
+		return nil
+	}
+	flags, _, err := s.readFlags(oldname)
+	if err != nil {
+		return err
+	}
+	if err := s.LockMany([]string{oldname, newname}); err != nil {
+		return err
+	}
+	defer s.UnlockMany([]string{oldname, newname})
+
+	if flags&optEncodingMask != optPaged {
+		if err := CopyFile(s, newname, s, oldname); err != nil {
+			return err
+		}
+		return s.deleteFile(oldname)
+	}
+	newPath := filepath.Join(s.dir, newname)
+	if err := createParentIfNotExist(s.backend, newPath); err != nil {
+		return err
+	}
+	defer s.invalidateCache(newname)
+	if err := s.rename(filepath.Join(s.dir, oldname), newPath); err != nil {
+		return err
+	}
+	s.invalidateCache(oldname)
+	return s.syncDir(filepath.Dir(filepath.Join(s.dir, oldname)))
+}
+
+// CopyFile copies a file from one storage to another, e.g. with a different
+// master key, or to a new name in the same storage. The content is decrypted
+// and re-encrypted with a new file key as it is copied, and it keeps its
+// encoding. The destination file is replaced atomically. Record files can't
+// be copied.
+//
+// CopyFile doesn't lock the files. The caller should lock them if they can
+// be modified concurrently.
+func CopyFile(dst *Storage, dstName string, src *Storage, srcName string) error {
+	flags, _, err := src.readFlags(srcName)
+	if err != nil {
+		return err
+	}
+	switch enc := flags & optEncodingMask; {
+	case enc == optRecords:
+		return errors.New("record files can't be copied")
+	case enc == optPaged:
+		return copyBlobFile(dst, dstName, src, srcName)
+	case flags&optHashed != 0:
+		return CopyBlob(dst, dstName, src, srcName)
+	default:
+		return copyDataFile(dst, dstName, src, srcName, enc)
+	}
+}
+
+// copyDataFile copies the content of a data file, keeping its encoding.
+func copyDataFile(dst *Storage, dstName string, src *Storage, srcName string, enc byte) error {
+	rs, err := src.openReadStream(srcName)
+	if err != nil {
+		return err
+	}
+	defer rs.Close()
+
+	t := fmt.Sprintf("%s.tmp-%d", dstName, time.Now().UnixNano())
+	tmpPath := filepath.Join(dst.dir, t)
+	if err := createParentIfNotExist(dst.backend, tmpPath); err != nil {
+		return err
+	}
+	w, err := dst.openWriteStream(fileContext(dstName), tmpPath, enc|dst.streamFlags(), 64*1024)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, rs); err != nil {
+		w.Close()
+		dst.backend.Remove(tmpPath)
+		return err
+	}
+	if err := w.Close(); err != nil {
+		dst.backend.Remove(tmpPath)
+		return err
+	}
+	defer dst.invalidateCache(dstName)
+	return dst.rename(tmpPath, filepath.Join(dst.dir, dstName))
+}
+
+// copyBlobFile copies a paged blob file.
+func copyBlobFile(dst *Storage, dstName string, src *Storage, srcName string) (retErr error) {
+	in, err := src.openBlobFile(srcName, false)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	t := fmt.Sprintf("%s.tmp-%d", dstName, time.Now().UnixNano())
+	out, err := dst.openBlobFile(t, true)
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(dst.dir, t)
+	defer func() {
+		if retErr != nil {
+			dst.backend.Remove(tmpPath)
+		}
+	}()
+	if _, err := io.Copy(io.NewOffsetWriter(out, 0), io.NewSectionReader(in, 0, in.Size())); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return dst.rename(tmpPath, filepath.Join(dst.dir, dstName))
+}
@@ -0,0 +1,164 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+func TestRenameFile(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey(), WithCompression())
+
+	type Foo struct {
+		N int
+	}
+	if err := s.SaveDataFile("foo", Foo{1}); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	content := bytes.Repeat([]byte("Hello world! "), 10000)
+	writeBlob(t, s, "blob", content)
+	bf, err := s.OpenBlobFile("paged")
+	if err != nil {
+		t.Fatalf("s.OpenBlobFile: %v", err)
+	}
+	if _, err := bf.WriteAt(content, 0); err != nil {
+		t.Fatalf("bf.WriteAt: %v", err)
+	}
+	if err := bf.Close(); err != nil {
+		t.Fatalf("bf.Close: %v", err)
+	}
+
+	for _, tc := range [][2]string{{"foo", "a/foo"}, {"blob", "b/blob"}, {"paged", "c/paged"}} {
+		if err := s.RenameFile(tc[0], tc[1]); err != nil {
+			t.Fatalf("s.RenameFile(%q, %q): %v", tc[0], tc[1], err)
+		}
+		if _, err := s.FS().Stat(tc[0]); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Stat(%q) = %v, want ErrNotExist", tc[0], err)
+		}
+	}
+	var foo Foo
+	if err := s.ReadDataFile("a/foo", &foo); err != nil || foo.N != 1 {
+		t.Errorf("s.ReadDataFile() = %v, %v", foo, err)
+	}
+	if got := readBlob(t, s, "b/blob"); !bytes.Equal(got, content) {
+		t.Error("Unexpected blob content")
+	}
+	if err := s.VerifyBlob("b/blob"); err != nil {
+		t.Errorf("s.VerifyBlob: %v", err)
+	}
+	if got := readBlob(t, s, "c/paged"); !bytes.Equal(got, content) {
+		t.Error("Unexpected paged blob content")
+	}
+
+	// Replace an existing file.
+	if err := s.SaveDataFile("foo", Foo{2}); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	if err := s.RenameFile("foo", "a/foo"); err != nil {
+		t.Fatalf("s.RenameFile: %v", err)
+	}
+	if err := s.ReadDataFile("a/foo", &foo); err != nil || foo.N != 2 {
+		t.Errorf("s.ReadDataFile() = %v, %v", foo, err)
+	}
+	if err := s.RenameFile("nothing", "x"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("s.RenameFile(nothing) = %v, want ErrNotExist", err)
+	}
+}
+
+func TestDeleteFile(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey())
+	if err := s.MkdirAll("a/b"); err != nil {
+		t.Fatalf("s.MkdirAll: %v", err)
+	}
+	if err := s.SaveDataFile("a/b/foo", "foo"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	if err := s.DeleteFile("a/b"); err == nil {
+		t.Fatal("s.DeleteFile() of non-empty directory succeeded")
+	}
+	for _, f := range []string{"a/b/foo", "a/b", "a"} {
+		if err := s.DeleteFile(f); err != nil {
+			t.Fatalf("s.DeleteFile(%q): %v", f, err)
+		}
+	}
+	if err := s.DeleteFile("a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("s.DeleteFile() = %v, want ErrNotExist", err)
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	dir := t.TempDir()
+	src := New(dir, aesEncryptionKey())
+	dst := New(dir, ccEncryptionKey(), WithCompression())
+
+	type Foo struct {
+		N int
+	}
+	if err := src.SaveDataFile("foo", Foo{1}); err != nil {
+		t.Fatalf("src.SaveDataFile: %v", err)
+	}
+	content := bytes.Repeat([]byte("Hello world! "), 10000)
+	writeBlob(t, src, "blob", content)
+	bf, err := src.OpenBlobFile("paged")
+	if err != nil {
+		t.Fatalf("src.OpenBlobFile: %v", err)
+	}
+	if _, err := bf.WriteAt(content, 0); err != nil {
+		t.Fatalf("bf.WriteAt: %v", err)
+	}
+	if err := bf.Close(); err != nil {
+		t.Fatalf("bf.Close: %v", err)
+	}
+	if err := src.AppendRecord("records", Foo{1}); err != nil {
+		t.Fatalf("src.AppendRecord: %v", err)
+	}
+
+	// Re-encrypt the files in place with the other key.
+	for _, f := range []string{"foo", "blob", "paged"} {
+		if err := CopyFile(dst, f, src, f); err != nil {
+			t.Fatalf("CopyFile(%q): %v", f, err)
+		}
+	}
+	var foo Foo
+	if err := dst.ReadDataFile("foo", &foo); err != nil || foo.N != 1 {
+		t.Errorf("dst.ReadDataFile() = %v, %v", foo, err)
+	}
+	if err := src.ReadDataFile("foo", &foo); err == nil {
+		t.Error("src.ReadDataFile() succeeded after re-encryption")
+	}
+	for _, f := range []string{"blob", "paged"} {
+		if got := readBlob(t, dst, f); !bytes.Equal(got, content) {
+			t.Errorf("Unexpected content in %q", f)
+		}
+	}
+	if h, err := dst.ReadHeader("foo"); err != nil || h.String() != "gob,encrypted,compressed,padded" {
+		t.Errorf("dst.ReadHeader(foo) = %v, %v", h, err)
+	}
+	if err := CopyFile(dst, "records", src, "records"); err == nil {
+		t.Error("CopyFile(records) succeeded")
+	}
+}
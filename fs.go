@@ -0,0 +1,335 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// FS is a read-only view of a Storage that implements fs.FS, fs.ReadFileFS,
+// fs.StatFS, and fs.ReadDirFS. The files are decrypted transparently. Blobs
+// are streamed, and the other data files contain their encoded objects, e.g.
+// the JSON or GOB encoding. Record files can't be opened.
+//
+// The internal files of the storage, e.g. the lock files and the records of
+// the pending operations, are hidden.
+//
+// Example:
+//
+//	http.Handle("/", http.FileServer(http.FS(s.FS())))
+type FS struct {
+	s *Storage
+}
+
+var (
+	_ fs.FS         = (*FS)(nil)
+	_ fs.ReadFileFS = (*FS)(nil)
+	_ fs.StatFS     = (*FS)(nil)
+	_ fs.ReadDirFS  = (*FS)(nil)
+)
+
+// FS returns a read-only view of s that implements fs.FS.
+func (s *Storage) FS() *FS {
+	return &FS{s: s}
+}
+
+// internalFileRE matches the names of the files that the storage uses
+// internally.
+var internalFileRE = regexp.MustCompile(`\.((bck|wal|tmp|stale)-[0-9]+|lock|lock\.q|flock|rlock)$`)
+
+// IsInternalFile returns true if the slash-separated name is reserved for the
+// storage's internal files, e.g. a lock file. These names are hidden by FS, and
+// they must not be used for other files.
+func IsInternalFile(name string) bool {
+	return isInternalFile(name)
+}
+
+// isInternalFile returns true if the slash-separated name is one of the
+// storage's internal files, or is inside an internal directory.
+func isInternalFile(name string) bool {
+	for p := name; p != "."; p = path.Dir(p) {
+		if internalFileRE.MatchString(p) {
+			return true
+		}
+		if path.Dir(p) == "." && (p == "pending" || p == uploadDir || p == replicationDir || p == snapshotDir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fsys *FS) fullPath(op, name string) (string, error) {
+	if !fs.ValidPath(name) || isInternalFile(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return filepath.Join(fsys.s.dir, filepath.FromSlash(name)), nil
+}
+
+// Open opens the named file for reading.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	full, err := fsys.fullPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+	bfi, err := fsys.s.backend.Stat(full)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	fi := &fsFileInfo{name: path.Base(name), mtime: bfi.ModTime(), dir: bfi.IsDir()}
+	if fi.dir {
+		return &fsDir{fsys: fsys, name: name, fi: fi}, nil
+	}
+	r, err := fsys.openContent(name)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	if fi.size, err = r.Seek(0, io.SeekEnd); err == nil {
+		_, err = r.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		r.Close()
+		return nil, pathError("open", name, err)
+	}
+	return &fsFile{ReadSeekCloser: r, fi: fi}, nil
+}
+
+// openContent returns a stream of the decrypted content of a file. Blobs are
+// streamed, and data files are decoded in memory.
+func (fsys *FS) openContent(name string) (io.ReadSeekCloser, error) {
+	s := fsys.s
+	fn := filepath.FromSlash(name)
+	if err := s.waitForRecovery(context.Background(), fn); err != nil {
+		return nil, err
+	}
+	flags, signed, err := s.readFlags(fn)
+	if err != nil {
+		return nil, err
+	}
+	switch enc := flags & optEncodingMask; {
+	case enc == optRecords:
+		return nil, errors.New("record files can't be opened")
+	case enc == optPaged, flags&optHashed != 0, enc == optRawBytes && flags&optCompressed == 0 && !signed:
+		return s.openBlobRead(fn, fn)
+	}
+
+	if s.readLocks {
+		if err := s.RLock(fn); err != nil {
+			return nil, err
+		}
+		defer s.RUnlock(fn)
+	}
+	rs, err := s.openReadStream(fn)
+	if err != nil {
+		return nil, err
+	}
+	b, err := appendAll(nil, rs, sizeHint(rs.f))
+	if e := rs.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nopSeekCloser{bytes.NewReader(b)}, nil
+}
+
+// ReadFile reads the named file and returns its decrypted content.
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	b, err := appendAll(nil, f, int(fi.Size()))
+	if err != nil {
+		return nil, pathError("read", name, err)
+	}
+	return b, nil
+}
+
+// Stat returns a FileInfo describing the named file. The size is the size of
+// the decrypted content, which requires opening the file.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// ReadDir reads the named directory and returns its entries sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	full, err := fsys.fullPath("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fsys.s.backend.ReadDir(full)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	out := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		p := path.Join(name, e.Name())
+		if isInternalFile(p) {
+			continue
+		}
+		out = append(out, &fsDirEntry{fsys: fsys, name: p, dir: e.IsDir()})
+	}
+	return out, nil
+}
+
+// pathError returns a PathError for name. The errors of the backend already
+// contain the full path of the file, which is replaced with name.
+func pathError(op, name string, err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
+
+// fsFile is a regular file opened by FS.
+type fsFile struct {
+	io.ReadSeekCloser
+	fi *fsFileInfo
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return f.fi, nil
+}
+
+// fsDir is a directory opened by FS.
+type fsDir struct {
+	fsys    *FS
+	name    string
+	fi      *fsFileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) {
+	return d.fi, nil
+}
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *fsDir) Close() error {
+	return nil
+}
+
+// ReadDir returns the next n entries of the directory, or all the remaining
+// entries if n <= 0.
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+	if n <= 0 {
+		out := d.entries
+		d.entries = nil
+		return out, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	out := d.entries[:n]
+	d.entries = d.entries[n:]
+	return out, nil
+}
+
+// fsDirEntry is a directory entry returned by FS. The FileInfo is computed
+// when Info is called, because it requires opening the file.
+type fsDirEntry struct {
+	fsys *FS
+	name string
+	dir  bool
+}
+
+func (e *fsDirEntry) Name() string {
+	return path.Base(e.name)
+}
+
+func (e *fsDirEntry) IsDir() bool {
+	return e.dir
+}
+
+func (e *fsDirEntry) Type() fs.FileMode {
+	if e.dir {
+		return fs.ModeDir
+	}
+	return 0
+}
+
+func (e *fsDirEntry) Info() (fs.FileInfo, error) {
+	return e.fsys.Stat(e.name)
+}
+
+type fsFileInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+	dir   bool
+}
+
+func (fi *fsFileInfo) Name() string       { return fi.name }
+func (fi *fsFileInfo) Size() int64        { return fi.size }
+func (fi *fsFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *fsFileInfo) IsDir() bool        { return fi.dir }
+func (fi *fsFileInfo) Sys() any           { return nil }
+
+func (fi *fsFileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0500
+	}
+	return 0400
+}
@@ -0,0 +1,134 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey(), WithCompression())
+
+	type Foo struct {
+		N int `json:"n"`
+	}
+	s.useGOB = false
+	if err := s.SaveDataFile("foo.json", Foo{1}); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	raw := []byte("raw bytes")
+	if err := s.SaveDataFile("dir/raw", &raw); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	content := bytes.Repeat([]byte("Hello world! "), 10000)
+	writeBlob(t, s, "dir/sub/blob", content)
+	bf, err := s.OpenBlobFile("paged")
+	if err != nil {
+		t.Fatalf("s.OpenBlobFile: %v", err)
+	}
+	if _, err := bf.WriteAt([]byte("paged"), 0); err != nil {
+		t.Fatalf("bf.WriteAt: %v", err)
+	}
+	if err := bf.Close(); err != nil {
+		t.Fatalf("bf.Close: %v", err)
+	}
+	// Internal files are hidden.
+	if err := s.Lock("foo.json"); err != nil {
+		t.Fatalf("s.Lock: %v", err)
+	}
+	defer s.Unlock("foo.json")
+
+	fsys := s.FS()
+	if err := fstest.TestFS(fsys, "foo.json", "dir/raw", "dir/sub/blob", "paged"); err != nil {
+		t.Fatalf("fstest.TestFS: %v", err)
+	}
+
+	b, err := fs.ReadFile(fsys, "foo.json")
+	if err != nil {
+		t.Fatalf("fs.ReadFile: %v", err)
+	}
+	var foo Foo
+	if err := json.Unmarshal(b, &foo); err != nil || foo.N != 1 {
+		t.Errorf("json.Unmarshal(%q) = %v, %v", b, foo, err)
+	}
+	for _, tc := range []struct {
+		name string
+		want []byte
+	}{
+		{"dir/raw", raw},
+		{"dir/sub/blob", content},
+		{"paged", []byte("paged")},
+	} {
+		if got, err := fs.ReadFile(fsys, tc.name); err != nil || !bytes.Equal(got, tc.want) {
+			t.Errorf("fs.ReadFile(%q) = %d bytes, %v, want %d bytes", tc.name, len(got), err, len(tc.want))
+		}
+	}
+	fi, err := fs.Stat(fsys, "dir/sub/blob")
+	if err != nil || fi.Size() != int64(len(content)) {
+		t.Errorf("fs.Stat() = %v, %v, want size %d", fi, err, len(content))
+	}
+
+	for _, name := range []string{"foo.json.lock", "pending", "../foo.json", "/foo.json"} {
+		if _, err := fsys.Open(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Open(%q) = %v, want ErrNotExist", name, err)
+		}
+	}
+	if err := s.AppendRecord("records", Foo{1}); err != nil {
+		t.Fatalf("s.AppendRecord: %v", err)
+	}
+	if _, err := fsys.Open("records"); err == nil {
+		t.Error("Open(records) succeeded")
+	}
+}
+
+func TestIsInternalFile(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{"foo", false},
+		{"a/pending", false},
+		{"lockfile", false},
+		{"pending", true},
+		{"pending/123", true},
+		{"uploads/x.parts/part-000001", true},
+		{"foo.lock", true},
+		{"foo.lock.q/ticket", true},
+		{"foo.flock", true},
+		{"foo.rlock/123", true},
+		{"a/foo.bck-123", true},
+		{"a/foo.wal-123", true},
+		{"a/foo.tmp-123", true},
+		{"a/foo.lock.stale-123", true},
+	} {
+		if got := isInternalFile(tc.name); got != tc.want {
+			t.Errorf("isInternalFile(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
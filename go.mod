@@ -6,13 +6,18 @@ toolchain go1.22.3
 
 require (
 	github.com/c2FmZQ/tpm v0.4.0
+	github.com/google/go-tpm v0.9.3
 	github.com/google/go-tpm-tools v0.4.4
-	golang.org/x/crypto v0.31.0
+	golang.org/x/crypto v0.32.0
+	golang.org/x/sys v0.29.0
+	golang.org/x/term v0.28.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/google/go-tpm v0.9.3 // indirect
+	github.com/golang/protobuf v1.5.4 // indirect
+	github.com/google/uuid v1.6.0 // indirect
 	golang.org/x/net v0.33.0 // indirect
-	golang.org/x/sys v0.28.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
+	google.golang.org/protobuf v1.36.1 // indirect
 )
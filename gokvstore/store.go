@@ -0,0 +1,144 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package gokvstore implements the gokv.Store interface of
+// github.com/philippgille/gokv on top of an encrypted storage, so that the
+// libraries that accept a gokv.Store can persist their data encrypted.
+//
+// Each key is stored in its own file, whose name is the keyed hash of the key,
+// in a fanout directory tree. The values are encoded like the other data files
+// of the storage, i.e. with JSON or GOB.
+//
+// The interface only uses builtin types, so this package doesn't depend on
+// gokv.
+//
+// Example:
+//
+//	var kv gokv.Store = gokvstore.New(s, "kv")
+//	if err := kv.Set("foo", value); err != nil {
+//		...
+//	}
+package gokvstore
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/c2FmZQ/storage"
+)
+
+// defaultFanout is the default number of levels of the directory tree.
+const defaultFanout = 2
+
+var (
+	// ErrEmptyKey is returned when a key is empty.
+	ErrEmptyKey = errors.New("the key is an empty string")
+	// ErrNilValue is returned when a value is nil.
+	ErrNilValue = errors.New("the value is nil")
+)
+
+// Option is used to specify optional parameters of the Store.
+type Option func(*Store)
+
+// WithFanout specifies the number of levels of the directory tree. The
+// default is 2, i.e. 65536 directories.
+func WithFanout(levels int) Option {
+	return func(kv *Store) {
+		kv.levels = levels
+	}
+}
+
+// Store implements gokv.Store.
+type Store struct {
+	s      *storage.Storage
+	dir    string
+	levels int
+}
+
+// New returns a Store that keeps its files under dir in s.
+func New(s *storage.Storage, dir string, opts ...Option) *Store {
+	kv := &Store{s: s, dir: dir, levels: defaultFanout}
+	for _, opt := range opts {
+		opt(kv)
+	}
+	return kv
+}
+
+// fileName returns the name of the file of a key.
+func (kv *Store) fileName(k string) (string, error) {
+	if k == "" {
+		return "", ErrEmptyKey
+	}
+	return filepath.Join(kv.dir, kv.s.FanoutPath(k, kv.levels)), nil
+}
+
+// Set stores the value v for the key k. It replaces the existing value, if
+// any.
+func (kv *Store) Set(k string, v any) error {
+	fn, err := kv.fileName(k)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return ErrNilValue
+	}
+	return kv.s.SaveDataFile(fn, v)
+}
+
+// Get retrieves the value of the key k into v, which must be a pointer. It
+// returns false if the key doesn't exist.
+func (kv *Store) Get(k string, v any) (found bool, err error) {
+	fn, err := kv.fileName(k)
+	if err != nil {
+		return false, err
+	}
+	if v == nil {
+		return false, ErrNilValue
+	}
+	if err := kv.s.ReadDataFile(fn, v); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Delete deletes the key k. Deleting a key that doesn't exist isn't an error.
+func (kv *Store) Delete(k string) error {
+	fn, err := kv.fileName(k)
+	if err != nil {
+		return err
+	}
+	if err := kv.s.DeleteFile(fn); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Close implements gokv.Store. It doesn't do anything, since the Store
+// doesn't keep any open files.
+func (kv *Store) Close() error {
+	return nil
+}
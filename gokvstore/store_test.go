@@ -0,0 +1,115 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package gokvstore_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/gokvstore"
+	"github.com/c2FmZQ/storage/internal/storagetest"
+)
+
+// gokvStore is the gokv.Store interface.
+type gokvStore interface {
+	Set(k string, v any) error
+	Get(k string, v any) (found bool, err error)
+	Delete(k string) error
+	Close() error
+}
+
+var _ gokvStore = (*gokvstore.Store)(nil)
+
+type value struct {
+	Name  string
+	Count int
+}
+
+func TestStore(t *testing.T) {
+	mk := storagetest.MasterKey(t)
+	dir := t.TempDir()
+	var kv gokvStore = gokvstore.New(storage.New(dir, mk), "kv")
+	defer kv.Close()
+
+	var v value
+	if found, err := kv.Get("foo", &v); err != nil || found {
+		t.Errorf("Get = %v, %v, want false, nil", found, err)
+	}
+	if err := kv.Set("foo", value{Name: "foo", Count: 1}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := kv.Set("bar", &value{Name: "bar", Count: 2}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if found, err := kv.Get("foo", &v); err != nil || !found || v != (value{Name: "foo", Count: 1}) {
+		t.Errorf("Get = %v, %v, %+v", found, err, v)
+	}
+	if err := kv.Set("foo", value{Name: "foo", Count: 3}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if found, err := kv.Get("foo", &v); err != nil || !found || v.Count != 3 {
+		t.Errorf("Get = %v, %v, %+v", found, err, v)
+	}
+
+	if err := kv.Set("", v); !errors.Is(err, gokvstore.ErrEmptyKey) {
+		t.Errorf("Set(\"\") = %v, want %v", err, gokvstore.ErrEmptyKey)
+	}
+	if err := kv.Set("baz", nil); !errors.Is(err, gokvstore.ErrNilValue) {
+		t.Errorf("Set(nil) = %v, want %v", err, gokvstore.ErrNilValue)
+	}
+
+	// The keys don't appear in the file names.
+	var files []string
+	filepath.WalkDir(filepath.Join(dir, "kv"), func(p string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, p)
+		}
+		return err
+	})
+	if len(files) != 2 {
+		t.Errorf("Files = %v, want 2 files", files)
+	}
+	for _, f := range files {
+		if strings.Contains(f, "foo") || strings.Contains(f, "bar") {
+			t.Errorf("File name %q contains the key", f)
+		}
+	}
+
+	if err := kv.Delete("foo"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := kv.Delete("foo"); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	if found, err := kv.Get("foo", &v); err != nil || found {
+		t.Errorf("Get = %v, %v, want false, nil", found, err)
+	}
+	if found, err := kv.Get("bar", &v); err != nil || !found || v.Name != "bar" {
+		t.Errorf("Get = %v, %v, %+v", found, err, v)
+	}
+}
@@ -0,0 +1,493 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grpcstorage
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"reflect"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/c2FmZQ/storage"
+)
+
+// Client is a client of the Storage service. Its methods have the same
+// semantics as those of storage.Storage. Objects are encoded and decoded by
+// the client, so they are stored the same way as with a local
+// storage.Storage.
+type Client struct {
+	c StorageClient
+}
+
+// NewClient returns a Client that uses cc.
+func NewClient(cc grpc.ClientConnInterface) *Client {
+	return &Client{c: NewStorageClient(cc)}
+}
+
+// ReadDataFile reads an object from a file.
+func (c *Client) ReadDataFile(filename string, obj interface{}) error {
+	f, err := c.c.ReadDataFile(context.Background(), &ReadDataFileRequest{Name: filename})
+	if err != nil {
+		return fromStatus(err)
+	}
+	return decode(f, obj)
+}
+
+// SaveDataFile atomically replace an object in a file.
+func (c *Client) SaveDataFile(filename string, obj interface{}) error {
+	f, err := encode(filename, obj)
+	if err != nil {
+		return err
+	}
+	_, err = c.c.SaveDataFile(context.Background(), &SaveDataFileRequest{File: f})
+	return fromStatus(err)
+}
+
+// DeleteFile deletes a file.
+func (c *Client) DeleteFile(filename string) error {
+	_, err := c.c.DeleteFile(context.Background(), &DeleteFileRequest{Name: filename})
+	return fromStatus(err)
+}
+
+// RenameFile renames a file.
+func (c *Client) RenameFile(oldname, newname string) error {
+	_, err := c.c.RenameFile(context.Background(), &RenameFileRequest{OldName: oldname, NewName: newname})
+	return fromStatus(err)
+}
+
+// OpenForUpdate opens a file with the expectation that the object will be
+// modified and then saved again. See storage.Storage.OpenForUpdate.
+func (c *Client) OpenForUpdate(f string, obj interface{}) (func(commit bool, errp *error) error, error) {
+	return c.OpenManyForUpdateContext(context.Background(), []string{f}, []interface{}{obj})
+}
+
+// OpenForUpdateContext is like OpenForUpdate, but it gives up waiting for the
+// lock when ctx is done.
+func (c *Client) OpenForUpdateContext(ctx context.Context, f string, obj interface{}) (func(commit bool, errp *error) error, error) {
+	return c.OpenManyForUpdateContext(ctx, []string{f}, []interface{}{obj})
+}
+
+// OpenManyForUpdate is like OpenForUpdate, but for multiple files.
+func (c *Client) OpenManyForUpdate(files []string, objects interface{}) (func(commit bool, errp *error) error, error) {
+	return c.OpenManyForUpdateContext(context.Background(), files, objects)
+}
+
+// OpenManyForUpdateContext is like OpenManyForUpdate, but it gives up waiting
+// for the locks when ctx is done. The locks are held by the server until the
+// returned function is called.
+func (c *Client) OpenManyForUpdateContext(ctx context.Context, files []string, objects interface{}) (func(commit bool, errp *error) error, error) {
+	if reflect.TypeOf(objects).Kind() != reflect.Slice {
+		return nil, errors.New("objects must be a slice")
+	}
+	objValue := reflect.ValueOf(objects)
+	if len(files) != objValue.Len() {
+		return nil, fmt.Errorf("len(files) != len(objects), %d != %d", len(files), objValue.Len())
+	}
+
+	// The lease outlives ctx, which only applies to opening the files.
+	streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, cancel)
+	stream, err := c.c.Update(streamCtx)
+	if err != nil {
+		cancel()
+		return nil, fromStatus(err)
+	}
+	if err := stream.Send(&UpdateRequest{Request: &UpdateRequest_Open{Open: &OpenRequest{Names: files}}}); err != nil {
+		cancel()
+		return nil, fromStatus(err)
+	}
+	resp, err := stream.Recv()
+	if !stop() {
+		cancel()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		cancel()
+		return nil, fromStatus(err)
+	}
+	if len(resp.GetFiles()) != len(files) {
+		cancel()
+		return nil, fmt.Errorf("got %d files, want %d", len(resp.GetFiles()), len(files))
+	}
+	var errorList []error
+	for i, f := range resp.GetFiles() {
+		if err := decode(f, objValue.Index(i).Interface()); err != nil {
+			errorList = append(errorList, fmt.Errorf("s.ReadDataFile(%q): %w", files[i], err))
+		}
+	}
+	if err := errors.Join(errorList...); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	var called, committed bool
+	return func(commit bool, errp *error) (retErr error) {
+		if called {
+			if committed {
+				return storage.ErrAlreadyCommitted
+			}
+			return storage.ErrAlreadyRolledBack
+		}
+		called = true
+		if errp == nil || *errp != nil {
+			errp = &retErr
+		}
+		// Ending the stream releases the locks, and rolls back the
+		// changes if they weren't committed.
+		defer cancel()
+
+		req := &CommitRequest{Commit: commit}
+		if commit {
+			for i := range files {
+				f, err := encode(files[i], objValue.Index(i).Interface())
+				if err != nil {
+					*errp = err
+					return *errp
+				}
+				req.Files = append(req.Files, f)
+			}
+		}
+		err := stream.Send(&UpdateRequest{Request: &UpdateRequest_Commit{Commit: req}})
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		if err != nil {
+			if *errp == nil {
+				*errp = fromStatus(err)
+			}
+		} else if commit {
+			committed = true
+		}
+		if !commit && *errp == nil {
+			*errp = storage.ErrRolledBack
+		}
+		return *errp
+	}, nil
+}
+
+// BlobSize returns the size of the content of a blob file.
+func (c *Client) BlobSize(filename string) (int64, error) {
+	resp, err := c.c.BlobSize(context.Background(), &BlobSizeRequest{Name: filename})
+	if err != nil {
+		return 0, fromStatus(err)
+	}
+	return resp.GetSize(), nil
+}
+
+// OpenBlobRead opens a blob file for reading. The reader is seekable. The
+// content is streamed from the current offset, and a new stream is started
+// when the offset changes.
+func (c *Client) OpenBlobRead(filename string, opts ...storage.BlobOption) (io.ReadSeekCloser, error) {
+	size, err := c.BlobSize(filename)
+	if err != nil {
+		return nil, err
+	}
+	return storage.TrackReadProgress(&blobReader{c: c.c, name: filename, size: size}, opts...), nil
+}
+
+// CreateBlob opens a BlobWriter for filename. The caller must call either
+// Commit or Abort when it is done writing. See storage.Storage.CreateBlob.
+func (c *Client) CreateBlob(filename string, opts ...storage.BlobOption) (*BlobWriter, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := c.c.WriteBlob(ctx)
+	if err != nil {
+		cancel()
+		return nil, fromStatus(err)
+	}
+	if err := stream.Send(&WriteBlobRequest{Name: filename}); err != nil {
+		cancel()
+		return nil, fromStatus(err)
+	}
+	w := &blobStream{stream: stream}
+	return &BlobWriter{w: storage.TrackWriteProgress(w, opts...), cancel: cancel}, nil
+}
+
+// BlobWriter writes a blob remotely. The blob is discarded unless Commit is
+// called.
+type BlobWriter struct {
+	w      io.WriteCloser
+	cancel context.CancelFunc
+	done   bool
+}
+
+// Write writes p to the blob.
+func (w *BlobWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, os.ErrClosed
+	}
+	return w.w.Write(p)
+}
+
+// Commit flushes the blob and renames it to its final name.
+func (w *BlobWriter) Commit() error {
+	if w.done {
+		return os.ErrClosed
+	}
+	w.done = true
+	defer w.cancel()
+	return w.w.Close()
+}
+
+// Abort discards the blob. It does nothing if the blob was already committed
+// or aborted.
+func (w *BlobWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.cancel()
+	return nil
+}
+
+// blobStream sends the content of a blob to the server. Close commits the
+// blob.
+type blobStream struct {
+	stream Storage_WriteBlobClient
+}
+
+func (w *blobStream) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		b := p[:min(len(p), blobChunkSize)]
+		if err := w.stream.Send(&WriteBlobRequest{Data: b}); err != nil {
+			return n, w.serverError(err)
+		}
+		n += len(b)
+		p = p[len(b):]
+	}
+	return n, nil
+}
+
+func (w *blobStream) Close() error {
+	if err := w.stream.Send(&WriteBlobRequest{Commit: true}); err != nil {
+		return w.serverError(err)
+	}
+	_, err := w.stream.CloseAndRecv()
+	return fromStatus(err)
+}
+
+// serverError returns the error that ended the stream. When the server fails,
+// Send only returns io.EOF.
+func (w *blobStream) serverError(err error) error {
+	if err == io.EOF {
+		_, err = w.stream.CloseAndRecv()
+	}
+	return fromStatus(err)
+}
+
+// blobReader reads a blob remotely.
+type blobReader struct {
+	c    StorageClient
+	name string
+	size int64
+
+	off    int64
+	buf    []byte
+	stream Storage_ReadBlobClient
+	cancel context.CancelFunc
+	closed bool
+}
+
+func (r *blobReader) Read(b []byte) (int, error) {
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if len(r.buf) == 0 {
+		if r.stream == nil {
+			ctx, cancel := context.WithCancel(context.Background())
+			stream, err := r.c.ReadBlob(ctx, &ReadBlobRequest{Name: r.name, Offset: r.off})
+			if err != nil {
+				cancel()
+				return 0, fromStatus(err)
+			}
+			r.stream, r.cancel = stream, cancel
+		}
+		chunk, err := r.stream.Recv()
+		if err == io.EOF {
+			r.reset()
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			r.reset()
+			return 0, fromStatus(err)
+		}
+		r.buf = chunk.GetData()
+	}
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	r.off += int64(n)
+	return n, nil
+}
+
+func (r *blobReader) Seek(offset int64, whence int) (int64, error) {
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if offset != r.off {
+		r.reset()
+		r.off = offset
+	}
+	return offset, nil
+}
+
+func (r *blobReader) Close() error {
+	r.reset()
+	r.closed = true
+	return nil
+}
+
+// reset ends the current stream, if any.
+func (r *blobReader) reset() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.stream, r.cancel, r.buf = nil, nil, nil
+}
+
+// encode encodes obj the same way as storage.Storage.SaveDataFile.
+func encode(filename string, obj interface{}) (*DataFile, error) {
+	f := &DataFile{Name: filename}
+	switch o := obj.(type) {
+	case *storage.EncodedObject:
+		f.Encoding, f.Data = o.Encoding, o.Data
+	case encoding.BinaryMarshaler:
+		b, err := o.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		f.Encoding, f.Data = "binary", b
+	case *[]byte:
+		f.Encoding = "raw"
+		if o != nil {
+			f.Data = *o
+		}
+	default:
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(obj); err != nil {
+			return nil, err
+		}
+		f.Encoding, f.Data = "gob", buf.Bytes()
+	}
+	return f, nil
+}
+
+// decode decodes the content of a data file into obj.
+func decode(f *DataFile, obj interface{}) error {
+	if e, ok := obj.(*storage.EncodedObject); ok {
+		e.Encoding, e.Data = f.GetEncoding(), f.GetData()
+		return nil
+	}
+	switch f.GetEncoding() {
+	case "gob":
+		return gob.NewDecoder(bytes.NewReader(f.GetData())).Decode(obj)
+	case "json":
+		return json.Unmarshal(f.GetData(), obj)
+	case "binary":
+		u, ok := obj.(encoding.BinaryUnmarshaler)
+		if !ok {
+			return fmt.Errorf("obj doesn't implement encoding.BinaryUnmarshaler: %T", obj)
+		}
+		return u.UnmarshalBinary(f.GetData())
+	case "raw":
+		b, ok := obj.(*[]byte)
+		if !ok {
+			return fmt.Errorf("obj isn't *[]byte: %T", obj)
+		}
+		*b = append((*b)[:0], f.GetData()...)
+		return nil
+	default:
+		return fmt.Errorf("unexpected encoding %q", f.GetEncoding())
+	}
+}
+
+// remoteError is an error returned by the server. It matches the errors that
+// callers check for, e.g. errors.Is(err, fs.ErrNotExist).
+type remoteError struct {
+	st     *status.Status
+	target error
+}
+
+func (e *remoteError) Error() string {
+	return e.st.Message()
+}
+
+func (e *remoteError) Is(target error) bool {
+	return e.target != nil && target == e.target
+}
+
+// GRPCStatus returns the status of the error, for status.FromError.
+func (e *remoteError) GRPCStatus() *status.Status {
+	return e.st
+}
+
+// fromStatus converts a gRPC status back to an error.
+func fromStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	e := &remoteError{st: st}
+	switch st.Code() {
+	case codes.NotFound:
+		e.target = fs.ErrNotExist
+	case codes.AlreadyExists:
+		e.target = fs.ErrExist
+	case codes.PermissionDenied:
+		e.target = fs.ErrPermission
+	case codes.Canceled:
+		e.target = context.Canceled
+	case codes.DeadlineExceeded:
+		e.target = context.DeadlineExceeded
+	}
+	return e
+}
@@ -0,0 +1,238 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grpcstorage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/grpcstorage"
+)
+
+type Foo struct {
+	A string
+	B int
+}
+
+func TestDataFiles(t *testing.T) {
+	s, conn := newTestServer(t)
+	c := grpcstorage.NewClient(conn)
+
+	if err := c.SaveDataFile("foo", Foo{A: "a", B: 1}); err != nil {
+		t.Fatalf("c.SaveDataFile: %v", err)
+	}
+	// The file is the same as if it was saved locally.
+	var foo Foo
+	if err := s.ReadDataFile("foo", &foo); err != nil {
+		t.Fatalf("s.ReadDataFile: %v", err)
+	}
+	if want := (Foo{A: "a", B: 1}); foo != want {
+		t.Errorf("foo = %+v, want %+v", foo, want)
+	}
+	raw := []byte("raw bytes")
+	if err := s.SaveDataFile("raw", &raw); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	var gotRaw []byte
+	if err := c.ReadDataFile("raw", &gotRaw); err != nil {
+		t.Fatalf("c.ReadDataFile: %v", err)
+	}
+	if !bytes.Equal(gotRaw, raw) {
+		t.Errorf("raw = %q, want %q", gotRaw, raw)
+	}
+
+	if err := c.RenameFile("foo", "bar"); err != nil {
+		t.Fatalf("c.RenameFile: %v", err)
+	}
+	var bar Foo
+	if err := c.ReadDataFile("bar", &bar); err != nil {
+		t.Fatalf("c.ReadDataFile: %v", err)
+	}
+	if bar != foo {
+		t.Errorf("bar = %+v, want %+v", bar, foo)
+	}
+	if err := c.ReadDataFile("foo", &foo); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("c.ReadDataFile(foo) = %v, want ErrNotExist", err)
+	}
+	if err := c.DeleteFile("bar"); err != nil {
+		t.Fatalf("c.DeleteFile: %v", err)
+	}
+	if err := c.DeleteFile("bar"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("c.DeleteFile(bar) = %v, want ErrNotExist", err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	s, conn := newTestServer(t)
+	c := grpcstorage.NewClient(conn)
+
+	for _, f := range []string{"a", "b"} {
+		if err := s.SaveDataFile(f, Foo{A: f}); err != nil {
+			t.Fatalf("s.SaveDataFile: %v", err)
+		}
+	}
+
+	var a, b Foo
+	commit, err := c.OpenManyForUpdate([]string{"a", "b"}, []*Foo{&a, &b})
+	if err != nil {
+		t.Fatalf("c.OpenManyForUpdate: %v", err)
+	}
+	if a.A != "a" || b.A != "b" {
+		t.Fatalf("Unexpected objects: %+v %+v", a, b)
+	}
+	// The files are locked while the lease is held.
+	if ok, err := s.TryLock("a"); err != nil || ok {
+		t.Errorf("s.TryLock(a) = %v, %v, want false", ok, err)
+	}
+	a.B, b.B = 1, 2
+	if err := commit(true, nil); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := commit(false, nil); err != storage.ErrAlreadyCommitted {
+		t.Errorf("commit = %v, want ErrAlreadyCommitted", err)
+	}
+	for _, want := range []Foo{{A: "a", B: 1}, {A: "b", B: 2}} {
+		var got Foo
+		if err := s.ReadDataFile(want.A, &got); err != nil {
+			t.Fatalf("s.ReadDataFile: %v", err)
+		}
+		if got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+
+	// Roll back.
+	commit, err = c.OpenForUpdate("a", &a)
+	if err != nil {
+		t.Fatalf("c.OpenForUpdate: %v", err)
+	}
+	a.B = 100
+	if err := commit(false, nil); err != storage.ErrRolledBack {
+		t.Errorf("commit = %v, want ErrRolledBack", err)
+	}
+	var got Foo
+	if err := s.ReadDataFile("a", &got); err != nil {
+		t.Fatalf("s.ReadDataFile: %v", err)
+	}
+	if want := (Foo{A: "a", B: 1}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if ok, err := s.TryLock("a"); err != nil || !ok {
+		t.Errorf("s.TryLock(a) = %v, %v, want true", ok, err)
+	}
+
+	// Give up waiting for the lock.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.OpenForUpdateContext(ctx, "a", &a); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("c.OpenForUpdateContext = %v, want DeadlineExceeded", err)
+	}
+	if err := s.Unlock("a"); err != nil {
+		t.Fatalf("s.Unlock: %v", err)
+	}
+
+	if _, err := c.OpenForUpdate("nothing", &a); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("c.OpenForUpdate(nothing) = %v, want ErrNotExist", err)
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	s, conn := newTestServer(t)
+	c := grpcstorage.NewClient(conn)
+
+	content := make([]byte, 1<<20+12345)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	var progress []storage.Progress
+	w, err := c.CreateBlob("blob", storage.WithProgress(func(p storage.Progress) {
+		progress = append(progress, p)
+	}))
+	if err != nil {
+		t.Fatalf("c.CreateBlob: %v", err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if want := []storage.Progress{{Bytes: int64(len(content)), Chunks: 1}, {Bytes: int64(len(content)), Chunks: 1, Done: true}}; !reflect.DeepEqual(progress, want) {
+		t.Errorf("progress = %+v, want %+v", progress, want)
+	}
+	if err := s.VerifyBlob("blob"); err != nil {
+		t.Errorf("s.VerifyBlob: %v", err)
+	}
+
+	if size, err := c.BlobSize("blob"); err != nil || size != int64(len(content)) {
+		t.Errorf("c.BlobSize = %d, %v, want %d", size, err, len(content))
+	}
+	r, err := c.OpenBlobRead("blob")
+	if err != nil {
+		t.Fatalf("c.OpenBlobRead: %v", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("Unexpected blob content")
+	}
+	if _, err := r.Seek(-100, io.SeekEnd); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if got, err = io.ReadAll(r); err != nil || !bytes.Equal(got, content[len(content)-100:]) {
+		t.Errorf("ReadAll after Seek = %d bytes, %v", len(got), err)
+	}
+	if _, err := r.Seek(1000, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(r, buf); err != nil || !bytes.Equal(buf, content[1000:1010]) {
+		t.Errorf("ReadFull after Seek = %v, %v", buf, err)
+	}
+
+	// An aborted blob is discarded.
+	w, err = c.CreateBlob("aborted")
+	if err != nil {
+		t.Fatalf("c.CreateBlob: %v", err)
+	}
+	if _, err := w.Write([]byte("foo")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatalf("Abort: %v", err)
+	}
+	if _, err := c.OpenBlobRead("aborted"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("c.OpenBlobRead(aborted) = %v, want ErrNotExist", err)
+	}
+}
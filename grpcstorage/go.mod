@@ -0,0 +1,20 @@
+module github.com/c2FmZQ/storage/grpcstorage
+
+go 1.22
+
+require (
+	github.com/c2FmZQ/storage v0.0.0-20261015041833-c4dbad651a82
+	google.golang.org/grpc v1.70.0
+	google.golang.org/protobuf v1.36.1
+)
+
+require (
+	github.com/c2FmZQ/tpm v0.4.0 // indirect
+	github.com/google/go-tpm v0.9.3 // indirect
+	golang.org/x/crypto v0.32.0 // indirect
+	golang.org/x/net v0.33.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20241223144023-3abc09e42ca8 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
@@ -0,0 +1,294 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative storage.proto
+
+// Package grpcstorage gives remote access to a storage over gRPC.
+//
+// The server holds the master key and serves the decrypted content of data
+// files and blobs. Client has the same methods as storage.Storage, see Store,
+// and decodes the objects locally:
+//
+//	gs := grpc.NewServer(grpc.Creds(creds))
+//	grpcstorage.RegisterStorageServer(gs, grpcstorage.NewServer(s))
+//
+//	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+//	...
+//	c := grpcstorage.NewClient(conn)
+//	err = c.ReadDataFile("foo", &foo)
+package grpcstorage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/c2FmZQ/storage"
+)
+
+// blobChunkSize is the maximum size of the blob chunks sent in messages.
+const blobChunkSize = 256 * 1024
+
+// Server implements the Storage service with a storage.Storage.
+type Server struct {
+	UnimplementedStorageServer
+	s *storage.Storage
+}
+
+// NewServer returns a Server for s.
+func NewServer(s *storage.Storage) *Server {
+	return &Server{s: s}
+}
+
+// ReadDataFile implements StorageServer.
+func (srv *Server) ReadDataFile(ctx context.Context, req *ReadDataFileRequest) (*DataFile, error) {
+	if err := checkName(req.GetName()); err != nil {
+		return nil, err
+	}
+	var obj storage.EncodedObject
+	if err := srv.s.ReadDataFile(req.GetName(), &obj); err != nil {
+		return nil, toStatus(err)
+	}
+	return &DataFile{Name: req.GetName(), Encoding: obj.Encoding, Data: obj.Data}, nil
+}
+
+// SaveDataFile implements StorageServer.
+func (srv *Server) SaveDataFile(ctx context.Context, req *SaveDataFileRequest) (*SaveDataFileResponse, error) {
+	f := req.GetFile()
+	if f.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing file name")
+	}
+	if err := checkName(f.GetName()); err != nil {
+		return nil, err
+	}
+	obj := &storage.EncodedObject{Encoding: f.GetEncoding(), Data: f.GetData()}
+	if err := srv.s.SaveDataFile(f.GetName(), obj); err != nil {
+		return nil, toStatus(err)
+	}
+	return &SaveDataFileResponse{}, nil
+}
+
+// DeleteFile implements StorageServer.
+func (srv *Server) DeleteFile(ctx context.Context, req *DeleteFileRequest) (*DeleteFileResponse, error) {
+	if err := checkName(req.GetName()); err != nil {
+		return nil, err
+	}
+	if err := srv.s.DeleteFile(req.GetName()); err != nil {
+		return nil, toStatus(err)
+	}
+	return &DeleteFileResponse{}, nil
+}
+
+// RenameFile implements StorageServer.
+func (srv *Server) RenameFile(ctx context.Context, req *RenameFileRequest) (*RenameFileResponse, error) {
+	if err := checkName(req.GetOldName()); err != nil {
+		return nil, err
+	}
+	if err := checkName(req.GetNewName()); err != nil {
+		return nil, err
+	}
+	if err := srv.s.RenameFile(req.GetOldName(), req.GetNewName()); err != nil {
+		return nil, toStatus(err)
+	}
+	return &RenameFileResponse{}, nil
+}
+
+// Update implements StorageServer. The files stay locked for as long as the
+// stream is open, or until the changes are committed or rolled back.
+func (srv *Server) Update(stream Storage_UpdateServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	open := req.GetOpen()
+	if open == nil || len(open.GetNames()) == 0 {
+		return status.Error(codes.InvalidArgument, "the first request must open files")
+	}
+	names := open.GetNames()
+	for _, name := range names {
+		if err := checkName(name); err != nil {
+			return err
+		}
+	}
+	objs := make([]*storage.EncodedObject, len(names))
+	for i := range objs {
+		objs[i] = &storage.EncodedObject{}
+	}
+	commit, err := srv.s.OpenManyForUpdateContext(stream.Context(), names, objs)
+	if err != nil {
+		return toStatus(err)
+	}
+	// Roll back, unless the changes are committed first.
+	defer commit(false, nil)
+
+	resp := &UpdateResponse{}
+	for i, obj := range objs {
+		resp.Files = append(resp.Files, &DataFile{Name: names[i], Encoding: obj.Encoding, Data: obj.Data})
+	}
+	if err := stream.Send(resp); err != nil {
+		return err
+	}
+	if req, err = stream.Recv(); err == io.EOF {
+		return status.Error(codes.Aborted, "stream ended before commit")
+	} else if err != nil {
+		return err
+	}
+	c := req.GetCommit()
+	if c == nil {
+		return status.Error(codes.InvalidArgument, "the second request must commit or roll back")
+	}
+	if !c.GetCommit() {
+		return stream.Send(&UpdateResponse{})
+	}
+	files := c.GetFiles()
+	if len(files) != len(names) {
+		return status.Errorf(codes.InvalidArgument, "got %d files, want %d", len(files), len(names))
+	}
+	for i, f := range files {
+		if f.GetName() != "" && f.GetName() != names[i] {
+			return status.Errorf(codes.InvalidArgument, "got file %q, want %q", f.GetName(), names[i])
+		}
+		*objs[i] = storage.EncodedObject{Encoding: f.GetEncoding(), Data: f.GetData()}
+	}
+	if err := commit(true, nil); err != nil {
+		return toStatus(err)
+	}
+	return stream.Send(&UpdateResponse{})
+}
+
+// BlobSize implements StorageServer.
+func (srv *Server) BlobSize(ctx context.Context, req *BlobSizeRequest) (*BlobSizeResponse, error) {
+	if err := checkName(req.GetName()); err != nil {
+		return nil, err
+	}
+	size, err := srv.s.BlobSize(req.GetName())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &BlobSizeResponse{Size: size}, nil
+}
+
+// ReadBlob implements StorageServer.
+func (srv *Server) ReadBlob(req *ReadBlobRequest, stream Storage_ReadBlobServer) error {
+	if req.GetOffset() < 0 || req.GetLength() < 0 {
+		return status.Error(codes.InvalidArgument, "negative offset or length")
+	}
+	if err := checkName(req.GetName()); err != nil {
+		return err
+	}
+	r, err := srv.s.OpenBlobRead(req.GetName())
+	if err != nil {
+		return toStatus(err)
+	}
+	defer r.Close()
+	if _, err := r.Seek(req.GetOffset(), io.SeekStart); err != nil {
+		return toStatus(err)
+	}
+	var src io.Reader = r
+	if req.GetLength() > 0 {
+		src = io.LimitReader(r, req.GetLength())
+	}
+	buf := make([]byte, blobChunkSize)
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			if err := stream.Send(&BlobChunk{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return toStatus(err)
+		}
+	}
+}
+
+// WriteBlob implements StorageServer.
+func (srv *Server) WriteBlob(stream Storage_WriteBlobServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if req.GetName() == "" {
+		return status.Error(codes.InvalidArgument, "the first request must have the name of the blob")
+	}
+	if err := checkName(req.GetName()); err != nil {
+		return err
+	}
+	w, err := srv.s.CreateBlob(req.GetName())
+	if err != nil {
+		return toStatus(err)
+	}
+	defer w.Abort()
+	for {
+		if _, err := w.Write(req.GetData()); err != nil {
+			return toStatus(err)
+		}
+		if req.GetCommit() {
+			if err := w.Commit(); err != nil {
+				return toStatus(err)
+			}
+			return stream.SendAndClose(&WriteBlobResponse{})
+		}
+		if req, err = stream.Recv(); err == io.EOF {
+			return status.Error(codes.Aborted, "stream ended before commit")
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// checkName returns an InvalidArgument error if name isn't a valid
+// slash-separated path inside the storage, e.g. ../foo, or if it is one of the
+// storage's internal files.
+func checkName(name string) error {
+	if !fs.ValidPath(name) || name == "." || storage.IsInternalFile(name) {
+		return status.Errorf(codes.InvalidArgument, "invalid file name %q", name)
+	}
+	return nil
+}
+
+// toStatus converts an error to a gRPC status, keeping the errors that
+// callers check for recognizable.
+func toStatus(err error) error {
+	code := codes.Unknown
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		code = codes.NotFound
+	case errors.Is(err, fs.ErrExist):
+		code = codes.AlreadyExists
+	case errors.Is(err, fs.ErrPermission):
+		code = codes.PermissionDenied
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	}
+	return status.Error(code, err.Error())
+}
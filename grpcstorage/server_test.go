@@ -0,0 +1,164 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grpcstorage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/c2FmZQ/storage/grpcstorage"
+)
+
+func TestAbandonedLease(t *testing.T) {
+	s, conn := newTestServer(t)
+	c := grpcstorage.NewStorageClient(conn)
+	if err := s.SaveDataFile("a", Foo{A: "a"}); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := c.Update(ctx)
+	if err != nil {
+		t.Fatalf("c.Update: %v", err)
+	}
+	if err := stream.Send(&grpcstorage.UpdateRequest{Request: &grpcstorage.UpdateRequest_Open{Open: &grpcstorage.OpenRequest{Names: []string{"a"}}}}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if f := resp.GetFiles(); len(f) != 1 || f[0].GetName() != "a" || f[0].GetEncoding() != "gob" {
+		t.Fatalf("Unexpected response: %v", resp)
+	}
+	// The lease ends when the client goes away.
+	cancel()
+	if err := s.LockWithTimeout("a", 5*time.Second); err != nil {
+		t.Fatalf("s.LockWithTimeout: %v", err)
+	}
+	s.Unlock("a")
+}
+
+func TestInvalidRequests(t *testing.T) {
+	_, conn := newTestServer(t)
+	c := grpcstorage.NewStorageClient(conn)
+	ctx := context.Background()
+
+	stream, err := c.Update(ctx)
+	if err != nil {
+		t.Fatalf("c.Update: %v", err)
+	}
+	if err := stream.Send(&grpcstorage.UpdateRequest{Request: &grpcstorage.UpdateRequest_Commit{Commit: &grpcstorage.CommitRequest{}}}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Update = %v, want InvalidArgument", err)
+	}
+
+	df := &grpcstorage.DataFile{Name: "foo", Encoding: "records"}
+	if _, err := c.SaveDataFile(ctx, &grpcstorage.SaveDataFileRequest{File: df}); err == nil {
+		t.Error("SaveDataFile with records encoding succeeded")
+	}
+
+	w, err := c.WriteBlob(ctx)
+	if err != nil {
+		t.Fatalf("c.WriteBlob: %v", err)
+	}
+	if err := w.Send(&grpcstorage.WriteBlobRequest{Data: []byte("foo"), Commit: true}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, err := w.CloseAndRecv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("WriteBlob = %v, want InvalidArgument", err)
+	}
+
+	r, err := c.ReadBlob(ctx, &grpcstorage.ReadBlobRequest{Name: "nothing"})
+	if err != nil {
+		t.Fatalf("c.ReadBlob: %v", err)
+	}
+	if _, err := r.Recv(); status.Code(err) != codes.NotFound {
+		t.Errorf("ReadBlob = %v, want NotFound", err)
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	_, conn := newTestServer(t)
+	c := grpcstorage.NewStorageClient(conn)
+	ctx := context.Background()
+
+	for _, name := range []string{"../foo", "a/../../foo", "/etc/passwd", ".", "foo.lock", "pending/foo"} {
+		if _, err := c.ReadDataFile(ctx, &grpcstorage.ReadDataFileRequest{Name: name}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ReadDataFile(%q) = %v, want InvalidArgument", name, err)
+		}
+		df := &grpcstorage.DataFile{Name: name, Encoding: "gob"}
+		if _, err := c.SaveDataFile(ctx, &grpcstorage.SaveDataFileRequest{File: df}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("SaveDataFile(%q) = %v, want InvalidArgument", name, err)
+		}
+		if _, err := c.DeleteFile(ctx, &grpcstorage.DeleteFileRequest{Name: name}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("DeleteFile(%q) = %v, want InvalidArgument", name, err)
+		}
+		if _, err := c.RenameFile(ctx, &grpcstorage.RenameFileRequest{OldName: "foo", NewName: name}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("RenameFile(foo, %q) = %v, want InvalidArgument", name, err)
+		}
+		if _, err := c.RenameFile(ctx, &grpcstorage.RenameFileRequest{OldName: name, NewName: "foo"}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("RenameFile(%q, foo) = %v, want InvalidArgument", name, err)
+		}
+		if _, err := c.BlobSize(ctx, &grpcstorage.BlobSizeRequest{Name: name}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("BlobSize(%q) = %v, want InvalidArgument", name, err)
+		}
+
+		stream, err := c.Update(ctx)
+		if err != nil {
+			t.Fatalf("c.Update: %v", err)
+		}
+		if err := stream.Send(&grpcstorage.UpdateRequest{Request: &grpcstorage.UpdateRequest_Open{Open: &grpcstorage.OpenRequest{Names: []string{"foo", name}}}}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Update(%q) = %v, want InvalidArgument", name, err)
+		}
+
+		r, err := c.ReadBlob(ctx, &grpcstorage.ReadBlobRequest{Name: name})
+		if err != nil {
+			t.Fatalf("c.ReadBlob: %v", err)
+		}
+		if _, err := r.Recv(); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ReadBlob(%q) = %v, want InvalidArgument", name, err)
+		}
+
+		w, err := c.WriteBlob(ctx)
+		if err != nil {
+			t.Fatalf("c.WriteBlob: %v", err)
+		}
+		if err := w.Send(&grpcstorage.WriteBlobRequest{Name: name, Data: []byte("foo"), Commit: true}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		if _, err := w.CloseAndRecv(); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("WriteBlob(%q) = %v, want InvalidArgument", name, err)
+		}
+	}
+}
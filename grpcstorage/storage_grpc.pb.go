@@ -0,0 +1,435 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.29.3
+// source: storage.proto
+
+package grpcstorage
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Storage_ReadDataFile_FullMethodName = "/c2fmzq.storage.v1.Storage/ReadDataFile"
+	Storage_SaveDataFile_FullMethodName = "/c2fmzq.storage.v1.Storage/SaveDataFile"
+	Storage_DeleteFile_FullMethodName   = "/c2fmzq.storage.v1.Storage/DeleteFile"
+	Storage_RenameFile_FullMethodName   = "/c2fmzq.storage.v1.Storage/RenameFile"
+	Storage_Update_FullMethodName       = "/c2fmzq.storage.v1.Storage/Update"
+	Storage_BlobSize_FullMethodName     = "/c2fmzq.storage.v1.Storage/BlobSize"
+	Storage_ReadBlob_FullMethodName     = "/c2fmzq.storage.v1.Storage/ReadBlob"
+	Storage_WriteBlob_FullMethodName    = "/c2fmzq.storage.v1.Storage/WriteBlob"
+)
+
+// StorageClient is the client API for Storage service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Storage gives remote access to a storage. The server holds the master key.
+// Data files and blobs are decrypted by the server, and transferred in the
+// clear, so the connection must be protected, e.g. with TLS.
+type StorageClient interface {
+	// ReadDataFile returns the encoded content of a data file.
+	ReadDataFile(ctx context.Context, in *ReadDataFileRequest, opts ...grpc.CallOption) (*DataFile, error)
+	// SaveDataFile atomically replaces a data file.
+	SaveDataFile(ctx context.Context, in *SaveDataFileRequest, opts ...grpc.CallOption) (*SaveDataFileResponse, error)
+	// DeleteFile deletes a file.
+	DeleteFile(ctx context.Context, in *DeleteFileRequest, opts ...grpc.CallOption) (*DeleteFileResponse, error)
+	// RenameFile renames a file.
+	RenameFile(ctx context.Context, in *RenameFileRequest, opts ...grpc.CallOption) (*RenameFileResponse, error)
+	// Update is a lease on a set of data files. The first request must be
+	// open, and the response contains the content of the files. The files
+	// stay locked until the second request, which commits or rolls back the
+	// changes. The changes are rolled back if the stream ends before that.
+	Update(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[UpdateRequest, UpdateResponse], error)
+	// BlobSize returns the size of the content of a blob.
+	BlobSize(ctx context.Context, in *BlobSizeRequest, opts ...grpc.CallOption) (*BlobSizeResponse, error)
+	// ReadBlob streams the content of a blob, starting at offset.
+	ReadBlob(ctx context.Context, in *ReadBlobRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[BlobChunk], error)
+	// WriteBlob atomically creates or replaces a blob. The first request must
+	// have the name of the blob, and the last one must have commit set. The
+	// blob is discarded if the stream ends before that.
+	WriteBlob(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[WriteBlobRequest, WriteBlobResponse], error)
+}
+
+type storageClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewStorageClient(cc grpc.ClientConnInterface) StorageClient {
+	return &storageClient{cc}
+}
+
+func (c *storageClient) ReadDataFile(ctx context.Context, in *ReadDataFileRequest, opts ...grpc.CallOption) (*DataFile, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DataFile)
+	err := c.cc.Invoke(ctx, Storage_ReadDataFile_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageClient) SaveDataFile(ctx context.Context, in *SaveDataFileRequest, opts ...grpc.CallOption) (*SaveDataFileResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SaveDataFileResponse)
+	err := c.cc.Invoke(ctx, Storage_SaveDataFile_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageClient) DeleteFile(ctx context.Context, in *DeleteFileRequest, opts ...grpc.CallOption) (*DeleteFileResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteFileResponse)
+	err := c.cc.Invoke(ctx, Storage_DeleteFile_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageClient) RenameFile(ctx context.Context, in *RenameFileRequest, opts ...grpc.CallOption) (*RenameFileResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RenameFileResponse)
+	err := c.cc.Invoke(ctx, Storage_RenameFile_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageClient) Update(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[UpdateRequest, UpdateResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Storage_ServiceDesc.Streams[0], Storage_Update_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[UpdateRequest, UpdateResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Storage_UpdateClient = grpc.BidiStreamingClient[UpdateRequest, UpdateResponse]
+
+func (c *storageClient) BlobSize(ctx context.Context, in *BlobSizeRequest, opts ...grpc.CallOption) (*BlobSizeResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BlobSizeResponse)
+	err := c.cc.Invoke(ctx, Storage_BlobSize_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageClient) ReadBlob(ctx context.Context, in *ReadBlobRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[BlobChunk], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Storage_ServiceDesc.Streams[1], Storage_ReadBlob_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ReadBlobRequest, BlobChunk]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Storage_ReadBlobClient = grpc.ServerStreamingClient[BlobChunk]
+
+func (c *storageClient) WriteBlob(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[WriteBlobRequest, WriteBlobResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Storage_ServiceDesc.Streams[2], Storage_WriteBlob_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WriteBlobRequest, WriteBlobResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Storage_WriteBlobClient = grpc.ClientStreamingClient[WriteBlobRequest, WriteBlobResponse]
+
+// StorageServer is the server API for Storage service.
+// All implementations must embed UnimplementedStorageServer
+// for forward compatibility.
+//
+// Storage gives remote access to a storage. The server holds the master key.
+// Data files and blobs are decrypted by the server, and transferred in the
+// clear, so the connection must be protected, e.g. with TLS.
+type StorageServer interface {
+	// ReadDataFile returns the encoded content of a data file.
+	ReadDataFile(context.Context, *ReadDataFileRequest) (*DataFile, error)
+	// SaveDataFile atomically replaces a data file.
+	SaveDataFile(context.Context, *SaveDataFileRequest) (*SaveDataFileResponse, error)
+	// DeleteFile deletes a file.
+	DeleteFile(context.Context, *DeleteFileRequest) (*DeleteFileResponse, error)
+	// RenameFile renames a file.
+	RenameFile(context.Context, *RenameFileRequest) (*RenameFileResponse, error)
+	// Update is a lease on a set of data files. The first request must be
+	// open, and the response contains the content of the files. The files
+	// stay locked until the second request, which commits or rolls back the
+	// changes. The changes are rolled back if the stream ends before that.
+	Update(grpc.BidiStreamingServer[UpdateRequest, UpdateResponse]) error
+	// BlobSize returns the size of the content of a blob.
+	BlobSize(context.Context, *BlobSizeRequest) (*BlobSizeResponse, error)
+	// ReadBlob streams the content of a blob, starting at offset.
+	ReadBlob(*ReadBlobRequest, grpc.ServerStreamingServer[BlobChunk]) error
+	// WriteBlob atomically creates or replaces a blob. The first request must
+	// have the name of the blob, and the last one must have commit set. The
+	// blob is discarded if the stream ends before that.
+	WriteBlob(grpc.ClientStreamingServer[WriteBlobRequest, WriteBlobResponse]) error
+	mustEmbedUnimplementedStorageServer()
+}
+
+// UnimplementedStorageServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedStorageServer struct{}
+
+func (UnimplementedStorageServer) ReadDataFile(context.Context, *ReadDataFileRequest) (*DataFile, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReadDataFile not implemented")
+}
+func (UnimplementedStorageServer) SaveDataFile(context.Context, *SaveDataFileRequest) (*SaveDataFileResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SaveDataFile not implemented")
+}
+func (UnimplementedStorageServer) DeleteFile(context.Context, *DeleteFileRequest) (*DeleteFileResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteFile not implemented")
+}
+func (UnimplementedStorageServer) RenameFile(context.Context, *RenameFileRequest) (*RenameFileResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RenameFile not implemented")
+}
+func (UnimplementedStorageServer) Update(grpc.BidiStreamingServer[UpdateRequest, UpdateResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Update not implemented")
+}
+func (UnimplementedStorageServer) BlobSize(context.Context, *BlobSizeRequest) (*BlobSizeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BlobSize not implemented")
+}
+func (UnimplementedStorageServer) ReadBlob(*ReadBlobRequest, grpc.ServerStreamingServer[BlobChunk]) error {
+	return status.Errorf(codes.Unimplemented, "method ReadBlob not implemented")
+}
+func (UnimplementedStorageServer) WriteBlob(grpc.ClientStreamingServer[WriteBlobRequest, WriteBlobResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method WriteBlob not implemented")
+}
+func (UnimplementedStorageServer) mustEmbedUnimplementedStorageServer() {}
+func (UnimplementedStorageServer) testEmbeddedByValue()                 {}
+
+// UnsafeStorageServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to StorageServer will
+// result in compilation errors.
+type UnsafeStorageServer interface {
+	mustEmbedUnimplementedStorageServer()
+}
+
+func RegisterStorageServer(s grpc.ServiceRegistrar, srv StorageServer) {
+	// If the following call pancis, it indicates UnimplementedStorageServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Storage_ServiceDesc, srv)
+}
+
+func _Storage_ReadDataFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReadDataFileRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).ReadDataFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Storage_ReadDataFile_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).ReadDataFile(ctx, req.(*ReadDataFileRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Storage_SaveDataFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SaveDataFileRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).SaveDataFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Storage_SaveDataFile_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).SaveDataFile(ctx, req.(*SaveDataFileRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Storage_DeleteFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteFileRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).DeleteFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Storage_DeleteFile_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).DeleteFile(ctx, req.(*DeleteFileRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Storage_RenameFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RenameFileRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).RenameFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Storage_RenameFile_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).RenameFile(ctx, req.(*RenameFileRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Storage_Update_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(StorageServer).Update(&grpc.GenericServerStream[UpdateRequest, UpdateResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Storage_UpdateServer = grpc.BidiStreamingServer[UpdateRequest, UpdateResponse]
+
+func _Storage_BlobSize_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlobSizeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).BlobSize(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Storage_BlobSize_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).BlobSize(ctx, req.(*BlobSizeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Storage_ReadBlob_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ReadBlobRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StorageServer).ReadBlob(m, &grpc.GenericServerStream[ReadBlobRequest, BlobChunk]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Storage_ReadBlobServer = grpc.ServerStreamingServer[BlobChunk]
+
+func _Storage_WriteBlob_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(StorageServer).WriteBlob(&grpc.GenericServerStream[WriteBlobRequest, WriteBlobResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Storage_WriteBlobServer = grpc.ClientStreamingServer[WriteBlobRequest, WriteBlobResponse]
+
+// Storage_ServiceDesc is the grpc.ServiceDesc for Storage service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Storage_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "c2fmzq.storage.v1.Storage",
+	HandlerType: (*StorageServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ReadDataFile",
+			Handler:    _Storage_ReadDataFile_Handler,
+		},
+		{
+			MethodName: "SaveDataFile",
+			Handler:    _Storage_SaveDataFile_Handler,
+		},
+		{
+			MethodName: "DeleteFile",
+			Handler:    _Storage_DeleteFile_Handler,
+		},
+		{
+			MethodName: "RenameFile",
+			Handler:    _Storage_RenameFile_Handler,
+		},
+		{
+			MethodName: "BlobSize",
+			Handler:    _Storage_BlobSize_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Update",
+			Handler:       _Storage_Update_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "ReadBlob",
+			Handler:       _Storage_ReadBlob_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WriteBlob",
+			Handler:       _Storage_WriteBlob_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "storage.proto",
+}
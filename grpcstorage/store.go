@@ -0,0 +1,52 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package grpcstorage
+
+import (
+	"context"
+	"io"
+
+	"github.com/c2FmZQ/storage"
+)
+
+// Store is the part of the storage.Storage API that is available remotely.
+// Code that is written against Store works the same way with a local
+// storage.Storage and with a Client.
+type Store interface {
+	ReadDataFile(filename string, obj interface{}) error
+	SaveDataFile(filename string, obj interface{}) error
+	DeleteFile(filename string) error
+	RenameFile(oldname, newname string) error
+	OpenForUpdate(f string, obj interface{}) (func(commit bool, errp *error) error, error)
+	OpenForUpdateContext(ctx context.Context, f string, obj interface{}) (func(commit bool, errp *error) error, error)
+	OpenManyForUpdate(files []string, objects interface{}) (func(commit bool, errp *error) error, error)
+	OpenManyForUpdateContext(ctx context.Context, files []string, objects interface{}) (func(commit bool, errp *error) error, error)
+	BlobSize(filename string) (int64, error)
+	OpenBlobRead(filename string, opts ...storage.BlobOption) (io.ReadSeekCloser, error)
+}
+
+var (
+	_ Store = (*storage.Storage)(nil)
+	_ Store = (*Client)(nil)
+)
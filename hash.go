@@ -0,0 +1,230 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+)
+
+// Blobs written with optHashed end with a trailer that contains the SHA-256
+// hash of their content, followed by the magic string "KRIH". When the blob is
+// encrypted, the trailer is encrypted with the rest of the stream.
+const (
+	blobHashSize    = sha256.Size
+	blobHashTrailer = "KRIH"
+	hashTrailerSize = blobHashSize + len(blobHashTrailer)
+)
+
+var (
+	// ErrBlobHashMismatch indicates that the content of a blob doesn't match
+	// the hash that was recorded when it was written.
+	ErrBlobHashMismatch = errors.New("blob hash mismatch")
+	// ErrNoBlobHash indicates that a blob was written without a hash.
+	ErrNoBlobHash = errors.New("blob doesn't have a hash")
+)
+
+// VerifyBlob reads a blob file entirely and verifies that its content matches
+// the hash that was recorded when it was written.
+func (s *Storage) VerifyBlob(filename string) error {
+	r, err := s.OpenBlobRead(filename)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, ok := r.(*verifyingReader); !ok {
+		return ErrNoBlobHash
+	}
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
+
+// hashingWriter hashes the data written to a blob. The hash itself is written
+// by the hashTrailerWriter at the end of the stream.
+type hashingWriter struct {
+	io.WriteCloser
+	h hash.Hash
+}
+
+func (w *hashingWriter) Write(b []byte) (int, error) {
+	n, err := w.WriteCloser.Write(b)
+	w.h.Write(b[:n])
+	return n, err
+}
+
+// hashTrailerWriter writes the hash trailer when it is closed.
+type hashTrailerWriter struct {
+	io.WriteCloser
+	h hash.Hash
+}
+
+func (w *hashTrailerWriter) Close() error {
+	b := append(w.h.Sum(nil), blobHashTrailer...)
+	_, err := w.WriteCloser.Write(b)
+	if e := w.WriteCloser.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// readHashTrailer reads the hash trailer at the end of r, and returns the hash
+// and the offset of the trailer.
+func readHashTrailer(r io.ReadSeeker) ([]byte, int64, error) {
+	end, err := r.Seek(-int64(hashTrailerSize), io.SeekEnd)
+	if err != nil {
+		return nil, 0, err
+	}
+	b := make([]byte, hashTrailerSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, 0, err
+	}
+	if string(b[blobHashSize:]) != blobHashTrailer {
+		return nil, 0, errors.New("invalid blob hash trailer")
+	}
+	return b[:blobHashSize], end, nil
+}
+
+// hashPrefix hashes the first n bytes of r, which are the content of a blob
+// that may or may not have been closed. It reports whether the content ends
+// with a matching hash trailer, in which case the trailer isn't included in
+// the returned hash.
+func hashPrefix(r io.Reader, n int64) (hash.Hash, bool, error) {
+	h := sha256.New()
+	if n < int64(hashTrailerSize) {
+		_, err := io.CopyN(h, r, n)
+		return h, false, err
+	}
+	if _, err := io.CopyN(h, r, n-int64(hashTrailerSize)); err != nil {
+		return nil, false, err
+	}
+	b := make([]byte, hashTrailerSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, false, err
+	}
+	if string(b[blobHashSize:]) == blobHashTrailer && bytes.Equal(h.Sum(nil), b[:blobHashSize]) {
+		return h, true, nil
+	}
+	h.Write(b)
+	return h, false, nil
+}
+
+// sectionReader reads the part of a stream between start and end.
+type sectionReader struct {
+	r          io.ReadSeekCloser
+	start, end int64
+	off        int64
+}
+
+func newSectionReader(r io.ReadSeekCloser, start, end int64) (*sectionReader, error) {
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &sectionReader{r: r, start: start, end: end, off: start}, nil
+}
+
+func (r *sectionReader) Read(b []byte) (int, error) {
+	if r.off >= r.end {
+		return 0, io.EOF
+	}
+	if max := r.end - r.off; int64(len(b)) > max {
+		b = b[:max]
+	}
+	n, err := r.r.Read(b)
+	r.off += int64(n)
+	return n, err
+}
+
+func (r *sectionReader) Seek(offset int64, whence int) (int64, error) {
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = r.start + offset
+	case io.SeekCurrent:
+		newOffset = r.off + offset
+	case io.SeekEnd:
+		newOffset = r.end + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if newOffset < r.start {
+		return 0, fs.ErrInvalid
+	}
+	if newOffset != r.off {
+		if _, err := r.r.Seek(newOffset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		r.off = newOffset
+	}
+	return r.off - r.start, nil
+}
+
+func (r *sectionReader) Close() error {
+	return r.r.Close()
+}
+
+// verifyingReader verifies the hash of a blob when it is read sequentially
+// from start to end.
+type verifyingReader struct {
+	io.ReadSeekCloser
+	h          hash.Hash
+	want       []byte
+	off        int64
+	sequential bool
+}
+
+func newVerifyingReader(r io.ReadSeekCloser, want []byte) *verifyingReader {
+	return &verifyingReader{ReadSeekCloser: r, h: sha256.New(), want: want, sequential: true}
+}
+
+func (r *verifyingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadSeekCloser.Read(b)
+	r.off += int64(n)
+	if r.sequential {
+		r.h.Write(b[:n])
+		if err == io.EOF {
+			r.sequential = false
+			if !bytes.Equal(r.h.Sum(nil), r.want) {
+				return n, ErrBlobHashMismatch
+			}
+		}
+	}
+	return n, err
+}
+
+func (r *verifyingReader) Seek(offset int64, whence int) (int64, error) {
+	off, err := r.ReadSeekCloser.Seek(offset, whence)
+	if err != nil {
+		return off, err
+	}
+	if off != r.off {
+		r.sequential = false
+		r.off = off
+	}
+	return off, nil
+}
@@ -0,0 +1,124 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeBlob(t *testing.T, s *Storage, filename string, content []byte) {
+	t.Helper()
+	w, err := s.CreateBlob(filename)
+	if err != nil {
+		t.Fatalf("s.CreateBlob: %v", err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatalf("w.Write: %v", err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("w.Commit: %v", err)
+	}
+}
+
+func TestVerifyBlob(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithCompression()}} {
+		dir := t.TempDir()
+		s := New(dir, nil, opts...)
+		content := []byte("Hello world! This is a test blob.")
+		writeBlob(t, s, "blob", content)
+
+		if err := s.VerifyBlob("blob"); err != nil {
+			t.Fatalf("s.VerifyBlob: %v", err)
+		}
+		if got := readBlob(t, s, "blob"); string(got) != string(content) {
+			t.Fatalf("Unexpected content. Want %q, got %q", content, got)
+		}
+		var b []byte
+		if err := s.ReadDataFile("blob", &b); err != nil || string(b) != string(content) {
+			t.Fatalf("s.ReadDataFile = %q, %v", b, err)
+		}
+	}
+}
+
+func TestVerifyBlobCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, nil)
+	writeBlob(t, s, "blob", []byte("Hello world!"))
+
+	fn := filepath.Join(dir, "blob")
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+	// Flip the 'w' of "world".
+	b[5+6] ^= 0x20
+	if err := os.WriteFile(fn, b, 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+
+	if err := s.VerifyBlob("blob"); !errors.Is(err, ErrBlobHashMismatch) {
+		t.Errorf("s.VerifyBlob: want %v, got %v", ErrBlobHashMismatch, err)
+	}
+	r, err := s.OpenBlobRead("blob")
+	if err != nil {
+		t.Fatalf("s.OpenBlobRead: %v", err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrBlobHashMismatch) {
+		t.Errorf("io.ReadAll: want %v, got %v", ErrBlobHashMismatch, err)
+	}
+	// Partial reads aren't verified.
+	if _, err := r.Seek(6, io.SeekStart); err != nil {
+		t.Fatalf("r.Seek: %v", err)
+	}
+	if got, err := io.ReadAll(r); err != nil || string(got) != "World!" {
+		t.Errorf("io.ReadAll = %q, %v", got, err)
+	}
+}
+
+func TestVerifyBlobWithoutHash(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, aesEncryptionKey())
+
+	w, err := s.openUncompressedWriteStream(fileContext("blob"), filepath.Join(dir, "blob"), optRawBytes|s.streamFlags(), 1024)
+	if err != nil {
+		t.Fatalf("s.openUncompressedWriteStream: %v", err)
+	}
+	if _, err := w.Write([]byte("Hello world!")); err != nil {
+		t.Fatalf("w.Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("w.Close: %v", err)
+	}
+	if err := s.VerifyBlob("blob"); !errors.Is(err, ErrNoBlobHash) {
+		t.Errorf("s.VerifyBlob: want %v, got %v", ErrNoBlobHash, err)
+	}
+	if got := readBlob(t, s, "blob"); string(got) != "Hello world!" {
+		t.Errorf("Unexpected content %q", got)
+	}
+}
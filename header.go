@@ -0,0 +1,149 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+// FileHeader describes how a file is encoded.
+type FileHeader struct {
+	// Encoding is one of json, gob, binary, raw, records, or paged.
+	Encoding   string
+	Encrypted  bool
+	Compressed bool
+	Padded     bool
+	// Hashed is true for blobs that end with a hash of their content.
+	Hashed bool
+	// Signed is true for data files that have a signature in their header.
+	Signed bool
+	// KeyID is the ID of the master key that encrypted the file key, or
+	// empty if it isn't known. See crypto.KeyID.
+	KeyID string
+}
+
+// String returns a comma-separated list of the encoding and flags, e.g.
+// gob,encrypted,padded.
+func (h FileHeader) String() string {
+	parts := []string{h.Encoding}
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"encrypted", h.Encrypted},
+		{"compressed", h.Compressed},
+		{"padded", h.Padded},
+		{"hashed", h.Hashed},
+		{"signed", h.Signed},
+	} {
+		if f.set {
+			parts = append(parts, f.name)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// ReadHeader returns the header of a file. The file doesn't have to be
+// decrypted to read its header.
+func (s *Storage) ReadHeader(filename string) (FileHeader, error) {
+	flags, signed, err := s.readFlags(filename)
+	if err != nil {
+		return FileHeader{}, err
+	}
+	h := FileHeader{
+		Encrypted:  flags&optEncrypted != 0,
+		Compressed: flags&optCompressed != 0,
+		Padded:     flags&optPadded != 0,
+		Hashed:     flags&optHashed != 0,
+		Signed:     signed,
+	}
+	enc, ok := encodingNames[flags&optEncodingMask]
+	if !ok {
+		return h, errors.New("unexpected encoding")
+	}
+	h.Encoding = enc
+	if h.Encrypted {
+		if h.KeyID, err = s.readKeyID(filename); err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+// readKeyID returns the ID of the master key that encrypted the file key of
+// an encrypted file.
+func (s *Storage) readKeyID(filename string) (string, error) {
+	f, err := s.backend.Open(filepath.Join(s.dir, filename))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		return "", err
+	}
+	if string(hdr[:4]) == signedMagic {
+		// Skip the signature.
+		var n [1]byte
+		if _, err := io.ReadFull(f, n[:]); err != nil {
+			return "", err
+		}
+		if _, err := f.Seek(int64(n[0]), io.SeekCurrent); err != nil {
+			return "", err
+		}
+	}
+	// The key ID is in the first 9 bytes of the encrypted key.
+	b := make([]byte, 9)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return "", err
+	}
+	return crypto.EncryptedKeyID(b), nil
+}
+
+// readFlags returns the flags byte of the header of a file, and whether the
+// file is signed.
+func (s *Storage) readFlags(filename string) (byte, bool, error) {
+	f, err := s.backend.Open(filepath.Join(s.dir, filename))
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		return 0, false, err
+	}
+	switch string(hdr[:4]) {
+	case "KRIN":
+		return hdr[4], false, nil
+	case signedMagic:
+		return hdr[4], true, nil
+	default:
+		return 0, false, errors.New("wrong file type")
+	}
+}
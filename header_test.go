@@ -0,0 +1,72 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+func TestReadHeader(t *testing.T) {
+	mk := aesEncryptionKey()
+	s := New(t.TempDir(), mk)
+	if err := s.SaveDataFile("foo", "foo"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	raw := []byte("raw")
+	if err := New(s.Dir(), nil).SaveDataFile("raw", &raw); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	writeBlob(t, s, "blob", []byte("blob"))
+	if err := s.AppendRecord("records", "foo"); err != nil {
+		t.Fatalf("s.AppendRecord: %v", err)
+	}
+
+	keyID := crypto.KeyID(mk)
+	for _, tc := range []struct {
+		name  string
+		want  string
+		keyID string
+	}{
+		{"foo", "gob,encrypted,padded", keyID},
+		{"raw", "raw", ""},
+		{"blob", "raw,encrypted,padded,hashed", keyID},
+		{"records", "records,encrypted", keyID},
+	} {
+		h, err := s.ReadHeader(tc.name)
+		if err != nil {
+			t.Fatalf("s.ReadHeader(%q): %v", tc.name, err)
+		}
+		if got := h.String(); got != tc.want {
+			t.Errorf("s.ReadHeader(%q) = %s, want %s", tc.name, got, tc.want)
+		}
+		if got := h.KeyID; got != tc.keyID {
+			t.Errorf("s.ReadHeader(%q).KeyID = %q, want %q", tc.name, got, tc.keyID)
+		}
+	}
+	if _, err := s.ReadHeader("nothing"); err == nil {
+		t.Error("s.ReadHeader(nothing) succeeded")
+	}
+}
@@ -0,0 +1,85 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// BlobHTTPHandler returns an http.Handler that serves the decrypted content of
+// the blobs in s. The name of the blob is the URL path without prefix. The
+// handler supports conditional requests and byte ranges, see
+// http.ServeContent.
+func BlobHTTPHandler(s *Storage, prefix string) http.Handler {
+	return &blobHandler{s: s, prefix: prefix}
+}
+
+type blobHandler struct {
+	s      *Storage
+	prefix string
+}
+
+func (h *blobHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := strings.CutPrefix(req.URL.Path, h.prefix)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if name == "" {
+		http.NotFound(w, req)
+		return
+	}
+	fi, err := h.s.backend.Stat(filepath.Join(h.s.dir, filepath.FromSlash(name)))
+	if err != nil || !fi.Mode().IsRegular() {
+		http.NotFound(w, req)
+		return
+	}
+	r, err := h.s.openBlobRead(filepath.FromSlash(name), filepath.FromSlash(name))
+	if err != nil {
+		h.s.Logger().Debugf("BlobHTTPHandler(%q): %v", name, err)
+		http.NotFound(w, req)
+		return
+	}
+	defer r.Close()
+
+	// The ETag is derived from the hash of the content when it is
+	// available, and from the file's metadata otherwise.
+	tag := fmt.Sprintf("%d-%d", fi.Size(), fi.ModTime().UnixNano())
+	if vr, ok := r.(*verifyingReader); ok {
+		tag = hex.EncodeToString(vr.want)
+	}
+	w.Header().Set("ETag", `"`+h.s.hashString(tag)[:32]+`"`)
+	http.ServeContent(w, req, path.Base(name), fi.ModTime(), r)
+}
@@ -0,0 +1,102 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestBlobHTTPHandler(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, aesEncryptionKey())
+	content := []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	writeBlob(t, s, "dir/blob.txt", content)
+
+	srv := httptest.NewServer(BlobHTTPHandler(s, "/blobs/"))
+	defer srv.Close()
+
+	get := func(method, path string, hdr map[string]string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest: %v", err)
+		}
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("http.Do: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("io.ReadAll: %v", err)
+		}
+		return resp, string(body)
+	}
+
+	resp, body := get("GET", "/blobs/dir/blob.txt", nil)
+	if resp.StatusCode != 200 || body != string(content) {
+		t.Fatalf("GET = %d %q", resp.StatusCode, body)
+	}
+	if got, want := resp.Header.Get("Content-Length"), strconv.Itoa(len(content)); got != want {
+		t.Errorf("Content-Length = %q, want %q", got, want)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("ETag is missing")
+	}
+
+	resp, body = get("GET", "/blobs/dir/blob.txt", map[string]string{"Range": "bytes=5-9"})
+	if resp.StatusCode != http.StatusPartialContent || body != "FGHIJ" {
+		t.Errorf("GET with range = %d %q", resp.StatusCode, body)
+	}
+	resp, body = get("GET", "/blobs/dir/blob.txt", map[string]string{"Range": "bytes=-3"})
+	if resp.StatusCode != http.StatusPartialContent || body != "XYZ" {
+		t.Errorf("GET with suffix range = %d %q", resp.StatusCode, body)
+	}
+	if resp, _ = get("GET", "/blobs/dir/blob.txt", map[string]string{"If-None-Match": etag}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("GET with If-None-Match = %d", resp.StatusCode)
+	}
+	resp, body = get("HEAD", "/blobs/dir/blob.txt", nil)
+	if resp.StatusCode != 200 || body != "" || resp.ContentLength != int64(len(content)) {
+		t.Errorf("HEAD = %d %q %d", resp.StatusCode, body, resp.ContentLength)
+	}
+	if resp, _ = get("POST", "/blobs/dir/blob.txt", nil); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST = %d", resp.StatusCode)
+	}
+	for _, p := range []string{"/blobs/nothere", "/blobs/dir", "/blobs/", "/other/dir/blob.txt"} {
+		if resp, _ = get("GET", p, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s = %d", p, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package index maintains secondary indexes of data files, on top of an
+// encrypted storage.
+//
+// Callers register an Extractor for each indexed field. When a data file is
+// written or deleted with the Index, the index files are updated in the same
+// transaction as the data file, so they are always consistent with it. A
+// Lookup then returns the names of the files that have a given value, without
+// reading any of them. The fields that are registered with RegisterOrdered
+// also support Range lookups.
+//
+// The index files are encrypted like all the other files, and their names are
+// keyed hashes of the fields and values.
+//
+// Example:
+//
+//	idx := index.New(s, "index/users")
+//	idx.Register("email", func(obj any) []string {
+//		return []string{obj.(*User).Email}
+//	})
+//	tx, err := s.Begin()
+//	if err != nil {
+//		return err
+//	}
+//	defer tx.Rollback()
+//	if err := idx.Write(tx, "users/alice", &user); err != nil {
+//		return err
+//	}
+//	if err := tx.Commit(); err != nil {
+//		return err
+//	}
+//	...
+//	files, err := idx.Lookup("email", "alice@example.com")
+package index
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/c2FmZQ/storage"
+)
+
+// fanoutLevels is the number of levels of the directory tree of each field.
+const fanoutLevels = 2
+
+// Extractor returns the values of a field of obj. The obj is the object that
+// was passed to Write.
+type Extractor func(obj any) []string
+
+// Index is a set of secondary indexes.
+type Index struct {
+	s   *storage.Storage
+	dir string
+
+	mu      sync.Mutex
+	fields  map[string]Extractor
+	ordered map[string]bool
+}
+
+// entry is the content of the index file of a value.
+type entry struct {
+	Field string   `json:"field"`
+	Value string   `json:"value"`
+	Files []string `json:"files"`
+}
+
+// doc is the content of the file that has the indexed values of a data file.
+// It is used to remove the old values when the data file changes.
+type doc struct {
+	File   string              `json:"file"`
+	Values map[string][]string `json:"values"`
+}
+
+// valueList is the content of the file that has the sorted values of an
+// ordered field.
+type valueList struct {
+	Field  string   `json:"field"`
+	Values []string `json:"values"`
+}
+
+// New returns an Index that keeps its files under dir in s.
+func New(s *storage.Storage, dir string) *Index {
+	return &Index{s: s, dir: dir, fields: make(map[string]Extractor), ordered: make(map[string]bool)}
+}
+
+// Register adds an indexed field. Only the files that are written after the
+// field is registered are indexed.
+func (x *Index) Register(field string, fn Extractor) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.fields[field] = fn
+	delete(x.ordered, field)
+}
+
+// RegisterOrdered is like Register, but the index also keeps the sorted list
+// of the distinct values of the field, so that it supports Range. This list
+// is one file, which is updated each time a value is added or removed.
+func (x *Index) RegisterOrdered(field string, fn Extractor) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.fields[field] = fn
+	x.ordered[field] = true
+}
+
+func (x *Index) isOrdered(field string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.ordered[field]
+}
+
+// entryFileName returns the name of the index file of a value.
+func (x *Index) entryFileName(field, value string) string {
+	return filepath.Join(x.dir, x.s.FanoutPath(field, 0), x.s.FanoutPath(value, fanoutLevels))
+}
+
+// valuesFileName returns the name of the file that has the sorted values of
+// an ordered field.
+func (x *Index) valuesFileName(field string) string {
+	return filepath.Join(x.dir, x.s.FanoutPath(field, 0), "values")
+}
+
+// docFileName returns the name of the file that has the indexed values of a
+// data file.
+func (x *Index) docFileName(filename string) string {
+	return filepath.Join(x.dir, "docs", x.s.FanoutPath(filename, fanoutLevels))
+}
+
+// extract returns the sorted values of all the fields of obj.
+func (x *Index) extract(obj any) map[string][]string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	values := make(map[string][]string, len(x.fields))
+	for field, fn := range x.fields {
+		v := fn(obj)
+		if len(v) == 0 {
+			continue
+		}
+		v = slices.Clone(v)
+		sort.Strings(v)
+		values[field] = slices.Compact(v)
+	}
+	return values
+}
+
+// Write stages obj to be written to filename in tx, along with the changes to
+// the index files.
+//
+// The index files are locked in a consistent order, but transactions that
+// call Write more than once can deadlock with each other, like any other
+// transactions that lock files in a different order.
+func (x *Index) Write(tx *storage.Tx, filename string, obj any) error {
+	if err := x.update(tx, filename, x.extract(obj)); err != nil {
+		return err
+	}
+	return tx.Write(filename, obj)
+}
+
+// Reindex updates the index files of filename in tx, without writing the data
+// file. It can be used to index existing files after a new field is
+// registered.
+func (x *Index) Reindex(tx *storage.Tx, filename string, obj any) error {
+	return x.update(tx, filename, x.extract(obj))
+}
+
+// Delete stages filename to be deleted in tx, and removes it from the index
+// files.
+func (x *Index) Delete(tx *storage.Tx, filename string) error {
+	if err := x.update(tx, filename, nil); err != nil {
+		return err
+	}
+	return tx.Delete(filename)
+}
+
+// update replaces the indexed values of filename with values.
+func (x *Index) update(tx *storage.Tx, filename string, values map[string][]string) error {
+	filename = filepath.Clean(filename)
+	docFile := x.docFileName(filename)
+	var old doc
+	if err := tx.Read(docFile, &old); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	type change struct {
+		field, value string
+		add          bool
+	}
+	changes := make(map[string]change)
+	for field, vv := range old.Values {
+		for _, v := range vv {
+			if !slices.Contains(values[field], v) {
+				changes[x.entryFileName(field, v)] = change{field, v, false}
+			}
+		}
+	}
+	for field, vv := range values {
+		for _, v := range vv {
+			if !slices.Contains(old.Values[field], v) {
+				changes[x.entryFileName(field, v)] = change{field, v, true}
+			}
+		}
+	}
+	files := make([]string, 0, len(changes))
+	for f := range changes {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+
+	// The values that are added to, or removed from, the ordered fields.
+	valueChanges := make(map[string]map[string]bool)
+	for _, f := range files {
+		c := changes[f]
+		var e entry
+		if err := tx.Read(f, &e); errors.Is(err, fs.ErrNotExist) {
+			e = entry{Field: c.field, Value: c.value}
+		} else if err != nil {
+			return err
+		}
+		wasEmpty := len(e.Files) == 0
+		i, found := slices.BinarySearch(e.Files, filename)
+		switch {
+		case c.add && !found:
+			e.Files = slices.Insert(e.Files, i, filename)
+		case !c.add && found:
+			e.Files = slices.Delete(e.Files, i, i+1)
+		}
+		var err error
+		if len(e.Files) == 0 {
+			err = tx.Delete(f)
+		} else {
+			err = tx.Write(f, &e)
+		}
+		if err != nil {
+			return err
+		}
+		if wasEmpty != (len(e.Files) == 0) && x.isOrdered(c.field) {
+			if valueChanges[c.field] == nil {
+				valueChanges[c.field] = make(map[string]bool)
+			}
+			valueChanges[c.field][c.value] = wasEmpty
+		}
+	}
+	if err := x.updateValues(tx, valueChanges); err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		if old.File == "" {
+			return nil
+		}
+		return tx.Delete(docFile)
+	}
+	return tx.Write(docFile, &doc{File: filename, Values: values})
+}
+
+// updateValues adds values to, or removes values from, the sorted lists of
+// the values of ordered fields.
+func (x *Index) updateValues(tx *storage.Tx, changes map[string]map[string]bool) error {
+	fields := make(map[string]string, len(changes))
+	files := make([]string, 0, len(changes))
+	for field := range changes {
+		f := x.valuesFileName(field)
+		fields[f] = field
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		field := fields[f]
+		var vl valueList
+		if err := tx.Read(f, &vl); errors.Is(err, fs.ErrNotExist) {
+			vl = valueList{Field: field}
+		} else if err != nil {
+			return err
+		}
+		for v, add := range changes[field] {
+			i, found := slices.BinarySearch(vl.Values, v)
+			switch {
+			case add && !found:
+				vl.Values = slices.Insert(vl.Values, i, v)
+			case !add && found:
+				vl.Values = slices.Delete(vl.Values, i, i+1)
+			}
+		}
+		var err error
+		if len(vl.Values) == 0 {
+			err = tx.Delete(f)
+		} else {
+			err = tx.Write(f, &vl)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lookup returns the sorted names of the files that have value in field.
+func (x *Index) Lookup(field, value string) ([]string, error) {
+	var e entry
+	if err := x.s.ReadDataFile(x.entryFileName(field, value), &e); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return e.Files, nil
+}
+
+// Range returns the sorted names of the files that have a value in field
+// with from <= value < to. An empty to means no upper bound. The field must
+// be registered with RegisterOrdered.
+func (x *Index) Range(field, from, to string) ([]string, error) {
+	if !x.isOrdered(field) {
+		return nil, fmt.Errorf("field %q isn't ordered", field)
+	}
+	var vl valueList
+	if err := x.s.ReadDataFile(x.valuesFileName(field), &vl); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	i, _ := slices.BinarySearch(vl.Values, from)
+	var out []string
+	for _, v := range vl.Values[i:] {
+		if to != "" && v >= to {
+			break
+		}
+		files, err := x.Lookup(field, v)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, files...)
+	}
+	sort.Strings(out)
+	return slices.Compact(out), nil
+}
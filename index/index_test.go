@@ -0,0 +1,199 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package index_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/index"
+	"github.com/c2FmZQ/storage/internal/storagetest"
+)
+
+type user struct {
+	Email  string
+	Groups []string
+}
+
+func newIndex(s *storage.Storage) *index.Index {
+	idx := index.New(s, "index")
+	idx.Register("email", func(obj any) []string {
+		return []string{obj.(*user).Email}
+	})
+	idx.Register("group", func(obj any) []string {
+		return obj.(*user).Groups
+	})
+	return idx
+}
+
+func write(t *testing.T, s *storage.Storage, idx *index.Index, filename string, u *user) {
+	t.Helper()
+	tx, err := s.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	defer tx.Rollback()
+	if u == nil {
+		err = idx.Delete(tx, filename)
+	} else {
+		err = idx.Write(tx, filename, u)
+	}
+	if err != nil {
+		t.Fatalf("%s: %v", filename, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+}
+
+func lookup(t *testing.T, idx *index.Index, field, value string, want []string) {
+	t.Helper()
+	got, err := idx.Lookup(field, value)
+	if err != nil {
+		t.Fatalf("Lookup(%q, %q): %v", field, value, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Lookup(%q, %q) = %q, want %q", field, value, got, want)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	s := storagetest.New(t)
+	idx := newIndex(s)
+	write(t, s, idx, "users/alice", &user{Email: "alice@example.com", Groups: []string{"admin", "dev"}})
+	write(t, s, idx, "users/bob", &user{Email: "bob@example.com", Groups: []string{"dev"}})
+
+	lookup(t, idx, "email", "alice@example.com", []string{"users/alice"})
+	lookup(t, idx, "group", "dev", []string{"users/alice", "users/bob"})
+	lookup(t, idx, "group", "admin", []string{"users/alice"})
+	lookup(t, idx, "group", "ops", nil)
+
+	var u user
+	if err := s.ReadDataFile("users/bob", &u); err != nil || u.Email != "bob@example.com" {
+		t.Errorf("ReadDataFile() = %+v, %v", u, err)
+	}
+
+	// Changing values.
+	write(t, s, idx, "users/alice", &user{Email: "alice@example.org", Groups: []string{"dev", "ops"}})
+	lookup(t, idx, "email", "alice@example.com", nil)
+	lookup(t, idx, "email", "alice@example.org", []string{"users/alice"})
+	lookup(t, idx, "group", "admin", nil)
+	lookup(t, idx, "group", "dev", []string{"users/alice", "users/bob"})
+	lookup(t, idx, "group", "ops", []string{"users/alice"})
+
+	// Deleting files.
+	write(t, s, idx, "users/bob", nil)
+	lookup(t, idx, "email", "bob@example.com", nil)
+	lookup(t, idx, "group", "dev", []string{"users/alice"})
+	if err := s.ReadDataFile("users/bob", &u); err == nil {
+		t.Error("ReadDataFile() succeeded after Delete")
+	}
+}
+
+func TestRollback(t *testing.T) {
+	s := storagetest.New(t)
+	idx := newIndex(s)
+	tx, err := s.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if err := idx.Write(tx, "users/alice", &user{Email: "alice@example.com"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	lookup(t, idx, "email", "alice@example.com", nil)
+}
+
+func TestReindex(t *testing.T) {
+	s := storagetest.New(t)
+	idx := index.New(s, "index")
+	u := &user{Email: "alice@example.com"}
+	write(t, s, idx, "users/alice", u)
+	lookup(t, idx, "email", "alice@example.com", nil)
+
+	idx = newIndex(s)
+	tx, err := s.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	defer tx.Rollback()
+	if err := idx.Reindex(tx, "users/alice", u); err != nil {
+		t.Fatalf("Reindex: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	lookup(t, idx, "email", "alice@example.com", []string{"users/alice"})
+}
+
+func TestRange(t *testing.T) {
+	s := storagetest.New(t)
+	idx := index.New(s, "index")
+	idx.RegisterOrdered("email", func(obj any) []string {
+		return []string{obj.(*user).Email}
+	})
+	write(t, s, idx, "users/alice", &user{Email: "alice@example.com"})
+	write(t, s, idx, "users/bob", &user{Email: "bob@example.com"})
+	write(t, s, idx, "users/bob2", &user{Email: "bob@example.com"})
+	write(t, s, idx, "users/carol", &user{Email: "carol@example.com"})
+
+	for _, tc := range []struct {
+		from, to string
+		want     []string
+	}{
+		{"", "", []string{"users/alice", "users/bob", "users/bob2", "users/carol"}},
+		{"b", "c", []string{"users/bob", "users/bob2"}},
+		{"bob@example.com", "", []string{"users/bob", "users/bob2", "users/carol"}},
+		{"", "bob@example.com", []string{"users/alice"}},
+		{"d", "", nil},
+	} {
+		got, err := idx.Range("email", tc.from, tc.to)
+		if err != nil {
+			t.Fatalf("Range(%q, %q): %v", tc.from, tc.to, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Range(%q, %q) = %q, want %q", tc.from, tc.to, got, tc.want)
+		}
+	}
+
+	write(t, s, idx, "users/bob", nil)
+	write(t, s, idx, "users/carol", &user{Email: "carol@example.org"})
+	got, err := idx.Range("email", "b", "")
+	if err != nil {
+		t.Fatalf("Range: %v", err)
+	}
+	if want := []string{"users/bob2", "users/carol"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Range() = %q, want %q", got, want)
+	}
+	write(t, s, idx, "users/bob2", nil)
+	if got, err := idx.Range("email", "bob", "c"); err != nil || got != nil {
+		t.Errorf("Range() = %q, %v", got, err)
+	}
+	if _, err := newIndex(s).Range("email", "", ""); err == nil {
+		t.Error("Range() succeeded on a field that isn't ordered")
+	}
+}
@@ -0,0 +1,357 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package jobs stores the state of jobs, e.g. for a scheduler, on top of an
+// encrypted storage.
+//
+// Each job is in one of the states Pending, Running, Done, or Failed. A worker
+// claims a pending job with a lease, which moves it to Running until the lease
+// expires. The worker renews the lease while it works on the job, and then
+// marks it done or failed. A job whose lease expired, e.g. because the worker
+// died, can be claimed again. All the state transitions are atomic, and they
+// are checked against the lease, so a worker that lost its lease can't change
+// the job anymore.
+//
+// Example:
+//
+//	js := jobs.New(s, "jobs")
+//	if _, err := js.Create("resize-123", payload); err != nil {
+//		return err
+//	}
+//	...
+//	j, err := js.ClaimNext("worker-1", time.Minute)
+//	if errors.Is(err, jobs.ErrNoJobs) {
+//		return nil
+//	}
+//	if err != nil {
+//		return err
+//	}
+//	if err := run(j.Data); err != nil {
+//		return js.Fail(j, err.Error())
+//	}
+//	return js.Complete(j, nil)
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+)
+
+var (
+	// ErrNotFound is returned when a job doesn't exist.
+	ErrNotFound = errors.New("job not found")
+	// ErrExists is returned by Create when a job already exists.
+	ErrExists = errors.New("job already exists")
+	// ErrNotClaimable is returned by Claim when a job isn't pending, and its
+	// lease, if any, hasn't expired.
+	ErrNotClaimable = errors.New("job can't be claimed")
+	// ErrNoJobs is returned by ClaimNext when there are no jobs to claim.
+	ErrNoJobs = errors.New("no jobs to claim")
+	// ErrLeaseLost is returned when the lease of a job expired, or when the
+	// job was claimed again.
+	ErrLeaseLost = errors.New("job lease lost")
+	// ErrNotFailed is returned by Retry when a job isn't failed.
+	ErrNotFailed = errors.New("job isn't failed")
+)
+
+// State is the state of a job.
+type State string
+
+const (
+	// Pending jobs are waiting to be claimed.
+	Pending State = "pending"
+	// Running jobs are claimed by a worker.
+	Running State = "running"
+	// Done jobs completed successfully.
+	Done State = "done"
+	// Failed jobs completed with an error.
+	Failed State = "failed"
+)
+
+// Job is a job.
+type Job struct {
+	// ID is the ID of the job.
+	ID string `json:"id"`
+	// State is the state of the job.
+	State State `json:"state"`
+	// Data is the data of the job, as passed to Create.
+	Data []byte `json:"data,omitempty"`
+	// Result is the result of the job, as passed to Complete.
+	Result []byte `json:"result,omitempty"`
+	// Error is the error message of the last failure, as passed to Fail.
+	Error string `json:"error,omitempty"`
+	// Owner is the worker that claimed the job last.
+	Owner string `json:"owner,omitempty"`
+	// Attempt is the number of times the job was claimed.
+	Attempt int `json:"attempt"`
+	// LeaseExpires is when the lease of a running job expires.
+	LeaseExpires time.Time `json:"leaseExpires,omitempty"`
+	// Created is when the job was created.
+	Created time.Time `json:"created"`
+	// Updated is when the job last changed.
+	Updated time.Time `json:"updated"`
+}
+
+// claimable returns whether the job can be claimed at time now.
+func (j *Job) claimable(now time.Time) bool {
+	return j.State == Pending || (j.State == Running && !now.Before(j.LeaseExpires))
+}
+
+// Store stores jobs.
+type Store struct {
+	s   *storage.Storage
+	dir string
+}
+
+// New returns a Store that keeps the jobs in dir.
+func New(s *storage.Storage, dir string) *Store {
+	return &Store{s: s, dir: dir}
+}
+
+// fileName returns the name of the file of a job. The IDs of the jobs are not
+// visible in the file names.
+func (js *Store) fileName(id string) string {
+	return filepath.Join(js.dir, js.s.HashString(id))
+}
+
+// update calls fn with the job in a transaction, and commits the changes if
+// fn returns nil. The job is nil if it doesn't exist.
+func (js *Store) update(id string, fn func(tx *storage.Tx, j *Job) error) error {
+	fileName := js.fileName(id)
+	tx, err := js.s.Begin(fileName)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var j *Job
+	if err := tx.Read(fileName, &j); errors.Is(err, fs.ErrNotExist) {
+		j = nil
+	} else if err != nil {
+		return err
+	}
+	if err := fn(tx, j); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Create adds a pending job.
+func (js *Store) Create(id string, data []byte) (*Job, error) {
+	if id == "" {
+		return nil, fmt.Errorf("empty job id")
+	}
+	now := time.Now().UTC()
+	j := &Job{ID: id, State: Pending, Data: append([]byte(nil), data...), Created: now, Updated: now}
+	err := js.update(id, func(tx *storage.Tx, old *Job) error {
+		if old != nil {
+			return ErrExists
+		}
+		return tx.Write(js.fileName(id), j)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Get returns a job.
+func (js *Store) Get(id string) (*Job, error) {
+	var j Job
+	if err := js.s.ReadDataFile(js.fileName(id), &j); errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// List returns the jobs that are in any of the given states, or all the jobs
+// if no states are given, oldest first. A running job whose lease expired is
+// listed as running.
+func (js *Store) List(states ...State) ([]*Job, error) {
+	entries, err := js.s.FS().ReadDir(filepath.ToSlash(js.dir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []*Job
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		var j Job
+		if err := js.s.ReadDataFile(filepath.Join(js.dir, e.Name()), &j); errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if len(states) == 0 || slices.Contains(states, j.State) {
+			out = append(out, &j)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Created.Equal(out[j].Created) {
+			return out[i].Created.Before(out[j].Created)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out, nil
+}
+
+// Claim moves a job to Running, with a lease that expires after d. The job
+// must be pending, or running with an expired lease.
+func (js *Store) Claim(id, owner string, d time.Duration) (*Job, error) {
+	var out *Job
+	err := js.update(id, func(tx *storage.Tx, j *Job) error {
+		if j == nil {
+			return ErrNotFound
+		}
+		now := time.Now().UTC()
+		if !j.claimable(now) {
+			return ErrNotClaimable
+		}
+		j.State = Running
+		j.Owner = owner
+		j.Attempt++
+		j.LeaseExpires = now.Add(d)
+		j.Updated = now
+		out = j
+		return tx.Write(js.fileName(id), j)
+	})
+	return out, err
+}
+
+// ClaimNext claims the oldest job that can be claimed. It returns ErrNoJobs
+// if there aren't any.
+func (js *Store) ClaimNext(owner string, d time.Duration) (*Job, error) {
+	list, err := js.List(Pending, Running)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, j := range list {
+		if !j.claimable(now) {
+			continue
+		}
+		// Another worker may claim the job first.
+		j, err := js.Claim(j.ID, owner, d)
+		if errors.Is(err, ErrNotClaimable) || errors.Is(err, ErrNotFound) {
+			continue
+		}
+		return j, err
+	}
+	return nil, ErrNoJobs
+}
+
+// updateLeased calls fn with a job in a transaction if the lease of j is
+// still valid, and updates j with the result.
+func (js *Store) updateLeased(j *Job, fn func(now time.Time, cur *Job)) error {
+	return js.update(j.ID, func(tx *storage.Tx, cur *Job) error {
+		if cur == nil {
+			return ErrNotFound
+		}
+		now := time.Now().UTC()
+		if cur.State != Running || cur.Owner != j.Owner || cur.Attempt != j.Attempt || !now.Before(cur.LeaseExpires) {
+			return ErrLeaseLost
+		}
+		fn(now, cur)
+		cur.Updated = now
+		if err := tx.Write(js.fileName(j.ID), cur); err != nil {
+			return err
+		}
+		*j = *cur
+		return nil
+	})
+}
+
+// Renew extends the lease of a job that was claimed by Claim or ClaimNext,
+// so that it expires after d.
+func (js *Store) Renew(j *Job, d time.Duration) error {
+	return js.updateLeased(j, func(now time.Time, cur *Job) {
+		cur.LeaseExpires = now.Add(d)
+	})
+}
+
+// Complete marks a job that was claimed by Claim or ClaimNext as done, with
+// an optional result.
+func (js *Store) Complete(j *Job, result []byte) error {
+	return js.updateLeased(j, func(now time.Time, cur *Job) {
+		cur.State = Done
+		cur.Result = append([]byte(nil), result...)
+		cur.Error = ""
+		cur.LeaseExpires = time.Time{}
+	})
+}
+
+// Fail marks a job that was claimed by Claim or ClaimNext as failed, with an
+// error message.
+func (js *Store) Fail(j *Job, msg string) error {
+	return js.updateLeased(j, func(now time.Time, cur *Job) {
+		cur.State = Failed
+		cur.Error = msg
+		cur.LeaseExpires = time.Time{}
+	})
+}
+
+// Release moves a job that was claimed by Claim or ClaimNext back to Pending,
+// so that it can be claimed again right away.
+func (js *Store) Release(j *Job) error {
+	return js.updateLeased(j, func(now time.Time, cur *Job) {
+		cur.State = Pending
+		cur.LeaseExpires = time.Time{}
+	})
+}
+
+// Retry moves a failed job back to Pending.
+func (js *Store) Retry(id string) error {
+	return js.update(id, func(tx *storage.Tx, j *Job) error {
+		if j == nil {
+			return ErrNotFound
+		}
+		if j.State != Failed {
+			return ErrNotFailed
+		}
+		j.State = Pending
+		j.Updated = time.Now().UTC()
+		return tx.Write(js.fileName(id), j)
+	})
+}
+
+// Delete deletes a job, in any state.
+func (js *Store) Delete(id string) error {
+	return js.update(id, func(tx *storage.Tx, j *Job) error {
+		if j == nil {
+			return ErrNotFound
+		}
+		return tx.Delete(js.fileName(id))
+	})
+}
@@ -0,0 +1,181 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jobs_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage/internal/storagetest"
+	"github.com/c2FmZQ/storage/jobs"
+)
+
+func TestLifecycle(t *testing.T) {
+	js := jobs.New(storagetest.New(t), "jobs")
+	if _, err := js.Create("job1", []byte("data")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := js.Create("job1", nil); !errors.Is(err, jobs.ErrExists) {
+		t.Errorf("Create() = %v, want ErrExists", err)
+	}
+
+	j, err := js.ClaimNext("worker", time.Minute)
+	if err != nil {
+		t.Fatalf("ClaimNext: %v", err)
+	}
+	if j.ID != "job1" || j.State != jobs.Running || j.Owner != "worker" || j.Attempt != 1 || string(j.Data) != "data" {
+		t.Errorf("ClaimNext() = %+v", j)
+	}
+	if _, err := js.ClaimNext("other", time.Minute); !errors.Is(err, jobs.ErrNoJobs) {
+		t.Errorf("ClaimNext() = %v, want ErrNoJobs", err)
+	}
+	if _, err := js.Claim("job1", "other", time.Minute); !errors.Is(err, jobs.ErrNotClaimable) {
+		t.Errorf("Claim() = %v, want ErrNotClaimable", err)
+	}
+	if err := js.Renew(j, time.Hour); err != nil {
+		t.Fatalf("Renew: %v", err)
+	}
+	if err := js.Complete(j, []byte("result")); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	got, err := js.Get("job1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.State != jobs.Done || string(got.Result) != "result" {
+		t.Errorf("Get() = %+v", got)
+	}
+	if err := js.Complete(j, nil); !errors.Is(err, jobs.ErrLeaseLost) {
+		t.Errorf("Complete() = %v, want ErrLeaseLost", err)
+	}
+	if err := js.Delete("job1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := js.Get("job1"); !errors.Is(err, jobs.ErrNotFound) {
+		t.Errorf("Get() = %v, want ErrNotFound", err)
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	js := jobs.New(storagetest.New(t), "jobs")
+	if _, err := js.Create("job1", nil); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	j1, err := js.Claim("job1", "worker1", time.Millisecond)
+	if err != nil {
+		t.Fatalf("Claim: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := js.Renew(j1, time.Minute); !errors.Is(err, jobs.ErrLeaseLost) {
+		t.Errorf("Renew() = %v, want ErrLeaseLost", err)
+	}
+	j2, err := js.ClaimNext("worker2", time.Minute)
+	if err != nil {
+		t.Fatalf("ClaimNext: %v", err)
+	}
+	if j2.Owner != "worker2" || j2.Attempt != 2 {
+		t.Errorf("ClaimNext() = %+v", j2)
+	}
+	if err := js.Fail(j1, "oops"); !errors.Is(err, jobs.ErrLeaseLost) {
+		t.Errorf("Fail() = %v, want ErrLeaseLost", err)
+	}
+	if err := js.Fail(j2, "oops"); err != nil {
+		t.Fatalf("Fail: %v", err)
+	}
+	if list, err := js.List(jobs.Failed); err != nil || len(list) != 1 || list[0].Error != "oops" {
+		t.Errorf("List(Failed) = %v, %v", list, err)
+	}
+	if err := js.Retry("job1"); err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+	if err := js.Retry("job1"); !errors.Is(err, jobs.ErrNotFailed) {
+		t.Errorf("Retry() = %v, want ErrNotFailed", err)
+	}
+	if list, err := js.List(jobs.Pending); err != nil || len(list) != 1 {
+		t.Errorf("List(Pending) = %v, %v", list, err)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	js := jobs.New(storagetest.New(t), "jobs")
+	if _, err := js.Create("job1", nil); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	j, err := js.Claim("job1", "worker", time.Minute)
+	if err != nil {
+		t.Fatalf("Claim: %v", err)
+	}
+	if err := js.Release(j); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if j.State != jobs.Pending {
+		t.Errorf("State = %q, want %q", j.State, jobs.Pending)
+	}
+	if _, err := js.Claim("job1", "worker", time.Minute); err != nil {
+		t.Fatalf("Claim: %v", err)
+	}
+}
+
+func TestConcurrentClaims(t *testing.T) {
+	js := jobs.New(storagetest.New(t), "jobs")
+	const n = 10
+	for i := 0; i < n; i++ {
+		if _, err := js.Create(string(rune('a'+i)), nil); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+	var mu sync.Mutex
+	claimed := make(map[string]int)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				j, err := js.ClaimNext("worker", time.Minute)
+				if errors.Is(err, jobs.ErrNoJobs) {
+					return
+				}
+				if err != nil {
+					t.Errorf("ClaimNext: %v", err)
+					return
+				}
+				mu.Lock()
+				claimed[j.ID]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(claimed) != n {
+		t.Errorf("Claimed %d jobs, want %d", len(claimed), n)
+	}
+	for id, c := range claimed {
+		if c != 1 {
+			t.Errorf("Job %q claimed %d times", id, c)
+		}
+	}
+}
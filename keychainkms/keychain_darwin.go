@@ -0,0 +1,228 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build darwin && cgo
+
+package keychainkms
+
+/*
+#cgo LDFLAGS: -framework CoreFoundation -framework Security
+#include <stdlib.h>
+#include <CoreFoundation/CoreFoundation.h>
+#include <Security/Security.h>
+
+static CFDictionaryRef keyQuery(const void *tag, int len) {
+	CFDataRef tagData = CFDataCreate(NULL, (const UInt8 *)tag, len);
+	const void *keys[] = {kSecClass, kSecAttrApplicationTag, kSecAttrKeyType, kSecUseDataProtectionKeychain, kSecReturnRef};
+	const void *vals[] = {kSecClassKey, tagData, kSecAttrKeyTypeECSECPrimeRandom, kCFBooleanTrue, kCFBooleanTrue};
+	CFDictionaryRef q = CFDictionaryCreate(NULL, keys, vals, 5, &kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+	CFRelease(tagData);
+	return q;
+}
+
+static SecKeyRef findKey(const void *tag, int len, OSStatus *status) {
+	CFDictionaryRef q = keyQuery(tag, len);
+	CFTypeRef item = NULL;
+	*status = SecItemCopyMatching(q, &item);
+	CFRelease(q);
+	if (*status != errSecSuccess) {
+		return NULL;
+	}
+	return (SecKeyRef)item;
+}
+
+static OSStatus deleteKey(const void *tag, int len) {
+	CFDictionaryRef q = keyQuery(tag, len);
+	CFMutableDictionaryRef d = CFDictionaryCreateMutableCopy(NULL, 0, q);
+	CFDictionaryRemoveValue(d, kSecReturnRef);
+	OSStatus status = SecItemDelete(d);
+	CFRelease(d);
+	CFRelease(q);
+	return status;
+}
+
+static SecKeyRef createKey(const void *tag, int len, int secureEnclave, int userPresence, CFErrorRef *err) {
+	SecAccessControlCreateFlags flags = 0;
+	if (secureEnclave) {
+		flags |= kSecAccessControlPrivateKeyUsage;
+	}
+	if (userPresence) {
+		flags |= kSecAccessControlUserPresence;
+	}
+	SecAccessControlRef access = SecAccessControlCreateWithFlags(NULL, kSecAttrAccessibleWhenUnlockedThisDeviceOnly, flags, err);
+	if (access == NULL) {
+		return NULL;
+	}
+	CFDataRef tagData = CFDataCreate(NULL, (const UInt8 *)tag, len);
+	CFMutableDictionaryRef priv = CFDictionaryCreateMutable(NULL, 0, &kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+	CFDictionarySetValue(priv, kSecAttrIsPermanent, kCFBooleanTrue);
+	CFDictionarySetValue(priv, kSecAttrApplicationTag, tagData);
+	CFDictionarySetValue(priv, kSecAttrAccessControl, access);
+
+	int bits = 256;
+	CFNumberRef size = CFNumberCreate(NULL, kCFNumberIntType, &bits);
+	CFMutableDictionaryRef attrs = CFDictionaryCreateMutable(NULL, 0, &kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+	CFDictionarySetValue(attrs, kSecAttrKeyType, kSecAttrKeyTypeECSECPrimeRandom);
+	CFDictionarySetValue(attrs, kSecAttrKeySizeInBits, size);
+	CFDictionarySetValue(attrs, kSecUseDataProtectionKeychain, kCFBooleanTrue);
+	if (secureEnclave) {
+		CFDictionarySetValue(attrs, kSecAttrTokenID, kSecAttrTokenIDSecureEnclave);
+	}
+	CFDictionarySetValue(attrs, kSecPrivateKeyAttrs, priv);
+
+	SecKeyRef key = SecKeyCreateRandomKey(attrs, err);
+	CFRelease(attrs);
+	CFRelease(size);
+	CFRelease(priv);
+	CFRelease(tagData);
+	CFRelease(access);
+	return key;
+}
+
+static SecKeyAlgorithm algorithm(void) {
+	return kSecKeyAlgorithmECIESEncryptionCofactorVariableIVX963SHA256AESGCM;
+}
+
+static CFDataRef encrypt(SecKeyRef key, const void *b, int len, CFErrorRef *err) {
+	SecKeyRef pub = SecKeyCopyPublicKey(key);
+	if (pub == NULL) {
+		return NULL;
+	}
+	CFDataRef in = CFDataCreate(NULL, (const UInt8 *)b, len);
+	CFDataRef out = SecKeyCreateEncryptedData(pub, algorithm(), in, err);
+	CFRelease(in);
+	CFRelease(pub);
+	return out;
+}
+
+static CFDataRef decrypt(SecKeyRef key, const void *b, int len, CFErrorRef *err) {
+	CFDataRef in = CFDataCreate(NULL, (const UInt8 *)b, len);
+	CFDataRef out = SecKeyCreateDecryptedData(key, algorithm(), in, err);
+	CFRelease(in);
+	return out;
+}
+
+// errorString returns the description of err, which the caller must free.
+static char *errorString(CFErrorRef err) {
+	CFStringRef desc = CFErrorCopyDescription(err);
+	CFIndex size = CFStringGetMaximumSizeForEncoding(CFStringGetLength(desc), kCFStringEncodingUTF8) + 1;
+	char *buf = malloc(size);
+	if (!CFStringGetCString(desc, buf, size, kCFStringEncodingUTF8)) {
+		buf[0] = 0;
+	}
+	CFRelease(desc);
+	return buf;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+type secKey struct {
+	ref C.SecKeyRef
+}
+
+// cfError converts err to a Go error, and releases it.
+func cfError(op string, err C.CFErrorRef) error {
+	if err == 0 {
+		return fmt.Errorf("keychain: %s failed", op)
+	}
+	defer C.CFRelease(C.CFTypeRef(err))
+	s := C.errorString(err)
+	defer C.free(unsafe.Pointer(s))
+	return fmt.Errorf("keychain: %s: %s", op, C.GoString(s))
+}
+
+// goBytes copies d to a Go slice, and releases it.
+func goBytes(d C.CFDataRef) []byte {
+	defer C.CFRelease(C.CFTypeRef(d))
+	return C.GoBytes(unsafe.Pointer(C.CFDataGetBytePtr(d)), C.int(C.CFDataGetLength(d)))
+}
+
+func bytesPtr(b []byte) unsafe.Pointer {
+	if len(b) == 0 {
+		return nil
+	}
+	return unsafe.Pointer(&b[0])
+}
+
+func openKey(tag string, o options) (*secKey, error) {
+	t := []byte(tag)
+	if len(t) == 0 {
+		return nil, errors.New("keychain: empty tag")
+	}
+	var status C.OSStatus
+	if ref := C.findKey(bytesPtr(t), C.int(len(t)), &status); ref != 0 {
+		return &secKey{ref: ref}, nil
+	}
+	if status != C.errSecItemNotFound {
+		return nil, fmt.Errorf("keychain: find key: OSStatus %d", int(status))
+	}
+	var cferr C.CFErrorRef
+	ref := C.createKey(bytesPtr(t), C.int(len(t)), boolInt(o.secureEnclave), boolInt(o.userPresence), &cferr)
+	if ref == 0 {
+		return nil, cfError("create key", cferr)
+	}
+	return &secKey{ref: ref}, nil
+}
+
+func deleteKey(tag string) error {
+	t := []byte(tag)
+	if status := C.deleteKey(bytesPtr(t), C.int(len(t))); status != C.errSecSuccess && status != C.errSecItemNotFound {
+		return fmt.Errorf("keychain: delete key: OSStatus %d", int(status))
+	}
+	return nil
+}
+
+func (k *secKey) encrypt(b []byte) ([]byte, error) {
+	var cferr C.CFErrorRef
+	out := C.encrypt(k.ref, bytesPtr(b), C.int(len(b)), &cferr)
+	if out == 0 {
+		return nil, cfError("encrypt", cferr)
+	}
+	return goBytes(out), nil
+}
+
+func (k *secKey) decrypt(b []byte) ([]byte, error) {
+	var cferr C.CFErrorRef
+	out := C.decrypt(k.ref, bytesPtr(b), C.int(len(b)), &cferr)
+	if out == 0 {
+		return nil, cfError("decrypt", cferr)
+	}
+	return goBytes(out), nil
+}
+
+func (k *secKey) release() {
+	C.CFRelease(C.CFTypeRef(k.ref))
+}
+
+func boolInt(v bool) C.int {
+	if v {
+		return 1
+	}
+	return 0
+}
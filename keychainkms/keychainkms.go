@@ -0,0 +1,155 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package keychainkms seals master keys with a key in the macOS Keychain,
+// or in the Secure Enclave, so that they can only be unsealed on the enrolled
+// machine, optionally with user presence (Touch ID or the login password).
+// It is analogous to the TPM option of the crypto package, and implements
+// crypto.KMS.
+//
+// The Keychain key is an elliptic curve key that is created the first time
+// it is used. Master keys are encrypted with ECIES. Only decryption needs the
+// private key, and user presence. The binary must be signed with an
+// entitlement for a keychain access group. On other platforms, New returns
+// ErrNotSupported.
+//
+// Example:
+//
+//	kms, err := keychainkms.New("com.example.storage")
+//	if err != nil {
+//		return err
+//	}
+//	defer kms.Close()
+//	mk, err := crypto.ReadMasterKeyWithKMS(ctx, kms, keyFile)
+package keychainkms
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+var _ crypto.KMS = (*KMS)(nil)
+
+var (
+	// ErrNotSupported is returned by New on platforms other than macOS,
+	// and when cgo isn't enabled.
+	ErrNotSupported = errors.New("keychain is not supported on this platform")
+	// ErrClosed is returned after Close was called.
+	ErrClosed = errors.New("closed")
+)
+
+// Option is used to specify optional parameters of New.
+type Option func(*options)
+
+type options struct {
+	secureEnclave bool
+	userPresence  bool
+}
+
+// WithSecureEnclave specifies whether the key is created in the Secure
+// Enclave. The default is true. Otherwise, the key is in the Keychain, and
+// can't be exported to other machines.
+func WithSecureEnclave(v bool) Option {
+	return func(o *options) {
+		o.secureEnclave = v
+	}
+}
+
+// WithUserPresence specifies whether user presence is required to unseal
+// master keys. The default is true.
+func WithUserPresence(v bool) Option {
+	return func(o *options) {
+		o.userPresence = v
+	}
+}
+
+// KMS seals and unseals master keys with a Keychain key.
+type KMS struct {
+	tag string
+
+	mu  sync.Mutex
+	key *secKey
+}
+
+// New returns a KMS that uses the Keychain key with the application tag tag.
+// The key is created if it doesn't exist. The options only apply when the
+// key is created.
+func New(tag string, opts ...Option) (*KMS, error) {
+	o := options{secureEnclave: true, userPresence: true}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	key, err := openKey(tag, o)
+	if err != nil {
+		return nil, err
+	}
+	return &KMS{tag: tag, key: key}, nil
+}
+
+// Encrypt encrypts plaintext with the public key.
+func (k *KMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.key == nil {
+		return nil, ErrClosed
+	}
+	return k.key.encrypt(plaintext)
+}
+
+// Decrypt decrypts ciphertext with the private key. It may ask for user
+// presence.
+func (k *KMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.key == nil {
+		return nil, ErrClosed
+	}
+	return k.key.decrypt(ciphertext)
+}
+
+// Close releases the key. It stays in the Keychain.
+func (k *KMS) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.key != nil {
+		k.key.release()
+		k.key = nil
+	}
+	return nil
+}
+
+// Delete closes the KMS and deletes the key from the Keychain. The master
+// keys that were sealed with it can no longer be unsealed.
+func (k *KMS) Delete() error {
+	k.Close()
+	return deleteKey(k.tag)
+}
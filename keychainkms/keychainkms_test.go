@@ -0,0 +1,80 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package keychainkms_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/c2FmZQ/storage/crypto"
+	"github.com/c2FmZQ/storage/keychainkms"
+)
+
+func TestNotSupported(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("supported on darwin")
+	}
+	if _, err := keychainkms.New("com.example.storage"); !errors.Is(err, keychainkms.ErrNotSupported) {
+		t.Errorf("New() = %v, want %v", err, keychainkms.ErrNotSupported)
+	}
+}
+
+// TestKeychain needs a signed binary with a keychain access group.
+func TestKeychain(t *testing.T) {
+	if os.Getenv("KEYCHAINKMS_TEST") == "" {
+		t.Skip("KEYCHAINKMS_TEST is not set")
+	}
+	ctx := context.Background()
+	kms, err := keychainkms.New("com.github.c2fmzq.storage.test", keychainkms.WithSecureEnclave(false), keychainkms.WithUserPresence(false))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer kms.Delete()
+
+	mk, err := crypto.CreateMasterKey()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := crypto.SaveWithKMS(ctx, mk, kms, keyFile); err != nil {
+		t.Fatalf("crypto.SaveWithKMS: %v", err)
+	}
+	got, err := crypto.ReadMasterKeyWithKMS(ctx, kms, keyFile)
+	if err != nil {
+		t.Fatalf("crypto.ReadMasterKeyWithKMS: %v", err)
+	}
+	defer got.Wipe()
+	if crypto.KeyID(got) != crypto.KeyID(mk) {
+		t.Error("crypto.ReadMasterKeyWithKMS returned a different key")
+	}
+	kms.Close()
+	if _, err := kms.Decrypt(ctx, []byte("x")); err != keychainkms.ErrClosed {
+		t.Errorf("Decrypt() after Close = %v, want %v", err, keychainkms.ErrClosed)
+	}
+}
@@ -0,0 +1,176 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package kv is a key-value store with buckets, on top of an encrypted
+// storage.
+//
+// Each key is stored in its own encrypted file, so that a Put only rewrites
+// the file of that key. The file names are keyed hashes of the bucket names
+// and of the keys, in a fanout directory tree, so the names don't reveal the
+// keys. Several keys, in any buckets, can be changed atomically with a
+// transaction.
+//
+// Example:
+//
+//	db := kv.New(s, "kv")
+//	users := db.Bucket("users")
+//	if err := users.Put("alice", &user); err != nil {
+//		...
+//	}
+//	err := db.Update(func(tx *kv.Tx) error {
+//		var from, to Account
+//		if err := tx.Bucket("accounts").Get("alice", &from); err != nil {
+//			return err
+//		}
+//		...
+//	})
+package kv
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sort"
+
+	"github.com/c2FmZQ/storage"
+)
+
+// ErrNotFound is returned when a key doesn't exist.
+var ErrNotFound = errors.New("key not found")
+
+// defaultFanout is the default number of levels of the directory tree of each
+// bucket.
+const defaultFanout = 2
+
+// Option is used to specify optional parameters of the DB.
+type Option func(*DB)
+
+// WithFanout specifies the number of levels of the directory tree of each
+// bucket. The default is 2, i.e. 65536 directories.
+func WithFanout(levels int) Option {
+	return func(db *DB) {
+		db.levels = levels
+	}
+}
+
+// DB is a key-value store.
+type DB struct {
+	s      *storage.Storage
+	dir    string
+	levels int
+}
+
+// record is the content of the file of a key. The key is saved with its
+// value so that the keys can be listed.
+type record struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// New returns a DB that keeps its files under dir in s.
+func New(s *storage.Storage, dir string, opts ...Option) *DB {
+	db := &DB{s: s, dir: dir, levels: defaultFanout}
+	for _, opt := range opts {
+		opt(db)
+	}
+	return db
+}
+
+// bucketDir returns the directory of a bucket.
+func (db *DB) bucketDir(bucket string) string {
+	return filepath.Join(db.dir, db.s.FanoutPath(bucket, 0))
+}
+
+// fileName returns the name of the file of a key.
+func (db *DB) fileName(bucket, key string) string {
+	return filepath.Join(db.bucketDir(bucket), db.s.FanoutPath(key, db.levels))
+}
+
+// Bucket returns a bucket. Buckets don't need to be created.
+func (db *DB) Bucket(name string) *Bucket {
+	return &Bucket{db: db, name: name}
+}
+
+// Bucket is a set of keys.
+type Bucket struct {
+	db   *DB
+	name string
+}
+
+// Get reads the value of key into v, which must be a pointer. It returns
+// ErrNotFound if the key doesn't exist.
+func (b *Bucket) Get(key string, v any) error {
+	var rec record
+	if err := b.db.s.ReadDataFile(b.db.fileName(b.name, key), &rec); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return json.Unmarshal(rec.Value, v)
+}
+
+// Put sets the value of key, replacing the existing value, if any. The value
+// is encoded with JSON.
+func (b *Bucket) Put(key string, v any) error {
+	return b.db.Update(func(tx *Tx) error {
+		return tx.Bucket(b.name).Put(key, v)
+	})
+}
+
+// Delete deletes key. Deleting a key that doesn't exist isn't an error.
+func (b *Bucket) Delete(key string) error {
+	return b.db.Update(func(tx *Tx) error {
+		return tx.Bucket(b.name).Delete(key)
+	})
+}
+
+// Keys returns the sorted keys of the bucket. Each file of the bucket is
+// decrypted to get its key.
+func (b *Bucket) Keys() ([]string, error) {
+	var keys []string
+	root := filepath.ToSlash(b.db.bucketDir(b.name))
+	err := fs.WalkDir(b.db.s.FS(), root, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == root {
+			return fs.SkipAll
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		var rec record
+		if err := b.db.s.ReadDataFile(filepath.FromSlash(p), &rec); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		keys = append(keys, rec.Key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
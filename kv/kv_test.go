@@ -0,0 +1,108 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package kv_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/internal/storagetest"
+	"github.com/c2FmZQ/storage/kv"
+)
+
+func newDB(t *testing.T) (*kv.DB, string) {
+	mk := storagetest.MasterKey(t)
+	dir := t.TempDir()
+	return kv.New(storage.New(dir, mk), "kv"), dir
+}
+
+type user struct {
+	Name string
+	Age  int
+}
+
+func TestBuckets(t *testing.T) {
+	db, dir := newDB(t)
+	users, groups := db.Bucket("users"), db.Bucket("groups")
+
+	var u user
+	if err := users.Get("alice", &u); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Get = %v, want ErrNotFound", err)
+	}
+	if err := users.Put("alice", user{Name: "Alice", Age: 30}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := users.Put("bob", &user{Name: "Bob", Age: 40}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := groups.Put("alice", []string{"admin"}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := users.Get("alice", &u); err != nil || u != (user{Name: "Alice", Age: 30}) {
+		t.Errorf("Get = %+v, %v", u, err)
+	}
+	var g []string
+	if err := groups.Get("alice", &g); err != nil || fmt.Sprint(g) != "[admin]" {
+		t.Errorf("Get = %v, %v", g, err)
+	}
+
+	keys, err := users.Keys()
+	if err != nil || fmt.Sprint(keys) != "[alice bob]" {
+		t.Errorf("Keys = %v, %v", keys, err)
+	}
+	if keys, err := db.Bucket("empty").Keys(); err != nil || len(keys) != 0 {
+		t.Errorf("Keys = %v, %v", keys, err)
+	}
+
+	// The names of the files don't reveal the keys or the buckets.
+	filepath.WalkDir(dir, func(p string, _ os.DirEntry, err error) error {
+		for _, s := range []string{"alice", "bob", "users", "groups"} {
+			if strings.Contains(p, s) {
+				t.Errorf("%s contains %q", p, s)
+			}
+		}
+		return err
+	})
+
+	if err := users.Delete("alice"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := users.Delete("alice"); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	if err := users.Get("alice", &u); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Get = %v, want ErrNotFound", err)
+	}
+	if err := groups.Get("alice", &g); err != nil {
+		t.Errorf("Get: %v", err)
+	}
+	if keys, err := users.Keys(); err != nil || fmt.Sprint(keys) != "[bob]" {
+		t.Errorf("Keys = %v, %v", keys, err)
+	}
+}
@@ -0,0 +1,129 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package kv
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+
+	"github.com/c2FmZQ/storage"
+)
+
+// Key identifies a key in a bucket.
+type Key struct {
+	Bucket string
+	Key    string
+}
+
+// Tx is a transaction that reads and changes keys atomically. See
+// storage.Tx. The keys are locked when they are first used, and they stay
+// locked until Commit or Rollback is called.
+//
+// Transactions that use the same keys in a different order can deadlock. The
+// keys that are passed to Begin are locked in a way that avoids that.
+//
+// Tx is not safe for concurrent use by multiple goroutines.
+type Tx struct {
+	db *DB
+	tx *storage.Tx
+}
+
+// Begin starts a new transaction. The keys, if any, are locked immediately.
+func (db *DB) Begin(keys ...Key) (*Tx, error) {
+	files := make([]string, 0, len(keys))
+	for _, k := range keys {
+		files = append(files, db.fileName(k.Bucket, k.Key))
+	}
+	tx, err := db.s.Begin(files...)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{db: db, tx: tx}, nil
+}
+
+// Update calls fn in a transaction. The transaction is committed if fn
+// returns nil, and rolled back otherwise.
+func (db *DB) Update(fn func(tx *Tx) error, keys ...Key) error {
+	tx, err := db.Begin(keys...)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Commit applies the changes of the transaction atomically, and releases the
+// locks.
+func (tx *Tx) Commit() error {
+	return tx.tx.Commit()
+}
+
+// Rollback discards the changes of the transaction, and releases the locks.
+// It does nothing if the transaction was already committed or rolled back.
+func (tx *Tx) Rollback() error {
+	return tx.tx.Rollback()
+}
+
+// Bucket returns a bucket in the transaction.
+func (tx *Tx) Bucket(name string) *TxBucket {
+	return &TxBucket{tx: tx, name: name}
+}
+
+// TxBucket is a bucket in a transaction.
+type TxBucket struct {
+	tx   *Tx
+	name string
+}
+
+// Get reads the value of key into v, which must be a pointer. It sees the
+// changes of the transaction. It returns ErrNotFound if the key doesn't
+// exist.
+func (b *TxBucket) Get(key string, v any) error {
+	var rec record
+	if err := b.tx.tx.Read(b.tx.db.fileName(b.name, key), &rec); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return json.Unmarshal(rec.Value, v)
+}
+
+// Put sets the value of key when the transaction is committed.
+func (b *TxBucket) Put(key string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.tx.tx.Write(b.tx.db.fileName(b.name, key), &record{Key: key, Value: value})
+}
+
+// Delete deletes key when the transaction is committed.
+func (b *TxBucket) Delete(key string) error {
+	return b.tx.tx.Delete(b.tx.db.fileName(b.name, key))
+}
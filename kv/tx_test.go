@@ -0,0 +1,127 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package kv_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/c2FmZQ/storage/kv"
+)
+
+func TestTransactions(t *testing.T) {
+	db, _ := newDB(t)
+	accounts := db.Bucket("accounts")
+	if err := accounts.Put("alice", 100); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := accounts.Put("bob", 0); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// transfer moves amount from alice to bob, and fails if alice doesn't
+	// have enough.
+	errInsufficient := errors.New("insufficient funds")
+	transfer := func(amount int) error {
+		return db.Update(func(tx *kv.Tx) error {
+			b := tx.Bucket("accounts")
+			var from, to int
+			if err := b.Get("alice", &from); err != nil {
+				return err
+			}
+			if err := b.Get("bob", &to); err != nil {
+				return err
+			}
+			if err := b.Put("alice", from-amount); err != nil {
+				return err
+			}
+			if err := b.Put("bob", to+amount); err != nil {
+				return err
+			}
+			// The transaction sees its own changes.
+			if err := b.Get("alice", &from); err != nil {
+				return err
+			}
+			if from < 0 {
+				return errInsufficient
+			}
+			return tx.Bucket("log").Put("last", amount)
+		}, kv.Key{Bucket: "accounts", Key: "alice"}, kv.Key{Bucket: "accounts", Key: "bob"})
+	}
+	check := func(alice, bob int) {
+		t.Helper()
+		var a, b int
+		if err := accounts.Get("alice", &a); err != nil || a != alice {
+			t.Errorf("alice = %d, %v, want %d", a, err, alice)
+		}
+		if err := accounts.Get("bob", &b); err != nil || b != bob {
+			t.Errorf("bob = %d, %v, want %d", b, err, bob)
+		}
+	}
+
+	if err := transfer(30); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	check(70, 30)
+	if err := transfer(100); !errors.Is(err, errInsufficient) {
+		t.Fatalf("transfer = %v, want %v", err, errInsufficient)
+	}
+	check(70, 30)
+	var last int
+	if err := db.Bucket("log").Get("last", &last); err != nil || last != 30 {
+		t.Errorf("last = %d, %v, want 30", last, err)
+	}
+
+	// Concurrent transfers don't lose updates.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := transfer(1); err != nil {
+				t.Errorf("transfer: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	check(60, 40)
+
+	// Rollback discards the changes.
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if err := tx.Bucket("accounts").Delete("alice"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	var a int
+	if err := tx.Bucket("accounts").Get("alice", &a); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Get = %v, want ErrNotFound", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	check(60, 40)
+}
@@ -0,0 +1,388 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+// Locker provides mutual exclusion between the users of a storage. Lock names
+// are file names relative to the root of the storage.
+//
+// The default Locker uses lock files next to the locked files. It works
+// across processes on the same host, and on shared filesystems that support
+// exclusive file creation.
+type Locker interface {
+	// Lock acquires the lock for name. It waits until the lock is
+	// available, or until ctx is done.
+	Lock(ctx context.Context, name string) error
+	// TryLock acquires the lock for name if it is available. It reports
+	// whether the lock was acquired.
+	TryLock(name string) (bool, error)
+	// Unlock releases the lock for name.
+	Unlock(name string) error
+}
+
+// LockInfo describes the state of a lock.
+type LockInfo struct {
+	// Locked is true when someone holds the exclusive lock.
+	Locked bool
+	// PID and Host identify the process that holds the exclusive lock,
+	// when they are known.
+	PID  int
+	Host string
+	// Since is when the exclusive lock was acquired, when it is known.
+	Since time.Time
+	// Readers is the number of shared locks that are held.
+	Readers int
+	// Waiters is the number of waiters for the exclusive lock, when it is
+	// known.
+	Waiters int
+}
+
+// LockInspector is implemented by the Lockers that can report the state of
+// their locks.
+type LockInspector interface {
+	LockInfo(name string) (LockInfo, error)
+}
+
+// ErrLockInfoNotSupported is returned by LockInfo when the Locker doesn't
+// implement LockInspector.
+var ErrLockInfoNotSupported = errors.New("locker doesn't support LockInfo")
+
+// LockInfo reports the current state of the lock of a file, e.g. to find out
+// who is holding it.
+func (s *Storage) LockInfo(fn string) (LockInfo, error) {
+	li, ok := s.locker.(LockInspector)
+	if !ok {
+		return LockInfo{}, ErrLockInfoNotSupported
+	}
+	info, err := li.LockInfo(fn)
+	if err != nil {
+		return LockInfo{}, err
+	}
+	if entries, err := s.backend.ReadDir(s.readersDir(fn)); err == nil {
+		info.Readers = len(entries)
+	}
+	return info, nil
+}
+
+// WithLocker specifies the Locker to use, e.g. one that is backed by a
+// distributed lock service, or NewFcntlLocker. The default Locker uses lock
+// files. With a custom Backend, the lock files are created in the Backend.
+func WithLocker(l Locker) Option {
+	return func(opt *option) {
+		opt.locker = l
+	}
+}
+
+// NewFileLocker returns a Locker that uses lock files in dir. It is the
+// default Locker of a Storage rooted at dir.
+func NewFileLocker(dir string) Locker {
+	return &fileLocker{dir: dir, backend: osBackend{}, logger: crypto.StdLogger(), metrics: nopMetrics{}}
+}
+
+type fileLocker struct {
+	dir     string
+	backend Backend
+	logger  crypto.Logger
+	metrics MetricsSink
+}
+
+func (l *fileLocker) lockFile(name string) string {
+	return filepath.Join(l.dir, name) + ".lock"
+}
+
+// queueDir returns the directory where the waiters for the lock of name
+// are queued. Each waiter creates a ticket file in it, and the lock is granted
+// in the order of the tickets.
+func (l *fileLocker) queueDir(name string) string {
+	return l.lockFile(name) + ".q"
+}
+
+// ticketRefresh is how often a waiter refreshes the modification time of its
+// ticket. A ticket that isn't refreshed for ticketDeadline is stale.
+const (
+	ticketRefresh  = 5 * time.Second
+	ticketDeadline = 30 * time.Second
+)
+
+func (l *fileLocker) Lock(ctx context.Context, name string) error {
+	if ok, err := l.TryLock(name); err != nil || ok {
+		return err
+	}
+	qdir := l.queueDir(name)
+	ticket, err := l.createTicket(qdir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		l.backend.Remove(filepath.Join(qdir, ticket))
+		// This fails if there are other waiters. That's ok.
+		l.backend.Remove(qdir)
+	}()
+
+	lockf := l.lockFile(name)
+	deadline := time.Duration(600+mrand.Int()%60) * time.Second
+	lastRefresh := time.Now()
+	for {
+		first, err := l.firstTicket(qdir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if first == "" || first > ticket {
+			// Our ticket was removed by someone who thought that it
+			// was stale. Get a new one.
+			if ticket, err = l.createTicket(qdir); err != nil {
+				return err
+			}
+			continue
+		}
+		if first == ticket {
+			if err := createOwnedFile(l.backend, lockf); err == nil {
+				return nil
+			} else if !errors.Is(err, os.ErrExist) {
+				return err
+			}
+			if tryToRemoveStaleLock(l.backend, l.logger, lockf, deadline) {
+				l.metrics.Count(MetricStaleLockReclaimed, name)
+			}
+		}
+		if time.Since(lastRefresh) > ticketRefresh {
+			now := time.Now()
+			if err := l.backend.Chtimes(filepath.Join(qdir, ticket), now, now); err != nil {
+				return err
+			}
+			lastRefresh = now
+		}
+		t := time.NewTimer(time.Duration(100+mrand.Int()%100) * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return fmt.Errorf("lock %s: %w", name, ctx.Err())
+		case <-t.C:
+		}
+	}
+}
+
+// createTicket adds a ticket to the queue in qdir. The ticket names start
+// with the time when they were created, so that they sort in FIFO order.
+func (l *fileLocker) createTicket(qdir string) (string, error) {
+	for {
+		if err := l.backend.MkdirAll(qdir, 0700); err != nil {
+			return "", err
+		}
+		ticket := fmt.Sprintf("%020d-%016x", time.Now().UnixNano(), mrand.Uint64())
+		err := createOwnedFile(l.backend, filepath.Join(qdir, ticket))
+		if errors.Is(err, os.ErrNotExist) {
+			// The last waiter removed the directory concurrently.
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return ticket, nil
+	}
+}
+
+// firstTicket returns the name of the first ticket in qdir, after removing
+// the stale tickets of waiters that went away.
+func (l *fileLocker) firstTicket(qdir string) (string, error) {
+	entries, err := l.backend.ReadDir(qdir)
+	if err != nil {
+		return "", err
+	}
+	// ReadDir returns the entries sorted by name.
+	for _, e := range entries {
+		if tryToRemoveStaleLock(l.backend, l.logger, filepath.Join(qdir, e.Name()), ticketDeadline) {
+			continue
+		}
+		return e.Name(), nil
+	}
+	return "", nil
+}
+
+// TryLock acquires the lock only if nobody is waiting for it, so that it
+// doesn't jump the queue.
+func (l *fileLocker) TryLock(name string) (bool, error) {
+	lockf := l.lockFile(name)
+	if err := createParentIfNotExist(l.backend, lockf); err != nil {
+		return false, err
+	}
+	if entries, err := l.backend.ReadDir(l.queueDir(name)); err == nil && len(entries) > 0 {
+		return false, nil
+	}
+	if err := createOwnedFile(l.backend, lockf); errors.Is(err, os.ErrExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (l *fileLocker) LockInfo(name string) (LockInfo, error) {
+	var info LockInfo
+	if entries, err := l.backend.ReadDir(l.queueDir(name)); err == nil {
+		info.Waiters = len(entries)
+	}
+	lockf := l.lockFile(name)
+	fi, err := l.backend.Stat(lockf)
+	if errors.Is(err, os.ErrNotExist) {
+		return info, nil
+	}
+	if err != nil {
+		return info, err
+	}
+	info.Locked = true
+	info.Since = fi.ModTime()
+	b, err := readFile(l.backend, lockf)
+	if errors.Is(err, os.ErrNotExist) {
+		// Released in the meantime.
+		return LockInfo{Waiters: info.Waiters}, nil
+	}
+	if err != nil {
+		return info, err
+	}
+	var owner lockOwner
+	if err := json.Unmarshal(b, &owner); err == nil {
+		info.PID, info.Host, info.Since = owner.PID, owner.Host, owner.TS
+	}
+	return info, nil
+}
+
+func (l *fileLocker) Unlock(name string) error {
+	return l.backend.Remove(l.lockFile(name))
+}
+
+// lockOwner identifies the owner of a lock. It is the content of the lock
+// files.
+type lockOwner struct {
+	PID  int       `json:"pid"`
+	Host string    `json:"host"`
+	TS   time.Time `json:"ts"`
+}
+
+var hostname = sync.OnceValue(func() string {
+	h, _ := os.Hostname()
+	return h
+})
+
+// createOwnedFile atomically creates a lock file that identifies this process
+// as its owner. It fails with os.ErrExist if the file already exists.
+func createOwnedFile(be Backend, lockf string) error {
+	b, err := json.Marshal(lockOwner{PID: os.Getpid(), Host: hostname(), TS: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	f, err := be.OpenFile(lockf, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_SYNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		be.Remove(lockf)
+		return err
+	}
+	return f.Close()
+}
+
+// isStaleLock returns true if the lock file content b, last modified at
+// mtime, belongs to a lock that was abandoned. When the owner is a process on
+// this host, the lock is stale as soon as the process is gone, and never
+// before. Otherwise, the lock is stale when it is older than deadline.
+func isStaleLock(b []byte, mtime time.Time, deadline time.Duration) bool {
+	var owner lockOwner
+	if err := json.Unmarshal(b, &owner); err == nil && owner.PID > 0 && owner.Host != "" && owner.Host == hostname() {
+		if alive, ok := processAlive(owner.PID); ok {
+			return !alive
+		}
+	}
+	return time.Since(mtime) > deadline
+}
+
+// tryToRemoveStaleLock removes lockf if it is stale. It returns true if lockf
+// was removed.
+func tryToRemoveStaleLock(be Backend, logger crypto.Logger, lockf string, deadline time.Duration) bool {
+	fi, err := be.Stat(lockf)
+	if err != nil {
+		return false
+	}
+	b, err := readFile(be, lockf)
+	if err != nil || !isStaleLock(b, fi.ModTime(), deadline) {
+		return false
+	}
+	// Move the lock out of the way before removing it, and make sure that
+	// it is still the one that was determined to be stale. Otherwise, it
+	// was released and acquired again in the meantime, and it must be put
+	// back.
+	stale := fmt.Sprintf("%s.stale-%d", lockf, mrand.Int63())
+	if err := be.Rename(lockf, stale); err != nil {
+		return false
+	}
+	defer be.Remove(stale)
+	if b2, err := readFile(be, stale); err != nil || !bytes.Equal(b, b2) {
+		be.Link(stale, lockf)
+		return false
+	}
+	logger.Errorf("Removed stale lock %q", lockf)
+	return true
+}
+
+// prefixLocker is the Locker of a Sub storage. It adds the sub storage's
+// prefix to the lock names.
+type prefixLocker struct {
+	l      Locker
+	prefix string
+}
+
+func (l prefixLocker) Lock(ctx context.Context, name string) error {
+	return l.l.Lock(ctx, filepath.Join(l.prefix, name))
+}
+
+func (l prefixLocker) TryLock(name string) (bool, error) {
+	return l.l.TryLock(filepath.Join(l.prefix, name))
+}
+
+func (l prefixLocker) Unlock(name string) error {
+	return l.l.Unlock(filepath.Join(l.prefix, name))
+}
+
+func (l prefixLocker) LockInfo(name string) (LockInfo, error) {
+	li, ok := l.l.(LockInspector)
+	if !ok {
+		return LockInfo{}, ErrLockInfoNotSupported
+	}
+	return li.LockInfo(filepath.Join(l.prefix, name))
+}
@@ -0,0 +1,227 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memLocker is an in-memory Locker.
+type memLocker struct {
+	mu     sync.Mutex
+	locked map[string]bool
+}
+
+func (l *memLocker) Lock(ctx context.Context, name string) error {
+	for {
+		if ok, _ := l.TryLock(name); ok {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+func (l *memLocker) TryLock(name string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locked[name] {
+		return false, nil
+	}
+	l.locked[name] = true
+	return true, nil
+}
+
+func (l *memLocker) Unlock(name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.locked, name)
+	return nil
+}
+
+func TestTryLock(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, aesEncryptionKey())
+
+	if ok, err := s.TryLock("foo"); err != nil || !ok {
+		t.Fatalf("TryLock() = %v, %v, want true", ok, err)
+	}
+	if ok, err := s.TryLock("foo"); err != nil || ok {
+		t.Fatalf("TryLock() = %v, %v, want false", ok, err)
+	}
+	if err := s.Unlock("foo"); err != nil {
+		t.Fatalf("Unlock() failed: %v", err)
+	}
+	if err := s.RLock("foo"); err != nil {
+		t.Fatalf("RLock() failed: %v", err)
+	}
+	if ok, err := s.TryLock("foo"); err != nil || ok {
+		t.Fatalf("TryLock() with reader = %v, %v, want false", ok, err)
+	}
+	if err := s.RUnlock("foo"); err != nil {
+		t.Fatalf("RUnlock() failed: %v", err)
+	}
+
+	// The sub storage uses the same lock files.
+	sub, err := s.Sub("sub")
+	if err != nil {
+		t.Fatalf("Sub() failed: %v", err)
+	}
+	if err := sub.Lock("bar"); err != nil {
+		t.Fatalf("sub.Lock() failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub", "bar.lock")); err != nil {
+		t.Errorf("Lock file not found: %v", err)
+	}
+	if ok, err := s.TryLock("sub/bar"); err != nil || ok {
+		t.Errorf("TryLock(sub/bar) = %v, %v, want false", ok, err)
+	}
+	if err := sub.Unlock("bar"); err != nil {
+		t.Errorf("sub.Unlock() failed: %v", err)
+	}
+}
+
+func TestWithLocker(t *testing.T) {
+	dir := t.TempDir()
+	l := &memLocker{locked: make(map[string]bool)}
+	s := New(dir, aesEncryptionKey(), WithLocker(l))
+
+	if err := s.SaveDataFile("foo", "hello"); err != nil {
+		t.Fatalf("SaveDataFile() failed: %v", err)
+	}
+	var obj string
+	commit, err := s.OpenForUpdate("foo", &obj)
+	if err != nil {
+		t.Fatalf("OpenForUpdate() failed: %v", err)
+	}
+	if !l.locked["foo"] {
+		t.Error("foo isn't locked")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "foo.lock")); !os.IsNotExist(err) {
+		t.Errorf("Unexpected lock file: %v", err)
+	}
+	if err := commit(true, nil); err != nil {
+		t.Fatalf("commit() failed: %v", err)
+	}
+	if l.locked["foo"] {
+		t.Error("foo is still locked")
+	}
+}
+
+func TestStaleLock(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, aesEncryptionKey())
+	lockf := filepath.Join(dir, "foo.lock")
+	old := time.Now().Add(-time.Hour)
+
+	for _, tc := range []struct {
+		name  string
+		owner lockOwner
+		mtime time.Time
+		stale bool
+	}{
+		{"dead local process", lockOwner{PID: math.MaxInt32, Host: hostname()}, time.Now(), true},
+		{"live local process", lockOwner{PID: os.Getpid(), Host: hostname()}, old, false},
+		{"recent remote process", lockOwner{PID: 1, Host: "remote." + hostname()}, time.Now(), false},
+		{"old remote process", lockOwner{PID: 1, Host: "remote." + hostname()}, old, true},
+		{"old format", lockOwner{}, old, true},
+	} {
+		var b []byte
+		if tc.owner.PID != 0 {
+			var err error
+			if b, err = json.Marshal(tc.owner); err != nil {
+				t.Fatalf("json.Marshal: %v", err)
+			}
+		}
+		if err := os.WriteFile(lockf, b, 0600); err != nil {
+			t.Fatalf("os.WriteFile: %v", err)
+		}
+		if err := os.Chtimes(lockf, tc.mtime, tc.mtime); err != nil {
+			t.Fatalf("os.Chtimes: %v", err)
+		}
+		err := s.LockWithTimeout("foo", 500*time.Millisecond)
+		if got := err == nil; got != tc.stale {
+			t.Errorf("%s: LockWithTimeout() = %v", tc.name, err)
+		}
+		var owner lockOwner
+		if b, err := os.ReadFile(lockf); err != nil {
+			t.Fatalf("os.ReadFile: %v", err)
+		} else if err := json.Unmarshal(b, &owner); tc.stale && (err != nil || owner.PID != os.Getpid() || owner.Host != hostname()) {
+			t.Errorf("%s: Unexpected lock owner %+v, %v", tc.name, owner, err)
+		}
+		os.Remove(lockf)
+	}
+}
+
+func TestLockFIFO(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, aesEncryptionKey())
+
+	if err := s.Lock("foo"); err != nil {
+		t.Fatalf("Lock() failed: %v", err)
+	}
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Lock("foo"); err != nil {
+				t.Errorf("Lock() failed: %v", err)
+				return
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			if err := s.Unlock("foo"); err != nil {
+				t.Errorf("Unlock() failed: %v", err)
+			}
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}
+	// Nobody can jump the queue.
+	if ok, err := s.TryLock("foo"); err != nil || ok {
+		t.Errorf("TryLock() = %v, %v, want false", ok, err)
+	}
+	if err := s.Unlock("foo"); err != nil {
+		t.Fatalf("Unlock() failed: %v", err)
+	}
+	wg.Wait()
+	if want := []int{0, 1, 2, 3, 4}; !slices.Equal(order, want) {
+		t.Errorf("Lock order = %v, want %v", order, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "foo.lock.q")); !os.IsNotExist(err) {
+		t.Errorf("Queue directory wasn't removed: %v", err)
+	}
+}
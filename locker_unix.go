@@ -0,0 +1,243 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build unix
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// NewFcntlLocker returns a Locker that uses fcntl byte-range locks on files
+// in dir. Unlike the default Locker, it doesn't rely on exclusive file
+// creation, which isn't reliable on some network filesystems, e.g. NFS and
+// SMB. The locks are released automatically by the operating system when the
+// process dies, so there are never any stale locks.
+//
+// It must be used with WithLocker by all the processes that share dir, since
+// it doesn't use the same lock files as the default Locker, e.g.
+//
+//	s, err := storage.Open(dir, mk, storage.WithLocker(storage.NewFcntlLocker(dir)))
+func NewFcntlLocker(dir string) Locker {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	return &fcntlLocker{dir: dir}
+}
+
+type fcntlLocker struct {
+	dir string
+}
+
+// fcntlLocks is the state of the fcntl locks of this process, by lock file.
+// fcntl locks are owned by the process, and closing any file descriptor of a
+// lock file releases its lock, so the state is shared by all the fcntlLockers.
+var fcntlLocks = struct {
+	mu      sync.Mutex
+	entries map[string]*fcntlEntry
+}{entries: make(map[string]*fcntlEntry)}
+
+// fcntlEntry is the state of a lock in this process. fcntl locks are owned
+// by the process, so they don't provide mutual exclusion between goroutines.
+// That is what sem does.
+type fcntlEntry struct {
+	sem    chan struct{}
+	refs   int
+	f      *os.File
+	locked bool
+}
+
+func (l *fcntlLocker) lockFile(name string) string {
+	return filepath.Join(l.dir, name) + ".flock"
+}
+
+func (l *fcntlLocker) ref(name string) *fcntlEntry {
+	fcntlLocks.mu.Lock()
+	defer fcntlLocks.mu.Unlock()
+	fn := l.lockFile(name)
+	e, ok := fcntlLocks.entries[fn]
+	if !ok {
+		e = &fcntlEntry{sem: make(chan struct{}, 1)}
+		fcntlLocks.entries[fn] = e
+	}
+	e.refs++
+	return e
+}
+
+func (l *fcntlLocker) unref(name string) {
+	fcntlLocks.mu.Lock()
+	defer fcntlLocks.mu.Unlock()
+	fn := l.lockFile(name)
+	if e := fcntlLocks.entries[fn]; e != nil {
+		if e.refs--; e.refs == 0 {
+			delete(fcntlLocks.entries, fn)
+		}
+	}
+}
+
+func (l *fcntlLocker) Lock(ctx context.Context, name string) error {
+	e := l.ref(name)
+	select {
+	case e.sem <- struct{}{}:
+	case <-ctx.Done():
+		l.unref(name)
+		return fmt.Errorf("lock %s: %w", name, ctx.Err())
+	}
+	for {
+		ok, err := l.tryLock(e, name)
+		if err != nil || ok {
+			return err
+		}
+		// F_SETLKW can't be interrupted when ctx is done, so poll
+		// instead.
+		t := time.NewTimer(time.Duration(100+mrand.Int()%100) * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			l.release(e, name)
+			return fmt.Errorf("lock %s: %w", name, ctx.Err())
+		case <-t.C:
+		}
+	}
+}
+
+func (l *fcntlLocker) TryLock(name string) (bool, error) {
+	e := l.ref(name)
+	select {
+	case e.sem <- struct{}{}:
+	default:
+		l.unref(name)
+		return false, nil
+	}
+	ok, err := l.tryLock(e, name)
+	if err == nil && !ok {
+		l.release(e, name)
+	}
+	return ok, err
+}
+
+// tryLock tries to acquire the fcntl lock. The caller must hold e.sem. On
+// error, e.sem is released.
+func (l *fcntlLocker) tryLock(e *fcntlEntry, name string) (bool, error) {
+	ok, err := l.setLock(e, name)
+	if err != nil {
+		l.release(e, name)
+	}
+	return ok, err
+}
+
+func (l *fcntlLocker) setLock(e *fcntlEntry, name string) (bool, error) {
+	// Closing any file descriptor of the lock file releases the lock.
+	// fcntlLocks.mu makes sure that LockInfo doesn't do that while the
+	// lock is being acquired.
+	fcntlLocks.mu.Lock()
+	defer fcntlLocks.mu.Unlock()
+	if e.f == nil {
+		fn := l.lockFile(name)
+		if err := createParentIfNotExist(osBackend{}, fn); err != nil {
+			return false, err
+		}
+		f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return false, err
+		}
+		e.f = f
+	}
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0}
+	err := syscall.FcntlFlock(e.f.Fd(), syscall.F_SETLK, &lk)
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EACCES) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	e.locked = true
+	return true, nil
+}
+
+// release closes the lock file, which releases the fcntl lock, and releases
+// e.sem.
+func (l *fcntlLocker) release(e *fcntlEntry, name string) error {
+	fcntlLocks.mu.Lock()
+	var err error
+	if e.f != nil {
+		err = e.f.Close()
+		e.f = nil
+	}
+	e.locked = false
+	fcntlLocks.mu.Unlock()
+	<-e.sem
+	l.unref(name)
+	return err
+}
+
+func (l *fcntlLocker) Unlock(name string) error {
+	fcntlLocks.mu.Lock()
+	e := fcntlLocks.entries[l.lockFile(name)]
+	fcntlLocks.mu.Unlock()
+	if e == nil || !e.locked {
+		return fmt.Errorf("%s is not locked", name)
+	}
+	return l.release(e, name)
+}
+
+func (l *fcntlLocker) LockInfo(name string) (LockInfo, error) {
+	fcntlLocks.mu.Lock()
+	defer fcntlLocks.mu.Unlock()
+	var info LockInfo
+	if e := fcntlLocks.entries[l.lockFile(name)]; e != nil {
+		// The other references are waiting for the lock.
+		info.Waiters = e.refs
+		if e.locked {
+			info.Waiters--
+			info.Locked, info.PID, info.Host = true, os.Getpid(), hostname()
+			return info, nil
+		}
+	}
+	f, err := os.OpenFile(l.lockFile(name), os.O_RDWR, 0600)
+	if errors.Is(err, os.ErrNotExist) {
+		return info, nil
+	}
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0}
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_GETLK, &lk); err != nil {
+		return info, err
+	}
+	if lk.Type != syscall.F_UNLCK {
+		// The pid is only meaningful when the holder is on this host.
+		info.Locked, info.PID = true, int(lk.Pid)
+	}
+	return info, nil
+}
@@ -0,0 +1,146 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build unix
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFcntlLocker(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, aesEncryptionKey(), WithLocker(NewFcntlLocker(dir)))
+
+	if err := s.Lock("foo"); err != nil {
+		t.Fatalf("Lock() failed: %v", err)
+	}
+	if ok, err := s.TryLock("foo"); err != nil || ok {
+		t.Errorf("TryLock() = %v, %v, want false", ok, err)
+	}
+	if err := s.LockWithTimeout("foo", 200*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("LockWithTimeout() = %v, want DeadlineExceeded", err)
+	}
+	if info, err := s.LockInfo("foo"); err != nil || !info.Locked || info.PID != os.Getpid() {
+		t.Errorf("LockInfo() = %+v, %v", info, err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.Unlock("foo")
+	}()
+	if err := s.Lock("foo"); err != nil {
+		t.Fatalf("Lock() failed: %v", err)
+	}
+	if err := s.Unlock("foo"); err != nil {
+		t.Fatalf("Unlock() failed: %v", err)
+	}
+	if err := s.Unlock("foo"); err == nil {
+		t.Error("Unlock() of unlocked file succeeded")
+	}
+	if info, err := s.LockInfo("foo"); err != nil || info.Locked {
+		t.Errorf("LockInfo() = %+v, %v", info, err)
+	}
+}
+
+func TestFcntlLockerSameProcess(t *testing.T) {
+	dir := t.TempDir()
+	mk := aesEncryptionKey()
+	s1 := New(dir, mk, WithLocker(NewFcntlLocker(dir)))
+	s2 := New(dir, mk, WithLocker(NewFcntlLocker(dir)))
+
+	if err := s1.Lock("foo"); err != nil {
+		t.Fatalf("Lock() failed: %v", err)
+	}
+	if ok, err := s2.TryLock("foo"); err != nil || ok {
+		t.Errorf("TryLock() = %v, %v, want false", ok, err)
+	}
+	if info, err := s2.LockInfo("foo"); err != nil || !info.Locked {
+		t.Errorf("LockInfo() = %+v, %v", info, err)
+	}
+	// LockInfo on s2 must not have released the lock of s1.
+	if ok, err := s2.TryLock("foo"); err != nil || ok {
+		t.Errorf("TryLock() = %v, %v, want false", ok, err)
+	}
+	if err := s1.Unlock("foo"); err != nil {
+		t.Fatalf("Unlock() failed: %v", err)
+	}
+	if ok, err := s2.TryLock("foo"); err != nil || !ok {
+		t.Fatalf("TryLock() = %v, %v, want true", ok, err)
+	}
+	if err := s2.Unlock("foo"); err != nil {
+		t.Fatalf("Unlock() failed: %v", err)
+	}
+}
+
+func TestFcntlLockerOtherProcess(t *testing.T) {
+	if dir := os.Getenv("FCNTL_LOCKER_HELPER_DIR"); dir != "" {
+		// This is the other process. It holds the lock until it is
+		// killed.
+		l := NewFcntlLocker(dir)
+		if err := l.Lock(context.Background(), "foo"); err != nil {
+			t.Fatalf("Lock() failed: %v", err)
+		}
+		os.WriteFile(filepath.Join(dir, "ready"), nil, 0600)
+		time.Sleep(time.Minute)
+		return
+	}
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFcntlLockerOtherProcess$")
+	cmd.Env = append(os.Environ(), "FCNTL_LOCKER_HELPER_DIR="+dir)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("cmd.Start: %v", err)
+	}
+	defer cmd.Process.Kill()
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "ready")); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	l := NewFcntlLocker(dir)
+	if ok, err := l.TryLock("foo"); err != nil || ok {
+		t.Fatalf("TryLock() = %v, %v, want false", ok, err)
+	}
+	if info, err := l.(LockInspector).LockInfo("foo"); err != nil || !info.Locked || info.PID != cmd.Process.Pid {
+		t.Errorf("LockInfo() = %+v, %v, want pid %d", info, err, cmd.Process.Pid)
+	}
+	// The lock is released when the process dies.
+	cmd.Process.Kill()
+	cmd.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := l.Lock(ctx, "foo"); err != nil {
+		t.Fatalf("Lock() failed: %v", err)
+	}
+	if err := l.Unlock("foo"); err != nil {
+		t.Fatalf("Unlock() failed: %v", err)
+	}
+}
@@ -0,0 +1,388 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package logfile is an append-only encrypted log, on top of an encrypted
+// storage.
+//
+// The log is split into segments. Each segment is a record file, to which the
+// entries are appended without rewriting the existing ones, and which is named
+// after the sequence number of its first entry. A new segment is started when
+// the current one reaches its maximum size or age. The old segments are pruned
+// according to the retention options.
+//
+// Example:
+//
+//	l, err := logfile.Open(s, "audit", logfile.WithMaxSegmentAge(24*time.Hour), logfile.WithRetention(90*24*time.Hour))
+//	if err != nil {
+//		return err
+//	}
+//	defer l.Close()
+//	if _, err := l.Append([]byte("user alice logged in")); err != nil {
+//		return err
+//	}
+//	r := l.NewReader(0)
+//	for {
+//		e, err := r.Next()
+//		if err == io.EOF {
+//			break
+//		}
+//		...
+//	}
+package logfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+)
+
+var (
+	// ErrClosed is returned when the log is closed.
+	ErrClosed = errors.New("log is closed")
+	// ErrLocked is returned by Open when the log is already open.
+	ErrLocked = errors.New("log is already open")
+)
+
+const (
+	// defaultMaxSegmentSize is the default maximum size of the entries of
+	// a segment.
+	defaultMaxSegmentSize = 8 << 20
+
+	lockFile = "log"
+)
+
+// segmentRE matches the names of the segment files.
+var segmentRE = regexp.MustCompile(`^[0-9]{20}$`)
+
+// Option is used to specify optional parameters of Open.
+type Option func(*Log)
+
+// WithMaxSegmentSize specifies the maximum total size of the entries of a
+// segment. The default is 8 MiB.
+func WithMaxSegmentSize(n int64) Option {
+	return func(l *Log) {
+		l.maxSize = n
+	}
+}
+
+// WithMaxSegmentAge specifies the maximum age of a segment, i.e. the time
+// since its first entry, after which a new segment is started. By default,
+// segments are rotated only based on their size.
+func WithMaxSegmentAge(d time.Duration) Option {
+	return func(l *Log) {
+		l.maxAge = d
+	}
+}
+
+// WithRetention specifies that the segments whose entries are all older than
+// d are deleted.
+func WithRetention(d time.Duration) Option {
+	return func(l *Log) {
+		l.retention = d
+	}
+}
+
+// WithMaxSegments specifies the maximum number of segments. The oldest
+// segments are deleted when there are more.
+func WithMaxSegments(n int) Option {
+	return func(l *Log) {
+		l.maxSegments = n
+	}
+}
+
+// Entry is an entry of the log.
+type Entry struct {
+	// Seq is the sequence number of the entry. The first entry is 1.
+	Seq uint64 `json:"seq"`
+	// Time is when the entry was appended.
+	Time time.Time `json:"time"`
+	// Data is the content of the entry.
+	Data []byte `json:"data"`
+}
+
+// segment is a segment file.
+type segment struct {
+	// first is the sequence number of the first entry.
+	first uint64
+	// start and end are the times of the first and last entries.
+	start, end time.Time
+	// size is the total size of the entries.
+	size int64
+}
+
+// Log is an append-only log. It is safe for concurrent use.
+type Log struct {
+	s           *storage.Storage
+	dir         string
+	maxSize     int64
+	maxAge      time.Duration
+	retention   time.Duration
+	maxSegments int
+
+	mu       sync.Mutex
+	closed   bool
+	segments []*segment
+	// next is the sequence number of the next entry.
+	next uint64
+}
+
+// Open opens the log in dir. Only one Log can have the log open at a time,
+// including in other processes.
+func Open(s *storage.Storage, dir string, opts ...Option) (*Log, error) {
+	l := &Log{s: s, dir: dir, maxSize: defaultMaxSegmentSize, next: 1}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if err := s.MkdirAll(dir); err != nil {
+		return nil, err
+	}
+	ok, err := s.TryLock(filepath.Join(dir, lockFile))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrLocked
+	}
+	if err := l.load(); err != nil {
+		s.Unlock(filepath.Join(dir, lockFile))
+		return nil, err
+	}
+	return l, nil
+}
+
+// load finds the segments, and reads the last one.
+func (l *Log) load() error {
+	entries, err := l.s.FS().ReadDir(filepath.ToSlash(l.dir))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !segmentRE.MatchString(e.Name()) {
+			continue
+		}
+		first, err := strconv.ParseUint(e.Name(), 10, 64)
+		if err != nil {
+			return err
+		}
+		l.segments = append(l.segments, &segment{first: first})
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i].first < l.segments[j].first })
+	for _, seg := range l.segments {
+		err := l.readSegment(seg, func(e *Entry) {
+			if seg.start.IsZero() {
+				seg.start = e.Time
+			}
+			seg.end = e.Time
+			seg.size += int64(len(e.Data))
+			l.next = e.Seq + 1
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Log) segmentName(seg *segment) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d", seg.first))
+}
+
+// readSegment calls fn with each entry of a segment.
+func (l *Log) readSegment(seg *segment, fn func(*Entry)) error {
+	err := l.s.ReadRecords(l.segmentName(seg), func(decode func(any) error) error {
+		var e Entry
+		if err := decode(&e); err != nil {
+			return err
+		}
+		fn(&e)
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Close closes the log.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	return l.s.Unlock(filepath.Join(l.dir, lockFile))
+}
+
+// Append appends an entry to the log, and returns its sequence number. The
+// entry is persisted when Append returns.
+func (l *Log) Append(data []byte) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
+	e := &Entry{Seq: l.next, Time: time.Now().UTC(), Data: data}
+	seg := l.current(e.Time)
+	if seg == nil {
+		seg = &segment{first: e.Seq, start: e.Time}
+		l.segments = append(l.segments, seg)
+		defer l.prune(e.Time)
+	}
+	if err := l.s.AppendRecord(l.segmentName(seg), e); err != nil {
+		if seg.size == 0 {
+			l.segments = l.segments[:len(l.segments)-1]
+		}
+		return 0, err
+	}
+	seg.end = e.Time
+	seg.size += int64(len(data))
+	l.next++
+	return e.Seq, nil
+}
+
+// current returns the segment where the next entry is appended, or nil if a
+// new segment must be started.
+func (l *Log) current(now time.Time) *segment {
+	if len(l.segments) == 0 {
+		return nil
+	}
+	seg := l.segments[len(l.segments)-1]
+	if seg.size >= l.maxSize || (l.maxAge > 0 && now.Sub(seg.start) >= l.maxAge) {
+		return nil
+	}
+	return seg
+}
+
+// Prune deletes the segments that are beyond the retention options. The
+// current segment is never deleted.
+func (l *Log) Prune() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.prune(time.Now())
+}
+
+func (l *Log) prune(now time.Time) error {
+	var n int
+	for n < len(l.segments)-1 {
+		seg := l.segments[n]
+		expired := l.retention > 0 && now.Sub(seg.end) > l.retention
+		tooMany := l.maxSegments > 0 && len(l.segments)-n > l.maxSegments
+		if !expired && !tooMany {
+			break
+		}
+		if err := l.s.DeleteFile(l.segmentName(seg)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			l.segments = l.segments[n:]
+			return err
+		}
+		n++
+	}
+	l.segments = l.segments[n:]
+	return nil
+}
+
+// NewReader returns a Reader that reads the entries sequentially, starting
+// with the entry whose sequence number is seq, or the oldest entry if it was
+// pruned.
+func (l *Log) NewReader(seq uint64) *Reader {
+	return &Reader{l: l, next: seq}
+}
+
+// Reader reads the entries of a log sequentially. It is not safe for
+// concurrent use.
+type Reader struct {
+	l    *Log
+	next uint64
+	// The entries of the segment that is being read.
+	entries []*Entry
+}
+
+// Next returns the next entry. It returns io.EOF when there are no more
+// entries. Next can be called again after more entries are appended.
+func (r *Reader) Next() (*Entry, error) {
+	for {
+		for len(r.entries) > 0 {
+			e := r.entries[0]
+			r.entries = r.entries[1:]
+			if e.Seq >= r.next {
+				r.next = e.Seq + 1
+				return e, nil
+			}
+		}
+		seg, err := r.segment()
+		if err != nil {
+			return nil, err
+		}
+		if seg == nil {
+			return nil, io.EOF
+		}
+		r.next = max(r.next, seg.first)
+		if err := r.l.readSegment(seg, func(e *Entry) {
+			if e.Seq >= r.next {
+				r.entries = append(r.entries, e)
+			}
+		}); err != nil {
+			return nil, err
+		}
+		if len(r.entries) == 0 {
+			// The segment was pruned while it was read, in which case
+			// segment() now returns the oldest remaining one.
+			if s, err := r.segment(); err != nil || s == seg {
+				return nil, io.EOF
+			}
+		}
+	}
+}
+
+// segment returns the segment that contains the next entry, or nil if there
+// isn't one.
+func (r *Reader) segment() (*segment, error) {
+	r.l.mu.Lock()
+	defer r.l.mu.Unlock()
+	if r.l.closed {
+		return nil, ErrClosed
+	}
+	if r.next >= r.l.next {
+		return nil, nil
+	}
+	i := sort.Search(len(r.l.segments), func(i int) bool { return r.l.segments[i].first > r.next })
+	if i == 0 {
+		if len(r.l.segments) == 0 {
+			return nil, nil
+		}
+		return r.l.segments[0], nil
+	}
+	return r.l.segments[i-1], nil
+}
@@ -0,0 +1,186 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package logfile_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/internal/storagetest"
+	"github.com/c2FmZQ/storage/logfile"
+)
+
+func open(t *testing.T, s *storage.Storage, opts ...logfile.Option) *logfile.Log {
+	t.Helper()
+	l, err := logfile.Open(s, "log", opts...)
+	if err != nil {
+		t.Fatalf("logfile.Open: %v", err)
+	}
+	return l
+}
+
+func appendN(t *testing.T, l *logfile.Log, from, to int) {
+	t.Helper()
+	for i := from; i <= to; i++ {
+		seq, err := l.Append([]byte(fmt.Sprintf("entry %d", i)))
+		if err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+		if seq != uint64(i) {
+			t.Fatalf("Append() = %d, want %d", seq, i)
+		}
+	}
+}
+
+func readAll(t *testing.T, r *logfile.Reader) []uint64 {
+	t.Helper()
+	var seqs []uint64
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return seqs
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if got, want := string(e.Data), fmt.Sprintf("entry %d", e.Seq); got != want {
+			t.Fatalf("Data = %q, want %q", got, want)
+		}
+		seqs = append(seqs, e.Seq)
+	}
+}
+
+func segments(t *testing.T, s *storage.Storage) int {
+	t.Helper()
+	entries, err := s.FS().ReadDir("log")
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	return len(entries)
+}
+
+func checkSeqs(t *testing.T, got []uint64, from, to int) {
+	t.Helper()
+	if len(got) != to-from+1 {
+		t.Fatalf("Got %d entries, want %d: %v", len(got), to-from+1, got)
+	}
+	for i, seq := range got {
+		if seq != uint64(from+i) {
+			t.Fatalf("Got %v, want %d..%d", got, from, to)
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+	s := storagetest.New(t)
+	l := open(t, s, logfile.WithMaxSegmentSize(50))
+	// Segments: 1-8, 9-15, 16-20.
+	appendN(t, l, 1, 20)
+	if got, want := segments(t, s), 3; got != want {
+		t.Errorf("Segments = %d, want %d", got, want)
+	}
+
+	r := l.NewReader(0)
+	checkSeqs(t, readAll(t, r), 1, 20)
+	appendN(t, l, 21, 25)
+	checkSeqs(t, readAll(t, r), 21, 25)
+	checkSeqs(t, readAll(t, l.NewReader(12)), 12, 25)
+
+	if _, err := logfile.Open(s, "log"); !errors.Is(err, logfile.ErrLocked) {
+		t.Errorf("Open() = %v, want ErrLocked", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := l.Append(nil); !errors.Is(err, logfile.ErrClosed) {
+		t.Errorf("Append() = %v, want ErrClosed", err)
+	}
+
+	l = open(t, s, logfile.WithMaxSegmentSize(50))
+	defer l.Close()
+	appendN(t, l, 26, 30)
+	checkSeqs(t, readAll(t, l.NewReader(0)), 1, 30)
+}
+
+func TestSegmentAge(t *testing.T) {
+	s := storagetest.New(t)
+	l := open(t, s, logfile.WithMaxSegmentAge(50*time.Millisecond))
+	defer l.Close()
+	appendN(t, l, 1, 2)
+	time.Sleep(60 * time.Millisecond)
+	appendN(t, l, 3, 4)
+	if got, want := segments(t, s), 2; got != want {
+		t.Errorf("Segments = %d, want %d", got, want)
+	}
+	checkSeqs(t, readAll(t, l.NewReader(0)), 1, 4)
+}
+
+func TestPrune(t *testing.T) {
+	s := storagetest.New(t)
+	l := open(t, s, logfile.WithMaxSegmentSize(50), logfile.WithMaxSegments(2))
+	appendN(t, l, 1, 20)
+	if got, want := segments(t, s), 2; got != want {
+		t.Errorf("Segments = %d, want %d", got, want)
+	}
+	checkSeqs(t, readAll(t, l.NewReader(0)), 9, 20)
+	l.Close()
+
+	l = open(t, s, logfile.WithRetention(50*time.Millisecond))
+	defer l.Close()
+	time.Sleep(60 * time.Millisecond)
+	if err := l.Prune(); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	// The current segment is never pruned.
+	if got, want := segments(t, s), 1; got != want {
+		t.Errorf("Segments = %d, want %d", got, want)
+	}
+	checkSeqs(t, readAll(t, l.NewReader(0)), 16, 20)
+}
+
+func TestTruncatedSegment(t *testing.T) {
+	s := storagetest.New(t)
+	l := open(t, s)
+	appendN(t, l, 1, 5)
+	l.Close()
+
+	name := filepath.Join(s.Dir(), "log", fmt.Sprintf("%020d", 1))
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if err := os.Truncate(name, fi.Size()-3); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+	l = open(t, s)
+	defer l.Close()
+	appendN(t, l, 5, 6)
+	checkSeqs(t, readAll(t, l.NewReader(0)), 1, 6)
+}
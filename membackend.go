@@ -0,0 +1,492 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewMemBackend returns a Backend that keeps all the files in memory. Nothing
+// is ever written to disk by the Backend itself, and everything is lost when
+// it is garbage collected. It is useful for tests, and for ephemeral data
+// that must not be persisted. Note that the memory can still be swapped out
+// by the operating system.
+//
+// The directory passed to Open is only used as a prefix for the file names.
+func NewMemBackend() Backend {
+	return &memBackend{nodes: make(map[string]*memNode)}
+}
+
+type memBackend struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+}
+
+// memNode is a file or a directory. The same node can have multiple names,
+// i.e. hard links.
+type memNode struct {
+	dir   bool
+	data  []byte
+	mtime time.Time
+}
+
+// isRoot returns true if name is the root of the filesystem, which always
+// exists.
+func isRoot(name string) bool {
+	return filepath.Dir(name) == name
+}
+
+// lookup returns the node of name. b.mu must be held.
+func (b *memBackend) lookup(op, name string) (*memNode, error) {
+	if isRoot(name) {
+		return &memNode{dir: true}, nil
+	}
+	n, ok := b.nodes[name]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return n, nil
+}
+
+// checkParent verifies that the parent of name is a directory. b.mu must be
+// held.
+func (b *memBackend) checkParent(op, name string) error {
+	p, err := b.lookup(op, filepath.Dir(name))
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if !p.dir {
+		return &fs.PathError{Op: op, Path: name, Err: errors.New("not a directory")}
+	}
+	return nil
+}
+
+// children returns the names of the direct children of dir. b.mu must be
+// held.
+func (b *memBackend) children(dir string) []string {
+	var out []string
+	for k := range b.nodes {
+		if k != dir && filepath.Dir(k) == dir {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// isUnder returns true if name is in the subtree of dir.
+func isUnder(name, dir string) bool {
+	return strings.HasPrefix(name, dir+string(filepath.Separator)) || (isRoot(dir) && name != dir)
+}
+
+func (b *memBackend) Open(name string) (File, error) {
+	return b.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (b *memBackend) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	cn := filepath.Clean(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, err := b.lookup("open", cn)
+	switch {
+	case err != nil && flag&os.O_CREATE == 0:
+		return nil, err
+	case err != nil:
+		if err := b.checkParent("open", cn); err != nil {
+			return nil, err
+		}
+		n = &memNode{mtime: time.Now()}
+		b.nodes[cn] = n
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case n.dir && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	if flag&os.O_TRUNC != 0 && !n.dir {
+		n.data = n.data[:0]
+		n.mtime = time.Now()
+	}
+	return &memFile{b: b, n: n, name: name, flag: flag}, nil
+}
+
+func (b *memBackend) Stat(name string) (fs.FileInfo, error) {
+	cn := filepath.Clean(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, err := b.lookup("stat", cn)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(filepath.Base(cn)), nil
+}
+
+func (b *memBackend) ReadDir(name string) ([]fs.DirEntry, error) {
+	cn := filepath.Clean(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, err := b.lookup("readdir", cn)
+	if err != nil {
+		return nil, err
+	}
+	if !n.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	var out []fs.DirEntry
+	for _, c := range b.children(cn) {
+		out = append(out, fs.FileInfoToDirEntry(b.nodes[c].info(filepath.Base(c))))
+	}
+	return out, nil
+}
+
+func (b *memBackend) Rename(oldpath, newpath string) error {
+	co, cn := filepath.Clean(oldpath), filepath.Clean(newpath)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, err := b.lookup("rename", co)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if co == cn {
+		return nil
+	}
+	if isRoot(co) || isUnder(cn, co) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrInvalid}
+	}
+	if err := b.checkParent("rename", cn); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if t, ok := b.nodes[cn]; ok {
+		if t.dir != n.dir || (t.dir && len(b.children(cn)) > 0) {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrExist}
+		}
+	}
+	if n.dir {
+		var moved []string
+		for k := range b.nodes {
+			if isUnder(k, co) {
+				moved = append(moved, k)
+			}
+		}
+		for _, k := range moved {
+			b.nodes[cn+k[len(co):]] = b.nodes[k]
+			delete(b.nodes, k)
+		}
+	}
+	delete(b.nodes, co)
+	b.nodes[cn] = n
+	return nil
+}
+
+func (b *memBackend) Link(oldname, newname string) error {
+	co, cn := filepath.Clean(oldname), filepath.Clean(newname)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, err := b.lookup("link", co)
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	if n.dir {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errors.New("is a directory")}
+	}
+	if _, ok := b.nodes[cn]; ok || isRoot(cn) {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fs.ErrExist}
+	}
+	if err := b.checkParent("link", cn); err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	b.nodes[cn] = n
+	return nil
+}
+
+func (b *memBackend) Remove(name string) error {
+	cn := filepath.Clean(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, err := b.lookup("remove", cn)
+	if err != nil {
+		return err
+	}
+	if isRoot(cn) || (n.dir && len(b.children(cn)) > 0) {
+		return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	delete(b.nodes, cn)
+	return nil
+}
+
+func (b *memBackend) RemoveAll(path string) error {
+	cn := filepath.Clean(path)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for k := range b.nodes {
+		if k == cn || isUnder(k, cn) {
+			delete(b.nodes, k)
+		}
+	}
+	return nil
+}
+
+func (b *memBackend) MkdirAll(path string, perm fs.FileMode) error {
+	cn := filepath.Clean(path)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var missing []string
+	for p := cn; !isRoot(p); p = filepath.Dir(p) {
+		if n, ok := b.nodes[p]; ok {
+			if !n.dir {
+				return &fs.PathError{Op: "mkdir", Path: p, Err: errors.New("not a directory")}
+			}
+			break
+		}
+		missing = append(missing, p)
+	}
+	now := time.Now()
+	for _, p := range missing {
+		b.nodes[p] = &memNode{dir: true, mtime: now}
+	}
+	return nil
+}
+
+func (b *memBackend) Chtimes(name string, atime, mtime time.Time) error {
+	cn := filepath.Clean(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, err := b.lookup("chtimes", cn)
+	if err != nil {
+		return err
+	}
+	n.mtime = mtime
+	return nil
+}
+
+// info returns the FileInfo of n. Sys returns n itself so that the storage's
+// cache can recognize the file.
+func (n *memNode) info(name string) fs.FileInfo {
+	return &memFileInfo{name: name, size: int64(len(n.data)), mtime: n.mtime, dir: n.dir, n: n}
+}
+
+type memFileInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+	dir   bool
+	n     *memNode
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *memFileInfo) IsDir() bool        { return fi.dir }
+func (fi *memFileInfo) Sys() any           { return fi.n }
+
+func (fi *memFileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0700
+	}
+	return 0600
+}
+
+// memFile is an open file of a memBackend.
+type memFile struct {
+	b      *memBackend
+	n      *memNode
+	name   string
+	flag   int
+	off    int64
+	closed bool
+}
+
+var errBadFileDescriptor = errors.New("bad file descriptor")
+
+// check verifies that the file is open, and that it was opened for writing
+// if write is true. f.b.mu must be held.
+func (f *memFile) check(op string, write bool) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+	if f.n.dir {
+		return &fs.PathError{Op: op, Path: f.name, Err: errors.New("is a directory")}
+	}
+	readable := f.flag&os.O_WRONLY == 0
+	writable := f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if (write && !writable) || (!write && !readable) {
+		return &fs.PathError{Op: op, Path: f.name, Err: errBadFileDescriptor}
+	}
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	n, err := f.readAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "readat", Path: f.name, Err: errors.New("negative offset")}
+	}
+	n, err := f.readAt(p, off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// readAt reads from the node's data. f.b.mu must be held.
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(f.n.data)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	return copy(p, f.n.data[off:]), nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.off = int64(len(f.n.data))
+	}
+	n := f.writeAt(p, f.off)
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "writeat", Path: f.name, Err: errors.New("negative offset")}
+	}
+	return f.writeAt(p, off), nil
+}
+
+// writeAt writes to the node's data, growing it as needed. f.b.mu must be
+// held.
+func (f *memFile) writeAt(p []byte, off int64) int {
+	if end := off + int64(len(p)); end > int64(len(f.n.data)) {
+		f.n.data = append(f.n.data, make([]byte, end-int64(len(f.n.data)))...)
+	}
+	copy(f.n.data[off:], p)
+	f.n.mtime = time.Now()
+	return len(p)
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.n.data))
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: errors.New("invalid whence")}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: errors.New("negative offset")}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+	return f.n.info(filepath.Base(f.name)), nil
+}
+
+func (f *memFile) Sync() error {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "sync", Path: f.name, Err: fs.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: errors.New("negative size")}
+	}
+	if size <= int64(len(f.n.data)) {
+		clear(f.n.data[size:])
+		f.n.data = f.n.data[:size]
+	} else {
+		f.n.data = append(f.n.data, make([]byte, size-int64(len(f.n.data)))...)
+	}
+	f.n.mtime = time.Now()
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
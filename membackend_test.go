@@ -0,0 +1,200 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestMemBackend(t *testing.T) {
+	b := NewMemBackend()
+
+	if _, err := b.OpenFile("/a/b", os.O_WRONLY|os.O_CREATE, 0600); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("OpenFile() = %v, want ErrNotExist", err)
+	}
+	if err := b.MkdirAll("/a/c", 0700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	f, err := b.OpenFile("/a/b", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := f.Write([]byte("Hello world")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("W"), 6); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	if _, err := f.Read(make([]byte, 1)); err == nil {
+		t.Error("Read on write-only file succeeded")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := b.OpenFile("/a/b", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("OpenFile() = %v, want ErrExist", err)
+	}
+
+	if err := b.Link("/a/b", "/a/d"); err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+	if err := b.Link("/a/b", "/a/d"); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("Link() = %v, want ErrExist", err)
+	}
+	if err := b.Rename("/a/d", "/a/c/e"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	got, err := readFile(b, "/a/c/e")
+	if err != nil || string(got) != "Hello World" {
+		t.Fatalf("readFile() = %q, %v", got, err)
+	}
+
+	entries, err := b.ReadDir("/a")
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := []string{"b", "c"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ReadDir() = %v, want %v", names, want)
+	}
+
+	if err := b.Remove("/a/c"); err == nil {
+		t.Error("Remove of non-empty directory succeeded")
+	}
+	if err := b.Rename("/a/c", "/x"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if _, err := b.Stat("/x/e"); err != nil {
+		t.Errorf("Stat(/x/e): %v", err)
+	}
+	if _, err := b.Stat("/a/c/e"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(/a/c/e) = %v, want ErrNotExist", err)
+	}
+	if err := b.RemoveAll("/x"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	if _, err := b.Stat("/x/e"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(/x/e) = %v, want ErrNotExist", err)
+	}
+
+	f, err = b.OpenFile("/a/b", os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f.Close()
+	if err := f.Truncate(5); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if got, err := io.ReadAll(f); err != nil || string(got) != "Hello" {
+		t.Errorf("ReadAll() = %q, %v", got, err)
+	}
+	buf := make([]byte, 10)
+	if n, err := f.ReadAt(buf, 1); err != io.EOF || string(buf[:n]) != "ello" {
+		t.Errorf("ReadAt() = %q, %v", buf[:n], err)
+	}
+}
+
+func TestStorageWithMemBackend(t *testing.T) {
+	be := NewMemBackend()
+	mk := aesEncryptionKey()
+	s, err := Open("/mem", mk, WithBackend(be), WithCache(10), WithCompression())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	type Foo struct {
+		N int
+	}
+	if err := s.SaveDataFile("foo", Foo{1}); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var foo Foo
+			commit, err := s.OpenForUpdate("foo", &foo)
+			if err != nil {
+				t.Errorf("s.OpenForUpdate: %v", err)
+				return
+			}
+			foo.N++
+			if err := commit(true, nil); err != nil {
+				t.Errorf("commit: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	var foo Foo
+	if err := s.ReadDataFile("foo", &foo); err != nil || foo.N != 11 {
+		t.Fatalf("s.ReadDataFile() = %v, %v", foo, err)
+	}
+
+	for _, f := range []string{"a", "b"} {
+		if err := s.SaveDataFile(f, Foo{}); err != nil {
+			t.Fatalf("s.SaveDataFile: %v", err)
+		}
+	}
+	var a, b Foo
+	commit, err := s.OpenManyForUpdate([]string{"a", "b"}, []*Foo{&a, &b})
+	if err != nil {
+		t.Fatalf("s.OpenManyForUpdate: %v", err)
+	}
+	a.N, b.N = 1, 2
+	if err := commit(true, nil); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	content := bytes.Repeat([]byte("Hello world! "), 10000)
+	writeBlob(t, s, "blob", content)
+	if got := readBlob(t, s, "blob"); !bytes.Equal(got, content) {
+		t.Errorf("readBlob() returned %d bytes, want %d", len(got), len(content))
+	}
+
+	// The data survives as long as the backend does.
+	s2, err := Open("/mem", mk, WithBackend(be))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := s2.ReadDataFile("b", &b); err != nil || b.N != 2 {
+		t.Fatalf("s2.ReadDataFile() = %v, %v", b, err)
+	}
+	if err := New("/mem", mk, WithBackend(NewMemBackend())).ReadDataFile("b", &b); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("ReadDataFile() = %v, want ErrNotExist", err)
+	}
+}
@@ -0,0 +1,89 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Names of the metrics reported to the MetricsSink.
+const (
+	// MetricLockWait is the time spent waiting to acquire a lock.
+	MetricLockWait = "lock_wait"
+	// MetricLockHold is the time during which a lock was held.
+	MetricLockHold = "lock_hold"
+	// MetricStaleLockReclaimed counts the stale locks that were removed.
+	MetricStaleLockReclaimed = "stale_lock_reclaimed"
+)
+
+// MetricsSink receives metrics from the storage, e.g. to export them to a
+// monitoring system. The methods are called concurrently, and should return
+// quickly.
+type MetricsSink interface {
+	// ObserveDuration records a duration for filename.
+	ObserveDuration(metric, filename string, d time.Duration)
+	// Count increments a counter for filename.
+	Count(metric, filename string)
+}
+
+// WithMetrics specifies where the storage should report its metrics.
+func WithMetrics(m MetricsSink) Option {
+	return func(opt *option) {
+		opt.metrics = m
+	}
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveDuration(string, string, time.Duration) {}
+func (nopMetrics) Count(string, string)                          {}
+
+// lockTimes keeps track of when the locks held by a storage were acquired, to
+// report how long they were held.
+type lockTimes struct {
+	mu sync.Mutex
+	m  map[string]time.Time
+}
+
+func newLockTimes() *lockTimes {
+	return &lockTimes{m: make(map[string]time.Time)}
+}
+
+func (lt *lockTimes) acquired(fn string) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.m[filepath.Clean(fn)] = time.Now()
+}
+
+// released returns how long fn was held.
+func (lt *lockTimes) released(fn string) (time.Duration, bool) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	fn = filepath.Clean(fn)
+	t, ok := lt.m[fn]
+	delete(lt.m, fn)
+	return time.Since(t), ok
+}
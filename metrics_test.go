@@ -0,0 +1,132 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testMetrics struct {
+	mu        sync.Mutex
+	durations map[string][]time.Duration
+	counts    map[string]int
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{
+		durations: make(map[string][]time.Duration),
+		counts:    make(map[string]int),
+	}
+}
+
+func (m *testMetrics) ObserveDuration(metric, filename string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := metric + ":" + filename
+	m.durations[k] = append(m.durations[k], d)
+}
+
+func (m *testMetrics) Count(metric, filename string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[metric+":"+filename]++
+}
+
+func TestLockMetrics(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestMetrics()
+	s := New(dir, aesEncryptionKey(), WithMetrics(m))
+
+	if err := s.Lock("foo"); err != nil {
+		t.Fatalf("Lock() failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := s.Unlock("foo"); err != nil {
+		t.Fatalf("Unlock() failed: %v", err)
+	}
+	if got := m.durations[MetricLockWait+":foo"]; len(got) != 1 {
+		t.Errorf("lock wait = %v", got)
+	}
+	if got := m.durations[MetricLockHold+":foo"]; len(got) != 1 || got[0] < 100*time.Millisecond {
+		t.Errorf("lock hold = %v", got)
+	}
+
+	// A lock held by a process that doesn't exist is reclaimed.
+	b, err := json.Marshal(lockOwner{PID: math.MaxInt32, Host: hostname(), TS: time.Now()})
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "foo.lock"), b, 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	if err := s.LockWithTimeout("foo", time.Second); err != nil {
+		t.Fatalf("LockWithTimeout() failed: %v", err)
+	}
+	if got := m.counts[MetricStaleLockReclaimed+":foo"]; got != 1 {
+		t.Errorf("stale locks = %d, want 1", got)
+	}
+	if err := s.Unlock("foo"); err != nil {
+		t.Fatalf("Unlock() failed: %v", err)
+	}
+}
+
+func TestLockInfo(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey())
+
+	if info, err := s.LockInfo("foo"); err != nil || info.Locked {
+		t.Errorf("LockInfo() = %+v, %v", info, err)
+	}
+	if err := s.RLock("foo"); err != nil {
+		t.Fatalf("RLock() failed: %v", err)
+	}
+	if info, err := s.LockInfo("foo"); err != nil || info.Locked || info.Readers != 1 {
+		t.Errorf("LockInfo() = %+v, %v", info, err)
+	}
+	if err := s.RUnlock("foo"); err != nil {
+		t.Fatalf("RUnlock() failed: %v", err)
+	}
+	start := time.Now()
+	if err := s.Lock("foo"); err != nil {
+		t.Fatalf("Lock() failed: %v", err)
+	}
+	info, err := s.LockInfo("foo")
+	if err != nil || !info.Locked || info.PID != os.Getpid() || info.Host != hostname() || info.Since.Before(start.Add(-time.Second)) {
+		t.Errorf("LockInfo() = %+v, %v", info, err)
+	}
+	if err := s.Unlock("foo"); err != nil {
+		t.Fatalf("Unlock() failed: %v", err)
+	}
+
+	s = New(t.TempDir(), aesEncryptionKey(), WithLocker(&memLocker{locked: make(map[string]bool)}))
+	if _, err := s.LockInfo("foo"); !errors.Is(err, ErrLockInfoNotSupported) {
+		t.Errorf("LockInfo() = %v, want ErrLockInfoNotSupported", err)
+	}
+}
@@ -0,0 +1,155 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package migrate runs data migrations on an encrypted storage.
+//
+// Migrations are registered in order, each with a unique ID. Run applies the
+// migrations that weren't applied yet, in order. Each migration runs in a
+// storage transaction, along with the update of the list of the applied
+// migrations, so a migration is either fully applied and recorded, or not at
+// all. Concurrent calls to Run, including in other processes, are serialized.
+//
+// Example:
+//
+//	m := migrate.New(s, "migrations")
+//	m.Add("0001-split-users", func(tx *storage.Tx) error {
+//		var old OldUsers
+//		if err := tx.Read("users", &old); err != nil {
+//			return err
+//		}
+//		...
+//		return tx.Delete("users")
+//	})
+//	if _, err := m.Run(); err != nil {
+//		return err
+//	}
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+)
+
+// Migration is a migration.
+type Migration struct {
+	// ID is the unique ID of the migration.
+	ID string
+	// Func applies the migration in tx.
+	Func func(tx *storage.Tx) error
+}
+
+// Applied is a migration that was applied.
+type Applied struct {
+	// ID is the ID of the migration.
+	ID string `json:"id"`
+	// Time is when the migration was applied.
+	Time time.Time `json:"time"`
+}
+
+// Migrator runs migrations.
+type Migrator struct {
+	s          *storage.Storage
+	name       string
+	migrations []Migration
+}
+
+// New returns a Migrator that records the applied migrations in the data file
+// name.
+func New(s *storage.Storage, name string) *Migrator {
+	return &Migrator{s: s, name: name}
+}
+
+// Add registers a migration. The migrations are applied in the order in which
+// they are registered.
+func (m *Migrator) Add(id string, fn func(tx *storage.Tx) error) {
+	m.migrations = append(m.migrations, Migration{ID: id, Func: fn})
+}
+
+// Applied returns the migrations that were applied, in order.
+func (m *Migrator) Applied() ([]Applied, error) {
+	var applied []Applied
+	if err := m.s.ReadDataFile(m.name, &applied); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// Run applies the migrations that weren't applied yet, and returns their IDs.
+// It stops at the first migration that fails.
+func (m *Migrator) Run() ([]string, error) {
+	seen := make(map[string]bool, len(m.migrations))
+	for _, mig := range m.migrations {
+		if mig.ID == "" {
+			return nil, errors.New("empty migration ID")
+		}
+		if seen[mig.ID] {
+			return nil, fmt.Errorf("duplicate migration ID %q", mig.ID)
+		}
+		seen[mig.ID] = true
+	}
+	var ran []string
+	for _, mig := range m.migrations {
+		ok, err := m.apply(mig)
+		if err != nil {
+			return ran, fmt.Errorf("migration %q: %w", mig.ID, err)
+		}
+		if ok {
+			ran = append(ran, mig.ID)
+		}
+	}
+	return ran, nil
+}
+
+// apply applies a migration, unless it was already applied.
+func (m *Migrator) apply(mig Migration) (bool, error) {
+	tx, err := m.s.Begin(m.name)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var applied []Applied
+	if err := tx.Read(m.name, &applied); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	for _, a := range applied {
+		if a.ID == mig.ID {
+			return false, nil
+		}
+	}
+	if err := mig.Func(tx); err != nil {
+		return false, err
+	}
+	applied = append(applied, Applied{ID: mig.ID, Time: time.Now().UTC()})
+	if err := tx.Write(m.name, applied); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	m.s.Logger().Infof("migrate: applied %s", mig.ID)
+	return true, nil
+}
@@ -0,0 +1,151 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package migrate_test
+
+import (
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/internal/storagetest"
+	"github.com/c2FmZQ/storage/migrate"
+)
+
+type user struct {
+	Name  string
+	Email string
+}
+
+func migrations(s *storage.Storage, calls *[]string) *migrate.Migrator {
+	m := migrate.New(s, "migrations")
+	m.Add("1-create", func(tx *storage.Tx) error {
+		*calls = append(*calls, "1-create")
+		return tx.Write("users", []string{"alice", "bob"})
+	})
+	m.Add("2-split", func(tx *storage.Tx) error {
+		*calls = append(*calls, "2-split")
+		var names []string
+		if err := tx.Read("users", &names); err != nil {
+			return err
+		}
+		for _, n := range names {
+			if err := tx.Write("users-"+n, &user{Name: n}); err != nil {
+				return err
+			}
+		}
+		return tx.Delete("users")
+	})
+	return m
+}
+
+func TestRun(t *testing.T) {
+	s := storagetest.New(t)
+	var calls []string
+	ran, err := migrations(s, &calls).Run()
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := []string{"1-create", "2-split"}
+	if !reflect.DeepEqual(ran, want) || !reflect.DeepEqual(calls, want) {
+		t.Errorf("Run() = %v, calls %v, want %v", ran, calls, want)
+	}
+	var u user
+	if err := s.ReadDataFile("users-bob", &u); err != nil || u.Name != "bob" {
+		t.Errorf("ReadDataFile() = %+v, %v", u, err)
+	}
+
+	// Migrations are applied only once.
+	calls = nil
+	m := migrations(s, &calls)
+	m.Add("3-email", func(tx *storage.Tx) error {
+		calls = append(calls, "3-email")
+		var u user
+		if err := tx.Read("users-alice", &u); err != nil {
+			return err
+		}
+		u.Email = "alice@example.com"
+		return tx.Write("users-alice", &u)
+	})
+	if ran, err = m.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if want := []string{"3-email"}; !reflect.DeepEqual(ran, want) || !reflect.DeepEqual(calls, want) {
+		t.Errorf("Run() = %v, calls %v, want %v", ran, calls, want)
+	}
+	applied, err := m.Applied()
+	if err != nil {
+		t.Fatalf("Applied: %v", err)
+	}
+	var ids []string
+	for _, a := range applied {
+		ids = append(ids, a.ID)
+	}
+	if want := []string{"1-create", "2-split", "3-email"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("Applied() = %v, want %v", ids, want)
+	}
+}
+
+func TestFailure(t *testing.T) {
+	s := storagetest.New(t)
+	m := migrate.New(s, "migrations")
+	m.Add("1", func(tx *storage.Tx) error {
+		return tx.Write("foo", "one")
+	})
+	m.Add("2", func(tx *storage.Tx) error {
+		if err := tx.Write("bar", "two"); err != nil {
+			return err
+		}
+		return errors.New("oops")
+	})
+	m.Add("3", func(tx *storage.Tx) error {
+		t.Error("migration 3 called")
+		return nil
+	})
+	ran, err := m.Run()
+	if err == nil {
+		t.Fatal("Run() succeeded")
+	}
+	if !reflect.DeepEqual(ran, []string{"1"}) {
+		t.Errorf("Run() = %v, want [1]", ran)
+	}
+	// The changes of the failed migration are rolled back.
+	var v string
+	if err := s.ReadDataFile("bar", &v); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadDataFile(bar) = %v, want ErrNotExist", err)
+	}
+	if applied, err := m.Applied(); err != nil || len(applied) != 1 {
+		t.Errorf("Applied() = %v, %v", applied, err)
+	}
+}
+
+func TestDuplicateID(t *testing.T) {
+	m := migrate.New(storagetest.New(t), "migrations")
+	m.Add("1", func(tx *storage.Tx) error { return nil })
+	m.Add("1", func(tx *storage.Tx) error { return nil })
+	if _, err := m.Run(); err == nil {
+		t.Error("Run() succeeded with duplicate IDs")
+	}
+}
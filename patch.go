@@ -0,0 +1,384 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// PatchDataFile atomically applies a patch to a JSON encoded file, without
+// needing the go type of the object stored in the file. Data files are GOB
+// encoded by default. Use WithJSONEncoding to create files that can be
+// patched.
+//
+// The patch is either a JSON Patch (RFC 6902), i.e. a JSON array of
+// operations, or a JSON Merge Patch (RFC 7386), i.e. a JSON object.
+//
+// Example:
+//
+//	s.PatchDataFile(filename, []byte(`[{"op":"replace","path":"/foo","value":"bar"}]`))
+//	s.PatchDataFile(filename, []byte(`{"foo":"bar","baz":null}`))
+func (s *Storage) PatchDataFile(filename string, patch []byte) (retErr error) {
+	if err := s.Lock(filename); err != nil {
+		return err
+	}
+	defer func() {
+		if err := s.Unlock(filename); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	rs, err := s.openReadStream(filename)
+	if err != nil {
+		return err
+	}
+	if rs.flags&optEncodingMask != optJSONEncoded {
+		rs.Close()
+		return ErrNotJSON
+	}
+	var doc any
+	dec := json.NewDecoder(rs)
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		rs.Close()
+		return err
+	}
+	if err := rs.Close(); err != nil {
+		return err
+	}
+	if doc, err = applyPatch(doc, patch); err != nil {
+		return err
+	}
+	return s.saveDataFile(filename, doc, optJSONEncoded)
+}
+
+// applyPatch applies a JSON Patch or JSON Merge Patch to doc.
+func applyPatch(doc any, patch []byte) (any, error) {
+	patch = bytes.TrimSpace(patch)
+	dec := json.NewDecoder(bytes.NewReader(patch))
+	dec.UseNumber()
+	if len(patch) > 0 && patch[0] == '[' {
+		var ops []jsonPatchOp
+		if err := dec.Decode(&ops); err != nil {
+			return nil, err
+		}
+		return applyJSONPatch(doc, ops)
+	}
+	var p any
+	if err := dec.Decode(&p); err != nil {
+		return nil, err
+	}
+	return mergePatch(doc, p), nil
+}
+
+// mergePatch implements RFC 7386.
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any)
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
+
+type jsonPatchOp struct {
+	Op    string           `json:"op"`
+	Path  *string          `json:"path"`
+	From  *string          `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch implements RFC 6902. The operations are applied in order. If
+// any of them fails, the whole patch fails.
+func applyJSONPatch(doc any, ops []jsonPatchOp) (any, error) {
+	for i, op := range ops {
+		var err error
+		if doc, err = op.apply(doc); err != nil {
+			return nil, fmt.Errorf("patch operation %d (%s): %w", i, op.Op, err)
+		}
+	}
+	return doc, nil
+}
+
+func (op jsonPatchOp) apply(doc any) (any, error) {
+	if op.Path == nil {
+		return nil, errors.New("missing path")
+	}
+	path, err := parsePointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+	var from []string
+	if op.Op == "move" || op.Op == "copy" {
+		if op.From == nil {
+			return nil, errors.New("missing from")
+		}
+		if from, err = parsePointer(*op.From); err != nil {
+			return nil, err
+		}
+	}
+	var value any
+	if op.Op == "add" || op.Op == "replace" || op.Op == "test" {
+		if op.Value == nil {
+			return nil, errors.New("missing value")
+		}
+		dec := json.NewDecoder(bytes.NewReader(*op.Value))
+		dec.UseNumber()
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return pointerAdd(doc, path, value)
+	case "remove":
+		doc, _, err := pointerRemove(doc, path)
+		return doc, err
+	case "replace":
+		if _, err := pointerGet(doc, path); err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			// The whole document is replaced.
+			return value, nil
+		}
+		if doc, _, err = pointerRemove(doc, path); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "move":
+		if len(path) > len(from) && reflect.DeepEqual(path[:len(from)], from) {
+			return nil, errors.New("cannot move a value into one of its children")
+		}
+		if doc, value, err = pointerRemove(doc, from); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "copy":
+		if value, err = pointerGet(doc, from); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, deepCopy(reflect.ValueOf(&value).Elem()).Interface())
+	case "test":
+		v, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(v, value) {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("unknown operation %q", op.Op)
+	}
+}
+
+// parsePointer parses a JSON Pointer (RFC 6901).
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if p[0] != '/' {
+		return nil, fmt.Errorf("invalid JSON pointer %q", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index. When allowEnd is true, "-" and len(a)
+// are accepted to refer to the end of the array.
+func arrayIndex(a []any, token string, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return len(a), nil
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') || strings.TrimLeft(token, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if max := len(a); i > max || (i == max && !allowEnd) {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+func pointerGet(doc any, path []string) (any, error) {
+	for _, t := range path {
+		switch n := doc.(type) {
+		case map[string]any:
+			v, ok := n[t]
+			if !ok {
+				return nil, fmt.Errorf("%q not found", t)
+			}
+			doc = v
+		case []any:
+			i, err := arrayIndex(n, t, false)
+			if err != nil {
+				return nil, err
+			}
+			doc = n[i]
+		default:
+			return nil, fmt.Errorf("%q not found", t)
+		}
+	}
+	return doc, nil
+}
+
+// pointerUpdate calls fn with the parent of the value at path, and the last
+// token of the path. It returns the updated document.
+func pointerUpdate(doc any, path []string, fn func(parent any, token string) (any, error)) (any, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+	child, err := pointerGet(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = pointerUpdate(child, path[1:], fn); err != nil {
+		return nil, err
+	}
+	switch n := doc.(type) {
+	case map[string]any:
+		n[path[0]] = child
+	case []any:
+		i, _ := arrayIndex(n, path[0], false)
+		n[i] = child
+	}
+	return doc, nil
+}
+
+func pointerAdd(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return pointerUpdate(doc, path, func(parent any, token string) (any, error) {
+		switch n := parent.(type) {
+		case map[string]any:
+			n[token] = value
+			return n, nil
+		case []any:
+			i, err := arrayIndex(n, token, true)
+			if err != nil {
+				return nil, err
+			}
+			return append(n[:i], append([]any{value}, n[i:]...)...), nil
+		default:
+			return nil, fmt.Errorf("cannot add %q to %T", token, parent)
+		}
+	})
+}
+
+func pointerRemove(doc any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("cannot remove the root")
+	}
+	var removed any
+	doc, err := pointerUpdate(doc, path, func(parent any, token string) (any, error) {
+		switch n := parent.(type) {
+		case map[string]any:
+			v, ok := n[token]
+			if !ok {
+				return nil, fmt.Errorf("%q not found", token)
+			}
+			removed = v
+			delete(n, token)
+			return n, nil
+		case []any:
+			i, err := arrayIndex(n, token, false)
+			if err != nil {
+				return nil, err
+			}
+			removed = n[i]
+			return append(n[:i], n[i+1:]...), nil
+		default:
+			return nil, fmt.Errorf("%q not found", token)
+		}
+	})
+	return doc, removed, err
+}
+
+// jsonEqual returns true if a and b are equal JSON values. Numbers are
+// compared by value.
+func jsonEqual(a, b any) bool {
+	switch x := a.(type) {
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if x == y {
+			return true
+		}
+		fx, err1 := x.Float64()
+		fy, err2 := y.Float64()
+		return err1 == nil && err2 == nil && fx == fy
+	case map[string]any:
+		y, ok := b.(map[string]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			w, ok := y[k]
+			if !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		y, ok := b.([]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
@@ -0,0 +1,127 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestApplyPatch(t *testing.T) {
+	testcases := []struct {
+		doc, patch, want string
+		fail             bool
+	}{
+		// RFC 6902 examples.
+		{doc: `{"foo":"bar"}`, patch: `[{"op":"add","path":"/baz","value":"qux"}]`, want: `{"baz":"qux","foo":"bar"}`},
+		{doc: `{"foo":["bar","baz"]}`, patch: `[{"op":"add","path":"/foo/1","value":"qux"}]`, want: `{"foo":["bar","qux","baz"]}`},
+		{doc: `{"baz":"qux","foo":"bar"}`, patch: `[{"op":"remove","path":"/baz"}]`, want: `{"foo":"bar"}`},
+		{doc: `{"foo":["bar","qux","baz"]}`, patch: `[{"op":"remove","path":"/foo/1"}]`, want: `{"foo":["bar","baz"]}`},
+		{doc: `{"baz":"qux","foo":"bar"}`, patch: `[{"op":"replace","path":"/baz","value":"boo"}]`, want: `{"baz":"boo","foo":"bar"}`},
+		{doc: `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, patch: `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, want: `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{doc: `{"foo":["all","grass","cows","eat"]}`, patch: `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, want: `{"foo":["all","cows","eat","grass"]}`},
+		{doc: `{"baz":"qux","foo":["a",2,"c"]}`, patch: `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`, want: `{"baz":"qux","foo":["a",2,"c"]}`},
+		{doc: `{"baz":"qux"}`, patch: `[{"op":"test","path":"/baz","value":"bar"}]`, fail: true},
+		{doc: `{"foo":"bar"}`, patch: `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, want: `{"child":{"grandchild":{}},"foo":"bar"}`},
+		{doc: `{"foo":"bar"}`, patch: `[{"op":"add","path":"/baz/bat","value":"qux"}]`, fail: true},
+		{doc: `{"foo":["bar"]}`, patch: `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, want: `{"foo":["bar",["abc","def"]]}`},
+		{doc: `{"/":9,"~1":10}`, patch: `[{"op":"test","path":"/~01","value":10},{"op":"copy","from":"/~1","path":"/x"}]`, want: `{"/":9,"x":9,"~1":10}`},
+		{doc: `{"foo":[1]}`, patch: `[{"op":"remove","path":"/foo/01"}]`, fail: true},
+		{doc: `{"foo":[1]}`, patch: `[{"op":"replace","path":"/bar","value":1}]`, fail: true},
+		{doc: `{"foo":[1]}`, patch: `[{"op":"replace","path":"","value":{"bar":2}}]`, want: `{"bar":2}`},
+		{doc: `{"foo":{"a":1}}`, patch: `[{"op":"move","from":"/foo","path":"/foo/a/b"}]`, fail: true},
+		// RFC 7386 examples.
+		{doc: `{"a":"b"}`, patch: `{"a":"c"}`, want: `{"a":"c"}`},
+		{doc: `{"a":"b"}`, patch: `{"b":"c"}`, want: `{"a":"b","b":"c"}`},
+		{doc: `{"a":"b"}`, patch: `{"a":null}`, want: `{}`},
+		{doc: `{"a":"b","b":"c"}`, patch: `{"a":null}`, want: `{"b":"c"}`},
+		{doc: `{"a":{"b":"c"}}`, patch: `{"a":{"b":"d","c":null}}`, want: `{"a":{"b":"d"}}`},
+		{doc: `{"a":[{"b":"c"}]}`, patch: `{"a":[1]}`, want: `{"a":[1]}`},
+		{doc: `["a","b"]`, patch: `{"a":"b"}`, want: `{"a":"b"}`},
+		{doc: `{"e":null}`, patch: `{"a":1}`, want: `{"a":1,"e":null}`},
+	}
+	for _, tc := range testcases {
+		var doc any
+		dec := json.NewDecoder(bytes.NewReader([]byte(tc.doc)))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			t.Fatalf("Decode(%s): %v", tc.doc, err)
+		}
+		got, err := applyPatch(doc, []byte(tc.patch))
+		if tc.fail {
+			if err == nil {
+				t.Errorf("applyPatch(%s, %s) didn't fail", tc.doc, tc.patch)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("applyPatch(%s, %s): %v", tc.doc, tc.patch, err)
+			continue
+		}
+		b, _ := json.Marshal(got)
+		if string(b) != tc.want {
+			t.Errorf("applyPatch(%s, %s) = %s, want %s", tc.doc, tc.patch, b, tc.want)
+		}
+	}
+}
+
+func TestPatchDataFile(t *testing.T) {
+	dir, mk := t.TempDir(), aesEncryptionKey()
+	s := New(dir, mk, WithJSONEncoding())
+
+	type Foo struct {
+		A string         `json:"a"`
+		B int64          `json:"b"`
+		M map[string]int `json:"m"`
+	}
+	if err := s.SaveDataFile("foo", Foo{A: "x", B: 1 << 60, M: map[string]int{"y": 1}}); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	if err := s.PatchDataFile("foo", []byte(`[{"op":"replace","path":"/a","value":"z"},{"op":"add","path":"/m/w","value":2}]`)); err != nil {
+		t.Fatalf("s.PatchDataFile: %v", err)
+	}
+	if err := s.PatchDataFile("foo", []byte(`{"m":{"y":null}}`)); err != nil {
+		t.Fatalf("s.PatchDataFile: %v", err)
+	}
+	var got Foo
+	if err := s.ReadDataFile("foo", &got); err != nil {
+		t.Fatalf("s.ReadDataFile: %v", err)
+	}
+	if got.A != "z" || got.B != 1<<60 || len(got.M) != 1 || got.M["w"] != 2 {
+		t.Errorf("Unexpected result: %+v", got)
+	}
+	if err := s.PatchDataFile("foo", []byte(`[{"op":"test","path":"/a","value":"x"}]`)); err == nil {
+		t.Error("s.PatchDataFile should have failed")
+	}
+
+	// GOB encoded files can't be patched.
+	s = New(dir, mk)
+	if err := s.SaveDataFile("bar", Foo{}); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	if err := s.PatchDataFile("bar", []byte(`{"a":"b"}`)); err != ErrNotJSON {
+		t.Errorf("s.PatchDataFile() = %v, want ErrNotJSON", err)
+	}
+}
@@ -0,0 +1,156 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"io"
+)
+
+// progressChunkSize is the granularity of progress reports. It is the same as
+// the size of the encrypted chunks.
+const progressChunkSize = 1 << 20
+
+// Progress reports the progress of a blob read or write.
+type Progress struct {
+	// The number of bytes of blob content read or written so far.
+	Bytes int64
+	// The number of complete chunks read or written so far.
+	Chunks int64
+	// Done is true when the blob was read until EOF, or closed.
+	Done bool
+}
+
+// BlobOption is used to specify optional parameters of blob readers and
+// writers.
+type BlobOption func(*blobOption)
+
+type blobOption struct {
+	progress func(Progress)
+}
+
+func (o *blobOption) apply(opts []BlobOption) {
+	for _, opt := range opts {
+		opt(o)
+	}
+}
+
+// WithProgress specifies a function that is called with the progress of a
+// blob read or write, every time a chunk is completed, and at the end.
+func WithProgress(fn func(Progress)) BlobOption {
+	return func(opt *blobOption) {
+		opt.progress = fn
+	}
+}
+
+// progressCounter counts the bytes transferred and reports progress.
+type progressCounter struct {
+	fn func(Progress)
+	p  Progress
+}
+
+func (c *progressCounter) add(n int) {
+	c.p.Bytes += int64(n)
+	if chunks := c.p.Bytes / progressChunkSize; chunks != c.p.Chunks {
+		c.p.Chunks = chunks
+		c.fn(c.p)
+	}
+}
+
+func (c *progressCounter) done() {
+	if !c.p.Done {
+		c.p.Done = true
+		c.fn(c.p)
+	}
+}
+
+// progressWriter reports the progress of a blob write.
+type progressWriter struct {
+	io.WriteCloser
+	c progressCounter
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.WriteCloser.Write(b)
+	w.c.add(n)
+	return n, err
+}
+
+func (w *progressWriter) Close() error {
+	err := w.WriteCloser.Close()
+	w.c.done()
+	return err
+}
+
+// progressReader reports the progress of a blob read.
+type progressReader struct {
+	io.ReadSeekCloser
+	c progressCounter
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.ReadSeekCloser.Read(b)
+	r.c.add(n)
+	if err == io.EOF {
+		r.c.done()
+	}
+	return n, err
+}
+
+func (r *progressReader) Close() error {
+	err := r.ReadSeekCloser.Close()
+	r.c.done()
+	return err
+}
+
+// withWriteProgress adds progress reporting to w, if requested in opts.
+func withWriteProgress(w io.WriteCloser, opts []BlobOption) io.WriteCloser {
+	var opt blobOption
+	opt.apply(opts)
+	if opt.progress == nil {
+		return w
+	}
+	return &progressWriter{WriteCloser: w, c: progressCounter{fn: opt.progress}}
+}
+
+// withReadProgress adds progress reporting to r, if requested in opts.
+func withReadProgress(r io.ReadSeekCloser, opts []BlobOption) io.ReadSeekCloser {
+	var opt blobOption
+	opt.apply(opts)
+	if opt.progress == nil {
+		return r
+	}
+	return &progressReader{ReadSeekCloser: r, c: progressCounter{fn: opt.progress}}
+}
+
+// TrackReadProgress adds the progress reporting requested in opts to a blob
+// reader. It is only needed by implementations of OpenBlobRead outside of
+// this package, e.g. remote clients.
+func TrackReadProgress(r io.ReadSeekCloser, opts ...BlobOption) io.ReadSeekCloser {
+	return withReadProgress(r, opts)
+}
+
+// TrackWriteProgress is like TrackReadProgress, but for blob writers.
+func TrackWriteProgress(w io.WriteCloser, opts ...BlobOption) io.WriteCloser {
+	return withWriteProgress(w, opts)
+}
@@ -0,0 +1,77 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestBlobProgress(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, aesEncryptionKey())
+	content := make([]byte, 2*progressChunkSize+100)
+
+	var got []Progress
+	w, err := s.CreateBlob("blob", WithProgress(func(p Progress) {
+		got = append(got, p)
+	}))
+	if err != nil {
+		t.Fatalf("s.CreateBlob: %v", err)
+	}
+	for i := 0; i < len(content); i += 1000 {
+		if _, err := w.Write(content[i:min(i+1000, len(content))]); err != nil {
+			t.Fatalf("w.Write: %v", err)
+		}
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("w.Commit: %v", err)
+	}
+	want := []Progress{
+		{Bytes: progressChunkSize + 424, Chunks: 1},
+		{Bytes: int64(len(content)), Chunks: 2},
+		{Bytes: int64(len(content)), Chunks: 2, Done: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected write progress. Got %+v, want %+v", got, want)
+	}
+
+	got = nil
+	r, err := s.OpenBlobRead("blob", WithProgress(func(p Progress) {
+		got = append(got, p)
+	}))
+	if err != nil {
+		t.Fatalf("s.OpenBlobRead: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatalf("io.Copy: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("r.Close: %v", err)
+	}
+	if n := len(got); n < 3 || got[n-1] != (Progress{Bytes: int64(len(content)), Chunks: 2, Done: true}) {
+		t.Errorf("Unexpected read progress: %+v", got)
+	}
+}
@@ -0,0 +1,425 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package queue is a persistent work queue, on top of an encrypted storage.
+//
+// The messages are appended to an encrypted record file when they are
+// enqueued, and an acknowledgment is appended when they are processed. The
+// delivery is at-least-once: a message that is dequeued is delivered again if
+// it isn't acknowledged before its visibility timeout, or if the process dies
+// before it is acknowledged.
+//
+// The record file is compacted when most of its messages are acknowledged.
+//
+// Example:
+//
+//	q, err := queue.Open(s, "jobs")
+//	if err != nil {
+//		return err
+//	}
+//	defer q.Close()
+//	if _, err := q.Enqueue(job); err != nil {
+//		return err
+//	}
+//	...
+//	m, err := q.Dequeue(ctx)
+//	if err != nil {
+//		return err
+//	}
+//	if err := process(m.Data); err != nil {
+//		return q.Nack(m.ID)
+//	}
+//	return q.Ack(m.ID)
+package queue
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+)
+
+var (
+	// ErrClosed is returned when the queue is closed.
+	ErrClosed = errors.New("queue is closed")
+	// ErrLocked is returned by Open when the queue is already open.
+	ErrLocked = errors.New("queue is already open")
+	// ErrNotInFlight is returned by Ack and Nack when the message isn't
+	// being delivered.
+	ErrNotInFlight = errors.New("message isn't in flight")
+)
+
+const (
+	// defaultVisibilityTimeout is the default time after which a message
+	// that isn't acknowledged is delivered again.
+	defaultVisibilityTimeout = 30 * time.Second
+	// compactThreshold is the minimum number of acknowledged messages in
+	// the record file before it is compacted.
+	compactThreshold = 1000
+
+	headFile = "head"
+	logFile  = "log-"
+	lockFile = "queue"
+)
+
+// Option is used to specify optional parameters of Open.
+type Option func(*Queue)
+
+// WithVisibilityTimeout specifies the time after which a message that was
+// dequeued, but not acknowledged, is delivered again. The default is 30
+// seconds.
+func WithVisibilityTimeout(d time.Duration) Option {
+	return func(q *Queue) {
+		q.timeout = d
+	}
+}
+
+// Message is a message of the queue.
+type Message struct {
+	// ID is the unique ID of the message. IDs are increasing.
+	ID uint64
+	// Data is the content of the message.
+	Data []byte
+	// Attempts is the number of times the message was delivered since the
+	// queue was opened, including this one.
+	Attempts int
+}
+
+// entry is a record of the log file.
+type entry struct {
+	ID   uint64 `json:"id"`
+	Data []byte `json:"data,omitempty"`
+	Ack  bool   `json:"ack,omitempty"`
+}
+
+// head is the content of the head file. It points to the current log file.
+type head struct {
+	Gen    int    `json:"gen"`
+	NextID uint64 `json:"nextId"`
+}
+
+// inFlight is a message that was dequeued.
+type inFlight struct {
+	m        *Message
+	deadline time.Time
+}
+
+// Queue is a persistent queue. It is safe for concurrent use.
+type Queue struct {
+	s       *storage.Storage
+	dir     string
+	timeout time.Duration
+
+	mu       sync.Mutex
+	closed   bool
+	head     head
+	ready    messageHeap
+	inFlight map[uint64]*inFlight
+	// acked is the number of acknowledged messages in the log file.
+	acked int
+	// changed is closed, and replaced, when a message becomes ready.
+	changed chan struct{}
+}
+
+// Open opens the queue in dir. Only one Queue can have the queue open at a
+// time, including in other processes.
+func Open(s *storage.Storage, dir string, opts ...Option) (*Queue, error) {
+	q := &Queue{
+		s:        s,
+		dir:      dir,
+		timeout:  defaultVisibilityTimeout,
+		inFlight: make(map[uint64]*inFlight),
+		changed:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	if err := s.MkdirAll(dir); err != nil {
+		return nil, err
+	}
+	ok, err := s.TryLock(q.lockName())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrLocked
+	}
+	if err := q.load(); err != nil {
+		s.Unlock(q.lockName())
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *Queue) lockName() string {
+	return filepath.Join(q.dir, lockFile)
+}
+
+func (q *Queue) logName(gen int) string {
+	return filepath.Join(q.dir, logFile+strconv.Itoa(gen))
+}
+
+// load reads the log file, and deletes the log files that were left behind
+// by an interrupted compaction.
+func (q *Queue) load() error {
+	if err := q.s.ReadDataFile(filepath.Join(q.dir, headFile), &q.head); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if q.head.NextID == 0 {
+		q.head.NextID = 1
+	}
+	messages := make(map[uint64]*Message)
+	err := q.s.ReadRecords(q.logName(q.head.Gen), func(decode func(any) error) error {
+		var e entry
+		if err := decode(&e); err != nil {
+			return err
+		}
+		if e.Ack {
+			delete(messages, e.ID)
+			q.acked++
+			return nil
+		}
+		messages[e.ID] = &Message{ID: e.ID, Data: e.Data}
+		q.head.NextID = max(q.head.NextID, e.ID+1)
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, m := range messages {
+		q.ready = append(q.ready, m)
+	}
+	heap.Init(&q.ready)
+
+	entries, err := q.s.FS().ReadDir(filepath.ToSlash(q.dir))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if gen, ok := strings.CutPrefix(e.Name(), logFile); ok && gen != strconv.Itoa(q.head.Gen) {
+			if err := q.s.DeleteFile(filepath.Join(q.dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes the queue. The messages that are in flight are delivered
+// again when the queue is opened again.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	close(q.changed)
+	return q.s.Unlock(q.lockName())
+}
+
+// Len returns the number of messages that aren't acknowledged, including the
+// ones that are in flight.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.ready) + len(q.inFlight)
+}
+
+// Enqueue adds a message to the queue, and returns its ID. The message is
+// persisted when Enqueue returns.
+func (q *Queue) Enqueue(data []byte) (uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return 0, ErrClosed
+	}
+	m := &Message{ID: q.head.NextID, Data: append([]byte(nil), data...)}
+	if err := q.s.AppendRecord(q.logName(q.head.Gen), &entry{ID: m.ID, Data: m.Data}); err != nil {
+		return 0, err
+	}
+	q.head.NextID++
+	heap.Push(&q.ready, m)
+	q.notify()
+	return m.ID, nil
+}
+
+// notify wakes up the callers of Dequeue.
+func (q *Queue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// Dequeue returns the oldest message that is ready, waiting until there is
+// one, or ctx is done. The message must be acknowledged with Ack before the
+// visibility timeout, or it is delivered again.
+func (q *Queue) Dequeue(ctx context.Context) (*Message, error) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return nil, ErrClosed
+		}
+		next := q.requeueExpired(time.Now())
+		if len(q.ready) > 0 {
+			m := heap.Pop(&q.ready).(*Message)
+			m.Attempts++
+			q.inFlight[m.ID] = &inFlight{m: m, deadline: time.Now().Add(q.timeout)}
+			q.mu.Unlock()
+			c := *m
+			c.Data = append([]byte(nil), m.Data...)
+			return &c, nil
+		}
+		changed := q.changed
+		q.mu.Unlock()
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			expired = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-changed:
+		case <-expired:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// requeueExpired makes the messages whose visibility timeout expired ready
+// again. It returns the next deadline of the messages in flight.
+func (q *Queue) requeueExpired(now time.Time) (next time.Time) {
+	for id, f := range q.inFlight {
+		if !now.Before(f.deadline) {
+			delete(q.inFlight, id)
+			heap.Push(&q.ready, f.m)
+			continue
+		}
+		if next.IsZero() || f.deadline.Before(next) {
+			next = f.deadline
+		}
+	}
+	return next
+}
+
+// Ack acknowledges a message that was dequeued. It isn't delivered again.
+func (q *Queue) Ack(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	if _, ok := q.inFlight[id]; !ok {
+		return ErrNotInFlight
+	}
+	if err := q.s.AppendRecord(q.logName(q.head.Gen), &entry{ID: id, Ack: true}); err != nil {
+		return err
+	}
+	delete(q.inFlight, id)
+	q.acked++
+	if live := len(q.ready) + len(q.inFlight); q.acked >= compactThreshold && q.acked > 2*live {
+		if err := q.compact(); err != nil {
+			q.s.Logger().Errorf("queue: compact %s: %v", q.dir, err)
+		}
+	}
+	return nil
+}
+
+// Nack returns a message that was dequeued to the queue, to be delivered
+// again immediately.
+func (q *Queue) Nack(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	f, ok := q.inFlight[id]
+	if !ok {
+		return ErrNotInFlight
+	}
+	delete(q.inFlight, id)
+	heap.Push(&q.ready, f.m)
+	q.notify()
+	return nil
+}
+
+// compact writes the messages that aren't acknowledged to a new log file,
+// and switches to it. If the process dies in the middle, the old log file
+// is still used, and the new one is deleted by the next Open.
+func (q *Queue) compact() error {
+	h := head{Gen: q.head.Gen + 1, NextID: q.head.NextID}
+	live := make(messageHeap, 0, len(q.ready)+len(q.inFlight))
+	live = append(live, q.ready...)
+	for _, f := range q.inFlight {
+		live = append(live, f.m)
+	}
+	heap.Init(&live)
+	newLog := q.logName(h.Gen)
+	for len(live) > 0 {
+		m := heap.Pop(&live).(*Message)
+		if err := q.s.AppendRecord(newLog, &entry{ID: m.ID, Data: m.Data}); err != nil {
+			q.s.DeleteFile(newLog)
+			return err
+		}
+	}
+	if err := q.s.SaveDataFile(filepath.Join(q.dir, headFile), &h); err != nil {
+		q.s.DeleteFile(newLog)
+		return err
+	}
+	oldLog := q.logName(q.head.Gen)
+	q.head = h
+	q.acked = 0
+	if err := q.s.DeleteFile(oldLog); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("delete %s: %w", oldLog, err)
+	}
+	return nil
+}
+
+// messageHeap is a min-heap of messages, ordered by ID.
+type messageHeap []*Message
+
+func (h messageHeap) Len() int           { return len(h) }
+func (h messageHeap) Less(i, j int) bool { return h[i].ID < h[j].ID }
+func (h messageHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *messageHeap) Push(x any)        { *h = append(*h, x.(*Message)) }
+func (h *messageHeap) Pop() any {
+	old := *h
+	m := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return m
+}
@@ -0,0 +1,208 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/internal/storagetest"
+	"github.com/c2FmZQ/storage/queue"
+)
+
+func open(t *testing.T, s *storage.Storage, opts ...queue.Option) *queue.Queue {
+	t.Helper()
+	q, err := queue.Open(s, "q", opts...)
+	if err != nil {
+		t.Fatalf("queue.Open: %v", err)
+	}
+	return q
+}
+
+func dequeue(t *testing.T, q *queue.Queue) *queue.Message {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m, err := q.Dequeue(ctx)
+	if err != nil {
+		t.Fatalf("Dequeue: %v", err)
+	}
+	return m
+}
+
+func TestQueue(t *testing.T) {
+	s := storagetest.New(t)
+	q := open(t, s)
+	for i := 0; i < 3; i++ {
+		if _, err := q.Enqueue([]byte(fmt.Sprintf("msg %d", i))); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+	if _, err := queue.Open(s, "q"); !errors.Is(err, queue.ErrLocked) {
+		t.Errorf("Open = %v, want ErrLocked", err)
+	}
+
+	m0, m1 := dequeue(t, q), dequeue(t, q)
+	if string(m0.Data) != "msg 0" || string(m1.Data) != "msg 1" || m0.Attempts != 1 {
+		t.Fatalf("Dequeue = %+v, %+v", m0, m1)
+	}
+	if err := q.Ack(m0.ID); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if err := q.Ack(m0.ID); !errors.Is(err, queue.ErrNotInFlight) {
+		t.Errorf("Ack = %v, want ErrNotInFlight", err)
+	}
+	// A message that is nacked is delivered again, in order.
+	if err := q.Nack(m1.ID); err != nil {
+		t.Fatalf("Nack: %v", err)
+	}
+	if m := dequeue(t, q); m.ID != m1.ID || m.Attempts != 2 {
+		t.Errorf("Dequeue = %+v, want %d", m, m1.ID)
+	}
+	if n := q.Len(); n != 2 {
+		t.Errorf("Len = %d, want 2", n)
+	}
+
+	// The messages that weren't acknowledged are delivered again after
+	// the queue is opened again.
+	if err := q.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := q.Enqueue(nil); !errors.Is(err, queue.ErrClosed) {
+		t.Errorf("Enqueue = %v, want ErrClosed", err)
+	}
+	q = open(t, s)
+	defer q.Close()
+	if n := q.Len(); n != 2 {
+		t.Errorf("Len = %d, want 2", n)
+	}
+	for _, want := range []string{"msg 1", "msg 2"} {
+		m := dequeue(t, q)
+		if string(m.Data) != want || m.Attempts != 1 {
+			t.Errorf("Dequeue = %+v, want %q", m, want)
+		}
+		if err := q.Ack(m.ID); err != nil {
+			t.Fatalf("Ack: %v", err)
+		}
+	}
+	id, err := q.Enqueue([]byte("new"))
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	if id != 4 {
+		t.Errorf("ID = %d, want 4", id)
+	}
+}
+
+func TestVisibilityTimeout(t *testing.T) {
+	q := open(t, storagetest.New(t), queue.WithVisibilityTimeout(50*time.Millisecond))
+	defer q.Close()
+	if _, err := q.Enqueue([]byte("foo")); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	m := dequeue(t, q)
+	start := time.Now()
+	// Dequeue waits for the visibility timeout.
+	if m2 := dequeue(t, q); m2.ID != m.ID || m2.Attempts != 2 {
+		t.Errorf("Dequeue = %+v", m2)
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("Message was delivered again after %s", d)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.Ack(m.ID); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if _, err := q.Dequeue(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Dequeue = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestWaitForEnqueue(t *testing.T) {
+	q := open(t, storagetest.New(t))
+	defer q.Close()
+	ch := make(chan *queue.Message)
+	go func() {
+		m, err := q.Dequeue(context.Background())
+		if err != nil {
+			t.Errorf("Dequeue: %v", err)
+		}
+		ch <- m
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := q.Enqueue([]byte("foo")); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	if m := <-ch; m == nil || string(m.Data) != "foo" {
+		t.Errorf("Dequeue = %+v", m)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	s := storagetest.New(t)
+	q := open(t, s)
+	for i := 0; i < 1100; i++ {
+		if _, err := q.Enqueue([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+		if i < 1050 {
+			if err := q.Ack(dequeue(t, q).ID); err != nil {
+				t.Fatalf("Ack: %v", err)
+			}
+		}
+	}
+	q.Close()
+
+	logs, err := filepath.Glob(filepath.Join(s.Dir(), "q", "log-*"))
+	if err != nil || len(logs) != 1 || filepath.Base(logs[0]) == "log-0" {
+		t.Fatalf("Log files = %v, %v", logs, err)
+	}
+	fi, err := os.Stat(logs[0])
+	if err != nil {
+		t.Fatalf("os.Stat: %v", err)
+	}
+	if fi.Size() > 64*1024 {
+		t.Errorf("Log file is %d bytes", fi.Size())
+	}
+
+	q = open(t, s)
+	defer q.Close()
+	if n := q.Len(); n != 50 {
+		t.Errorf("Len = %d, want 50", n)
+	}
+	if m := dequeue(t, q); string(m.Data) != "1050" {
+		t.Errorf("Dequeue = %q, want 1050", m.Data)
+	}
+	if id, err := q.Enqueue(nil); err != nil || id != 1101 {
+		t.Errorf("Enqueue = %d, %v, want 1101", id, err)
+	}
+}
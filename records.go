@@ -0,0 +1,456 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+const (
+	// optRecords indicates that the file contains a sequence of records.
+	optRecords = 0x05
+
+	// The maximum size of one record.
+	maxRecordSize = 64 << 20
+)
+
+// ErrCorruptRecord indicates that a record file is corrupt.
+var ErrCorruptRecord = errors.New("corrupt record")
+
+// Record files contain a header, followed by the encrypted file key (if
+// encrypted), followed by records. Each record is:
+//
+//	size (uint32) | payload (size bytes) | size (uint32)
+//
+// The payload is encrypted with the file key. The plaintext payload is:
+//
+//	sequence number (uint64) | encoding (uint8) | encoded object | crc32 (uint32)
+//
+// The size is repeated at the end of the record so that the last record can
+// be found without reading the whole file. The sequence number detects
+// records that are removed or reordered in the middle of the file. Records
+// truncated at the end of the file, e.g. after a crash, are ignored and
+// removed by the next append.
+
+type recordFile struct {
+	s        *Storage
+	f        File
+	filename string
+	k        crypto.EncryptionKey
+	start    int64
+	size     int64
+}
+
+// AppendRecord appends obj to filename, without rewriting the existing
+// records. The file is created if it doesn't exist.
+func (s *Storage) AppendRecord(filename string, obj interface{}) (retErr error) {
+	if err := s.Lock(filename); err != nil {
+		return err
+	}
+	defer func() {
+		if err := s.Unlock(filename); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	rf, err := s.openRecordFile(filename, true)
+	if err != nil {
+		return err
+	}
+	defer rf.close()
+
+	end, seq, err := rf.tail()
+	if err != nil {
+		return err
+	}
+	if end != rf.size {
+		s.Logger().Infof("Truncating partial record in %s at %d", filename, end)
+		if err := rf.f.Truncate(end); err != nil {
+			return err
+		}
+	}
+	payload, err := rf.encode(seq+1, obj)
+	if err != nil {
+		return err
+	}
+	rec := make([]byte, 0, len(payload)+8)
+	rec = binary.BigEndian.AppendUint32(rec, uint32(len(payload)))
+	rec = append(rec, payload...)
+	rec = binary.BigEndian.AppendUint32(rec, uint32(len(payload)))
+	if _, err := rf.f.WriteAt(rec, end); err != nil {
+		return err
+	}
+	if s.durability != DurabilityNone {
+		return rf.f.Sync()
+	}
+	return nil
+}
+
+// ReadRecords reads all the records in filename, in order. fn is called for
+// each record with a function that decodes the record into an object.
+//
+// Example:
+//
+//	err := s.ReadRecords(filename, func(decode func(interface{}) error) error {
+//	  var e Event
+//	  if err := decode(&e); err != nil {
+//	    return err
+//	  }
+//	  // use e
+//	  return nil
+//	})
+//
+// If fn returns an error, ReadRecords stops and returns that error.
+func (s *Storage) ReadRecords(filename string, fn func(decode func(obj interface{}) error) error) error {
+	rf, err := s.openRecordFile(filename, false)
+	if err != nil {
+		return err
+	}
+	defer rf.close()
+	_, err = rf.scan(func(_ uint64, data []byte) error {
+		return fn(func(obj interface{}) error {
+			return rf.decode(data, obj)
+		})
+	})
+	return err
+}
+
+func (s *Storage) openRecordFile(filename string, create bool) (retRF *recordFile, retErr error) {
+	fn := filepath.Join(s.dir, filename)
+	rf := &recordFile{s: s, filename: filename}
+	var err error
+	if rf.f, err = s.backend.OpenFile(fn, os.O_RDWR, 0600); errors.Is(err, os.ErrNotExist) && create {
+		err = s.createKeyedFile(fn, optRecords, nil)
+		if err == nil || errors.Is(err, os.ErrExist) {
+			rf.f, err = s.backend.OpenFile(fn, os.O_RDWR, 0600)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			rf.close()
+		}
+	}()
+
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(rf.f, hdr); err != nil {
+		return nil, err
+	}
+	if string(hdr[:4]) != "KRIN" {
+		return nil, errors.New("wrong file type")
+	}
+	flags := hdr[4]
+	if flags&optEncodingMask != optRecords {
+		return nil, errors.New("not a record file")
+	}
+	if flags&optEncrypted != 0 {
+		if s.masterKey == nil {
+			return nil, errors.New("file is encrypted, but a master key was not provided")
+		}
+		if rf.k, err = s.masterKey.ReadEncryptedKey(rf.f); err != nil {
+			return nil, err
+		}
+	}
+	if rf.start, err = rf.f.Seek(0, io.SeekCurrent); err != nil {
+		return nil, err
+	}
+	fi, err := rf.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	rf.size = fi.Size()
+	return rf, nil
+}
+
+// createKeyedFile atomically creates a file that contains a header with
+// encoding enc, and a new encrypted file key. When the file is encrypted and
+// init isn't nil, init writes the initial content with the file key.
+func (s *Storage) createKeyedFile(fn string, enc byte, init func(k crypto.EncryptionKey, w io.Writer) error) error {
+	if err := createParentIfNotExist(s.backend, fn); err != nil {
+		return err
+	}
+	flags := enc
+	if s.masterKey != nil {
+		flags |= optEncrypted
+	}
+	var buf bytes.Buffer
+	buf.Write([]byte{'K', 'R', 'I', 'N', flags})
+	if s.masterKey != nil {
+		k, err := s.masterKey.NewKey()
+		if err != nil {
+			return err
+		}
+		defer k.Wipe()
+		if err := k.WriteEncryptedKey(&buf); err != nil {
+			return err
+		}
+		if init != nil {
+			if err := init(k, &buf); err != nil {
+				return err
+			}
+		}
+	}
+	t := fmt.Sprintf("%s.tmp-%d", fn, time.Now().UnixNano())
+	f, err := s.openFile(t)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		s.backend.Remove(t)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		s.backend.Remove(t)
+		return err
+	}
+	// Don't replace the file if it was created concurrently.
+	if err := s.backend.Link(t, fn); err != nil {
+		s.backend.Remove(t)
+		return err
+	}
+	s.backend.Remove(t)
+	return s.syncDir(filepath.Dir(fn))
+}
+
+func (rf *recordFile) close() {
+	if rf.k != nil {
+		rf.k.Wipe()
+	}
+	rf.f.Close()
+}
+
+func (rf *recordFile) encode(seq uint64, obj interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, seq)
+	enc := rf.s.encodingOf(obj)
+	buf.WriteByte(enc)
+	switch enc {
+	case optGOBEncoded:
+		if err := gob.NewEncoder(&buf).Encode(obj); err != nil {
+			return nil, err
+		}
+	case optJSONEncoded:
+		if err := json.NewEncoder(&buf).Encode(obj); err != nil {
+			return nil, err
+		}
+	default:
+		b, err := encodeBytes(obj)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+	}
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	if buf.Len() > maxRecordSize {
+		return nil, fmt.Errorf("record too large: %d", buf.Len())
+	}
+	if rf.k == nil {
+		return buf.Bytes(), nil
+	}
+	return rf.k.Encrypt(buf.Bytes())
+}
+
+func (rf *recordFile) decode(data []byte, obj interface{}) error {
+	enc, data := data[0], data[1:]
+	switch enc {
+	case optGOBEncoded:
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(obj)
+	case optJSONEncoded:
+		return json.NewDecoder(bytes.NewReader(data)).Decode(obj)
+	default:
+		return decodeBytes(enc, data, obj)
+	}
+}
+
+// open decrypts and verifies a record's payload. It returns the sequence
+// number and the encoded object (starting with the encoding byte).
+func (rf *recordFile) open(payload []byte) (uint64, []byte, error) {
+	if rf.k != nil {
+		var err error
+		if payload, err = rf.k.Decrypt(payload); err != nil {
+			return 0, nil, err
+		}
+	}
+	if len(payload) < 13 {
+		return 0, nil, ErrCorruptRecord
+	}
+	data, sum := payload[:len(payload)-4], payload[len(payload)-4:]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(sum) {
+		return 0, nil, ErrCorruptRecord
+	}
+	return binary.BigEndian.Uint64(data[:8]), data[8:], nil
+}
+
+// readAt reads the record at offset off.
+func (rf *recordFile) readAt(off int64) (size int64, seq uint64, data []byte, err error) {
+	var sz [4]byte
+	if _, err := rf.f.ReadAt(sz[:], off); err != nil {
+		return 0, 0, nil, ErrCorruptRecord
+	}
+	n := int64(binary.BigEndian.Uint32(sz[:]))
+	if n > maxRecordSize*2 || off+n+8 > rf.size {
+		return 0, 0, nil, ErrCorruptRecord
+	}
+	buf := make([]byte, n+4)
+	if _, err := rf.f.ReadAt(buf, off+4); err != nil {
+		return 0, 0, nil, ErrCorruptRecord
+	}
+	if binary.BigEndian.Uint32(buf[n:]) != uint32(n) {
+		return 0, 0, nil, ErrCorruptRecord
+	}
+	if seq, data, err = rf.open(buf[:n]); err != nil {
+		return 0, 0, nil, ErrCorruptRecord
+	}
+	return n + 8, seq, data, nil
+}
+
+// scan reads all the records, starting at the beginning of the file. It
+// returns the offset of the end of the last valid record. An invalid record
+// at the end of the file is a partial write and is ignored. An invalid record
+// anywhere else is an error.
+func (rf *recordFile) scan(fn func(seq uint64, data []byte) error) (int64, error) {
+	off := rf.start
+	var want uint64 = 1
+	for off < rf.size {
+		size, seq, data, err := rf.readAt(off)
+		if err != nil {
+			if rf.isTail(off) {
+				break
+			}
+			return 0, fmt.Errorf("%s at offset %d: %w", rf.filename, off, err)
+		}
+		if seq != want {
+			return 0, fmt.Errorf("%s at offset %d: unexpected sequence number %d: %w", rf.filename, off, seq, ErrCorruptRecord)
+		}
+		want++
+		if fn != nil {
+			if err := fn(seq, data); err != nil {
+				return 0, err
+			}
+		}
+		off += size
+	}
+	return off, nil
+}
+
+// isTail returns true if the invalid record at off extends to the end of
+// the file, i.e. it is the last record and it was only partially written.
+// A corrupt size could make any record look like it extends to the end of the
+// file, so a valid record after off also means that off isn't the tail.
+func (rf *recordFile) isTail(off int64) bool {
+	var sz [4]byte
+	if _, err := rf.f.ReadAt(sz[:], off); err != nil {
+		return true
+	}
+	if off+int64(binary.BigEndian.Uint32(sz[:]))+8 < rf.size {
+		return false
+	}
+	if _, err := rf.f.ReadAt(sz[:], rf.size-4); err != nil {
+		return true
+	}
+	if last := rf.size - 8 - int64(binary.BigEndian.Uint32(sz[:])); last > off {
+		if _, _, _, err := rf.readAt(last); err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// tail returns the offset of the end of the last valid record, and its
+// sequence number. The last record is found using the size at the end of the
+// file. If the end of the file isn't a valid record, the whole file is
+// scanned.
+func (rf *recordFile) tail() (int64, uint64, error) {
+	if rf.size == rf.start {
+		return rf.start, 0, nil
+	}
+	var sz [4]byte
+	if rf.size-rf.start >= 8 {
+		if _, err := rf.f.ReadAt(sz[:], rf.size-4); err != nil {
+			return 0, 0, err
+		}
+		if off := rf.size - 8 - int64(binary.BigEndian.Uint32(sz[:])); off >= rf.start {
+			if _, seq, _, err := rf.readAt(off); err == nil {
+				return rf.size, seq, nil
+			}
+		}
+	}
+	var last uint64
+	end, err := rf.scan(func(seq uint64, _ []byte) error {
+		last = seq
+		return nil
+	})
+	return end, last, err
+}
+
+// encodeBytes encodes obj with optBinaryEncoded or optRawBytes.
+func encodeBytes(obj interface{}) ([]byte, error) {
+	switch v := obj.(type) {
+	case encoding.BinaryMarshaler:
+		return v.MarshalBinary()
+	case *[]byte:
+		if v == nil {
+			return nil, nil
+		}
+		return *v, nil
+	default:
+		return nil, fmt.Errorf("unexpected object type %T", obj)
+	}
+}
+
+// decodeBytes decodes data encoded with encodeBytes.
+func decodeBytes(enc byte, data []byte, obj interface{}) error {
+	switch enc {
+	case optBinaryEncoded:
+		u, ok := obj.(encoding.BinaryUnmarshaler)
+		if !ok {
+			return fmt.Errorf("obj doesn't implement encoding.BinaryUnmarshaler: %T", obj)
+		}
+		return u.UnmarshalBinary(data)
+	case optRawBytes:
+		b, ok := obj.(*[]byte)
+		if !ok {
+			return fmt.Errorf("obj isn't *[]byte: %T", obj)
+		}
+		*b = append(*b, data...)
+		return nil
+	default:
+		return fmt.Errorf("unexpected encoding %x", enc)
+	}
+}
@@ -0,0 +1,181 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+func readAllRecords(t *testing.T, s *Storage, filename string) ([]int, error) {
+	var got []int
+	err := s.ReadRecords(filename, func(decode func(interface{}) error) error {
+		var v int
+		if err := decode(&v); err != nil {
+			return err
+		}
+		got = append(got, v)
+		return nil
+	})
+	return got, err
+}
+
+func TestRecords(t *testing.T) {
+	testcases := []struct {
+		name string
+		mk   crypto.EncryptionKey
+	}{
+		{"AES", aesEncryptionKey()},
+		{"Chacha20Poly1305", ccEncryptionKey()},
+		{"PlainText", nil},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := New(dir, tc.mk)
+			for i := 0; i < 10; i++ {
+				if err := s.AppendRecord("events", i); err != nil {
+					t.Fatalf("s.AppendRecord: %v", err)
+				}
+			}
+			got, err := readAllRecords(t, s, "events")
+			if err != nil {
+				t.Fatalf("s.ReadRecords: %v", err)
+			}
+			if len(got) != 10 || got[0] != 0 || got[9] != 9 {
+				t.Errorf("Unexpected records: %v", got)
+			}
+
+			// Simulate a partial write.
+			fn := filepath.Join(dir, "events")
+			fi, err := os.Stat(fn)
+			if err != nil {
+				t.Fatalf("os.Stat: %v", err)
+			}
+			if err := os.Truncate(fn, fi.Size()-3); err != nil {
+				t.Fatalf("os.Truncate: %v", err)
+			}
+			got, err = readAllRecords(t, s, "events")
+			if err != nil {
+				t.Fatalf("s.ReadRecords: %v", err)
+			}
+			if len(got) != 9 {
+				t.Errorf("Unexpected records after truncation: %v", got)
+			}
+			if err := s.AppendRecord("events", 100); err != nil {
+				t.Fatalf("s.AppendRecord: %v", err)
+			}
+			got, err = readAllRecords(t, s, "events")
+			if err != nil {
+				t.Fatalf("s.ReadRecords: %v", err)
+			}
+			if len(got) != 10 || got[8] != 8 || got[9] != 100 {
+				t.Errorf("Unexpected records after append: %v", got)
+			}
+
+			// Corruption in the middle of the file.
+			b, err := os.ReadFile(fn)
+			if err != nil {
+				t.Fatalf("os.ReadFile: %v", err)
+			}
+			b[len(b)/2] ^= 0xff
+			if err := os.WriteFile(fn, b, 0600); err != nil {
+				t.Fatalf("os.WriteFile: %v", err)
+			}
+			if _, err := readAllRecords(t, s, "events"); !errors.Is(err, ErrCorruptRecord) {
+				t.Errorf("s.ReadRecords() = %v, want ErrCorruptRecord", err)
+			}
+		})
+	}
+}
+
+func TestRecordsStop(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey())
+	for i := 0; i < 3; i++ {
+		if err := s.AppendRecord("events", i); err != nil {
+			t.Fatalf("s.AppendRecord: %v", err)
+		}
+	}
+	stop := errors.New("stop")
+	n := 0
+	if err := s.ReadRecords("events", func(func(interface{}) error) error {
+		n++
+		return stop
+	}); err != stop || n != 1 {
+		t.Errorf("s.ReadRecords() = %v, n=%d", err, n)
+	}
+	if err := s.ReadRecords("does-not-exist", nil); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("s.ReadRecords() = %v, want ErrNotExist", err)
+	}
+	if err := s.SaveDataFile("datafile", 1); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	if err := s.AppendRecord("datafile", 2); err == nil {
+		t.Error("s.AppendRecord(datafile) didn't fail")
+	}
+}
+
+func TestRecordsCorruptSize(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, aesEncryptionKey())
+	for i := 0; i < 10; i++ {
+		if err := s.AppendRecord("events", i); err != nil {
+			t.Fatalf("s.AppendRecord: %v", err)
+		}
+	}
+	rf, err := s.openRecordFile("events", false)
+	if err != nil {
+		t.Fatalf("s.openRecordFile: %v", err)
+	}
+	off := rf.start
+	for i := 0; i < 5; i++ {
+		size, _, _, err := rf.readAt(off)
+		if err != nil {
+			t.Fatalf("rf.readAt(%d): %v", off, err)
+		}
+		off += size
+	}
+	rf.close()
+
+	// A corrupt size in the middle of the file makes the record look like
+	// it extends to the end of the file. It isn't a partial write because
+	// the last record is valid.
+	fn := filepath.Join(dir, "events")
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+	binary.BigEndian.PutUint32(b[off:], uint32(len(b)))
+	if err := os.WriteFile(fn, b, 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	if _, err := readAllRecords(t, s, "events"); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("s.ReadRecords() = %v, want ErrCorruptRecord", err)
+	}
+}
@@ -0,0 +1,679 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replicationDir is the directory where the replication journal and the
+// state of the replicas are kept.
+const replicationDir = "replication"
+
+// replicationRetry is how often the shipping of changes is retried after a
+// failure.
+const replicationRetry = 30 * time.Second
+
+var journalFile = filepath.Join(replicationDir, "journal")
+
+// Replica is a copy of the storage that is kept up to date asynchronously.
+type Replica struct {
+	// Name identifies the replica. It must be unique, and usable as a file
+	// name.
+	Name string
+	// Backend is the filesystem of the replica. The local filesystem is
+	// used when it is nil.
+	Backend Backend
+	// Dir is the root directory of the replica in Backend.
+	Dir string
+}
+
+// WithReplication specifies that the changes committed to the storage should
+// be journaled and shipped to replicas in the background. The encrypted files
+// are copied as they are, so a replica can be opened as a warm standby with
+// the same master key.
+//
+// Each file is replaced atomically on the replicas, but the changes of a
+// transaction that modifies several files can be shipped separately. Only
+// one process should open the storage with replication.
+func WithReplication(replicas ...Replica) Option {
+	return func(opt *option) {
+		opt.replicas = append(opt.replicas, replicas...)
+	}
+}
+
+// ReplicaStatus is the status of a replica.
+type ReplicaStatus struct {
+	Name string
+	// Pending is the number of journaled changes that weren't shipped yet.
+	Pending uint64
+	// LastSync is the last time when the replica was brought up to date.
+	LastSync time.Time
+	// Err is the error of the last attempt to ship changes, if any.
+	Err error
+	// Conflicts are the files that were modified on the replica since they
+	// were last shipped. They aren't replicated until the conflicts are
+	// resolved with ResolveConflicts.
+	Conflicts []string
+}
+
+// journalEntry records that a file was changed.
+type journalEntry struct {
+	Seq  uint64
+	Name string
+}
+
+// replicaState is the persistent state of a replica.
+type replicaState struct {
+	// Seq is the sequence number of the last journal entry that was
+	// shipped.
+	Seq uint64
+	// Synced is true after the initial copy of all the files.
+	Synced bool
+	// Hashes are the SHA-256 hashes of the files that were shipped.
+	Hashes map[string]string
+	// Conflicts are the files that couldn't be shipped because they were
+	// modified on the replica.
+	Conflicts []string
+}
+
+type replica struct {
+	Replica
+	// state and force are only used while shipping changes.
+	state replicaState
+	force map[string]bool
+
+	// The status, protected by Replicator.mu.
+	shipped   uint64
+	lastSync  time.Time
+	err       error
+	conflicts []string
+}
+
+// Replicator ships the changes committed to a storage to its replicas. See
+// WithReplication.
+type Replicator struct {
+	s *Storage
+	// backend is the storage's backend, without journaling.
+	backend Backend
+
+	// mu protects the journal and the status of the replicas.
+	mu  sync.Mutex
+	seq uint64
+
+	// shipMu serializes the shipping of changes.
+	shipMu   sync.Mutex
+	replicas []*replica
+
+	wake      chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// newReplicator loads the state of the replicas, starts journaling the
+// changes of s, and starts shipping them in the background.
+func newReplicator(s *Storage, replicas []Replica) (*Replicator, error) {
+	r := &Replicator{
+		s:       s,
+		backend: s.backend,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	names := make(map[string]bool)
+	for _, rr := range replicas {
+		if rr.Name == "" || rr.Name != filepath.Base(rr.Name) || names[rr.Name] || rr.Name == filepath.Base(journalFile) {
+			return nil, fmt.Errorf("invalid replica name %q", rr.Name)
+		}
+		names[rr.Name] = true
+		if rr.Backend == nil {
+			rr.Backend = osBackend{}
+		}
+		rep := &replica{Replica: rr, force: make(map[string]bool)}
+		if err := s.ReadDataFile(filepath.Join(replicationDir, rr.Name), &rep.state); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if rep.state.Hashes == nil {
+			rep.state.Hashes = make(map[string]string)
+		}
+		rep.shipped = rep.state.Seq
+		rep.conflicts = rep.state.Conflicts
+		r.seq = max(r.seq, rep.state.Seq)
+		r.replicas = append(r.replicas, rep)
+	}
+	entries, err := r.readJournal()
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		r.seq = max(r.seq, entries[len(entries)-1].Seq)
+	}
+	s.backend = journalingBackend{Backend: s.backend, dir: s.dir, r: r}
+	r.wake <- struct{}{}
+	go r.run()
+	return r, nil
+}
+
+// Replicator returns the storage's Replicator, or nil when replication isn't
+// enabled.
+func (s *Storage) Replicator() *Replicator {
+	return s.replicator
+}
+
+// Flush ships all the changes that were journaled so far, and returns when
+// the replicas are up to date, or when shipping failed.
+func (r *Replicator) Flush() error {
+	return r.shipAll()
+}
+
+// Close stops shipping changes in the background. The changes are still
+// journaled, and they are shipped the next time the storage is opened, or
+// when Flush is called.
+func (r *Replicator) Close() error {
+	r.closeOnce.Do(func() { close(r.done) })
+	<-r.stopped
+	return nil
+}
+
+// Status returns the status of the replicas.
+func (r *Replicator) Status() []ReplicaStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []ReplicaStatus
+	for _, rep := range r.replicas {
+		out = append(out, ReplicaStatus{
+			Name:      rep.Name,
+			Pending:   r.seq - rep.shipped,
+			LastSync:  rep.lastSync,
+			Err:       rep.err,
+			Conflicts: slices.Clone(rep.conflicts),
+		})
+	}
+	return out
+}
+
+// ResolveConflicts overwrites the conflicting files of a replica with their
+// current version, and ships any other pending changes.
+func (r *Replicator) ResolveConflicts(name string) error {
+	r.shipMu.Lock()
+	i := slices.IndexFunc(r.replicas, func(rep *replica) bool { return rep.Name == name })
+	if i < 0 {
+		r.shipMu.Unlock()
+		return fmt.Errorf("unknown replica %q", name)
+	}
+	for _, f := range r.replicas[i].state.Conflicts {
+		r.replicas[i].force[f] = true
+	}
+	r.shipMu.Unlock()
+	return r.shipAll()
+}
+
+// Verify compares the files of the storage with those of the replicas, and
+// returns an error that lists the differences. Changes that weren't shipped
+// yet are reported as differences, so Flush should normally be called first.
+func (r *Replicator) Verify() error {
+	r.shipMu.Lock()
+	defer r.shipMu.Unlock()
+	files, err := walkFiles(r.backend, r.s.dir)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, rep := range r.replicas {
+		replicaFiles, err := walkFiles(rep.Backend, rep.Dir)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("replica %s: %w", rep.Name, err))
+			continue
+		}
+		for _, f := range files {
+			want, err := hashFile(r.backend, filepath.Join(r.s.dir, f))
+			if err != nil {
+				return err
+			}
+			got, err := hashFile(rep.Backend, filepath.Join(rep.Dir, f))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("replica %s: %w", rep.Name, err))
+				continue
+			}
+			if got == "" {
+				errs = append(errs, fmt.Errorf("replica %s: %s is missing", rep.Name, f))
+			} else if got != want {
+				errs = append(errs, fmt.Errorf("replica %s: %s differs", rep.Name, f))
+			}
+		}
+		for _, f := range replicaFiles {
+			if _, found := slices.BinarySearch(files, f); !found {
+				errs = append(errs, fmt.Errorf("replica %s: %s doesn't exist in the storage", rep.Name, f))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// run ships the changes in the background until Close is called.
+func (r *Replicator) run() {
+	defer close(r.stopped)
+	ticker := time.NewTicker(replicationRetry)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.wake:
+		case <-ticker.C:
+		}
+		if err := r.shipAll(); err != nil {
+			r.s.Logger().Errorf("Replication: %v", err)
+		}
+	}
+}
+
+// journal records that a file is about to change.
+func (r *Replicator) journal(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.s.AppendRecord(journalFile, journalEntry{Seq: r.seq + 1, Name: name}); err != nil {
+		return err
+	}
+	r.seq++
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// readJournal returns all the entries of the journal.
+func (r *Replicator) readJournal() ([]journalEntry, error) {
+	var entries []journalEntry
+	err := r.s.ReadRecords(journalFile, func(decode func(obj interface{}) error) error {
+		var e journalEntry
+		if err := decode(&e); err != nil {
+			return err
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	return entries, err
+}
+
+// shipAll ships the pending changes to all the replicas, and deletes the
+// journal when they are all up to date.
+func (r *Replicator) shipAll() error {
+	r.shipMu.Lock()
+	defer r.shipMu.Unlock()
+
+	r.mu.Lock()
+	head := r.seq
+	entries, err := r.readJournal()
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, rep := range r.replicas {
+		err := r.shipReplica(rep, head, entries)
+		r.mu.Lock()
+		if rep.err = err; err == nil {
+			rep.shipped = head
+			rep.lastSync = time.Now()
+		}
+		rep.conflicts = rep.state.Conflicts
+		r.mu.Unlock()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("replica %s: %w", rep.Name, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+	for _, rep := range r.replicas {
+		if rep.shipped != r.seq {
+			return nil
+		}
+	}
+	if err := r.s.DeleteFile(journalFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// shipReplica ships the changes after the replica's last shipped entry, up to
+// head. The first time, all the files are shipped.
+func (r *Replicator) shipReplica(rep *replica, head uint64, entries []journalEntry) error {
+	names := make(map[string]bool)
+	if !rep.state.Synced {
+		files, err := walkFiles(r.backend, r.s.dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			names[f] = true
+		}
+	}
+	for _, e := range entries {
+		if e.Seq > rep.state.Seq && e.Seq <= head {
+			names[e.Name] = true
+		}
+	}
+	for f := range rep.force {
+		names[f] = true
+	}
+	if rep.state.Synced && rep.state.Seq == head && len(names) == 0 {
+		return nil
+	}
+
+	conflicts := make(map[string]bool)
+	for _, f := range rep.state.Conflicts {
+		conflicts[f] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for f := range names {
+		sorted = append(sorted, f)
+	}
+	slices.Sort(sorted)
+	for _, f := range sorted {
+		conflict, err := r.shipFile(rep, f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f, err)
+		}
+		if conflict {
+			r.s.Logger().Errorf("Replication conflict: %s was modified on replica %s", f, rep.Name)
+		}
+		conflicts[f] = conflict
+		delete(rep.force, f)
+	}
+
+	rep.state.Conflicts = nil
+	for f, c := range conflicts {
+		if c {
+			rep.state.Conflicts = append(rep.state.Conflicts, f)
+		}
+	}
+	slices.Sort(rep.state.Conflicts)
+	rep.state.Seq = head
+	rep.state.Synced = true
+	return r.s.SaveDataFile(filepath.Join(replicationDir, rep.Name), &rep.state)
+}
+
+// shipFile copies the current version of a file to a replica, or deletes it
+// from the replica if it doesn't exist anymore. It returns true if the file
+// was modified on the replica since it was last shipped.
+func (r *Replicator) shipFile(rep *replica, name string) (conflict bool, retErr error) {
+	src := filepath.Join(r.s.dir, name)
+	dst := filepath.Join(rep.Dir, name)
+	fi, err := r.backend.Stat(src)
+	if errors.Is(err, fs.ErrNotExist) {
+		return r.deleteFromReplica(rep, name)
+	}
+	if err != nil {
+		return false, err
+	}
+	if fi.IsDir() {
+		return false, nil
+	}
+	current, err := hashFile(rep.Backend, dst)
+	if err != nil {
+		return false, err
+	}
+
+	if err := rep.Backend.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return false, err
+	}
+	tmp := fmt.Sprintf("%s.tmp-%d", dst, time.Now().UnixNano())
+	hash, err := copyToBackend(rep.Backend, tmp, r.backend, src)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := rep.Backend.Remove(tmp); err != nil && !errors.Is(err, fs.ErrNotExist) && retErr == nil {
+			retErr = err
+		}
+	}()
+	if current == hash {
+		rep.state.Hashes[name] = hash
+		return false, nil
+	}
+	if current != rep.state.Hashes[name] && !rep.force[name] {
+		return true, nil
+	}
+	// Verify the copy before it replaces the replica's file.
+	if h, err := hashFile(rep.Backend, tmp); err != nil {
+		return false, err
+	} else if h != hash {
+		return false, errors.New("integrity check failed")
+	}
+	if err := rep.Backend.Rename(tmp, dst); err != nil {
+		return false, err
+	}
+	rep.state.Hashes[name] = hash
+	return false, nil
+}
+
+// deleteFromReplica deletes a file or directory that doesn't exist anymore
+// from a replica.
+func (r *Replicator) deleteFromReplica(rep *replica, name string) (bool, error) {
+	dst := filepath.Join(rep.Dir, name)
+	fi, err := rep.Backend.Stat(dst)
+	if errors.Is(err, fs.ErrNotExist) {
+		delete(rep.state.Hashes, name)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if fi.IsDir() {
+		if err := rep.Backend.RemoveAll(dst); err != nil {
+			return false, err
+		}
+		prefix := name + string(filepath.Separator)
+		for f := range rep.state.Hashes {
+			if strings.HasPrefix(f, prefix) {
+				delete(rep.state.Hashes, f)
+			}
+		}
+		return false, nil
+	}
+	current, err := hashFile(rep.Backend, dst)
+	if err != nil {
+		return false, err
+	}
+	if current != rep.state.Hashes[name] && !rep.force[name] {
+		return true, nil
+	}
+	if err := rep.Backend.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	delete(rep.state.Hashes, name)
+	return false, nil
+}
+
+// copyToBackend copies a file from one backend to another, and returns the
+// SHA-256 hash of its content.
+func copyToBackend(dstBackend Backend, dst string, srcBackend Backend, src string) (string, error) {
+	in, err := srcBackend.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := dstBackend.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), in); err != nil {
+		out.Close()
+		dstBackend.Remove(dst)
+		return "", err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		dstBackend.Remove(dst)
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		dstBackend.Remove(dst)
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile returns the SHA-256 hash of the content of a file, or an empty
+// string if the file doesn't exist.
+func hashFile(b Backend, name string) (string, error) {
+	f, err := b.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// walkFiles returns the sorted relative names of the files under dir, except
+// the storage's internal files.
+func walkFiles(b Backend, dir string) ([]string, error) {
+	return walkAll(b, dir, isInternalFile)
+}
+
+// walkAll returns the sorted relative names of the files under dir. The files
+// and directories for which skip returns true are skipped. skip is called
+// with slash-separated names.
+func walkAll(b Backend, dir string, skip func(name string) bool) ([]string, error) {
+	var files []string
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		entries, err := b.ReadDir(filepath.Join(dir, rel))
+		if errors.Is(err, fs.ErrNotExist) && rel == "." {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			name := filepath.Join(rel, e.Name())
+			if skip(filepath.ToSlash(name)) {
+				continue
+			}
+			if e.IsDir() {
+				if err := walk(name); err != nil {
+					return err
+				}
+				continue
+			}
+			files = append(files, name)
+		}
+		return nil
+	}
+	if err := walk("."); err != nil {
+		return nil, err
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// journalingBackend journals the changes to the storage's files before they
+// are made.
+type journalingBackend struct {
+	Backend
+	dir string
+	r   *Replicator
+}
+
+func (b journalingBackend) journal(names ...string) error {
+	for _, name := range names {
+		rel, err := filepath.Rel(b.dir, name)
+		if err != nil || !filepath.IsLocal(rel) || isInternalFile(filepath.ToSlash(rel)) {
+			continue
+		}
+		if err := b.r.journal(rel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b journalingBackend) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if err := b.journal(name); err != nil {
+			return nil, err
+		}
+	}
+	return b.Backend.OpenFile(name, flag, perm)
+}
+
+func (b journalingBackend) Rename(oldpath, newpath string) error {
+	if err := b.journal(oldpath, newpath); err != nil {
+		return err
+	}
+	return b.Backend.Rename(oldpath, newpath)
+}
+
+func (b journalingBackend) Link(oldname, newname string) error {
+	if err := b.journal(newname); err != nil {
+		return err
+	}
+	return b.Backend.Link(oldname, newname)
+}
+
+func (b journalingBackend) Remove(name string) error {
+	if err := b.journal(name); err != nil {
+		return err
+	}
+	return b.Backend.Remove(name)
+}
+
+func (b journalingBackend) RemoveAll(path string) error {
+	if err := b.journal(path); err != nil {
+		return err
+	}
+	return b.Backend.RemoveAll(path)
+}
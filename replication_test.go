@@ -0,0 +1,218 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReplication(t *testing.T) {
+	mk := aesEncryptionKey()
+	dir := t.TempDir()
+	replicaDir := t.TempDir()
+	mem := NewMemBackend()
+
+	s := New(dir, mk)
+	// Files that exist before replication is enabled are copied too.
+	if err := s.SaveDataFile("before", "before"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+
+	s = New(dir, mk, WithReplication(
+		Replica{Name: "local", Dir: replicaDir},
+		Replica{Name: "mem", Backend: mem, Dir: "/replica"},
+	))
+	defer s.Replicator().Close()
+	if err := s.SaveDataFile("foo", "foo"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	if err := s.SaveDataFile("dir/bar", "bar"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	writeBlob(t, s, "blob", []byte("blob content"))
+	if err := s.AppendRecord("records", "one"); err != nil {
+		t.Fatalf("s.AppendRecord: %v", err)
+	}
+	var foo string
+	commit, err := s.OpenForUpdate("foo", &foo)
+	if err != nil {
+		t.Fatalf("s.OpenForUpdate: %v", err)
+	}
+	foo = "updated"
+	if err := commit(true, nil); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := s.RenameFile("dir/bar", "baz"); err != nil {
+		t.Fatalf("s.RenameFile: %v", err)
+	}
+	if err := s.Replicator().Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := s.Replicator().Verify(); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	// The journal is deleted when all the replicas are up to date.
+	if _, err := os.Stat(filepath.Join(dir, journalFile)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("journal exists: %v", err)
+	}
+	for _, st := range s.Replicator().Status() {
+		if st.Pending != 0 || st.Err != nil || st.LastSync.IsZero() || len(st.Conflicts) != 0 {
+			t.Errorf("Unexpected status: %+v", st)
+		}
+	}
+
+	for _, r := range []*Storage{
+		New(replicaDir, mk),
+		New("/replica", mk, WithBackend(mem)),
+	} {
+		for _, tc := range []struct{ name, want string }{
+			{"before", "before"},
+			{"foo", "updated"},
+			{"baz", "bar"},
+		} {
+			var got string
+			if err := r.ReadDataFile(tc.name, &got); err != nil {
+				t.Fatalf("r.ReadDataFile(%q): %v", tc.name, err)
+			}
+			if got != tc.want {
+				t.Errorf("r.ReadDataFile(%q) = %q, want %q", tc.name, got, tc.want)
+			}
+		}
+		if got := readBlob(t, r, "blob"); string(got) != "blob content" {
+			t.Errorf("blob = %q", got)
+		}
+		var bar string
+		if err := r.ReadDataFile("dir/bar", &bar); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("r.ReadDataFile(dir/bar) = %v, want ErrNotExist", err)
+		}
+		if _, err := r.ReadHeader(journalFile); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("The journal was replicated: %v", err)
+		}
+	}
+}
+
+func TestReplicationCatchUp(t *testing.T) {
+	mk := aesEncryptionKey()
+	dir := t.TempDir()
+	replicaDir := t.TempDir()
+
+	s := New(dir, mk, WithReplication(Replica{Name: "r", Dir: replicaDir}))
+	if err := s.Replicator().Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// Changes are journaled while nothing is shipped.
+	if err := s.SaveDataFile("foo", "foo"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	if st := s.Replicator().Status(); len(st) != 1 || st[0].Pending == 0 {
+		t.Errorf("Status = %+v", st)
+	}
+	if _, err := os.Stat(filepath.Join(replicaDir, "foo")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("foo was replicated: %v", err)
+	}
+
+	// The journal is shipped when the storage is opened again.
+	s = New(dir, mk, WithReplication(Replica{Name: "r", Dir: replicaDir}))
+	defer s.Replicator().Close()
+	if err := s.Replicator().Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	var foo string
+	if err := New(replicaDir, mk).ReadDataFile("foo", &foo); err != nil || foo != "foo" {
+		t.Errorf("ReadDataFile = %q, %v", foo, err)
+	}
+}
+
+func TestReplicationConflicts(t *testing.T) {
+	mk := aesEncryptionKey()
+	dir := t.TempDir()
+	replicaDir := t.TempDir()
+
+	s := New(dir, mk, WithReplication(Replica{Name: "r", Dir: replicaDir}))
+	defer s.Replicator().Close()
+	for _, f := range []string{"foo", "bar"} {
+		if err := s.SaveDataFile(f, f); err != nil {
+			t.Fatalf("s.SaveDataFile: %v", err)
+		}
+	}
+	if err := s.Replicator().Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	// foo is modified on the replica.
+	r := New(replicaDir, mk)
+	if err := r.SaveDataFile("foo", "modified on replica"); err != nil {
+		t.Fatalf("r.SaveDataFile: %v", err)
+	}
+	if err := s.Replicator().Verify(); err == nil || !strings.Contains(err.Error(), "foo differs") {
+		t.Errorf("Verify = %v", err)
+	}
+	for _, f := range []string{"foo", "bar"} {
+		if err := s.SaveDataFile(f, "new "+f); err != nil {
+			t.Fatalf("s.SaveDataFile: %v", err)
+		}
+	}
+	if err := s.Replicator().Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if st := s.Replicator().Status(); !reflect.DeepEqual(st[0].Conflicts, []string{"foo"}) {
+		t.Errorf("Conflicts = %v", st[0].Conflicts)
+	}
+	var got string
+	if err := r.ReadDataFile("foo", &got); err != nil || got != "modified on replica" {
+		t.Errorf("r.ReadDataFile(foo) = %q, %v", got, err)
+	}
+	if err := r.ReadDataFile("bar", &got); err != nil || got != "new bar" {
+		t.Errorf("r.ReadDataFile(bar) = %q, %v", got, err)
+	}
+
+	if err := s.Replicator().ResolveConflicts("r"); err != nil {
+		t.Fatalf("ResolveConflicts: %v", err)
+	}
+	if st := s.Replicator().Status(); len(st[0].Conflicts) != 0 {
+		t.Errorf("Conflicts = %v", st[0].Conflicts)
+	}
+	if err := r.ReadDataFile("foo", &got); err != nil || got != "new foo" {
+		t.Errorf("r.ReadDataFile(foo) = %q, %v", got, err)
+	}
+	if err := s.Replicator().Verify(); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	if err := s.Replicator().ResolveConflicts("nope"); err == nil {
+		t.Error("ResolveConflicts(nope) succeeded")
+	}
+}
+
+func TestReplicationInvalidName(t *testing.T) {
+	for _, name := range []string{"", "a/b", "journal"} {
+		if _, err := Open(t.TempDir(), nil, WithReplication(Replica{Name: name, Dir: t.TempDir()})); err == nil {
+			t.Errorf("Open with replica %q succeeded", name)
+		}
+	}
+}
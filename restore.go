@@ -0,0 +1,286 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// RestoreOption is used to specify optional parameters of Restore.
+type RestoreOption func(*restoreOption)
+
+type restoreOption struct {
+	manifest   *Manifest
+	verifyOnly bool
+	partial    bool
+}
+
+// WithRestoreManifest specifies the manifest of the snapshot that is being
+// restored, e.g. the one returned by Snapshot or BackupScheduler.Manifest.
+// The files are verified against their hashes, and the files that are missing
+// are reported. It isn't needed to restore an export.
+func WithRestoreManifest(m *Manifest) RestoreOption {
+	return func(opt *restoreOption) {
+		opt.manifest = m
+	}
+}
+
+// WithVerifyOnly specifies that the files are only verified. Nothing is
+// restored.
+func WithVerifyOnly() RestoreOption {
+	return func(opt *restoreOption) {
+		opt.verifyOnly = true
+	}
+}
+
+// WithPartialRestore specifies that the files that are verified successfully
+// are restored even when other files aren't. By default, nothing is restored
+// unless all the files are.
+func WithPartialRestore() RestoreOption {
+	return func(opt *restoreOption) {
+		opt.partial = true
+	}
+}
+
+// RestoreResult is the result of the restore of one file.
+type RestoreResult struct {
+	// Name is the relative name of the file.
+	Name string
+	// Size is the size of the encrypted file.
+	Size int64
+	// Err is the reason why the file can't be restored, if any.
+	Err error
+	// Restored is true when the file was swapped into place.
+	Restored bool
+}
+
+// Restore restores the files of a snapshot, or of exports, from dir in src.
+// A nil src means the local filesystem. Exports are restored from the
+// directory where they were extracted, in order, on top of one another.
+//
+// The files are first copied next to their final location. Each copy is
+// verified: its hash must match the manifest, it must be decryptable with the
+// storage's master key, and its content must be intact. Then, the copies are
+// swapped into place, while the files are locked. The files of the storage
+// that aren't in the snapshot are left untouched.
+//
+// Restore returns the result for every file, sorted by name, and an error if
+// any of them failed.
+func (s *Storage) Restore(src Backend, dir string, opts ...RestoreOption) ([]RestoreResult, error) {
+	var opt restoreOption
+	for _, o := range opts {
+		o(&opt)
+	}
+	if src == nil {
+		src = osBackend{}
+	}
+
+	// The source of each file, by name.
+	sources := make(map[string]string)
+	m, err := loadManifest(src, filepath.Join(dir, exportManifest))
+	switch {
+	case err == nil:
+		for name, e := range m.Files {
+			sources[name] = filepath.Join(dir, exportObjects, e.SHA256)
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	case opt.manifest != nil:
+		m = opt.manifest
+		for name := range m.Files {
+			sources[name] = filepath.Join(dir, filepath.FromSlash(name))
+		}
+	default:
+		files, err := walkFiles(src, dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range files {
+			sources[name] = filepath.Join(dir, name)
+		}
+	}
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]RestoreResult, len(names))
+	tmps := make([]string, len(names))
+	defer func() {
+		for _, tmp := range tmps {
+			if tmp != "" {
+				s.backend.Remove(tmp)
+			}
+		}
+	}()
+	var failed int
+	for i, name := range names {
+		results[i].Name = name
+		if tmps[i], results[i].Size, results[i].Err = s.stageRestore(src, sources[name], name, m, opt.verifyOnly); results[i].Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 && !opt.partial {
+		return results, fmt.Errorf("restore: %d of %d files failed verification", failed, len(names))
+	}
+	if opt.verifyOnly {
+		return results, nil
+	}
+
+	for i, name := range names {
+		if results[i].Err != nil {
+			continue
+		}
+		if err := s.swapRestore(tmps[i], name); err != nil {
+			results[i].Err = err
+			failed++
+			continue
+		}
+		tmps[i] = ""
+		results[i].Restored = true
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("restore: %d of %d files failed", failed, len(names))
+	}
+	return results, nil
+}
+
+// stageRestore copies file from src next to name, and verifies the copy. It
+// returns the name of the copy, and the size of the file. When verifyOnly is
+// true, file is verified where it is, and it isn't copied.
+func (s *Storage) stageRestore(src Backend, file, name string, m *Manifest, verifyOnly bool) (tmp string, size int64, err error) {
+	fi, err := src.Stat(file)
+	if err != nil {
+		return "", 0, err
+	}
+	size = fi.Size()
+
+	var hash string
+	b, path := src, file
+	if verifyOnly {
+		if hash, err = hashFile(src, file); err != nil {
+			return "", size, err
+		}
+	} else {
+		path = fmt.Sprintf("%s.tmp-%d", filepath.Join(s.dir, filepath.FromSlash(name)), time.Now().UnixNano())
+		if err := createParentIfNotExist(s.backend, path); err != nil {
+			return "", size, err
+		}
+		if hash, err = copyToBackend(s.backend, path, src, file); err != nil {
+			return "", size, err
+		}
+		b = s.backend
+		tmp = path
+	}
+	if m != nil && hash != m.Files[name].SHA256 {
+		return tmp, size, errors.New("integrity check failed")
+	}
+	return tmp, size, s.verifyFile(b, path, filepath.FromSlash(name))
+}
+
+// swapRestore renames a verified copy over the file.
+func (s *Storage) swapRestore(tmp, name string) error {
+	fn := filepath.FromSlash(name)
+	if err := s.Lock(fn); err != nil {
+		return err
+	}
+	defer s.Unlock(fn)
+	if err := s.backend.Rename(tmp, filepath.Join(s.dir, fn)); err != nil {
+		return err
+	}
+	s.invalidateCache(fn)
+	return nil
+}
+
+// verifyFile reads the whole content of file in b, as if it were the file
+// called filename in the storage, to verify that it is decryptable and intact.
+func (s *Storage) verifyFile(b Backend, file, filename string) error {
+	v := &Storage{
+		dir:          s.dir,
+		masterKey:    s.masterKey,
+		logger:       s.logger,
+		verifyingKey: s.verifyingKey,
+		backend:      aliasBackend{Backend: b, name: filepath.Join(s.dir, filename), file: file},
+	}
+	flags, _, err := v.readFlags(filename)
+	if err != nil {
+		return err
+	}
+	var r io.ReadCloser
+	switch enc := flags & optEncodingMask; {
+	case enc == optRecords:
+		return v.ReadRecords(filename, func(func(interface{}) error) error { return nil })
+	case enc == optPaged:
+		bf, err := v.openBlobFile(filename, false)
+		if err != nil {
+			return err
+		}
+		r = &blobFileReader{io.NewSectionReader(bf, 0, bf.Size()), bf}
+	case flags&optHashed != 0, enc == optRawBytes && flags&optCompressed == 0:
+		if r, err = v.openBlobRead(filename, filename); err != nil {
+			return err
+		}
+	default:
+		if r, err = v.openReadStream(filename); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(io.Discard, r)
+	if e := r.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// aliasBackend is a Backend where name refers to file.
+type aliasBackend struct {
+	Backend
+	name, file string
+}
+
+func (b aliasBackend) path(name string) string {
+	if name == b.name {
+		return b.file
+	}
+	return name
+}
+
+func (b aliasBackend) Open(name string) (File, error) {
+	return b.Backend.Open(b.path(name))
+}
+
+func (b aliasBackend) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	return b.Backend.OpenFile(b.path(name), flag, perm)
+}
+
+func (b aliasBackend) Stat(name string) (fs.FileInfo, error) {
+	return b.Backend.Stat(b.path(name))
+}
@@ -0,0 +1,238 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// extractExport extracts an export into dir.
+func extractExport(t *testing.T, data []byte, dir string) {
+	t.Helper()
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			t.Fatalf("tr.Next: %v", err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("io.ReadAll: %v", err)
+		}
+		fn := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(fn), 0o700); err != nil {
+			t.Fatalf("os.MkdirAll: %v", err)
+		}
+		if err := os.WriteFile(fn, b, 0o600); err != nil {
+			t.Fatalf("os.WriteFile: %v", err)
+		}
+	}
+}
+
+// populateFiles creates a data file, a blob, and a record file.
+func populateFiles(t *testing.T, s *Storage, value string) {
+	t.Helper()
+	if err := s.SaveDataFile("dir/foo", value); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	writeBlob(t, s, "blob", []byte(value))
+	if err := s.AppendRecord("records", value); err != nil {
+		t.Fatalf("s.AppendRecord: %v", err)
+	}
+}
+
+// checkFiles verifies the content of the files created by populateFiles.
+func checkFiles(t *testing.T, s *Storage, value string, records int) {
+	t.Helper()
+	var foo string
+	if err := s.ReadDataFile("dir/foo", &foo); err != nil || foo != value {
+		t.Errorf("ReadDataFile = %q, %v, want %q", foo, err, value)
+	}
+	if got := string(readBlob(t, s, "blob")); got != value {
+		t.Errorf("blob = %q, want %q", got, value)
+	}
+	var n int
+	err := s.ReadRecords("records", func(decode func(interface{}) error) error {
+		n++
+		return nil
+	})
+	if err != nil || n != records {
+		t.Errorf("ReadRecords = %d, %v, want %d", n, err, records)
+	}
+}
+
+func checkResults(t *testing.T, results []RestoreResult, restored bool) {
+	t.Helper()
+	if len(results) != 3 {
+		t.Fatalf("Restore returned %d results, want 3: %v", len(results), results)
+	}
+	for _, r := range results {
+		if r.Err != nil || r.Restored != restored || r.Size == 0 {
+			t.Errorf("Result = %+v", r)
+		}
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	mk := aesEncryptionKey()
+	dir := t.TempDir()
+	s := New(dir, mk)
+	populateFiles(t, s, "old")
+	snap := filepath.Join(t.TempDir(), "snap")
+	m, err := s.Snapshot(nil, snap)
+	if err != nil {
+		t.Fatalf("s.Snapshot: %v", err)
+	}
+	populateFiles(t, s, "new")
+
+	results, err := s.Restore(nil, snap, WithRestoreManifest(m), WithVerifyOnly())
+	if err != nil {
+		t.Fatalf("s.Restore: %v", err)
+	}
+	checkResults(t, results, false)
+	checkFiles(t, s, "new", 2)
+
+	results, err = s.Restore(nil, snap, WithRestoreManifest(m))
+	if err != nil {
+		t.Fatalf("s.Restore: %v", err)
+	}
+	checkResults(t, results, true)
+	checkFiles(t, s, "old", 1)
+
+	// Without a manifest, the files are found in the snapshot.
+	populateFiles(t, s, "new")
+	if results, err = s.Restore(nil, snap); err != nil {
+		t.Fatalf("s.Restore: %v", err)
+	}
+	checkResults(t, results, true)
+	checkFiles(t, s, "old", 1)
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.tmp-*")); len(matches) != 0 {
+		t.Errorf("Temporary files weren't deleted: %v", matches)
+	}
+}
+
+func TestRestoreExport(t *testing.T) {
+	mk := aesEncryptionKey()
+	s := New(t.TempDir(), mk)
+	populateFiles(t, s, "one")
+	var buf bytes.Buffer
+	base, err := s.Export(&buf)
+	if err != nil {
+		t.Fatalf("s.Export: %v", err)
+	}
+	exp := t.TempDir()
+	extractExport(t, buf.Bytes(), exp)
+
+	populateFiles(t, s, "two")
+	buf.Reset()
+	if _, err := s.Export(&buf, WithBaseManifest(base)); err != nil {
+		t.Fatalf("s.Export: %v", err)
+	}
+	extractExport(t, buf.Bytes(), exp)
+
+	r := New(t.TempDir(), mk)
+	results, err := r.Restore(nil, exp)
+	if err != nil {
+		t.Fatalf("r.Restore: %v", err)
+	}
+	checkResults(t, results, true)
+	checkFiles(t, r, "two", 2)
+}
+
+func TestRestoreVerification(t *testing.T) {
+	mk := aesEncryptionKey()
+	s := New(t.TempDir(), mk)
+	populateFiles(t, s, "old")
+	snap := filepath.Join(t.TempDir(), "snap")
+	m, err := s.Snapshot(nil, snap)
+	if err != nil {
+		t.Fatalf("s.Snapshot: %v", err)
+	}
+	populateFiles(t, s, "new")
+
+	// The snapshot can't be decrypted with another key.
+	other := New(t.TempDir(), aesEncryptionKey())
+	results, err := other.Restore(nil, snap)
+	if err == nil {
+		t.Fatal("other.Restore succeeded unexpectedly")
+	}
+	for _, r := range results {
+		if r.Err == nil || r.Restored {
+			t.Errorf("Result = %+v", r)
+		}
+	}
+
+	// Corrupt the end of the data file.
+	fn := filepath.Join(snap, "dir", "foo")
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+	b[len(b)-1] ^= 1
+	if err := os.WriteFile(fn, b, 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+
+	results, err = s.Restore(nil, snap, WithRestoreManifest(m))
+	if err == nil {
+		t.Fatal("s.Restore succeeded unexpectedly")
+	}
+	for _, r := range results {
+		if (r.Name == "dir/foo") != (r.Err != nil) || r.Restored {
+			t.Errorf("Result = %+v", r)
+		}
+		if r.Name == "dir/foo" && !strings.Contains(r.Err.Error(), "integrity") {
+			t.Errorf("Err = %v, want integrity check failure", r.Err)
+		}
+	}
+	// Nothing was restored.
+	checkFiles(t, s, "new", 2)
+
+	// Without the manifest, the file fails to decrypt.
+	if results, err = s.Restore(nil, snap, WithPartialRestore()); err == nil {
+		t.Fatal("s.Restore succeeded unexpectedly")
+	}
+	for _, r := range results {
+		if (r.Name == "dir/foo") == r.Restored {
+			t.Errorf("Result = %+v", r)
+		}
+	}
+	var foo string
+	if err := s.ReadDataFile("dir/foo", &foo); err != nil || foo != "new" {
+		t.Errorf("ReadDataFile = %q, %v, want new", foo, err)
+	}
+	if got := string(readBlob(t, s, "blob")); got != "old" {
+		t.Errorf("blob = %q, want old", got)
+	}
+}
@@ -0,0 +1,240 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// WithReadLocks specifies that ReadDataFile should hold a shared lock on the
+// file while reading it. The read then waits for commits that have the file
+// locked, so it never observes some of the changes of a multi-file commit but
+// not the others. Without it, reads don't use locks at all.
+//
+// When a reader dies without releasing its shared lock, writers on the same
+// host remove it as soon as they see that the process is gone. The shared
+// locks of readers on other hosts are only considered stale after they
+// haven't been refreshed for 10 minutes, and writers wait until then.
+func WithReadLocks() Option {
+	return func(opt *option) {
+		opt.readLocks = true
+	}
+}
+
+// readerRefresh is how often the modification time of the reader files is
+// refreshed while the shared locks are held. Writers consider the reader files
+// of other hosts stale when they aren't refreshed for 10 minutes.
+var readerRefresh = time.Minute
+
+// readers keeps track of the shared locks held by this Storage.
+type readers struct {
+	mu sync.Mutex
+	// The names of the reader files, by locked file name.
+	files map[string][]string
+	// refreshing is true while a goroutine refreshes the reader files.
+	refreshing bool
+	refresh    time.Duration
+}
+
+func newReaders() *readers {
+	return &readers{files: make(map[string][]string), refresh: readerRefresh}
+}
+
+// push adds a reader file. It returns true if the caller needs to start
+// refreshing the reader files.
+func (r *readers) push(fn, reader string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files[fn] = append(r.files[fn], reader)
+	if r.refreshing {
+		return false
+	}
+	r.refreshing = true
+	return true
+}
+
+func (r *readers) pop(fn string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l := r.files[fn]
+	if len(l) == 0 {
+		return "", false
+	}
+	reader := l[len(l)-1]
+	if len(l) == 1 {
+		delete(r.files, fn)
+	} else {
+		r.files[fn] = l[:len(l)-1]
+	}
+	return reader, true
+}
+
+// all returns all the reader files. When there are none, it returns false and
+// the refreshing stops.
+func (r *readers) all() ([]string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.files) == 0 {
+		r.refreshing = false
+		return nil, false
+	}
+	var out []string
+	for _, l := range r.files {
+		out = append(out, l...)
+	}
+	return out, true
+}
+
+// refreshReaders updates the modification time of the reader files until all
+// the shared locks are released, so that writers on other hosts don't remove
+// them while they are still in use.
+func (s *Storage) refreshReaders() {
+	t := time.NewTicker(s.readers.refresh)
+	defer t.Stop()
+	for range t.C {
+		files, ok := s.readers.all()
+		if !ok {
+			return
+		}
+		now := time.Now()
+		for _, f := range files {
+			if err := s.backend.Chtimes(f, now, now); err != nil {
+				s.Logger().Debugf("Refresh %s: %v", f, err)
+			}
+		}
+	}
+}
+
+// readersDir returns the directory where the shared locks of fn are
+// recorded. Each reader creates a file in it.
+func (s *Storage) readersDir(fn string) string {
+	return filepath.Join(s.dir, fn) + ".rlock"
+}
+
+// RLock acquires a shared lock for the given filename. Many readers can hold
+// the shared lock at the same time, but not while someone holds the lock
+// acquired with Lock. Writers have priority: RLock waits while a writer is
+// waiting for the current readers to release their locks. The shared lock is
+// kept alive for as long as it is held, even by long reads.
+func (s *Storage) RLock(fn string) error {
+	return s.RLockContext(context.Background(), fn)
+}
+
+// RLockContext is like RLock, but it gives up when ctx is done, in which case
+// the error wraps ctx.Err().
+func (s *Storage) RLockContext(ctx context.Context, fn string) (retErr error) {
+	start := time.Now()
+	// The exclusive lock is held only while the reader file is created.
+	if err := s.lockFile(ctx, fn); err != nil {
+		return err
+	}
+	s.metrics.ObserveDuration(MetricLockWait, fn, time.Since(start))
+	defer func() {
+		if err := s.Unlock(fn); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	dir := s.readersDir(fn)
+	reader := filepath.Join(dir, hex.EncodeToString(b))
+	for {
+		if err := s.backend.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		err := createOwnedFile(s.backend, reader)
+		if errors.Is(err, os.ErrNotExist) {
+			// The last reader removed the directory concurrently.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+	if s.readers.push(filepath.Clean(fn), reader) {
+		go s.refreshReaders()
+	}
+	s.Logger().Debugf("RLocked %s", fn)
+	return nil
+}
+
+// RUnlock releases a shared lock acquired with RLock.
+func (s *Storage) RUnlock(fn string) error {
+	reader, ok := s.readers.pop(filepath.Clean(fn))
+	if !ok {
+		return fmt.Errorf("%s is not read locked", fn)
+	}
+	if err := s.backend.Remove(reader); err != nil {
+		return err
+	}
+	// This fails if there are other readers, or the directory was already
+	// removed. That's ok.
+	s.backend.Remove(filepath.Dir(reader))
+	s.Logger().Debugf("RUnlocked %s", fn)
+	return nil
+}
+
+// waitForReaders waits until all the shared locks of fn are released. The
+// caller must hold the lock file of fn, so that no new readers can arrive.
+func (s *Storage) waitForReaders(ctx context.Context, fn string) error {
+	dir := s.readersDir(fn)
+	deadline := time.Duration(600+mrand.Int()%60) * time.Second
+	for {
+		entries, err := s.backend.ReadDir(dir)
+		if errors.Is(err, os.ErrNotExist) || (err == nil && len(entries) == 0) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			tryToRemoveStaleLock(s.backend, s.Logger(), filepath.Join(dir, e.Name()), deadline)
+		}
+		t := time.NewTimer(time.Duration(100+mrand.Int()%100) * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return fmt.Errorf("lock %s: %w", fn, ctx.Err())
+		case <-t.C:
+		}
+	}
+}
+
+// hasReaders returns true if anyone holds a shared lock on fn.
+func (s *Storage) hasReaders(fn string) bool {
+	entries, err := s.backend.ReadDir(s.readersDir(fn))
+	return err == nil && len(entries) > 0
+}
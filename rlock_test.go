@@ -0,0 +1,232 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRLock(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey())
+
+	if err := s.RLock("foo"); err != nil {
+		t.Fatalf("RLock() failed: %v", err)
+	}
+	if err := s.RLock("foo"); err != nil {
+		t.Fatalf("RLock() failed: %v", err)
+	}
+	if err := s.LockWithTimeout("foo", 200*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("LockWithTimeout() = %v, want DeadlineExceeded", err)
+	}
+	if err := s.RUnlock("foo"); err != nil {
+		t.Errorf("RUnlock() failed: %v", err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.RUnlock("foo")
+	}()
+	// Lock waits for the last reader.
+	if err := s.LockWithTimeout("foo", 5*time.Second); err != nil {
+		t.Fatalf("LockWithTimeout() failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := s.RLockContext(ctx, "foo"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("RLockContext() = %v, want DeadlineExceeded", err)
+	}
+	if err := s.Unlock("foo"); err != nil {
+		t.Errorf("Unlock() failed: %v", err)
+	}
+	if err := s.RUnlock("foo"); err == nil {
+		t.Error("RUnlock() of unlocked file succeeded")
+	}
+}
+
+func TestReadLocks(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey(), WithReadLocks())
+
+	if err := s.SaveDataFile("foo", "hello"); err != nil {
+		t.Fatalf("SaveDataFile() failed: %v", err)
+	}
+	var obj string
+	commit, err := s.OpenForUpdate("foo", &obj)
+	if err != nil {
+		t.Fatalf("OpenForUpdate() failed: %v", err)
+	}
+	ch := make(chan string)
+	go func() {
+		var got string
+		if err := s.ReadDataFile("foo", &got); err != nil {
+			t.Errorf("ReadDataFile() failed: %v", err)
+		}
+		ch <- got
+	}()
+	time.Sleep(200 * time.Millisecond)
+	obj = "world"
+	if err := commit(true, nil); err != nil {
+		t.Fatalf("commit() failed: %v", err)
+	}
+	// The read waited for the commit.
+	if got := <-ch; got != "world" {
+		t.Errorf("ReadDataFile() = %q, want world", got)
+	}
+}
+
+func TestRLockRefresh(t *testing.T) {
+	defer func(d time.Duration) { readerRefresh = d }(readerRefresh)
+	readerRefresh = 50 * time.Millisecond
+	s := New(t.TempDir(), aesEncryptionKey())
+
+	if err := s.RLock("foo"); err != nil {
+		t.Fatalf("RLock() failed: %v", err)
+	}
+	entries, err := os.ReadDir(s.readersDir("foo"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("ReadDir() = %v, %v", entries, err)
+	}
+	reader := filepath.Join(s.readersDir("foo"), entries[0].Name())
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(reader, old, old); err != nil {
+		t.Fatalf("Chtimes() failed: %v", err)
+	}
+	// The reader file is refreshed while the lock is held.
+	time.Sleep(200 * time.Millisecond)
+	if fi, err := os.Stat(reader); err != nil || time.Since(fi.ModTime()) > time.Minute {
+		t.Errorf("Stat() = %v, %v, want a recent modification time", fi, err)
+	}
+	if err := s.RUnlock("foo"); err != nil {
+		t.Errorf("RUnlock() failed: %v", err)
+	}
+}
+
+func TestRLockInternalFiles(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, aesEncryptionKey())
+	for _, f := range []string{"foo", "dir/bar"} {
+		if err := s.SaveDataFile(f, f); err != nil {
+			t.Fatalf("SaveDataFile: %v", err)
+		}
+		if err := s.RLock(f); err != nil {
+			t.Fatalf("RLock() failed: %v", err)
+		}
+		defer s.RUnlock(f)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dir", "bar.rlock")); err != nil {
+		t.Fatalf("os.Stat: %v", err)
+	}
+	want := []string{"dir/bar", "foo"}
+
+	var files []string
+	fs.WalkDir(s.FS(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("FS files = %v, want %v", files, want)
+	}
+	if _, err := fs.Stat(s.FS(), "foo.rlock"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("fs.Stat(foo.rlock) = %v, want ErrNotExist", err)
+	}
+
+	files, err := walkFiles(s.backend, dir)
+	if err != nil {
+		t.Fatalf("walkFiles: %v", err)
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("walkFiles() = %v, want %v", files, want)
+	}
+
+	m, err := s.Snapshot(nil, filepath.Join(t.TempDir(), "snap"))
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	if len(m.Files) != 2 || m.Files["foo"].Size == 0 || m.Files["dir/bar"].Size == 0 {
+		t.Errorf("Snapshot manifest = %v, want %v", m.Files, want)
+	}
+	if m, err = s.Export(&bytes.Buffer{}); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if len(m.Files) != 2 || m.Files["foo"].Size == 0 || m.Files["dir/bar"].Size == 0 {
+		t.Errorf("Export manifest = %v, want %v", m.Files, want)
+	}
+}
+
+func TestRLockDeadReader(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey())
+	addReader := func(owner lockOwner) string {
+		dir := s.readersDir("foo")
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatalf("os.MkdirAll: %v", err)
+		}
+		b, err := json.Marshal(owner)
+		if err != nil {
+			t.Fatalf("json.Marshal: %v", err)
+		}
+		fn := filepath.Join(dir, "reader")
+		if err := os.WriteFile(fn, b, 0600); err != nil {
+			t.Fatalf("os.WriteFile: %v", err)
+		}
+		return fn
+	}
+
+	// A reader on this host whose process is gone doesn't block writers.
+	addReader(lockOwner{PID: math.MaxInt32, Host: hostname(), TS: time.Now()})
+	if err := s.LockWithTimeout("foo", 5*time.Second); err != nil {
+		t.Fatalf("LockWithTimeout() failed: %v", err)
+	}
+	if err := s.Unlock("foo"); err != nil {
+		t.Fatalf("Unlock() failed: %v", err)
+	}
+
+	// A reader on another host is only stale when it isn't refreshed.
+	fn := addReader(lockOwner{PID: 1, Host: "remote." + hostname(), TS: time.Now()})
+	if err := s.LockWithTimeout("foo", 300*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("LockWithTimeout() = %v, want DeadlineExceeded", err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(fn, old, old); err != nil {
+		t.Fatalf("os.Chtimes: %v", err)
+	}
+	if err := s.LockWithTimeout("foo", 5*time.Second); err != nil {
+		t.Fatalf("LockWithTimeout() failed: %v", err)
+	}
+	if err := s.Unlock("foo"); err != nil {
+		t.Fatalf("Unlock() failed: %v", err)
+	}
+}
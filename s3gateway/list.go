@@ -0,0 +1,221 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package s3gateway
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxKeys is the maximum number of keys that are returned by ListObjects.
+const maxKeys = 1000
+
+type object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Marker                *string        `xml:"Marker"`
+	NextMarker            string         `xml:"NextMarker,omitempty"`
+	KeyCount              *int           `xml:"KeyCount"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	Contents              []object       `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+// listEntry is a key or a common prefix.
+type listEntry struct {
+	key    string
+	prefix bool
+}
+
+func (h *handler) listObjects(w http.ResponseWriter, req *http.Request, bucket string) error {
+	if err := h.checkBucket(bucket); err != nil {
+		return err
+	}
+	q := req.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	result := listBucketResult{
+		Name:      bucket,
+		Prefix:    q.Get("prefix"),
+		Delimiter: q.Get("delimiter"),
+		MaxKeys:   maxKeys,
+	}
+	if s := q.Get("max-keys"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return errInvalidArgument
+		}
+		result.MaxKeys = min(n, maxKeys)
+	}
+	var after string
+	if v2 {
+		result.StartAfter = q.Get("start-after")
+		result.ContinuationToken = q.Get("continuation-token")
+		after = result.StartAfter
+		if result.ContinuationToken != "" {
+			b, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+			if err != nil {
+				return errInvalidArgument
+			}
+			after = string(b)
+		}
+	} else {
+		marker := q.Get("marker")
+		result.Marker = &marker
+		after = marker
+	}
+
+	entries, err := h.walkBucket(bucket, result.Prefix, result.Delimiter)
+	if err != nil {
+		return err
+	}
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].key > after })
+	entries = entries[i:]
+	if len(entries) > result.MaxKeys {
+		entries = entries[:result.MaxKeys]
+		result.IsTruncated = true
+	}
+	for _, e := range entries {
+		if e.prefix {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: e.key})
+			continue
+		}
+		fi, err := h.fsys.Stat(bucket + "/" + e.key)
+		if err != nil {
+			// The file was deleted, or it isn't a file that can be
+			// read, e.g. a record file.
+			continue
+		}
+		result.Contents = append(result.Contents, object{
+			Key:          e.key,
+			LastModified: fi.ModTime().UTC().Format(timeFormat),
+			ETag:         etag(fi),
+			Size:         fi.Size(),
+			StorageClass: "STANDARD",
+		})
+	}
+	if result.IsTruncated {
+		last := entries[len(entries)-1].key
+		if v2 {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		} else {
+			result.NextMarker = last
+		}
+	}
+	if v2 {
+		n := len(result.Contents) + len(result.CommonPrefixes)
+		result.KeyCount = &n
+	}
+	return writeXML(w, http.StatusOK, result)
+}
+
+// walkBucket returns the sorted keys of the bucket that start with prefix,
+// and their common prefixes up to the first delimiter after prefix.
+func (h *handler) walkBucket(bucket, prefix, delimiter string) ([]listEntry, error) {
+	root := bucket
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		root = path.Join(bucket, prefix[:i])
+		if !fs.ValidPath(root) {
+			return nil, nil
+		}
+	}
+	var entries []listEntry
+	prefixes := make(map[string]bool)
+	// add adds a key, or its common prefix, and returns true if it is a
+	// common prefix.
+	add := func(key string) bool {
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				p := key[:len(prefix)+i+len(delimiter)]
+				if !prefixes[p] {
+					prefixes[p] = true
+					entries = append(entries, listEntry{key: p, prefix: true})
+				}
+				return true
+			}
+		}
+		entries = append(entries, listEntry{key: key})
+		return false
+	}
+	err := fs.WalkDir(h.fsys, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if p == bucket {
+			return nil
+		}
+		key := strings.TrimPrefix(p, bucket+"/")
+		if !d.IsDir() {
+			if strings.HasPrefix(key, prefix) {
+				add(key)
+			}
+			return nil
+		}
+		key += "/"
+		switch {
+		case strings.HasPrefix(key, prefix):
+			// All the keys in this directory have the same common
+			// prefix when the delimiter is in the directory name.
+			if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+				add(key)
+				return fs.SkipDir
+			}
+		case !strings.HasPrefix(prefix, key):
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries, nil
+}
@@ -0,0 +1,396 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package s3gateway serves the blobs of an encrypted storage with a minimal
+// S3-compatible API, so that existing S3 clients can store data that is
+// encrypted at rest.
+//
+// The top-level directories of the storage are the buckets, and the objects
+// are the files inside them. The supported operations are ListBuckets,
+// CreateBucket, HeadBucket, ListObjects (V1 and V2), GetObject with Range,
+// HeadObject, PutObject, and DeleteObject. Multipart uploads, versioning, and
+// object metadata aren't supported. The buckets are addressed with path-style
+// URLs, e.g. http://localhost:9000/bucket/key.
+//
+// The requests are authenticated with AWS Signature Version 4 when
+// credentials are specified, including the presigned URLs and the streaming
+// uploads of the AWS SDKs.
+//
+// Example:
+//
+//	h := s3gateway.NewHandler(s,
+//		s3gateway.WithCredentials(s3gateway.StaticCredentials(accessKey, secretKey)),
+//	)
+//	http.ListenAndServe(":9000", h)
+package s3gateway
+
+import (
+	"crypto/subtle"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+)
+
+// CredentialsFunc returns the secret key of an access key. It returns false
+// if the access key is unknown.
+type CredentialsFunc func(accessKey string) (secretKey string, ok bool)
+
+// Option is used to specify optional parameters of the Handler.
+type Option func(*option)
+
+type option struct {
+	credentials CredentialsFunc
+	readOnly    bool
+	logger      func(*http.Request, error)
+}
+
+// WithCredentials specifies the credentials that are used to authenticate
+// the requests. Without it, all the requests are allowed.
+func WithCredentials(fn CredentialsFunc) Option {
+	return func(opt *option) {
+		opt.credentials = fn
+	}
+}
+
+// WithReadOnly specifies that the requests that would modify the storage
+// must be rejected.
+func WithReadOnly() Option {
+	return func(opt *option) {
+		opt.readOnly = true
+	}
+}
+
+// WithLogger specifies a function that is called after every request, with
+// the error, if any.
+func WithLogger(fn func(*http.Request, error)) Option {
+	return func(opt *option) {
+		opt.logger = fn
+	}
+}
+
+// StaticCredentials returns a CredentialsFunc that accepts a single access
+// key.
+func StaticCredentials(accessKey, secretKey string) CredentialsFunc {
+	return func(key string) (string, bool) {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(accessKey)) != 1 {
+			return "", false
+		}
+		return secretKey, true
+	}
+}
+
+// NewHandler returns an http.Handler that serves s with an S3-compatible API.
+func NewHandler(s *storage.Storage, opts ...Option) http.Handler {
+	var opt option
+	for _, o := range opts {
+		o(&opt)
+	}
+	return &handler{opt: opt, s: s, fsys: s.FS()}
+}
+
+type handler struct {
+	opt  option
+	s    *storage.Storage
+	fsys *storage.FS
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	err := h.serve(w, req)
+	if err != nil {
+		writeError(w, req, err)
+	}
+	if h.opt.logger != nil {
+		h.opt.logger(req, err)
+	}
+}
+
+func (h *handler) serve(w http.ResponseWriter, req *http.Request) error {
+	var sig *signature
+	if h.opt.credentials != nil {
+		var err error
+		if sig, err = h.authenticate(req, time.Now()); err != nil {
+			return err
+		}
+	}
+	if h.opt.readOnly {
+		switch req.Method {
+		case http.MethodGet, http.MethodHead:
+		default:
+			return errAccessDenied
+		}
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	switch {
+	case bucket == "" && req.Method == http.MethodGet:
+		return h.listBuckets(w)
+	case bucket == "":
+	case key == "" && req.Method == http.MethodHead:
+		return h.headBucket(bucket)
+	case key == "" && req.Method == http.MethodGet:
+		return h.listObjects(w, req, bucket)
+	case key == "" && req.Method == http.MethodPut:
+		return h.createBucket(bucket)
+	case key == "":
+	case req.Method == http.MethodGet, req.Method == http.MethodHead:
+		return h.getObject(w, req, bucket, key)
+	case req.Method == http.MethodPut:
+		return h.putObject(w, req, sig, bucket, key)
+	case req.Method == http.MethodDelete:
+		return h.deleteObject(w, bucket, key)
+	}
+	return errNotImplemented
+}
+
+// bucketNameRE matches the valid bucket names.
+var bucketNameRE = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// objectName returns the name of the file of an object.
+func objectName(bucket, key string) (string, error) {
+	name := bucket + "/" + key
+	if !bucketNameRE.MatchString(bucket) || !fs.ValidPath(name) || storage.IsInternalFile(name) {
+		return "", errInvalidObjectName
+	}
+	return name, nil
+}
+
+// checkBucket returns an error if the bucket doesn't exist.
+func (h *handler) checkBucket(bucket string) error {
+	if !bucketNameRE.MatchString(bucket) || storage.IsInternalFile(bucket) {
+		return errNoSuchBucket
+	}
+	fi, err := h.fsys.Stat(bucket)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && !fi.IsDir()) {
+		return errNoSuchBucket
+	}
+	return err
+}
+
+// etag returns the entity tag of an object. It is derived from the size and
+// modification time of the object, not from its content.
+func etag(fi fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
+
+func (h *handler) listBuckets(w http.ResponseWriter) error {
+	entries, err := h.fsys.ReadDir(".")
+	if err != nil {
+		return err
+	}
+	result := listAllMyBucketsResult{Owner: owner{ID: "storage", DisplayName: "storage"}}
+	for _, e := range entries {
+		if !e.IsDir() || !bucketNameRE.MatchString(e.Name()) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return err
+		}
+		result.Buckets = append(result.Buckets, bucketInfo{Name: e.Name(), CreationDate: fi.ModTime().UTC().Format(timeFormat)})
+	}
+	return writeXML(w, http.StatusOK, result)
+}
+
+func (h *handler) headBucket(bucket string) error {
+	return h.checkBucket(bucket)
+}
+
+func (h *handler) createBucket(bucket string) error {
+	if !bucketNameRE.MatchString(bucket) || storage.IsInternalFile(bucket) {
+		return errInvalidBucketName
+	}
+	if err := h.checkBucket(bucket); err == nil {
+		return errBucketAlreadyOwnedByYou
+	}
+	return h.s.MkdirAll(bucket)
+}
+
+func (h *handler) getObject(w http.ResponseWriter, req *http.Request, bucket, key string) error {
+	name, err := objectName(bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := h.checkBucket(bucket); err != nil {
+		return err
+	}
+	f, err := h.fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	rs, ok := f.(io.ReadSeeker)
+	if fi.IsDir() || !ok {
+		return errNoSuchKey
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", etag(fi))
+	http.ServeContent(w, req, "", fi.ModTime(), rs)
+	return nil
+}
+
+func (h *handler) putObject(w http.ResponseWriter, req *http.Request, sig *signature, bucket, key string) (retErr error) {
+	if req.Header.Get("X-Amz-Copy-Source") != "" {
+		return errNotImplemented
+	}
+	name, err := objectName(bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := h.checkBucket(bucket); err != nil {
+		return err
+	}
+	body, err := payload(req, sig)
+	if err != nil {
+		return err
+	}
+	bw, err := h.s.CreateBlob(filepath.FromSlash(name))
+	if err != nil {
+		return err
+	}
+	defer bw.Abort()
+	if _, err := io.Copy(bw, body); err != nil {
+		return err
+	}
+	if err := bw.Commit(); err != nil {
+		return err
+	}
+	fi, err := h.fsys.Stat(name)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", etag(fi))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (h *handler) deleteObject(w http.ResponseWriter, bucket, key string) error {
+	name, err := objectName(bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := h.checkBucket(bucket); err != nil {
+		return err
+	}
+	if err := h.s.DeleteFile(filepath.FromSlash(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// s3Error is an error response.
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string {
+	return e.code + ": " + e.message
+}
+
+var (
+	errAccessDenied            = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errBadDigest               = &s3Error{http.StatusBadRequest, "BadDigest", "The content doesn't match its checksum"}
+	errBucketAlreadyOwnedByYou = &s3Error{http.StatusConflict, "BucketAlreadyOwnedByYou", "The bucket already exists"}
+	errIncompleteBody          = &s3Error{http.StatusBadRequest, "IncompleteBody", "The request body is malformed or incomplete"}
+	errInvalidAccessKeyID      = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key doesn't exist"}
+	errInvalidArgument         = &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid argument"}
+	errInvalidBucketName       = &s3Error{http.StatusBadRequest, "InvalidBucketName", "The bucket name isn't valid"}
+	errInvalidObjectName       = &s3Error{http.StatusBadRequest, "InvalidArgument", "The object key isn't supported"}
+	errNoSuchBucket            = &s3Error{http.StatusNotFound, "NoSuchBucket", "The bucket doesn't exist"}
+	errNoSuchKey               = &s3Error{http.StatusNotFound, "NoSuchKey", "The key doesn't exist"}
+	errNotImplemented          = &s3Error{http.StatusNotImplemented, "NotImplemented", "The operation isn't implemented"}
+	errRequestExpired          = &s3Error{http.StatusForbidden, "AccessDenied", "The request has expired"}
+	errRequestTimeTooSkewed    = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+	errSignatureDoesNotMatch   = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature doesn't match"}
+	errInternalError           = &s3Error{http.StatusInternalServerError, "InternalError", "Internal error"}
+)
+
+type errorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+// writeError writes the error response of err.
+func writeError(w http.ResponseWriter, req *http.Request, err error) {
+	var e *s3Error
+	switch {
+	case errors.As(err, &e):
+	case errors.Is(err, fs.ErrNotExist):
+		e = errNoSuchKey
+	default:
+		e = errInternalError
+	}
+	if req.Method == http.MethodHead {
+		w.WriteHeader(e.status)
+		return
+	}
+	writeXML(w, e.status, errorResponse{Code: e.code, Message: e.message, Resource: req.URL.Path})
+}
+
+// writeXML writes an XML response.
+func writeXML(w http.ResponseWriter, status int, v any) error {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	_, err = w.Write(b)
+	return err
+}
+
+// timeFormat is the format of the timestamps in the responses.
+const timeFormat = "2006-01-02T15:04:05.000Z"
+
+type owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type bucketInfo struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name     `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   owner        `xml:"Owner"`
+	Buckets []bucketInfo `xml:"Buckets>Bucket"`
+}
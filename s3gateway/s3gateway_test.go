@@ -0,0 +1,441 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package s3gateway_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage/internal/storagetest"
+	"github.com/c2FmZQ/storage/s3gateway"
+)
+
+const (
+	accessKey = "access"
+	secretKey = "secret"
+)
+
+// do sends a request to h, and returns the response.
+func do(t *testing.T, h http.Handler, method, target string, body []byte, hdr ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	for i := 0; i+1 < len(hdr); i += 2 {
+		req.Header.Set(hdr[i], hdr[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// errorCode returns the error code of a response.
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var e struct {
+		Code string `xml:"Code"`
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &e); err != nil {
+		t.Fatalf("xml.Unmarshal(%q): %v", w.Body, err)
+	}
+	return e.Code
+}
+
+func TestObjects(t *testing.T) {
+	h := s3gateway.NewHandler(storagetest.New(t))
+
+	if w := do(t, h, "PUT", "/bucket/foo", []byte("foo")); w.Code != 404 || errorCode(t, w) != "NoSuchBucket" {
+		t.Errorf("PutObject = %d %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "PUT", "/bucket", nil); w.Code != 200 {
+		t.Fatalf("CreateBucket = %d %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "PUT", "/bucket", nil); w.Code != 409 {
+		t.Errorf("CreateBucket = %d %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "PUT", "/Bad_Name", nil); w.Code != 400 {
+		t.Errorf("CreateBucket = %d %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "HEAD", "/bucket", nil); w.Code != 200 {
+		t.Errorf("HeadBucket = %d", w.Code)
+	}
+
+	content := []byte("Hello, world!")
+	w := do(t, h, "PUT", "/bucket/dir/hello.txt", content)
+	if w.Code != 200 || w.Header().Get("ETag") == "" {
+		t.Fatalf("PutObject = %d %s", w.Code, w.Body)
+	}
+	etag := w.Header().Get("ETag")
+
+	if w := do(t, h, "GET", "/bucket/dir/hello.txt", nil); w.Code != 200 || !bytes.Equal(w.Body.Bytes(), content) || w.Header().Get("ETag") != etag {
+		t.Errorf("GetObject = %d %q %s", w.Code, w.Body, w.Header())
+	}
+	if w := do(t, h, "GET", "/bucket/dir/hello.txt", nil, "Range", "bytes=7-11"); w.Code != 206 || w.Body.String() != "world" {
+		t.Errorf("GetObject(Range) = %d %q", w.Code, w.Body)
+	}
+	if w := do(t, h, "HEAD", "/bucket/dir/hello.txt", nil); w.Code != 200 || w.Header().Get("Content-Length") != "13" {
+		t.Errorf("HeadObject = %d %s", w.Code, w.Header())
+	}
+	if w := do(t, h, "GET", "/bucket/dir/hello.txt", nil, "If-None-Match", etag); w.Code != 304 {
+		t.Errorf("GetObject(If-None-Match) = %d", w.Code)
+	}
+	if w := do(t, h, "GET", "/bucket/dir", nil); w.Code != 404 || errorCode(t, w) != "NoSuchKey" {
+		t.Errorf("GetObject(dir) = %d %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "PUT", "/bucket/foo.lock", []byte("x")); w.Code != 400 {
+		t.Errorf("PutObject(foo.lock) = %d %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "PUT", "/bucket/dir/copy", nil, "X-Amz-Copy-Source", "/bucket/dir/hello.txt"); w.Code != 501 {
+		t.Errorf("CopyObject = %d %s", w.Code, w.Body)
+	}
+
+	var buckets struct {
+		Names []string `xml:"Buckets>Bucket>Name"`
+	}
+	w = do(t, h, "GET", "/", nil)
+	if err := xml.Unmarshal(w.Body.Bytes(), &buckets); err != nil || len(buckets.Names) != 1 || buckets.Names[0] != "bucket" {
+		t.Errorf("ListBuckets = %v, %v", buckets.Names, err)
+	}
+
+	if w := do(t, h, "DELETE", "/bucket/dir/hello.txt", nil); w.Code != 204 {
+		t.Errorf("DeleteObject = %d %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "DELETE", "/bucket/dir/hello.txt", nil); w.Code != 204 {
+		t.Errorf("DeleteObject = %d %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "GET", "/bucket/dir/hello.txt", nil); w.Code != 404 {
+		t.Errorf("GetObject = %d %s", w.Code, w.Body)
+	}
+}
+
+type listResult struct {
+	Keys                  []string `xml:"Contents>Key"`
+	Prefixes              []string `xml:"CommonPrefixes>Prefix"`
+	IsTruncated           bool     `xml:"IsTruncated"`
+	NextContinuationToken string   `xml:"NextContinuationToken"`
+	NextMarker            string   `xml:"NextMarker"`
+}
+
+func list(t *testing.T, h http.Handler, query string) listResult {
+	t.Helper()
+	w := do(t, h, "GET", "/bucket?"+query, nil)
+	if w.Code != 200 {
+		t.Fatalf("ListObjects(%q) = %d %s", query, w.Code, w.Body)
+	}
+	var r listResult
+	if err := xml.Unmarshal(w.Body.Bytes(), &r); err != nil {
+		t.Fatalf("xml.Unmarshal: %v", err)
+	}
+	return r
+}
+
+func TestListObjects(t *testing.T) {
+	h := s3gateway.NewHandler(storagetest.New(t))
+	if w := do(t, h, "PUT", "/bucket", nil); w.Code != 200 {
+		t.Fatalf("CreateBucket = %d %s", w.Code, w.Body)
+	}
+	for _, k := range []string{"a/1", "a/2", "a-b", "b", "c/d/e"} {
+		if w := do(t, h, "PUT", "/bucket/"+k, []byte(k)); w.Code != 200 {
+			t.Fatalf("PutObject(%q) = %d %s", k, w.Code, w.Body)
+		}
+	}
+
+	for _, tc := range []struct {
+		query    string
+		keys     []string
+		prefixes []string
+	}{
+		{"list-type=2", []string{"a-b", "a/1", "a/2", "b", "c/d/e"}, nil},
+		{"list-type=2&delimiter=/", []string{"a-b", "b"}, []string{"a/", "c/"}},
+		{"list-type=2&prefix=a/", []string{"a/1", "a/2"}, nil},
+		{"list-type=2&prefix=a", []string{"a-b", "a/1", "a/2"}, nil},
+		{"list-type=2&prefix=c/&delimiter=/", nil, []string{"c/d/"}},
+		{"list-type=2&prefix=x/", nil, nil},
+		{"list-type=2&start-after=a/2", []string{"b", "c/d/e"}, nil},
+		{"marker=b", []string{"c/d/e"}, nil},
+	} {
+		r := list(t, h, tc.query)
+		if fmt.Sprint(r.Keys) != fmt.Sprint(tc.keys) || fmt.Sprint(r.Prefixes) != fmt.Sprint(tc.prefixes) {
+			t.Errorf("ListObjects(%q) = %v %v, want %v %v", tc.query, r.Keys, r.Prefixes, tc.keys, tc.prefixes)
+		}
+	}
+
+	var keys []string
+	query := "list-type=2&max-keys=2"
+	for {
+		r := list(t, h, query)
+		keys = append(keys, r.Keys...)
+		if !r.IsTruncated {
+			break
+		}
+		query = "list-type=2&max-keys=2&continuation-token=" + url.QueryEscape(r.NextContinuationToken)
+	}
+	if got, want := fmt.Sprint(keys), "[a-b a/1 a/2 b c/d/e]"; got != want {
+		t.Errorf("Paginated keys = %v, want %v", got, want)
+	}
+	if r := list(t, h, "max-keys=3"); !r.IsTruncated || r.NextMarker != "a/2" {
+		t.Errorf("ListObjects = %+v", r)
+	}
+}
+
+// signer signs requests with AWS Signature Version 4.
+type signer struct {
+	now   time.Time
+	key   []byte
+	scope string
+}
+
+func newSigner(secret string, now time.Time) *signer {
+	date := now.UTC().Format("20060102")
+	s := &signer{now: now, key: []byte("AWS4" + secret), scope: date + "/us-east-1/s3/aws4_request"}
+	for _, v := range []string{date, "us-east-1", "s3", "aws4_request"} {
+		s.key = s.hmac(v)
+	}
+	return s
+}
+
+func (s *signer) hmac(data string) []byte {
+	m := hmac.New(sha256.New, s.key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+func (s *signer) sign(lines ...string) string {
+	return hex.EncodeToString(s.hmac(strings.Join(lines, "\n")))
+}
+
+func hashHex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// signRequest adds the Authorization header to req, and returns the
+// signature.
+func (s *signer) signRequest(req *http.Request, payloadHash string) string {
+	date := s.now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	names := []string{"host"}
+	for k := range req.Header {
+		names = append(names, strings.ToLower(k))
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, k := range names {
+		v := req.Host
+		if k != "host" {
+			v = req.Header.Get(k)
+		}
+		headers.WriteString(k + ":" + v + "\n")
+	}
+	cr := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers.String(), strings.Join(names, ";"), payloadHash}, "\n")
+	sig := s.sign("AWS4-HMAC-SHA256", date, s.scope, hashHex([]byte(cr)))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, s.scope, strings.Join(names, ";"), sig))
+	return sig
+}
+
+// chunked returns the aws-chunked encoding of chunks. The chunks are signed
+// when seed isn't empty.
+func (s *signer) chunked(seed string, chunks [][]byte, trailer string) []byte {
+	date := s.now.UTC().Format("20060102T150405Z")
+	var buf bytes.Buffer
+	prev := seed
+	for _, c := range append(chunks, nil) {
+		if seed == "" {
+			fmt.Fprintf(&buf, "%x\r\n", len(c))
+		} else {
+			prev = s.sign("AWS4-HMAC-SHA256-PAYLOAD", date, s.scope, prev, hashHex(nil), hashHex(c))
+			fmt.Fprintf(&buf, "%x;chunk-signature=%s\r\n", len(c), prev)
+		}
+		if c != nil {
+			buf.Write(c)
+			buf.WriteString("\r\n")
+		}
+	}
+	if trailer != "" {
+		buf.WriteString(trailer + "\r\n")
+		if seed != "" {
+			sig := s.sign("AWS4-HMAC-SHA256-TRAILER", date, s.scope, prev, hashHex([]byte(trailer+"\n")))
+			buf.WriteString("x-amz-trailer-signature:" + sig + "\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+func crc32IEEE(b []byte) []byte {
+	h := crc32.NewIEEE()
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+func TestAuthentication(t *testing.T) {
+	h := s3gateway.NewHandler(storagetest.New(t), s3gateway.WithCredentials(s3gateway.StaticCredentials(accessKey, secretKey)))
+	s := newSigner(secretKey, time.Now())
+
+	send := func(method, target string, body []byte, payloadHash string, hdr ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		for i := 0; i+1 < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		s.signRequest(req, payloadHash)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	get := func(key string) string {
+		t.Helper()
+		w := send("GET", "/bucket/"+key, nil, hashHex(nil))
+		if w.Code != 200 {
+			return fmt.Sprint(w.Code)
+		}
+		return w.Body.String()
+	}
+
+	if w := do(t, h, "PUT", "/bucket", nil); w.Code != 403 || errorCode(t, w) != "AccessDenied" {
+		t.Errorf("Unsigned CreateBucket = %d %s", w.Code, w.Body)
+	}
+	if w := send("PUT", "/bucket", nil, hashHex(nil)); w.Code != 200 {
+		t.Fatalf("CreateBucket = %d %s", w.Code, w.Body)
+	}
+
+	// Payload with its hash.
+	if w := send("PUT", "/bucket/foo", []byte("foo"), hashHex([]byte("foo"))); w.Code != 200 {
+		t.Errorf("PutObject = %d %s", w.Code, w.Body)
+	}
+	if got := get("foo"); got != "foo" {
+		t.Errorf("GetObject = %q, want foo", got)
+	}
+	if w := send("PUT", "/bucket/bar", []byte("bar"), hashHex([]byte("foo"))); w.Code != 400 || errorCode(t, w) != "BadDigest" {
+		t.Errorf("PutObject = %d %s", w.Code, w.Body)
+	}
+	if got := get("bar"); got != "404" {
+		t.Errorf("GetObject = %q, want 404", got)
+	}
+
+	// Signed chunks.
+	data := [][]byte{bytes.Repeat([]byte("x"), 1000), []byte("yz")}
+	req := httptest.NewRequest("PUT", "/bucket/chunked", nil)
+	req.Header.Set("Content-Encoding", "aws-chunked")
+	seed := s.signRequest(req, "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+	req.Body = io.NopCloser(bytes.NewReader(s.chunked(seed, data, "")))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Errorf("PutObject(chunked) = %d %s", w.Code, w.Body)
+	}
+	if got, want := get("chunked"), string(bytes.Join(data, nil)); got != want {
+		t.Errorf("GetObject = %q, want %q", got, want)
+	}
+
+	// Tampered chunk.
+	req = httptest.NewRequest("PUT", "/bucket/tampered", nil)
+	seed = s.signRequest(req, "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+	body := s.chunked(seed, data, "")
+	body[bytes.IndexByte(body, 'x')] = 'X'
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 403 || errorCode(t, w) != "SignatureDoesNotMatch" {
+		t.Errorf("PutObject(tampered) = %d %s", w.Code, w.Body)
+	}
+	if got := get("tampered"); got != "404" {
+		t.Errorf("GetObject = %q, want 404", got)
+	}
+
+	// Unsigned chunks, with a checksum in the trailer.
+	content := bytes.Join(data, nil)
+	for _, tc := range []struct {
+		name     string
+		seed     bool
+		checksum []byte
+		code     int
+	}{
+		{"unsigned", false, crc32IEEE(content), 200},
+		{"signed", true, crc32IEEE(content), 200},
+		{"corrupt", false, crc32IEEE([]byte("other")), 400},
+	} {
+		req = httptest.NewRequest("PUT", "/bucket/"+tc.name, nil)
+		req.Header.Set("X-Amz-Trailer", "x-amz-checksum-crc32")
+		payloadHash := "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+		if tc.seed {
+			payloadHash = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+		}
+		seed = s.signRequest(req, payloadHash)
+		if !tc.seed {
+			seed = ""
+		}
+		trailer := "x-amz-checksum-crc32:" + base64.StdEncoding.EncodeToString(tc.checksum)
+		req.Body = io.NopCloser(bytes.NewReader(s.chunked(seed, data, trailer)))
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tc.code {
+			t.Errorf("PutObject(%s) = %d %s", tc.name, w.Code, w.Body)
+		}
+		if w.Code == 200 {
+			if got := get(tc.name); got != string(content) {
+				t.Errorf("GetObject(%s) = %q", tc.name, got)
+			}
+		}
+	}
+
+	// Wrong secret.
+	s = newSigner("wrong", time.Now())
+	if w := send("GET", "/bucket/foo", nil, hashHex(nil)); w.Code != 403 || errorCode(t, w) != "SignatureDoesNotMatch" {
+		t.Errorf("GetObject = %d %s", w.Code, w.Body)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	st := storagetest.New(t)
+	if err := st.MkdirAll("bucket"); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	var logged []error
+	h := s3gateway.NewHandler(st, s3gateway.WithReadOnly(), s3gateway.WithLogger(func(_ *http.Request, err error) {
+		logged = append(logged, err)
+	}))
+	if w := do(t, h, "PUT", "/bucket/foo", []byte("foo")); w.Code != 403 {
+		t.Errorf("PutObject = %d %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "GET", "/bucket", nil); w.Code != 200 {
+		t.Errorf("ListObjects = %d %s", w.Code, w.Body)
+	}
+	if len(logged) != 2 || logged[0] == nil || logged[1] != nil {
+		t.Errorf("Logged errors = %v", logged)
+	}
+}
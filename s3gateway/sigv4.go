@@ -0,0 +1,499 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package s3gateway
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigAlgorithm   = "AWS4-HMAC-SHA256"
+	amzDateFormat  = "20060102T150405Z"
+	maxClockSkew   = 15 * time.Minute
+	maxPresignTime = 7 * 24 * time.Hour
+
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingPayloadTrailer  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+// emptyHash is the hex-encoded SHA-256 hash of an empty string.
+var emptyHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+// signature is the verified signature of a request. It is used to verify
+// the signatures of the chunks of a streaming upload.
+type signature struct {
+	key   []byte
+	date  string
+	scope string
+	sig   string
+}
+
+// authenticate verifies the signature of a request, in the Authorization
+// header, or in the query parameters of a presigned URL.
+func (h *handler) authenticate(req *http.Request, now time.Time) (*signature, error) {
+	var (
+		credential, signedHeaders, sig, date string
+		payloadHash                          string
+	)
+	query := req.URL.Query()
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		params, ok := strings.CutPrefix(auth, sigAlgorithm+" ")
+		if !ok {
+			return nil, errAccessDenied
+		}
+		for _, p := range strings.Split(params, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			switch k {
+			case "Credential":
+				credential = v
+			case "SignedHeaders":
+				signedHeaders = v
+			case "Signature":
+				sig = v
+			}
+		}
+		date = req.Header.Get("X-Amz-Date")
+		payloadHash = req.Header.Get("X-Amz-Content-Sha256")
+		t, err := time.Parse(amzDateFormat, date)
+		if err != nil {
+			return nil, errAccessDenied
+		}
+		if d := now.Sub(t); d > maxClockSkew || d < -maxClockSkew {
+			return nil, errRequestTimeTooSkewed
+		}
+	} else if query.Get("X-Amz-Algorithm") == sigAlgorithm {
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		sig = query.Get("X-Amz-Signature")
+		date = query.Get("X-Amz-Date")
+		payloadHash = unsignedPayload
+		if v := query.Get("X-Amz-Content-Sha256"); v != "" {
+			payloadHash = v
+		}
+		query.Del("X-Amz-Signature")
+		t, err := time.Parse(amzDateFormat, date)
+		if err != nil {
+			return nil, errAccessDenied
+		}
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 0 || time.Duration(expires)*time.Second > maxPresignTime {
+			return nil, errAccessDenied
+		}
+		if now.Before(t.Add(-maxClockSkew)) || now.After(t.Add(time.Duration(expires)*time.Second)) {
+			return nil, errRequestExpired
+		}
+	} else {
+		return nil, errAccessDenied
+	}
+	if payloadHash == "" || signedHeaders == "" || sig == "" {
+		return nil, errAccessDenied
+	}
+
+	// The credential is <access key>/<date>/<region>/<service>/aws4_request.
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[1] != date[:min(8, len(date))] || parts[4] != "aws4_request" {
+		return nil, errAccessDenied
+	}
+	secret, ok := h.opt.credentials(parts[0])
+	if !ok {
+		return nil, errInvalidAccessKeyID
+	}
+	s := &signature{
+		key:   signingKey(secret, parts[1], parts[2], parts[3]),
+		date:  date,
+		scope: strings.Join(parts[1:], "/"),
+	}
+	cr := canonicalRequest(req, query, strings.Split(signedHeaders, ";"), payloadHash)
+	s.sig = s.sign(sigAlgorithm, sha256Hex([]byte(cr)))
+	if !hmac.Equal([]byte(s.sig), []byte(sig)) {
+		return nil, errSignatureDoesNotMatch
+	}
+	return s, nil
+}
+
+// sign returns the signature of a string to sign that ends with lines.
+func (s *signature) sign(algorithm string, lines ...string) string {
+	sts := strings.Join(append([]string{algorithm, s.date, s.scope}, lines...), "\n")
+	return hex.EncodeToString(hmacSHA256(s.key, sts))
+}
+
+// signingKey derives the signing key of a request.
+func signingKey(secret, date, region, service string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), date)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, service)
+	return hmacSHA256(k, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// canonicalRequest returns the canonical form of a request that is signed.
+func canonicalRequest(req *http.Request, query url.Values, signedHeaders []string, payloadHash string) string {
+	var queryParams []string
+	for k, values := range query {
+		for _, v := range values {
+			queryParams = append(queryParams, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(queryParams)
+
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		var values []string
+		if name == "host" {
+			values = []string{req.Host}
+		} else {
+			values = req.Header.Values(name)
+		}
+		for i, v := range values {
+			values[i] = strings.Join(strings.Fields(v), " ")
+		}
+		headers.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+	return strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		strings.Join(queryParams, "&"),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// uriEncode encodes s the way it is encoded in the canonical requests. The
+// slashes are encoded only when encodeSlash is true.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// checksums are the hash functions of the x-amz-checksum-* headers.
+var checksums = map[string]func() hash.Hash{
+	"x-amz-checksum-crc32":     func() hash.Hash { return crc32.NewIEEE() },
+	"x-amz-checksum-crc32c":    func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	"x-amz-checksum-crc64nvme": func() hash.Hash { return crc64.New(crc64.MakeTable(0x9a6c9329ac4bc9b5)) },
+	"x-amz-checksum-sha1":      sha1.New,
+	"x-amz-checksum-sha256":    sha256.New,
+	"content-md5":              md5.New,
+}
+
+// payload returns the content of the body of a request. The content is
+// verified against the checksums of the request, and against the signatures
+// of the chunks of a streaming upload. The reader returns an error at the
+// end of the content if it can't be verified.
+func payload(req *http.Request, sig *signature) (io.Reader, error) {
+	pr := &payloadReader{r: req.Body}
+	switch ph := req.Header.Get("X-Amz-Content-Sha256"); ph {
+	case streamingPayload, streamingPayloadTrailer, streamingUnsignedTrailer:
+		cr := &chunkedReader{
+			r:       bufio.NewReader(req.Body),
+			trailer: ph != streamingPayload,
+		}
+		if ph != streamingUnsignedTrailer && sig != nil {
+			cr.sig, cr.prev = sig, sig.sig
+		}
+		pr.r, pr.trailer = cr, cr
+		if t := strings.ToLower(req.Header.Get("X-Amz-Trailer")); t != "" {
+			if _, ok := checksums[t]; !ok || !cr.trailer {
+				return nil, errInvalidArgument
+			}
+			pr.add(t, "")
+		}
+	case "", unsignedPayload:
+	default:
+		want, err := hex.DecodeString(ph)
+		if err != nil {
+			return nil, errInvalidArgument
+		}
+		pr.sums = append(pr.sums, sum{name: "x-amz-content-sha256", h: sha256.New(), want: want})
+	}
+	for name := range checksums {
+		if v := req.Header.Get(name); v != "" {
+			if err := pr.add(name, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return pr, nil
+}
+
+// sum is a checksum of the payload.
+type sum struct {
+	name string
+	h    hash.Hash
+	want []byte
+}
+
+// payloadReader verifies the checksums of a payload.
+type payloadReader struct {
+	r       io.Reader
+	sums    []sum
+	trailer *chunkedReader
+	err     error
+}
+
+// add adds a checksum. An empty value means that the value is in the
+// trailer.
+func (pr *payloadReader) add(name, value string) error {
+	s := sum{name: name, h: checksums[name]()}
+	if value != "" {
+		var err error
+		if s.want, err = base64.StdEncoding.DecodeString(value); err != nil {
+			return errInvalidArgument
+		}
+	}
+	pr.sums = append(pr.sums, s)
+	return nil
+}
+
+func (pr *payloadReader) Read(b []byte) (int, error) {
+	if pr.err != nil {
+		return 0, pr.err
+	}
+	n, err := pr.r.Read(b)
+	for _, s := range pr.sums {
+		s.h.Write(b[:n])
+	}
+	if errors.Is(err, io.EOF) {
+		err = pr.verify()
+	}
+	pr.err = err
+	return n, err
+}
+
+// verify verifies the checksums at the end of the payload.
+func (pr *payloadReader) verify() error {
+	for _, s := range pr.sums {
+		want := s.want
+		if want == nil {
+			var err error
+			if want, err = base64.StdEncoding.DecodeString(pr.trailer.trailers.Get(s.name)); err != nil || len(want) == 0 {
+				return errBadDigest
+			}
+		}
+		if !bytes.Equal(s.h.Sum(nil), want) {
+			return errBadDigest
+		}
+	}
+	return io.EOF
+}
+
+// chunkedReader decodes the aws-chunked encoding of the streaming uploads.
+// Each chunk is "<hex size>[;chunk-signature=<sig>]\r\n<data>\r\n". The
+// last chunk is empty, and it is followed by the trailers, if any.
+type chunkedReader struct {
+	r       *bufio.Reader
+	sig     *signature
+	prev    string
+	trailer bool
+
+	// The remaining data of the current chunk.
+	n        int64
+	chunkSig string
+	h        hash.Hash
+	eof      bool
+	trailers http.Header
+}
+
+// maxLineSize is the maximum size of the chunk headers and of the trailers.
+const maxLineSize = 4096
+
+func (cr *chunkedReader) Read(b []byte) (int, error) {
+	if cr.eof {
+		return 0, io.EOF
+	}
+	if cr.n == 0 {
+		if err := cr.nextChunk(); err != nil {
+			return 0, err
+		}
+		if cr.eof {
+			return 0, io.EOF
+		}
+	}
+	if int64(len(b)) > cr.n {
+		b = b[:cr.n]
+	}
+	n, err := cr.r.Read(b)
+	cr.n -= int64(n)
+	if cr.h != nil {
+		cr.h.Write(b[:n])
+	}
+	if errors.Is(err, io.EOF) {
+		err = errIncompleteBody
+	}
+	if err == nil && cr.n == 0 {
+		err = cr.endChunk()
+	}
+	return n, err
+}
+
+// readLine reads a line that ends with \r\n.
+func (cr *chunkedReader) readLine() (string, error) {
+	var line []byte
+	for {
+		b, isPrefix, err := cr.r.ReadLine()
+		if err != nil {
+			return "", errIncompleteBody
+		}
+		if line = append(line, b...); len(line) > maxLineSize {
+			return "", errIncompleteBody
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// nextChunk reads the header of the next chunk.
+func (cr *chunkedReader) nextChunk() error {
+	line, err := cr.readLine()
+	if err != nil {
+		return err
+	}
+	size, ext, _ := strings.Cut(line, ";")
+	if cr.n, err = strconv.ParseInt(size, 16, 64); err != nil || cr.n < 0 {
+		return errIncompleteBody
+	}
+	if cr.sig != nil {
+		var ok bool
+		if cr.chunkSig, ok = strings.CutPrefix(ext, "chunk-signature="); !ok {
+			return errSignatureDoesNotMatch
+		}
+		cr.h = sha256.New()
+	}
+	if cr.n == 0 {
+		return cr.end()
+	}
+	return nil
+}
+
+// endChunk verifies the signature of the chunk, and reads its terminating
+// \r\n.
+func (cr *chunkedReader) endChunk() error {
+	if err := cr.verifyChunk(); err != nil {
+		return err
+	}
+	if line, err := cr.readLine(); err != nil || line != "" {
+		return errIncompleteBody
+	}
+	return nil
+}
+
+func (cr *chunkedReader) verifyChunk() error {
+	if cr.sig == nil {
+		return nil
+	}
+	sig := cr.sig.sign(sigAlgorithm+"-PAYLOAD", cr.prev, emptyHash, hex.EncodeToString(cr.h.Sum(nil)))
+	if !hmac.Equal([]byte(sig), []byte(cr.chunkSig)) {
+		return errSignatureDoesNotMatch
+	}
+	cr.prev = sig
+	return nil
+}
+
+// end verifies the last chunk, and reads the trailers.
+func (cr *chunkedReader) end() error {
+	if err := cr.verifyChunk(); err != nil {
+		return err
+	}
+	cr.trailers = make(http.Header)
+	var signed strings.Builder
+	var trailerSig string
+	for {
+		line, err := cr.readLine()
+		if err != nil {
+			// Some clients don't send the final \r\n without
+			// trailers.
+			if !cr.trailer && len(cr.trailers) == 0 {
+				break
+			}
+			return err
+		}
+		if line == "" {
+			break
+		}
+		if !cr.trailer {
+			return errIncompleteBody
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			return errIncompleteBody
+		}
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		if k == "x-amz-trailer-signature" {
+			trailerSig = v
+			continue
+		}
+		cr.trailers.Add(k, v)
+		signed.WriteString(k + ":" + v + "\n")
+	}
+	if cr.sig != nil && cr.trailer {
+		sig := cr.sig.sign(sigAlgorithm+"-TRAILER", cr.prev, sha256Hex([]byte(signed.String())))
+		if !hmac.Equal([]byte(sig), []byte(trailerSig)) {
+			return errSignatureDoesNotMatch
+		}
+	}
+	cr.eof = true
+	return nil
+}
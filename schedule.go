@@ -0,0 +1,247 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// generationFormat is the format of the names of backup generations. They
+// sort chronologically.
+const generationFormat = "20060102T150405.000000000Z"
+
+// BackupOption is used to specify optional parameters of scheduled backups.
+type BackupOption func(*backupOption)
+
+type backupOption struct {
+	generations int
+	incremental bool
+}
+
+// WithGenerations specifies the number of backup generations to keep. The
+// default is 7.
+func WithGenerations(n int) BackupOption {
+	return func(opt *backupOption) {
+		opt.generations = n
+	}
+}
+
+// WithIncrementalBackups specifies that the files that didn't change since
+// the previous generation should be hard-linked instead of copied, when the
+// target Backend supports hard links. Every generation is still a complete
+// copy of the storage.
+func WithIncrementalBackups() BackupOption {
+	return func(opt *backupOption) {
+		opt.incremental = true
+	}
+}
+
+// BackupStatus is the status of scheduled backups.
+type BackupStatus struct {
+	// LastBackup is the time of the last successful backup.
+	LastBackup time.Time
+	// LastGeneration is the name of the last generation that was created.
+	LastGeneration string
+	// Err is the error of the last backup attempt, if any.
+	Err error
+}
+
+// BackupScheduler takes snapshots of a storage periodically, and keeps a
+// fixed number of generations. See StartBackups.
+type BackupScheduler struct {
+	s        *Storage
+	dst      Backend
+	dir      string
+	interval time.Duration
+	opt      backupOption
+
+	// mu serializes the backups.
+	mu sync.Mutex
+
+	statusMu sync.Mutex
+	status   BackupStatus
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// StartBackups starts taking a snapshot of the storage every interval. Each
+// snapshot is a generation in its own subdirectory of dir in dst, named
+// after the UTC time when it was taken, with a manifest of its files next to
+// it. The snapshots are crash-consistent, see Snapshot. A nil dst means the
+// local filesystem.
+//
+// The first backup is taken after interval. Call BackupNow to take one
+// immediately.
+func (s *Storage) StartBackups(dst Backend, dir string, interval time.Duration, opts ...BackupOption) *BackupScheduler {
+	if dst == nil {
+		dst = osBackend{}
+	}
+	b := &BackupScheduler{
+		s:        s,
+		dst:      dst,
+		dir:      dir,
+		interval: interval,
+		opt:      backupOption{generations: 7},
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(&b.opt)
+	}
+	go b.run()
+	return b
+}
+
+// Stop stops the scheduled backups, and waits for a backup in progress to
+// finish.
+func (b *BackupScheduler) Stop() {
+	b.closeOnce.Do(func() { close(b.done) })
+	<-b.stopped
+}
+
+// Status returns the status of the backups.
+func (b *BackupScheduler) Status() BackupStatus {
+	b.statusMu.Lock()
+	defer b.statusMu.Unlock()
+	return b.status
+}
+
+// Generations returns the names of the generations that exist in the target
+// directory, oldest first.
+func (b *BackupScheduler) Generations() ([]string, error) {
+	entries, err := b.dst.ReadDir(b.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var gens []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(generationFormat, e.Name()); err != nil {
+			continue
+		}
+		gens = append(gens, e.Name())
+	}
+	slices.Sort(gens)
+	return gens, nil
+}
+
+// Manifest returns the manifest of a generation.
+func (b *BackupScheduler) Manifest(generation string) (*Manifest, error) {
+	return loadManifest(b.dst, filepath.Join(b.dir, generation+".json"))
+}
+
+// BackupNow takes a snapshot, deletes the generations in excess, and returns
+// the name of the new generation.
+func (b *BackupScheduler) BackupNow() (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	gen, err := b.backup()
+	b.statusMu.Lock()
+	defer b.statusMu.Unlock()
+	if b.status.Err = err; gen != "" {
+		b.status.LastBackup = time.Now()
+		b.status.LastGeneration = gen
+	}
+	return gen, err
+}
+
+func (b *BackupScheduler) run() {
+	defer close(b.stopped)
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		}
+		if _, err := b.BackupNow(); err != nil {
+			b.s.Logger().Errorf("Backup: %v", err)
+		}
+	}
+}
+
+func (b *BackupScheduler) backup() (string, error) {
+	if err := b.dst.MkdirAll(b.dir, 0o700); err != nil {
+		return "", err
+	}
+	gens, err := b.Generations()
+	if err != nil {
+		return "", err
+	}
+	var prev *Manifest
+	var prevDir string
+	if b.opt.incremental && len(gens) > 0 {
+		last := gens[len(gens)-1]
+		// Without a manifest, all the files are copied.
+		if m, err := b.Manifest(last); err == nil {
+			prev, prevDir = m, filepath.Join(b.dir, last)
+		}
+	}
+	gen := time.Now().UTC().Format(generationFormat)
+	m, err := b.s.snapshot(b.dst, filepath.Join(b.dir, gen), prev, prevDir)
+	if err != nil {
+		return "", err
+	}
+	if err := saveManifest(b.dst, filepath.Join(b.dir, gen+".json"), m); err != nil {
+		return gen, err
+	}
+
+	// Delete the oldest generations.
+	gens = append(gens, gen)
+	var errs []error
+	for len(gens) > max(b.opt.generations, 1) {
+		old := gens[0]
+		gens = gens[1:]
+		if err := b.dst.RemoveAll(filepath.Join(b.dir, old)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := b.dst.Remove(filepath.Join(b.dir, old+".json")); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	// Clean up the snapshots that were interrupted.
+	if entries, err := b.dst.ReadDir(b.dir); err == nil {
+		for _, e := range entries {
+			if name := e.Name(); e.IsDir() && strings.Contains(name, ".tmp-") && !strings.HasPrefix(name, gen) {
+				b.dst.RemoveAll(filepath.Join(b.dir, name))
+			}
+		}
+	}
+	return gen, errors.Join(errs...)
+}
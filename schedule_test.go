@@ -0,0 +1,118 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupScheduler(t *testing.T) {
+	mk := aesEncryptionKey()
+	s := New(t.TempDir(), mk)
+	target := t.TempDir()
+	b := s.StartBackups(nil, target, time.Hour, WithGenerations(2), WithIncrementalBackups())
+	defer b.Stop()
+
+	if err := s.SaveDataFile("foo", "foo"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	if err := s.SaveDataFile("bar", "bar1"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	var gens []string
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			if err := s.SaveDataFile("bar", "bar2"); err != nil {
+				t.Fatalf("s.SaveDataFile: %v", err)
+			}
+		}
+		gen, err := b.BackupNow()
+		if err != nil {
+			t.Fatalf("BackupNow: %v", err)
+		}
+		gens = append(gens, gen)
+	}
+	got, err := b.Generations()
+	if err != nil {
+		t.Fatalf("Generations: %v", err)
+	}
+	if len(got) != 2 || got[0] != gens[1] || got[1] != gens[2] {
+		t.Errorf("Generations = %v, want %v", got, gens[1:])
+	}
+	if _, err := os.Stat(filepath.Join(target, gens[0]+".json")); !os.IsNotExist(err) {
+		t.Errorf("The manifest of the deleted generation exists: %v", err)
+	}
+	if st := b.Status(); st.Err != nil || st.LastGeneration != gens[2] {
+		t.Errorf("Status = %+v", st)
+	}
+
+	// Unchanged files are linked to the previous generation.
+	fi1, err := os.Stat(filepath.Join(target, gens[1], "foo"))
+	if err != nil {
+		t.Fatalf("os.Stat: %v", err)
+	}
+	fi2, err := os.Stat(filepath.Join(target, gens[2], "foo"))
+	if err != nil {
+		t.Fatalf("os.Stat: %v", err)
+	}
+	if !os.SameFile(fi1, fi2) {
+		t.Error("foo wasn't linked")
+	}
+	m, err := b.Manifest(gens[2])
+	if err != nil {
+		t.Fatalf("Manifest: %v", err)
+	}
+	if len(m.Files) != 2 {
+		t.Errorf("Manifest = %+v", m)
+	}
+
+	var bar string
+	if err := New(filepath.Join(target, gens[2]), mk).ReadDataFile("bar", &bar); err != nil || bar != "bar2" {
+		t.Errorf("ReadDataFile(bar) = %q, %v", bar, err)
+	}
+}
+
+func TestBackupSchedulerInterval(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey())
+	if err := s.SaveDataFile("foo", "foo"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	mem := NewMemBackend()
+	b := s.StartBackups(mem, "/backups", 10*time.Millisecond)
+	deadline := time.Now().Add(10 * time.Second)
+	for b.Status().LastGeneration == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("No backup was taken")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.Stop()
+	gens, err := b.Generations()
+	if err != nil || len(gens) == 0 {
+		t.Errorf("Generations = %v, %v", gens, err)
+	}
+}
@@ -0,0 +1,162 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package search is an encrypted keyword search index of data files, on top
+// of an encrypted storage.
+//
+// The text of each data file is split into terms by a Tokenizer, and the
+// index maps each term to the files that contain it. The index is updated in
+// the same transaction as the data files. The terms are never stored on disk
+// in plaintext: the index only has keyed hashes of the terms, in encrypted
+// files.
+//
+// Example:
+//
+//	idx := search.New(s, "search/notes", func(obj any) string {
+//		n := obj.(*Note)
+//		return n.Title + " " + n.Body
+//	})
+//	tx, err := s.Begin()
+//	if err != nil {
+//		return err
+//	}
+//	defer tx.Rollback()
+//	if err := idx.Write(tx, "notes/123", &note); err != nil {
+//		return err
+//	}
+//	if err := tx.Commit(); err != nil {
+//		return err
+//	}
+//	...
+//	files, err := idx.Query("shopping list")
+package search
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/index"
+)
+
+const termField = "term"
+
+// Tokenizer splits text into terms.
+type Tokenizer func(text string) []string
+
+// DefaultTokenizer splits text into words of letters and digits, and converts
+// them to lower case.
+func DefaultTokenizer(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Option is used to specify optional parameters of New.
+type Option func(*Index)
+
+// WithTokenizer specifies the Tokenizer used to split the text of the files
+// and the queries. The default is DefaultTokenizer.
+func WithTokenizer(t Tokenizer) Option {
+	return func(x *Index) {
+		x.tokenize = t
+	}
+}
+
+// Index is a keyword search index.
+type Index struct {
+	s        *storage.Storage
+	idx      *index.Index
+	text     func(obj any) string
+	tokenize Tokenizer
+}
+
+// New returns an Index that keeps its files under dir in s. The text function
+// returns the searchable text of the objects that are passed to Write.
+func New(s *storage.Storage, dir string, text func(obj any) string, opts ...Option) *Index {
+	x := &Index{
+		s:        s,
+		idx:      index.New(s, dir),
+		text:     text,
+		tokenize: DefaultTokenizer,
+	}
+	for _, opt := range opts {
+		opt(x)
+	}
+	x.idx.Register(termField, func(obj any) []string {
+		return x.terms(x.text(obj))
+	})
+	return x
+}
+
+// terms returns the hashes of the terms of text.
+func (x *Index) terms(text string) []string {
+	tokens := x.tokenize(text)
+	out := make([]string, 0, len(tokens))
+	for _, t := range tokens {
+		out = append(out, x.s.HashString(t))
+	}
+	return out
+}
+
+// Write stages obj to be written to filename in tx, along with the changes to
+// the index.
+func (x *Index) Write(tx *storage.Tx, filename string, obj any) error {
+	return x.idx.Write(tx, filename, obj)
+}
+
+// Delete stages filename to be deleted in tx, and removes it from the index.
+func (x *Index) Delete(tx *storage.Tx, filename string) error {
+	return x.idx.Delete(tx, filename)
+}
+
+// Query returns the sorted names of the files that contain all the terms of
+// query.
+func (x *Index) Query(query string) ([]string, error) {
+	terms := x.terms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	slices.Sort(terms)
+	terms = slices.Compact(terms)
+	var out []string
+	for i, t := range terms {
+		files, err := x.idx.Lookup(termField, t)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			out = files
+		} else {
+			out = slices.DeleteFunc(out, func(f string) bool {
+				_, found := slices.BinarySearch(files, f)
+				return !found
+			})
+		}
+		if len(out) == 0 {
+			return nil, nil
+		}
+	}
+	return out, nil
+}
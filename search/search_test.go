@@ -0,0 +1,116 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package search_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/internal/storagetest"
+	"github.com/c2FmZQ/storage/search"
+)
+
+type note struct {
+	Title string
+	Body  string
+}
+
+func noteText(obj any) string {
+	n := obj.(*note)
+	return n.Title + " " + n.Body
+}
+
+func write(t *testing.T, s *storage.Storage, x *search.Index, filename string, n *note) {
+	t.Helper()
+	tx, err := s.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	defer tx.Rollback()
+	if n == nil {
+		err = x.Delete(tx, filename)
+	} else {
+		err = x.Write(tx, filename, n)
+	}
+	if err != nil {
+		t.Fatalf("%s: %v", filename, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+}
+
+func query(t *testing.T, x *search.Index, q string, want []string) {
+	t.Helper()
+	got, err := x.Query(q)
+	if err != nil {
+		t.Fatalf("Query(%q): %v", q, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Query(%q) = %q, want %q", q, got, want)
+	}
+}
+
+func TestDefaultTokenizer(t *testing.T) {
+	got := search.DefaultTokenizer("Hello, World! It's 2023.")
+	want := []string{"hello", "world", "it", "s", "2023"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DefaultTokenizer() = %q, want %q", got, want)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	s := storagetest.New(t)
+	x := search.New(s, "search", noteText)
+	write(t, s, x, "notes/1", &note{Title: "Shopping list", Body: "Milk, eggs, bread."})
+	write(t, s, x, "notes/2", &note{Title: "Recipe", Body: "Eggs and milk. Whisk."})
+	write(t, s, x, "notes/3", &note{Title: "Todo", Body: "Call Bob."})
+
+	query(t, x, "milk", []string{"notes/1", "notes/2"})
+	query(t, x, "EGGS milk", []string{"notes/1", "notes/2"})
+	query(t, x, "milk bread", []string{"notes/1"})
+	query(t, x, "milk bob", nil)
+	query(t, x, "nothing", nil)
+	query(t, x, "", nil)
+
+	write(t, s, x, "notes/1", &note{Title: "Shopping list", Body: "Bread."})
+	query(t, x, "milk", []string{"notes/2"})
+	query(t, x, "bread", []string{"notes/1"})
+
+	write(t, s, x, "notes/2", nil)
+	query(t, x, "milk", nil)
+	query(t, x, "whisk", nil)
+}
+
+func TestTokenizer(t *testing.T) {
+	s := storagetest.New(t)
+	x := search.New(s, "search", noteText, search.WithTokenizer(func(text string) []string {
+		return strings.Split(text, " ")
+	}))
+	write(t, s, x, "notes/1", &note{Title: "Foo", Body: "bar"})
+	query(t, x, "Foo", []string{"notes/1"})
+	query(t, x, "foo", nil)
+}
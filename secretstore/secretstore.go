@@ -0,0 +1,316 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package secretstore stores named secrets with immutable versions, on top of
+// an encrypted storage.
+//
+// Each call to Put adds a new version of a secret. Versions can't be modified
+// or deleted individually. A secret can be soft deleted, after which it can be
+// restored with Undelete, or deleted permanently with Purge.
+//
+// Example:
+//
+//	ss := secretstore.New(s, "secrets")
+//	v, err := ss.Put("db-password", []byte("hunter2"), secretstore.WithCreatedBy("alice"))
+//	if err != nil {
+//		return err
+//	}
+//	...
+//	secret, err := ss.Get("db-password")
+//	if err != nil {
+//		return err
+//	}
+//	connect(secret.Value)
+package secretstore
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+)
+
+var (
+	// ErrNotFound is returned when a secret or version doesn't exist.
+	ErrNotFound = errors.New("secret not found")
+	// ErrDeleted is returned when a secret is soft deleted.
+	ErrDeleted = errors.New("secret is deleted")
+	// ErrNotDeleted is returned by Purge when a secret isn't soft deleted.
+	ErrNotDeleted = errors.New("secret is not deleted")
+	// ErrExpired is returned when a version has expired.
+	ErrExpired = errors.New("secret version has expired")
+)
+
+// PutOption is used to specify optional parameters of Put.
+type PutOption func(*Metadata)
+
+// WithCreatedBy records who created the version.
+func WithCreatedBy(who string) PutOption {
+	return func(m *Metadata) {
+		m.CreatedBy = who
+	}
+}
+
+// WithExpiry specifies when the version expires. Expired versions can't be
+// read.
+func WithExpiry(t time.Time) PutOption {
+	return func(m *Metadata) {
+		m.Expires = t
+	}
+}
+
+// Metadata is the metadata of a version of a secret.
+type Metadata struct {
+	// Version is the version number. The first version is 1.
+	Version int `json:"version"`
+	// Created is when the version was created.
+	Created time.Time `json:"created"`
+	// CreatedBy is who created the version, if known.
+	CreatedBy string `json:"createdBy,omitempty"`
+	// Expires is when the version expires, if ever.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// Expired returns whether the version has expired.
+func (m Metadata) Expired() bool {
+	return !m.Expires.IsZero() && !time.Now().Before(m.Expires)
+}
+
+// Secret is a version of a secret.
+type Secret struct {
+	Metadata
+	// Name is the name of the secret.
+	Name string
+	// Value is the value of the secret.
+	Value []byte
+}
+
+// Info is the information about a secret returned by List.
+type Info struct {
+	// Name is the name of the secret.
+	Name string
+	// Latest is the latest version number.
+	Latest int
+	// Deleted is when the secret was soft deleted, if it is.
+	Deleted time.Time
+}
+
+// version is a version of a secret, as it is stored.
+type version struct {
+	Metadata
+	Value []byte `json:"value"`
+}
+
+// secret is a secret, as it is stored.
+type secret struct {
+	Name     string     `json:"name"`
+	Versions []*version `json:"versions"`
+	Deleted  time.Time  `json:"deleted,omitempty"`
+}
+
+// Store stores secrets.
+type Store struct {
+	s   *storage.Storage
+	dir string
+}
+
+// New returns a Store that keeps the secrets in dir.
+func New(s *storage.Storage, dir string) *Store {
+	return &Store{s: s, dir: dir}
+}
+
+// fileName returns the name of the file of a secret. The names of the secrets
+// are not visible in the file names.
+func (ss *Store) fileName(name string) string {
+	return filepath.Join(ss.dir, ss.s.HashString(name))
+}
+
+// update calls fn with the secret in a transaction, and commits the changes
+// if fn returns nil.
+func (ss *Store) update(name string, fn func(tx *storage.Tx, sec *secret) error) error {
+	fileName := ss.fileName(name)
+	tx, err := ss.s.Begin(fileName)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var sec secret
+	if err := tx.Read(fileName, &sec); errors.Is(err, fs.ErrNotExist) {
+		sec.Name = name
+	} else if err != nil {
+		return err
+	}
+	if err := fn(tx, &sec); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Put adds a new version of a secret, and returns its version number.
+func (ss *Store) Put(name string, value []byte, opts ...PutOption) (int, error) {
+	if name == "" {
+		return 0, fmt.Errorf("empty secret name")
+	}
+	var n int
+	err := ss.update(name, func(tx *storage.Tx, sec *secret) error {
+		if !sec.Deleted.IsZero() {
+			return ErrDeleted
+		}
+		v := &version{
+			Metadata: Metadata{Version: len(sec.Versions) + 1, Created: time.Now().UTC()},
+			Value:    append([]byte(nil), value...),
+		}
+		for _, opt := range opts {
+			opt(&v.Metadata)
+		}
+		sec.Versions = append(sec.Versions, v)
+		n = v.Version
+		return tx.Write(ss.fileName(name), sec)
+	})
+	return n, err
+}
+
+// read reads a secret that isn't deleted.
+func (ss *Store) read(name string) (*secret, error) {
+	var sec secret
+	if err := ss.s.ReadDataFile(ss.fileName(name), &sec); errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if !sec.Deleted.IsZero() {
+		return nil, ErrDeleted
+	}
+	return &sec, nil
+}
+
+// Get returns the latest version of a secret.
+func (ss *Store) Get(name string) (*Secret, error) {
+	return ss.GetVersion(name, 0)
+}
+
+// GetVersion returns a version of a secret. Version 0 is the latest version.
+func (ss *Store) GetVersion(name string, n int) (*Secret, error) {
+	sec, err := ss.read(name)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		n = len(sec.Versions)
+	}
+	if n < 1 || n > len(sec.Versions) {
+		return nil, ErrNotFound
+	}
+	v := sec.Versions[n-1]
+	if v.Expired() {
+		return nil, ErrExpired
+	}
+	return &Secret{Metadata: v.Metadata, Name: sec.Name, Value: v.Value}, nil
+}
+
+// Versions returns the metadata of all the versions of a secret, oldest
+// first.
+func (ss *Store) Versions(name string) ([]Metadata, error) {
+	sec, err := ss.read(name)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Metadata, 0, len(sec.Versions))
+	for _, v := range sec.Versions {
+		out = append(out, v.Metadata)
+	}
+	return out, nil
+}
+
+// List returns information about all the secrets, including the ones that
+// are soft deleted, sorted by name.
+func (ss *Store) List() ([]Info, error) {
+	entries, err := ss.s.FS().ReadDir(filepath.ToSlash(ss.dir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []Info
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		var sec secret
+		if err := ss.s.ReadDataFile(filepath.Join(ss.dir, e.Name()), &sec); errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		out = append(out, Info{Name: sec.Name, Latest: len(sec.Versions), Deleted: sec.Deleted})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// Delete soft deletes a secret. Its versions can't be read, and no new
+// versions can be added, until it is restored with Undelete.
+func (ss *Store) Delete(name string) error {
+	return ss.update(name, func(tx *storage.Tx, sec *secret) error {
+		if len(sec.Versions) == 0 {
+			return ErrNotFound
+		}
+		if !sec.Deleted.IsZero() {
+			return ErrDeleted
+		}
+		sec.Deleted = time.Now().UTC()
+		return tx.Write(ss.fileName(name), sec)
+	})
+}
+
+// Undelete restores a secret that was soft deleted.
+func (ss *Store) Undelete(name string) error {
+	return ss.update(name, func(tx *storage.Tx, sec *secret) error {
+		if len(sec.Versions) == 0 {
+			return ErrNotFound
+		}
+		if sec.Deleted.IsZero() {
+			return ErrNotDeleted
+		}
+		sec.Deleted = time.Time{}
+		return tx.Write(ss.fileName(name), sec)
+	})
+}
+
+// Purge permanently deletes a secret that was soft deleted.
+func (ss *Store) Purge(name string) error {
+	return ss.update(name, func(tx *storage.Tx, sec *secret) error {
+		if len(sec.Versions) == 0 {
+			return ErrNotFound
+		}
+		if sec.Deleted.IsZero() {
+			return ErrNotDeleted
+		}
+		return tx.Delete(ss.fileName(name))
+	})
+}
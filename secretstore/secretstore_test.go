@@ -0,0 +1,144 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package secretstore_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage/internal/storagetest"
+	"github.com/c2FmZQ/storage/secretstore"
+)
+
+func put(t *testing.T, ss *secretstore.Store, name, value string, want int, opts ...secretstore.PutOption) {
+	t.Helper()
+	v, err := ss.Put(name, []byte(value), opts...)
+	if err != nil {
+		t.Fatalf("Put(%q): %v", name, err)
+	}
+	if v != want {
+		t.Fatalf("Put(%q) = %d, want %d", name, v, want)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	ss := secretstore.New(storagetest.New(t), "secrets")
+	put(t, ss, "db", "one", 1, secretstore.WithCreatedBy("alice"))
+	put(t, ss, "db", "two", 2, secretstore.WithCreatedBy("bob"))
+	put(t, ss, "api", "key", 1)
+
+	sec, err := ss.Get("db")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if sec.Name != "db" || sec.Version != 2 || string(sec.Value) != "two" || sec.CreatedBy != "bob" {
+		t.Errorf("Get() = %+v", sec)
+	}
+	if sec, err = ss.GetVersion("db", 1); err != nil || string(sec.Value) != "one" {
+		t.Errorf("GetVersion(1) = %+v, %v", sec, err)
+	}
+	if _, err := ss.GetVersion("db", 3); !errors.Is(err, secretstore.ErrNotFound) {
+		t.Errorf("GetVersion(3) = %v, want ErrNotFound", err)
+	}
+	if _, err := ss.Get("nothing"); !errors.Is(err, secretstore.ErrNotFound) {
+		t.Errorf("Get(nothing) = %v, want ErrNotFound", err)
+	}
+
+	md, err := ss.Versions("db")
+	if err != nil {
+		t.Fatalf("Versions: %v", err)
+	}
+	if len(md) != 2 || md[0].Version != 1 || md[0].CreatedBy != "alice" || md[1].Version != 2 || md[1].Created.IsZero() {
+		t.Errorf("Versions() = %+v", md)
+	}
+
+	list, err := ss.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(list) != 2 || list[0].Name != "api" || list[0].Latest != 1 || list[1].Name != "db" || list[1].Latest != 2 {
+		t.Errorf("List() = %+v", list)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	ss := secretstore.New(storagetest.New(t), "secrets")
+	put(t, ss, "token", "old", 1)
+	put(t, ss, "token", "new", 2, secretstore.WithExpiry(time.Now().Add(-time.Second)))
+	if _, err := ss.Get("token"); !errors.Is(err, secretstore.ErrExpired) {
+		t.Errorf("Get() = %v, want ErrExpired", err)
+	}
+	if sec, err := ss.GetVersion("token", 1); err != nil || string(sec.Value) != "old" {
+		t.Errorf("GetVersion(1) = %+v, %v", sec, err)
+	}
+	md, err := ss.Versions("token")
+	if err != nil {
+		t.Fatalf("Versions: %v", err)
+	}
+	if md[0].Expired() || !md[1].Expired() {
+		t.Errorf("Versions() = %+v", md)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	ss := secretstore.New(storagetest.New(t), "secrets")
+	put(t, ss, "db", "one", 1)
+
+	if err := ss.Purge("db"); !errors.Is(err, secretstore.ErrNotDeleted) {
+		t.Errorf("Purge() = %v, want ErrNotDeleted", err)
+	}
+	if err := ss.Delete("db"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := ss.Get("db"); !errors.Is(err, secretstore.ErrDeleted) {
+		t.Errorf("Get() = %v, want ErrDeleted", err)
+	}
+	if _, err := ss.Put("db", []byte("two")); !errors.Is(err, secretstore.ErrDeleted) {
+		t.Errorf("Put() = %v, want ErrDeleted", err)
+	}
+	if list, err := ss.List(); err != nil || len(list) != 1 || list[0].Deleted.IsZero() {
+		t.Errorf("List() = %+v, %v", list, err)
+	}
+
+	if err := ss.Undelete("db"); err != nil {
+		t.Fatalf("Undelete: %v", err)
+	}
+	put(t, ss, "db", "two", 2)
+
+	if err := ss.Delete("db"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := ss.Purge("db"); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+	if _, err := ss.Get("db"); !errors.Is(err, secretstore.ErrNotFound) {
+		t.Errorf("Get() = %v, want ErrNotFound", err)
+	}
+	if err := ss.Delete("db"); !errors.Is(err, secretstore.ErrNotFound) {
+		t.Errorf("Delete() = %v, want ErrNotFound", err)
+	}
+	// A purged secret can be created again.
+	put(t, ss, "db", "three", 1)
+}
@@ -0,0 +1,17 @@
+module github.com/c2FmZQ/storage/sessionstore
+
+go 1.22
+
+require (
+	github.com/c2FmZQ/storage v0.0.0-20261015041833-c4dbad651a82
+	github.com/gorilla/sessions v1.3.0
+)
+
+require (
+	github.com/c2FmZQ/tpm v0.4.0 // indirect
+	github.com/google/go-tpm v0.9.3 // indirect
+	github.com/gorilla/securecookie v1.1.2 // indirect
+	golang.org/x/crypto v0.32.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
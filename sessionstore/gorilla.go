@@ -0,0 +1,112 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sessionstore
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+var _ sessions.Store = (*GorillaStore)(nil)
+
+// GorillaStore implements sessions.Store. The cookies contain only the
+// session IDs, which are random and unguessable. The session values are
+// saved in the Store.
+type GorillaStore struct {
+	st *Store
+	// Options are the default options of the new sessions.
+	Options *sessions.Options
+}
+
+// NewGorillaStore returns a sessions.Store that saves the sessions in st.
+// The cookies of the new sessions have the same lifetime as st's sessions.
+func NewGorillaStore(st *Store) *GorillaStore {
+	return &GorillaStore{
+		st: st,
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   int(st.TTL() / time.Second),
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+	}
+}
+
+// Get returns a session for the given name, after adding it to the registry
+// of the request. It returns a new session if the session doesn't exist.
+func (gs *GorillaStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(gs, name)
+}
+
+// New returns the session for the given name, without adding it to the
+// registry of the request. It returns a new session if the session doesn't
+// exist.
+func (gs *GorillaStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(gs, name)
+	opts := *gs.Options
+	session.Options = &opts
+	session.IsNew = true
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	values := make(map[interface{}]interface{})
+	if err := gs.st.Load(c.Value, &values); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return session, nil
+		}
+		return session, err
+	}
+	session.ID = c.Value
+	session.Values = values
+	session.IsNew = false
+	return session, nil
+}
+
+// Save saves the session, and sets its cookie. A session with a negative
+// MaxAge is deleted.
+func (gs *GorillaStore) Save(_ *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := gs.st.Delete(session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	if session.ID == "" {
+		session.ID = NewID()
+	}
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	if err := gs.st.Save(session.ID, session.Values, ttl); err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), session.ID, session.Options))
+	return nil
+}
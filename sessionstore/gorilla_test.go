@@ -0,0 +1,93 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sessionstore_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/c2FmZQ/storage/internal/storagetest"
+	"github.com/c2FmZQ/storage/sessionstore"
+)
+
+func TestGorillaStore(t *testing.T) {
+	gs := sessionstore.NewGorillaStore(sessionstore.New(storagetest.New(t), "sessions"))
+
+	// request calls fn with a request that has cookies, and returns the
+	// cookies of the response.
+	request := func(cookies []*http.Cookie, fn func(http.ResponseWriter, *http.Request)) []*http.Cookie {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		fn(w, req)
+		return w.Result().Cookies()
+	}
+
+	var cookies []*http.Cookie
+	cookies = request(nil, func(w http.ResponseWriter, req *http.Request) {
+		session, err := gs.Get(req, "session")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if !session.IsNew {
+			t.Error("Session isn't new")
+		}
+		session.Values["user"] = "alice"
+		if err := session.Save(req, w); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	})
+	if len(cookies) != 1 || !cookies[0].HttpOnly || !cookies[0].Secure || cookies[0].MaxAge <= 0 {
+		t.Fatalf("Cookies = %v", cookies)
+	}
+
+	request(cookies, func(w http.ResponseWriter, req *http.Request) {
+		session, err := gs.Get(req, "session")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if session.IsNew || session.Values["user"] != "alice" {
+			t.Errorf("Session = %+v", session)
+		}
+		session.Options.MaxAge = -1
+		if err := session.Save(req, w); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	})
+
+	// The session was deleted.
+	request(cookies, func(w http.ResponseWriter, req *http.Request) {
+		session, err := gs.Get(req, "session")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if !session.IsNew || session.ID != "" || len(session.Values) != 0 {
+			t.Errorf("Session = %+v", session)
+		}
+	})
+}
@@ -0,0 +1,229 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package sessionstore stores HTTP sessions in an encrypted storage, with
+// expiry.
+//
+// Store is a generic session API: each session has a random ID, and its data
+// is saved in its own file, until it expires. Expired sessions are ignored,
+// and they are deleted by Cleanup, or periodically with StartCleanup. The
+// data is encoded with GOB.
+//
+// GorillaStore implements the sessions.Store interface of
+// github.com/gorilla/sessions on top of a Store.
+//
+// Example:
+//
+//	st := sessionstore.New(s, "sessions", sessionstore.WithTTL(24*time.Hour))
+//	defer st.StartCleanup(time.Hour)()
+//	gs := sessionstore.NewGorillaStore(st)
+//	...
+//	session, err := gs.Get(req, "session")
+package sessionstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+)
+
+// ErrNotFound is returned when a session doesn't exist, or has expired.
+var ErrNotFound = errors.New("session not found")
+
+// defaultTTL is the default lifetime of the sessions.
+const defaultTTL = 30 * 24 * time.Hour
+
+// Option is used to specify optional parameters of the Store.
+type Option func(*Store)
+
+// WithTTL specifies the default lifetime of the sessions. The default is 30
+// days.
+func WithTTL(ttl time.Duration) Option {
+	return func(st *Store) {
+		st.ttl = ttl
+	}
+}
+
+// Store stores sessions.
+type Store struct {
+	s   *storage.Storage
+	dir string
+	ttl time.Duration
+}
+
+// record is the content of a session file.
+type record struct {
+	Expires time.Time `json:"expires"`
+	Data    []byte    `json:"data"`
+}
+
+// New returns a Store that keeps its sessions under dir in s.
+func New(s *storage.Storage, dir string, opts ...Option) *Store {
+	st := &Store{s: s, dir: dir, ttl: defaultTTL}
+	for _, opt := range opts {
+		opt(st)
+	}
+	return st
+}
+
+// TTL returns the default lifetime of the sessions.
+func (st *Store) TTL() time.Duration {
+	return st.ttl
+}
+
+// NewID returns a new random session ID.
+func NewID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// idRE matches the session IDs returned by NewID.
+var idRE = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+// fileName returns the name of the file of a session.
+func (st *Store) fileName(id string) (string, error) {
+	if !idRE.MatchString(id) {
+		return "", ErrNotFound
+	}
+	return filepath.Join(st.dir, st.s.FanoutPath(id, 1)), nil
+}
+
+// Save saves the data of a session. The session expires after ttl, or after
+// the default TTL when ttl is 0.
+func (st *Store) Save(id string, data any, ttl time.Duration) error {
+	fn, err := st.fileName(id)
+	if err != nil {
+		return err
+	}
+	if ttl == 0 {
+		ttl = st.ttl
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+		return err
+	}
+	return st.s.SaveDataFile(fn, &record{Expires: time.Now().Add(ttl), Data: buf.Bytes()})
+}
+
+// Load reads the data of a session into data, which must be a pointer. It
+// returns ErrNotFound if the session doesn't exist, or has expired.
+func (st *Store) Load(id string, data any) error {
+	fn, err := st.fileName(id)
+	if err != nil {
+		return err
+	}
+	var rec record
+	if err := st.s.ReadDataFile(fn, &rec); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if !time.Now().Before(rec.Expires) {
+		return ErrNotFound
+	}
+	return gob.NewDecoder(bytes.NewReader(rec.Data)).Decode(data)
+}
+
+// Delete deletes a session. Deleting a session that doesn't exist isn't an
+// error.
+func (st *Store) Delete(id string) error {
+	fn, err := st.fileName(id)
+	if err != nil {
+		return nil
+	}
+	if err := st.s.DeleteFile(fn); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Cleanup deletes the expired sessions, and returns how many were deleted.
+func (st *Store) Cleanup() (int, error) {
+	var deleted int
+	now := time.Now()
+	err := fs.WalkDir(st.s.FS(), filepath.ToSlash(st.dir), func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == filepath.ToSlash(st.dir) {
+			return fs.SkipAll
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		fn := filepath.FromSlash(p)
+		var rec record
+		if err := st.s.ReadDataFile(fn, &rec); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if now.Before(rec.Expires) {
+			return nil
+		}
+		if err := st.s.DeleteFile(fn); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		deleted++
+		return nil
+	})
+	return deleted, err
+}
+
+// StartCleanup calls Cleanup periodically, until the returned function is
+// called.
+func (st *Store) StartCleanup(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if n, err := st.Cleanup(); err != nil {
+					st.s.Logger().Errorf("sessionstore: Cleanup: %v", err)
+				} else if n > 0 {
+					st.s.Logger().Debugf("sessionstore: deleted %d expired sessions", n)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-ch
+	}
+}
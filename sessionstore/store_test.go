@@ -0,0 +1,104 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sessionstore_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage/internal/storagetest"
+	"github.com/c2FmZQ/storage/sessionstore"
+)
+
+type data struct {
+	User string
+}
+
+func TestStore(t *testing.T) {
+	st := sessionstore.New(storagetest.New(t), "sessions")
+	id := sessionstore.NewID()
+	if id == sessionstore.NewID() {
+		t.Fatal("NewID returned the same ID twice")
+	}
+
+	var d data
+	if err := st.Load(id, &d); !errors.Is(err, sessionstore.ErrNotFound) {
+		t.Errorf("Load = %v, want ErrNotFound", err)
+	}
+	if err := st.Save(id, data{User: "alice"}, 0); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := st.Load(id, &d); err != nil || d.User != "alice" {
+		t.Errorf("Load = %+v, %v", d, err)
+	}
+	if err := st.Load("../../etc/passwd", &d); !errors.Is(err, sessionstore.ErrNotFound) {
+		t.Errorf("Load = %v, want ErrNotFound", err)
+	}
+	if err := st.Delete(id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := st.Load(id, &d); !errors.Is(err, sessionstore.ErrNotFound) {
+		t.Errorf("Load = %v, want ErrNotFound", err)
+	}
+	if err := st.Delete(id); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	st := sessionstore.New(storagetest.New(t), "sessions", sessionstore.WithTTL(time.Hour))
+	if n, err := st.Cleanup(); err != nil || n != 0 {
+		t.Errorf("Cleanup = %d, %v, want 0, nil", n, err)
+	}
+	short, long := sessionstore.NewID(), sessionstore.NewID()
+	if err := st.Save(short, data{User: "bob"}, 10*time.Millisecond); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := st.Save(long, data{User: "carol"}, 0); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	var d data
+	if err := st.Load(short, &d); !errors.Is(err, sessionstore.ErrNotFound) {
+		t.Errorf("Load = %v, want ErrNotFound", err)
+	}
+	if n, err := st.Cleanup(); err != nil || n != 1 {
+		t.Errorf("Cleanup = %d, %v, want 1, nil", n, err)
+	}
+	if err := st.Load(long, &d); err != nil || d.User != "carol" {
+		t.Errorf("Load = %+v, %v", d, err)
+	}
+
+	if err := st.Save(short, data{User: "bob"}, 10*time.Millisecond); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	stop := st.StartCleanup(5 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	if n, err := st.Cleanup(); err != nil || n != 0 {
+		t.Errorf("Cleanup = %d, %v, want 0, nil", n, err)
+	}
+}
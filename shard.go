@@ -0,0 +1,252 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ShardedMap is a map-like object that is split across multiple data files.
+// Each key is stored in the shard selected by its hash, so that updating a
+// key only requires re-encrypting one shard instead of the whole map.
+//
+// Example:
+//
+//	m, err := storage.NewShardedMap[Foo](s, "index", 16)
+//	if err != nil {
+//	  panic(err)
+//	}
+//	if err := m.Set("key", Foo{}); err != nil {
+//	  panic(err)
+//	}
+type ShardedMap[V any] struct {
+	s         *Storage
+	dir       string
+	numShards int
+}
+
+type shardedMapMeta struct {
+	NumShards int `json:"numShards"`
+}
+
+type shardContent[V any] struct {
+	Entries map[string]V `json:"entries"`
+}
+
+// NewShardedMap returns a ShardedMap stored in numShards files in dir. The
+// number of shards is recorded when the map is created. It is an error to
+// open an existing map with a different number of shards.
+func NewShardedMap[V any](s *Storage, dir string, numShards int) (*ShardedMap[V], error) {
+	if numShards <= 0 {
+		return nil, errors.New("numShards must be positive")
+	}
+	m := &ShardedMap[V]{s: s, dir: dir, numShards: numShards}
+	metaFile := filepath.Join(dir, "meta")
+	var meta shardedMapMeta
+	if err := s.ReadDataFile(metaFile, &meta); errors.Is(err, os.ErrNotExist) {
+		for i := 0; i < numShards; i++ {
+			if err := s.CreateEmptyFile(m.shardFile(i), shardContent[V]{}); err != nil && !errors.Is(err, os.ErrExist) {
+				return nil, err
+			}
+		}
+		if err := s.SaveDataFile(metaFile, shardedMapMeta{NumShards: numShards}); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if meta.NumShards != numShards {
+		return nil, fmt.Errorf("%s has %d shards, not %d", dir, meta.NumShards, numShards)
+	}
+	return m, nil
+}
+
+func (m *ShardedMap[V]) shardFile(i int) string {
+	return filepath.Join(m.dir, fmt.Sprintf("shard-%04d", i))
+}
+
+func (m *ShardedMap[V]) shardOf(key string) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int(h.Sum64() % uint64(m.numShards))
+}
+
+// Get returns the value associated with key.
+func (m *ShardedMap[V]) Get(key string) (value V, ok bool, err error) {
+	var sc shardContent[V]
+	if err := m.s.ReadDataFile(m.shardFile(m.shardOf(key)), &sc); err != nil {
+		return value, false, err
+	}
+	value, ok = sc.Entries[key]
+	return value, ok, nil
+}
+
+// Set atomically sets the value associated with key.
+func (m *ShardedMap[V]) Set(key string, value V) error {
+	u, commit, err := m.OpenForUpdate(key)
+	if err != nil {
+		return err
+	}
+	u.Set(key, value)
+	return commit(true, nil)
+}
+
+// Delete atomically deletes key.
+func (m *ShardedMap[V]) Delete(key string) error {
+	u, commit, err := m.OpenForUpdate(key)
+	if err != nil {
+		return err
+	}
+	u.Delete(key)
+	return commit(true, nil)
+}
+
+// Range calls fn for each key and value in the map, one shard at a time. It
+// stops if fn returns false. Each shard is read consistently, but the map
+// can be modified concurrently between shards.
+func (m *ShardedMap[V]) Range(fn func(key string, value V) bool) error {
+	for i := 0; i < m.numShards; i++ {
+		var sc shardContent[V]
+		if err := m.s.ReadDataFile(m.shardFile(i), &sc); err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(sc.Entries))
+		for k := range sc.Entries {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if !fn(k, sc.Entries[k]) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// OpenForUpdate opens the shards that contain keys for update. All the
+// changes made with the returned ShardedUpdate are committed atomically, even
+// when they span multiple shards.
+//
+// Example:
+//
+//	 func foo() (retErr error) {
+//	   u, commit, err := m.OpenForUpdate("key1", "key2")
+//	   if err != nil {
+//	     panic(err)
+//	   }
+//	   defer commit(false, &retErr) // rollback unless first committed.
+//	   v, _ := u.Get("key1")
+//	   u.Set("key2", v)
+//	   u.Delete("key1")
+//	   return commit(true, nil) // commit
+//	}
+func (m *ShardedMap[V]) OpenForUpdate(keys ...string) (*ShardedUpdate[V], func(commit bool, errp *error) error, error) {
+	seen := make(map[int]bool)
+	var shards []int
+	for _, k := range keys {
+		if i := m.shardOf(k); !seen[i] {
+			seen[i] = true
+			shards = append(shards, i)
+		}
+	}
+	return m.openShards(shards)
+}
+
+// OpenAllForUpdate opens all the shards for update.
+func (m *ShardedMap[V]) OpenAllForUpdate() (*ShardedUpdate[V], func(commit bool, errp *error) error, error) {
+	shards := make([]int, m.numShards)
+	for i := range shards {
+		shards[i] = i
+	}
+	return m.openShards(shards)
+}
+
+func (m *ShardedMap[V]) openShards(shards []int) (*ShardedUpdate[V], func(commit bool, errp *error) error, error) {
+	files := make([]string, len(shards))
+	contents := make([]*shardContent[V], len(shards))
+	u := &ShardedUpdate[V]{m: m, shards: make(map[int]*shardContent[V])}
+	for i, shard := range shards {
+		files[i] = m.shardFile(shard)
+		contents[i] = &shardContent[V]{}
+		u.shards[shard] = contents[i]
+	}
+	commit, err := m.s.OpenManyForUpdate(files, contents)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, sc := range contents {
+		if sc.Entries == nil {
+			sc.Entries = make(map[string]V)
+		}
+	}
+	return u, commit, nil
+}
+
+// ShardedUpdate gives access to the shards opened with OpenForUpdate. It
+// panics if it is used with a key that belongs to a shard that wasn't opened.
+type ShardedUpdate[V any] struct {
+	m      *ShardedMap[V]
+	shards map[int]*shardContent[V]
+}
+
+func (u *ShardedUpdate[V]) shard(key string) *shardContent[V] {
+	sc, ok := u.shards[u.m.shardOf(key)]
+	if !ok {
+		panic(fmt.Sprintf("shard for key %q is not open for update", key))
+	}
+	return sc
+}
+
+// Get returns the value associated with key.
+func (u *ShardedUpdate[V]) Get(key string) (V, bool) {
+	v, ok := u.shard(key).Entries[key]
+	return v, ok
+}
+
+// Set sets the value associated with key.
+func (u *ShardedUpdate[V]) Set(key string, value V) {
+	u.shard(key).Entries[key] = value
+}
+
+// Delete deletes key.
+func (u *ShardedUpdate[V]) Delete(key string) {
+	delete(u.shard(key).Entries, key)
+}
+
+// Range calls fn for each key and value in the open shards. It stops if fn
+// returns false.
+func (u *ShardedUpdate[V]) Range(fn func(key string, value V) bool) {
+	for _, sc := range u.shards {
+		for k, v := range sc.Entries {
+			if !fn(k, v) {
+				return
+			}
+		}
+	}
+}
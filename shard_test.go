@@ -0,0 +1,96 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestShardedMap(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey())
+	m, err := NewShardedMap[int](s, "index", 8)
+	if err != nil {
+		t.Fatalf("NewShardedMap: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := m.Set(fmt.Sprintf("key%d", i), i); err != nil {
+			t.Fatalf("m.Set: %v", err)
+		}
+	}
+	if v, ok, err := m.Get("key42"); err != nil || !ok || v != 42 {
+		t.Errorf("m.Get(key42) = %d, %v, %v", v, ok, err)
+	}
+	if err := m.Delete("key42"); err != nil {
+		t.Fatalf("m.Delete: %v", err)
+	}
+	if v, ok, err := m.Get("key42"); err != nil || ok {
+		t.Errorf("m.Get(key42) = %d, %v, %v", v, ok, err)
+	}
+
+	// Transaction across shards.
+	u, commit, err := m.OpenForUpdate("key1", "key2", "key3")
+	if err != nil {
+		t.Fatalf("m.OpenForUpdate: %v", err)
+	}
+	v1, _ := u.Get("key1")
+	v2, _ := u.Get("key2")
+	u.Set("key3", v1+v2)
+	u.Delete("key1")
+	if err := commit(true, nil); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if v, ok, err := m.Get("key3"); err != nil || !ok || v != 3 {
+		t.Errorf("m.Get(key3) = %d, %v, %v", v, ok, err)
+	}
+
+	// Rollback.
+	u, commit, err = m.OpenForUpdate("key5")
+	if err != nil {
+		t.Fatalf("m.OpenForUpdate: %v", err)
+	}
+	u.Set("key5", -1)
+	if err := commit(false, nil); err != ErrRolledBack {
+		t.Fatalf("commit: %v", err)
+	}
+	if v, ok, err := m.Get("key5"); err != nil || !ok || v != 5 {
+		t.Errorf("m.Get(key5) = %d, %v, %v", v, ok, err)
+	}
+
+	count := 0
+	if err := m.Range(func(string, int) bool { count++; return true }); err != nil {
+		t.Fatalf("m.Range: %v", err)
+	}
+	if want := 98; count != want {
+		t.Errorf("m.Range() count = %d, want %d", count, want)
+	}
+
+	// Reopen.
+	if _, err := NewShardedMap[int](s, "index", 8); err != nil {
+		t.Errorf("NewShardedMap: %v", err)
+	}
+	if _, err := NewShardedMap[int](s, "index", 4); err == nil {
+		t.Error("NewShardedMap with different number of shards didn't fail")
+	}
+}
@@ -0,0 +1,162 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+// The magic number of signed data files. Unsigned files start with KRIN.
+const signedMagic = "KRIS"
+
+// ErrNotSigned indicates that a file isn't signed, but the storage requires
+// valid signatures.
+var ErrNotSigned = errors.New("file is not signed")
+
+// WithSigningKey specifies that data files should be signed with k when they
+// are written. The signature is stored in the file header, and covers the
+// file name and the whole content of the file. The signatures are verified
+// when the files are read, as with WithVerifyingKey(k.VerifyingKey()).
+//
+// Blobs, record files, and paged blob files aren't signed.
+func WithSigningKey(k crypto.SigningKey) Option {
+	return func(opt *option) {
+		opt.signingKey = k
+	}
+}
+
+// WithVerifyingKey specifies that data files must have a valid signature
+// from the signing key of k. Reading a file that isn't signed fails with
+// ErrNotSigned, and reading a file whose signature doesn't match fails with
+// crypto.ErrInvalidSignature. The files are verified in full before they are
+// decoded.
+//
+// Without a signing key or a verifying key, the signatures of signed files
+// are ignored.
+func WithVerifyingKey(k crypto.VerifyingKey) Option {
+	return func(opt *option) {
+		opt.verifyingKey = k
+	}
+}
+
+// signedMessage returns the message that is signed for a file with header
+// hdr, file context ctx, and content digest.
+func signedMessage(hdr, ctx, digest []byte) []byte {
+	msg := []byte("c2FmZQ storage signed file\x00")
+	msg = append(msg, hdr...)
+	msg = append(msg, ctx...)
+	return append(msg, digest...)
+}
+
+// openSignedWriteStream is like openUncompressedWriteStream, but the file is
+// signed when the stream is closed.
+func (s *Storage) openSignedWriteStream(ctx []byte, fullPath string, flags byte, maxPadding int) (io.WriteCloser, error) {
+	f, err := s.openFile(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	hdr := []byte{signedMagic[0], signedMagic[1], signedMagic[2], signedMagic[3], flags}
+	n := s.signingKey.VerifyingKey().SignatureSize()
+	if n <= 0 || n > 255 {
+		f.Close()
+		return nil, errors.New("unexpected signature size")
+	}
+	// The signature is written over the placeholder when the stream is
+	// closed.
+	placeholder := append(append(hdr, byte(n)), make([]byte, n)...)
+	if _, err := f.Write(placeholder); err != nil {
+		f.Close()
+		return nil, err
+	}
+	sw := &signingWriter{
+		f:   f,
+		h:   sha256.New(),
+		key: s.signingKey,
+		hdr: hdr,
+		ctx: ctx,
+	}
+	return s.startWriteStream(ctx, sw, hdr, maxPadding)
+}
+
+// signingWriter computes the digest of the content of a file as it is
+// written, and writes its signature in the file header when it is closed.
+type signingWriter struct {
+	f   *syncFile
+	h   hash.Hash
+	key crypto.SigningKey
+	hdr []byte
+	ctx []byte
+}
+
+func (w *signingWriter) Write(b []byte) (int, error) {
+	n, err := w.f.Write(b)
+	w.h.Write(b[:n])
+	return n, err
+}
+
+func (w *signingWriter) Close() error {
+	sig, err := w.key.Sign(signedMessage(w.hdr, w.ctx, w.h.Sum(nil)))
+	if err == nil && len(sig) != w.key.VerifyingKey().SignatureSize() {
+		err = errors.New("unexpected signature size")
+	}
+	if err == nil {
+		_, err = w.f.WriteAt(sig, int64(len(w.hdr)+1))
+	}
+	if e := w.f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// verifySignature reads the signature of a signed file whose header hdr was
+// just read from f, and verifies it with the storage's verifying key, if
+// any. When it returns, f is positioned after the signature.
+func (s *Storage) verifySignature(f File, filename string, hdr []byte) error {
+	var n [1]byte
+	if _, err := io.ReadFull(f, n[:]); err != nil {
+		return err
+	}
+	sig := make([]byte, int(n[0]))
+	if _, err := io.ReadFull(f, sig); err != nil {
+		return err
+	}
+	if s.verifyingKey == nil {
+		return nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	start := int64(len(hdr) + 1 + len(sig))
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, start, fi.Size()-start)); err != nil {
+		return err
+	}
+	return s.verifyingKey.Verify(signedMessage(hdr, fileContext(filename), h.Sum(nil)), sig)
+}
@@ -0,0 +1,124 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+func TestSignedFiles(t *testing.T) {
+	sk, err := crypto.CreateEd25519SigningKey()
+	if err != nil {
+		t.Fatalf("CreateEd25519SigningKey: %v", err)
+	}
+	defer sk.Wipe()
+	other, err := crypto.CreateEd25519SigningKey()
+	if err != nil {
+		t.Fatalf("CreateEd25519SigningKey: %v", err)
+	}
+	defer other.Wipe()
+
+	for _, tc := range []struct {
+		name string
+		mk   crypto.EncryptionKey
+		opts []Option
+	}{
+		{"Plaintext", nil, nil},
+		{"AES", aesEncryptionKey(), nil},
+		{"Chacha20Poly1305", ccEncryptionKey(), []Option{WithCompression()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := New(dir, tc.mk, append(tc.opts, WithSigningKey(sk))...)
+
+			want := []byte("Hello world")
+			for _, f := range []string{"foo", "bar", "baz"} {
+				if err := s.SaveDataFile(f, &want); err != nil {
+					t.Fatalf("SaveDataFile(%q): %v", f, err)
+				}
+			}
+			var got []byte
+			if err := s.ReadDataFile("foo", &got); err != nil {
+				t.Fatalf("ReadDataFile: %v", err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("ReadDataFile() = %q, want %q", got, want)
+			}
+			h, err := s.ReadHeader("foo")
+			if err != nil {
+				t.Fatalf("ReadHeader: %v", err)
+			}
+			if !h.Signed {
+				t.Errorf("ReadHeader() = %s, want signed", h)
+			}
+
+			// Readers with the verifying key, or without any key, can
+			// read the file.
+			r := New(dir, tc.mk, append(tc.opts, WithVerifyingKey(sk.VerifyingKey()))...)
+			if err := r.ReadDataFile("foo", &got); err != nil {
+				t.Errorf("ReadDataFile with verifying key: %v", err)
+			}
+			if err := New(dir, tc.mk, tc.opts...).ReadDataFile("foo", &got); err != nil {
+				t.Errorf("ReadDataFile without verifying key: %v", err)
+			}
+			if err := New(dir, tc.mk, append(tc.opts, WithVerifyingKey(other.VerifyingKey()))...).ReadDataFile("foo", &got); !errors.Is(err, crypto.ErrInvalidSignature) {
+				t.Errorf("ReadDataFile with other key: err = %v, want %v", err, crypto.ErrInvalidSignature)
+			}
+
+			// A file swapped for another one is detected.
+			if err := os.Rename(filepath.Join(dir, "bar"), filepath.Join(dir, "foo")); err != nil {
+				t.Fatalf("os.Rename: %v", err)
+			}
+			if err := r.ReadDataFile("foo", &got); err == nil {
+				t.Error("ReadDataFile of swapped file should have failed, but didn't")
+			}
+
+			// A modified file is detected.
+			b, err := os.ReadFile(filepath.Join(dir, "baz"))
+			if err != nil {
+				t.Fatalf("os.ReadFile: %v", err)
+			}
+			b[len(b)-1] ^= 1
+			if err := os.WriteFile(filepath.Join(dir, "baz"), b, 0600); err != nil {
+				t.Fatalf("os.WriteFile: %v", err)
+			}
+			if err := r.ReadDataFile("baz", &got); !errors.Is(err, crypto.ErrInvalidSignature) {
+				t.Errorf("ReadDataFile of modified file: err = %v, want %v", err, crypto.ErrInvalidSignature)
+			}
+
+			// An unsigned file is rejected.
+			if err := New(dir, tc.mk, tc.opts...).SaveDataFile("unsigned", &want); err != nil {
+				t.Fatalf("SaveDataFile: %v", err)
+			}
+			if err := r.ReadDataFile("unsigned", &got); !errors.Is(err, ErrNotSigned) {
+				t.Errorf("ReadDataFile of unsigned file: err = %v, want %v", err, ErrNotSigned)
+			}
+		})
+	}
+}
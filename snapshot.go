@@ -0,0 +1,449 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// snapshotDir is the directory where the files of snapshots are staged.
+const snapshotDir = "snapshot"
+
+// snapshotExcludeRE matches the internal files that aren't part of a
+// snapshot. The other internal files, e.g. pending operations and backups,
+// are needed to recover the operations that were in progress.
+var snapshotExcludeRE = regexp.MustCompile(`\.(stale-[0-9]+|lock|lock\.q|flock|rlock)$`)
+
+// Manifest describes the files of a snapshot.
+type Manifest struct {
+	// Time is when the snapshot was taken.
+	Time time.Time `json:"time"`
+	// Base is the time of the manifest that an incremental export is
+	// relative to.
+	Base *time.Time `json:"base,omitempty"`
+	// Files are the files of the snapshot, by relative name.
+	Files map[string]ManifestEntry `json:"files"`
+}
+
+// ManifestEntry describes one file of a snapshot.
+type ManifestEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// SHA256 is the hex-encoded hash of the encrypted file.
+	SHA256 string `json:"sha256"`
+}
+
+// Snapshot writes a crash-consistent copy of the storage to dir in dst. The
+// changes to the storage are paused while the files are staged, which is fast
+// when the storage's Backend supports hard links, and the files are copied
+// after the changes resume. The operations that were in progress are
+// recovered when the copy is opened, as they would be after a crash.
+//
+// dir must not exist. It appears atomically when the copy is complete. A nil
+// dst means the local filesystem.
+func (s *Storage) Snapshot(dst Backend, dir string) (*Manifest, error) {
+	return s.snapshot(dst, dir, nil, "")
+}
+
+// snapshot writes a snapshot of the storage to dir. When prev isn't nil, the
+// files that didn't change since the snapshot in prevDir are linked instead
+// of copied, if dst supports it.
+func (s *Storage) snapshot(dst Backend, dir string, prev *Manifest, prevDir string) (_ *Manifest, retErr error) {
+	if dst == nil {
+		dst = osBackend{}
+	}
+	if _, err := dst.Stat(dir); err == nil {
+		return nil, &fs.PathError{Op: "snapshot", Path: dir, Err: fs.ErrExist}
+	}
+	st, err := s.barrier.stage(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := st.close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	m := &Manifest{Time: st.time, Files: make(map[string]ManifestEntry)}
+	tmp := fmt.Sprintf("%s.tmp-%d", dir, st.time.UnixNano())
+	if err := dst.MkdirAll(tmp, 0o700); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			dst.RemoveAll(tmp)
+		}
+	}()
+	for _, f := range st.files {
+		out := filepath.Join(tmp, f.name)
+		if err := dst.MkdirAll(filepath.Dir(out), 0o700); err != nil {
+			return nil, err
+		}
+		if prev != nil {
+			if e, ok := prev.Files[f.name]; ok && e.Size == f.fi.Size() && e.ModTime.Equal(f.fi.ModTime()) {
+				if err := dst.Link(filepath.Join(prevDir, f.name), out); err == nil {
+					m.Files[f.name] = e
+					continue
+				}
+			}
+		}
+		hash, err := st.copy(f, dst, out)
+		if err != nil {
+			return nil, err
+		}
+		if err := dst.Chtimes(out, f.fi.ModTime(), f.fi.ModTime()); err != nil {
+			return nil, err
+		}
+		m.Files[f.name] = ManifestEntry{Size: f.fi.Size(), ModTime: f.fi.ModTime(), SHA256: hash}
+	}
+	if err := dst.Rename(tmp, dir); err != nil {
+		return nil, err
+	}
+	if err := syncPath(dst, filepath.Dir(dir)); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// saveManifest atomically writes m to file in b.
+func saveManifest(b Backend, file string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.tmp-%d", file, time.Now().UnixNano())
+	f, err := b.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		b.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		b.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		b.Remove(tmp)
+		return err
+	}
+	return b.Rename(tmp, file)
+}
+
+// loadManifest reads a manifest written by saveManifest.
+func loadManifest(b Backend, file string) (*Manifest, error) {
+	data, err := readFile(b, file)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return &m, nil
+}
+
+// barrier lets snapshots pause all the changes to the storage's files. It is
+// installed as the storage's Backend.
+type barrier struct {
+	Backend
+
+	// The changes hold mu for reading, and stage holds it for writing.
+	mu sync.RWMutex
+
+	wmu sync.Mutex
+	// writers counts the open files that can be written to.
+	writers map[string]int
+	// linked are the staged files that are hard links to the storage's
+	// files, and that must be copied before they are modified in place.
+	linked map[string]*stagedFile
+}
+
+func newBarrier(b Backend) *barrier {
+	return &barrier{
+		Backend: b,
+		writers: make(map[string]int),
+		linked:  make(map[string]*stagedFile),
+	}
+}
+
+// stagedFile is a file of a snapshot that is staged in the storage's Backend.
+type stagedFile struct {
+	name   string
+	src    string
+	staged string
+	fi     fs.FileInfo
+
+	// mu is held while the file is copied, or unlinked.
+	mu sync.Mutex
+	// done is true when the file was copied, and doesn't need to be
+	// unlinked anymore.
+	done bool
+}
+
+// staging is a set of staged files.
+type staging struct {
+	b     *barrier
+	dir   string
+	time  time.Time
+	files []*stagedFile
+}
+
+// stage pauses the changes, and links or copies all the files of the storage
+// rooted at root to a staging directory.
+func (b *barrier) stage(root string) (_ *staging, retErr error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	st := &staging{
+		b:    b,
+		dir:  filepath.Join(root, snapshotDir, fmt.Sprintf("%d", now.UnixNano())),
+		time: now,
+	}
+	defer func() {
+		if retErr != nil {
+			st.close()
+		}
+	}()
+	names, err := walkAll(b.Backend, root, func(name string) bool {
+		return snapshotExcludeRE.MatchString(name) || name == snapshotDir || name == replicationDir
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
+	for _, name := range names {
+		f := &stagedFile{
+			name:   name,
+			src:    filepath.Join(root, name),
+			staged: filepath.Join(st.dir, name),
+		}
+		if err := b.Backend.MkdirAll(filepath.Dir(f.staged), 0o700); err != nil {
+			return nil, err
+		}
+		// Files that are open for writing can't be linked.
+		linked := false
+		if b.writers[f.src] == 0 {
+			linked = b.Backend.Link(f.src, f.staged) == nil
+		}
+		if !linked {
+			if err := b.copyFile(f.src, f.staged); err != nil {
+				return nil, err
+			}
+		}
+		if f.fi, err = b.Backend.Stat(f.staged); err != nil {
+			return nil, err
+		}
+		if linked {
+			b.linked[f.src] = f
+		}
+		st.files = append(st.files, f)
+	}
+	return st, nil
+}
+
+// copyFile copies a file in the barrier's Backend, keeping its modification
+// time.
+func (b *barrier) copyFile(src, dst string) error {
+	fi, err := b.Backend.Stat(src)
+	if err != nil {
+		return err
+	}
+	if _, err := copyToBackend(b.Backend, dst, b.Backend, src); err != nil {
+		return err
+	}
+	return b.Backend.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
+
+// unlink replaces the staged hard link to name with a copy, if necessary,
+// before name is modified in place.
+func (b *barrier) unlink(name string) error {
+	b.wmu.Lock()
+	f := b.linked[name]
+	delete(b.linked, name)
+	b.wmu.Unlock()
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done {
+		return nil
+	}
+	tmp := fmt.Sprintf("%s.tmp-%d", f.staged, time.Now().UnixNano())
+	if err := b.copyFile(f.staged, tmp); err != nil {
+		return err
+	}
+	return b.Backend.Rename(tmp, f.staged)
+}
+
+// copy copies a staged file to dst, and returns its hash.
+func (st *staging) copy(f *stagedFile, dst Backend, out string) (hash string, err error) {
+	err = st.read(f, true, func(src string) error {
+		hash, err = copyToBackend(dst, out, st.b.Backend, src)
+		return err
+	})
+	return hash, err
+}
+
+// read calls fn with the name of a staged file, while it can't be unlinked.
+// When done is true, the file doesn't need to be read again afterwards.
+func (st *staging) read(f *stagedFile, done bool, fn func(name string) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := fn(f.staged); err != nil {
+		return err
+	}
+	if !done {
+		return nil
+	}
+	f.done = true
+	st.b.wmu.Lock()
+	if st.b.linked[f.src] == f {
+		delete(st.b.linked, f.src)
+	}
+	st.b.wmu.Unlock()
+	return nil
+}
+
+// close deletes the staging directory.
+func (st *staging) close() error {
+	st.b.wmu.Lock()
+	for _, f := range st.files {
+		if st.b.linked[f.src] == f {
+			delete(st.b.linked, f.src)
+		}
+	}
+	st.b.wmu.Unlock()
+	return st.b.Backend.RemoveAll(st.dir)
+}
+
+func (b *barrier) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return b.Backend.OpenFile(name, flag, perm)
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if err := b.unlink(filepath.Clean(name)); err != nil {
+		return nil, err
+	}
+	f, err := b.Backend.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	b.wmu.Lock()
+	b.writers[filepath.Clean(name)]++
+	b.wmu.Unlock()
+	return &barrierFile{File: f, b: b, name: filepath.Clean(name)}, nil
+}
+
+func (b *barrier) Rename(oldpath, newpath string) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.Backend.Rename(oldpath, newpath)
+}
+
+func (b *barrier) Link(oldname, newname string) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.Backend.Link(oldname, newname)
+}
+
+func (b *barrier) Remove(name string) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.Backend.Remove(name)
+}
+
+func (b *barrier) RemoveAll(path string) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.Backend.RemoveAll(path)
+}
+
+func (b *barrier) MkdirAll(path string, perm fs.FileMode) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.Backend.MkdirAll(path, perm)
+}
+
+func (b *barrier) Chtimes(name string, atime, mtime time.Time) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.Backend.Chtimes(name, atime, mtime)
+}
+
+// barrierFile is a file that is open for writing. The writes are paused
+// while files are staged.
+type barrierFile struct {
+	File
+	b      *barrier
+	name   string
+	closed bool
+}
+
+func (f *barrierFile) Write(p []byte) (int, error) {
+	f.b.mu.RLock()
+	defer f.b.mu.RUnlock()
+	return f.File.Write(p)
+}
+
+func (f *barrierFile) WriteAt(p []byte, off int64) (int, error) {
+	f.b.mu.RLock()
+	defer f.b.mu.RUnlock()
+	return f.File.WriteAt(p, off)
+}
+
+func (f *barrierFile) Truncate(size int64) error {
+	f.b.mu.RLock()
+	defer f.b.mu.RUnlock()
+	return f.File.Truncate(size)
+}
+
+func (f *barrierFile) Close() error {
+	err := f.File.Close()
+	if !f.closed {
+		f.closed = true
+		f.b.wmu.Lock()
+		if f.b.writers[f.name]--; f.b.writers[f.name] == 0 {
+			delete(f.b.writers, f.name)
+		}
+		f.b.wmu.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,163 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	mk := aesEncryptionKey()
+	dir := t.TempDir()
+	s := New(dir, mk)
+	if err := s.SaveDataFile("foo", "foo"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	if err := s.SaveDataFile("dir/bar", "bar"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	writeBlob(t, s, "blob", []byte("blob content"))
+	if err := s.Lock("foo"); err != nil {
+		t.Fatalf("s.Lock: %v", err)
+	}
+	defer s.Unlock("foo")
+
+	snap := filepath.Join(t.TempDir(), "snap")
+	m, err := s.Snapshot(nil, snap)
+	if err != nil {
+		t.Fatalf("s.Snapshot: %v", err)
+	}
+	if len(m.Files) != 3 {
+		t.Errorf("Manifest has %d files, want 3: %v", len(m.Files), m.Files)
+	}
+	for name, e := range m.Files {
+		b, err := os.ReadFile(filepath.Join(snap, name))
+		if err != nil {
+			t.Fatalf("os.ReadFile: %v", err)
+		}
+		if h := sha256.Sum256(b); hex.EncodeToString(h[:]) != e.SHA256 || int64(len(b)) != e.Size {
+			t.Errorf("%s doesn't match the manifest", name)
+		}
+	}
+	// The staging directory is deleted, and lock files aren't copied.
+	if _, err := os.Stat(filepath.Join(dir, snapshotDir)); err == nil {
+		if entries, _ := os.ReadDir(filepath.Join(dir, snapshotDir)); len(entries) != 0 {
+			t.Errorf("Staging directory wasn't deleted: %v", entries)
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(snap, "*.lock")); len(matches) != 0 {
+		t.Errorf("Lock files were copied: %v", matches)
+	}
+
+	r := New(snap, mk)
+	var foo, bar string
+	if err := r.ReadDataFile("foo", &foo); err != nil || foo != "foo" {
+		t.Errorf("r.ReadDataFile(foo) = %q, %v", foo, err)
+	}
+	if err := r.ReadDataFile("dir/bar", &bar); err != nil || bar != "bar" {
+		t.Errorf("r.ReadDataFile(dir/bar) = %q, %v", bar, err)
+	}
+	if got := readBlob(t, r, "blob"); string(got) != "blob content" {
+		t.Errorf("blob = %q", got)
+	}
+
+	if _, err := s.Snapshot(nil, snap); !errors.Is(err, os.ErrExist) {
+		t.Errorf("s.Snapshot(existing dir) = %v, want ErrExist", err)
+	}
+
+	// Snapshot to another backend.
+	mem := NewMemBackend()
+	if _, err := s.Snapshot(mem, "/snap"); err != nil {
+		t.Fatalf("s.Snapshot(mem): %v", err)
+	}
+	if err := New("/snap", mk, WithBackend(mem)).ReadDataFile("foo", &foo); err != nil || foo != "foo" {
+		t.Errorf("ReadDataFile(foo) = %q, %v", foo, err)
+	}
+}
+
+func TestSnapshotRecovery(t *testing.T) {
+	mk := aesEncryptionKey()
+	s := New(t.TempDir(), mk)
+	if err := s.SaveDataFile("foo", "old"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	// An operation is in progress when the snapshot is taken.
+	if _, err := s.createBackup([]string{"foo"}); err != nil {
+		t.Fatalf("s.createBackup: %v", err)
+	}
+	if err := s.SaveDataFile("foo", "new"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	snap := filepath.Join(t.TempDir(), "snap")
+	if _, err := s.Snapshot(nil, snap); err != nil {
+		t.Fatalf("s.Snapshot: %v", err)
+	}
+	// It is rolled back when the snapshot is opened.
+	var foo string
+	if err := New(snap, mk, WithExclusiveAccess()).ReadDataFile("foo", &foo); err != nil || foo != "old" {
+		t.Errorf("ReadDataFile(foo) = %q, %v, want old", foo, err)
+	}
+}
+
+func TestSnapshotInPlaceChanges(t *testing.T) {
+	mk := aesEncryptionKey()
+	dir := t.TempDir()
+	s := New(dir, mk)
+	if err := s.AppendRecord("records", "one"); err != nil {
+		t.Fatalf("s.AppendRecord: %v", err)
+	}
+	st, err := s.barrier.stage(dir)
+	if err != nil {
+		t.Fatalf("stage: %v", err)
+	}
+	defer st.close()
+	// The staged link is replaced with a copy before the file is
+	// modified in place.
+	if err := s.AppendRecord("records", "two"); err != nil {
+		t.Fatalf("s.AppendRecord: %v", err)
+	}
+	out := t.TempDir()
+	for _, f := range st.files {
+		if _, err := st.copy(f, osBackend{}, filepath.Join(out, f.name)); err != nil {
+			t.Fatalf("copy: %v", err)
+		}
+	}
+	var got []string
+	err = New(out, mk).ReadRecords("records", func(decode func(obj interface{}) error) error {
+		var v string
+		if err := decode(&v); err != nil {
+			return err
+		}
+		got = append(got, v)
+		return nil
+	})
+	if err != nil || len(got) != 1 || got[0] != "one" {
+		t.Errorf("ReadRecords = %v, %v, want [one]", got, err)
+	}
+}
@@ -25,11 +25,12 @@
 package storage
 
 import (
-	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding"
 	"encoding/binary"
 	"encoding/gob"
@@ -39,14 +40,10 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
-	"io/ioutil"
-	mrand "math/rand"
-	"os"
-	"os/exec"
 	"path/filepath"
 	"reflect"
+	"slices"
 	"sort"
-	"strings"
 	"time"
 
 	"github.com/c2FmZQ/storage/crypto"
@@ -62,6 +59,7 @@ const (
 	optEncrypted  = 0x10
 	optCompressed = 0x20
 	optPadded     = 0x40
+	optHashed     = 0x80
 )
 
 var (
@@ -73,24 +71,179 @@ var (
 	ErrAlreadyCommitted = errors.New("already committed")
 )
 
+// Option is used to specify optional parameters of Storage.
+type Option func(*option)
+
+type option struct {
+	durability     Durability
+	groupSyncTime  time.Duration
+	cacheSize      int
+	compress       bool
+	commitStrategy CommitStrategy
+	asyncRecovery  bool
+	jsonEncoding   bool
+	exclusive      bool
+	readLocks      bool
+	locker         Locker
+	metrics        MetricsSink
+	editFormat     EditFormat
+	backend        Backend
+	replicas       []Replica
+	signingKey     crypto.SigningKey
+	verifyingKey   crypto.VerifyingKey
+}
+
+// WithAsyncRecovery specifies that the recovery of pending operations should
+// happen in the background instead of delaying Open. The files that are
+// affected by the recovery can't be locked or read until it is complete. Use
+// WaitForRecovery to get the results.
+func WithAsyncRecovery() Option {
+	return func(opt *option) {
+		opt.asyncRecovery = true
+	}
+}
+
+// WithExclusiveAccess specifies that the caller guarantees that no other
+// process is using the storage at the same time. Pending operations are then
+// recovered immediately, instead of waiting to make sure that they were
+// really abandoned.
+func WithExclusiveAccess() Option {
+	return func(opt *option) {
+		opt.exclusive = true
+	}
+}
+
+// WithJSONEncoding specifies that objects should be encoded with encoding/json
+// instead of encoding/gob in the data files. JSON encoded files can be patched
+// with PatchDataFile, and iterated over with the Token and More methods of
+// Decoder. Files are always read with the encoding that they were written
+// with.
+func WithJSONEncoding() Option {
+	return func(opt *option) {
+		opt.jsonEncoding = true
+	}
+}
+
+// WithCompression specifies that the content of data files and blobs should be
+// compressed. Blobs are compressed in independent blocks so that they remain
+// seekable.
+func WithCompression() Option {
+	return func(opt *option) {
+		opt.compress = true
+	}
+}
+
+// WithDurability specifies the durability mode of the storage. The default
+// is DurabilityFull.
+func WithDurability(d Durability) Option {
+	return func(opt *option) {
+		opt.durability = d
+	}
+}
+
+// WithGroupSync specifies that sync operations should be batched together
+// and executed every interval. This reduces the number of syncs when many
+// files are committed concurrently, at the cost of latency. It has no effect
+// with DurabilityNone.
+func WithGroupSync(interval time.Duration) Option {
+	return func(opt *option) {
+		opt.groupSyncTime = interval
+	}
+}
+
 // New returns a new Storage rooted at dir. The caller must provide an
 // EncryptionKey that will be used to encrypt and decrypt per-file encryption
 // keys.
-func New(dir string, masterKey crypto.EncryptionKey) *Storage {
+//
+// New is the same as Open, except that it calls Fatalf on the master key's
+// logger if the recovery of pending operations fails.
+func New(dir string, masterKey crypto.EncryptionKey, opts ...Option) *Storage {
+	s, err := Open(dir, masterKey, opts...)
+	if err != nil {
+		s.Logger().Fatalf("storage.Open: %v", err)
+	}
+	return s
+}
+
+// Open returns a new Storage rooted at dir. The caller must provide an
+// EncryptionKey that will be used to encrypt and decrypt per-file encryption
+// keys.
+//
+// Operations that were interrupted are recovered before Open returns. If the
+// recovery fails, Open returns the Storage along with the error, and the
+// caller can decide whether to proceed, or to retry with RollbackPendingOps.
+func Open(dir string, masterKey crypto.EncryptionKey, opts ...Option) (*Storage, error) {
+	var opt option
+	for _, o := range opts {
+		o(&opt)
+	}
 	s := &Storage{
-		dir:       dir,
-		masterKey: masterKey,
-		useGOB:    true,
+		dir:            dir,
+		masterKey:      masterKey,
+		compress:       opt.compress,
+		useGOB:         !opt.jsonEncoding,
+		durability:     opt.durability,
+		commitStrategy: opt.commitStrategy,
+		exclusive:      opt.exclusive,
+		readLocks:      opt.readLocks,
+		readers:        newReaders(),
+		locker:         opt.locker,
+		metrics:        opt.metrics,
+		lockTimes:      newLockTimes(),
+		editFormat:     opt.editFormat,
+		backend:        opt.backend,
+		signingKey:     opt.signingKey,
+		verifyingKey:   opt.verifyingKey,
+	}
+	if s.signingKey != nil && s.verifyingKey == nil {
+		s.verifyingKey = s.signingKey.VerifyingKey()
+	}
+	if s.backend == nil {
+		s.backend = osBackend{}
+	}
+	if opt.groupSyncTime > 0 && opt.durability != DurabilityNone {
+		s.syncer = newGroupSyncer(opt.groupSyncTime, s.backend)
+	}
+	if opt.cacheSize > 0 {
+		s.cache = newObjectCache(opt.cacheSize, s.backend)
 	}
 	if masterKey != nil {
 		s.logger = masterKey.Logger()
 	} else {
 		s.logger = crypto.StdLogger()
 	}
-	if err := s.rollbackPendingOps(); err != nil {
-		masterKey.Logger().Fatalf("s.rollbackPendingOps: %v", err)
+	if s.metrics == nil {
+		s.metrics = nopMetrics{}
 	}
-	return s
+	if s.locker == nil {
+		if _, ok := s.backend.(osBackend); ok && isNetworkFS(dir) {
+			// Switching automatically would break the mutual exclusion
+			// with the processes that still use the default lock files.
+			s.logger.Infof("%s is on a network filesystem. Consider using WithLocker(NewFcntlLocker(dir)) in all the processes that use it.", dir)
+		}
+		s.locker = &fileLocker{dir: dir, backend: s.backend, logger: s.logger, metrics: s.metrics}
+	}
+	s.barrier = newBarrier(s.backend)
+	s.backend = s.barrier
+	if len(opt.replicas) > 0 {
+		r, err := newReplicator(s, opt.replicas)
+		if err != nil {
+			return s, err
+		}
+		s.replicator = r
+	}
+	ops, err := s.loadPendingOps()
+	if err != nil {
+		return s, err
+	}
+	if opt.asyncRecovery && len(ops) > 0 {
+		s.recoverAsync(ops)
+		return s, nil
+	}
+	if _, err := s.recoverPendingOps(ops); err != nil {
+		return s, err
+	}
+	return s, nil
 }
 
 // Storage offers the API to atomically read, write, and update encrypted files.
@@ -100,6 +253,71 @@ type Storage struct {
 	logger    crypto.Logger
 	compress  bool
 	useGOB    bool
+
+	durability     Durability
+	syncer         *groupSyncer
+	cache          *objectCache
+	commitStrategy CommitStrategy
+	exclusive      bool
+	recovery       *recovery
+	readLocks      bool
+	readers        *readers
+	locker         Locker
+	metrics        MetricsSink
+	lockTimes      *lockTimes
+	editFormat     EditFormat
+	backend        Backend
+	barrier        *barrier
+	replicator     *Replicator
+	signingKey     crypto.SigningKey
+	verifyingKey   crypto.VerifyingKey
+}
+
+// Sub returns a Storage rooted at the prefix subdirectory of s. Its master key
+// is derived from the master key of s and prefix, such that the keys of
+// different subdirectories are independent. The files in the subdirectory can
+// only be accessed with the returned Storage, or another one returned by Sub
+// with the same prefix.
+func (s *Storage) Sub(prefix string) (*Storage, error) {
+	prefix = filepath.Clean(prefix)
+	if !filepath.IsLocal(prefix) || prefix == "." {
+		return nil, fmt.Errorf("invalid prefix %q", prefix)
+	}
+	sub := &Storage{
+		dir:            filepath.Join(s.dir, prefix),
+		logger:         s.logger,
+		compress:       s.compress,
+		useGOB:         s.useGOB,
+		durability:     s.durability,
+		syncer:         s.syncer,
+		commitStrategy: s.commitStrategy,
+		exclusive:      s.exclusive,
+		readLocks:      s.readLocks,
+		readers:        newReaders(),
+		locker:         prefixLocker{s.locker, prefix},
+		metrics:        s.metrics,
+		lockTimes:      newLockTimes(),
+		editFormat:     s.editFormat,
+		backend:        s.backend,
+		barrier:        s.barrier,
+		replicator:     s.replicator,
+		signingKey:     s.signingKey,
+		verifyingKey:   s.verifyingKey,
+	}
+	if s.cache != nil {
+		sub.cache = newObjectCache(s.cache.maxEntries, s.backend)
+	}
+	if s.masterKey != nil {
+		k, err := s.masterKey.DeriveKey([]byte("sub:" + filepath.ToSlash(prefix)))
+		if err != nil {
+			return nil, err
+		}
+		sub.masterKey = k
+	}
+	if _, err := sub.RollbackPendingOps(); err != nil {
+		return nil, err
+	}
+	return sub, nil
 }
 
 // Dir returns the root directory of the storage.
@@ -117,38 +335,123 @@ func (s *Storage) HashString(str string) string {
 	return hex.EncodeToString(s.masterKey.Hash([]byte(str)))
 }
 
-func createParentIfNotExist(filename string) error {
+// hashString is like HashString, but it also works without a master key, in
+// which case the hash isn't keyed.
+func (s *Storage) hashString(str string) string {
+	if s.masterKey == nil {
+		sum := sha256.Sum256([]byte(str))
+		return hex.EncodeToString(sum[:])
+	}
+	return s.HashString(str)
+}
+
+// FanoutPath returns a relative file name for name, in a directory tree with
+// the given number of levels, e.g. ab/cd/abcdef... with 2 levels. The file
+// name is the keyed hash of name, and each level of the tree uses the next
+// two characters of the hash. This spreads large numbers of files across
+// directories, without revealing their names.
+func (s *Storage) FanoutPath(name string, levels int) string {
+	h := s.hashString(name)
+	levels = max(0, min(levels, len(h)/2))
+	parts := make([]string, 0, levels+1)
+	for i := 0; i < levels; i++ {
+		parts = append(parts, h[2*i:2*i+2])
+	}
+	return filepath.Join(append(parts, h)...)
+}
+
+// EncryptDeterministic encrypts plaintext with the master key so that the
+// same context and plaintext always produce the same ciphertext, e.g. for
+// encrypted lookup keys. See crypto.EncryptDeterministic.
+func (s *Storage) EncryptDeterministic(context, plaintext []byte) ([]byte, error) {
+	if s.masterKey == nil {
+		return nil, errors.New("a master key was not provided")
+	}
+	return crypto.EncryptDeterministic(s.masterKey, context, plaintext)
+}
+
+// DecryptDeterministic decrypts a ciphertext that was encrypted with
+// EncryptDeterministic and the same context.
+func (s *Storage) DecryptDeterministic(context, ciphertext []byte) ([]byte, error) {
+	if s.masterKey == nil {
+		return nil, errors.New("a master key was not provided")
+	}
+	return crypto.DecryptDeterministic(s.masterKey, context, ciphertext)
+}
+
+func createParentIfNotExist(b Backend, filename string) error {
 	dir, _ := filepath.Split(filename)
-	return os.MkdirAll(dir, 0700)
+	return b.MkdirAll(dir, 0700)
 }
 
 // Lock atomically creates a lock file for the given filename. When this
 // function returns without error, the lock is acquired and nobody else can
 // acquire it until it is released.
 //
-// There is logic in place to remove stale locks after a while.
+// With the default Locker, there is logic in place to remove stale locks
+// after a while. See WithLocker.
 func (s *Storage) Lock(fn string) error {
-	lockf := filepath.Join(s.dir, fn) + ".lock"
-	if err := createParentIfNotExist(lockf); err != nil {
+	return s.LockContext(context.Background(), fn)
+}
+
+// LockContext is like Lock, but it gives up when ctx is done, in which case
+// the error wraps ctx.Err().
+func (s *Storage) LockContext(ctx context.Context, fn string) error {
+	start := time.Now()
+	if err := s.lockFile(ctx, fn); err != nil {
 		return err
 	}
-	deadline := time.Duration(600+mrand.Int()%60) * time.Second
-	for {
-		f, err := os.OpenFile(lockf, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_SYNC, 0600)
-		if errors.Is(err, os.ErrExist) {
-			s.tryToRemoveStaleLock(lockf, deadline)
-			time.Sleep(time.Duration(100+mrand.Int()%100) * time.Millisecond)
-			continue
-		}
-		if err != nil {
-			return err
-		}
-		s.Logger().Debugf("Locked %s", fn)
-		if err := f.Close(); err != nil {
-			return err
+	if err := s.waitForReaders(ctx, fn); err != nil {
+		s.Unlock(fn)
+		return err
+	}
+	s.metrics.ObserveDuration(MetricLockWait, fn, time.Since(start))
+	return nil
+}
+
+// lockFile acquires the lock for fn, without waiting for readers.
+func (s *Storage) lockFile(ctx context.Context, fn string) error {
+	if err := s.waitForRecovery(ctx, fn); err != nil {
+		return err
+	}
+	if err := s.locker.Lock(ctx, fn); err != nil {
+		return err
+	}
+	s.lockTimes.acquired(fn)
+	s.Logger().Debugf("Locked %s", fn)
+	return nil
+}
+
+// TryLock is like Lock, but it returns immediately. It reports whether the
+// lock was acquired.
+func (s *Storage) TryLock(fn string) (bool, error) {
+	if s.recovery != nil {
+		if _, ok := s.recovery.files[filepath.Clean(fn)]; ok {
+			select {
+			case <-s.recovery.done:
+			default:
+				return false, nil
+			}
 		}
-		return nil
 	}
+	ok, err := s.locker.TryLock(fn)
+	if err != nil || !ok {
+		return false, err
+	}
+	if s.hasReaders(fn) {
+		return false, s.locker.Unlock(fn)
+	}
+	s.lockTimes.acquired(fn)
+	s.Logger().Debugf("Locked %s", fn)
+	return true, nil
+}
+
+// LockWithTimeout is like Lock, but it gives up after timeout, in which case
+// the error wraps context.DeadlineExceeded.
+func (s *Storage) LockWithTimeout(fn string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.LockContext(ctx, fn)
 }
 
 // LockMany locks multiple files such that if the exact same files are locked
@@ -156,12 +459,18 @@ func (s *Storage) Lock(fn string) error {
 //
 // When the function returns successfully, all the files are locked.
 func (s *Storage) LockMany(filenames []string) error {
+	return s.LockManyContext(context.Background(), filenames)
+}
+
+// LockManyContext is like LockMany, but it gives up when ctx is done. None of
+// the files are locked when it returns an error.
+func (s *Storage) LockManyContext(ctx context.Context, filenames []string) error {
 	sorted := make([]string, len(filenames))
 	copy(sorted, filenames)
 	sort.Strings(sorted)
 	var locks []string
 	for _, f := range sorted {
-		if err := s.Lock(f); err != nil {
+		if err := s.LockContext(ctx, f); err != nil {
 			s.UnlockMany(locks)
 			return err
 		}
@@ -172,10 +481,12 @@ func (s *Storage) LockMany(filenames []string) error {
 
 // Unlock released the lock file for the given filename.
 func (s *Storage) Unlock(fn string) error {
-	lockf := filepath.Join(s.dir, fn) + ".lock"
-	if err := os.Remove(lockf); err != nil {
+	if err := s.locker.Unlock(fn); err != nil {
 		return err
 	}
+	if d, ok := s.lockTimes.released(fn); ok {
+		s.metrics.ObserveDuration(MetricLockHold, fn, d)
+	}
 	s.Logger().Debugf("Unlocked %s", fn)
 	return nil
 }
@@ -193,18 +504,6 @@ func (s *Storage) UnlockMany(filenames []string) error {
 	return nil
 }
 
-func (s *Storage) tryToRemoveStaleLock(lockf string, deadline time.Duration) {
-	fi, err := os.Stat(lockf)
-	if err != nil {
-		return
-	}
-	if time.Since(fi.ModTime()) > deadline {
-		if err := os.Remove(lockf); err == nil {
-			s.Logger().Errorf("Removed stale lock %q", lockf)
-		}
-	}
-}
-
 // OpenForUpdate opens a file with the expectation that the object will be
 // modified and then saved again.
 //
@@ -225,6 +524,12 @@ func (s *Storage) OpenForUpdate(f string, obj interface{}) (func(commit bool, er
 	return s.OpenManyForUpdate([]string{f}, []interface{}{obj})
 }
 
+// OpenForUpdateContext is like OpenForUpdate, but it gives up waiting for the
+// lock when ctx is done.
+func (s *Storage) OpenForUpdateContext(ctx context.Context, f string, obj interface{}) (func(commit bool, errp *error) error, error) {
+	return s.OpenManyForUpdateContext(ctx, []string{f}, []interface{}{obj})
+}
+
 // OpenManyForUpdate is like OpenForUpdate, but for multiple files.
 //
 // Example:
@@ -245,6 +550,12 @@ func (s *Storage) OpenForUpdate(f string, obj interface{}) (func(commit bool, er
 //	   return commit(true, nil) // commit
 //	}
 func (s *Storage) OpenManyForUpdate(files []string, objects interface{}) (func(commit bool, errp *error) error, error) {
+	return s.OpenManyForUpdateContext(context.Background(), files, objects)
+}
+
+// OpenManyForUpdateContext is like OpenManyForUpdate, but it gives up waiting
+// for the locks when ctx is done.
+func (s *Storage) OpenManyForUpdateContext(ctx context.Context, files []string, objects interface{}) (func(commit bool, errp *error) error, error) {
 	if reflect.TypeOf(objects).Kind() != reflect.Slice {
 		s.Logger().Fatal("objects must be a slice")
 	}
@@ -252,7 +563,7 @@ func (s *Storage) OpenManyForUpdate(files []string, objects interface{}) (func(c
 	if len(files) != objValue.Len() {
 		s.Logger().Fatalf("len(files) != len(objects), %d != %d", len(files), objValue.Len())
 	}
-	if err := s.LockMany(files); err != nil {
+	if err := s.LockManyContext(ctx, files); err != nil {
 		return nil, err
 	}
 	type readValue struct {
@@ -262,7 +573,7 @@ func (s *Storage) OpenManyForUpdate(files []string, objects interface{}) (func(c
 	ch := make(chan readValue)
 	for i := range files {
 		go func(i int, file string, obj interface{}) {
-			err := s.ReadDataFile(file, obj)
+			err := s.readCachedDataFile(file, obj)
 			ch <- readValue{i, err}
 		}(i, files[i], objValue.Index(i).Interface())
 	}
@@ -271,12 +582,12 @@ func (s *Storage) OpenManyForUpdate(files []string, objects interface{}) (func(c
 	for _ = range files {
 		v := <-ch
 		if v.err != nil {
-			errorList = append(errorList, v.err)
+			errorList = append(errorList, fmt.Errorf("s.ReadDataFile(%q): %w", files[v.i], v.err))
 		}
 	}
-	if errorList != nil {
+	if err := errors.Join(errorList...); err != nil {
 		s.UnlockMany(files)
-		return nil, fmt.Errorf("s.ReadDataFile: %w %v", errorList[0], errorList[1:])
+		return nil, err
 	}
 
 	var called, committed bool
@@ -292,43 +603,15 @@ func (s *Storage) OpenManyForUpdate(files []string, objects interface{}) (func(c
 			errp = &retErr
 		}
 		if commit {
-			// If some of the SaveDataFile calls fails and some succeed, the data could
-			// be inconsistent. When we have more then one file, make a backup of the
-			// original data, and restore it if anything goes wrong.
-			//
-			// If the process dies in the middle of saving the data, the backup will be
-			// restored automatically when the process restarts. See New().
-			var backup *backup
-			if len(files) > 1 {
-				var err error
-				if backup, err = s.createBackup(files); err != nil {
-					*errp = err
-					return *errp
-				}
-			}
-			ch := make(chan error)
+			objs := make([]interface{}, len(files))
 			for i := range files {
-				go func(file string, obj interface{}) {
-					ch <- s.SaveDataFile(file, obj)
-				}(files[i], objValue.Index(i).Interface())
-			}
-			var errorList []error
-			for _ = range files {
-				if err := <-ch; err != nil {
-					errorList = append(errorList, err)
-				}
+				objs[i] = objValue.Index(i).Interface()
 			}
-			if errorList != nil {
-				if backup != nil {
-					backup.restore()
-				}
+			if err := s.commitChanges(files, objs, nil); err != nil {
 				if *errp == nil {
-					*errp = fmt.Errorf("s.SaveDataFile: %w %v", errorList[0], errorList[1:])
+					*errp = err
 				}
 			} else {
-				if backup != nil {
-					backup.delete()
-				}
 				committed = true
 			}
 		}
@@ -342,66 +625,80 @@ func (s *Storage) OpenManyForUpdate(files []string, objects interface{}) (func(c
 	}, nil
 }
 
-func context(s string) []byte {
+func fileContext(s string) []byte {
 	h := sha1.Sum([]byte(s))
 	return h[:]
 }
 
 // ReadDataFile reads an object from a file.
 func (s *Storage) ReadDataFile(filename string, obj interface{}) error {
-	f, err := os.Open(filepath.Join(s.dir, filename))
-	if err != nil {
-		return err
+	if s.readLocks {
+		if err := s.RLock(filename); err != nil {
+			return err
+		}
+		defer s.RUnlock(filename)
 	}
-	defer f.Close()
+	return s.readCachedDataFile(filename, obj)
+}
 
-	hdr := make([]byte, 5)
-	if _, err := io.ReadFull(f, hdr); err != nil {
+// readCachedDataFile is like ReadDataFile, but without the read lock. It is
+// used when the caller already holds the lock.
+func (s *Storage) readCachedDataFile(filename string, obj interface{}) error {
+	if err := s.waitForRecovery(context.Background(), filename); err != nil {
 		return err
 	}
-	if string(hdr[:4]) != "KRIN" {
-		return errors.New("wrong file type")
+	if s.cache == nil {
+		return s.readDataFile(filename, obj, nil)
 	}
-	flags := hdr[4]
-	if flags&optEncrypted != 0 && s.masterKey == nil {
-		return errors.New("file is encrypted, but a master key was not provided")
+	filename = filepath.Clean(filename)
+	if s.cache.get(filename, filepath.Join(s.dir, filename), obj) {
+		return nil
+	}
+	var fi fs.FileInfo
+	if err := s.readDataFile(filename, obj, &fi); err != nil {
+		return err
 	}
+	s.cache.add(filename, fi, obj)
+	return nil
+}
 
-	var r io.ReadSeekCloser = f
-	if flags&optEncrypted != 0 {
-		// Read the encrypted file key.
-		k, err := s.masterKey.ReadEncryptedKey(f)
-		if err != nil {
-			return err
-		}
-		defer k.Wipe()
-		// Use the file key to decrypt the rest of the file.
-		if r, err = k.StartReader(context(filename), f); err != nil {
-			return err
+// invalidateCache removes filename from the object cache, if any.
+func (s *Storage) invalidateCache(filename string) {
+	if s.cache != nil {
+		s.cache.invalidate(filepath.Clean(filename))
+	}
+}
+
+// readDataFile reads an object from a file. When fi isn't nil, it is set to
+// the FileInfo of the file that was read.
+func (s *Storage) readDataFile(filename string, obj interface{}, fi *fs.FileInfo) (retErr error) {
+	rs, err := s.openReadStream(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := rs.Close(); err != nil && retErr == nil {
+			retErr = err
 		}
-		// Read the header again.
-		h := make([]byte, 5)
-		if _, err := io.ReadFull(r, h); err != nil {
+	}()
+	if fi != nil {
+		if *fi, err = rs.f.Stat(); err != nil {
 			return err
 		}
-		if bytes.Compare(hdr, h) != 0 {
-			return errors.New("wrong encrypted header")
-		}
-		if flags&optPadded != 0 {
-			if err := SkipPadding(r); err != nil {
-				return err
-			}
-		}
 	}
-	var rc io.Reader = r
-	if flags&optCompressed != 0 {
-		// Decompress the content of the file.
-		gz, err := gzip.NewReader(r)
-		if err != nil {
+	f, rc, flags := rs.f, rs.Reader, rs.flags
+
+	if e, ok := obj.(*EncodedObject); ok {
+		// Pass the encoded object through.
+		name := encodingNames[flags&optEncodingMask]
+		if _, ok := objectEncoding(name); !ok {
+			return fmt.Errorf("unexpected encoding %x", flags&optEncodingMask)
+		}
+		e.Encoding = name
+		if e.Data, err = appendAll(e.Data[:0], rc, sizeHint(f)); err != nil {
 			return err
 		}
-		defer gz.Close()
-		rc = gz
+		return nil
 	}
 
 	switch enc := flags & optEncodingMask; enc {
@@ -423,7 +720,7 @@ func (s *Storage) ReadDataFile(filename string, obj interface{}) error {
 		if !ok {
 			return fmt.Errorf("obj doesn't implement encoding.BinaryUnmarshaler: %T", obj)
 		}
-		b, err := io.ReadAll(rc)
+		b, err := appendAll(nil, rc, sizeHint(f))
 		if err != nil {
 			return err
 		}
@@ -436,62 +733,179 @@ func (s *Storage) ReadDataFile(filename string, obj interface{}) error {
 		if !ok {
 			return fmt.Errorf("obj isn't *[]byte: %T", obj)
 		}
-		buf := make([]byte, 1024)
-		for {
-			n, err := rc.Read(buf)
-			if n > 0 {
-				*b = append(*b, buf[:n]...)
-			}
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return err
-			}
+		if *b, err = appendAll(*b, rc, sizeHint(f)); err != nil {
+			return err
 		}
 	default:
 		return fmt.Errorf("unexpected encoding %x", enc)
 	}
-	if r != f {
-		if err := r.Close(); err != nil {
-			return err
+	return nil
+}
+
+// readStream is a data file open for reading.
+type readStream struct {
+	// The decrypted and decompressed content of the file.
+	io.Reader
+	// The header flags.
+	flags byte
+
+	f  File
+	r  io.ReadSeekCloser
+	gz *gzip.Reader
+}
+
+// openReadStream opens a data file, verifies its header, and returns a
+// stream of its decrypted and decompressed content.
+func (s *Storage) openReadStream(filename string) (_ *readStream, retErr error) {
+	f, err := s.backend.Open(filepath.Join(s.dir, filename))
+	if err != nil {
+		return nil, err
+	}
+	rs := &readStream{f: f, r: f}
+	defer func() {
+		if retErr != nil {
+			rs.Close()
+		}
+	}()
+
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		return nil, err
+	}
+	switch string(hdr[:4]) {
+	case "KRIN":
+		if s.verifyingKey != nil {
+			return nil, ErrNotSigned
+		}
+	case signedMagic:
+		if err := s.verifySignature(f, filename, hdr); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("wrong file type")
+	}
+	rs.flags = hdr[4]
+	if rs.flags&optEncrypted != 0 && s.masterKey == nil {
+		return nil, errors.New("file is encrypted, but a master key was not provided")
+	}
+
+	if rs.flags&optEncrypted != 0 {
+		// Read the encrypted file key.
+		k, err := s.masterKey.ReadEncryptedKey(f)
+		if err != nil {
+			return nil, err
+		}
+		defer k.Wipe()
+		// Use the file key to decrypt the rest of the file.
+		if rs.r, err = k.StartReader(fileContext(filename), f); err != nil {
+			rs.r = f
+			return nil, err
+		}
+		// Read the header again.
+		h := make([]byte, 5)
+		if _, err := io.ReadFull(rs.r, h); err != nil {
+			return nil, err
+		}
+		if bytes.Compare(hdr, h) != 0 {
+			return nil, errors.New("wrong encrypted header")
+		}
+		if rs.flags&optPadded != 0 {
+			if err := SkipPadding(rs.r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	rs.Reader = rs.r
+	if rs.flags&optHashed != 0 {
+		// This is a blob.
+		off, err := rs.r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		if rs.Reader, err = blobContent(rs.r, rs.flags, off); err != nil {
+			return nil, err
+		}
+	} else if rs.flags&optCompressed != 0 {
+		// Decompress the content of the file.
+		if rs.gz, err = gzip.NewReader(rs.r); err != nil {
+			return nil, err
+		}
+		rs.Reader = rs.gz
+	}
+	return rs, nil
+}
+
+// Close closes the stream and the underlying file.
+func (rs *readStream) Close() error {
+	if rs.gz != nil {
+		rs.gz.Close()
+	}
+	var err error
+	if rs.r != rs.f {
+		err = rs.r.Close()
+	}
+	rs.f.Close()
+	return err
+}
+
+// sizeHint returns the size of f. It is an upper bound of the size of the
+// decrypted content, unless it is compressed.
+func sizeHint(f File) int {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0
+	}
+	return int(fi.Size())
+}
+
+// appendAll reads from r until EOF and appends the data to b. The buffer is
+// grown by sizeHint bytes before reading to avoid repeated allocations.
+func appendAll(b []byte, r io.Reader, sizeHint int) ([]byte, error) {
+	b = slices.Grow(b, sizeHint)
+	for {
+		if len(b) == cap(b) {
+			b = append(b, 0)[:len(b)]
+		}
+		n, err := r.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		if err == io.EOF {
+			return b, nil
+		}
+		if err != nil {
+			return b, err
 		}
 	}
-	return nil
 }
 
 // SaveDataFile atomically replace an object in a file.
 func (s *Storage) SaveDataFile(filename string, obj interface{}) error {
+	return s.saveDataFile(filename, obj, s.encodingOf(obj))
+}
+
+// saveDataFile atomically replace an object in a file, using the given
+// encoding.
+func (s *Storage) saveDataFile(filename string, obj interface{}, enc byte) error {
 	t := fmt.Sprintf("%s.tmp-%d", filename, time.Now().UnixNano())
-	if err := s.writeFile(context(filename), t, obj); err != nil {
+	if err := s.writeEncodedFile(fileContext(filename), t, obj, enc); err != nil {
 		return err
 	}
 	// Atomically replace the file.
-	return os.Rename(filepath.Join(s.dir, t), filepath.Join(s.dir, filename))
+	defer s.invalidateCache(filename)
+	return s.rename(filepath.Join(s.dir, t), filepath.Join(s.dir, filename))
 }
 
 // CreateEmptyFile creates an empty file.
 func (s *Storage) CreateEmptyFile(filename string, empty interface{}) error {
-	return s.writeFile(context(filename), filename, empty)
-}
-
-// writeFile writes obj to a file.
-func (s *Storage) writeFile(ctx []byte, filename string, obj interface{}) (retErr error) {
-	fn := filepath.Join(s.dir, filename)
-	if err := createParentIfNotExist(fn); err != nil {
+	if err := s.writeFile(fileContext(filename), filename, empty); err != nil {
 		return err
 	}
+	return s.syncDir(filepath.Dir(filepath.Join(s.dir, filename)))
+}
 
+// streamFlags returns the encryption and compression flags of the files
+// written by the storage.
+func (s *Storage) streamFlags() byte {
 	var flags byte
-	if _, ok := obj.(encoding.BinaryMarshaler); ok {
-		flags = optBinaryEncoded
-	} else if _, ok := obj.(*[]byte); ok {
-		flags = optRawBytes
-	} else if s.useGOB {
-		flags = optGOBEncoded
-	} else {
-		flags = optJSONEncoded
-	}
 	if s.masterKey != nil {
 		flags |= optEncrypted
 		flags |= optPadded
@@ -499,6 +913,45 @@ func (s *Storage) writeFile(ctx []byte, filename string, obj interface{}) (retEr
 	if s.compress {
 		flags |= optCompressed
 	}
+	return flags
+}
+
+// writeFile writes obj to a file.
+func (s *Storage) writeFile(ctx []byte, filename string, obj interface{}) error {
+	return s.writeEncodedFile(ctx, filename, obj, s.encodingOf(obj))
+}
+
+// encodingOf returns the encoding to use for obj.
+func (s *Storage) encodingOf(obj interface{}) byte {
+	if e, ok := obj.(*EncodedObject); ok {
+		enc, _ := objectEncoding(e.Encoding)
+		return enc
+	}
+	if _, ok := obj.(encoding.BinaryMarshaler); ok {
+		return optBinaryEncoded
+	}
+	if _, ok := obj.(*[]byte); ok {
+		return optRawBytes
+	}
+	if s.useGOB {
+		return optGOBEncoded
+	}
+	return optJSONEncoded
+}
+
+// writeEncodedFile writes obj to a file with the given encoding.
+func (s *Storage) writeEncodedFile(ctx []byte, filename string, obj interface{}, enc byte) (retErr error) {
+	if e, ok := obj.(*EncodedObject); ok {
+		if _, ok := objectEncoding(e.Encoding); !ok {
+			return fmt.Errorf("unexpected encoding %q", e.Encoding)
+		}
+	}
+	fn := filepath.Join(s.dir, filename)
+	if err := createParentIfNotExist(s.backend, fn); err != nil {
+		return err
+	}
+
+	flags := enc | s.streamFlags()
 
 	w, err := s.openWriteStream(ctx, fn, flags, 64*1024)
 	if err != nil {
@@ -510,6 +963,12 @@ func (s *Storage) writeFile(ctx []byte, filename string, obj interface{}) (retEr
 		}
 	}()
 
+	if e, ok := obj.(*EncodedObject); ok {
+		// Write the encoded object as is.
+		_, err := w.Write(e.Data)
+		return err
+	}
+
 	switch enc := flags & optEncodingMask; enc {
 	case optGOBEncoded:
 		// Encode with GOB.
@@ -558,22 +1017,37 @@ func (s *Storage) writeFile(ctx []byte, filename string, obj interface{}) (retEr
 // writeFileName is the name of the file where to write the data.
 // finalFileName is the final name of the file. The caller is expected to rename
 // the file to that name when it is done with writing.
-func (s *Storage) OpenBlobWrite(writeFileName, finalFileName string) (io.WriteCloser, error) {
+func (s *Storage) OpenBlobWrite(writeFileName, finalFileName string, opts ...BlobOption) (io.WriteCloser, error) {
 	fn := filepath.Join(s.dir, writeFileName)
-	if err := createParentIfNotExist(fn); err != nil {
+	if err := createParentIfNotExist(s.backend, fn); err != nil {
 		return nil, err
 	}
-	var flags byte = optRawBytes
-	if s.masterKey != nil {
-		flags |= optEncrypted
-		flags |= optPadded
+	flags := optRawBytes | optHashed | s.streamFlags()
+	w, err := s.openUncompressedWriteStream(fileContext(finalFileName), fn, flags, 1024*1024)
+	if err != nil {
+		return nil, err
 	}
-	return s.openWriteStream(context(finalFileName), fn, flags, 1024*1024)
+	h := sha256.New()
+	w = &hashTrailerWriter{w, h}
+	if flags&optCompressed != 0 {
+		w = newBlockWriter(w)
+	}
+	return withWriteProgress(&hashingWriter{w, h}, opts), nil
 }
 
 // OpenBlobRead opens a blob file for reading.
-func (s *Storage) OpenBlobRead(filename string) (stream io.ReadSeekCloser, retErr error) {
-	f, err := os.Open(filepath.Join(s.dir, filename))
+func (s *Storage) OpenBlobRead(filename string, opts ...BlobOption) (io.ReadSeekCloser, error) {
+	r, err := s.openBlobRead(filename, filename)
+	if err != nil {
+		return nil, err
+	}
+	return withReadProgress(r, opts), nil
+}
+
+// openBlobRead opens a blob file for reading. finalFileName is the name that
+// was used with OpenBlobWrite.
+func (s *Storage) openBlobRead(filename, finalFileName string) (stream io.ReadSeekCloser, retErr error) {
+	f, err := s.backend.Open(filepath.Join(s.dir, filename))
 	if err != nil {
 		return nil, err
 	}
@@ -591,12 +1065,17 @@ func (s *Storage) OpenBlobRead(filename string) (stream io.ReadSeekCloser, retEr
 		return nil, errors.New("wrong file type")
 	}
 	flags := hdr[4]
+	if flags&optEncodingMask == optPaged {
+		f.Close()
+		bf, err := s.openBlobFile(filename, false)
+		if err != nil {
+			return nil, err
+		}
+		return &blobFileReader{io.NewSectionReader(bf, 0, bf.Size()), bf}, nil
+	}
 	if flags&optRawBytes == 0 {
 		return nil, errors.New("blob files is not raw bytes")
 	}
-	if flags&optCompressed != 0 {
-		return nil, errors.New("blob files cannot be compressed")
-	}
 	if flags&optEncrypted != 0 && s.masterKey == nil {
 		return nil, errors.New("file is encrypted, but a master key was not provided")
 	}
@@ -610,7 +1089,7 @@ func (s *Storage) OpenBlobRead(filename string) (stream io.ReadSeekCloser, retEr
 		}
 		defer k.Wipe()
 		// Use the file key to decrypt the rest of the file.
-		if r, err = k.StartReader(context(filename), f); err != nil {
+		if r, err = k.StartReader(fileContext(finalFileName), f); err != nil {
 			return nil, err
 		}
 		// Read the header again.
@@ -631,7 +1110,35 @@ func (s *Storage) OpenBlobRead(filename string) (stream io.ReadSeekCloser, retEr
 	if err != nil {
 		return nil, err
 	}
-	return &seekWrapper{r, off}, nil
+	return blobContent(r, flags, off)
+}
+
+// blobContent returns a stream of the content of a blob that starts at offset
+// off of r.
+func blobContent(r io.ReadSeekCloser, flags byte, off int64) (stream io.ReadSeekCloser, err error) {
+	if flags&optHashed == 0 && flags&optCompressed == 0 {
+		return &seekWrapper{r, off}, nil
+	}
+	var want []byte
+	var end int64
+	if flags&optHashed != 0 {
+		if want, end, err = readHashTrailer(r); err != nil {
+			return nil, err
+		}
+	} else if end, err = r.Seek(0, io.SeekEnd); err != nil {
+		return nil, err
+	}
+	if flags&optCompressed != 0 {
+		if stream, err = newBlockReader(r, off, end); err != nil {
+			return nil, err
+		}
+	} else if stream, err = newSectionReader(r, off, end); err != nil {
+		return nil, err
+	}
+	if want != nil {
+		stream = newVerifyingReader(stream, want)
+	}
+	return stream, nil
 }
 
 // seekWrapper wraps a read stream such that Seek calls are relative to the
@@ -657,15 +1164,48 @@ func (w *seekWrapper) Seek(offset int64, whence int) (newOffset int64, err error
 
 // openWriteStream opens a write stream.
 func (s *Storage) openWriteStream(ctx []byte, fullPath string, flags byte, maxPadding int) (io.WriteCloser, error) {
-	f, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_SYNC, 0600)
+	var w io.WriteCloser
+	var err error
+	if s.signingKey != nil {
+		w, err = s.openSignedWriteStream(ctx, fullPath, flags, maxPadding)
+	} else {
+		w, err = s.openUncompressedWriteStream(ctx, fullPath, flags, maxPadding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if flags&optCompressed != 0 {
+		// Compress the content.
+		gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		return &gzipWrapper{gz, w}, nil
+	}
+	return w, nil
+}
+
+// openUncompressedWriteStream opens a write stream and writes the file header,
+// without compressing the content, even if flags has optCompressed.
+func (s *Storage) openUncompressedWriteStream(ctx []byte, fullPath string, flags byte, maxPadding int) (io.WriteCloser, error) {
+	f, err := s.openFile(fullPath)
 	if err != nil {
 		return nil, err
 	}
-	if _, err := f.Write([]byte{'K', 'R', 'I', 'N', flags}); err != nil {
+	hdr := []byte{'K', 'R', 'I', 'N', flags}
+	if _, err := f.Write(hdr); err != nil {
 		f.Close()
 		return nil, err
 	}
-	var w io.WriteCloser = f
+	return s.startWriteStream(ctx, f, hdr, maxPadding)
+}
+
+// startWriteStream returns a stream to write the content of a file after its
+// header hdr was written to f.
+func (s *Storage) startWriteStream(ctx []byte, f io.WriteCloser, hdr []byte, maxPadding int) (io.WriteCloser, error) {
+	flags := hdr[4]
+	w := f
 	if flags&optEncrypted != 0 {
 		k, err := s.masterKey.NewKey()
 		if err != nil {
@@ -683,7 +1223,7 @@ func (s *Storage) openWriteStream(ctx []byte, fullPath string, flags byte, maxPa
 			return nil, err
 		}
 		// Write the header again.
-		if _, err := w.Write([]byte{'K', 'R', 'I', 'N', flags}); err != nil {
+		if _, err := w.Write(hdr); err != nil {
 			w.Close()
 			return nil, err
 		}
@@ -693,16 +1233,7 @@ func (s *Storage) openWriteStream(ctx []byte, fullPath string, flags byte, maxPa
 			}
 		}
 	}
-	var wc io.WriteCloser = w
-	if flags&optCompressed != 0 {
-		// Compress the content.
-		gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
-		if err != nil {
-			return nil, err
-		}
-		wc = &gzipWrapper{gz, w}
-	}
-	return wc, nil
+	return w, nil
 }
 
 // gzipWrapper wraps a gzip.Writer so that its Close function also closes the
@@ -720,88 +1251,6 @@ func (gz *gzipWrapper) Close() error {
 	return err
 }
 
-// EditDataFile opens a file in a text editor.
-func (s *Storage) EditDataFile(filename string, obj interface{}) (retErr error) {
-	commit, err := s.OpenForUpdate(filename, obj)
-	if err != nil {
-		return err
-	}
-	defer commit(false, &retErr)
-
-	tmpdir := os.TempDir()
-	if _, err := os.Stat("/dev/shm"); err == nil {
-		tmpdir = "/dev/shm"
-	}
-	dir, err := ioutil.TempDir(tmpdir, "edit-*")
-	if err != nil {
-		return err
-	}
-	defer func() { os.RemoveAll(dir) }()
-	if err := os.Chmod(dir, 0700); err != nil {
-		return err
-	}
-	fn := filepath.Join(dir, "datafile")
-	f, err := os.Create(fn)
-	if err != nil {
-		return err
-	}
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-	if err := enc.Encode(obj); err != nil {
-		f.Close()
-		return err
-	}
-	if err := f.Close(); err != nil {
-		return err
-	}
-	var bin string
-	for _, ed := range []string{os.Getenv("EDITOR"), "vim", "vi", "nano"} {
-		if ed == "" {
-			continue
-		}
-		if bin, err = exec.LookPath(ed); err == nil {
-			break
-		}
-		s.Logger().Debugf("LookPath(%q): %v", ed, err)
-		continue
-
-	}
-	if bin == "" {
-		return errors.New("cannot find any text editor")
-	}
-	for {
-		cmd := exec.Command(bin, fn)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			return err
-		}
-
-		// Clear the object before unmarshalling into it again.
-		data := reflect.Indirect(reflect.ValueOf(obj))
-		data.Set(reflect.Zero(data.Type()))
-
-		in, err := os.Open(fn)
-		if err != nil {
-			return err
-		}
-		if err := json.NewDecoder(in).Decode(obj); err != nil {
-			in.Close()
-			fmt.Fprintf(os.Stderr, "JSON: %v\n", err)
-			fmt.Printf("\nRetry (Y/n) ? ")
-			reply, _ := bufio.NewReader(os.Stdin).ReadString('\n')
-			if reply = strings.ToLower(strings.TrimSpace(reply)); reply == "n" {
-				return errors.New("aborted")
-			}
-			continue
-		}
-		in.Close()
-		break
-	}
-	return commit(true, nil)
-}
-
 // AddPadding writes a random-sized padding in the range [0,max[ at the current
 // write position.
 func AddPadding(w io.Writer, max int) error {
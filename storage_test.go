@@ -24,14 +24,18 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"errors"
 	"io"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/c2FmZQ/tpm"
@@ -98,6 +102,46 @@ func TestLock(t *testing.T) {
 	}
 }
 
+func TestLockTimeout(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, aesEncryptionKey())
+
+	if err := s.SaveDataFile("foo", "hello"); err != nil {
+		t.Fatalf("SaveDataFile() failed: %v", err)
+	}
+	if err := s.Lock("foo"); err != nil {
+		t.Fatalf("Lock() failed: %v", err)
+	}
+	if err := s.LockWithTimeout("foo", 200*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("LockWithTimeout() = %v, want DeadlineExceeded", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.LockManyContext(ctx, []string{"bar", "foo"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("LockManyContext() = %v, want Canceled", err)
+	}
+	// bar was unlocked when LockManyContext failed.
+	if err := s.LockWithTimeout("bar", time.Second); err != nil {
+		t.Errorf("LockWithTimeout(bar) = %v", err)
+	}
+	var obj string
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := s.OpenForUpdateContext(ctx, "foo", &obj); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("OpenForUpdateContext() = %v, want DeadlineExceeded", err)
+	}
+	if err := s.UnlockMany([]string{"foo", "bar"}); err != nil {
+		t.Errorf("UnlockMany() failed: %v", err)
+	}
+	commit, err := s.OpenForUpdateContext(context.Background(), "foo", &obj)
+	if err != nil {
+		t.Fatalf("OpenForUpdateContext() = %v", err)
+	}
+	if err := commit(true, nil); err != nil {
+		t.Errorf("commit() = %v", err)
+	}
+}
+
 func TestOpenForUpdate(t *testing.T) {
 	testcases := []struct {
 		name string
@@ -381,6 +425,57 @@ func TestBlobs(t *testing.T) {
 	}
 }
 
+func TestAppendAll(t *testing.T) {
+	content := make([]byte, 3*1024*1024+17)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	for _, hint := range []int{0, 10, len(content), 2 * len(content)} {
+		got, err := appendAll([]byte("prefix"), iotest.HalfReader(bytes.NewReader(content)), hint)
+		if err != nil {
+			t.Fatalf("appendAll: %v", err)
+		}
+		if want := append([]byte("prefix"), content...); !bytes.Equal(want, got) {
+			t.Errorf("appendAll(hint=%d) returned unexpected content", hint)
+		}
+	}
+}
+
+func TestLargeRawBytes(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey())
+	want := make([]byte, 5*1024*1024+123)
+	if _, err := rand.Read(want); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	if err := s.SaveDataFile("file", &want); err != nil {
+		t.Fatalf("s.SaveDataFile() failed: %v", err)
+	}
+	var got []byte
+	if err := s.ReadDataFile("file", &got); err != nil {
+		t.Fatalf("s.ReadDataFile() failed: %v", err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Error("Unexpected content")
+	}
+}
+
+func BenchmarkReadDataFileRawBytes(b *testing.B) {
+	s := New(b.TempDir(), aesEncryptionKey())
+	content := make([]byte, 10*1024*1024)
+	if err := s.SaveDataFile("file", &content); err != nil {
+		b.Fatalf("s.SaveDataFile() failed: %v", err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(content)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var got []byte
+		if err := s.ReadDataFile("file", &got); err != nil {
+			b.Fatalf("s.ReadDataFile() failed: %v", err)
+		}
+	}
+}
+
 func RunBenchmarkOpenForUpdate(b *testing.B, kb int, k crypto.EncryptionKey, compress, useGOB bool) {
 	dir := b.TempDir()
 	file := filepath.Join(dir, "testfile")
@@ -403,7 +498,7 @@ func RunBenchmarkOpenForUpdate(b *testing.B, kb int, k crypto.EncryptionKey, com
 		}
 		obj.M[string(key)] = string(value)
 	}
-	if err := s.writeFile(context("testfile"), "testfile", &obj); err != nil {
+	if err := s.writeFile(fileContext("testfile"), "testfile", &obj); err != nil {
 		b.Fatalf("s.writeFile: %v", err)
 	}
 	fi, err := os.Stat(file)
@@ -550,3 +645,219 @@ func BenchmarkOpenForUpdate_GOB_10MB_PlainText_GZIP(b *testing.B) {
 func BenchmarkOpenForUpdate_GOB_20MB_PlainText_GZIP(b *testing.B) {
 	RunBenchmarkOpenForUpdate(b, 20480, nil, true, true)
 }
+
+func TestFanoutPath(t *testing.T) {
+	for _, mk := range []crypto.EncryptionKey{aesEncryptionKey(), nil} {
+		s := New(t.TempDir(), mk)
+		p := s.FanoutPath("foo", 2)
+		parts := strings.Split(p, string(filepath.Separator))
+		if len(parts) != 3 || len(parts[0]) != 2 || len(parts[1]) != 2 || !strings.HasPrefix(parts[2], parts[0]+parts[1]) {
+			t.Errorf("Unexpected path %q", p)
+		}
+		if p2 := s.FanoutPath("foo", 2); p2 != p {
+			t.Errorf("FanoutPath isn't deterministic: %q != %q", p, p2)
+		}
+		if p2 := s.FanoutPath("bar", 2); p2 == p {
+			t.Errorf("FanoutPath(bar) == FanoutPath(foo): %q", p)
+		}
+		if p0 := s.FanoutPath("foo", 0); p0 != parts[2] {
+			t.Errorf("FanoutPath(foo, 0) = %q, want %q", p0, parts[2])
+		}
+	}
+}
+
+func TestEncryptDeterministic(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey())
+	enc1, err := s.EncryptDeterministic([]byte("email"), []byte("alice@example.com"))
+	if err != nil {
+		t.Fatalf("EncryptDeterministic: %v", err)
+	}
+	enc2, err := s.EncryptDeterministic([]byte("email"), []byte("alice@example.com"))
+	if err != nil {
+		t.Fatalf("EncryptDeterministic: %v", err)
+	}
+	if !bytes.Equal(enc1, enc2) {
+		t.Errorf("EncryptDeterministic isn't deterministic: %x != %x", enc1, enc2)
+	}
+	dec, err := s.DecryptDeterministic([]byte("email"), enc1)
+	if err != nil {
+		t.Fatalf("DecryptDeterministic: %v", err)
+	}
+	if got, want := string(dec), "alice@example.com"; got != want {
+		t.Errorf("DecryptDeterministic = %q, want %q", got, want)
+	}
+	if _, err := New(t.TempDir(), nil).EncryptDeterministic([]byte("email"), dec); err == nil {
+		t.Error("EncryptDeterministic without a master key didn't fail")
+	}
+}
+
+func TestSub(t *testing.T) {
+	dir := t.TempDir()
+	mk := aesEncryptionKey()
+	s := New(dir, mk)
+
+	users, err := s.Sub("users")
+	if err != nil {
+		t.Fatalf("s.Sub: %v", err)
+	}
+	if want, got := filepath.Join(dir, "users"), users.Dir(); want != got {
+		t.Errorf("users.Dir() = %q, want %q", got, want)
+	}
+	certs, err := s.Sub("certs")
+	if err != nil {
+		t.Fatalf("s.Sub: %v", err)
+	}
+	if err := users.SaveDataFile("file", "secret"); err != nil {
+		t.Fatalf("users.SaveDataFile: %v", err)
+	}
+
+	// Another Sub with the same prefix can read the file.
+	users2, err := New(dir, mk).Sub("users/")
+	if err != nil {
+		t.Fatalf("s.Sub: %v", err)
+	}
+	var got string
+	if err := users2.ReadDataFile("file", &got); err != nil || got != "secret" {
+		t.Errorf("users2.ReadDataFile() = %q, %v", got, err)
+	}
+	// Other keys can't.
+	if err := s.ReadDataFile("users/file", &got); err == nil {
+		t.Error("s.ReadDataFile() didn't fail")
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "certs"), 0700); err != nil {
+		t.Fatalf("os.MkdirAll: %v", err)
+	}
+	if err := os.Link(filepath.Join(dir, "users", "file"), filepath.Join(dir, "certs", "file")); err != nil {
+		t.Fatalf("os.Link: %v", err)
+	}
+	if err := certs.ReadDataFile("file", &got); err == nil {
+		t.Error("certs.ReadDataFile() didn't fail")
+	}
+
+	for _, p := range []string{"", ".", "..", "../foo", "/foo"} {
+		if _, err := s.Sub(p); err == nil {
+			t.Errorf("s.Sub(%q) didn't fail", p)
+		}
+	}
+}
+
+func TestWriteOnlyPublicKey(t *testing.T) {
+	mk, err := crypto.CreateX25519MasterKey()
+	if err != nil {
+		t.Fatalf("CreateX25519MasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	pub := mk.(*crypto.X25519Key).PublicKey()
+
+	dir := t.TempDir()
+	w := New(dir, pub)
+	want := []byte("Hello world")
+	if err := w.SaveDataFile("file", &want); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+	var got []byte
+	if err := w.ReadDataFile("file", &got); err == nil {
+		t.Fatal("ReadDataFile with public key should have failed, but didn't")
+	}
+
+	r := New(dir, mk)
+	if err := r.ReadDataFile("file", &got); err != nil {
+		t.Fatalf("ReadDataFile: %v", err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("ReadDataFile() = %q, want %q", got, want)
+	}
+}
+
+func TestMultiRecipient(t *testing.T) {
+	primary, recovery, other := ccEncryptionKey(), aesEncryptionKey(), ccEncryptionKey()
+	mk, err := crypto.NewMultiKey(primary, recovery)
+	if err != nil {
+		t.Fatalf("NewMultiKey: %v", err)
+	}
+	dir := t.TempDir()
+	s := New(dir, mk)
+	want := []byte("Hello world")
+	if err := s.SaveDataFile("file", &want); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+	writeBlob(t, s, "blob", want)
+
+	for _, tc := range []struct {
+		name string
+		key  crypto.EncryptionKey
+		ok   bool
+	}{
+		{"primary", primary, true},
+		{"recovery", recovery, true},
+		{"other", other, false},
+	} {
+		id, err := crypto.NewMultiKey(tc.key)
+		if err != nil {
+			t.Fatalf("NewMultiKey: %v", err)
+		}
+		r := New(dir, id)
+		var got []byte
+		err = r.ReadDataFile("file", &got)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("%s: ReadDataFile should have failed, but didn't", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: ReadDataFile: %v", tc.name, err)
+		}
+		if !bytes.Equal(want, got) {
+			t.Errorf("%s: ReadDataFile() = %q, want %q", tc.name, got, want)
+		}
+		f, err := r.OpenBlobRead("blob")
+		if err != nil {
+			t.Fatalf("%s: OpenBlobRead: %v", tc.name, err)
+		}
+		if got, err = io.ReadAll(f); err != nil {
+			t.Fatalf("%s: ReadAll: %v", tc.name, err)
+		}
+		f.Close()
+		if !bytes.Equal(want, got) {
+			t.Errorf("%s: blob = %q, want %q", tc.name, got, want)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey, newKey := aesEncryptionKey(), ccEncryptionKey()
+	dir := t.TempDir()
+	want := []byte("Hello world")
+	if err := New(dir, oldKey).SaveDataFile("file", &want); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+
+	ks, err := crypto.NewKeyset(newKey, oldKey)
+	if err != nil {
+		t.Fatalf("NewKeyset: %v", err)
+	}
+	s := New(dir, ks)
+	var got []byte
+	if err := s.ReadDataFile("file", &got); err != nil {
+		t.Fatalf("ReadDataFile: %v", err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("ReadDataFile() = %q, want %q", got, want)
+	}
+	if err := New(dir, newKey).ReadDataFile("file", &got); err == nil {
+		t.Fatal("ReadDataFile with new key should have failed, but didn't")
+	}
+
+	// The file is re-encrypted with the new key when it is written again.
+	if err := s.SaveDataFile("file", &got); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+	got = nil
+	if err := New(dir, newKey).ReadDataFile("file", &got); err != nil {
+		t.Fatalf("ReadDataFile with new key: %v", err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("ReadDataFile() = %q, want %q", got, want)
+	}
+}
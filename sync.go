@@ -0,0 +1,174 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Durability specifies how hard the storage tries to make sure that data is
+// on stable storage before returning.
+type Durability int
+
+const (
+	// DurabilityFull opens files with O_SYNC, and syncs the parent
+	// directory after files are renamed. This is the default.
+	DurabilityFull Durability = iota
+	// DurabilityFlushOnClose syncs files when they are closed, and syncs
+	// the parent directory after files are renamed.
+	DurabilityFlushOnClose
+	// DurabilityNone leaves it to the operating system to decide when the
+	// data is written to stable storage. This is fast, but recent changes
+	// can be lost if the system crashes.
+	DurabilityNone
+)
+
+// syncFile is returned by openFile. It syncs the file before closing it when
+// needed.
+type syncFile struct {
+	File
+	s *Storage
+}
+
+func (f *syncFile) Close() error {
+	var err error
+	if f.s.durability == DurabilityFlushOnClose {
+		if f.s.syncer != nil {
+			err = f.s.syncer.sync(f.Name())
+		} else {
+			err = f.Sync()
+		}
+	}
+	if e := f.File.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// openFile creates a new file for writing with the flags required by the
+// storage's durability mode.
+func (s *Storage) openFile(fullPath string) (*syncFile, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if s.durability == DurabilityFull {
+		flags |= os.O_SYNC
+	}
+	f, err := s.backend.OpenFile(fullPath, flags, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &syncFile{f, s}, nil
+}
+
+// rename atomically renames a file, and then syncs the parent directory when
+// required by the storage's durability mode.
+func (s *Storage) rename(oldPath, newPath string) error {
+	if err := s.backend.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	return s.syncDir(filepath.Dir(newPath))
+}
+
+// syncDir syncs a directory, when required by the storage's durability mode.
+func (s *Storage) syncDir(dir string) error {
+	if s.durability == DurabilityNone {
+		return nil
+	}
+	if s.syncer != nil {
+		return s.syncer.sync(dir)
+	}
+	return syncPath(s.backend, dir)
+}
+
+func syncPath(b Backend, name string) error {
+	f, err := b.Open(name)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	// Some systems don't support syncing directories.
+	if errors.Is(err, os.ErrInvalid) {
+		err = nil
+	}
+	return err
+}
+
+// groupSyncer batches sync requests. All the requests received during the
+// same interval are deduplicated and executed together. The callers are
+// blocked until their request is done.
+type groupSyncer struct {
+	interval time.Duration
+	backend  Backend
+
+	mu      sync.Mutex
+	pending map[string][]chan error
+	timer   *time.Timer
+}
+
+func newGroupSyncer(interval time.Duration, backend Backend) *groupSyncer {
+	return &groupSyncer{
+		interval: interval,
+		backend:  backend,
+		pending:  make(map[string][]chan error),
+	}
+}
+
+// sync blocks until name is synced.
+func (g *groupSyncer) sync(name string) error {
+	ch := make(chan error, 1)
+	g.mu.Lock()
+	g.pending[name] = append(g.pending[name], ch)
+	if g.timer == nil {
+		g.timer = time.AfterFunc(g.interval, g.flush)
+	}
+	g.mu.Unlock()
+	return <-ch
+}
+
+func (g *groupSyncer) flush() {
+	g.mu.Lock()
+	pending := g.pending
+	g.pending = make(map[string][]chan error)
+	g.timer = nil
+	g.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for name, waiters := range pending {
+		wg.Add(1)
+		go func(name string, waiters []chan error) {
+			defer wg.Done()
+			err := syncPath(g.backend, name)
+			for _, ch := range waiters {
+				ch <- err
+			}
+		}(name, waiters)
+	}
+	wg.Wait()
+}
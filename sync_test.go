@@ -0,0 +1,97 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDurability(t *testing.T) {
+	testcases := []struct {
+		name string
+		opts []Option
+	}{
+		{"Full", []Option{WithDurability(DurabilityFull)}},
+		{"FlushOnClose", []Option{WithDurability(DurabilityFlushOnClose)}},
+		{"None", []Option{WithDurability(DurabilityNone)}},
+		{"FullGroupSync", []Option{WithDurability(DurabilityFull), WithGroupSync(10 * time.Millisecond)}},
+		{"FlushOnCloseGroupSync", []Option{WithDurability(DurabilityFlushOnClose), WithGroupSync(10 * time.Millisecond)}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := New(t.TempDir(), aesEncryptionKey(), tc.opts...)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					fn := fmt.Sprintf("dir%d/file%d", i%2, i)
+					if err := s.SaveDataFile(fn, fmt.Sprintf("Hello %d", i)); err != nil {
+						t.Errorf("s.SaveDataFile(%q): %v", fn, err)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			for i := 0; i < 10; i++ {
+				fn := fmt.Sprintf("dir%d/file%d", i%2, i)
+				var got string
+				if err := s.ReadDataFile(fn, &got); err != nil {
+					t.Fatalf("s.ReadDataFile(%q): %v", fn, err)
+				}
+				if want := fmt.Sprintf("Hello %d", i); want != got {
+					t.Errorf("Unexpected content. Want %q, got %q", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestGroupSyncer(t *testing.T) {
+	dir := t.TempDir()
+	g := newGroupSyncer(50*time.Millisecond, osBackend{})
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := g.sync(dir); err != nil {
+				t.Errorf("g.sync: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("g.sync returned too early: %s", d)
+	}
+	if err := g.sync(dir + "/does-not-exist"); err == nil {
+		t.Error("g.sync(does-not-exist) didn't fail")
+	}
+}
@@ -0,0 +1,361 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package tpmkms seals master keys with a TPM, to a policy that requires
+// selected PCRs to have specific values, i.e. to the measured boot state of
+// the machine. Unlike the TPM option of the crypto package, which only binds
+// master keys to the TPM chip, a sealed master key can't be unsealed after
+// the firmware, the boot loader or the kernel were tampered with. It
+// implements crypto.KMS.
+//
+// Legitimate upgrades also change the PCR values. Before rebooting, the
+// master key must be re-sealed to the values that are expected after the
+// upgrade, with WithPCRValues and crypto.ResealWithKMS.
+//
+// Example:
+//
+//	kms, err := tpmkms.New(rwc, []int{0, 2, 4, 7})
+//	if err != nil {
+//		return err
+//	}
+//	if err := crypto.SaveWithKMS(ctx, mk, kms, keyFile); err != nil {
+//		return err
+//	}
+//	mk, err := crypto.ReadMasterKeyWithKMS(ctx, kms, keyFile)
+package tpmkms
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+var _ crypto.KMS = (*KMS)(nil)
+
+// The number of PCRs of PC Client TPMs.
+const numPCRs = 24
+
+// ErrInvalidCiphertext is returned by Decrypt when the sealed data can't be
+// parsed.
+var ErrInvalidCiphertext = errors.New("invalid ciphertext")
+
+// Option is used to specify optional parameters of New.
+type Option func(*KMS)
+
+// WithPCRValues specifies the SHA256 values of some PCRs to seal to, instead
+// of their current values, e.g. the values that are expected after an
+// upgrade.
+func WithPCRValues(values map[int][]byte) Option {
+	return func(k *KMS) {
+		for pcr, v := range values {
+			k.values[pcr] = slices.Clone(v)
+		}
+	}
+}
+
+// WithOwnerAuth specifies the passphrase of the owner hierarchy.
+func WithOwnerAuth(pp []byte) Option {
+	return func(k *KMS) {
+		k.ownerAuth = slices.Clone(pp)
+	}
+}
+
+// KMS seals and unseals master keys with a TPM.
+type KMS struct {
+	mu        sync.Mutex
+	tpm       transport.TPM
+	pcrs      []int
+	values    map[int][]byte
+	ownerAuth []byte
+}
+
+// New returns a KMS that uses the TPM rw, and seals master keys to the
+// SHA256 bank of pcrs. Unsealing only depends on the TPM, and on the PCRs
+// that were selected when the key was sealed.
+func New(rw io.ReadWriter, pcrs []int, opts ...Option) (*KMS, error) {
+	if len(pcrs) == 0 {
+		return nil, errors.New("no pcrs")
+	}
+	k := &KMS{
+		tpm:    transport.FromReadWriter(rw),
+		pcrs:   slices.Clone(pcrs),
+		values: make(map[int][]byte),
+	}
+	slices.Sort(k.pcrs)
+	k.pcrs = slices.Compact(k.pcrs)
+	for _, pcr := range k.pcrs {
+		if pcr < 0 || pcr >= numPCRs {
+			return nil, fmt.Errorf("invalid pcr %d", pcr)
+		}
+	}
+	for _, opt := range opts {
+		opt(k)
+	}
+	for pcr, v := range k.values {
+		if !slices.Contains(k.pcrs, pcr) {
+			return nil, fmt.Errorf("pcr %d isn't selected", pcr)
+		}
+		if len(v) != sha256.Size {
+			return nil, fmt.Errorf("invalid value for pcr %d", pcr)
+		}
+	}
+	return k, nil
+}
+
+// PCRValues returns the current SHA256 values of the selected PCRs.
+func (k *KMS) PCRValues() (map[int][]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	out := make(map[int][]byte)
+	for _, pcr := range k.pcrs {
+		v, err := k.readPCR(pcr)
+		if err != nil {
+			return nil, err
+		}
+		out[pcr] = v
+	}
+	return out, nil
+}
+
+// Encrypt seals plaintext to the policy. It is at most 128 bytes.
+func (k *KMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	policy, err := k.policyDigest()
+	if err != nil {
+		return nil, err
+	}
+	srk, err := k.srk()
+	if err != nil {
+		return nil, err
+	}
+	defer k.flush(srk.Handle)
+	resp, err := tpm2.Create{
+		ParentHandle: srk,
+		InSensitive: tpm2.TPM2BSensitiveCreate{
+			Sensitive: &tpm2.TPMSSensitiveCreate{
+				Data: tpm2.NewTPMUSensitiveCreate(&tpm2.TPM2BSensitiveData{Buffer: plaintext}),
+			},
+		},
+		InPublic: tpm2.New2B(tpm2.TPMTPublic{
+			Type:    tpm2.TPMAlgKeyedHash,
+			NameAlg: tpm2.TPMAlgSHA256,
+			ObjectAttributes: tpm2.TPMAObject{
+				FixedTPM:    true,
+				FixedParent: true,
+				NoDA:        true,
+			},
+			AuthPolicy: tpm2.TPM2BDigest{Buffer: policy},
+		}),
+	}.Execute(k.tpm)
+	if err != nil {
+		return nil, fmt.Errorf("TPM2_Create: %w", err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(byte(len(k.pcrs)))
+	for _, pcr := range k.pcrs {
+		buf.WriteByte(byte(pcr))
+	}
+	for _, b := range [][]byte{tpm2.Marshal(resp.OutPublic), tpm2.Marshal(resp.OutPrivate)} {
+		binary.Write(&buf, binary.BigEndian, uint16(len(b)))
+		buf.Write(b)
+	}
+	return buf.Bytes(), nil
+}
+
+// Decrypt unseals ciphertext. It fails when the PCRs don't have the values
+// that ciphertext was sealed to.
+func (k *KMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pcrs, pub, priv, err := parseCiphertext(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	srk, err := k.srk()
+	if err != nil {
+		return nil, err
+	}
+	defer k.flush(srk.Handle)
+	loaded, err := tpm2.Load{
+		ParentHandle: srk,
+		InPrivate:    *priv,
+		InPublic:     *pub,
+	}.Execute(k.tpm)
+	if err != nil {
+		return nil, fmt.Errorf("TPM2_Load: %w", err)
+	}
+	defer k.flush(loaded.ObjectHandle)
+
+	sess, closeSess, err := tpm2.PolicySession(k.tpm, tpm2.TPMAlgSHA256, 16)
+	if err != nil {
+		return nil, fmt.Errorf("TPM2_StartAuthSession: %w", err)
+	}
+	defer closeSess()
+	if _, err := (tpm2.PolicyPCR{PolicySession: sess.Handle(), Pcrs: selection(pcrs)}).Execute(k.tpm); err != nil {
+		return nil, fmt.Errorf("TPM2_PolicyPCR: %w", err)
+	}
+	resp, err := tpm2.Unseal{
+		ItemHandle: tpm2.AuthHandle{
+			Handle: loaded.ObjectHandle,
+			Name:   loaded.Name,
+			Auth:   sess,
+		},
+	}.Execute(k.tpm)
+	if err != nil {
+		return nil, fmt.Errorf("TPM2_Unseal: %w", err)
+	}
+	return resp.OutData.Buffer, nil
+}
+
+func parseCiphertext(b []byte) ([]int, *tpm2.TPM2BPublic, *tpm2.TPM2BPrivate, error) {
+	if len(b) == 0 || len(b) < 1+int(b[0]) {
+		return nil, nil, nil, ErrInvalidCiphertext
+	}
+	pcrs := make([]int, int(b[0]))
+	for i := range pcrs {
+		if pcrs[i] = int(b[1+i]); pcrs[i] >= numPCRs {
+			return nil, nil, nil, ErrInvalidCiphertext
+		}
+	}
+	b = b[1+len(pcrs):]
+	var parts [2][]byte
+	for i := range parts {
+		if len(b) < 2 {
+			return nil, nil, nil, ErrInvalidCiphertext
+		}
+		n := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+n {
+			return nil, nil, nil, ErrInvalidCiphertext
+		}
+		parts[i], b = b[2:2+n], b[2+n:]
+	}
+	if len(pcrs) == 0 || len(b) != 0 {
+		return nil, nil, nil, ErrInvalidCiphertext
+	}
+	pub, err := tpm2.Unmarshal[tpm2.TPM2BPublic](parts[0])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidCiphertext
+	}
+	priv, err := tpm2.Unmarshal[tpm2.TPM2BPrivate](parts[1])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidCiphertext
+	}
+	return pcrs, pub, priv, nil
+}
+
+func selection(pcrs []int) tpm2.TPMLPCRSelection {
+	sel := make([]uint, 0, len(pcrs))
+	for _, pcr := range pcrs {
+		sel = append(sel, uint(pcr))
+	}
+	return tpm2.TPMLPCRSelection{
+		PCRSelections: []tpm2.TPMSPCRSelection{{
+			Hash:      tpm2.TPMAlgSHA256,
+			PCRSelect: tpm2.PCClientCompatible.PCRs(sel...),
+		}},
+	}
+}
+
+func (k *KMS) readPCR(pcr int) ([]byte, error) {
+	resp, err := tpm2.PCRRead{PCRSelectionIn: selection([]int{pcr})}.Execute(k.tpm)
+	if err != nil {
+		return nil, fmt.Errorf("TPM2_PCR_Read: %w", err)
+	}
+	if len(resp.PCRValues.Digests) != 1 {
+		return nil, fmt.Errorf("TPM2_PCR_Read: pcr %d isn't allocated", pcr)
+	}
+	return resp.PCRValues.Digests[0].Buffer, nil
+}
+
+// policyDigest returns the digest of the PCR policy, with the current values
+// of the PCRs unless WithPCRValues specified them.
+func (k *KMS) policyDigest() ([]byte, error) {
+	h := sha256.New()
+	for _, pcr := range k.pcrs {
+		v, ok := k.values[pcr]
+		if !ok {
+			var err error
+			if v, err = k.readPCR(pcr); err != nil {
+				return nil, err
+			}
+		}
+		h.Write(v)
+	}
+	calc, err := tpm2.NewPolicyCalculator(tpm2.TPMAlgSHA256)
+	if err != nil {
+		return nil, err
+	}
+	policy := tpm2.PolicyPCR{
+		PcrDigest: tpm2.TPM2BDigest{Buffer: h.Sum(nil)},
+		Pcrs:      selection(k.pcrs),
+	}
+	if err := policy.Update(calc); err != nil {
+		return nil, err
+	}
+	return calc.Hash().Digest, nil
+}
+
+// srk creates the storage root key in the owner hierarchy. It is derived
+// from the seed of the hierarchy, and is the same every time.
+func (k *KMS) srk() (tpm2.AuthHandle, error) {
+	resp, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.AuthHandle{
+			Handle: tpm2.TPMRHOwner,
+			Auth:   tpm2.PasswordAuth(k.ownerAuth),
+		},
+		InPublic: tpm2.New2B(tpm2.ECCSRKTemplate),
+	}.Execute(k.tpm)
+	if err != nil {
+		return tpm2.AuthHandle{}, fmt.Errorf("TPM2_CreatePrimary: %w", err)
+	}
+	return tpm2.AuthHandle{
+		Handle: resp.ObjectHandle,
+		Name:   resp.Name,
+		Auth:   tpm2.PasswordAuth(nil),
+	}, nil
+}
+
+func (k *KMS) flush(h tpm2.TPMHandle) {
+	tpm2.FlushContext{FlushHandle: h}.Execute(k.tpm)
+}
@@ -0,0 +1,158 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package tpmkms_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-tpm-tools/simulator"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+
+	"github.com/c2FmZQ/storage/crypto"
+	"github.com/c2FmZQ/storage/tpmkms"
+)
+
+// The debug PCR can be extended and reset by the tests.
+const debugPCR = 16
+
+func extend(t *testing.T, rwc *simulator.Simulator, data string) {
+	t.Helper()
+	digest := sha256.Sum256([]byte(data))
+	_, err := tpm2.PCRExtend{
+		PCRHandle: tpm2.AuthHandle{
+			Handle: tpm2.TPMHandle(debugPCR),
+			Auth:   tpm2.PasswordAuth(nil),
+		},
+		Digests: tpm2.TPMLDigestValues{
+			Digests: []tpm2.TPMTHA{{HashAlg: tpm2.TPMAlgSHA256, Digest: digest[:]}},
+		},
+	}.Execute(transport.FromReadWriter(rwc))
+	if err != nil {
+		t.Fatalf("TPM2_PCR_Extend: %v", err)
+	}
+}
+
+func TestSealUnseal(t *testing.T) {
+	ctx := context.Background()
+	rwc, err := simulator.Get()
+	if err != nil {
+		t.Fatalf("simulator.Get: %v", err)
+	}
+	defer rwc.Close()
+
+	kms, err := tpmkms.New(rwc, []int{7, debugPCR})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	mk, err := crypto.CreateMasterKey()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := crypto.SaveWithKMS(ctx, mk, kms, keyFile); err != nil {
+		t.Fatalf("crypto.SaveWithKMS: %v", err)
+	}
+	got, err := crypto.ReadMasterKeyWithKMS(ctx, kms, keyFile)
+	if err != nil {
+		t.Fatalf("crypto.ReadMasterKeyWithKMS: %v", err)
+	}
+	defer got.Wipe()
+	if crypto.KeyID(got) != crypto.KeyID(mk) {
+		t.Error("crypto.ReadMasterKeyWithKMS returned a different key")
+	}
+
+	// An upgrade changes the PCR value. Re-seal to the expected value first.
+	values, err := kms.PCRValues()
+	if err != nil {
+		t.Fatalf("PCRValues: %v", err)
+	}
+	digest := sha256.Sum256([]byte("upgrade"))
+	next := sha256.Sum256(append(values[debugPCR], digest[:]...))
+	newKMS, err := tpmkms.New(rwc, []int{debugPCR}, tpmkms.WithPCRValues(map[int][]byte{debugPCR: next[:]}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := crypto.ResealWithKMS(ctx, kms, newKMS, keyFile); err != nil {
+		t.Fatalf("crypto.ResealWithKMS: %v", err)
+	}
+	if _, err := crypto.ReadMasterKeyWithKMS(ctx, kms, keyFile); err == nil {
+		t.Error("crypto.ReadMasterKeyWithKMS() before the upgrade didn't fail")
+	}
+	extend(t, rwc, "upgrade")
+	if values, err = newKMS.PCRValues(); err != nil {
+		t.Fatalf("PCRValues: %v", err)
+	}
+	if !bytes.Equal(values[debugPCR], next[:]) {
+		t.Errorf("PCR %d = %x, want %x", debugPCR, values[debugPCR], next)
+	}
+	got2, err := crypto.ReadMasterKeyWithKMS(ctx, newKMS, keyFile)
+	if err != nil {
+		t.Fatalf("crypto.ReadMasterKeyWithKMS after the upgrade: %v", err)
+	}
+	defer got2.Wipe()
+	if crypto.KeyID(got2) != crypto.KeyID(mk) {
+		t.Error("crypto.ReadMasterKeyWithKMS returned a different key")
+	}
+
+	// Tampering changes the PCR value too.
+	extend(t, rwc, "tampering")
+	if _, err := crypto.ReadMasterKeyWithKMS(ctx, newKMS, keyFile); err == nil {
+		t.Error("crypto.ReadMasterKeyWithKMS() after tampering didn't fail")
+	}
+}
+
+func TestNew(t *testing.T) {
+	rwc, err := simulator.Get()
+	if err != nil {
+		t.Fatalf("simulator.Get: %v", err)
+	}
+	defer rwc.Close()
+	for _, tc := range []struct {
+		pcrs []int
+		opts []tpmkms.Option
+	}{
+		{pcrs: nil},
+		{pcrs: []int{24}},
+		{pcrs: []int{-1}},
+		{pcrs: []int{7}, opts: []tpmkms.Option{tpmkms.WithPCRValues(map[int][]byte{8: make([]byte, 32)})}},
+		{pcrs: []int{7}, opts: []tpmkms.Option{tpmkms.WithPCRValues(map[int][]byte{7: make([]byte, 20)})}},
+	} {
+		if _, err := tpmkms.New(rwc, tc.pcrs, tc.opts...); err == nil {
+			t.Errorf("New(%v) didn't fail", tc.pcrs)
+		}
+	}
+	kms, err := tpmkms.New(rwc, []int{7})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := kms.Decrypt(context.Background(), []byte{1, 7, 0}); err != tpmkms.ErrInvalidCiphertext {
+		t.Errorf("Decrypt() = %v, want %v", err, tpmkms.ErrInvalidCiphertext)
+	}
+}
@@ -0,0 +1,472 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package tsstore is a time-series store, on top of an encrypted storage.
+//
+// Points are buffered in memory, and appended in compressed chunks to segment
+// files, without rewriting the existing data. Each segment is a record file
+// that has the points of one series in a fixed window of time. Range queries
+// only read the segments that overlap the range, and the segments that are
+// older than the retention period are deleted.
+//
+// Example:
+//
+//	ts, err := tsstore.Open(s, "metrics", tsstore.WithRetention(30*24*time.Hour))
+//	if err != nil {
+//		return err
+//	}
+//	defer ts.Close()
+//	if err := ts.Append("cpu", time.Now(), 0.42); err != nil {
+//		return err
+//	}
+//	...
+//	points, err := ts.Downsample("cpu", from, to, time.Hour, tsstore.Mean)
+package tsstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+)
+
+var (
+	// ErrClosed is returned when the store is closed.
+	ErrClosed = errors.New("store is closed")
+	// ErrLocked is returned by Open when the store is already open.
+	ErrLocked = errors.New("store is already open")
+	// ErrCorruptChunk is returned when a chunk can't be decoded.
+	ErrCorruptChunk = errors.New("corrupt chunk")
+)
+
+const (
+	defaultSegmentDuration = 24 * time.Hour
+	defaultMaxBuffered     = 1000
+
+	lockFile = "tsstore"
+)
+
+// segmentRE matches the names of the segment files.
+var segmentRE = regexp.MustCompile(`^-?[0-9]{1,20}$`)
+
+// Option is used to specify optional parameters of Open.
+type Option func(*Store)
+
+// WithSegmentDuration specifies the window of time of each segment. The
+// default is 24 hours. It must not change after points are stored.
+func WithSegmentDuration(d time.Duration) Option {
+	return func(ts *Store) {
+		ts.segmentDuration = d
+	}
+}
+
+// WithMaxBuffered specifies the number of points that are buffered in memory
+// before they are flushed. The default is 1000.
+func WithMaxBuffered(n int) Option {
+	return func(ts *Store) {
+		ts.maxBuffered = n
+	}
+}
+
+// WithRetention specifies that the segments whose points are all older than
+// d are deleted.
+func WithRetention(d time.Duration) Option {
+	return func(ts *Store) {
+		ts.retention = d
+	}
+}
+
+// Point is a timestamped value.
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// Store is a time-series store. It is safe for concurrent use.
+type Store struct {
+	s               *storage.Storage
+	dir             string
+	segmentDuration time.Duration
+	maxBuffered     int
+	retention       time.Duration
+
+	mu     sync.Mutex
+	closed bool
+	// buffer has the points that aren't flushed yet, by series.
+	buffer   map[string][]Point
+	buffered int
+}
+
+// Open opens the store in dir. Only one Store can have the store open at a
+// time, including in other processes.
+func Open(s *storage.Storage, dir string, opts ...Option) (*Store, error) {
+	ts := &Store{
+		s:               s,
+		dir:             dir,
+		segmentDuration: defaultSegmentDuration,
+		maxBuffered:     defaultMaxBuffered,
+		buffer:          make(map[string][]Point),
+	}
+	for _, opt := range opts {
+		opt(ts)
+	}
+	if ts.segmentDuration <= 0 {
+		return nil, fmt.Errorf("invalid segment duration: %v", ts.segmentDuration)
+	}
+	if err := s.MkdirAll(dir); err != nil {
+		return nil, err
+	}
+	ok, err := s.TryLock(filepath.Join(dir, lockFile))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrLocked
+	}
+	return ts, nil
+}
+
+// Close flushes the buffered points, and closes the store.
+func (ts *Store) Close() error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.closed {
+		return nil
+	}
+	err := ts.flush()
+	ts.closed = true
+	if uErr := ts.s.Unlock(filepath.Join(ts.dir, lockFile)); err == nil {
+		err = uErr
+	}
+	return err
+}
+
+// seriesDir returns the directory of a series. The name of the series isn't
+// visible in the directory name.
+func (ts *Store) seriesDir(series string) string {
+	return filepath.Join(ts.dir, ts.s.FanoutPath(series, 0))
+}
+
+// window returns the start of the segment window that contains t, in
+// nanoseconds since the epoch.
+func (ts *Store) window(t time.Time) int64 {
+	n, d := t.UnixNano(), int64(ts.segmentDuration)
+	w := n - n%d
+	if n < 0 && n%d != 0 {
+		w -= d
+	}
+	return w
+}
+
+func (ts *Store) segmentName(series string, window int64) string {
+	return filepath.Join(ts.seriesDir(series), strconv.FormatInt(window, 10))
+}
+
+// Append adds a point to a series. The point is buffered in memory until the
+// buffer is full, or Flush or Close is called. The points don't have to be
+// appended in chronological order.
+func (ts *Store) Append(series string, t time.Time, v float64) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.closed {
+		return ErrClosed
+	}
+	ts.buffer[series] = append(ts.buffer[series], Point{Time: t, Value: v})
+	ts.buffered++
+	if ts.buffered >= ts.maxBuffered {
+		return ts.flush()
+	}
+	return nil
+}
+
+// Flush writes the buffered points to the segment files.
+func (ts *Store) Flush() error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.closed {
+		return ErrClosed
+	}
+	return ts.flush()
+}
+
+func (ts *Store) flush() error {
+	for series, points := range ts.buffer {
+		windows := make(map[int64]chunk)
+		for _, p := range points {
+			w := ts.window(p.Time)
+			windows[w] = append(windows[w], p)
+		}
+		for w, c := range windows {
+			if err := ts.s.AppendRecord(ts.segmentName(series, w), &c); err != nil {
+				// Keep the points that weren't written.
+				var rest []Point
+				for _, p := range points {
+					if _, ok := windows[ts.window(p.Time)]; ok {
+						rest = append(rest, p)
+					}
+				}
+				ts.buffered -= len(points) - len(rest)
+				ts.buffer[series] = rest
+				return err
+			}
+			delete(windows, w)
+		}
+		ts.buffered -= len(points)
+		delete(ts.buffer, series)
+		if err := ts.prune(series, time.Now()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segments returns the sorted windows of the segments of a series.
+func (ts *Store) segments(series string) ([]int64, error) {
+	entries, err := ts.s.FS().ReadDir(filepath.ToSlash(ts.seriesDir(series)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []int64
+	for _, e := range entries {
+		if !segmentRE.MatchString(e.Name()) {
+			continue
+		}
+		w, err := strconv.ParseInt(e.Name(), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, w)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out, nil
+}
+
+// Prune deletes the segments of a series that are older than the retention
+// period.
+func (ts *Store) Prune(series string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.closed {
+		return ErrClosed
+	}
+	return ts.prune(series, time.Now())
+}
+
+func (ts *Store) prune(series string, now time.Time) error {
+	if ts.retention <= 0 {
+		return nil
+	}
+	windows, err := ts.segments(series)
+	if err != nil {
+		return err
+	}
+	cutoff := now.Add(-ts.retention).UnixNano()
+	for _, w := range windows {
+		if w+int64(ts.segmentDuration) > cutoff {
+			break
+		}
+		if err := ts.s.DeleteFile(ts.segmentName(series, w)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query returns the points of a series with from <= Time < to, in
+// chronological order. It includes the points that aren't flushed yet.
+func (ts *Store) Query(series string, from, to time.Time) ([]Point, error) {
+	ts.mu.Lock()
+	if ts.closed {
+		ts.mu.Unlock()
+		return nil, ErrClosed
+	}
+	var out []Point
+	for _, p := range ts.buffer[series] {
+		if !p.Time.Before(from) && p.Time.Before(to) {
+			out = append(out, p)
+		}
+	}
+	ts.mu.Unlock()
+
+	windows, err := ts.segments(series)
+	if err != nil {
+		return nil, err
+	}
+	first, last := ts.window(from), ts.window(to)
+	for _, w := range windows {
+		if w < first || w > last {
+			continue
+		}
+		err := ts.s.ReadRecords(ts.segmentName(series, w), func(decode func(any) error) error {
+			var c chunk
+			if err := decode(&c); err != nil {
+				return err
+			}
+			for _, p := range c {
+				if !p.Time.Before(from) && p.Time.Before(to) {
+					out = append(out, p)
+				}
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out, nil
+}
+
+// Aggregator combines the values of the points in an interval. The values are
+// in chronological order, and there is at least one.
+type Aggregator func(values []float64) float64
+
+// Mean returns the mean of the values.
+func Mean(values []float64) float64 {
+	return Sum(values) / float64(len(values))
+}
+
+// Sum returns the sum of the values.
+func Sum(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+
+// Min returns the smallest value.
+func Min(values []float64) float64 {
+	m := values[0]
+	for _, v := range values[1:] {
+		m = math.Min(m, v)
+	}
+	return m
+}
+
+// Max returns the largest value.
+func Max(values []float64) float64 {
+	m := values[0]
+	for _, v := range values[1:] {
+		m = math.Max(m, v)
+	}
+	return m
+}
+
+// Last returns the last value.
+func Last(values []float64) float64 {
+	return values[len(values)-1]
+}
+
+// Downsample returns the points of a series with from <= Time < to, combined
+// by agg in intervals of step, starting at from. The time of each returned
+// point is the start of its interval. The intervals without points are
+// omitted.
+func (ts *Store) Downsample(series string, from, to time.Time, step time.Duration, agg Aggregator) ([]Point, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("invalid step: %v", step)
+	}
+	points, err := ts.Query(series, from, to)
+	if err != nil {
+		return nil, err
+	}
+	var out []Point
+	var values []float64
+	var start time.Time
+	for _, p := range points {
+		s := from.Add(p.Time.Sub(from) / step * step)
+		if len(values) > 0 && !s.Equal(start) {
+			out = append(out, Point{Time: start, Value: agg(values)})
+			values = values[:0]
+		}
+		start = s
+		values = append(values, p.Value)
+	}
+	if len(values) > 0 {
+		out = append(out, Point{Time: start, Value: agg(values)})
+	}
+	return out, nil
+}
+
+// chunk is a batch of points that is stored in one record. The times are
+// delta encoded, and the values are XORed with the previous value, which
+// makes regular series very compact.
+type chunk []Point
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (c *chunk) MarshalBinary() ([]byte, error) {
+	b := binary.AppendUvarint(nil, uint64(len(*c)))
+	var prevTime int64
+	var prevValue uint64
+	for _, p := range *c {
+		t, v := p.Time.UnixNano(), math.Float64bits(p.Value)
+		b = binary.AppendVarint(b, t-prevTime)
+		b = binary.AppendUvarint(b, v^prevValue)
+		prevTime, prevValue = t, v
+	}
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (c *chunk) UnmarshalBinary(b []byte) error {
+	n, sz := binary.Uvarint(b)
+	if sz <= 0 || n > uint64(len(b)) {
+		return ErrCorruptChunk
+	}
+	b = b[sz:]
+	out := make(chunk, 0, n)
+	var prevTime int64
+	var prevValue uint64
+	for i := uint64(0); i < n; i++ {
+		dt, sz := binary.Varint(b)
+		if sz <= 0 {
+			return ErrCorruptChunk
+		}
+		b = b[sz:]
+		dv, sz := binary.Uvarint(b)
+		if sz <= 0 {
+			return ErrCorruptChunk
+		}
+		b = b[sz:]
+		prevTime += dt
+		prevValue ^= dv
+		out = append(out, Point{Time: time.Unix(0, prevTime).UTC(), Value: math.Float64frombits(prevValue)})
+	}
+	if len(b) != 0 {
+		return ErrCorruptChunk
+	}
+	*c = out
+	return nil
+}
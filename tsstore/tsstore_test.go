@@ -0,0 +1,179 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package tsstore_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/internal/storagetest"
+	"github.com/c2FmZQ/storage/tsstore"
+)
+
+func open(t *testing.T, s *storage.Storage, opts ...tsstore.Option) *tsstore.Store {
+	t.Helper()
+	ts, err := tsstore.Open(s, "metrics", opts...)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return ts
+}
+
+func query(t *testing.T, ts *tsstore.Store, series string, from, to time.Time) []tsstore.Point {
+	t.Helper()
+	points, err := ts.Query(series, from, to)
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	return points
+}
+
+func TestAppendQuery(t *testing.T) {
+	s := storagetest.New(t)
+	ts := open(t, s, tsstore.WithSegmentDuration(time.Hour), tsstore.WithMaxBuffered(10))
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var want []tsstore.Point
+	for i := 0; i < 300; i++ {
+		p := tsstore.Point{Time: start.Add(time.Duration(i) * time.Minute), Value: float64(i) / 10}
+		if err := ts.Append("cpu", p.Time, p.Value); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+		want = append(want, p)
+	}
+	if err := ts.Append("mem", start, 1); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	// Some of the points are still buffered.
+	if got := query(t, ts, "cpu", start, start.Add(5*time.Hour)); !reflect.DeepEqual(got, want) {
+		t.Errorf("Query() returned %d points, want %d", len(got), len(want))
+	}
+	if err := ts.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	ts = open(t, s, tsstore.WithSegmentDuration(time.Hour))
+	defer ts.Close()
+	if got := query(t, ts, "cpu", start, start.Add(5*time.Hour)); !reflect.DeepEqual(got, want) {
+		t.Errorf("Query() returned %d points, want %d", len(got), len(want))
+	}
+	if got, want := query(t, ts, "cpu", start.Add(90*time.Minute), start.Add(95*time.Minute)), want[90:95]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Query() = %v, want %v", got, want)
+	}
+	if got := query(t, ts, "mem", start, start.Add(time.Hour)); len(got) != 1 || got[0].Value != 1 {
+		t.Errorf("Query(mem) = %v", got)
+	}
+	if got := query(t, ts, "disk", start, start.Add(time.Hour)); got != nil {
+		t.Errorf("Query(disk) = %v", got)
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+	ts := open(t, storagetest.New(t), tsstore.WithSegmentDuration(time.Hour))
+	defer ts.Close()
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, m := range []int{30, 100, 10, 70} {
+		if err := ts.Append("x", start.Add(time.Duration(m)*time.Minute), float64(m)); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+		if err := ts.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	var got []float64
+	for _, p := range query(t, ts, "x", start, start.Add(3*time.Hour)) {
+		got = append(got, p.Value)
+	}
+	if want := []float64{10, 30, 70, 100}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Query() = %v, want %v", got, want)
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	ts := open(t, storagetest.New(t))
+	defer ts.Close()
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 6; i++ {
+		if err := ts.Append("x", start.Add(time.Duration(i)*10*time.Minute), float64(i)); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	if err := ts.Append("x", start.Add(3*time.Hour), 10); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	for _, tc := range []struct {
+		agg  tsstore.Aggregator
+		want []tsstore.Point
+	}{
+		{tsstore.Mean, []tsstore.Point{{start, 1}, {start.Add(30 * time.Minute), 4}, {start.Add(3 * time.Hour), 10}}},
+		{tsstore.Max, []tsstore.Point{{start, 2}, {start.Add(30 * time.Minute), 5}, {start.Add(3 * time.Hour), 10}}},
+		{tsstore.Min, []tsstore.Point{{start, 0}, {start.Add(30 * time.Minute), 3}, {start.Add(3 * time.Hour), 10}}},
+		{tsstore.Sum, []tsstore.Point{{start, 3}, {start.Add(30 * time.Minute), 12}, {start.Add(3 * time.Hour), 10}}},
+	} {
+		got, err := ts.Downsample("x", start, start.Add(4*time.Hour), 30*time.Minute, tc.agg)
+		if err != nil {
+			t.Fatalf("Downsample: %v", err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Downsample() = %v, want %v", got, tc.want)
+		}
+	}
+}
+
+func TestRetention(t *testing.T) {
+	ts := open(t, storagetest.New(t), tsstore.WithSegmentDuration(time.Hour), tsstore.WithRetention(24*time.Hour))
+	defer ts.Close()
+	now := time.Now()
+	old, recent := now.Add(-48*time.Hour), now.Add(-time.Hour)
+	for _, tm := range []time.Time{old, recent} {
+		if err := ts.Append("x", tm, 1); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	if err := ts.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	points := query(t, ts, "x", now.Add(-72*time.Hour), now)
+	if len(points) != 1 || !points[0].Time.Equal(recent) {
+		t.Errorf("Query() = %v", points)
+	}
+}
+
+func TestLocked(t *testing.T) {
+	s := storagetest.New(t)
+	ts := open(t, s)
+	if _, err := tsstore.Open(s, "metrics"); !errors.Is(err, tsstore.ErrLocked) {
+		t.Errorf("Open() = %v, want ErrLocked", err)
+	}
+	if err := ts.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := ts.Append("x", time.Now(), 1); !errors.Is(err, tsstore.ErrClosed) {
+		t.Errorf("Append() = %v, want ErrClosed", err)
+	}
+}
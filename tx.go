@@ -0,0 +1,207 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+)
+
+// Tx is a transaction that reads, writes, and deletes data files atomically.
+// Files are locked when they are first used in the transaction, and they stay
+// locked until Commit or Rollback is called. Writes and deletes are staged,
+// and applied when the transaction is committed. If the process dies in the
+// middle of a commit, the changes are rolled back the next time the storage
+// is opened.
+//
+// Example:
+//
+//	func foo() error {
+//	  tx, err := s.Begin(file1, file2)
+//	  if err != nil {
+//	    return err
+//	  }
+//	  defer tx.Rollback() // no-op after Commit.
+//	  var foo FooStruct
+//	  if err := tx.Read(file1, &foo); err != nil {
+//	    return err
+//	  }
+//	  foo.Bar = X
+//	  if err := tx.Write(file1, &foo); err != nil {
+//	    return err
+//	  }
+//	  if err := tx.Delete(file2); err != nil {
+//	    return err
+//	  }
+//	  return tx.Commit()
+//	}
+//
+// Tx is not safe for concurrent use by multiple goroutines.
+type Tx struct {
+	s      *Storage
+	locked map[string]bool
+	// The staged writes and deletes. A txDelete value is a delete.
+	staged map[string]interface{}
+	done   error
+}
+
+type txDelete struct{}
+
+// Begin starts a new transaction. The files, if any, are locked immediately,
+// in a way that avoids deadlocks with other transactions that lock the same
+// files. Other files are locked when they are first used.
+func (s *Storage) Begin(files ...string) (*Tx, error) {
+	tx := &Tx{s: s, locked: make(map[string]bool), staged: make(map[string]interface{})}
+	if err := s.LockMany(files); err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		tx.locked[f] = true
+	}
+	return tx, nil
+}
+
+func (tx *Tx) lock(filename string) error {
+	if tx.done != nil {
+		return tx.done
+	}
+	if tx.locked[filename] {
+		return nil
+	}
+	if err := tx.s.Lock(filename); err != nil {
+		return err
+	}
+	tx.locked[filename] = true
+	return nil
+}
+
+// Read reads a data file into obj. If the file has a staged write in the
+// transaction, obj is set to a copy of the staged object. If the file has a
+// staged delete, it returns os.ErrNotExist.
+func (tx *Tx) Read(filename string, obj interface{}) error {
+	if err := tx.lock(filename); err != nil {
+		return err
+	}
+	staged, ok := tx.staged[filename]
+	if !ok {
+		return tx.s.readCachedDataFile(filename, obj)
+	}
+	if _, ok := staged.(txDelete); ok {
+		return os.ErrNotExist
+	}
+	dst, src := reflect.ValueOf(obj), reflect.ValueOf(staged)
+	if dst.Kind() != reflect.Pointer || dst.IsNil() {
+		return fmt.Errorf("obj isn't a pointer: %T", obj)
+	}
+	if src.Kind() == reflect.Pointer && src.Type() == dst.Type() {
+		src = src.Elem()
+	}
+	if src.Type() != dst.Elem().Type() {
+		return fmt.Errorf("staged object for %s is %T, not %T", filename, staged, obj)
+	}
+	dst.Elem().Set(deepCopy(src))
+	return nil
+}
+
+// Write stages obj to be written to filename when the transaction is
+// committed. A copy of obj is staged, so later changes to obj are not
+// included.
+func (tx *Tx) Write(filename string, obj interface{}) error {
+	if err := tx.lock(filename); err != nil {
+		return err
+	}
+	if obj == nil {
+		return errors.New("obj is nil")
+	}
+	tx.staged[filename] = deepCopy(reflect.ValueOf(obj)).Interface()
+	return nil
+}
+
+// Delete stages filename to be deleted when the transaction is committed.
+func (tx *Tx) Delete(filename string) error {
+	if err := tx.lock(filename); err != nil {
+		return err
+	}
+	tx.staged[filename] = txDelete{}
+	return nil
+}
+
+// Commit applies the staged writes and deletes atomically, and releases the
+// locks. If any of the changes can't be applied, none of them are.
+func (tx *Tx) Commit() (retErr error) {
+	if tx.done != nil {
+		return tx.done
+	}
+	tx.done = ErrAlreadyCommitted
+	defer func() {
+		if err := tx.unlock(); err != nil && retErr == nil {
+			retErr = err
+		}
+		if retErr != nil {
+			tx.done = ErrAlreadyRolledBack
+		}
+	}()
+	files := make([]string, 0, len(tx.staged))
+	for f := range tx.staged {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	if len(files) == 0 {
+		return nil
+	}
+
+	var writes, deletes []string
+	var objs []interface{}
+	for _, f := range files {
+		if _, ok := tx.staged[f].(txDelete); ok {
+			deletes = append(deletes, f)
+			continue
+		}
+		writes = append(writes, f)
+		objs = append(objs, tx.staged[f])
+	}
+	return tx.s.commitChanges(writes, objs, deletes)
+}
+
+// Rollback discards the staged changes and releases the locks. It does
+// nothing if the transaction was already committed or rolled back.
+func (tx *Tx) Rollback() error {
+	if tx.done != nil {
+		return nil
+	}
+	tx.done = ErrAlreadyRolledBack
+	return tx.unlock()
+}
+
+func (tx *Tx) unlock() error {
+	files := make([]string, 0, len(tx.locked))
+	for f := range tx.locked {
+		files = append(files, f)
+	}
+	tx.locked = nil
+	return tx.s.UnlockMany(files)
+}
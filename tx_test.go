@@ -0,0 +1,162 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestTx(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey())
+	type Foo struct {
+		N int
+	}
+	if err := s.SaveDataFile("a", Foo{1}); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	if err := s.SaveDataFile("b", Foo{2}); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+
+	tx, err := s.Begin("a", "b")
+	if err != nil {
+		t.Fatalf("s.Begin: %v", err)
+	}
+	var a Foo
+	if err := tx.Read("a", &a); err != nil || a.N != 1 {
+		t.Fatalf("tx.Read(a) = %v, %v", a, err)
+	}
+	a.N = 10
+	if err := tx.Write("a", &a); err != nil {
+		t.Fatalf("tx.Write(a): %v", err)
+	}
+	if err := tx.Write("c", Foo{3}); err != nil {
+		t.Fatalf("tx.Write(c): %v", err)
+	}
+	if err := tx.Delete("b"); err != nil {
+		t.Fatalf("tx.Delete(b): %v", err)
+	}
+	// Read the staged changes.
+	var c Foo
+	if err := tx.Read("c", &c); err != nil || c.N != 3 {
+		t.Fatalf("tx.Read(c) = %v, %v", c, err)
+	}
+	if err := tx.Read("b", &c); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("tx.Read(b) = %v", err)
+	}
+	// Nothing is written before commit.
+	if err := s.ReadDataFile("a", &a); err != nil || a.N != 1 {
+		t.Fatalf("s.ReadDataFile(a) = %v, %v", a, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("tx.Commit: %v", err)
+	}
+	if err := tx.Commit(); err != ErrAlreadyCommitted {
+		t.Errorf("tx.Commit again = %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Errorf("tx.Rollback after commit = %v", err)
+	}
+	if err := tx.Write("a", &a); err != ErrAlreadyCommitted {
+		t.Errorf("tx.Write after commit = %v", err)
+	}
+
+	if err := s.ReadDataFile("a", &a); err != nil || a.N != 10 {
+		t.Errorf("s.ReadDataFile(a) = %v, %v", a, err)
+	}
+	if err := s.ReadDataFile("b", &a); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("s.ReadDataFile(b) = %v", err)
+	}
+	if err := s.ReadDataFile("c", &c); err != nil || c.N != 3 {
+		t.Errorf("s.ReadDataFile(c) = %v, %v", c, err)
+	}
+	// The locks were released.
+	if err := s.Lock("a"); err != nil {
+		t.Fatalf("s.Lock: %v", err)
+	}
+	s.Unlock("a")
+}
+
+func TestTxRollback(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey())
+	if err := s.SaveDataFile("a", "foo"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	if err := s.SaveDataFile("b", "bar"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+
+	tx, err := s.Begin()
+	if err != nil {
+		t.Fatalf("s.Begin: %v", err)
+	}
+	if err := tx.Write("a", "new"); err != nil {
+		t.Fatalf("tx.Write: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("tx.Rollback: %v", err)
+	}
+	if err := tx.Commit(); err != ErrAlreadyRolledBack {
+		t.Errorf("tx.Commit after rollback = %v", err)
+	}
+
+	// A failed commit doesn't apply any change.
+	if tx, err = s.Begin(); err != nil {
+		t.Fatalf("s.Begin: %v", err)
+	}
+	tx.Delete("a")
+	tx.Write("b", make(chan int))
+	if err := tx.Commit(); err == nil {
+		t.Fatal("tx.Commit didn't fail")
+	}
+	var got string
+	if err := s.ReadDataFile("a", &got); err != nil || got != "foo" {
+		t.Errorf("s.ReadDataFile(a) = %q, %v", got, err)
+	}
+	if err := s.ReadDataFile("b", &got); err != nil || got != "bar" {
+		t.Errorf("s.ReadDataFile(b) = %q, %v", got, err)
+	}
+}
+
+func TestTxRollbackCreate(t *testing.T) {
+	s := New(t.TempDir(), aesEncryptionKey())
+	if err := s.SaveDataFile("b", "bar"); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	tx, err := s.Begin()
+	if err != nil {
+		t.Fatalf("s.Begin: %v", err)
+	}
+	tx.Write("new", "foo")
+	tx.Write("b", make(chan int))
+	if err := tx.Commit(); err == nil {
+		t.Fatal("tx.Commit didn't fail")
+	}
+	var got string
+	if err := s.ReadDataFile("new", &got); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("s.ReadDataFile(new) = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,248 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// ErrUploadOffsetMismatch indicates that a part was not appended at the
+	// current end of the upload, e.g. because the previous part was already
+	// received.
+	ErrUploadOffsetMismatch = errors.New("upload offset mismatch")
+	// ErrInvalidUploadID indicates that an upload ID is malformed.
+	ErrInvalidUploadID = errors.New("invalid upload id")
+)
+
+// Upload sessions are stored in the uploads directory. The state of each
+// session is in a data file named after the session ID, and the parts are
+// blobs in a directory next to it:
+//
+//	uploads/<id>
+//	uploads/<id>.parts/part-000000
+//	uploads/<id>.parts/part-000001
+//	...
+//
+// The parts are written with BlobWriter, so a part that is interrupted by a
+// crash is deleted by the pending ops machinery the next time the storage is
+// opened, and a part that is still being written is left alone. The session
+// state is updated only after the part is committed. The
+// sessions themselves survive restarts.
+const uploadDir = "uploads"
+
+type uploadSession struct {
+	Filename string    `json:"filename"`
+	Size     int64     `json:"size"`
+	Parts    int       `json:"parts"`
+	Created  time.Time `json:"created"`
+}
+
+// UploadInfo contains information about an upload session.
+type UploadInfo struct {
+	// The ID of the session.
+	ID string
+	// The name of the blob that will be created by CompleteUpload.
+	Filename string
+	// The number of bytes received so far.
+	Size int64
+	// The number of parts received so far.
+	Parts int
+	// When the session was created.
+	Created time.Time
+}
+
+// CreateUpload creates a new upload session for a blob. The data is sent in
+// parts with AppendPart, and the blob is created with CompleteUpload. The
+// session is persisted such that the upload can be resumed after the process
+// restarts. It returns the ID of the session.
+func (s *Storage) CreateUpload(filename string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	sess := uploadSession{
+		Filename: filename,
+		Created:  time.Now().UTC(),
+	}
+	if err := s.SaveDataFile(uploadSessionFile(id), sess); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// GetUpload returns information about an upload session. It can be used to
+// find where to resume an interrupted upload.
+func (s *Storage) GetUpload(id string) (UploadInfo, error) {
+	if err := checkUploadID(id); err != nil {
+		return UploadInfo{}, err
+	}
+	var sess uploadSession
+	if err := s.ReadDataFile(uploadSessionFile(id), &sess); err != nil {
+		return UploadInfo{}, err
+	}
+	return UploadInfo{
+		ID:       id,
+		Filename: sess.Filename,
+		Size:     sess.Size,
+		Parts:    sess.Parts,
+		Created:  sess.Created,
+	}, nil
+}
+
+// AppendPart reads r until EOF and appends the data to the upload. offset must
+// be the number of bytes already received, otherwise ErrUploadOffsetMismatch
+// is returned. This makes it safe to retry a part when the client doesn't know
+// whether it was received. If an error occurs, the part is discarded, and it
+// must be sent again.
+//
+// It returns the new number of bytes received.
+func (s *Storage) AppendPart(id string, offset int64, r io.Reader) (retSize int64, retErr error) {
+	if err := checkUploadID(id); err != nil {
+		return 0, err
+	}
+	var sess uploadSession
+	commit, err := s.OpenForUpdate(uploadSessionFile(id), &sess)
+	if err != nil {
+		return 0, err
+	}
+	defer commit(false, &retErr)
+	if offset != sess.Size {
+		return sess.Size, ErrUploadOffsetMismatch
+	}
+	w, err := s.CreateBlob(uploadPartFile(id, sess.Parts))
+	if err != nil {
+		return 0, err
+	}
+	defer w.Abort()
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return 0, err
+	}
+	if err := w.Commit(); err != nil {
+		return 0, err
+	}
+	sess.Parts++
+	sess.Size += n
+	if err := commit(true, nil); err != nil {
+		return 0, err
+	}
+	return sess.Size, nil
+}
+
+// CompleteUpload assembles the parts of an upload into a blob, and deletes the
+// session.
+func (s *Storage) CompleteUpload(id string) (retErr error) {
+	if err := checkUploadID(id); err != nil {
+		return err
+	}
+	sf := uploadSessionFile(id)
+	if err := s.Lock(sf); err != nil {
+		return err
+	}
+	defer func() {
+		if err := s.Unlock(sf); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	var sess uploadSession
+	if err := s.readCachedDataFile(sf, &sess); err != nil {
+		return err
+	}
+	w, err := s.CreateBlob(sess.Filename)
+	if err != nil {
+		return err
+	}
+	defer w.Abort()
+	for i := 0; i < sess.Parts; i++ {
+		if err := copyBlob(w, s, uploadPartFile(id, i)); err != nil {
+			return err
+		}
+	}
+	if err := w.Commit(); err != nil {
+		return err
+	}
+	return s.deleteUpload(id)
+}
+
+// AbortUpload discards an upload session and all its parts.
+func (s *Storage) AbortUpload(id string) (retErr error) {
+	if err := checkUploadID(id); err != nil {
+		return err
+	}
+	sf := uploadSessionFile(id)
+	if err := s.Lock(sf); err != nil {
+		return err
+	}
+	defer func() {
+		if err := s.Unlock(sf); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	if _, err := s.backend.Stat(filepath.Join(s.dir, sf)); err != nil {
+		return err
+	}
+	return s.deleteUpload(id)
+}
+
+// deleteUpload deletes the parts of an upload, and then the session.
+func (s *Storage) deleteUpload(id string) error {
+	if err := s.backend.RemoveAll(filepath.Join(s.dir, uploadDir, id+".parts")); err != nil {
+		return err
+	}
+	return s.backend.Remove(filepath.Join(s.dir, uploadSessionFile(id)))
+}
+
+// copyBlob copies the content of a blob to w.
+func copyBlob(w io.Writer, s *Storage, filename string) error {
+	r, err := s.OpenBlobRead(filename)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func checkUploadID(id string) error {
+	if b, err := hex.DecodeString(id); err != nil || len(b) != 16 {
+		return ErrInvalidUploadID
+	}
+	return nil
+}
+
+func uploadSessionFile(id string) string {
+	return filepath.Join(uploadDir, id)
+}
+
+func uploadPartFile(id string, part int) string {
+	return filepath.Join(uploadDir, id+".parts", fmt.Sprintf("part-%06d", part))
+}
@@ -0,0 +1,147 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUpload(t *testing.T) {
+	dir := t.TempDir()
+	mk := aesEncryptionKey()
+	s := New(dir, mk)
+
+	id, err := s.CreateUpload("blob")
+	if err != nil {
+		t.Fatalf("s.CreateUpload: %v", err)
+	}
+	parts := []string{"Hello ", "world", "!"}
+	var off int64
+	for _, p := range parts {
+		if off, err = s.AppendPart(id, off, strings.NewReader(p)); err != nil {
+			t.Fatalf("s.AppendPart: %v", err)
+		}
+	}
+	// Retry the last part.
+	if n, err := s.AppendPart(id, off-1, strings.NewReader("!")); !errors.Is(err, ErrUploadOffsetMismatch) || n != off {
+		t.Fatalf("s.AppendPart = %d, %v", n, err)
+	}
+
+	// Resume after a restart.
+	s = New(dir, mk)
+	info, err := s.GetUpload(id)
+	if err != nil {
+		t.Fatalf("s.GetUpload: %v", err)
+	}
+	if info.Filename != "blob" || info.Size != 12 || info.Parts != 3 {
+		t.Fatalf("Unexpected upload info: %+v", info)
+	}
+	if err := s.CompleteUpload(id); err != nil {
+		t.Fatalf("s.CompleteUpload: %v", err)
+	}
+	if got := readBlob(t, s, "blob"); !bytes.Equal(got, []byte("Hello world!")) {
+		t.Errorf("Unexpected content %q", got)
+	}
+	if _, err := s.GetUpload(id); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("s.GetUpload after complete: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, uploadDir, id+".parts")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Parts not deleted: %v", err)
+	}
+}
+
+// readerFunc calls fn before the first read.
+type readerFunc struct {
+	io.Reader
+	fn func()
+}
+
+func (r *readerFunc) Read(b []byte) (int, error) {
+	if r.fn != nil {
+		r.fn()
+		r.fn = nil
+	}
+	return r.Reader.Read(b)
+}
+
+func TestUploadConcurrentOpen(t *testing.T) {
+	dir := t.TempDir()
+	mk := aesEncryptionKey()
+	s := New(dir, mk)
+
+	id, err := s.CreateUpload("blob")
+	if err != nil {
+		t.Fatalf("s.CreateUpload: %v", err)
+	}
+	// The storage is opened by another process while a part is being
+	// written.
+	r := &readerFunc{Reader: strings.NewReader("Hello world!"), fn: func() {
+		if _, err := Open(dir, mk, WithExclusiveAccess()); err != nil {
+			t.Errorf("Open: %v", err)
+		}
+	}}
+	if _, err := s.AppendPart(id, 0, r); err != nil {
+		t.Fatalf("s.AppendPart: %v", err)
+	}
+	if err := s.CompleteUpload(id); err != nil {
+		t.Fatalf("s.CompleteUpload: %v", err)
+	}
+	if got := readBlob(t, s, "blob"); !bytes.Equal(got, []byte("Hello world!")) {
+		t.Errorf("Unexpected content %q", got)
+	}
+}
+
+func TestAbortUpload(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir, aesEncryptionKey())
+
+	id, err := s.CreateUpload("blob")
+	if err != nil {
+		t.Fatalf("s.CreateUpload: %v", err)
+	}
+	if _, err := s.AppendPart(id, 0, strings.NewReader("foo")); err != nil {
+		t.Fatalf("s.AppendPart: %v", err)
+	}
+	if err := s.AbortUpload(id); err != nil {
+		t.Fatalf("s.AbortUpload: %v", err)
+	}
+	if _, err := s.GetUpload(id); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("s.GetUpload after abort: %v", err)
+	}
+	if err := s.AbortUpload(id); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("s.AbortUpload again: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "blob")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Blob should not exist: %v", err)
+	}
+	if _, err := s.AppendPart("../foo", 0, strings.NewReader("foo")); !errors.Is(err, ErrInvalidUploadID) {
+		t.Errorf("s.AppendPart with invalid ID: %v", err)
+	}
+}
@@ -0,0 +1,291 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package vaultkms seals master keys with the transit secrets engine of
+// HashiCorp Vault. It implements crypto.KMS.
+//
+// The master key is sealed when it is saved, and unsealed when it is read.
+// The Vault token is renewed automatically when it is about to expire.
+//
+// Example:
+//
+//	kms := vaultkms.New("https://vault.example.com:8200", os.Getenv("VAULT_TOKEN"), "storage")
+//	mk, err := crypto.ReadMasterKeyWithKMS(ctx, kms, keyFile)
+//	if err != nil {
+//		return err
+//	}
+//	defer mk.Wipe()
+//	s := storage.New(dir, mk)
+package vaultkms
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+var _ crypto.KMS = (*KMS)(nil)
+
+// Error is an error returned by Vault.
+type Error struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Errors are the error messages of the response.
+	Errors []string
+}
+
+func (e *Error) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("vault: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("vault: %d %s", e.StatusCode, strings.Join(e.Errors, "; "))
+}
+
+// Option is used to specify optional parameters of New.
+type Option func(*KMS)
+
+// WithMount specifies the mount path of the transit engine. The default is
+// "transit".
+func WithMount(mount string) Option {
+	return func(k *KMS) {
+		k.mount = strings.Trim(mount, "/")
+	}
+}
+
+// WithNamespace specifies the Vault Enterprise namespace.
+func WithNamespace(ns string) Option {
+	return func(k *KMS) {
+		k.namespace = ns
+	}
+}
+
+// WithHTTPClient specifies the HTTP client to use, e.g. with custom TLS
+// settings. The default is http.DefaultClient.
+func WithHTTPClient(c *http.Client) Option {
+	return func(k *KMS) {
+		k.client = c
+	}
+}
+
+// WithRenewWindow specifies how long before it expires the token is renewed.
+// The default is 5 minutes.
+func WithRenewWindow(d time.Duration) Option {
+	return func(k *KMS) {
+		k.renewWindow = d
+	}
+}
+
+// KMS seals and unseals master keys with a key of the transit engine.
+type KMS struct {
+	addr        string
+	keyName     string
+	mount       string
+	namespace   string
+	client      *http.Client
+	renewWindow time.Duration
+
+	mu        sync.Mutex
+	token     string
+	looked    bool
+	renewable bool
+	expires   time.Time
+}
+
+// New returns a KMS that uses the transit key keyName of the Vault server at
+// addr, with token.
+func New(addr, token, keyName string, opts ...Option) *KMS {
+	k := &KMS{
+		addr:        strings.TrimRight(addr, "/"),
+		keyName:     keyName,
+		mount:       "transit",
+		client:      http.DefaultClient,
+		renewWindow: 5 * time.Minute,
+		token:       token,
+	}
+	for _, opt := range opts {
+		opt(k)
+	}
+	return k
+}
+
+// Encrypt encrypts plaintext with the transit key. The ciphertext is in
+// Vault's format, e.g. vault:v1:....
+func (k *KMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	req := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)}
+	if err := k.call(ctx, http.MethodPost, k.transitPath("encrypt"), req, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Data.Ciphertext == "" {
+		return nil, fmt.Errorf("vault: encrypt: no ciphertext")
+	}
+	return []byte(resp.Data.Ciphertext), nil
+}
+
+// Decrypt decrypts ciphertext that was returned by Encrypt.
+func (k *KMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	req := map[string]string{"ciphertext": string(ciphertext)}
+	if err := k.call(ctx, http.MethodPost, k.transitPath("decrypt"), req, &resp); err != nil {
+		return nil, err
+	}
+	b, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("vault: decrypt: %w", err)
+	}
+	return b, nil
+}
+
+// RenewToken renews the token. It is called automatically when the token is
+// about to expire.
+func (k *KMS) RenewToken(ctx context.Context) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.renewLocked(ctx)
+}
+
+func (k *KMS) transitPath(op string) string {
+	return "/v1/" + k.mount + "/" + op + "/" + url.PathEscape(k.keyName)
+}
+
+// call sends a request to Vault, after renewing the token if needed.
+func (k *KMS) call(ctx context.Context, method, path string, in, out any) error {
+	k.mu.Lock()
+	err := k.maybeRenewLocked(ctx)
+	token := k.token
+	k.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return k.do(ctx, token, method, path, in, out)
+}
+
+// maybeRenewLocked looks up the token the first time it is used, and renews
+// it when it is about to expire.
+func (k *KMS) maybeRenewLocked(ctx context.Context) error {
+	if !k.looked {
+		var resp struct {
+			Data struct {
+				TTL       int64 `json:"ttl"`
+				Renewable bool  `json:"renewable"`
+			} `json:"data"`
+		}
+		if err := k.do(ctx, k.token, http.MethodGet, "/v1/auth/token/lookup-self", nil, &resp); err != nil {
+			return err
+		}
+		k.looked = true
+		k.renewable = resp.Data.Renewable
+		k.expires = time.Time{}
+		if resp.Data.TTL > 0 {
+			k.expires = time.Now().Add(time.Duration(resp.Data.TTL) * time.Second)
+		}
+	}
+	if !k.renewable || k.expires.IsZero() || time.Until(k.expires) > k.renewWindow {
+		return nil
+	}
+	return k.renewLocked(ctx)
+}
+
+func (k *KMS) renewLocked(ctx context.Context) error {
+	var resp struct {
+		Auth struct {
+			LeaseDuration int64 `json:"lease_duration"`
+			Renewable     bool  `json:"renewable"`
+		} `json:"auth"`
+	}
+	if err := k.do(ctx, k.token, http.MethodPost, "/v1/auth/token/renew-self", map[string]string{}, &resp); err != nil {
+		return fmt.Errorf("token renewal: %w", err)
+	}
+	k.looked = true
+	k.renewable = resp.Auth.Renewable
+	k.expires = time.Time{}
+	if resp.Auth.LeaseDuration > 0 {
+		k.expires = time.Now().Add(time.Duration(resp.Auth.LeaseDuration) * time.Second)
+	}
+	return nil
+}
+
+// do sends a request to Vault and decodes the response.
+func (k *KMS) do(ctx context.Context, token, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, k.addr+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	req.Header.Set("X-Vault-Request", "true")
+	if k.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", k.namespace)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e := &Error{StatusCode: resp.StatusCode}
+		var r struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(b, &r) == nil {
+			e.Errors = r.Errors
+		}
+		return e
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("vault: %w", err)
+	}
+	return nil
+}
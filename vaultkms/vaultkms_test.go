@@ -0,0 +1,152 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vaultkms_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/c2FmZQ/storage/crypto"
+	"github.com/c2FmZQ/storage/vaultkms"
+)
+
+// fakeVault is a minimal transit engine. The "ciphertext" is the base64
+// plaintext with a prefix.
+type fakeVault struct {
+	mu      sync.Mutex
+	token   string
+	ttl     int
+	renewed int
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	reply := func(code int, body any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(body)
+	}
+	if r.Header.Get("X-Vault-Token") != v.token {
+		reply(http.StatusForbidden, map[string]any{"errors": []string{"permission denied"}})
+		return
+	}
+	var req map[string]string
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			reply(http.StatusBadRequest, map[string]any{"errors": []string{err.Error()}})
+			return
+		}
+	}
+	switch r.URL.Path {
+	case "/v1/auth/token/lookup-self":
+		reply(http.StatusOK, map[string]any{"data": map[string]any{"ttl": v.ttl, "renewable": true}})
+	case "/v1/auth/token/renew-self":
+		v.renewed++
+		v.ttl = 3600
+		reply(http.StatusOK, map[string]any{"auth": map[string]any{"lease_duration": v.ttl, "renewable": true}})
+	case "/v1/transit/encrypt/storage":
+		reply(http.StatusOK, map[string]any{"data": map[string]any{"ciphertext": "vault:v1:" + req["plaintext"]}})
+	case "/v1/transit/decrypt/storage":
+		pt, ok := strings.CutPrefix(req["ciphertext"], "vault:v1:")
+		if !ok {
+			reply(http.StatusBadRequest, map[string]any{"errors": []string{"invalid ciphertext"}})
+			return
+		}
+		reply(http.StatusOK, map[string]any{"data": map[string]any{"plaintext": pt}})
+	default:
+		reply(http.StatusNotFound, map[string]any{"errors": []string{}})
+	}
+}
+
+func TestSealUnseal(t *testing.T) {
+	fv := &fakeVault{token: "secret", ttl: 60}
+	srv := httptest.NewServer(fv)
+	defer srv.Close()
+	ctx := context.Background()
+
+	kms := vaultkms.New(srv.URL, "secret", "storage")
+	mk, err := crypto.CreateMasterKey()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := crypto.SaveWithKMS(ctx, mk, kms, keyFile); err != nil {
+		t.Fatalf("crypto.SaveWithKMS: %v", err)
+	}
+	if fv.renewed != 1 {
+		t.Errorf("Token renewed %d times, want 1", fv.renewed)
+	}
+	if _, err := crypto.ReadMasterKey([]byte("foo"), keyFile); err != crypto.ErrKMSKey {
+		t.Errorf("crypto.ReadMasterKey() = %v, want %v", err, crypto.ErrKMSKey)
+	}
+
+	got, err := crypto.ReadMasterKeyWithKMS(ctx, vaultkms.New(srv.URL, "secret", "storage"), keyFile)
+	if err != nil {
+		t.Fatalf("crypto.ReadMasterKeyWithKMS: %v", err)
+	}
+	defer got.Wipe()
+	if crypto.KeyID(got) != crypto.KeyID(mk) {
+		t.Error("crypto.ReadMasterKeyWithKMS returned a different key")
+	}
+	if fv.renewed != 1 {
+		t.Errorf("Token renewed %d times, want 1", fv.renewed)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	srv := httptest.NewServer(&fakeVault{token: "secret", ttl: 3600})
+	defer srv.Close()
+	ctx := context.Background()
+
+	_, err := vaultkms.New(srv.URL, "wrong", "storage").Encrypt(ctx, []byte("hello"))
+	var verr *vaultkms.Error
+	if !errors.As(err, &verr) || verr.StatusCode != http.StatusForbidden || len(verr.Errors) != 1 || verr.Errors[0] != "permission denied" {
+		t.Errorf("Encrypt() with wrong token = %#v", err)
+	}
+
+	kms := vaultkms.New(srv.URL, "secret", "storage")
+	if _, err := kms.Decrypt(ctx, []byte("garbage")); !errors.As(err, &verr) || verr.StatusCode != http.StatusBadRequest {
+		t.Errorf("Decrypt(garbage) = %v", err)
+	}
+	ct, err := kms.Encrypt(ctx, []byte("hello"))
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if want := "vault:v1:" + base64.StdEncoding.EncodeToString([]byte("hello")); string(ct) != want {
+		t.Errorf("Encrypt() = %q, want %q", ct, want)
+	}
+	if _, err := vaultkms.New(srv.URL, "secret", "other").Encrypt(ctx, []byte("hello")); !errors.As(err, &verr) || verr.StatusCode != http.StatusNotFound {
+		t.Errorf("Encrypt() with unknown key = %v", err)
+	}
+}
@@ -0,0 +1,19 @@
+module github.com/c2FmZQ/storage/webdav
+
+go 1.22
+
+require (
+	github.com/c2FmZQ/storage v0.0.0-20261015041833-c4dbad651a82
+	github.com/c2FmZQ/storage/aferofs v0.0.0-20261015041957-2d47be418313
+	golang.org/x/net v0.33.0
+)
+
+require (
+	github.com/c2FmZQ/tpm v0.4.0 // indirect
+	github.com/google/go-tpm v0.9.3 // indirect
+	github.com/spf13/afero v1.12.0 // indirect
+	golang.org/x/crypto v0.32.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
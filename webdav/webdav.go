@@ -0,0 +1,181 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package webdav serves the content of an encrypted storage over WebDAV.
+//
+// The files are decrypted when they are read, and encrypted when they are
+// written, see the aferofs package for the details. Blobs are streamed with
+// seekable readers, so that range requests don't decrypt more than needed.
+//
+// Example:
+//
+//	h := webdav.NewHandler(s,
+//		webdav.WithPrefix("/dav"),
+//		webdav.WithAuth(webdav.BasicAuth("Storage", checkPassword)),
+//	)
+//	http.Handle("/dav/", h)
+package webdav
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"os"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/aferofs"
+)
+
+// AuthFunc authenticates a request. It returns true if the request is
+// allowed to proceed. Otherwise, it must write the response, e.g. 401
+// Unauthorized.
+type AuthFunc func(w http.ResponseWriter, req *http.Request) bool
+
+// Option is used to specify optional parameters of the Handler.
+type Option func(*option)
+
+type option struct {
+	prefix   string
+	auth     AuthFunc
+	readOnly bool
+	logger   func(*http.Request, error)
+}
+
+// WithPrefix specifies the URL path prefix to strip from the resource paths.
+func WithPrefix(prefix string) Option {
+	return func(opt *option) {
+		opt.prefix = prefix
+	}
+}
+
+// WithAuth specifies the function that authenticates the requests. Without
+// it, all the requests are allowed.
+func WithAuth(fn AuthFunc) Option {
+	return func(opt *option) {
+		opt.auth = fn
+	}
+}
+
+// WithReadOnly specifies that the requests that would modify the storage
+// must be rejected.
+func WithReadOnly() Option {
+	return func(opt *option) {
+		opt.readOnly = true
+	}
+}
+
+// WithLogger specifies a function that is called after every request, with
+// the error, if any.
+func WithLogger(fn func(*http.Request, error)) Option {
+	return func(opt *option) {
+		opt.logger = fn
+	}
+}
+
+// BasicAuth returns an AuthFunc that uses HTTP basic authentication. check
+// returns true if the user and password are valid.
+func BasicAuth(realm string, check func(user, password string) bool) AuthFunc {
+	return func(w http.ResponseWriter, req *http.Request) bool {
+		if user, password, ok := req.BasicAuth(); ok && check(user, password) {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+}
+
+// StaticPassword returns a check function for BasicAuth that accepts a
+// single user and password.
+func StaticPassword(user, password string) func(string, string) bool {
+	return func(u, p string) bool {
+		uok := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+		pok := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+		return uok && pok
+	}
+}
+
+// NewHandler returns an http.Handler that serves s over WebDAV.
+func NewHandler(s *storage.Storage, opts ...Option) http.Handler {
+	var opt option
+	for _, o := range opts {
+		o(&opt)
+	}
+	return &handler{
+		opt: opt,
+		dav: &webdav.Handler{
+			Prefix:     opt.prefix,
+			FileSystem: &fileSystem{afs: aferofs.New(s)},
+			LockSystem: webdav.NewMemLS(),
+			Logger:     opt.logger,
+		},
+	}
+}
+
+type handler struct {
+	opt option
+	dav *webdav.Handler
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.opt.auth != nil && !h.opt.auth(w, req) {
+		return
+	}
+	if h.opt.readOnly {
+		switch req.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		default:
+			w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+	}
+	h.dav.ServeHTTP(w, req)
+}
+
+// fileSystem implements webdav.FileSystem with an aferofs.Fs.
+type fileSystem struct {
+	afs *aferofs.Fs
+}
+
+func (fsys *fileSystem) Mkdir(_ context.Context, name string, perm os.FileMode) error {
+	return fsys.afs.Mkdir(name, perm)
+}
+
+func (fsys *fileSystem) OpenFile(_ context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	return fsys.afs.OpenFile(name, flag, perm)
+}
+
+func (fsys *fileSystem) RemoveAll(_ context.Context, name string) error {
+	return fsys.afs.RemoveAll(name)
+}
+
+func (fsys *fileSystem) Rename(_ context.Context, oldName, newName string) error {
+	return fsys.afs.Rename(oldName, newName)
+}
+
+func (fsys *fileSystem) Stat(_ context.Context, name string) (os.FileInfo, error) {
+	return fsys.afs.Stat(name)
+}
@@ -0,0 +1,150 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package webdav_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/storage/internal/storagetest"
+	"github.com/c2FmZQ/storage/webdav"
+)
+
+func do(t *testing.T, method, url, body string, hdr ...string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("http.NewRequest: %v", err)
+	}
+	for i := 0; i+1 < len(hdr); i += 2 {
+		req.Header.Set(hdr[i], hdr[i+1])
+	}
+	req.SetBasicAuth("bob", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("io.ReadAll: %v", err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestHandler(t *testing.T) {
+	s := storagetest.New(t)
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	w, err := s.CreateBlob("blob")
+	if err != nil {
+		t.Fatalf("s.CreateBlob: %v", err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatalf("w.Write: %v", err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("w.Commit: %v", err)
+	}
+
+	h := webdav.NewHandler(s,
+		webdav.WithPrefix("/dav"),
+		webdav.WithLogger(func(r *http.Request, err error) {
+			if err != nil {
+				t.Logf("%s %s: %v", r.Method, r.URL, err)
+			}
+		}),
+		webdav.WithAuth(webdav.BasicAuth("test", webdav.StaticPassword("bob", "secret"))),
+	)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	url := srv.URL + "/dav"
+
+	if code, body := do(t, "GET", url+"/blob", "", "Range", "bytes=10005-10014"); code != http.StatusPartialContent || body != "5678901234" {
+		t.Errorf("GET blob = %d %q", code, body)
+	}
+	if code, _ := do(t, "MKCOL", url+"/dir", ""); code != http.StatusCreated {
+		t.Errorf("MKCOL = %d", code)
+	}
+	if code, _ := do(t, "PUT", url+"/dir/hello.txt", "Hello world"); code != http.StatusCreated {
+		t.Errorf("PUT = %d", code)
+	}
+	if code, body := do(t, "GET", url+"/dir/hello.txt", ""); code != http.StatusOK || body != "Hello world" {
+		t.Errorf("GET = %d %q", code, body)
+	}
+	if code, _ := do(t, "MOVE", url+"/dir/hello.txt", "", "Destination", url+"/hello.txt"); code != http.StatusCreated {
+		t.Errorf("MOVE = %d", code)
+	}
+	code, body := do(t, "PROPFIND", url+"/", "", "Depth", "1")
+	if code != http.StatusMultiStatus {
+		t.Errorf("PROPFIND = %d", code)
+	}
+	for _, want := range []string{"/dav/blob", "/dav/dir/", "/dav/hello.txt", "<D:getcontentlength>11</D:getcontentlength>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("PROPFIND response doesn't contain %q: %s", want, body)
+		}
+	}
+	if code, _ := do(t, "DELETE", url+"/dir", ""); code != http.StatusNoContent {
+		t.Errorf("DELETE = %d", code)
+	}
+	if code, _ := do(t, "GET", url+"/dir/hello.txt", ""); code != http.StatusNotFound {
+		t.Errorf("GET = %d", code)
+	}
+
+	req, err := http.NewRequest("GET", url+"/hello.txt", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest: %v", err)
+	}
+	req.SetBasicAuth("bob", "wrong")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("GET with wrong password = %d", resp.StatusCode)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	s := storagetest.New(t)
+	raw := []byte("data")
+	if err := s.SaveDataFile("file", &raw); err != nil {
+		t.Fatalf("s.SaveDataFile: %v", err)
+	}
+	srv := httptest.NewServer(webdav.NewHandler(s, webdav.WithReadOnly()))
+	defer srv.Close()
+
+	if code, body := do(t, "GET", srv.URL+"/file", ""); code != http.StatusOK || body != "data" {
+		t.Errorf("GET = %d %q", code, body)
+	}
+	for _, method := range []string{"PUT", "DELETE", "MKCOL", "PROPPATCH", "LOCK"} {
+		if code, _ := do(t, method, srv.URL+"/file", ""); code != http.StatusMethodNotAllowed {
+			t.Errorf("%s = %d, want %d", method, code, http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package winkms seals master keys with the Data Protection API (DPAPI) or
+// with a Windows Hello key, so that they can only be unsealed by the same
+// user, or on the same machine. It is analogous to the TPM option of the
+// crypto package, and implements crypto.KMS.
+//
+// DPAPI keys are managed by Windows. With ScopeUser, master keys can only be
+// unsealed by the same user, which is suitable for desktop apps. With
+// ScopeMachine, they can be unsealed by any process on the same machine,
+// which is suitable for services that run without a user profile.
+//
+// Windows Hello keys are RSA keys in the Microsoft Passport Key Storage
+// Provider. They are created the first time they are used, and are usually
+// backed by the TPM. Only decryption needs the private key, and user
+// verification (PIN, face or fingerprint). On other platforms, NewDPAPI and
+// NewHello return ErrNotSupported.
+//
+// Example:
+//
+//	kms, err := winkms.NewDPAPI(winkms.ScopeMachine)
+//	if err != nil {
+//		return err
+//	}
+//	defer kms.Close()
+//	mk, err := crypto.ReadMasterKeyWithKMS(ctx, kms, keyFile)
+package winkms
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+var _ crypto.KMS = (*KMS)(nil)
+
+var (
+	// ErrNotSupported is returned by NewDPAPI and NewHello on platforms
+	// other than Windows.
+	ErrNotSupported = errors.New("windows data protection is not supported on this platform")
+	// ErrClosed is returned after Close was called.
+	ErrClosed = errors.New("closed")
+)
+
+// Scope is the scope of DPAPI protection.
+type Scope int
+
+const (
+	// ScopeUser limits unsealing to the current user.
+	ScopeUser Scope = iota
+	// ScopeMachine allows unsealing by any user on the current machine.
+	ScopeMachine
+)
+
+// Option is used to specify optional parameters of NewDPAPI.
+type Option func(*options)
+
+type options struct {
+	entropy     []byte
+	description string
+}
+
+// WithEntropy specifies additional entropy that is required to unseal master
+// keys, e.g. an application secret. It is most useful with ScopeMachine,
+// since it stops other applications on the same machine from unsealing the
+// keys.
+func WithEntropy(entropy []byte) Option {
+	return func(o *options) {
+		o.entropy = append([]byte(nil), entropy...)
+	}
+}
+
+// WithDescription specifies the description that DPAPI stores in the sealed
+// data. It isn't secret.
+func WithDescription(desc string) Option {
+	return func(o *options) {
+		o.description = desc
+	}
+}
+
+// protector is implemented by the platform backends.
+type protector interface {
+	encrypt([]byte) ([]byte, error)
+	decrypt([]byte) ([]byte, error)
+	release()
+}
+
+// KMS seals and unseals master keys with DPAPI or a Windows Hello key.
+type KMS struct {
+	mu sync.Mutex
+	p  protector
+
+	// helloName is the name of the Windows Hello key, if any.
+	helloName string
+}
+
+// NewDPAPI returns a KMS that uses DPAPI with the given scope.
+func NewDPAPI(scope Scope, opts ...Option) (*KMS, error) {
+	if scope != ScopeUser && scope != ScopeMachine {
+		return nil, errors.New("invalid scope")
+	}
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	p, err := newDPAPI(scope, o)
+	if err != nil {
+		return nil, err
+	}
+	return &KMS{p: p}, nil
+}
+
+// NewHello returns a KMS that uses the Windows Hello key with the given
+// name. The key is created if it doesn't exist. Unsealing master keys
+// requires user verification.
+func NewHello(name string) (*KMS, error) {
+	if name == "" {
+		return nil, errors.New("empty key name")
+	}
+	p, err := openHelloKey(name)
+	if err != nil {
+		return nil, err
+	}
+	return &KMS{p: p, helloName: name}, nil
+}
+
+// Encrypt seals plaintext.
+func (k *KMS) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.p == nil {
+		return nil, ErrClosed
+	}
+	return k.p.encrypt(plaintext)
+}
+
+// Decrypt unseals ciphertext. With Windows Hello, it asks for user
+// verification.
+func (k *KMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.p == nil {
+		return nil, ErrClosed
+	}
+	return k.p.decrypt(ciphertext)
+}
+
+// Close releases the key. Windows Hello keys stay in the key storage
+// provider.
+func (k *KMS) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.p != nil {
+		k.p.release()
+		k.p = nil
+	}
+	return nil
+}
+
+// Delete closes the KMS and deletes the Windows Hello key. The master keys
+// that were sealed with it can no longer be unsealed. DPAPI keys are managed
+// by Windows and can't be deleted.
+func (k *KMS) Delete() error {
+	k.Close()
+	if k.helloName == "" {
+		return errors.New("only windows hello keys can be deleted")
+	}
+	return deleteHelloKey(k.helloName)
+}
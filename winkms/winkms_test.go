@@ -0,0 +1,109 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package winkms_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/c2FmZQ/storage/crypto"
+	"github.com/c2FmZQ/storage/winkms"
+)
+
+func TestNotSupported(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("supported on windows")
+	}
+	if _, err := winkms.NewDPAPI(winkms.ScopeUser); !errors.Is(err, winkms.ErrNotSupported) {
+		t.Errorf("NewDPAPI() = %v, want %v", err, winkms.ErrNotSupported)
+	}
+	if _, err := winkms.NewHello("test"); !errors.Is(err, winkms.ErrNotSupported) {
+		t.Errorf("NewHello() = %v, want %v", err, winkms.ErrNotSupported)
+	}
+}
+
+func TestDPAPI(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("windows only")
+	}
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name  string
+		scope winkms.Scope
+		opts  []winkms.Option
+	}{
+		{"User", winkms.ScopeUser, nil},
+		{"Machine", winkms.ScopeMachine, []winkms.Option{winkms.WithEntropy([]byte("foo")), winkms.WithDescription("test")}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			kms, err := winkms.NewDPAPI(tc.scope, tc.opts...)
+			if err != nil {
+				t.Fatalf("NewDPAPI: %v", err)
+			}
+			defer kms.Close()
+			testRoundTrip(t, ctx, kms)
+		})
+	}
+}
+
+// TestHello needs a user with Windows Hello, and asks for user verification.
+func TestHello(t *testing.T) {
+	if os.Getenv("WINKMS_HELLO_TEST") == "" {
+		t.Skip("WINKMS_HELLO_TEST is not set")
+	}
+	kms, err := winkms.NewHello("test")
+	if err != nil {
+		t.Fatalf("NewHello: %v", err)
+	}
+	defer kms.Delete()
+	testRoundTrip(t, context.Background(), kms)
+}
+
+func testRoundTrip(t *testing.T, ctx context.Context, kms *winkms.KMS) {
+	mk, err := crypto.CreateMasterKey()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	defer mk.Wipe()
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := crypto.SaveWithKMS(ctx, mk, kms, keyFile); err != nil {
+		t.Fatalf("crypto.SaveWithKMS: %v", err)
+	}
+	got, err := crypto.ReadMasterKeyWithKMS(ctx, kms, keyFile)
+	if err != nil {
+		t.Fatalf("crypto.ReadMasterKeyWithKMS: %v", err)
+	}
+	defer got.Wipe()
+	if crypto.KeyID(got) != crypto.KeyID(mk) {
+		t.Error("crypto.ReadMasterKeyWithKMS returned a different key")
+	}
+	kms.Close()
+	if _, err := kms.Decrypt(ctx, []byte("x")); err != winkms.ErrClosed {
+		t.Errorf("Decrypt() after Close = %v, want %v", err, winkms.ErrClosed)
+	}
+}
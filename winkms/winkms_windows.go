@@ -0,0 +1,266 @@
+// MIT License
+//
+// Copyright (c) 2021-2023 TTBT Enterprises LLC
+// Copyright (c) 2021-2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build windows
+
+package winkms
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// The name of the Windows Hello key storage provider.
+const helloProvider = "Microsoft Passport Key Storage Provider"
+
+const (
+	ncryptPadOAEPFlag      = 0x4
+	ncryptAllowDecryptFlag = 0x1
+	nteBadKeyset           = 0x80090016
+	nteNoKey               = 0x8009000D
+)
+
+var (
+	ncrypt = windows.NewLazySystemDLL("ncrypt.dll")
+
+	procNCryptOpenStorageProvider = ncrypt.NewProc("NCryptOpenStorageProvider")
+	procNCryptOpenKey             = ncrypt.NewProc("NCryptOpenKey")
+	procNCryptCreatePersistedKey  = ncrypt.NewProc("NCryptCreatePersistedKey")
+	procNCryptSetProperty         = ncrypt.NewProc("NCryptSetProperty")
+	procNCryptFinalizeKey         = ncrypt.NewProc("NCryptFinalizeKey")
+	procNCryptEncrypt             = ncrypt.NewProc("NCryptEncrypt")
+	procNCryptDecrypt             = ncrypt.NewProc("NCryptDecrypt")
+	procNCryptDeleteKey           = ncrypt.NewProc("NCryptDeleteKey")
+	procNCryptFreeObject          = ncrypt.NewProc("NCryptFreeObject")
+)
+
+type dpapi struct {
+	flags       uint32
+	entropy     []byte
+	description string
+}
+
+func newDPAPI(scope Scope, o options) (protector, error) {
+	p := &dpapi{
+		flags:       windows.CRYPTPROTECT_UI_FORBIDDEN,
+		entropy:     o.entropy,
+		description: o.description,
+	}
+	if scope == ScopeMachine {
+		p.flags |= windows.CRYPTPROTECT_LOCAL_MACHINE
+	}
+	return p, nil
+}
+
+func dataBlob(b []byte) *windows.DataBlob {
+	if len(b) == 0 {
+		return nil
+	}
+	return &windows.DataBlob{Size: uint32(len(b)), Data: &b[0]}
+}
+
+// takeBlob copies and frees a blob that was allocated by DPAPI.
+func takeBlob(b *windows.DataBlob) []byte {
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(b.Data)))
+	src := unsafe.Slice(b.Data, b.Size)
+	out := append([]byte(nil), src...)
+	clear(src)
+	return out
+}
+
+func (p *dpapi) encrypt(plaintext []byte) ([]byte, error) {
+	if len(plaintext) == 0 {
+		return nil, errors.New("empty plaintext")
+	}
+	var desc *uint16
+	if p.description != "" {
+		var err error
+		if desc, err = windows.UTF16PtrFromString(p.description); err != nil {
+			return nil, err
+		}
+	}
+	var out windows.DataBlob
+	if err := windows.CryptProtectData(dataBlob(plaintext), desc, dataBlob(p.entropy), 0, nil, p.flags, &out); err != nil {
+		return nil, fmt.Errorf("CryptProtectData: %w", err)
+	}
+	return takeBlob(&out), nil
+}
+
+func (p *dpapi) decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == 0 {
+		return nil, errors.New("empty ciphertext")
+	}
+	var out windows.DataBlob
+	if err := windows.CryptUnprotectData(dataBlob(ciphertext), nil, dataBlob(p.entropy), 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return nil, fmt.Errorf("CryptUnprotectData: %w", err)
+	}
+	return takeBlob(&out), nil
+}
+
+func (p *dpapi) release() {
+	clear(p.entropy)
+}
+
+func ncryptCall(proc *windows.LazyProc, args ...uintptr) error {
+	if err := proc.Find(); err != nil {
+		return ErrNotSupported
+	}
+	if r, _, _ := proc.Call(args...); r != 0 {
+		return fmt.Errorf("%s: %w", proc.Name, windows.Errno(r))
+	}
+	return nil
+}
+
+func utf16Ptr(s string) uintptr {
+	return uintptr(unsafe.Pointer(windows.StringToUTF16Ptr(s)))
+}
+
+// helloKeyName returns the name of the key in the Windows Hello key storage
+// provider, which is scoped to the current user.
+func helloKeyName(name string) (string, error) {
+	u, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return "", err
+	}
+	return u.User.Sid.String() + "//c2FmZQ-storage//" + name, nil
+}
+
+func openHelloProvider() (uintptr, error) {
+	var prov uintptr
+	if err := ncryptCall(procNCryptOpenStorageProvider, uintptr(unsafe.Pointer(&prov)), utf16Ptr(helloProvider), 0); err != nil {
+		return 0, err
+	}
+	return prov, nil
+}
+
+func isKeyNotFound(err error) bool {
+	var errno windows.Errno
+	return errors.As(err, &errno) && (errno == nteBadKeyset || errno == nteNoKey)
+}
+
+type helloKey struct {
+	prov uintptr
+	key  uintptr
+}
+
+func openHelloKey(name string) (protector, error) {
+	keyName, err := helloKeyName(name)
+	if err != nil {
+		return nil, err
+	}
+	prov, err := openHelloProvider()
+	if err != nil {
+		return nil, err
+	}
+	k := &helloKey{prov: prov}
+	err = ncryptCall(procNCryptOpenKey, prov, uintptr(unsafe.Pointer(&k.key)), utf16Ptr(keyName), 0, 0)
+	if isKeyNotFound(err) {
+		err = k.create(keyName)
+	}
+	if err != nil {
+		k.release()
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *helloKey) create(keyName string) error {
+	if err := ncryptCall(procNCryptCreatePersistedKey, k.prov, uintptr(unsafe.Pointer(&k.key)), utf16Ptr("RSA"), utf16Ptr(keyName), 0, 0); err != nil {
+		return err
+	}
+	length := uint32(2048)
+	if err := ncryptCall(procNCryptSetProperty, k.key, utf16Ptr("Length"), uintptr(unsafe.Pointer(&length)), 4, 0); err != nil {
+		return err
+	}
+	usage := uint32(ncryptAllowDecryptFlag)
+	if err := ncryptCall(procNCryptSetProperty, k.key, utf16Ptr("Key Usage"), uintptr(unsafe.Pointer(&usage)), 4, 0); err != nil {
+		return err
+	}
+	return ncryptCall(procNCryptFinalizeKey, k.key, 0)
+}
+
+// oaepPaddingInfo is BCRYPT_OAEP_PADDING_INFO.
+type oaepPaddingInfo struct {
+	algID     *uint16
+	label     *byte
+	labelSize uint32
+}
+
+// crypt calls NCryptEncrypt or NCryptDecrypt with OAEP padding, first to get
+// the size of the output, then to fill it.
+func (k *helloKey) crypt(proc *windows.LazyProc, in []byte) ([]byte, error) {
+	if len(in) == 0 {
+		return nil, errors.New("empty input")
+	}
+	pad := oaepPaddingInfo{algID: windows.StringToUTF16Ptr("SHA256")}
+	var size uint32
+	if err := ncryptCall(proc, k.key, uintptr(unsafe.Pointer(&in[0])), uintptr(len(in)), uintptr(unsafe.Pointer(&pad)), 0, 0, uintptr(unsafe.Pointer(&size)), ncryptPadOAEPFlag); err != nil {
+		return nil, err
+	}
+	out := make([]byte, size)
+	if err := ncryptCall(proc, k.key, uintptr(unsafe.Pointer(&in[0])), uintptr(len(in)), uintptr(unsafe.Pointer(&pad)), uintptr(unsafe.Pointer(&out[0])), uintptr(size), uintptr(unsafe.Pointer(&size)), ncryptPadOAEPFlag); err != nil {
+		clear(out)
+		return nil, err
+	}
+	return out[:size], nil
+}
+
+func (k *helloKey) encrypt(plaintext []byte) ([]byte, error) {
+	return k.crypt(procNCryptEncrypt, plaintext)
+}
+
+func (k *helloKey) decrypt(ciphertext []byte) ([]byte, error) {
+	return k.crypt(procNCryptDecrypt, ciphertext)
+}
+
+func (k *helloKey) release() {
+	if k.key != 0 {
+		procNCryptFreeObject.Call(k.key)
+		k.key = 0
+	}
+	if k.prov != 0 {
+		procNCryptFreeObject.Call(k.prov)
+		k.prov = 0
+	}
+}
+
+func deleteHelloKey(name string) error {
+	keyName, err := helloKeyName(name)
+	if err != nil {
+		return err
+	}
+	prov, err := openHelloProvider()
+	if err != nil {
+		return err
+	}
+	defer procNCryptFreeObject.Call(prov)
+	var key uintptr
+	if err := ncryptCall(procNCryptOpenKey, prov, uintptr(unsafe.Pointer(&key)), utf16Ptr(keyName), 0, 0); err != nil {
+		return err
+	}
+	// NCryptDeleteKey frees the key handle.
+	return ncryptCall(procNCryptDeleteKey, key, 0)
+}